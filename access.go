@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"gossh/internal/httpapi"
+)
+
+// accessCookieName holds an access token set by the /access landing
+// endpoint (or by a portal on the same site) until / exchanges it
+const accessCookieName = "gossh_access"
+
+// accessCookieMaxAge is how long a landing cookie stays valid, in seconds
+const accessCookieMaxAge = 60
+
+// handOffAccess exchanges an access token for a single-use connection ID and
+// redirects to a URL carrying only that ID, so the token never stays in the
+// address bar, browser history or Referer headers
+func handOffAccess(w http.ResponseWriter, r *http.Request, token string) {
+	creds, err := decryptAccessRequest(r, token)
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.InvalidToken, "Invalid access token")
+		requestLogger(r).Warn("Failed to decrypt access token", "err", err)
+		return
+	}
+
+	// Keep the decrypted credentials server-side; the page only gets
+	// an ID that /ws exchanges for them
+	connID, err := handoffs.put(creds)
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.Internal, "Failed to prepare connection")
+		requestLogger(r).Error("Failed to store handoff", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, basePath(r)+"/?conn="+url.QueryEscape(connID), http.StatusSeeOther)
+}
+
+// setAccessCookie stores token in a short-lived cookie, or clears it when
+// token is empty
+func setAccessCookie(w http.ResponseWriter, r *http.Request, token string) {
+	cookie := &http.Cookie{
+		Name:     accessCookieName,
+		Value:    token,
+		Path:     basePath(r) + "/",
+		MaxAge:   accessCookieMaxAge,
+		HttpOnly: true,
+		Secure:   tlsEnabled(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// accessLandingHandler accepts access tokens without putting them in a URL.
+// GET serves a bounce page that reads the token from the URL fragment
+// (/access#<token>), which browsers never send to the server, and POSTs it
+// to /. POST stores the "access" form field in a short-lived cookie and
+// redirects to /, for portals that submit tokens on the user's behalf.
+func accessLandingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		renderTemplate(w, r, "access.html", newPageData(r))
+
+	case "POST":
+		token := r.PostFormValue("access")
+		if token == "" {
+			responder.ErrorCode(w, r, httpapi.MissingParams, "Missing access token")
+			return
+		}
+		setAccessCookie(w, r, token)
+		http.Redirect(w, r, basePath(r)+"/", http.StatusSeeOther)
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
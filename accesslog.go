@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	basePathKey
+)
+
+// validRequestID limits which incoming X-Request-Id values are reused, so a
+// proxy's ID can be followed through without letting clients inject junk
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{8,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID assigned to r by withAccessLog
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger returns a logger carrying the request ID and client address
+func requestLogger(r *http.Request) *slog.Logger {
+	logger := slog.With("client_ip", clientIP(r))
+	if id := requestID(r); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	return logger
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+	onHijack func()
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades take over the connection
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+		w.status = http.StatusSwitchingProtocols
+		w.onHijack()
+	}
+	return conn, rw, err
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog logs every request and tags it with a request ID, returned
+// in X-Request-Id and carried by log lines written while handling it. A
+// WebSocket is logged when it is upgraded and again when it closes.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		started := time.Now()
+		logger := slog.With(
+			"request_id", id,
+			"method", r.Method,
+			"path", redactedRequestURI(r.URL),
+			"client_ip", clientIP(r),
+			"user_agent", r.UserAgent(),
+		)
+		lw := &accessLogWriter{ResponseWriter: w}
+		lw.onHijack = func() {
+			logger.Info("WebSocket upgraded", "status", http.StatusSwitchingProtocols)
+		}
+
+		next.ServeHTTP(lw, r)
+
+		if lw.hijacked {
+			logger.Info("WebSocket closed", "duration", time.Since(started))
+			return
+		}
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		logger.Info("HTTP request", "status", lw.status, "bytes", lw.bytes, "duration", time.Since(started))
+	})
+}
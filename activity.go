@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gossh/internal/sshbridge"
+)
+
+const (
+	defaultActivityMinBusy     = 30 * time.Second
+	defaultActivityQuiet       = 5 * time.Second
+	defaultActivityResumeAfter = 5 * time.Minute
+	// defaultActivityPrompt matches the end of the usual shell prompts: $,
+	// #, > or a % that isn't a percentage, and a space
+	defaultActivityPrompt = `(?:[$#>]|(?:^|\D)%) `
+	// activityTail is how much recent output prompts are matched against
+	activityTail = 256
+
+	defaultInactiveAfter       = 10 * time.Minute
+	defaultInactiveMinInterval = time.Minute
+)
+
+// ActivityConfig tells the page when a long command in a session finishes
+// or output comes back after a long silence, so it can notify a user who
+// has switched tabs. Off by default; it only timestamps the output and
+// keeps its last few hundred bytes, so it is cheap to leave on.
+type ActivityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// A command has finished when, having run for MinBusy or more since it
+	// was entered or its output began, its output stays at a prompt for
+	// Quiet
+	MinBusy time.Duration `yaml:"min_busy"`
+	Quiet   time.Duration `yaml:"quiet"`
+	// Prompt is a regular expression the output, without escape sequences,
+	// must end with, e.g. '\$ '
+	Prompt string `yaml:"prompt"`
+	// ResumeAfter is the silence after which new output, other than the
+	// echo of typing, is reported
+	ResumeAfter time.Duration `yaml:"resume_after"`
+}
+
+func (c *ActivityConfig) applyDefaults() {
+	if c.MinBusy <= 0 {
+		c.MinBusy = defaultActivityMinBusy
+	}
+	if c.Quiet <= 0 {
+		c.Quiet = defaultActivityQuiet
+	}
+	if c.Prompt == "" {
+		c.Prompt = defaultActivityPrompt
+	}
+	if c.ResumeAfter <= 0 {
+		c.ResumeAfter = defaultActivityResumeAfter
+	}
+}
+
+// parseActivityPrompt compiles session.activity.prompt to match the end of
+// the output
+func parseActivityPrompt(prompt string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?:" + prompt + `)\z`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prompt %q: %v", prompt, err)
+	}
+	return re, nil
+}
+
+// InactivityConfig tells the page when a session's output goes quiet and
+// when it comes back, so it can mark or dim idle terminals
+type InactivityConfig struct {
+	// Disabled sends no inactive and active events
+	Disabled bool `yaml:"disabled"`
+	// After is how long without output makes a session inactive
+	After time.Duration `yaml:"after"`
+	// MinInterval is the least time between two events of a session, so
+	// one whose output comes and goes doesn't flood the page
+	MinInterval time.Duration `yaml:"min_interval"`
+}
+
+func (c *InactivityConfig) applyDefaults() {
+	if c.After <= 0 {
+		c.After = defaultInactiveAfter
+	}
+	if c.MinInterval <= 0 {
+		c.MinInterval = defaultInactiveMinInterval
+	}
+}
+
+// terminalEscape matches the CSI and OSC sequences prompts are colored and
+// titled with
+var terminalEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// activityDetector is the heuristic behind activityMonitor, kept apart from
+// clocks and timers so recorded timelines can be replayed through it
+type activityDetector struct {
+	cfg    ActivityConfig
+	prompt *regexp.Regexp
+
+	// start is when the current command was entered or its output began,
+	// last when output was last seen and typed when the user last typed
+	start, last, typed time.Time
+	tail               []byte
+	// settled is set once the output has been quiet at a prompt for
+	// cfg.Quiet and judged, until more arrives
+	settled bool
+}
+
+func newActivityDetector(cfg ActivityConfig, prompt *regexp.Regexp) *activityDetector {
+	return &activityDetector{cfg: cfg, prompt: prompt, settled: true}
+}
+
+// output notes output seen at now, returning an output_resumed event when
+// it broke a long silence the user didn't end by typing
+func (d *activityDetector) output(now time.Time, data []byte) *sshbridge.ActivityMessage {
+	var ev *sshbridge.ActivityMessage
+	if idle := now.Sub(d.last); !d.last.IsZero() && idle >= d.cfg.ResumeAfter && !d.typed.After(d.last) {
+		ev = &sshbridge.ActivityMessage{Type: "activity", Event: "output_resumed", IdleSeconds: idle.Seconds()}
+	}
+	if d.settled {
+		d.start, d.settled = now, false
+	}
+	d.last = now
+	d.tail = append(d.tail, data...)
+	if len(d.tail) > activityTail {
+		d.tail = append(d.tail[:0], d.tail[len(d.tail)-activityTail:]...)
+	}
+	return ev
+}
+
+// input notes typing at now. Entering a line starts a command, which may
+// run a long while before printing anything.
+func (d *activityDetector) input(now time.Time, data string) {
+	d.typed = now
+	if strings.ContainsAny(data, "\r\n") {
+		d.start, d.settled = now, false
+	}
+}
+
+// check judges the output at now. It returns a command_finished event
+// once the output has stayed at a prompt for cfg.Quiet after a long
+// command, or, while the output may yet settle, how much longer to wait
+// before checking again.
+func (d *activityDetector) check(now time.Time) (*sshbridge.ActivityMessage, time.Duration) {
+	if d.settled || d.last.IsZero() {
+		return nil, 0
+	}
+	idle := now.Sub(d.last)
+	if idle < d.cfg.Quiet {
+		return nil, d.cfg.Quiet - idle
+	}
+	// Quiet output away from a prompt, such as a progress line, is a
+	// command still running
+	if !d.atPrompt() {
+		return nil, 0
+	}
+	d.settled = true
+	busy := d.last.Sub(d.start)
+	if busy < d.cfg.MinBusy {
+		return nil, 0
+	}
+	return &sshbridge.ActivityMessage{Type: "activity", Event: "command_finished", IdleSeconds: idle.Seconds(), BusySeconds: busy.Seconds()}, 0
+}
+
+// atPrompt reports whether the last line of output ends with a prompt
+func (d *activityDetector) atPrompt() bool {
+	tail := d.tail
+	if i := strings.LastIndexAny(string(tail), "\r\n"); i >= 0 {
+		tail = tail[i+1:]
+	}
+	return d.prompt.Match(terminalEscape.ReplaceAll(tail, nil))
+}
+
+// activityMonitor sends a session's page the events of its
+// activityDetector. A timer is only set while output may be settling, not
+// for every write. A nil monitor watches nothing.
+type activityMonitor struct {
+	out *wsWriter
+
+	mu       sync.Mutex
+	detector *activityDetector
+	timer    *time.Timer
+	stopped  bool
+}
+
+// newActivityMonitor returns the monitor of a session, or nil when
+// session.activity is off
+func newActivityMonitor(out *wsWriter) *activityMonitor {
+	cfg := currentConfig()
+	if !cfg.Session.Activity.Enabled {
+		return nil
+	}
+	return &activityMonitor{out: out, detector: newActivityDetector(cfg.Session.Activity, cfg.activityPrompt)}
+}
+
+// output notes output sent to the page
+func (m *activityMonitor) output(data []byte) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	ev := m.detector.output(time.Now(), data)
+	if m.timer == nil {
+		m.timer = time.AfterFunc(m.detector.cfg.Quiet, m.fire)
+	}
+	m.mu.Unlock()
+	if ev != nil {
+		m.out.WriteJSON(ev)
+	}
+}
+
+// input notes input from the user
+func (m *activityMonitor) input(data string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.detector.input(time.Now(), data)
+}
+
+// fire checks whether the output has settled, waiting longer if it hasn't
+func (m *activityMonitor) fire() {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	ev, wait := m.detector.check(time.Now())
+	m.timer = nil
+	if wait > 0 {
+		m.timer = time.AfterFunc(wait, m.fire)
+	}
+	m.mu.Unlock()
+	if ev != nil {
+		m.out.WriteJSON(ev)
+	}
+}
+
+// stop ends the monitor along with its session
+func (m *activityMonitor) stop() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
+
+// idleMonitor keeps when a session last printed, and tells its page when
+// the output has been quiet for session.inactivity.after and when it comes
+// back. One timer runs per quiet period, not one per write. A nil monitor
+// watches nothing.
+type idleMonitor struct {
+	out *wsWriter
+	cfg InactivityConfig
+	// lastOutput is when output was last sent, as UnixNano
+	lastOutput atomic.Int64
+	// inactive is the state the page was last told about; wake is set
+	// with it, for the next output to take
+	inactive, wake atomic.Bool
+
+	mu sync.Mutex
+	// sent is when the page was last told, quietSince when the output the
+	// inactive event was about ended
+	sent, quietSince time.Time
+	timer            *time.Timer
+	stopped          bool
+}
+
+// newIdleMonitor returns the monitor of a session started at now
+func newIdleMonitor(out *wsWriter, now time.Time) *idleMonitor {
+	m := &idleMonitor{out: out, cfg: currentConfig().Session.Inactivity}
+	m.lastOutput.Store(now.UnixNano())
+	if !m.cfg.Disabled {
+		m.timer = time.AfterFunc(m.cfg.After, m.fire)
+	}
+	return m
+}
+
+// output notes output sent to the page. It is called for every write,
+// with the writer's lock held, so the first output of an inactive session
+// has the page told in the background.
+func (m *idleMonitor) output(now time.Time) {
+	if m == nil {
+		return
+	}
+	m.lastOutput.Store(now.UnixNano())
+	if m.wake.CompareAndSwap(true, false) {
+		go m.evaluate()
+	}
+}
+
+// last returns when output was last sent
+func (m *idleMonitor) last() time.Time {
+	return time.Unix(0, m.lastOutput.Load())
+}
+
+// fire is the timer's look at the session
+func (m *idleMonitor) fire() {
+	m.mu.Lock()
+	m.timer = nil
+	m.mu.Unlock()
+	m.evaluate()
+}
+
+// evaluate tells the page when the session changed state, unless it was
+// told of the last change less than cfg.MinInterval ago, and sets the
+// timer to look again
+func (m *idleMonitor) evaluate() {
+	m.mu.Lock()
+	if m.stopped || m.cfg.Disabled {
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	last := m.last()
+	idle := now.Sub(last)
+	inactive := idle >= m.cfg.After
+	var ev *sshbridge.ActivityMessage
+	var wait time.Duration
+	if inactive != m.inactive.Load() {
+		if held := m.cfg.MinInterval - now.Sub(m.sent); !m.sent.IsZero() && held > 0 {
+			// Too soon after the last event: look again once it may be
+			// sent
+			wait = held
+		} else if inactive {
+			m.inactive.Store(true)
+			m.sent, m.quietSince = now, last
+			ev = &sshbridge.ActivityMessage{Type: "activity", Event: "inactive", IdleSeconds: idle.Seconds()}
+		} else {
+			m.inactive.Store(false)
+			m.sent = now
+			ev = &sshbridge.ActivityMessage{Type: "activity", Event: "active", IdleSeconds: now.Sub(m.quietSince).Seconds()}
+		}
+	}
+	// An active session is looked at again when it would become inactive;
+	// an inactive one is woken by output
+	if wait == 0 && !m.inactive.Load() {
+		wait = m.cfg.After - idle
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if wait > 0 {
+		m.timer = time.AfterFunc(wait, m.fire)
+	} else {
+		m.wake.Store(true)
+	}
+	m.mu.Unlock()
+	if ev != nil {
+		m.out.WriteJSON(ev)
+	}
+}
+
+// stop ends the monitor along with its session
+func (m *idleMonitor) stop() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
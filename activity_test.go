@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gossh/internal/sshbridge"
+)
+
+// activityEntry is a moment of a recorded session: output from the host
+// or input from the user, at an offset from the start
+type activityEntry struct {
+	at            time.Duration
+	output, input string
+}
+
+// lines returns output every interval from start up to end, as a command
+// printing steadily would
+func lines(start, end, interval time.Duration, text string) []activityEntry {
+	var entries []activityEntry
+	for at := start; at < end; at += interval {
+		entries = append(entries, activityEntry{at: at, output: text})
+	}
+	return entries
+}
+
+// replayActivity runs a timeline through an activityDetector, checking it
+// when activityMonitor's timer would, until end. It returns the events as
+// "event idle busy" in seconds.
+func replayActivity(t *testing.T, cfg ActivityConfig, timeline []activityEntry, end time.Duration) []string {
+	t.Helper()
+	cfg.applyDefaults()
+	prompt, err := parseActivityPrompt(cfg.Prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newActivityDetector(cfg, prompt)
+	start := time.Date(2026, 10, 7, 9, 0, 0, 0, time.UTC)
+	var events []string
+	record := func(ev *sshbridge.ActivityMessage) {
+		if ev != nil {
+			events = append(events, fmt.Sprintf("%s %g %g", ev.Event, ev.IdleSeconds, ev.BusySeconds))
+		}
+	}
+	timer := time.Duration(-1)
+	runTimer := func(until time.Duration) {
+		for timer >= 0 && timer <= until {
+			ev, wait := d.check(start.Add(timer))
+			record(ev)
+			if wait > 0 {
+				timer += wait
+			} else {
+				timer = -1
+			}
+		}
+	}
+	for _, e := range timeline {
+		runTimer(e.at)
+		now := start.Add(e.at)
+		if e.input != "" {
+			d.input(now, e.input)
+		}
+		if e.output != "" {
+			record(d.output(now, []byte(e.output)))
+			if timer < 0 {
+				timer = e.at + cfg.Quiet
+			}
+		}
+	}
+	runTimer(end)
+	return events
+}
+
+func TestActivityTimelines(t *testing.T) {
+	const prompt = "alice@build01:~/src$ "
+	colorPrompt := "\x1b]0;alice@build01: ~/src\x07\x1b[01;32malice@build01\x1b[00m:\x1b[01;34m~/src\x1b[00m$ "
+	sec := time.Second
+	join := func(parts ...[]activityEntry) []activityEntry {
+		var all []activityEntry
+		for _, p := range parts {
+			all = append(all, p...)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name     string
+		cfg      ActivityConfig
+		timeline []activityEntry
+		end      time.Duration
+		want     []string
+	}{
+		{"long build", ActivityConfig{}, join(
+			[]activityEntry{{at: 0, input: "make\r", output: "make\r\n"}},
+			lines(sec, 40*sec, sec, "cc -c module.c\r\n"),
+			[]activityEntry{{at: 40 * sec, output: "Build finished\r\n" + prompt}},
+		), time.Minute, []string{"command_finished 5 40"}},
+
+		{"short command", ActivityConfig{}, []activityEntry{
+			{at: 0, input: "ls\r", output: "ls\r\n"},
+			{at: 100 * time.Millisecond, output: "Makefile  module.c\r\n" + prompt},
+		}, time.Minute, nil},
+
+		{"silent command", ActivityConfig{}, []activityEntry{
+			{at: 0, input: "sleep 90\r", output: "sleep 90\r\n"},
+			{at: 90 * sec, output: prompt},
+		}, 2 * time.Minute, []string{"command_finished 5 90"}},
+
+		{"colored prompt with a title", ActivityConfig{}, []activityEntry{
+			{at: 0, input: "./test.sh\r", output: "./test.sh\r\n"},
+			{at: 45 * sec, output: "PASS\r\n" + colorPrompt},
+		}, time.Minute, []string{"command_finished 5 45"}},
+
+		// A progress line that stops updating is not a prompt, even with
+		// a percentage in it
+		{"stalled progress", ActivityConfig{}, []activityEntry{
+			{at: 0, input: "apt upgrade\r", output: "apt upgrade\r\n"},
+			{at: sec, output: "\rProgress: [ 45%] "},
+			{at: 2 * time.Minute, output: "\rProgress: [100%] \r\n" + prompt},
+		}, 3 * time.Minute, []string{"command_finished 5 120"}},
+
+		// Typing and its echo at a prompt finish nothing
+		{"typing at a prompt", ActivityConfig{}, []activityEntry{
+			{at: 0, output: prompt},
+			{at: 10 * sec, input: "g", output: "g"},
+			{at: 11 * sec, input: "i", output: "i"},
+			{at: 12 * sec, input: "\x7f\x7f", output: "\b\b  \b\b"},
+		}, time.Minute, nil},
+
+		// A full-screen program is never at a prompt
+		{"editor", ActivityConfig{}, join(
+			[]activityEntry{{at: 0, input: "vim notes\r", output: "vim notes\r\n"}},
+			lines(sec, 60*sec, 10*sec, "\x1b[H\x1b[2J~\r\n~\r\n\x1b[24;1H\"notes\" 12L"),
+		), 2 * time.Minute, nil},
+
+		{"thresholds from the config", ActivityConfig{MinBusy: 10 * sec, Quiet: 2 * sec, Prompt: `\$ `}, []activityEntry{
+			{at: 0, input: "make\r", output: "make\r\n"},
+			{at: 12 * sec, output: "done\r\n$ "},
+			{at: 20 * sec, input: "make test\r", output: "make test\r\n"},
+			{at: 25 * sec, output: "ok\r\n$ "},
+		}, time.Minute, []string{"command_finished 2 12"}},
+
+		{"output after a long silence", ActivityConfig{}, []activityEntry{
+			{at: 0, input: "tail -f app.log\r", output: "tail -f app.log\r\n"},
+			{at: sec, output: "started\r\n"},
+			{at: 10*time.Minute + sec, output: "ERROR: disk full\r\n"},
+		}, 11 * time.Minute, []string{"output_resumed 600 0"}},
+
+		{"silence broken by typing", ActivityConfig{}, []activityEntry{
+			{at: 0, output: prompt},
+			{at: 10 * time.Minute, input: "l", output: "l"},
+		}, 11 * time.Minute, nil},
+
+		{"output sooner than resume_after", ActivityConfig{ResumeAfter: time.Hour}, []activityEntry{
+			{at: 0, input: "tail -f app.log\r", output: "tail -f app.log\r\n"},
+			{at: 30 * time.Minute, output: "ERROR: disk full\r\n"},
+		}, time.Hour, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := replayActivity(t, tt.cfg, tt.timeline, tt.end)
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActivityPromptMatching(t *testing.T) {
+	prompt, err := parseActivityPrompt(defaultActivityPrompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"alice@build01:~$ ", true},
+		{"root@db01:/# ", true},
+		{"PS C:\\Users\\alice> ", true},
+		{"alice@mac ~ % ", true},
+		{"\x1b[1;31mroot\x1b[0m# ", true},
+		{"Downloading 45% ", false},
+		{"alice@build01:~$ ls\r\n", false},
+		{"building...", false},
+	}
+	for _, tt := range tests {
+		d := newActivityDetector(ActivityConfig{}, prompt)
+		d.output(time.Now(), []byte(tt.output))
+		if got := d.atPrompt(); got != tt.want {
+			t.Errorf("%q at a prompt: %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// clientAllowlist restricts which client addresses may use the service
+type clientAllowlist struct {
+	allowed    []*net.IPNet
+	exceptions map[string][]*net.IPNet // path -> additionally allowed networks
+
+	mu         sync.Mutex
+	lastLogged map[string]time.Time
+}
+
+// parseCIDRs parses a list of CIDRs; bare IP addresses are treated as /32 or /128
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			v = fmt.Sprintf("%s/%d", v, bits)
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newClientAllowlist builds the allowlist from config. It returns nil when
+// no allowlist is configured.
+func newClientAllowlist(cidrs []string, exceptions map[string][]string) (*clientAllowlist, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+
+	allowed, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &clientAllowlist{
+		allowed:    allowed,
+		exceptions: make(map[string][]*net.IPNet),
+		lastLogged: make(map[string]time.Time),
+	}
+	for path, values := range exceptions {
+		nets, err := parseCIDRs(values)
+		if err != nil {
+			return nil, fmt.Errorf("exception for %s: %v", path, err)
+		}
+		a.exceptions[path] = nets
+	}
+	return a, nil
+}
+
+func (a *clientAllowlist) allows(ip net.IP, path string) bool {
+	if ip == nil {
+		return false
+	}
+	return containsIP(a.allowed, ip) || containsIP(a.exceptions[path], ip)
+}
+
+// logDenied logs a denied client at most once per minute per address
+func (a *clientAllowlist) logDenied(ip, path string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(a.lastLogged[ip]) < time.Minute {
+		return
+	}
+	if len(a.lastLogged) >= 10000 {
+		a.lastLogged = make(map[string]time.Time)
+	}
+	a.lastLogged[ip] = now
+	slog.Warn("Denied request: client address not in allowed_client_cidrs", "client_ip", ip, "path", path)
+}
+
+// withClientAllowlist rejects clients outside server.allowed_client_cidrs
+// before any handler runs, including static files and WebSocket upgrades
+func withClientAllowlist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowlist := currentConfig().allowlist
+		if allowlist == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if !allowlist.allows(net.ParseIP(ip), r.URL.Path) {
+			allowlist.logDenied(ip, r.URL.Path)
+			responder.ErrorCode(w, r, httpapi.Forbidden, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
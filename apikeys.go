@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// API key scopes
+const (
+	scopeUpload   = "upload"
+	scopeDownload = "download"
+	scopeExec     = "exec"
+	scopeTerminal = "terminal" // sessions through the gRPC API, joining shared ones
+	scopeProfiles = "profiles"
+	scopeAdmin    = "admin"
+)
+
+var validScopes = map[string]bool{
+	scopeUpload:   true,
+	scopeDownload: true,
+	scopeExec:     true,
+	scopeTerminal: true,
+	scopeProfiles: true,
+	scopeAdmin:    true,
+}
+
+// APIKeyConfig describes a static API key declared in config.yaml.
+// Only the SHA-256 hash of the key is stored.
+type APIKeyConfig struct {
+	Name      string   `yaml:"name"`
+	Hash      string   `yaml:"hash"`
+	Scopes    []string `yaml:"scopes"`
+	RateLimit float64  `yaml:"rate_limit"` // requests per minute, 0 = unlimited
+	Burst     int      `yaml:"burst"`
+	QuotaMB   int64    `yaml:"quota_mb"` // transfer quota, 0 = quotas.api_key_mb
+}
+
+type apiKey struct {
+	Name    string
+	Hash    []byte
+	Scopes  []string
+	Minted  bool
+	Created time.Time
+	QuotaMB int64
+	limiter *tokenBucket
+}
+
+// hasScope reports whether the key grants the given scope.
+// A key without any scopes grants everything except admin.
+func (k *apiKey) hasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return scope != scopeAdmin
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyContextKey struct{}
+
+var (
+	apiKeysMu sync.RWMutex
+	apiKeys   []*apiKey
+)
+
+func newAPIKey(name string, hash []byte, scopes []string, rateLimit float64, burst int, quotaMB int64) (*apiKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("api key name is required")
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("api key %q: hash must be a hex-encoded SHA-256 digest", name)
+	}
+	for _, s := range scopes {
+		if !validScopes[s] {
+			return nil, fmt.Errorf("api key %q: unknown scope %q", name, s)
+		}
+	}
+	if quotaMB < 0 {
+		return nil, fmt.Errorf("api key %q: quota_mb can't be negative", name)
+	}
+
+	key := &apiKey{
+		Name:    name,
+		Hash:    hash,
+		Scopes:  scopes,
+		Created: time.Now(),
+		QuotaMB: quotaMB,
+	}
+	if rateLimit > 0 {
+		if burst <= 0 {
+			burst = 1
+		}
+		key.limiter = newTokenBucket(rateLimit/60, burst)
+	}
+	return key, nil
+}
+
+// parseAPIKeys builds the API keys declared in config
+func parseAPIKeys(configs []APIKeyConfig) ([]*apiKey, error) {
+	var keys []*apiKey
+	seen := make(map[string]bool)
+
+	for _, c := range configs {
+		hash, err := hex.DecodeString(strings.TrimPrefix(c.Hash, "sha256:"))
+		if err != nil {
+			return nil, fmt.Errorf("api key %q: invalid hash: %v", c.Name, err)
+		}
+		key, err := newAPIKey(c.Name, hash, c.Scopes, c.RateLimit, c.Burst, c.QuotaMB)
+		if err != nil {
+			return nil, err
+		}
+		if seen[key.Name] {
+			return nil, fmt.Errorf("duplicate api key name %q", key.Name)
+		}
+		seen[key.Name] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// installAPIKeys replaces the configured (non-minted) API keys. A key
+// whose name and hash are unchanged keeps what it has used of its rate
+// limit, so a reload doesn't refill every bucket.
+func installAPIKeys(keys []*apiKey) {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		seen[k.Name] = true
+	}
+
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+
+	old := make(map[string]*apiKey, len(apiKeys))
+	for _, k := range apiKeys {
+		old[k.Name] = k
+	}
+	for _, k := range keys {
+		if prev := old[k.Name]; prev != nil && bytes.Equal(prev.Hash, k.Hash) && prev.limiter != nil && k.limiter != nil {
+			k.limiter.carryOver(prev.limiter)
+		}
+	}
+
+	// Keep keys minted at runtime
+	for _, k := range apiKeys {
+		if k.Minted && !seen[k.Name] {
+			keys = append(keys, k)
+		}
+	}
+	apiKeys = keys
+}
+
+// lookupAPIKey finds the key matching the presented secret. Every configured
+// hash is compared in constant time so the lookup doesn't leak which key matched.
+func lookupAPIKey(secret string) *apiKey {
+	sum := sha256.Sum256([]byte(secret))
+
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+
+	var found *apiKey
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare(sum[:], k.Hash) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// apiKeyFromContext returns the API key that authenticated the request, if any
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return key
+}
+
+// apiKeyAuth validates an optional Bearer API key and checks it grants scope.
+// Requests without a key pass through unless api.require_key is set;
+// admin endpoints always require a key.
+func apiKeyAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return keyAuth(scope, false, next)
+}
+
+// apiKeyRequired is apiKeyAuth for endpoints that need a key whatever
+// api.require_key says
+func apiKeyRequired(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return keyAuth(scope, true, next)
+}
+
+func keyAuth(scope string, required bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := bearerToken(r)
+		if secret == "" {
+			if required || currentConfig().API.RequireKey || scope == scopeAdmin {
+				responder.ErrorCode(w, r, httpapi.APIKeyRequired, "API key required")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		key := lookupAPIKey(secret)
+		if key == nil {
+			requestLogger(r).Warn("Rejected invalid API key", "path", r.URL.Path)
+			responder.ErrorCode(w, r, httpapi.InvalidAPIKey, "Invalid API key")
+			return
+		}
+
+		if !key.hasScope(scope) {
+			requestLogger(r).Warn("API key denied: missing scope", "api_key", key.Name, "scope", scope, "path", r.URL.Path)
+			responder.ErrorCode(w, r, httpapi.Forbidden, fmt.Sprintf("API key lacks the %q scope", scope))
+			return
+		}
+
+		if key.limiter != nil {
+			if ok, wait := key.limiter.take(); !ok {
+				requestLogger(r).Debug("API key rate limited", "api_key", key.Name)
+				responder.Error(w, r, &RateLimitedError{RetryAfter: wait}, httpapi.RateLimited)
+				return
+			}
+		}
+
+		next(w, withAPIKey(r, key))
+	}
+}
+
+// withAPIKey records the use of key and returns r authenticated by it
+func withAPIKey(r *http.Request, key *apiKey) *http.Request {
+	requestLogger(r).Info("API key used", "api_key", key.Name, "method", r.Method, "path", r.URL.Path)
+	audit.Emit(AuditEvent{
+		Event:     auditTokenUse,
+		Outcome:   outcomeSuccess,
+		ClientIP:  clientIP(r),
+		User:      key.Name,
+		TokenType: "api_key",
+		Target:    r.URL.Path,
+	})
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+// mintAPIKey generates a new random key and registers it for the lifetime of the process
+func mintAPIKey(name string, scopes []string, rateLimit float64, burst int, quotaMB int64) (string, *apiKey, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	secret := "gossh_" + base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(secret))
+
+	key, err := newAPIKey(name, sum[:], scopes, rateLimit, burst, quotaMB)
+	if err != nil {
+		return "", nil, err
+	}
+	key.Minted = true
+
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+	for _, k := range apiKeys {
+		if k.Name == name {
+			return "", nil, fmt.Errorf("api key %q already exists", name)
+		}
+	}
+	apiKeys = append(apiKeys, key)
+
+	return secret, key, nil
+}
+
+// revokeAPIKey removes a minted key. Keys declared in config can only be
+// removed by editing the config.
+func revokeAPIKey(name string) error {
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+
+	for i, k := range apiKeys {
+		if k.Name != name {
+			continue
+		}
+		if !k.Minted {
+			return fmt.Errorf("api key %q is defined in config and cannot be revoked at runtime", name)
+		}
+		apiKeys = append(apiKeys[:i], apiKeys[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("api key %q not found", name)
+}
+
+// adminKeysHandler lists, mints and revokes API keys
+func adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	admin := apiKeyFromContext(r.Context())
+
+	switch r.Method {
+	case "GET":
+		apiKeysMu.RLock()
+		keys := make([]map[string]interface{}, 0, len(apiKeys))
+		for _, k := range apiKeys {
+			keys = append(keys, map[string]interface{}{
+				"name":     k.Name,
+				"scopes":   k.Scopes,
+				"minted":   k.Minted,
+				"created":  k.Created,
+				"quota_mb": k.QuotaMB,
+			})
+		}
+		apiKeysMu.RUnlock()
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+			"keys":    keys,
+		})
+
+	case "POST":
+		var req struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			RateLimit float64  `json:"rate_limit"`
+			Burst     int      `json:"burst"`
+			QuotaMB   int64    `json:"quota_mb"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid request body")
+			return
+		}
+
+		secret, key, err := mintAPIKey(req.Name, req.Scopes, req.RateLimit, req.Burst, req.QuotaMB)
+		if err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+
+		requestLogger(r).Info("API key minted", "api_key", key.Name, "admin", admin.Name, "scopes", key.Scopes)
+		audit.Emit(AuditEvent{
+			Event:     auditTokenCreate,
+			Outcome:   outcomeSuccess,
+			ClientIP:  clientIP(r),
+			User:      admin.Name,
+			TokenType: "api_key",
+			Target:    key.Name,
+		})
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+			"name":    key.Name,
+			"key":     secret,
+			"hash":    hex.EncodeToString(key.Hash),
+			"scopes":  key.Scopes,
+		})
+
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if err := revokeAPIKey(name); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+
+		requestLogger(r).Info("API key revoked", "api_key", name, "admin", admin.Name)
+		audit.Emit(AuditEvent{
+			Event:    auditAdminAction,
+			Outcome:  outcomeSuccess,
+			ClientIP: clientIP(r),
+			User:     admin.Name,
+			Action:   "api_key_revoke",
+			Target:   name,
+		})
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+		})
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// tokenBucket is a simple thread-safe token bucket rate limiter
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// carryOver starts b with the tokens old had left, up to b's burst
+func (b *tokenBucket) carryOver(old *tokenBucket) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	b.tokens, b.last = min(old.tokens, b.burst), old.last
+}
+
+// Allow consumes a token if one is available
+func (b *tokenBucket) Allow() bool {
+	ok, _ := b.take()
+	return ok
+}
+
+// take consumes a token if one is available, and otherwise reports how
+// long until the next one
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAPIKeyRateLimitSetsRetryAfter(t *testing.T) {
+	useConfig(t, "")
+	secret, _, err := mintAPIKey("ci", []string{scopeDownload}, 1, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := apiKeyAuth(scopeDownload, func(w http.ResponseWriter, r *http.Request) {})
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/download", nil)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	w := get()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if s, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || s < 1 || s > 61 {
+		t.Errorf("Retry-After %q, want the seconds until the next request is allowed", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestAPIKeyRateLimitSurvivesReload(t *testing.T) {
+	useConfig(t, "")
+	reload := func(secret string, burst int) {
+		t.Helper()
+		sum := sha256.Sum256([]byte(secret))
+		keys, err := parseAPIKeys([]APIKeyConfig{{Name: "ci", Hash: hex.EncodeToString(sum[:]), RateLimit: 1, Burst: burst}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		installAPIKeys(keys)
+	}
+	handler := apiKeyAuth(scopeDownload, func(w http.ResponseWriter, r *http.Request) {})
+	get := func(secret string) int {
+		r := httptest.NewRequest("GET", "/download", nil)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	reload("old-secret", 2)
+	for i := range 2 {
+		if code := get("old-secret"); code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, code)
+		}
+	}
+	// Reloading the same key, even with a bigger burst, hands out no tokens
+	reload("old-secret", 2)
+	if code := get("old-secret"); code != http.StatusTooManyRequests {
+		t.Errorf("after a reload: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	reload("old-secret", 5)
+	if code := get("old-secret"); code != http.StatusTooManyRequests {
+		t.Errorf("after raising the burst: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// A rotated key starts afresh
+	reload("new-secret", 2)
+	if code := get("new-secret"); code != http.StatusOK {
+		t.Errorf("rotated key: status %d, want %d", code, http.StatusOK)
+	}
+}
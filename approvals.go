@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+const (
+	defaultApprovalTimeout = 10 * time.Minute
+	// approvalRetention is how long decided requests stay listed
+	approvalRetention = 24 * time.Hour
+	// approvalPing is how often a waiting page is checked for
+	approvalPing = 5 * time.Second
+)
+
+// Approval request states
+const (
+	approvalPending   = "pending"
+	approvalApproved  = "approved"
+	approvalDenied    = "denied"
+	approvalExpired   = "expired"
+	approvalCancelled = "cancelled"
+)
+
+// ApprovalsConfig configures the approval of terminal sessions to hosts
+// whose policy sets require_approval
+type ApprovalsConfig struct {
+	// Timeout is how long a request waits for a decision
+	Timeout time.Duration `yaml:"timeout"`
+	// WebhookURL receives each new request as a JSON POST
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+func (c *ApprovalsConfig) applyDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultApprovalTimeout
+	}
+}
+
+func validateApprovalsConfig(c ApprovalsConfig) error {
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || u.Host == "" {
+			return fmt.Errorf("webhook_url %q is not a valid URL", c.WebhookURL)
+		}
+	}
+	return nil
+}
+
+// approvalRequest is a terminal session waiting for, or given, an admin's
+// decision
+type approvalRequest struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Requester   string     `json:"requester"`
+	ClientIP    string     `json:"client_ip"`
+	Host        string     `json:"host"`
+	SSHUser     string     `json:"ssh_user,omitempty"`
+	Policy      string     `json:"policy"`
+	Created     time.Time  `json:"created"`
+	Expires     time.Time  `json:"expires"`
+	Decided     *time.Time `json:"decided,omitempty"`
+	Approver    string     `json:"approver,omitempty"`
+	ApproverKey string     `json:"approver_key,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+
+	// decided is closed once Status leaves pending
+	decided chan struct{}
+}
+
+// approvalRegistry holds the pending requests and recently decided ones.
+// Requests only live in memory; a restart drops the pages waiting on them.
+type approvalRegistry struct {
+	mu       sync.Mutex
+	requests map[string]*approvalRequest
+}
+
+var approvals = &approvalRegistry{requests: map[string]*approvalRequest{}}
+
+// create opens a pending request
+func (reg *approvalRegistry) create(req *approvalRequest) error {
+	id, err := randomID(8)
+	if err != nil {
+		return err
+	}
+	req.ID, req.Status, req.decided = id, approvalPending, make(chan struct{})
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.prune(req.Created)
+	reg.requests[id] = req
+	return nil
+}
+
+// prune forgets requests decided over approvalRetention ago. The caller
+// holds mu.
+func (reg *approvalRegistry) prune(now time.Time) {
+	for id, req := range reg.requests {
+		if req.Decided != nil && now.Sub(*req.Decided) > approvalRetention {
+			delete(reg.requests, id)
+		}
+	}
+}
+
+// decide moves a pending request to status, reporting whether it was
+// still pending
+func (reg *approvalRegistry) decide(req *approvalRequest, status, approver, approverKey, comment string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if req.Status != approvalPending {
+		return false
+	}
+	now := time.Now()
+	req.Status, req.Decided, req.Approver, req.ApproverKey, req.Comment = status, &now, approver, approverKey, comment
+	close(req.decided)
+	return true
+}
+
+// snapshot returns a copy of a request, safe to encode
+func (reg *approvalRegistry) snapshot(req *approvalRequest) approvalRequest {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return *req
+}
+
+func (reg *approvalRegistry) get(id string) (*approvalRequest, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	req, ok := reg.requests[id]
+	return req, ok
+}
+
+// list returns the requests with status, all of them for "", newest first
+func (reg *approvalRegistry) list(status string) []approvalRequest {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.prune(time.Now())
+	list := []approvalRequest{}
+	for _, req := range reg.requests {
+		if status == "" || req.Status == status {
+			list = append(list, *req)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list
+}
+
+// approvalPolicy returns the first policy of host that requires approval
+func approvalPolicy(host string) *HostPolicy {
+	for _, p := range hostPolicies(&currentConfig().Authz, host) {
+		if p.RequireApproval {
+			return p
+		}
+	}
+	return nil
+}
+
+// emitApproval audits a step of a request, naming both the requester and
+// the approver
+func emitApproval(req approvalRequest, outcome string) {
+	audit.Emit(AuditEvent{
+		Event:    auditApproval,
+		Outcome:  outcome,
+		ClientIP: req.ClientIP,
+		User:     req.Requester,
+		Approver: req.Approver,
+		Host:     hostname(req.Host),
+		SSHUser:  req.SSHUser,
+		Action:   req.Status,
+		Target:   req.ID,
+		Rule:     "host_policies/" + req.Policy,
+		Error:    req.Comment,
+	})
+}
+
+// awaitApproval holds a terminal connection to a host of policy until an
+// admin approves it, returning nil, or denies it, it expires or the page
+// goes away, returning why
+func awaitApproval(conn sshbridge.Conn, r *http.Request, host, sshUser string, policy *HostPolicy) error {
+	log := requestLogger(r)
+	// The approver must differ from the person, not just their API key,
+	// so an API key's name never stands in for the requester
+	id, err := participantIdentity(r)
+	if err != nil {
+		return fmt.Errorf("%s requires approval, which %v", hostname(host), err)
+	}
+	cfg := currentConfig().Approvals
+	now := time.Now()
+	req := &approvalRequest{
+		Requester: id.User,
+		ClientIP:  clientIP(r),
+		Host:      host,
+		SSHUser:   sshUser,
+		Policy:    policy.Name,
+		Created:   now,
+		Expires:   now.Add(cfg.Timeout),
+	}
+	if err := approvals.create(req); err != nil {
+		return fmt.Errorf("Failed to create approval request: %v", err)
+	}
+	snapshot := approvals.snapshot(req)
+	log.Info("Session waiting for approval", "approval", req.ID, "user", id.User, "host", hostname(host), "policy", policy.Name)
+	emitApproval(snapshot, outcomeSuccess)
+	if cfg.WebhookURL != "" {
+		go func() {
+			body := map[string]interface{}{"event": "approval_requested", "approval": snapshot, "version": build.Version}
+			if err := postWebhook(cfg.WebhookURL, body); err != nil {
+				log.Warn("Failed to send approval request to the webhook", "approval", req.ID, "err", err)
+			}
+		}()
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("\x1b[1;33m[Waiting for approval to connect to %s (request %s, expires in %s)…]\x1b[0m\r\n",
+		hostname(host), req.ID, formatDuration(cfg.Timeout))))
+
+	expired := time.NewTimer(cfg.Timeout)
+	defer expired.Stop()
+	ping := time.NewTicker(approvalPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-req.decided:
+		case <-expired.C:
+			approvals.decide(req, approvalExpired, "", "", "")
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				approvals.decide(req, approvalCancelled, "", "", "")
+			}
+			continue
+		}
+		break
+	}
+
+	decided := approvals.snapshot(req)
+	log.Info("Approval request decided", "approval", req.ID, "status", decided.Status, "approver", decided.Approver)
+	switch decided.Status {
+	case approvalApproved:
+		// Approvals are audited where they are given
+		return nil
+	case approvalDenied:
+		reason := "Access to " + hostname(host) + " was denied by " + decided.Approver
+		if decided.Comment != "" {
+			reason += ": " + decided.Comment
+		}
+		return fmt.Errorf("%s", reason)
+	case approvalExpired:
+		emitApproval(decided, outcomeFailure)
+		return fmt.Errorf("No one approved access to %s within %s", hostname(host), formatDuration(cfg.Timeout))
+	}
+	emitApproval(decided, outcomeFailure)
+	if decided.Comment != "" {
+		return fmt.Errorf("Approval request cancelled: %s", decided.Comment)
+	}
+	return fmt.Errorf("Approval request cancelled")
+}
+
+// approvalsHandler lists approval requests on GET /api/approvals, those
+// in one state with ?status=
+func approvalsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	httpapi.JSON(w, map[string]interface{}{
+		"success":   true,
+		"approvals": approvals.list(r.URL.Query().Get("status")),
+	})
+}
+
+// approvalDecision is the body of POST /api/approvals/{id}
+type approvalDecision struct {
+	Decision string `json:"decision"` // approve or deny
+	Comment  string `json:"comment"`
+}
+
+// approvalHandler returns a request on GET /api/approvals/{id}, and
+// decides it on POST. The approver must be a user the authentication
+// proxy vouches for, other than the requester; the admin key alone
+// doesn't say who is deciding.
+func approvalHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/approvals/")
+	req, ok := approvals.get(id)
+	if !ok {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Approval request not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, approvals.snapshot(req))
+	case "POST":
+		var body approvalDecision
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+			return
+		}
+		status := map[string]string{"approve": approvalApproved, "deny": approvalDenied}[body.Decision]
+		if status == "" {
+			responder.ErrorCode(w, r, httpapi.BadRequest, `decision must be "approve" or "deny"`)
+			return
+		}
+		approver := proxyIdentity(r).User
+		if approver == "" || !fromTrustedProxy(r) {
+			responder.ErrorCode(w, r, httpapi.Forbidden, "Approvals need a user identified by the authentication proxy")
+			return
+		}
+		approverKey := ""
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			approverKey = key.Name
+		}
+		if approver == req.Requester {
+			requestLogger(r).Warn("Refused self-approval", "approval", req.ID, "user", approver)
+			responder.ErrorCode(w, r, httpapi.Forbidden, "The requester can't decide their own request")
+			return
+		}
+		if !approvals.decide(req, status, approver, approverKey, body.Comment) {
+			responder.ErrorCode(w, r, httpapi.Conflict, "Request was already "+approvals.snapshot(req).Status)
+			return
+		}
+		decided := approvals.snapshot(req)
+		outcome := outcomeSuccess
+		if status == approvalDenied {
+			outcome = outcomeDenied
+		}
+		emitApproval(decided, outcome)
+		requestLogger(r).Info("Approval request "+decided.Status, "approval", req.ID, "requester", decided.Requester, "approver", approver, "api_key", approverKey, "host", hostname(decided.Host))
+		httpapi.JSON(w, map[string]interface{}{"success": true, "approval": decided})
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// cancelAll turns away the pages still waiting, at shutdown
+func (reg *approvalRegistry) cancelAll() {
+	reg.mu.Lock()
+	pending := []*approvalRequest{}
+	for _, req := range reg.requests {
+		if req.Status == approvalPending {
+			pending = append(pending, req)
+		}
+	}
+	reg.mu.Unlock()
+	for _, req := range pending {
+		reg.decide(req, approvalCancelled, "", "", "server shutting down")
+	}
+	if len(pending) > 0 {
+		slog.Info("Cancelled pending approval requests", "requests", len(pending))
+	}
+}
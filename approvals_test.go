@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalNeedsAnotherUser(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+authz:
+  user_header: X-User
+`)
+	secret, _, err := mintAPIKey("ops", []string{scopeAdmin}, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	req := &approvalRequest{Requester: "alice", Host: "db01:22", Policy: "restricted", Created: now, Expires: now.Add(time.Minute)}
+	if err := approvals.create(req); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		approvals.mu.Lock()
+		delete(approvals.requests, req.ID)
+		approvals.mu.Unlock()
+	})
+
+	handler := withIdentityHeaders(apiKeyAuth(scopeAdmin, approvalHandler))
+	decide := func(peer, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/approvals/"+req.ID, strings.NewReader(`{"decision":"approve"}`))
+		r.RemoteAddr = peer
+		r.Header.Set("Authorization", "Bearer "+secret)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name, peer, user string
+	}{
+		// The admin key's name isn't a person
+		{"key only", "10.0.0.1:4000", ""},
+		{"requester", "10.0.0.1:4000", "alice"},
+		{"untrusted header", "10.0.0.2:4000", "bob"},
+	}
+	for _, tt := range tests {
+		if w := decide(tt.peer, tt.user); w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403: %s", tt.name, w.Code, w.Body)
+		}
+	}
+	if got := approvals.snapshot(req); got.Status != approvalPending {
+		t.Fatalf("request is %s after refused decisions", got.Status)
+	}
+
+	w := decide("10.0.0.1:4000", "bob")
+	var resp struct {
+		Approval approvalRequest `json:"approval"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("bob's approval: status %d: %s", w.Code, w.Body)
+	}
+	if a := resp.Approval; a.Status != approvalApproved || a.Approver != "bob" || a.ApproverKey != "ops" {
+		t.Errorf("approval %+v, want approved by bob with the ops key", a)
+	}
+}
+
+func TestApprovalRequesterNeedsTrustedProxy(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+authz:
+  user_header: X-User
+`)
+	secret, _, err := mintAPIKey("ops-terminal", []string{scopeTerminal}, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, peer, user, requester string // requester empty when refused
+	}{
+		{"trusted proxy", "10.0.0.1:4000", "alice", "alice"},
+		// Headers that got past withIdentityHeaders, as gRPC metadata did
+		{"forged requester", "10.0.0.2:4000", "bob", ""},
+		// The key's name would let its holder approve their own session
+		{"API key alone", "10.0.0.2:4000", "", ""},
+		{"trusted proxy naming no one", "10.0.0.1:4000", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = tt.peer
+			if tt.user != "" {
+				r.Header.Set("X-User", tt.user)
+			}
+			r = withAPIKey(r, lookupAPIKey(secret))
+
+			conn := newFakeConn()
+			defer conn.Close()
+			done := make(chan error, 1)
+			go func() { done <- awaitApproval(conn, r, "db01:22", "ops", &HostPolicy{Name: "restricted"}) }()
+
+			if tt.requester == "" {
+				select {
+				case err := <-done:
+					if err == nil {
+						t.Fatal("awaitApproval let the session through")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("an approval request was filed")
+				}
+				if pending := approvals.list(approvalPending); len(pending) != 0 {
+					t.Fatalf("requests filed: %+v", pending)
+				}
+				return
+			}
+
+			var pending []approvalRequest
+			for deadline := time.Now().Add(5 * time.Second); len(pending) == 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("no approval request was filed")
+				}
+				time.Sleep(10 * time.Millisecond)
+				pending = approvals.list(approvalPending)
+			}
+			req, _ := approvals.get(pending[0].ID)
+			approvals.decide(req, approvalDenied, "test", "", "")
+			<-done
+			approvals.mu.Lock()
+			delete(approvals.requests, req.ID)
+			approvals.mu.Unlock()
+
+			if pending[0].Requester != tt.requester {
+				t.Errorf("requester %q, want %q", pending[0].Requester, tt.requester)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	auditSessionStart  = "session_start"
+	auditSessionEnd    = "session_end"
+	auditUpload        = "upload"
+	auditDownload      = "download"
+	auditTokenCreate   = "token_create"
+	auditTokenUse      = "token_use"
+	auditAdminAction   = "admin_action"
+	auditAccessDenied  = "access_denied"
+	auditCommand       = "command"
+	auditConsent       = "consent"
+	auditQuotaWarning  = "quota_warning"
+	auditTunnel        = "tunnel"
+	auditExec          = "exec"
+	auditAutoResponse  = "auto_response"
+	auditApproval      = "approval"
+	auditSessionJoin   = "session_join"
+	auditCredentialUse = "credential_use"
+	auditSessionLock   = "session_lock"
+)
+
+// Audit event outcomes
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeDenied  = "denied"
+)
+
+// AuditConfig configures the audit event sink
+type AuditConfig struct {
+	Sink      string `yaml:"sink"` // none (default), file, syslog or stdout
+	File      string `yaml:"file"`
+	SyslogTag string `yaml:"syslog_tag"`
+	// Rotation applies when sink is file
+	Rotation RotationConfig `yaml:"rotation"`
+	// Syslog ships the events to a remote collector as well
+	Syslog AuditSyslogConfig `yaml:"syslog"`
+}
+
+// AuditEvent is one JSON line in the audit stream. It must never carry
+// passwords, private keys or access tokens.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Outcome  string    `json:"outcome,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Approver string    `json:"approver,omitempty"` // set for approval decisions
+	// Participants are the other users of a dual-control session
+	Participants []string `json:"participants,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	SSHUser      string   `json:"ssh_user,omitempty"`
+	AuthMethod   string   `json:"auth_method,omitempty"`
+	ReadOnly     bool     `json:"read_only,omitempty"`
+	Protocol     string   `json:"protocol,omitempty"` // set for telnet sessions and ZMODEM transfers
+	Path         string   `json:"path,omitempty"`
+	Size         int64    `json:"size,omitempty"`
+	SHA256       string   `json:"sha256,omitempty"`
+	DurationMS   int64    `json:"duration_ms,omitempty"`
+	BytesIn      int64    `json:"bytes_in,omitempty"`
+	BytesOut     int64    `json:"bytes_out,omitempty"`
+	TokenType    string   `json:"token_type,omitempty"`
+	Action       string   `json:"action,omitempty"`
+	Target       string   `json:"target,omitempty"`
+	Operation    string   `json:"operation,omitempty"`
+	Rule         string   `json:"rule,omitempty"`
+	Command      string   `json:"command,omitempty"`
+	ExitCode     *int     `json:"exit_code,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// auditLogger writes audit events as JSON lines. Write failures never
+// propagate to callers; they are logged loudly and the sink is reopened.
+type auditLogger struct {
+	mu         sync.Mutex
+	cfg        AuditConfig
+	w          io.WriteCloser
+	shipper    *auditShipper
+	failures   int
+	lastReport time.Time
+}
+
+var audit = &auditLogger{}
+
+// nopWriteCloser adapts stdout so closing the sink doesn't close it
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// initAudit opens the configured sink. A sink that can't be opened at
+// startup is a configuration error.
+func initAudit(cfg AuditConfig) error {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	if err := validateAuditConfig(cfg); err != nil {
+		return err
+	}
+
+	audit.cfg = cfg
+	if audit.w != nil {
+		audit.w.Close()
+		audit.w = nil
+	}
+	if cfg.Syslog.Address != "" && audit.shipper == nil {
+		audit.shipper = newAuditShipper(cfg.Syslog, cfg.SyslogTag)
+	}
+	return audit.open()
+}
+
+// validateAuditConfig checks the sink settings
+func validateAuditConfig(cfg AuditConfig) error {
+	switch cfg.Sink {
+	case "", "none", "stdout", "syslog":
+	case "file":
+		if cfg.File == "" {
+			return fmt.Errorf("audit.file is required when audit.sink is \"file\"")
+		}
+		if err := validateRotationConfig(cfg.Rotation); err != nil {
+			return fmt.Errorf("audit.rotation: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown audit sink %q", cfg.Sink)
+	}
+	return validateAuditSyslogConfig(cfg.Syslog)
+}
+
+// open connects the sink. Must be called with mu held.
+func (a *auditLogger) open() error {
+	switch a.cfg.Sink {
+	case "file":
+		f, err := openRotatingFile(a.cfg.File, a.cfg.Rotation, 0600)
+		if err != nil {
+			return fmt.Errorf("error opening audit log: %v", err)
+		}
+		a.w = f
+	case "syslog":
+		tag := a.cfg.SyslogTag
+		if tag == "" {
+			tag = "gossh-audit"
+		}
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+		if err != nil {
+			return fmt.Errorf("error connecting to syslog: %v", err)
+		}
+		a.w = w
+	case "stdout":
+		a.w = nopWriteCloser{os.Stdout}
+	}
+	return nil
+}
+
+func (a *auditLogger) enabled() bool {
+	return a.cfg.Sink != "" && a.cfg.Sink != "none"
+}
+
+// Emit writes an event to the audit sink, and queues it for the syslog
+// collector
+func (a *auditLogger) Emit(ev AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.enabled() && a.shipper == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if a.shipper != nil {
+		a.shipper.ship(ev)
+	}
+	if !a.enabled() {
+		return
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("AUDIT FAILURE: failed to encode event", "event", ev.Event, "err", err)
+		return
+	}
+	data = append(data, '\n')
+
+	if a.w == nil {
+		if err := a.open(); err != nil {
+			a.reportFailure(ev.Event, err)
+			return
+		}
+	}
+	if _, err := a.w.Write(data); err != nil {
+		a.w.Close()
+		a.w = nil
+		a.reportFailure(ev.Event, err)
+		return
+	}
+
+	if a.failures > 0 {
+		slog.Warn("AUDIT RECOVERED: audit sink is writable again", "dropped", a.failures)
+		a.failures = 0
+	}
+}
+
+// flush gives the syslog collector up to timeout to take the queued
+// events, at shutdown
+func (a *auditLogger) flush(timeout time.Duration) {
+	a.mu.Lock()
+	shipper := a.shipper
+	a.mu.Unlock()
+	if shipper != nil {
+		shipper.flush(timeout)
+	}
+}
+
+// reportFailure logs a dropped event, at most once every 10 seconds.
+// Must be called with mu held.
+func (a *auditLogger) reportFailure(event string, err error) {
+	a.failures++
+	if time.Since(a.lastReport) < 10*time.Second {
+		return
+	}
+	a.lastReport = time.Now()
+	slog.Error("AUDIT FAILURE: audit sink is unavailable, dropping events", "sink", a.cfg.Sink, "event", event, "dropped", a.failures, "err", err)
+}
+
+// requestMeta identifies the client behind a connection or transfer
+type requestMeta struct {
+	ClientIP string
+	User     string
+	// RequestID and SessionID tag error reports
+	RequestID string
+	SessionID string
+	// Log carries the client address and identity on every line
+	Log *slog.Logger
+}
+
+func newRequestMeta(r *http.Request) requestMeta {
+	id := requestIdentity(r)
+	meta := requestMeta{
+		ClientIP:  clientIP(r),
+		User:      id.User,
+		RequestID: requestID(r),
+	}
+	meta.Log = requestLogger(r)
+	if meta.User != "" {
+		meta.Log = meta.Log.With("user", meta.User)
+	}
+	return meta
+}
+
+// authMethod describes which credentials were supplied for audit records
+func authMethod(password string, privateKey []byte) string {
+	switch {
+	case password != "" && len(privateKey) > 0:
+		return "password,publickey"
+	case len(privateKey) > 0:
+		return "publickey"
+	case password != "":
+		return "password"
+	}
+	return "none"
+}
+
+// outcomeOf maps an error to an audit outcome
+func outcomeOf(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// errorString returns err's message, or "" for nil
+func errorString(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
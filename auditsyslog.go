@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditSyslogBuffer = 10000
+	auditSyslogDialTimeout   = 10 * time.Second
+	auditSyslogWriteTimeout  = 10 * time.Second
+	auditSyslogMaxBackoff    = time.Minute
+)
+
+// AuditSyslogConfig ships audit events to a remote syslog collector, such
+// as a SIEM, in addition to audit.sink
+type AuditSyslogConfig struct {
+	// Address is host:port, or a socket path for unix; empty ships nothing
+	Address  string `yaml:"address"`
+	Protocol string `yaml:"protocol"` // tcp (default), udp or unix
+	Facility string `yaml:"facility"` // default auth
+	Format   string `yaml:"format"`   // cef (default) or rfc5424-json
+	// Buffer is how many events are held while the collector can't be
+	// reached; the oldest are dropped beyond it
+	Buffer int `yaml:"buffer"`
+}
+
+func (c *AuditSyslogConfig) applyDefaults() {
+	if c.Protocol == "" {
+		c.Protocol = "tcp"
+	}
+	if c.Facility == "" {
+		c.Facility = "auth"
+	}
+	if c.Format == "" {
+		c.Format = "cef"
+	}
+	if c.Buffer == 0 {
+		c.Buffer = defaultAuditSyslogBuffer
+	}
+}
+
+// syslogFacilities are the facility codes of RFC 5424
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+func validateAuditSyslogConfig(c AuditSyslogConfig) error {
+	if c.Address == "" {
+		return nil
+	}
+	switch c.Protocol {
+	case "tcp", "udp", "unix":
+	default:
+		return fmt.Errorf("audit.syslog.protocol must be tcp, udp or unix, not %q", c.Protocol)
+	}
+	if c.Protocol != "unix" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("audit.syslog.address: %v", err)
+		}
+	}
+	if _, ok := syslogFacilities[c.Facility]; !ok {
+		return fmt.Errorf("unknown audit.syslog.facility %q", c.Facility)
+	}
+	if c.Format != "cef" && c.Format != "rfc5424-json" {
+		return fmt.Errorf("audit.syslog.format must be cef or rfc5424-json, not %q", c.Format)
+	}
+	if c.Buffer < 0 {
+		return fmt.Errorf("audit.syslog.buffer can't be negative")
+	}
+	return nil
+}
+
+var errSyslogClosed = errors.New("connection closed by the collector")
+
+// auditShipper sends audit events to a syslog collector from a bounded
+// buffer, so neither an outage nor a slow collector holds up whoever emits
+// them. It reconnects with backoff, resending the event it failed on.
+type auditShipper struct {
+	cfg AuditSyslogConfig
+	// hostname and tag head RFC 5424 messages
+	hostname, tag string
+	queue         chan []byte
+
+	mu sync.Mutex
+	// pending counts the events queued or being sent; empty is signalled
+	// when it drops to zero
+	pending int
+	empty   *sync.Cond
+
+	dropped    int
+	lastReport time.Time
+}
+
+func newAuditShipper(cfg AuditSyslogConfig, tag string) *auditShipper {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if tag == "" {
+		tag = "gossh-audit"
+	}
+	s := &auditShipper{cfg: cfg, hostname: hostname, tag: tag, queue: make(chan []byte, max(cfg.Buffer, 1))}
+	s.empty = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// ship formats and queues an event, dropping the oldest queued one when
+// the buffer is full
+func (s *auditShipper) ship(ev AuditEvent) {
+	msg := s.format(ev)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		select {
+		case s.queue <- msg:
+			s.pending++
+			return
+		default:
+		}
+		select {
+		case <-s.queue:
+			s.pending--
+			s.dropped++
+			if time.Since(s.lastReport) >= 10*time.Second {
+				s.lastReport = time.Now()
+				slog.Error("AUDIT FAILURE: syslog buffer is full, dropping the oldest events", "address", s.cfg.Address, "dropped", s.dropped)
+			}
+		default:
+		}
+	}
+}
+
+// run sends queued events until the process exits
+func (s *auditShipper) run() {
+	var conn net.Conn
+	// closed is closed once the collector has closed a stream conn. A
+	// write to a closed TCP connection succeeds, losing the event, so
+	// collectors, which never send anything, are read from to notice.
+	var closed chan struct{}
+	backoff := time.Second
+	for msg := range s.queue {
+		for {
+			if conn == nil {
+				var err error
+				if conn, err = s.dial(); err != nil {
+					slog.Error("AUDIT FAILURE: can't reach syslog collector, retrying", "address", s.cfg.Address, "retry_in", backoff, "err", err)
+					time.Sleep(backoff)
+					backoff = min(backoff*2, auditSyslogMaxBackoff)
+					continue
+				}
+				if backoff > time.Second {
+					slog.Warn("AUDIT RECOVERED: syslog collector is reachable again", "address", s.cfg.Address)
+				}
+				backoff = time.Second
+				closed = nil
+				if s.cfg.Protocol != "udp" {
+					closed = make(chan struct{})
+					go func(conn net.Conn, closed chan struct{}) {
+						io.Copy(io.Discard, conn)
+						close(closed)
+					}(conn, closed)
+				}
+			}
+			err := errSyslogClosed
+			select {
+			case <-closed:
+			default:
+				conn.SetWriteDeadline(time.Now().Add(auditSyslogWriteTimeout))
+				_, err = conn.Write(msg)
+			}
+			if err != nil {
+				slog.Warn("Lost connection to syslog collector", "address", s.cfg.Address, "err", err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+			break
+		}
+		s.mu.Lock()
+		if s.pending--; s.pending == 0 {
+			s.empty.Broadcast()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// dial connects to the collector. Unix sockets are tried as datagram
+// sockets first, as local syslog daemons'.
+func (s *auditShipper) dial() (net.Conn, error) {
+	if s.cfg.Protocol == "unix" {
+		if conn, err := net.DialTimeout("unixgram", s.cfg.Address, auditSyslogDialTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialTimeout(s.cfg.Protocol, s.cfg.Address, auditSyslogDialTimeout)
+}
+
+// flush waits up to timeout for the queued events to be sent
+func (s *auditShipper) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		for s.pending > 0 {
+			s.empty.Wait()
+		}
+		s.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.mu.Lock()
+		slog.Error("AUDIT FAILURE: syslog collector didn't take every event before shutdown", "address", s.cfg.Address, "unsent", s.pending)
+		s.mu.Unlock()
+	}
+}
+
+// format renders an event as one syslog message. Stream connections get
+// a newline after it, per RFC 6587's non-transparent framing.
+func (s *auditShipper) format(ev AuditEvent) []byte {
+	pri := syslogFacilities[s.cfg.Facility]*8 + auditSeverity(ev).syslog
+	var msg string
+	if s.cfg.Format == "cef" {
+		// The BSD header ArcSight and most CEF collectors expect
+		msg = fmt.Sprintf("<%d>%s %s %s", pri, ev.Time.UTC().Format(time.Stamp), s.hostname, formatCEF(ev))
+	} else {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			data = []byte("{}")
+		}
+		msg = fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", pri, ev.Time.UTC().Format(time.RFC3339Nano), s.hostname, s.tag, os.Getpid(), ev.Event, data)
+	}
+	if s.cfg.Protocol != "udp" {
+		msg += "\n"
+	}
+	return []byte(msg)
+}
+
+// auditSeverities grade an event for syslog and for CEF, whose severities
+// run from 0 to 10
+type auditSeverities struct{ syslog, cef int }
+
+func auditSeverity(ev AuditEvent) auditSeverities {
+	switch {
+	case ev.Event == auditAccessDenied || ev.Outcome == outcomeDenied:
+		return auditSeverities{syslog: 4, cef: 7} // warning
+	case ev.Outcome == outcomeFailure:
+		return auditSeverities{syslog: 4, cef: 5}
+	case ev.Event == auditQuotaWarning:
+		return auditSeverities{syslog: 5, cef: 4} // notice
+	case ev.Event == auditAdminAction || ev.Event == auditTokenCreate:
+		return auditSeverities{syslog: 5, cef: 3}
+	}
+	return auditSeverities{syslog: 6, cef: 1} // informational
+}
+
+// auditEventNames are the CEF names of the audit event types
+var auditEventNames = map[string]string{
+	auditSessionStart:  "Session started",
+	auditSessionEnd:    "Session ended",
+	auditUpload:        "File uploaded",
+	auditDownload:      "File downloaded",
+	auditTokenCreate:   "Access token created",
+	auditTokenUse:      "Access token used",
+	auditAdminAction:   "Administrative action",
+	auditAccessDenied:  "Access denied",
+	auditCommand:       "Restricted session command",
+	auditConsent:       "Usage notice accepted",
+	auditQuotaWarning:  "Transfer quota nearly used",
+	auditTunnel:        "Port forwarding",
+	auditExec:          "Command executed",
+	auditAutoResponse:  "Prompt answered automatically",
+	auditApproval:      "Connection approval",
+	auditSessionJoin:   "Session participant",
+	auditCredentialUse: "Stored credential used",
+	auditSessionLock:   "Session lock",
+}
+
+// formatCEF renders an event as a CEF:0 record. The mapping of its fields
+// to CEF keys is documented in the README; unset fields are left out.
+func formatCEF(ev AuditEvent) string {
+	name := auditEventNames[ev.Event]
+	if name == "" {
+		name = ev.Event
+	}
+	header := []string{"CEF:0", "gossh", "gossh", build.Version, ev.Event, name, strconv.Itoa(auditSeverity(ev).cef)}
+	for i := 1; i < len(header); i++ {
+		header[i] = cefHeaderEscaper.Replace(header[i])
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValueEscaper.Replace(value))
+		}
+	}
+	number := func(key string, n int64) {
+		if n != 0 {
+			add(key, strconv.FormatInt(n, 10))
+		}
+	}
+	labeled := func(key, label, value string) {
+		if value != "" {
+			add(key, value)
+			add(key+"Label", label)
+		}
+	}
+	number("rt", ev.Time.UnixMilli())
+	add("outcome", ev.Outcome)
+	add("src", ev.ClientIP)
+	add("suser", ev.User)
+	if host, port, err := net.SplitHostPort(ev.Host); err == nil {
+		add("dhost", host)
+		add("dpt", port)
+	} else {
+		add("dhost", ev.Host)
+	}
+	add("duser", ev.SSHUser)
+	add("app", ev.Protocol)
+	add("act", ev.Action)
+	add("filePath", ev.Path)
+	number("fsize", ev.Size)
+	add("fileHash", ev.SHA256)
+	number("in", ev.BytesIn)
+	number("out", ev.BytesOut)
+	add("msg", ev.Error)
+	labeled("cs1", "authMethod", ev.AuthMethod)
+	labeled("cs2", "tokenType", ev.TokenType)
+	labeled("cs3", "target", ev.Target)
+	labeled("cs4", "operation", ev.Operation)
+	labeled("cs5", "rule", ev.Rule)
+	labeled("cs6", "command", ev.Command)
+	labeled("flexString1", "approver", ev.Approver)
+	labeled("flexString2", "participants", strings.Join(ev.Participants, ","))
+	if ev.DurationMS != 0 {
+		labeled("cn1", "durationMs", strconv.FormatInt(ev.DurationMS, 10))
+	}
+	if ev.ExitCode != nil {
+		labeled("cn2", "exitCode", strconv.Itoa(*ev.ExitCode))
+	}
+	if ev.ReadOnly {
+		labeled("cn3", "readOnly", "1")
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+var (
+	// cefHeaderEscaper escapes the pipe-separated header fields
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	// cefValueEscaper escapes the values of key=value extensions
+	cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// cefEvents are an event of each type, as the code emitting them fills
+// them in
+func cefEvents() map[string]AuditEvent {
+	at := time.Date(2026, 10, 7, 9, 30, 0, 0, time.UTC)
+	zero, failed := 0, 2
+	return map[string]AuditEvent{
+		auditSessionStart:  {Time: at, Event: auditSessionStart, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "db01.internal:2222", SSHUser: "postgres", AuthMethod: "publickey", TokenType: "access"},
+		auditSessionEnd:    {Time: at, Event: auditSessionEnd, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "db01.internal", SSHUser: "postgres", DurationMS: 754210, BytesIn: 1834, BytesOut: 981244, ReadOnly: true},
+		auditUpload:        {Time: at, Event: auditUpload, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "web01", SSHUser: "deploy", Path: "/srv/app/release 2.tar.gz", Size: 10485760, SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", DurationMS: 2210},
+		auditDownload:      {Time: at, Event: auditDownload, Outcome: outcomeFailure, ClientIP: "203.0.113.7", User: "alice", Host: "web01", SSHUser: "deploy", Path: "/var/log/app.log", Protocol: "zmodem", Error: "No such file"},
+		auditTokenCreate:   {Time: at, Event: auditTokenCreate, Outcome: outcomeSuccess, ClientIP: "10.0.0.5", User: "ci", Host: "web01", SSHUser: "deploy", TokenType: "access", Target: "web01"},
+		auditTokenUse:      {Time: at, Event: auditTokenUse, Outcome: outcomeDenied, ClientIP: "198.51.100.20", Host: "web01", TokenType: "access", Error: "Token expired"},
+		auditAdminAction:   {Time: at, Event: auditAdminAction, Outcome: outcomeSuccess, ClientIP: "10.0.0.5", User: "ops", Action: "maintenance_enable", Target: "maintenance"},
+		auditAccessDenied:  {Time: at, Event: auditAccessDenied, Outcome: outcomeDenied, ClientIP: "198.51.100.20", User: "mallory", Host: "db01.internal", SSHUser: "root", Rule: "deny root|prod", Error: "Denied by authz rule"},
+		auditCommand:       {Time: at, Event: auditCommand, Outcome: outcomeDenied, ClientIP: "203.0.113.7", User: "alice", Host: "db01.internal", SSHUser: "postgres", Command: `psql -c "DROP TABLE users;"`, Rule: "no-ddl"},
+		auditConsent:       {Time: at, Event: auditConsent, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice"},
+		auditQuotaWarning:  {Time: at, Event: auditQuotaWarning, ClientIP: "203.0.113.7", User: "alice", Operation: "upload", Size: 943718400, Target: "user:alice"},
+		auditTunnel:        {Time: at, Event: auditTunnel, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "bastion:22", SSHUser: "alice", Target: "10.1.2.3:5432", DurationMS: 60000, BytesIn: 4096, BytesOut: 65536},
+		auditExec:          {Time: at, Event: auditExec, Outcome: outcomeFailure, ClientIP: "10.0.0.5", User: "ci", Host: "web01", SSHUser: "deploy", Command: "systemctl restart app\nexit 1", ExitCode: &failed, DurationMS: 1540},
+		auditAutoResponse:  {Time: at, Event: auditAutoResponse, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "db01.internal", SSHUser: "postgres", Rule: "sudo-password"},
+		auditApproval:      {Time: at, Event: auditApproval, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Approver: "bob", Host: "prod01", SSHUser: "root", Operation: "connect"},
+		auditSessionJoin:   {Time: at, Event: auditSessionJoin, Outcome: outcomeSuccess, ClientIP: "203.0.113.9", User: "alice", Participants: []string{"bob", "carol"}, Host: "prod01", SSHUser: "root", ReadOnly: true},
+		auditCredentialUse: {Time: at, Event: auditCredentialUse, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "prod01", SSHUser: "root", Target: "prod-root", ExitCode: &zero},
+		auditSessionLock:   {Time: at, Event: auditSessionLock, Outcome: outcomeSuccess, ClientIP: "203.0.113.7", User: "alice", Host: "prod01", SSHUser: "root", Action: "lock"},
+	}
+}
+
+func TestFormatCEFGolden(t *testing.T) {
+	defer func(v string) { build.Version = v }(build.Version)
+	build.Version = "1.0.0|test"
+
+	events := cefEvents()
+	for event := range auditEventNames {
+		if _, ok := events[event]; !ok {
+			t.Errorf("no golden test for %s events", event)
+		}
+	}
+	for event, ev := range events {
+		t.Run(event, func(t *testing.T) {
+			got := formatCEF(ev) + "\n"
+			golden := filepath.Join("testdata", "cef", event+".cef")
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestFormatCEFUnknownEvent(t *testing.T) {
+	got := formatCEF(AuditEvent{Event: "new|event", User: `a=b\c`})
+	for _, want := range []string{`|new\|event|new\|event|1|`, `suser=a\=b\\c`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s doesn't contain %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"gossh/internal/httpapi"
+)
+
+// Operations that can be granted by authorization rules
+const (
+	opTerminal = "terminal"
+	opUpload   = "upload"
+	opDownload = "download"
+	opExec     = "exec"
+	opTunnel   = "tunnel"
+)
+
+// AuthzConfig maps users and groups to the hosts and operations they may use
+type AuthzConfig struct {
+	UserHeader   string              `yaml:"user_header"`
+	GroupsHeader string              `yaml:"groups_header"`
+	Groups       map[string][]string `yaml:"groups"`
+	Rules        []AuthzRule         `yaml:"rules"`
+	SSHUsers     SSHUserPolicy       `yaml:"ssh_users"`
+	HostPolicies []HostPolicy        `yaml:"host_policies"`
+
+	// AuthTimeHeader is when the proxy last signed the user in, as Unix
+	// seconds or RFC 3339, for unlocking locked sessions
+	AuthTimeHeader string `yaml:"auth_time_header"`
+}
+
+// SSHUserPolicy refuses logins as some SSH users, such as root, whatever
+// the request or access token asks for
+type SSHUserPolicy struct {
+	Deny []string `yaml:"deny"`
+	// Exceptions allow users on the deny list on hosts matching a pattern,
+	// for appliances that only have root: host pattern -> users
+	Exceptions map[string][]string `yaml:"exceptions"`
+}
+
+// denies reports whether logging in to host as user is refused
+func (p *SSHUserPolicy) denies(host, user string) bool {
+	host = hostname(host)
+	matches := func(u string) bool { return strings.EqualFold(u, user) }
+	if !slices.ContainsFunc(p.Deny, matches) {
+		return false
+	}
+	for pattern, users := range p.Exceptions {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok && slices.ContainsFunc(users, matches) {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthzRule grants (or denies) operations on matching hosts. Deny rules take
+// precedence over allow rules; a request matching no rule is denied.
+type AuthzRule struct {
+	Name       string   `yaml:"name"`
+	Users      []string `yaml:"users"`
+	Groups     []string `yaml:"groups"`
+	Hosts      []string `yaml:"hosts"`
+	Operations []string `yaml:"operations"`
+	Effect     string   `yaml:"effect"` // allow (default) or deny
+
+	// HostGroups match the hosts in host_groups or aliases' groups
+	HostGroups []string `yaml:"host_groups"`
+
+	// RestrictedCommands limits terminal sessions granted by this rule to
+	// the listed command patterns
+	RestrictedCommands []string `yaml:"restricted_commands"`
+	// AutoRespond names the session.auto_responses entries terminal
+	// sessions granted by this rule use
+	AutoRespond []string `yaml:"auto_respond"`
+
+	// groupHosts are the hostnames in HostGroups
+	groupHosts map[string]bool
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	User   string
+	Groups []string
+	Source string // "header", "api_key" or "" for anonymous
+}
+
+func (id Identity) String() string {
+	if id.User == "" {
+		return "anonymous"
+	}
+	return id.User
+}
+
+// requestIdentity determines who is making the request. API keys identify
+// themselves by name; otherwise the user is taken from the configured
+// authentication proxy header, which withIdentityHeaders has removed
+// unless a trusted proxy set it.
+func requestIdentity(r *http.Request) Identity {
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		return Identity{User: key.Name, Source: "api_key"}
+	}
+	return proxyIdentity(r)
+}
+
+// proxyIdentity returns the user the authentication proxy vouches for,
+// whether or not the request also carries an API key
+func proxyIdentity(r *http.Request) Identity {
+	authz := currentConfig().Authz
+	if authz.UserHeader == "" {
+		return Identity{}
+	}
+	user := strings.TrimSpace(r.Header.Get(authz.UserHeader))
+	if user == "" {
+		return Identity{}
+	}
+
+	id := Identity{User: user, Source: "header"}
+	if authz.GroupsHeader != "" {
+		for _, g := range strings.Split(r.Header.Get(authz.GroupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	}
+	return id
+}
+
+// identityHeaders are the headers the authentication proxy vouches for
+func (a *AuthzConfig) identityHeaders() []string {
+	var headers []string
+	for _, h := range []string{a.UserHeader, a.GroupsHeader, a.AuthTimeHeader} {
+		if h != "" {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// withIdentityHeaders removes the authentication proxy's headers from
+// requests that don't come from server.trusted_proxies, so clients can't
+// name themselves
+func withIdentityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := currentConfig().Authz.identityHeaders()
+		if len(headers) > 0 && !fromTrustedProxy(r) {
+			forged := false
+			for _, h := range headers {
+				forged = forged || r.Header.Get(h) != ""
+			}
+			if forged {
+				requestLogger(r).Warn("Ignoring identity headers from an untrusted peer", "peer", peerAddress(r))
+				r = r.Clone(r.Context())
+				for _, h := range headers {
+					r.Header.Del(h)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identityGroups returns the groups of an identity, including groups
+// configured in authz.groups
+func identityGroups(authz *AuthzConfig, id Identity) []string {
+	groups := append([]string{}, id.Groups...)
+	if id.User == "" {
+		return groups
+	}
+	for group, members := range authz.Groups {
+		for _, m := range members {
+			if m == id.User {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+func (rule *AuthzRule) matchesIdentity(id Identity, groups []string) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return true
+	}
+	for _, u := range rule.Users {
+		// Only "*" takes in anonymous callers; naming a user never does
+		if u == "*" || (id.User != "" && u == id.User) {
+			return true
+		}
+	}
+	for _, g := range rule.Groups {
+		for _, have := range groups {
+			if g == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule *AuthzRule) matchesHost(host string) bool {
+	if len(rule.Hosts) == 0 && len(rule.HostGroups) == 0 {
+		return true
+	}
+	if rule.groupHosts[host] {
+		return true
+	}
+	for _, pattern := range rule.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *AuthzRule) matchesOperation(op string) bool {
+	return permitsOperation(rule.Operations, op)
+}
+
+// permitsOperation reports whether op is in ops. An empty list permits
+// every operation.
+func permitsOperation(ops []string, op string) bool {
+	if len(ops) == 0 {
+		return true
+	}
+	for _, o := range ops {
+		if o == op || o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// hostname strips the port and IPv6 brackets from a host string
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// decidingRule returns the rule that decides op on host for id along with
+// its display name: the first matching deny rule, otherwise the first
+// matching allow rule. It returns nil when no rule matches.
+func decidingRule(authz *AuthzConfig, id Identity, host, op string) (*AuthzRule, string) {
+	host = hostname(host)
+	groups := identityGroups(authz, id)
+
+	var allowedBy *AuthzRule
+	allowedName := ""
+	for i := range authz.Rules {
+		rule := &authz.Rules[i]
+		if !rule.matchesIdentity(id, groups) || !rule.matchesHost(host) || !rule.matchesOperation(op) {
+			continue
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule #%d", i+1)
+		}
+		if rule.Effect == "deny" {
+			return rule, name
+		}
+		if allowedBy == nil {
+			allowedBy, allowedName = rule, name
+		}
+	}
+	return allowedBy, allowedName
+}
+
+// evaluateAuthz checks an operation on host against the rules and returns
+// whether it is allowed along with the name of the deciding rule
+func evaluateAuthz(authz *AuthzConfig, id Identity, host, op string) (bool, string) {
+	if len(authz.Rules) == 0 {
+		return true, ""
+	}
+
+	rule, name := decidingRule(authz, id, host, op)
+	if rule == nil {
+		return false, "default deny"
+	}
+	return rule.Effect != "deny", name
+}
+
+// authorize is the single policy check run before any SSH dial. user is
+// the SSH user the request logs in as, or "" when it doesn't log in.
+func authorize(r *http.Request, host, user, op string) error {
+	return authorizeIdentity(requestLogger(r), clientIP(r), requestIdentity(r), host, user, op)
+}
+
+// authorizeIdentity checks id outside of an HTTP request, such as for a
+// SOCKS connection through the identity's session
+func authorizeIdentity(logger *slog.Logger, clientIP string, id Identity, host, user, op string) error {
+	if err := authorizeLogin(logger, clientIP, id.User, host, user, op); err != nil {
+		return err
+	}
+	if err := authorizeHostPolicy(logger, clientIP, id.User, host, op); err != nil {
+		return err
+	}
+	allowed, rule := evaluateAuthz(&currentConfig().Authz, id, host, op)
+	if !allowed {
+		logger.Warn("Authorization denied", "user", id.String(), "host", hostname(host), "operation", op, "rule", rule)
+		audit.Emit(AuditEvent{
+			Event:     auditAccessDenied,
+			Outcome:   outcomeDenied,
+			ClientIP:  clientIP,
+			User:      id.User,
+			Host:      hostname(host),
+			Operation: op,
+			Rule:      rule,
+		})
+		return fmt.Errorf("access denied: %s is not permitted to %s on %s", id.String(), op, hostname(host))
+	}
+	return nil
+}
+
+// authorizeLogin refuses logins as the users on authz.ssh_users.deny. It
+// runs again once stored credentials have named the user, when op may be
+// unknown.
+func authorizeLogin(logger *slog.Logger, clientIP, identity, host, user, op string) error {
+	if user == "" || !currentConfig().Authz.SSHUsers.denies(host, user) {
+		return nil
+	}
+	logger.Warn("Login denied by SSH user policy", "user", identity, "host", hostname(host), "ssh_user", user)
+	audit.Emit(AuditEvent{
+		Event:     auditAccessDenied,
+		Outcome:   outcomeDenied,
+		ClientIP:  clientIP,
+		User:      identity,
+		Host:      hostname(host),
+		SSHUser:   user,
+		Operation: op,
+		Rule:      "ssh_users.deny",
+	})
+	return httpapi.Errorf(httpapi.LoginDenied, "login as %s is not permitted via this gateway", user)
+}
+
+// validateAuthzConfig checks rule definitions for obvious mistakes and
+// resolves the host groups they name
+func validateAuthzConfig(authz *AuthzConfig, groups map[string]*hostGroup) error {
+	validOps := map[string]bool{opTerminal: true, opUpload: true, opDownload: true, opExec: true, opTunnel: true, "*": true}
+	for i := range authz.Rules {
+		rule := &authz.Rules[i]
+		if rule.Effect != "" && rule.Effect != "allow" && rule.Effect != "deny" {
+			return fmt.Errorf("authz rule #%d: effect must be \"allow\" or \"deny\"", i+1)
+		}
+		for _, op := range rule.Operations {
+			if !validOps[op] {
+				return fmt.Errorf("authz rule #%d: unknown operation %q", i+1, op)
+			}
+		}
+		for _, pattern := range rule.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("authz rule #%d: invalid host pattern %q", i+1, pattern)
+			}
+		}
+		var err error
+		if rule.groupHosts, err = policyHosts(groups, rule.HostGroups); err != nil {
+			return fmt.Errorf("authz rule #%d: %v", i+1, err)
+		}
+	}
+	for pattern := range authz.SSHUsers.Exceptions {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("authz.ssh_users.exceptions: invalid host pattern %q", pattern)
+		}
+	}
+	for i := range authz.HostPolicies {
+		p := &authz.HostPolicies[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := p.parse(groups); err != nil {
+			return fmt.Errorf("host policy %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const overlappingRules = `
+authz:
+  groups:
+    team-db: [alice, bob]
+  rules:
+    - name: db-team
+      groups: [team-db]
+      hosts: ["db*.internal"]
+    - name: no-prod-writes
+      groups: [team-db]
+      hosts: ["db*.prod.internal"]
+      operations: [upload, exec]
+      effect: deny
+    - name: interns
+      groups: [interns]
+      hosts: [sandbox.internal]
+      operations: [terminal]
+    - name: bob-everywhere
+      users: [bob]
+    - name: not-a-wildcard
+      users: [anonymous]
+      hosts: [anon.internal]
+    - name: nobody-on-vault
+      users: ["*"]
+      hosts: ["vault*"]
+      effect: deny
+`
+
+func TestEvaluateAuthzOverlappingRules(t *testing.T) {
+	cfg := useConfig(t, overlappingRules)
+	tests := []struct {
+		name    string
+		id      Identity
+		host    string
+		op      string
+		allowed bool
+		rule    string
+	}{
+		{"group allow", Identity{User: "alice"}, "db1.internal", opTerminal, true, "db-team"},
+		{"port is ignored", Identity{User: "alice"}, "db1.internal:2222", opUpload, true, "db-team"},
+		{"host case is ignored", Identity{User: "alice"}, "DB1.internal", opTerminal, true, "db-team"},
+		{"deny beats earlier allow", Identity{User: "alice"}, "db1.prod.internal", opUpload, false, "no-prod-writes"},
+		{"deny only covers its operations", Identity{User: "alice"}, "db1.prod.internal", opDownload, true, "db-team"},
+		{"deny beats later user allow", Identity{User: "bob"}, "db1.prod.internal", opExec, false, "no-prod-writes"},
+		{"user allow outside the group's hosts", Identity{User: "bob"}, "web1.internal", opExec, true, "bob-everywhere"},
+		{"wildcard deny beats user allow", Identity{User: "bob"}, "vault1", opTerminal, false, "nobody-on-vault"},
+		{"group from the header", Identity{User: "carol", Groups: []string{"interns"}}, "sandbox.internal", opTerminal, true, "interns"},
+		{"operation not granted", Identity{User: "carol", Groups: []string{"interns"}}, "sandbox.internal", opUpload, false, "default deny"},
+		{"no matching rule", Identity{User: "carol"}, "db1.internal", opTerminal, false, "default deny"},
+		{"anonymous", Identity{}, "db1.internal", opTerminal, false, "default deny"},
+		{"anonymous is not a user name", Identity{}, "anon.internal", opTerminal, false, "default deny"},
+		{"user named anonymous", Identity{User: "anonymous"}, "anon.internal", opTerminal, true, "not-a-wildcard"},
+		{"wildcard deny covers anonymous", Identity{}, "vault1", opTerminal, false, "nobody-on-vault"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, rule := evaluateAuthz(&cfg.Authz, tt.id, tt.host, tt.op)
+			if allowed != tt.allowed || rule != tt.rule {
+				t.Errorf("evaluateAuthz(%v, %s, %s) = %v, %q; want %v, %q", tt.id, tt.host, tt.op, allowed, rule, tt.allowed, tt.rule)
+			}
+		})
+	}
+}
+
+func TestEvaluateAuthzWithoutRules(t *testing.T) {
+	cfg := useConfig(t, "")
+	if allowed, _ := evaluateAuthz(&cfg.Authz, Identity{}, "any.host", opExec); !allowed {
+		t.Error("requests are denied although no rules are configured")
+	}
+}
+
+func TestSSHUserPolicy(t *testing.T) {
+	p := SSHUserPolicy{
+		Deny:       []string{"root", "admin"},
+		Exceptions: map[string][]string{"pdu-*.mgmt": {"root"}},
+	}
+	tests := []struct {
+		host, user string
+		denied     bool
+	}{
+		{"web1", "root", true},
+		{"web1", "ROOT", true},
+		{"web1", "deploy", false},
+		{"pdu-1.mgmt:22", "root", false},
+		{"pdu-1.mgmt", "admin", true},
+	}
+	for _, tt := range tests {
+		if got := p.denies(tt.host, tt.user); got != tt.denied {
+			t.Errorf("denies(%s, %s) = %v, want %v", tt.host, tt.user, got, tt.denied)
+		}
+	}
+}
+
+func TestIdentityHeadersOnlyFromTrustedProxies(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+authz:
+  user_header: X-User
+  groups_header: X-Groups
+`)
+	var got Identity
+	handler := withIdentityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestIdentity(r)
+	}))
+	tests := []struct {
+		peer string
+		want Identity
+	}{
+		{"10.0.0.1:4000", Identity{User: "alice", Groups: []string{"ops", "dba"}, Source: "header"}},
+		{"10.0.0.2:4000", Identity{}},
+		{"127.0.0.1:4000", Identity{}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set("X-User", "alice")
+		r.Header.Set("X-Groups", "ops, dba")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got.User != tt.want.User || got.Source != tt.want.Source || len(got.Groups) != len(tt.want.Groups) {
+			t.Errorf("from %s: identity %+v, want %+v", tt.peer, got, tt.want)
+		}
+		if tt.want.User == "" && r.Header.Get("X-User") == "" {
+			t.Errorf("from %s: the caller's request was modified", tt.peer)
+		}
+	}
+}
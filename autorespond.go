@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAutoResponseQuietPeriod = 500 * time.Millisecond
+	// autoResponseTail is how much recent output prompts are matched against
+	autoResponseTail = 512
+)
+
+// AutoResponseConfig answers a prompt in a session's output, such as sudo's
+// password prompt, with a secret the browser never sees. Sessions use it
+// when the authz rule granting them lists it in auto_respond.
+type AutoResponseConfig struct {
+	// Prompts are regular expressions matched against the end of the
+	// output, e.g. '\[sudo\] password for \S+: '
+	Prompts []string `yaml:"prompts"`
+	// Secret is a vault:<path> credential source; its password is typed,
+	// followed by a newline
+	Secret string `yaml:"secret"`
+	// MaxResponses is how often a session may be answered
+	MaxResponses int `yaml:"max_responses"`
+	// QuietPeriod is how long the output must stay at the prompt before it
+	// is answered
+	QuietPeriod time.Duration `yaml:"quiet_period"`
+}
+
+func (c *AutoResponseConfig) applyDefaults() {
+	if c.MaxResponses <= 0 {
+		c.MaxResponses = 1
+	}
+	if c.QuietPeriod <= 0 {
+		c.QuietPeriod = defaultAutoResponseQuietPeriod
+	}
+}
+
+// autoResponse is a compiled session.auto_responses entry
+type autoResponse struct {
+	name    string
+	prompts []*regexp.Regexp
+	cfg     AutoResponseConfig
+}
+
+// parseAutoResponses compiles session.auto_responses and checks that the
+// authz rules only name entries that exist
+func parseAutoResponses(responses map[string]AutoResponseConfig, rules []AuthzRule) (map[string]*autoResponse, error) {
+	names := make([]string, 0, len(responses))
+	for name := range responses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	compiled := make(map[string]*autoResponse, len(responses))
+	for _, name := range names {
+		c := responses[name]
+		if len(c.Prompts) == 0 {
+			return nil, fmt.Errorf("%s: prompts are required", name)
+		}
+		if !strings.HasPrefix(c.Secret, vaultSourcePrefix) {
+			return nil, fmt.Errorf("%s: secret must be a %s<path> credential source", name, vaultSourcePrefix)
+		}
+		a := &autoResponse{name: name, cfg: c}
+		for _, prompt := range c.Prompts {
+			// Only a prompt the output ends with is answered
+			re, err := regexp.Compile("(?:" + prompt + `)\z`)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid prompt %q: %v", name, prompt, err)
+			}
+			a.prompts = append(a.prompts, re)
+		}
+		compiled[name] = a
+	}
+
+	for i, rule := range rules {
+		for _, name := range rule.AutoRespond {
+			if _, ok := compiled[name]; !ok {
+				return nil, fmt.Errorf("authz rule #%d: auto_respond names unknown entry %q", i+1, name)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+// sessionAutoResponses returns the auto-responses the authz rule granting a
+// terminal session on host enables for it
+func sessionAutoResponses(r *http.Request, host string) []*autoResponse {
+	cfg := currentConfig()
+	rule, _ := decidingRule(&cfg.Authz, requestIdentity(r), host, opTerminal)
+	if rule == nil || rule.Effect == "deny" {
+		return nil
+	}
+	var responses []*autoResponse
+	for _, name := range rule.AutoRespond {
+		if a, ok := cfg.autoResponses[name]; ok {
+			responses = append(responses, a)
+		}
+	}
+	return responses
+}
+
+// promptResponder watches a session's output for the prompts of its
+// auto-responses. A prompt is only answered once the output has ended with
+// it for the quiet period and the user hasn't typed meanwhile. A nil
+// responder answers nothing.
+type promptResponder struct {
+	meta      requestMeta
+	host      string
+	sshUser   string
+	stdin     io.Writer
+	responses []*autoResponse
+
+	mu    sync.Mutex
+	tail  []byte
+	timer *time.Timer
+	// gen changes with every output and keystroke, so a scheduled answer
+	// can tell it is stale
+	gen   int
+	count map[string]int
+}
+
+func newPromptResponder(meta requestMeta, host, sshUser string, stdin io.Writer, responses []*autoResponse) *promptResponder {
+	return &promptResponder{
+		meta:      meta,
+		host:      host,
+		sshUser:   sshUser,
+		stdin:     stdin,
+		responses: responses,
+		count:     make(map[string]int),
+	}
+}
+
+// output notes output sent to the page
+func (p *promptResponder) output(data []byte) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tail = append(p.tail, data...)
+	if len(p.tail) > autoResponseTail {
+		p.tail = append(p.tail[:0], p.tail[len(p.tail)-autoResponseTail:]...)
+	}
+	p.cancel()
+	for _, a := range p.responses {
+		if p.count[a.name] >= a.cfg.MaxResponses {
+			continue
+		}
+		for _, re := range a.prompts {
+			if re.Match(p.tail) {
+				gen := p.gen
+				p.timer = time.AfterFunc(a.cfg.QuietPeriod, func() { p.respond(a, gen) })
+				return
+			}
+		}
+	}
+}
+
+// typed notes input from the user, who is then answering themselves
+func (p *promptResponder) typed() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tail = p.tail[:0]
+	p.cancel()
+}
+
+// cancel drops a scheduled answer. The caller holds mu.
+func (p *promptResponder) cancel() {
+	p.gen++
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// respond types the secret of a unless the output or the user moved on
+// since it was scheduled
+func (p *promptResponder) respond(a *autoResponse, gen int) {
+	p.mu.Lock()
+	if gen != p.gen {
+		p.mu.Unlock()
+		return
+	}
+	p.count[a.name]++
+	p.tail = p.tail[:0]
+	p.timer = nil
+	p.mu.Unlock()
+
+	event := AuditEvent{
+		Event:    auditAutoResponse,
+		ClientIP: p.meta.ClientIP,
+		User:     p.meta.User,
+		Host:     p.host,
+		SSHUser:  p.sshUser,
+		Rule:     a.name,
+	}
+	err := p.typeSecret(a)
+	if err != nil {
+		event.Outcome = outcomeFailure
+		event.Error = err.Error()
+		p.meta.Log.Warn("Failed to answer prompt", "auto_response", a.name, "err", err)
+	} else {
+		event.Outcome = outcomeSuccess
+		p.meta.Log.Info("Answered prompt", "auto_response", a.name)
+	}
+	audit.Emit(event)
+}
+
+func (p *promptResponder) typeSecret(a *autoResponse) error {
+	vault := currentConfig().vault
+	if vault == nil {
+		return fmt.Errorf("vault credential source is not configured on this server")
+	}
+	// The authz rule granting the session already chose who gets the
+	// secret, so only its hosts are checked
+	creds, err := vault.secretFor(p.meta, nil, strings.TrimPrefix(a.cfg.Secret, vaultSourcePrefix), p.host)
+	if err != nil {
+		return err
+	}
+	if creds.Password == "" {
+		return fmt.Errorf("secret %s has no password", strings.TrimPrefix(a.cfg.Secret, vaultSourcePrefix))
+	}
+	_, err = p.stdin.Write([]byte(creds.Password + "\n"))
+	return err
+}
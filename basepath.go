@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// forwardedPrefixHeader is set by proxies that strip the prefix gossh is
+// mounted under before passing requests on
+const forwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// validBasePath matches a URL prefix such as /gossh or /tools/ssh
+var validBasePath = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// validateBasePath checks server.base_path, already stripped of any
+// trailing slash by applyDefaults
+func validateBasePath(path string) []string {
+	if path != "" && !validBasePath.MatchString(path) {
+		return []string{"server.base_path must be a path such as /gossh"}
+	}
+	return nil
+}
+
+// basePath returns the prefix the client reached gossh under, for building
+// links and redirects; "" when it is served at the root
+func basePath(r *http.Request) string {
+	prefix, _ := r.Context().Value(basePathKey).(string)
+	return prefix
+}
+
+// withBasePath serves the routes under server.base_path. Requests carrying
+// the prefix have it removed before routing; requests a proxy has already
+// stripped are routed as they are, using X-Forwarded-Prefix for links when
+// it comes from one of server.trusted_proxies.
+func withBasePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := currentConfig().Server.BasePath
+		if prefix != "" && r.URL.Path == prefix {
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		if rest, ok := strings.CutPrefix(r.URL.Path, prefix+"/"); prefix != "" && ok {
+			r2 := r.Clone(context.WithValue(r.Context(), basePathKey, prefix))
+			r2.URL.Path = "/" + rest
+			r2.URL.RawPath = ""
+			next.ServeHTTP(w, r2)
+			return
+		}
+
+		if forwarded := strings.TrimRight(r.Header.Get(forwardedPrefixHeader), "/"); validBasePath.MatchString(forwarded) && fromTrustedProxy(r) {
+			r = r.WithContext(context.WithValue(r.Context(), basePathKey, forwarded))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
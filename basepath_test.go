@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedPrefixOnlyFromTrustedProxies(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+`)
+	var got string
+	handler := withBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = basePath(r)
+	}))
+	tests := []struct {
+		peer, prefix, want string
+	}{
+		{"10.0.0.1:4000", "/gossh", "/gossh"},
+		{"10.0.0.1:4000", "/gossh/", "/gossh"},
+		{"10.0.0.1:4000", "javascript:alert(1)", ""},
+		{"10.0.0.2:4000", "/gossh", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/terminal", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set(forwardedPrefixHeader, tt.prefix)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("%s from %s: base path %q, want %q", tt.prefix, tt.peer, got, tt.want)
+		}
+	}
+}
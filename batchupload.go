@@ -0,0 +1,573 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+const (
+	// maxBatchField bounds the form fields of a batch upload other than
+	// the file
+	maxBatchField = 1 << 20
+	// batchProgressInterval is how often a streamed batch reports the
+	// progress of each host
+	batchProgressInterval = time.Second
+	// spoolJanitorInterval is how often expired spooled files are removed
+	spoolJanitorInterval = time.Minute
+	ndjsonContentType    = "application/x-ndjson"
+)
+
+// spooledFile is the file of a batch upload, written to disk once for every
+// host to read and kept a while so failed hosts can be retried without
+// sending it again
+type spooledFile struct {
+	ID       string
+	Owner    string
+	Filename string
+	Path     string
+	Size     int64
+	SHA256   string
+
+	// users counts the batches reading the file; expires is set when the
+	// last one is done. Both are guarded by spoolStore.mu.
+	users   int
+	expires time.Time
+}
+
+type spoolStore struct {
+	mu      sync.Mutex
+	files   map[string]*spooledFile
+	janitor sync.Once
+}
+
+var spools = &spoolStore{files: make(map[string]*spooledFile)}
+
+// create spools the file read from r for owner. It fails once more than
+// limit bytes have been read, leaving nothing behind.
+func (s *spoolStore) create(r io.Reader, owner, filename string, limit int64) (*spooledFile, error) {
+	cfg := currentConfig().Transfers
+	id, err := randomID(16)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(cfg.SpoolDir, "gossh-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to spool file: %v", err)
+	}
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(r, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil:
+		err = fmt.Errorf("Failed to spool file: %v", err)
+	case n > limit:
+		err = httpapi.Errorf(httpapi.TooLarge, "File is larger than %s", transfer.FormatSize(limit))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	file := &spooledFile{
+		ID:       id,
+		Owner:    owner,
+		Filename: filename,
+		Path:     f.Name(),
+		Size:     n,
+		SHA256:   hex.EncodeToString(hasher.Sum(nil)),
+		users:    1,
+	}
+	s.mu.Lock()
+	s.files[id] = file
+	s.mu.Unlock()
+	s.janitor.Do(func() { go s.prune() })
+	return file, nil
+}
+
+// acquire returns spooled file id for another batch, if owner spooled it
+// and it is still there
+func (s *spoolStore) acquire(id, owner string) (*spooledFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok || f.Owner != owner {
+		return nil, false
+	}
+	f.users++
+	return f, true
+}
+
+// release ends a batch's use of f, which is kept for spool_retention after
+// the last one
+func (s *spoolStore) release(f *spooledFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.users--
+	if f.users == 0 {
+		f.expires = time.Now().Add(currentConfig().Transfers.SpoolRetention)
+	}
+}
+
+// prune removes expired spooled files, for as long as the process runs
+func (s *spoolStore) prune() {
+	for range time.Tick(spoolJanitorInterval) {
+		now := time.Now()
+		s.mu.Lock()
+		for id, f := range s.files {
+			if f.users == 0 && now.After(f.expires) {
+				delete(s.files, id)
+				if err := os.Remove(f.Path); err != nil {
+					slog.Warn("Failed to remove spooled file", "path", f.Path, "err", err)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// batchResult is how a batch upload went on one host
+type batchResult struct {
+	Host    string `json:"host"`
+	User    string `json:"user,omitempty"`
+	Success bool   `json:"success"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Warning string `json:"warning,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+	// Extracted is set when the file was an archive sent with extract
+	Extracted *transfer.ExtractResult `json:"extracted,omitempty"`
+}
+
+// batchResponse is the body of POST /api/upload/batch, and the last line of
+// its stream
+type batchResponse struct {
+	Event     string `json:"event,omitempty"` // "summary" in a stream
+	Spool     string `json:"spool"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Succeeded int    `json:"succeeded"`
+	Skipped   int    `json:"skipped"` // of the succeeded, hosts that had the file
+	Failed    int    `json:"failed"`
+	// FailedHosts still need the file, which spool sends them again
+	FailedHosts []string      `json:"failed_hosts"`
+	Results     []batchResult `json:"results"`
+}
+
+// batchEvent is a line of a streamed batch about one host: started,
+// progress with the bytes sent so far, or finished with its result
+type batchEvent struct {
+	Event  string       `json:"event"`
+	Host   string       `json:"host"`
+	Bytes  int64        `json:"bytes,omitempty"`
+	Result *batchResult `json:"result,omitempty"`
+}
+
+// batchTarget is a host of a batch, resolved or refused. Results name it
+// as the request did, so failed hosts can be sent again as they are.
+type batchTarget struct {
+	name   string
+	target *transferTarget
+	result batchResult
+}
+
+// batchUpload is a batch upload in progress
+type batchUpload struct {
+	r     *http.Request
+	meta  requestMeta
+	spool *spooledFile
+	// ifChanged skips hosts that already have the file
+	ifChanged bool
+	// extract unpacks the file on each host it is sent to
+	extract *transfer.Archive
+
+	// emit writes a line of the stream; nil when the response isn't one
+	emit func(v interface{})
+}
+
+// batchUploadHandler sends one file to many hosts. The multipart body has
+// the file, or the spool of an earlier batch, and the hosts: targets, a
+// JSON list of objects like the body of /api/exec names its target, and
+// group, a host group logged into with the user, password, private_key and
+// credentials fields.
+func batchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.BadRequest, "Expected a multipart/form-data body")
+		return
+	}
+
+	meta := newRequestMeta(r)
+	cfg := currentConfig().Transfers
+	fields := make(map[string]string)
+	var spool *spooledFile
+	defer func() {
+		if spool != nil {
+			spools.release(spool)
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Failed to read form: "+err.Error())
+			return
+		}
+		name := part.FormName()
+		if name == "file" {
+			if spool != nil {
+				responder.ErrorCode(w, r, httpapi.BadRequest, "Only one file may be sent")
+				return
+			}
+			filename := transferFileName(part.FileName())
+			if filename == "" {
+				responder.ErrorCode(w, r, httpapi.BadRequest, "The file has no name")
+				return
+			}
+			if spool, err = spools.create(part, meta.User, filename, cfg.SpoolMaxMB<<20); err != nil {
+				responder.Error(w, r, err, httpapi.Internal)
+				return
+			}
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxBatchField+1))
+		if err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Failed to read form: "+err.Error())
+			return
+		}
+		if len(value) > maxBatchField {
+			responder.ErrorCode(w, r, httpapi.BadRequest, fmt.Sprintf("Field %s is too large", name))
+			return
+		}
+		fields[name] = string(value)
+	}
+	if id := fields["spool"]; id != "" {
+		var ok bool
+		if spool != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Send either a file or a spool, not both")
+			return
+		}
+		if spool, ok = spools.acquire(id, meta.User); !ok {
+			responder.ErrorCode(w, r, httpapi.NotFound, "Spooled file not found or expired")
+			return
+		}
+	}
+	if spool == nil {
+		responder.ErrorCode(w, r, httpapi.MissingParams, "Missing file")
+		return
+	}
+
+	requests, err := batchRequests(fields, cfg.BatchMaxTargets, requestIdentity(r))
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	// An archive to extract is inspected once for all the hosts
+	var extract *transfer.Archive
+	if v, _ := strconv.ParseBool(fields["extract"]); v {
+		archive, err := os.Open(spool.Path)
+		if err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		defer archive.Close()
+		if extract, err = transfer.NewArchive(spool.Filename, fields["extract_to"], archive, spool.Size, currentConfig().Transfers.limits()); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+	}
+
+	// The batch is mirrored once, from the spooled file, before any host
+	// gets it
+	mirror, err := startMirror(mirrorRecord{
+		Direction: auditUpload,
+		User:      meta.User,
+		ClientIP:  meta.ClientIP,
+		Session:   mirrorSession(meta, nil),
+		Filename:  spool.Filename,
+	})
+	if err == nil && mirror != nil {
+		var f *os.File
+		if f, err = os.Open(spool.Path); err == nil {
+			_, err = io.Copy(mirror, f)
+			f.Close()
+		}
+		if err != nil {
+			mirror.finish(nil, err)
+		}
+	}
+	if err != nil {
+		responder.Error(w, r, err, httpapi.Internal)
+		return
+	}
+
+	b := &batchUpload{r: r, meta: meta, spool: spool, extract: extract}
+	b.ifChanged, _ = strconv.ParseBool(fields["if_changed"])
+	var lines sync.Mutex
+	if strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		enc := json.NewEncoder(w)
+		flusher := http.NewResponseController(w)
+		b.emit = func(v interface{}) {
+			lines.Lock()
+			defer lines.Unlock()
+			enc.Encode(v)
+			flusher.Flush()
+		}
+	}
+
+	targets := make([]batchTarget, len(requests))
+	for i, req := range requests {
+		targets[i] = b.resolve(i, req)
+	}
+
+	ctx, span := startRequestSpan(r, "transfer.batch_upload")
+	span.SetAttributes(attribute.Int("gossh.batch.targets", len(targets)), attribute.Int64("gossh.transfer.size", spool.Size))
+	sem := make(chan struct{}, cfg.BatchConcurrency)
+	var wg sync.WaitGroup
+	for i := range targets {
+		if targets[i].target == nil {
+			b.finished(&targets[i].result)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t *batchTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t.result = b.upload(ctx, t.name, t.target)
+			b.finished(&t.result)
+		}(&targets[i])
+	}
+	wg.Wait()
+
+	hosts := make([]mirrorHost, len(targets))
+	for i, t := range targets {
+		hosts[i] = mirrorHost{Host: t.result.Host, SSHUser: t.result.User, Path: t.result.Path, Success: t.result.Success, Skipped: t.result.Skipped, Error: t.result.Error}
+	}
+	if err := mirror.finish(hosts, nil); err != nil {
+		for i := range targets {
+			if targets[i].result.Success {
+				targets[i].result = failedBatchResult(targets[i].result, err, httpapi.Internal)
+			}
+		}
+	}
+
+	response := batchResponse{
+		Spool:       spool.ID,
+		Filename:    spool.Filename,
+		Size:        spool.Size,
+		SHA256:      spool.SHA256,
+		FailedHosts: []string{},
+	}
+	for _, t := range targets {
+		response.Results = append(response.Results, t.result)
+		if t.result.Success {
+			response.Succeeded++
+			if t.result.Skipped {
+				response.Skipped++
+			}
+		} else {
+			response.Failed++
+			response.FailedHosts = append(response.FailedHosts, t.result.Host)
+		}
+	}
+	span.SetAttributes(attribute.Int("gossh.batch.failed", response.Failed))
+	endSpan(span, nil)
+	meta.Log.Info("Batch upload finished", "spool", spool.ID, "filename", spool.Filename, "size", spool.Size, "succeeded", response.Succeeded, "failed", response.Failed)
+
+	if b.emit != nil {
+		response.Event = "summary"
+		b.emit(response)
+		return
+	}
+	httpapi.JSON(w, response)
+}
+
+// batchRequests reads the hosts of a batch from its form fields. A group
+// takes in the aliases in it and the profiles id sees tagged with it.
+func batchRequests(fields map[string]string, maxTargets int, id Identity) ([]targetRequest, error) {
+	var requests []targetRequest
+	if v := fields["targets"]; v != "" {
+		if err := json.Unmarshal([]byte(v), &requests); err != nil {
+			return nil, httpapi.Errorf(httpapi.BadRequest, "Invalid targets: %v", err)
+		}
+	}
+	if group := fields["group"]; group != "" {
+		hosts, ok := groupHosts(group, id)
+		if !ok {
+			return nil, httpapi.Errorf(httpapi.NotFound, "Host group %s not found", group)
+		}
+		for _, e := range hosts {
+			req := targetRequest{
+				Host:        e.Name,
+				User:        fields["user"],
+				Password:    fields["password"],
+				PrivateKey:  fields["private_key"],
+				Credentials: fields["credentials"],
+			}
+			// Profiles log in as their own user and credential source
+			// unless the batch names others
+			if e.Kind == hostKindProfile {
+				p, _ := profiles.lookup(e.Profile)
+				req.Host, req.User = p.address(), cmp.Or(req.User, p.User)
+				if req.Credentials == "" && req.Password == "" && req.PrivateKey == "" {
+					req.Credentials = p.Credentials
+				}
+			}
+			requests = append(requests, req)
+		}
+	}
+	if len(requests) == 0 {
+		return nil, httpapi.Errorf(httpapi.MissingParams, "Missing targets or group")
+	}
+	if len(requests) > maxTargets {
+		return nil, httpapi.Errorf(httpapi.BadRequest, "A batch may have at most %d targets", maxTargets)
+	}
+	return requests, nil
+}
+
+// resolve finds the host of the batch's i-th target and checks it may be
+// uploaded to. Refused targets come back with their result.
+func (b *batchUpload) resolve(i int, req targetRequest) batchTarget {
+	host := req.Host
+	if host == "" {
+		host = fmt.Sprintf("targets[%d]", i)
+	}
+	res := batchResult{Host: host, User: req.User}
+	target, err := resolveTransferTarget(b.r, opUpload, req.param)
+	if err != nil {
+		return batchTarget{name: host, result: failedBatchResult(res, err, httpapi.BadRequest)}
+	}
+	if err := authorize(b.r, target.Host, target.User, opUpload); err != nil {
+		return batchTarget{name: host, result: failedBatchResult(res, err, httpapi.Forbidden)}
+	}
+	return batchTarget{name: host, target: target}
+}
+
+// upload sends the spooled file to one host
+func (b *batchUpload) upload(ctx context.Context, name string, target *transferTarget) batchResult {
+	res := batchResult{Host: name, User: target.User}
+	if b.emit != nil {
+		b.emit(batchEvent{Event: "started", Host: name})
+	}
+	if err := quotas.check(target.Quotas); err != nil {
+		return failedBatchResult(res, err, httpapi.QuotaExceeded)
+	}
+
+	var result transfer.Result
+	meter := &quotaMeter{subjects: target.Quotas, meta: b.meta, op: opUpload}
+	sshConn, release, err := target.connect(ctx, b.meta)
+	if err == nil {
+		res.User = target.User
+		var f *os.File
+		if f, err = os.Open(b.spool.Path); err == nil {
+			reader := &batchReader{ctx: ctx, r: f, host: name, emit: b.emit}
+			result, err = transferHost(b.meta.Log, sshConn).Upload(quotaReader{r: reader, meter: meter}, b.spool.Filename, transfer.UploadOptions{Size: b.spool.Size, SHA256: b.spool.SHA256, IfChanged: b.ifChanged, Extract: b.extract})
+			f.Close()
+		}
+		release()
+	}
+	audit.Emit(AuditEvent{
+		Event:    auditUpload,
+		Outcome:  outcomeOf(err),
+		ClientIP: b.meta.ClientIP,
+		User:     b.meta.User,
+		Host:     target.Host,
+		SSHUser:  target.User,
+		Path:     result.Path,
+		Size:     result.Size,
+		SHA256:   result.SHA256,
+		Target:   b.spool.ID,
+		Action:   transfer.UploadAction(result),
+		Error:    errorString(err),
+	})
+	if err != nil {
+		if meter.err != nil {
+			err = meter.err
+		}
+		res.Path = result.Path
+		return failedBatchResult(res, err, httpapi.TransferFailed)
+	}
+	res.Success = true
+	res.Path = result.Path
+	res.Size = result.Size
+	res.SHA256 = result.SHA256
+	res.Skipped = result.Skipped
+	res.Warning = result.Warning
+	res.Extracted = result.Extracted
+	return res
+}
+
+// finished reports a host's result in the stream
+func (b *batchUpload) finished(res *batchResult) {
+	if b.emit != nil {
+		b.emit(batchEvent{Event: "finished", Host: res.Host, Result: res})
+	}
+}
+
+// failedBatchResult records err in res, with the code it is reported under
+func failedBatchResult(res batchResult, err error, fallback httpapi.Code) batchResult {
+	code, _ := httpapi.Classify(err, fallback)
+	res.Success = false
+	res.Error = err.Error()
+	res.Code = code.Name
+	return res
+}
+
+// batchReader reads the spooled file for one host, reporting progress to
+// the stream and stopping when the request is abandoned
+type batchReader struct {
+	ctx      context.Context
+	r        io.Reader
+	host     string
+	emit     func(v interface{})
+	sent     int64
+	reported time.Time
+}
+
+func (r *batchReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.sent += int64(n)
+	if r.emit != nil && time.Since(r.reported) >= batchProgressInterval {
+		r.reported = time.Now()
+		r.emit(batchEvent{Event: "progress", Host: r.host, Bytes: r.sent})
+	}
+	return n, err
+}
@@ -5,10 +5,15 @@ set -e
 
 echo "Building Go SSH Web Terminal..."
 
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+
 # Build for Linux AMD64
-GOOS=linux GOARCH=amd64 go build -o gossh -ldflags="-s -w"
+GOOS=linux GOARCH=amd64 go build -o gossh \
+    -ldflags="-s -w -X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$BUILD_DATE"
 
-echo "Build complete: gossh"
+echo "Build complete: gossh $VERSION ($COMMIT)"
 echo "Size: $(du -h gossh | cut -f1)"
 echo ""
 echo "To deploy to production server:"
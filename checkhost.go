@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// checkHostTimeout bounds each stage of a host check, so the login form
+// gets an answer quickly
+const checkHostTimeout = 3 * time.Second
+
+// hostCheck is the result of GET /api/check-host
+type hostCheck struct {
+	Host string `json:"host"`
+	// Via is the jump host that was checked instead, when there is one
+	Via       string `json:"via,omitempty"`
+	Reachable bool   `json:"reachable"`
+	// Banner is the SSH server's version line
+	Banner string  `json:"banner,omitempty"`
+	DNSMs  float64 `json:"dns_ms"`
+	TCPMs  float64 `json:"tcp_ms"`
+	// Failure is the class of failure, as in connection logs, and Error
+	// what to tell the user
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// checkHost resolves host, connects and waits for the SSH banner, the steps
+// of a connection that need no credentials. Hosts behind a jump host are
+// only checked as far as the jump host.
+func checkHost(ctx context.Context, meta requestMeta, host string) hostCheck {
+	addr := sshAddress(host)
+	result := hostCheck{Host: addr}
+	dialHost, dialAddr := host, addr
+	if aliased := aliasedHostAt(addr); aliased != nil && aliased.jumpHost != "" {
+		_, jump, ok := strings.Cut(aliased.jumpHost, "@")
+		if !ok {
+			jump = aliased.jumpHost
+		}
+		dialHost, _ = resolveHost(jump, "")
+		dialAddr = sshAddress(dialHost)
+		result.Via = dialAddr
+	}
+	rec := newConnectRecord(meta, dialHost, "", checkHostTimeout)
+	fail := func(failure string, err error) hostCheck {
+		result.DNSMs, result.TCPMs = millis(rec.dns), millis(rec.tcp)
+		result.Failure = failure
+		result.Error = rec.connectError(failure, err).Error()
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*checkHostTimeout)
+	defer cancel()
+	conn, err := dialTarget(ctx, meta, dialHost, dialAddr, checkHostTimeout, rec)
+	if err != nil {
+		return fail(dialFailure(err), err)
+	}
+	defer conn.Close()
+
+	// Servers may send other lines before the version line
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(checkHostTimeout))
+	reader := bufio.NewReaderSize(conn, 256)
+	for range 5 {
+		var line string
+		line, err = reader.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			result.Banner = strings.TrimSpace(line)
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	rec.handshake = time.Since(start)
+	if result.Banner == "" {
+		if err == nil {
+			err = fmt.Errorf("the server does not speak SSH")
+		}
+		return fail(failureBanner, err)
+	}
+	result.DNSMs, result.TCPMs = millis(rec.dns), millis(rec.tcp)
+	result.Reachable = true
+	return result
+}
+
+// checkHostHandler checks that the host of the login form can be reached
+// before a terminal is opened for it. Only hosts in ssh.check_targets that
+// the caller may open sessions to are checked, so the endpoint can't be used
+// to scan ports.
+func checkHostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	host, _ := resolveHost(r.URL.Query().Get("host"), "")
+	if host == "" {
+		responder.ErrorCode(w, r, httpapi.MissingParams, "Missing host")
+		return
+	}
+	cfg := currentConfig()
+	if len(cfg.checkTargets) == 0 {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Host checks are disabled")
+		return
+	}
+	if !tunnelAllowed(cfg.checkTargets, sshAddress(host)) {
+		responder.ErrorCode(w, r, httpapi.Forbidden, "Host is not among the hosts that may be checked")
+		return
+	}
+	if err := authorize(r, host, "", opTerminal); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	result := checkHost(r.Context(), meta, host)
+	meta.Log.Debug("Checked host", "host", result.Host, "reachable", result.Reachable, "failure", result.Failure)
+	httpapi.JSON(w, result)
+}
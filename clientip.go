@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client that made the request. The
+// X-Forwarded-For and X-Real-IP headers are only believed when the request
+// comes from one of server.trusted_proxies, or over a Unix socket, which
+// only a local proxy can reach; anyone else could forge them.
+func clientIP(r *http.Request) string {
+	peer := peerAddress(r)
+	if !fromTrustedProxy(r) {
+		return peer
+	}
+	if ip := forwardedClientIP(r.Header, currentConfig().trustedProxies); ip != "" {
+		return ip
+	}
+	return peer
+}
+
+// peerAddress is the address the request's connection comes from
+func peerAddress(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// fromTrustedProxy reports whether r comes from one of
+// server.trusted_proxies or over a Unix socket, so that the headers a proxy
+// sets can be believed
+func fromTrustedProxy(r *http.Request) bool {
+	return viaUnixSocket(r) || containsIP(currentConfig().trustedProxies, net.ParseIP(peerAddress(r)))
+}
+
+// forwardedClientIP walks X-Forwarded-For from the right, past the trusted
+// proxies that appended to it, and returns the first address they did not
+// vouch for. Entries further left were written by the client and could be
+// anything. X-Real-IP is used when there is no X-Forwarded-For.
+func forwardedClientIP(header http.Header, trusted []*net.IPNet) string {
+	var hops []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// Garbage from beyond the last proxy
+			break
+		}
+		client = ip.String()
+		if !containsIP(trusted, ip) {
+			return client
+		}
+	}
+	if client != "" {
+		return client
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.0/8, 127.0.0.1]
+`)
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct", "203.0.113.5:50000", nil, "", "203.0.113.5"},
+		{"direct over IPv6", "[2001:db8::1]:50000", nil, "", "2001:db8::1"},
+		{"forged X-Forwarded-For", "203.0.113.5:50000", []string{"198.51.100.7"}, "", "203.0.113.5"},
+		{"forged X-Real-IP", "203.0.113.5:50000", nil, "198.51.100.7", "203.0.113.5"},
+		{"behind a proxy", "127.0.0.1:40000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"forged hop before the proxy's", "127.0.0.1:40000", []string{"1.2.3.4, 198.51.100.7"}, "", "198.51.100.7"},
+		{"two proxies", "10.0.0.1:40000", []string{"1.2.3.4, 198.51.100.7, 10.0.0.2"}, "", "198.51.100.7"},
+		{"header per proxy", "10.0.0.1:40000", []string{"1.2.3.4", "198.51.100.7, 10.0.0.2"}, "", "198.51.100.7"},
+		{"forged trusted address", "10.0.0.1:40000", []string{"10.0.0.9, 198.51.100.7"}, "", "198.51.100.7"},
+		{"only proxies", "10.0.0.1:40000", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"garbage before the client", "127.0.0.1:40000", []string{"<script>, 198.51.100.7"}, "", "198.51.100.7"},
+		{"garbage from the proxy", "127.0.0.1:40000", []string{"198.51.100.7, unknown"}, "", "127.0.0.1"},
+		{"X-Real-IP from a proxy", "127.0.0.1:40000", nil, "198.51.100.7", "198.51.100.7"},
+		{"X-Forwarded-For over X-Real-IP", "127.0.0.1:40000", []string{"198.51.100.7"}, "1.2.3.4", "198.51.100.7"},
+		{"proxy without headers", "127.0.0.1:40000", nil, "", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("client %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+)
+
+// defaultClipboardMaxBytes bounds a clipboard write, as base64
+const defaultClipboardMaxBytes = 128 << 10
+
+// oscClipboard starts an OSC 52 sequence, with which programs such as tmux
+// and neovim set the terminal's clipboard: ESC ] 52 ; <selection> ; <base64>
+// ended by BEL or ESC \
+const oscClipboard = "\x1b]52;"
+
+// States of an osc52Filter
+const (
+	oscText   = iota
+	oscPrefix // within what may be the start of oscClipboard
+	oscBody
+	oscBodyEsc // ESC within the body, which ends it when followed by \
+)
+
+// osc52Filter takes OSC 52 sequences out of terminal output, where they may
+// be split across reads. Nothing else is changed. Sessions have a PTY, so
+// the output is one stream. It is guarded by the wsWriter's mu.
+type osc52Filter struct {
+	// allow passes clipboard writes on; otherwise they are dropped
+	allow    bool
+	maxBytes int
+
+	state    int
+	matched  int // bytes of oscClipboard matched, in oscPrefix
+	body     []byte
+	oversize bool // the body passed maxBytes, so the sequence is dropped
+}
+
+func newOSC52Filter(allow bool, maxBytes int) *osc52Filter {
+	return &osc52Filter{allow: allow, maxBytes: maxBytes}
+}
+
+// filter returns p without OSC 52 sequences, and the clipboard writes they
+// made that are to be passed on. The start of a sequence at the end of p is
+// held back until the next call tells whether it is one.
+func (f *osc52Filter) filter(p []byte) ([]byte, []string) {
+	if f.state == oscText && bytes.IndexByte(p, 0x1b) < 0 {
+		return p, nil
+	}
+	out := make([]byte, 0, len(p)+len(oscClipboard))
+	var clips []string
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch f.state {
+		case oscText:
+			if b == 0x1b {
+				f.state, f.matched = oscPrefix, 1
+				continue
+			}
+			out = append(out, b)
+
+		case oscPrefix:
+			if b == oscClipboard[f.matched] {
+				f.matched++
+				if f.matched == len(oscClipboard) {
+					f.state, f.body, f.oversize = oscBody, f.body[:0], false
+				}
+				continue
+			}
+			// Some other sequence: let it through and look at b again
+			out = append(out, oscClipboard[:f.matched]...)
+			f.state = oscText
+			i--
+
+		case oscBody:
+			switch b {
+			case 0x07: // BEL
+				clips = f.finish(clips)
+			case 0x1b:
+				f.state = oscBodyEsc
+			case 0x18, 0x1a: // CAN and SUB cancel the sequence
+				f.state = oscText
+			default:
+				if f.oversize {
+					continue
+				}
+				if len(f.body) == f.maxBytes {
+					// Too long to be passed on: drop the rest of it, up
+					// to its end, without holding it
+					f.oversize, f.body = true, f.body[:0]
+					continue
+				}
+				f.body = append(f.body, b)
+			}
+
+		case oscBodyEsc:
+			if b == '\\' {
+				clips = f.finish(clips)
+				continue
+			}
+			// A new sequence cancels this one
+			f.state, f.matched = oscPrefix, 1
+			i--
+		}
+	}
+	return out, clips
+}
+
+// finish ends a sequence, adding its clipboard write to clips when it is
+// passed on. Queries of the clipboard ("?") are never answered, and
+// oversized writes never passed on.
+func (f *osc52Filter) finish(clips []string) []string {
+	f.state = oscText
+	_, data, ok := bytes.Cut(f.body, []byte(";"))
+	if f.oversize || !f.allow || !ok || len(data) == 0 || string(data) == "?" {
+		return clips
+	}
+	if _, err := base64.StdEncoding.DecodeString(string(data)); err != nil {
+		return clips
+	}
+	return append(clips, string(data))
+}
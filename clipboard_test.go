@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOSC52Filter(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  bool
+		chunks []string
+		want   string
+		clips  []string
+	}{
+		{"plain text", true, []string{"hello"}, "hello", nil},
+		{"write with BEL", true, []string{"a\x1b]52;c;aGk=\x07b"}, "ab", []string{"aGk="}},
+		{"write with ST", true, []string{"a\x1b]52;c;aGk=\x1b\\b"}, "ab", []string{"aGk="}},
+		{"split across reads", true, []string{"a\x1b]5", "2;c;aG", "k=\x1b", "\\b"}, "ab", []string{"aGk="}},
+		{"disabled", false, []string{"a\x1b]52;c;aGk=\x07b"}, "ab", nil},
+		{"query never answered", true, []string{"\x1b]52;c;?\x07"}, "", nil},
+		{"invalid base64", true, []string{"\x1b]52;c;!!\x07"}, "", nil},
+		{"other sequences kept", true, []string{"\x1b]0;title\x07\x1b[1m"}, "\x1b]0;title\x07\x1b[1m", nil},
+		{"cancelled", true, []string{"a\x1b]52;c;aGk=\x18b"}, "ab", nil},
+		{"over the cap", true, []string{"\x1b]52;c;aGVsbG8gd29y", "bGQ=\x07after"}, "after", nil},
+		{"over the cap with ST", true, []string{"\x1b]52;c;aGVsbG8gd29ybGQ=\x1b", "\\after"}, "after", nil},
+		{"at the cap", true, []string{"\x1b]52;c;aGVsbG8gd29y\x07"}, "", []string{"aGVsbG8gd29y"}},
+		{"over the cap, then another", true, []string{"\x1b]52;c;" + strings.Repeat("A", 40) + "\x07\x1b]52;c;aGk=\x07"}, "", []string{"aGk="}},
+		// Until it ends, an oversized sequence takes the output with it
+		{"unterminated", true, []string{"\x1b]52;c;" + strings.Repeat("A", 40), "\r\n$ ls\r\n"}, "", nil},
+		{"ended by another sequence", true, []string{"\x1b]52;c;" + strings.Repeat("A", 40), "\r\n\x1b[1m$ ls"}, "\x1b[1m$ ls", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOSC52Filter(tt.allow, 16)
+			var out strings.Builder
+			var clips []string
+			for _, c := range tt.chunks {
+				data, cs := f.filter([]byte(c))
+				out.Write(data)
+				clips = append(clips, cs...)
+			}
+			if out.String() != tt.want || !slices.Equal(clips, tt.clips) {
+				t.Errorf("filtered %q to %q and %q, want %q and %q", tt.chunks, out.String(), clips, tt.want, tt.clips)
+			}
+		})
+	}
+}
+
+// TestOSC52FilterDropsOversized writes more than the default cap in the
+// reads a session makes and checks that none of it comes out
+func TestOSC52FilterDropsOversized(t *testing.T) {
+	f := newOSC52Filter(true, defaultClipboardMaxBytes)
+	stream := "before\x1b]52;c;" + strings.Repeat("QUJD", defaultClipboardMaxBytes/2) + "\x07after"
+	var out strings.Builder
+	for chunk := range slices.Chunk([]byte(stream), 4096) {
+		data, clips := f.filter(chunk)
+		if len(clips) > 0 {
+			t.Fatalf("passed on a clipboard write of %d bytes", len(clips[0]))
+		}
+		out.Write(data)
+	}
+	if out.String() != "beforeafter" {
+		t.Errorf("filtered to %d bytes starting %.20q, want %q", out.Len(), out.String(), "beforeafter")
+	}
+}
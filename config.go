@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fernet/fernet-go"
+	"gopkg.in/yaml.v3"
+
+	"github.com/gorilla/websocket"
+	"gossh/internal/config"
+)
+
+type Config struct {
+	Server struct {
+		Address string `yaml:"address"`
+		Port    int    `yaml:"port"`
+		// Listen overrides address and port: host:port, or unix:/path to
+		// serve on a Unix socket
+		Listen      string `yaml:"listen"`
+		SocketMode  string `yaml:"socket_mode"`  // e.g. "0660"
+		SocketOwner string `yaml:"socket_owner"` // user, user:group or :group
+		// Listeners replaces address, port, listen and tls with several
+		// listeners, each serving some or all of the endpoints
+		Listeners            []ListenerConfig    `yaml:"listeners"`
+		TLS                  TLSConfig           `yaml:"tls"`
+		AllowedClientCIDRs   []string            `yaml:"allowed_client_cidrs"`
+		ClientCIDRExceptions map[string][]string `yaml:"client_cidr_exceptions"`
+		// TrustedProxies may report the client address in X-Forwarded-For
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// CORS lets browser apps on other origins call the API
+		CORS CORSConfig `yaml:"cors"`
+		// DebugEndpoints serves pprof and expvar under /debug/
+		DebugEndpoints bool `yaml:"debug_endpoints"`
+		// DevMode re-reads templates on every request and shows their errors
+		DevMode bool `yaml:"dev_mode"`
+		// BasePath serves gossh under a URL prefix such as /gossh
+		BasePath string         `yaml:"base_path"`
+		Timeouts TimeoutsConfig `yaml:"timeouts"`
+		// ShutdownGrace is how long SIGTERM waits for sessions to end
+		ShutdownGrace   time.Duration `yaml:"shutdown_grace"`
+		ShutdownMessage string        `yaml:"shutdown_message"`
+		// Maintenance is the maintenance state at startup
+		Maintenance MaintenanceConfig `yaml:"maintenance"`
+		// RestartHandoff lets SIGUSR2 start a new process on the same listener
+		RestartHandoff bool `yaml:"restart_handoff"`
+	} `yaml:"server"`
+	Security struct {
+		FernetKey string `yaml:"fernet_key"`
+		// AllowQueryToken keeps old /?access=<token> links working. The
+		// token is exchanged and the browser redirected to a clean URL.
+		// /ws?access=<token> is refused without it too.
+		AllowQueryToken bool `yaml:"allow_query_token"`
+		// AllowClipboard lets programs in a session set the browser's
+		// clipboard with OSC 52, up to ClipboardMaxBytes of base64.
+		// Otherwise the sequences are dropped.
+		AllowClipboard    bool              `yaml:"allow_clipboard"`
+		ClipboardMaxBytes int               `yaml:"clipboard_max_bytes"`
+		Lockout           LockoutConfig     `yaml:"lockout"`
+		RateLimit         RateLimitConfig   `yaml:"rate_limit"`
+		Headers           map[string]string `yaml:"headers"`
+	} `yaml:"security"`
+	API struct {
+		RequireKey bool           `yaml:"require_key"`
+		Keys       []APIKeyConfig `yaml:"keys"`
+	} `yaml:"api"`
+	UI      UIConfig      `yaml:"ui"`
+	Session SessionConfig `yaml:"session"`
+	// WebSocket tunes the terminal connections
+	WebSocket  WebSocketConfig  `yaml:"ws"`
+	Vault      VaultConfig      `yaml:"vault"`
+	Authz      AuthzConfig      `yaml:"authz"`
+	Audit      AuditConfig      `yaml:"audit"`
+	Logging    LoggingConfig    `yaml:"logging"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Quotas     QuotaConfig      `yaml:"quotas"`
+	Forwarding ForwardingConfig `yaml:"forwarding"`
+	// Telnet allows sessions to telnet-only devices
+	Telnet TelnetConfig `yaml:"telnet"`
+	// SSH controls how hosts are reached
+	SSH SSHConfig `yaml:"ssh"`
+	// GRPC serves the terminal API to gRPC clients
+	GRPC GRPCConfig `yaml:"grpc"`
+	// Exec limits commands run through /api/exec
+	Exec ExecConfig `yaml:"exec"`
+	Jobs JobsConfig `yaml:"jobs"`
+	// Schedules run commands at set times
+	Schedules SchedulesConfig `yaml:"schedules"`
+	// Transfers tunes file transfers
+	Transfers TransfersConfig `yaml:"transfers"`
+	// Hosts are aliases users may give instead of an address
+	Hosts map[string]HostAlias `yaml:"hosts"`
+	// HostGroups define groups of hosts by member or by tags
+	HostGroups map[string]HostGroupConfig `yaml:"host_groups"`
+	// Recording keeps the output of terminal sessions
+	Recording RecordingConfig `yaml:"recording"`
+	// Approvals holds sessions to hosts whose policy requires approval
+	Approvals ApprovalsConfig `yaml:"approvals"`
+	// Profiles are saved connections managed through /api/profiles
+	Profiles ProfilesConfig `yaml:"profiles"`
+	// CredentialStore keeps credentials that never reach the browser
+	CredentialStore CredentialStoreConfig `yaml:"credential_store"`
+	// ManagedKeys are keypairs gossh generates for users
+	ManagedKeys ManagedKeysConfig `yaml:"managed_keys"`
+	// HostChecks probes hosts in the background
+	HostChecks HostChecksConfig `yaml:"host_checks"`
+	// History remembers each user's recent connections
+	History HistoryConfig `yaml:"history"`
+	// ErrorReporting forwards recovered panics to Sentry or a webhook
+	ErrorReporting ErrorReportingConfig `yaml:"error_reporting"`
+
+	// State derived from the settings above, built by loadConfig
+	allowlist      *clientAllowlist
+	tunnelTargets  []tunnelTarget
+	exposeTargets  []tunnelTarget
+	checkTargets   []tunnelTarget
+	trustedProxies []*net.IPNet
+	vault          *vaultClient
+	reporter       *errorReporter
+	aliasedHosts   map[string]*aliasedHost
+	hostGroups     map[string]*hostGroup
+	sshConfigFile  *sshConfigFile
+	autoResponses  map[string]*autoResponse
+	activityPrompt *regexp.Regexp
+	upgrader       *websocket.Upgrader
+	// scheduleEntries are Schedules.Entries, parsed and checked, and
+	// scheduleLocation the timezone they are read in
+	scheduleEntries  []*Schedule
+	scheduleLocation *time.Location
+}
+
+// configPath is read at startup and again on SIGHUP
+const configPath = "config.yaml"
+
+// activeConfig holds the configuration in use. A loaded Config is never
+// modified; reloading swaps in a new one.
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig returns the configuration in use. Handlers should call it
+// once per request and use the result throughout, so a concurrent reload
+// can't mix old and new settings.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// configStatus records when the configuration was last (re)loaded
+type configStatus struct {
+	mu         sync.Mutex
+	loaded     time.Time
+	lastReload time.Time
+	lastError  string
+}
+
+var configState = &configStatus{}
+
+// defaultPort is used when server.port is not set
+const defaultPort = 8022
+
+// envPrefix starts every configuration override variable
+const envPrefix = "GOSSH_"
+
+// applyDefaults fills in every setting left unset
+func (c *Config) applyDefaults() {
+	if c.Server.Address == "" {
+		c.Server.Address = "0.0.0.0"
+	}
+	if c.Server.Port == 0 {
+		c.Server.Port = defaultPort
+	}
+	if c.Server.ShutdownGrace == 0 {
+		c.Server.ShutdownGrace = defaultShutdownGrace
+	}
+	if c.Server.ShutdownMessage == "" {
+		c.Server.ShutdownMessage = defaultShutdownMessage
+	}
+	c.Server.BasePath = strings.TrimRight(c.Server.BasePath, "/")
+	c.Server.Timeouts.applyDefaults()
+	c.Server.CORS.applyDefaults()
+	c.UI.applyDefaults()
+	c.Session.applyDefaults()
+	c.WebSocket.applyDefaults()
+	if c.Security.ClipboardMaxBytes <= 0 {
+		c.Security.ClipboardMaxBytes = defaultClipboardMaxBytes
+	}
+	c.Security.Lockout.applyDefaults()
+	c.Security.RateLimit.applyDefaults()
+	c.Vault.applyDefaults()
+	c.Metrics.applyDefaults()
+	c.Quotas.applyDefaults()
+	c.Forwarding.applyDefaults()
+	c.SSH.applyDefaults()
+	c.Exec.applyDefaults()
+	c.Transfers.applyDefaults()
+	c.Jobs.applyDefaults()
+	c.Schedules.applyDefaults()
+	c.Recording.applyDefaults()
+	c.Approvals.applyDefaults()
+	c.HostChecks.applyDefaults()
+	c.Audit.Syslog.applyDefaults()
+	c.History.applyDefaults()
+	c.ErrorReporting.applyDefaults()
+}
+
+// loadConfig reads and validates filename and builds the state derived from
+// it. Nothing is installed, so a broken file can be rejected safely. Unknown
+// keys are errors, and all problems are reported at once.
+func loadConfig(filename string) (*Config, []*apiKey, error) {
+	// Environment variables take precedence over the file
+	cfg := &Config{}
+	overrides, err := config.Load(filename, cfg, envPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(overrides) > 0 {
+		slog.Info("Configuration overrides from the environment (env > file > defaults)", "variables", strings.Join(overrides, ","))
+	}
+
+	cfg.applyDefaults()
+
+	var problems []string
+	check := func(err error, format string) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf(format, err))
+		}
+	}
+
+	// Validate Fernet key
+	if cfg.Security.FernetKey == "" {
+		problems = append(problems, "security.fernet_key is not set")
+	} else if _, err := fernet.DecodeKeys(cfg.Security.FernetKey); err != nil {
+		problems = append(problems, fmt.Sprintf("security.fernet_key is invalid: %v", err))
+	}
+
+	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("server.port %d is out of range", cfg.Server.Port))
+	}
+	problems = append(problems, validateListenConfig(cfg)...)
+	problems = append(problems, validateBasePath(cfg.Server.BasePath)...)
+	problems = append(problems, validateCORSConfig(cfg.Server.CORS)...)
+	problems = append(problems, validateUIConfig(cfg.UI)...)
+	if cfg.Server.ShutdownGrace < 0 {
+		problems = append(problems, "server.shutdown_grace must not be negative")
+	}
+	check(validateAuditConfig(cfg.Audit), "%v")
+	check(validateLoggingConfig(cfg.Logging), "%v")
+	check(validateTracingConfig(cfg.Tracing), "%v")
+	check(validateQuotaConfig(cfg.Quotas), "%v")
+	check(validateWebSocketConfig(cfg.WebSocket), "%v")
+	cfg.upgrader = newUpgrader(cfg.WebSocket)
+	check(validateRateLimitConfig(cfg.Security.RateLimit), "%v")
+
+	keys, err := parseAPIKeys(cfg.API.Keys)
+	check(err, "api.keys: %v")
+
+	cfg.trustedProxies, err = parseCIDRs(cfg.Server.TrustedProxies)
+	check(err, "server.trusted_proxies: %v")
+
+	// Build client address allowlist
+	cfg.allowlist, err = newClientAllowlist(cfg.Server.AllowedClientCIDRs, cfg.Server.ClientCIDRExceptions)
+	check(err, "server.allowed_client_cidrs: %v")
+
+	cfg.tunnelTargets, err = parseTunnelTargets(cfg.Forwarding.AllowedTargets)
+	check(err, "forwarding.allowed_targets: %v")
+	cfg.exposeTargets, err = parseTunnelTargets(cfg.Forwarding.Expose)
+	check(err, "forwarding.expose: %v")
+	check(validateForwardingConfig(cfg.Forwarding), "%v")
+	check(validateSSHConfig(cfg.SSH), "%v")
+	cfg.checkTargets, err = parseTunnelTargets(cfg.SSH.CheckTargets)
+	check(err, "ssh.check_targets: %v")
+	problems = append(problems, validateGRPCConfig(cfg.GRPC)...)
+	check(validateExecConfig(cfg.Exec), "%v")
+	check(validateTransfersConfig(cfg.Transfers), "%v")
+	check(validateJobsConfig(cfg.Jobs), "%v")
+	cfg.scheduleEntries, cfg.scheduleLocation, err = parseSchedules(cfg.Schedules, cfg.Jobs.MaxTimeout)
+	check(err, "schedules: %v")
+	check(validateRecordingConfig(cfg.Recording), "%v")
+	check(validateHistoryConfig(cfg.History), "%v")
+	cfg.aliasedHosts, err = parseHostAliases(cfg.Hosts)
+	check(err, "hosts: %v")
+	cfg.hostGroups, err = parseHostGroups(cfg.HostGroups, cfg.Hosts)
+	check(err, "host_groups: %v")
+	if cfg.SSH.ConfigFile != "" {
+		cfg.sshConfigFile, err = parseSSHConfigFile(cfg.SSH.ConfigFile)
+		check(err, "ssh.config_file: %v")
+	}
+
+	// Connect the Vault credential source
+	cfg.vault, err = newVaultClient(cfg.Vault)
+	check(err, "vault: %v")
+
+	cfg.reporter, err = newErrorReporter(cfg.ErrorReporting)
+	check(err, "error_reporting: %v")
+
+	if len(cfg.Session.RestrictedCommands) > 0 {
+		_, err := newCommandPolicy([][]string{cfg.Session.RestrictedCommands})
+		check(err, "session.restricted_commands: %v")
+	}
+
+	// Validate authorization rules
+	check(validateAuthzConfig(&cfg.Authz, cfg.hostGroups), "authz: %v")
+	cfg.autoResponses, err = parseAutoResponses(cfg.Session.AutoResponses, cfg.Authz.Rules)
+	check(err, "session.auto_responses: %v")
+	cfg.activityPrompt, err = parseActivityPrompt(cfg.Session.Activity.Prompt)
+	check(err, "session.activity: %v")
+	check(validateLockConfig(cfg.Session), "%v")
+	check(validateApprovalsConfig(cfg.Approvals), "approvals: %v")
+	check(validateHostChecksConfig(cfg.HostChecks), "host_checks: %v")
+
+	if len(problems) > 0 {
+		return nil, nil, config.Problems(problems)
+	}
+	return cfg, keys, nil
+}
+
+// redactedConfig returns a copy of cfg with secrets masked, for display
+func redactedConfig(cfg *Config) Config {
+	c := *cfg
+	mask := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	mask(&c.Security.FernetKey)
+	mask(&c.Vault.Token)
+	mask(&c.Vault.SecretID)
+	mask(&c.ErrorReporting.DSN)
+	c.ErrorReporting.WebhookURL = redactedWebhook(c.ErrorReporting.WebhookURL)
+	c.Approvals.WebhookURL = redactedWebhook(c.Approvals.WebhookURL)
+	c.Schedules.WebhookURL = redactedWebhook(c.Schedules.WebhookURL)
+	c.SSH = c.SSH.redacted()
+	return c
+}
+
+// redactedWebhook keeps the scheme and host of a webhook URL. Its token
+// may be in the path (as with Slack), the query or the userinfo.
+func redactedWebhook(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+// printConfig writes the effective configuration as YAML with secrets
+// masked, for "gossh config print"
+func printConfig(w io.Writer, cfg *Config) error {
+	c := redactedConfig(cfg)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// installConfig makes cfg the configuration in use
+func installConfig(cfg *Config, keys []*apiKey) {
+	installAPIKeys(keys)
+	activeConfig.Store(cfg)
+
+	configState.mu.Lock()
+	configState.loaded = time.Now()
+	configState.mu.Unlock()
+}
+
+// restartRequired lists settings that differ between old and cfg but only
+// take effect at startup
+func restartRequired(old, cfg *Config) []string {
+	var fields []string
+	if old.Server.Address != cfg.Server.Address || old.Server.Port != cfg.Server.Port || old.Server.Listen != cfg.Server.Listen ||
+		old.Server.SocketMode != cfg.Server.SocketMode || old.Server.SocketOwner != cfg.Server.SocketOwner {
+		fields = append(fields, "server.address/server.port/server.listen")
+	}
+	if !reflect.DeepEqual(old.Server.Listeners, cfg.Server.Listeners) {
+		fields = append(fields, "server.listeners")
+	}
+	if old.Server.DebugEndpoints != cfg.Server.DebugEndpoints {
+		fields = append(fields, "server.debug_endpoints")
+	}
+	if old.Server.Maintenance != cfg.Server.Maintenance {
+		fields = append(fields, "server.maintenance")
+	}
+	if old.Forwarding.SOCKSListen != cfg.Forwarding.SOCKSListen {
+		fields = append(fields, "forwarding.socks_listen")
+	}
+	if old.GRPC != cfg.GRPC {
+		fields = append(fields, "grpc")
+	}
+	if old.Server.Timeouts != cfg.Server.Timeouts {
+		fields = append(fields, "server.timeouts")
+	}
+	if old.Server.TLS != cfg.Server.TLS {
+		fields = append(fields, "server.tls")
+	}
+	if old.Jobs.Dir != cfg.Jobs.Dir {
+		fields = append(fields, "jobs.dir")
+	}
+	if old.Schedules.Dir != cfg.Schedules.Dir {
+		fields = append(fields, "schedules.dir")
+	}
+	if old.Recording.Dir != cfg.Recording.Dir {
+		fields = append(fields, "recording.dir")
+	}
+	if old.Profiles != cfg.Profiles {
+		fields = append(fields, "profiles")
+	}
+	if old.CredentialStore != cfg.CredentialStore {
+		fields = append(fields, "credential_store")
+	}
+	if old.ManagedKeys.File != cfg.ManagedKeys.File {
+		fields = append(fields, "managed_keys.file")
+	}
+	if old.History.File != cfg.History.File {
+		fields = append(fields, "history.file")
+	}
+	if old.Audit != cfg.Audit {
+		fields = append(fields, "audit")
+	}
+	if old.Tracing != cfg.Tracing {
+		fields = append(fields, "tracing")
+	}
+	oldLogging, newLogging := old.Logging, cfg.Logging
+	oldLogging.Level, newLogging.Level = "", ""
+	if oldLogging != newLogging {
+		fields = append(fields, "logging")
+	}
+	return fields
+}
+
+// reloadConfig re-reads the config file and swaps it in. Active sessions
+// are unaffected. An invalid file is rejected and the old config kept.
+func reloadConfig() error {
+	cfg, keys, err := loadConfig(configPath)
+
+	configState.mu.Lock()
+	configState.lastReload = time.Now()
+	configState.lastError = errorString(err)
+	configState.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Config reload failed, keeping previous configuration", "err", err)
+		return err
+	}
+
+	// Settings bound at startup keep their old values until a restart
+	old := currentConfig()
+	for _, field := range restartRequired(old, cfg) {
+		slog.Warn("Config reload: setting changed but requires a restart to take effect", "setting", field)
+	}
+	cfg.Server.Address = old.Server.Address
+	cfg.Server.Port = old.Server.Port
+	cfg.Server.Listen = old.Server.Listen
+	cfg.Server.SocketMode = old.Server.SocketMode
+	cfg.Server.SocketOwner = old.Server.SocketOwner
+	cfg.Server.Listeners = old.Server.Listeners
+	cfg.Server.TLS = old.Server.TLS
+	cfg.Server.Timeouts = old.Server.Timeouts
+	cfg.Server.DebugEndpoints = old.Server.DebugEndpoints
+	cfg.Server.Maintenance = old.Server.Maintenance
+	cfg.Forwarding.SOCKSListen = old.Forwarding.SOCKSListen
+	cfg.GRPC = old.GRPC
+	cfg.Jobs.Dir = old.Jobs.Dir
+	cfg.Schedules.Dir = old.Schedules.Dir
+	cfg.Recording.Dir = old.Recording.Dir
+	cfg.Profiles = old.Profiles
+	cfg.CredentialStore = old.CredentialStore
+	cfg.ManagedKeys.File = old.ManagedKeys.File
+	cfg.History.File = old.History.File
+	cfg.Audit = old.Audit
+	cfg.Tracing = old.Tracing
+
+	// Of the logging settings only the level changes without a restart
+	level := cfg.Logging.Level
+	cfg.Logging = old.Logging
+	cfg.Logging.Level = level
+	parsed, _ := parseLogLevel(level)
+	logLevel.Set(parsed)
+
+	installConfig(cfg, keys)
+	slog.Info("Configuration reloaded", "path", configPath)
+	return nil
+}
+
+// status reports the reload state for the health endpoint
+func (s *configStatus) status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := map[string]interface{}{
+		"loaded": s.loaded,
+	}
+	if !s.lastReload.IsZero() {
+		reload := map[string]interface{}{
+			"time":    s.lastReload,
+			"success": s.lastError == "",
+		}
+		if s.lastError != "" {
+			reload["error"] = s.lastError
+		}
+		st["last_reload"] = reload
+	}
+	return st
+}
+
+// watchSIGHUP reloads the configuration, and the TLS certificates of the
+// HTTPS listeners, whenever the process receives SIGHUP
+func watchSIGHUP(certs []*certReloader) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			reloadConfig()
+			for _, c := range certs {
+				if err := c.reload(); err != nil {
+					slog.Error("TLS certificate reload failed, keeping previous certificate", "err", err)
+					continue
+				}
+				slog.Info("TLS certificate reloaded", "path", c.certFile)
+			}
+		}
+	}()
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+)
+
+// Failure classes of an SSH connection attempt
+const (
+	failureDNS       = "dns"
+	failureTimeout   = "timeout"
+	failureRefused   = "refused"
+	failureDial      = "dial"
+	failureHostKey   = "hostkey"
+	failureAuth      = "auth"
+	failureHandshake = "handshake"
+	// The port accepted the connection but sent no SSH banner
+	failureBanner = "banner"
+	// The proxy in front of the host couldn't be reached, failed, refused
+	// the target, or rejected gossh's credentials
+	failureProxyUnreachable = "proxy_unreachable"
+	failureProxy            = "proxy"
+	failureProxyRefused     = "proxy_refused"
+	failureProxyAuth        = "proxy_auth"
+)
+
+// recentConnections is how many connection records /api/stats/connections
+// keeps
+const recentConnections = 100
+
+// connectRecordKey carries a **connectRecord that dialSSH points at its
+// record, for callers that report the timings themselves
+type connectRecordKey struct{}
+
+// connectRecord is the timing breakdown of one SSH connection attempt
+type connectRecord struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	User     string    `json:"user,omitempty"`
+	Host     string    `json:"host"`
+	SSHUser  string    `json:"ssh_user"`
+	// Durations in milliseconds; DNS is 0 for IP addresses
+	DNSMs       float64 `json:"dns_ms"`
+	TCPMs       float64 `json:"tcp_ms"`
+	HandshakeMs float64 `json:"handshake_ms"`
+	TotalMs     float64 `json:"total_ms"`
+	// Proxy is the proxy the host was reached through; DNS and TCP times
+	// are then those of the proxy, and ProxyMs its handshake
+	Proxy   string  `json:"proxy,omitempty"`
+	ProxyMs float64 `json:"proxy_ms,omitempty"`
+	// AuthMethod is the method that succeeded, or the last one tried
+	AuthMethod string `json:"auth_method,omitempty"`
+	Failure    string `json:"failure,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	start                      time.Time
+	dns, tcp, proxy, handshake time.Duration
+	total, dialTimeout         time.Duration
+}
+
+func newConnectRecord(meta requestMeta, host, sshUser string, dialTimeout time.Duration) *connectRecord {
+	now := time.Now()
+	return &connectRecord{Time: now, ClientIP: meta.ClientIP, User: meta.User, Host: host, SSHUser: sshUser, start: now, dialTimeout: dialTimeout}
+}
+
+// finish records the outcome, logs the attempt and keeps it for
+// /api/stats/connections. A failure is returned as a ConnectError.
+func (c *connectRecord) finish(meta requestMeta, failure string, err error) error {
+	c.total = time.Since(c.start)
+	c.DNSMs, c.TCPMs, c.HandshakeMs, c.TotalMs = millis(c.dns), millis(c.tcp), millis(c.handshake), millis(c.total)
+	c.ProxyMs = millis(c.proxy)
+	c.Failure = failure
+	if err != nil {
+		c.Error = err.Error()
+	}
+	connectLog.add(*c)
+
+	attrs := []any{"host", c.Host, "ssh_user", c.SSHUser, "dns_ms", c.DNSMs, "tcp_ms", c.TCPMs,
+		"handshake_ms", c.HandshakeMs, "total_ms", c.TotalMs, "auth_method", c.AuthMethod}
+	if c.Proxy != "" {
+		attrs = append(attrs, "proxy", c.Proxy, "proxy_ms", c.ProxyMs)
+	}
+	if err == nil {
+		meta.Log.Info("SSH connection established", attrs...)
+		return nil
+	}
+	meta.Log.Warn("SSH connection failed", append(attrs, "failure", failure, "err", err)...)
+	return c.connectError(failure, err)
+}
+
+// connectError describes a failure of the attempt
+func (c *connectRecord) connectError(failure string, err error) *ConnectError {
+	// Name and TCP failures are those of the proxy or jump host when the
+	// connection went through one
+	addr := sshAddress(c.Host)
+	if _, _, splitErr := net.SplitHostPort(c.Proxy); splitErr == nil {
+		switch failure {
+		case failureDNS, failureTimeout, failureRefused, failureDial, failureProxyUnreachable:
+			addr = c.Proxy
+		}
+	}
+	return &ConnectError{Failure: failure, Addr: addr, Elapsed: c.stageTime(failure), Timeout: c.dialTimeout, AuthMethod: c.AuthMethod, Err: err}
+}
+
+// stageTime is how long the stage that failed took
+func (c *connectRecord) stageTime(failure string) time.Duration {
+	switch failure {
+	case failureDNS:
+		return c.dns
+	case failureTimeout, failureRefused, failureDial:
+		return c.tcp
+	case failureProxyUnreachable:
+		return c.dns + c.tcp
+	case failureProxy, failureProxyRefused, failureProxyAuth:
+		return c.proxy
+	}
+	return c.handshake
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// ConnectError is a failed SSH connection attempt. Its message says which
+// stage failed and how long it took, so users can tell a firewall from a
+// wrong password.
+type ConnectError struct {
+	Failure string
+	// Addr is the host:port the failed stage was talking to
+	Addr       string
+	Elapsed    time.Duration
+	Timeout    time.Duration
+	AuthMethod string
+	Err        error
+}
+
+func (e *ConnectError) Error() string {
+	elapsed := e.Elapsed.Round(time.Millisecond)
+	if elapsed == 0 {
+		elapsed = e.Elapsed.Round(time.Microsecond)
+	}
+	host, port, _ := net.SplitHostPort(e.Addr)
+	var stage string
+	switch e.Failure {
+	case failureDNS:
+		stage = fmt.Sprintf("DNS lookup failed for %s after %s", host, elapsed)
+	case failureTimeout:
+		if e.Timeout > 0 {
+			elapsed = e.Timeout
+		}
+		stage = fmt.Sprintf("TCP port %s of %s unreachable (filtered?): no answer after %s", port, host, elapsed.Round(time.Second))
+	case failureRefused:
+		stage = fmt.Sprintf("TCP port %s of %s refused the connection after %s (nothing listening?)", port, host, elapsed)
+	case failureDial:
+		stage = fmt.Sprintf("TCP connect to %s failed after %s", e.Addr, elapsed)
+	case failureBanner:
+		stage = fmt.Sprintf("connected to %s but no SSH banner received after %s", e.Addr, elapsed)
+	case failureProxyUnreachable:
+		stage = fmt.Sprintf("proxy unreachable after %s", elapsed)
+	case failureProxy:
+		stage = fmt.Sprintf("proxy handshake failed after %s", elapsed)
+	case failureProxyRefused:
+		stage = fmt.Sprintf("proxy refused the connection after %s", elapsed)
+	case failureProxyAuth:
+		stage = fmt.Sprintf("proxy authentication failed after %s", elapsed)
+	case failureHostKey:
+		stage = fmt.Sprintf("host key rejected after %s", elapsed)
+	case failureAuth:
+		stage = fmt.Sprintf("authentication failed after %s", elapsed)
+		if e.AuthMethod != "" {
+			stage += fmt.Sprintf(" (tried %s)", e.AuthMethod)
+		}
+	default:
+		stage = fmt.Sprintf("SSH handshake failed after %s", elapsed)
+	}
+	return fmt.Sprintf("%s: %v", stage, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// dialFailure classifies a failed name lookup, TCP dial or proxy handshake
+func dialFailure(err error) string {
+	var proxyErr *proxyError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &proxyErr):
+		return proxyErr.failure
+	case errors.As(err, &dnsErr):
+		return failureDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failureRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return failureTimeout
+	}
+	return failureDial
+}
+
+// hostOutcome maps a failure class to the outcomes counted per host
+func hostOutcome(failure string) string {
+	switch failure {
+	case "":
+		return connectSuccess
+	case failureTimeout:
+		return connectDialTimeout
+	case failureDNS, failureRefused, failureDial, failureProxyUnreachable, failureProxy, failureProxyRefused, failureProxyAuth:
+		return connectDialError
+	case failureAuth:
+		return connectAuthFailure
+	}
+	return connectHandshakeError
+}
+
+// authRecorder notes the authentication method most recently offered to
+// the server. Methods are tried one at a time, so after a successful
+// handshake it is the one that worked.
+type authRecorder struct {
+	method string
+	// keys is set once a key is among the methods offered
+	keys bool
+	// interactive is set once the user answered prompts of the server
+	interactive bool
+}
+
+func (a *authRecorder) password(password string) ssh.AuthMethod {
+	return ssh.PasswordCallback(func() (string, error) {
+		a.method = "password"
+		return password, nil
+	})
+}
+
+func (a *authRecorder) publicKeys(signers ...ssh.Signer) ssh.AuthMethod {
+	a.keys = true
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		a.method = "publickey"
+		return signers, nil
+	})
+}
+
+// connectLogRing keeps the most recent connection records in memory
+type connectLogRing struct {
+	mu      sync.Mutex
+	records []connectRecord
+	next    int
+}
+
+var connectLog = &connectLogRing{}
+
+func (l *connectLogRing) add(rec connectRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) < recentConnections {
+		l.records = append(l.records, rec)
+		return
+	}
+	l.records[l.next] = rec
+	l.next = (l.next + 1) % recentConnections
+}
+
+// recent returns the records newest first
+func (l *connectLogRing) recent() []connectRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]connectRecord, 0, len(l.records))
+	for i := range l.records {
+		idx := (l.next - 1 - i + 2*len(l.records)) % len(l.records)
+		out = append(out, l.records[idx])
+	}
+	return out
+}
+
+func connectLogHandler(w http.ResponseWriter, r *http.Request) {
+	httpapi.JSON(w, map[string]interface{}{
+		"connections": connectLog.recent(),
+	})
+}
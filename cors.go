@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// CORSConfig lets browser apps on other origins call the JSON API,
+// /upload and /download. The WebSocket origin policy is not affected.
+type CORSConfig struct {
+	// AllowedOrigins such as https://portal.example.com, or "*"
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"` // how long preflights are cached
+}
+
+func (c *CORSConfig) applyDefaults() {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = []string{"GET", "POST", "DELETE"}
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = []string{"Authorization", "Content-Type", requestIDHeader}
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = 10 * time.Minute
+	}
+}
+
+func validateCORSConfig(cfg CORSConfig) []string {
+	var problems []string
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			if cfg.AllowCredentials {
+				problems = append(problems, "server.cors: allowed_origins \"*\" can't be combined with allow_credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			problems = append(problems, fmt.Sprintf("server.cors: origin %q must look like https://host[:port]", origin))
+		}
+	}
+	return problems
+}
+
+// corsExposedHeaders may be read by scripts on allowed origins
+var corsExposedHeaders = strings.Join([]string{requestIDHeader, "Retry-After", "Content-Disposition", transfer.ChecksumHeader}, ", ")
+
+// corsPath reports whether path is an endpoint CORS applies to
+func corsPath(path string) bool {
+	switch path {
+	case "/upload", "/download", "/validate-download":
+		return true
+	}
+	return strings.HasPrefix(path, "/api/")
+}
+
+// allowsOrigin reports whether origin may call the API
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS answers preflight requests and adds CORS headers to responses
+// for allowed origins on the API endpoints
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig().Server.CORS
+		if len(cfg.AllowedOrigins) == 0 || !corsPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !cfg.allowsOrigin(origin) {
+			if preflight {
+				requestLogger(r).Warn("Refused CORS preflight", "origin", origin)
+				responder.ErrorCode(w, r, httpapi.Forbidden, "Origin not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if containsFold(cfg.AllowedOrigins, "*") && !cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !containsFold(cfg.AllowedMethods, method) {
+			responder.ErrorCode(w, r, httpapi.MethodNotAllowed, fmt.Sprintf("Method %s not allowed", method))
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if header = strings.TrimSpace(header); header != "" && !containsFold(cfg.AllowedHeaders, header) {
+				responder.ErrorCode(w, r, httpapi.Forbidden, fmt.Sprintf("Header %s not allowed", header))
+				return
+			}
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fernet/fernet-go"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+
+	"gossh/internal/httpapi"
+)
+
+// storedSourcePrefix names a credential held by gossh itself, e.g.
+// "stored:3f2a…", where vault: and vault-ssh: name ones held by Vault
+const storedSourcePrefix = "stored:"
+
+// CredentialStoreConfig keeps passwords and private keys on the server, so
+// sessions can log in without them passing through the browser
+type CredentialStoreConfig struct {
+	// File keeps the credentials across restarts, their secrets encrypted
+	// with security.fernet_key. Empty keeps them in memory only. Changes
+	// require a restart.
+	File string `yaml:"file"`
+}
+
+// StoredCredential is a password or private key, for use on the hosts
+// matching Hosts by the users and groups listed. Password and PrivateKey
+// are Fernet tokens, here and in the file, and never leave the server.
+type StoredCredential struct {
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+	// User is the SSH user to log in as; empty leaves it to the request
+	User string `yaml:"user,omitempty"`
+	// Hosts are shell patterns of the hostnames the credential is for
+	Hosts []string `yaml:"hosts"`
+	// Users and Groups may use the credential; with neither, no one may
+	Users  []string `yaml:"users,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+
+	Password   string `yaml:"password,omitempty"`
+	PrivateKey string `yaml:"private_key,omitempty"`
+	// KeyFingerprint is the SHA256 fingerprint of the private key's public
+	// half
+	KeyFingerprint string `yaml:"key_fingerprint,omitempty"`
+
+	Owner   string    `yaml:"owner,omitempty"`
+	Created time.Time `yaml:"created"`
+	Updated time.Time `yaml:"updated"`
+}
+
+// credentialView is a stored credential as the API returns it: everything
+// but the secrets
+type credentialView struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	User           string    `json:"user,omitempty"`
+	Hosts          []string  `json:"hosts"`
+	Users          []string  `json:"users,omitempty"`
+	Groups         []string  `json:"groups,omitempty"`
+	HasPassword    bool      `json:"has_password"`
+	HasPrivateKey  bool      `json:"has_private_key"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+	// Source is what connection requests and profiles name it by
+	Source string `json:"source"`
+}
+
+func (c *StoredCredential) view() credentialView {
+	return credentialView{
+		ID:             c.ID,
+		Name:           c.Name,
+		User:           c.User,
+		Hosts:          c.Hosts,
+		Users:          c.Users,
+		Groups:         c.Groups,
+		HasPassword:    c.Password != "",
+		HasPrivateKey:  c.PrivateKey != "",
+		KeyFingerprint: c.KeyFingerprint,
+		Owner:          c.Owner,
+		Created:        c.Created,
+		Updated:        c.Updated,
+		Source:         storedSourcePrefix + c.ID,
+	}
+}
+
+// matchesHost reports whether the credential is for host
+func (c *StoredCredential) matchesHost(host string) bool {
+	host = hostname(host)
+	for _, pattern := range c.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bound reports whether the credential names who may use it
+func (c *StoredCredential) bound() bool {
+	return len(c.Users) > 0 || len(c.Groups) > 0
+}
+
+// usableBy reports whether id may use the credential
+func (c *StoredCredential) usableBy(id Identity) bool {
+	if id.User == "" {
+		return false
+	}
+	if slices.Contains(c.Users, id.User) {
+		return true
+	}
+	for _, g := range identityGroups(&currentConfig().Authz, id) {
+		if slices.Contains(c.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialRequest is the body of POST /api/credentials and PUT
+// /api/credentials/{id}. A PUT without a password or private key keeps
+// the stored one.
+type credentialRequest struct {
+	Name       string   `json:"name"`
+	User       string   `json:"user"`
+	Hosts      []string `json:"hosts"`
+	Users      []string `json:"users"`
+	Groups     []string `json:"groups"`
+	Password   string   `json:"password"`
+	PrivateKey string   `json:"private_key"` // PEM, without a passphrase
+}
+
+// apply checks the request and copies it to c, encrypting the secrets
+func (req *credentialRequest) apply(c *StoredCredential) error {
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing name")
+	case len(req.Hosts) == 0:
+		return httpapi.Errorf(httpapi.MissingParams, "Missing hosts")
+	case len(req.Users) == 0 && len(req.Groups) == 0:
+		return httpapi.Errorf(httpapi.MissingParams, "Missing users or groups")
+	case req.Password == "" && req.PrivateKey == "" && c.Password == "" && c.PrivateKey == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing password or private_key")
+	}
+	for _, pattern := range req.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid host pattern %q", pattern)
+		}
+	}
+	fingerprint := c.KeyFingerprint
+	if req.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(req.PrivateKey))
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return httpapi.Errorf(httpapi.BadRequest, "The private key is encrypted; store it without its passphrase")
+		}
+		if err != nil {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid private key: %v", err)
+		}
+		fingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+	}
+	password, err := encryptSecret(req.Password)
+	if err != nil {
+		return err
+	}
+	privateKey, err := encryptSecret(req.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	c.Name = strings.TrimSpace(req.Name)
+	c.User = req.User
+	c.Hosts = req.Hosts
+	c.Users = req.Users
+	c.Groups = req.Groups
+	if password != "" {
+		c.Password = password
+	}
+	if privateKey != "" {
+		c.PrivateKey, c.KeyFingerprint = privateKey, fingerprint
+	}
+	return nil
+}
+
+// encryptSecret encrypts a secret with security.fernet_key. An empty
+// secret stays empty.
+func encryptSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	keys, err := fernet.DecodeKeys(getDefaultFernetKey())
+	if err != nil {
+		return "", fmt.Errorf("invalid fernet key: %v", err)
+	}
+	token, err := fernet.EncryptAndSign([]byte(secret), keys[0])
+	if err != nil {
+		return "", fmt.Errorf("Failed to encrypt the secret: %v", err)
+	}
+	return string(token), nil
+}
+
+// decryptSecret reverses encryptSecret
+func decryptSecret(token string) ([]byte, error) {
+	if token == "" {
+		return nil, nil
+	}
+	keys, err := fernet.DecodeKeys(getDefaultFernetKey())
+	if err != nil {
+		return nil, fmt.Errorf("invalid fernet key: %v", err)
+	}
+	secret := fernet.VerifyAndDecrypt([]byte(token), 0, keys)
+	if secret == nil {
+		return nil, fmt.Errorf("security.fernet_key doesn't decrypt it")
+	}
+	return secret, nil
+}
+
+// credentialStore holds the stored credentials, saving every change to
+// credential_store.file
+type credentialStore struct {
+	mu          sync.Mutex
+	credentials map[string]*StoredCredential
+	// file is credential_store.file as of startup
+	file string
+}
+
+var storedCredentials = &credentialStore{credentials: make(map[string]*StoredCredential)}
+
+// open loads the credentials kept in file, which need not exist yet
+func (s *credentialStore) open(file string) error {
+	if file == "" {
+		return nil
+	}
+	s.file = file
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("credential store %s: %v", file, err)
+	}
+	var list []*StoredCredential
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("credential store %s: %v", file, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range list {
+		if c.ID == "" {
+			return fmt.Errorf("credential store %s: credential %q has no id", file, c.Name)
+		}
+		if !c.bound() {
+			slog.Warn("Stored credential has no users or groups, so no one can use it", "credential", c.ID, "name", c.Name)
+		}
+		s.credentials[c.ID] = c
+	}
+	slog.Info("Loaded stored credentials", "file", file, "credentials", len(list))
+	return nil
+}
+
+// save writes every credential to the file, replacing it atomically. The
+// caller holds mu.
+func (s *credentialStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := yaml.Marshal(s.sorted())
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.file), ".credentials-*")
+	if err != nil {
+		return fmt.Errorf("Failed to store credentials: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to store credentials: %v", err)
+	}
+	return nil
+}
+
+// sorted lists the credentials by name. The caller holds mu.
+func (s *credentialStore) sorted() []*StoredCredential {
+	list := make([]*StoredCredential, 0, len(s.credentials))
+	for _, c := range s.credentials {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+func (s *credentialStore) list() []credentialView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []credentialView{}
+	for _, c := range s.sorted() {
+		list = append(list, c.view())
+	}
+	return list
+}
+
+// get returns a copy of credential cid
+func (s *credentialStore) get(cid string) (StoredCredential, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.credentials[cid]
+	if !ok {
+		return StoredCredential{}, false
+	}
+	return *c, true
+}
+
+// put adds or replaces c
+func (s *credentialStore) put(c *StoredCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.credentials[c.ID]
+	s.credentials[c.ID] = c
+	if err := s.save(); err != nil {
+		if existed {
+			s.credentials[c.ID] = prev
+		} else {
+			delete(s.credentials, c.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove deletes credential cid. Sessions logged in with it keep running.
+func (s *credentialStore) remove(cid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.credentials[cid]
+	if !ok {
+		return nil
+	}
+	delete(s.credentials, cid)
+	if err := s.save(); err != nil {
+		s.credentials[cid] = prev
+		return err
+	}
+	return nil
+}
+
+// lookup decrypts credential cid for id to log in to host with, auditing
+// the use and any refusal
+func (s *credentialStore) lookup(meta requestMeta, id Identity, cid, host, user string) (*vaultCredentials, error) {
+	c, ok := s.get(cid)
+	event := AuditEvent{
+		Event:    auditCredentialUse,
+		ClientIP: meta.ClientIP,
+		User:     id.User,
+		Host:     hostname(host),
+		SSHUser:  user,
+		Target:   cid,
+	}
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("stored credential %s does not exist", cid)
+	case !c.matchesHost(host):
+		err = fmt.Errorf("stored credential %s is not valid for host %s", cid, hostname(host))
+	case !c.bound():
+		err = fmt.Errorf("stored credential %s has no users or groups that may use it", cid)
+	case !c.usableBy(id):
+		err = fmt.Errorf("stored credential %s may not be used by %s", cid, id)
+	}
+	if err != nil {
+		event.Outcome, event.Error = outcomeDenied, err.Error()
+		audit.Emit(event)
+		meta.Log.Warn("Refused stored credential", "credential", cid, "host", hostname(host), "err", err)
+		return nil, err
+	}
+
+	creds := &vaultCredentials{User: c.User}
+	if creds.User != "" {
+		event.SSHUser = creds.User
+	}
+	password, err := decryptSecret(c.Password)
+	if err == nil {
+		creds.PrivateKey, err = decryptSecret(c.PrivateKey)
+	}
+	if err != nil {
+		event.Outcome, event.Error = outcomeFailure, err.Error()
+		audit.Emit(event)
+		meta.Log.Error("Failed to decrypt stored credential", "credential", cid, "err", err)
+		return nil, fmt.Errorf("stored credential %s can't be decrypted: %v", cid, err)
+	}
+	creds.Password = string(password)
+	event.Outcome = outcomeSuccess
+	audit.Emit(event)
+	meta.Log.Info("Using stored credential", "credential", cid, "host", hostname(host))
+	return creds, nil
+}
+
+// credentialsHandler lists the stored credentials on GET /api/credentials
+// and creates one on POST. Neither ever returns a secret.
+func credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, map[string]interface{}{
+			"success":     true,
+			"credentials": storedCredentials.list(),
+		})
+
+	case "POST":
+		now := time.Now()
+		c := &StoredCredential{ID: newJobID(), Owner: requestIdentity(r).User, Created: now, Updated: now}
+		if err := decodeCredentialRequest(w, r, c); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+		if err := storedCredentials.put(c); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditProfileChange(r, "credential_create", c.ID)
+		requestLogger(r).Info("Stored credential created", "credential", c.ID, "name", c.Name)
+		httpapi.JSONStatus(w, http.StatusCreated, c.view())
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// credentialHandler returns, replaces and deletes /api/credentials/{id}.
+// Deleting a credential leaves the profiles using it unable to connect;
+// the response lists them.
+func credentialHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/credentials/")
+	c, ok := storedCredentials.get(id)
+	if !ok {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Credential not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, c.view())
+
+	case "PUT":
+		if err := decodeCredentialRequest(w, r, &c); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+		c.Updated = time.Now()
+		if err := storedCredentials.put(&c); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditProfileChange(r, "credential_update", c.ID)
+		requestLogger(r).Info("Stored credential updated", "credential", c.ID, "name", c.Name)
+		httpapi.JSON(w, c.view())
+
+	case "DELETE":
+		if err := storedCredentials.remove(c.ID); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		invalidated := profiles.usingSource(storedSourcePrefix + c.ID)
+		auditProfileChange(r, "credential_delete", c.ID)
+		requestLogger(r).Info("Stored credential deleted", "credential", c.ID, "name", c.Name, "invalidated_profiles", len(invalidated))
+		httpapi.JSON(w, map[string]interface{}{
+			"success":              true,
+			"invalidated_profiles": invalidated,
+		})
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// decodeCredentialRequest reads a credential body into c
+func decodeCredentialRequest(w http.ResponseWriter, r *http.Request, c *StoredCredential) error {
+	var req credentialRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		return httpapi.Errorf(httpapi.BadRequest, "Invalid JSON body: %v", err)
+	}
+	return req.apply(c)
+}
+
+// credentialSourceProblem explains why a profile's or schedule's
+// credential source can't be used, or returns ""
+func credentialSourceProblem(source string) string {
+	if cid, ok := strings.CutPrefix(source, storedSourcePrefix); ok {
+		if _, ok := storedCredentials.get(cid); !ok {
+			return fmt.Sprintf("stored credential %s has been deleted", cid)
+		}
+	}
+	if kid, ok := strings.CutPrefix(source, managedKeySourcePrefix); ok {
+		if _, ok := managedKeys.get(kid); !ok {
+			return fmt.Sprintf("managed key %s has been deleted", kid)
+		}
+	}
+	return ""
+}
+
+// isCredentialSource reports whether source names a credential source
+func isCredentialSource(source string) bool {
+	return strings.HasPrefix(source, vaultSourcePrefix) || strings.HasPrefix(source, vaultSSHSourcePrefix) || strings.HasPrefix(source, storedSourcePrefix) || strings.HasPrefix(source, managedKeySourcePrefix)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCredentialRequestNeedsBinding(t *testing.T) {
+	useConfig(t, "")
+	req := &credentialRequest{Name: "db01", Hosts: []string{"db01"}, Password: "hunter2"}
+	if err := req.apply(&StoredCredential{}); err == nil {
+		t.Error("a credential without users or groups was accepted")
+	}
+	req.Groups = []string{"dba"}
+	if err := req.apply(&StoredCredential{}); err != nil {
+		t.Errorf("a credential bound to a group was refused: %v", err)
+	}
+}
+
+func TestStoredCredentialUsableBy(t *testing.T) {
+	useConfig(t, "")
+	c := &StoredCredential{Users: []string{"alice"}, Groups: []string{"dba"}}
+	tests := []struct {
+		id   Identity
+		want bool
+	}{
+		{Identity{User: "alice"}, true},
+		{Identity{User: "bob", Groups: []string{"dba"}}, true},
+		{Identity{User: "bob"}, false},
+		{Identity{}, false},
+	}
+	for _, tt := range tests {
+		if got := c.usableBy(tt.id); got != tt.want {
+			t.Errorf("usableBy(%+v) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+	if (&StoredCredential{}).usableBy(Identity{User: "alice"}) {
+		t.Error("a credential without users or groups is usable")
+	}
+}
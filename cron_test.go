@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		// at are minutes the expression must match, not those it must not
+		at, notAt []string
+	}{
+		{"*/15 * * * *", []string{"2026-01-05 10:00", "2026-01-05 10:45"}, []string{"2026-01-05 10:10"}},
+		{"30 2 * * *", []string{"2026-01-05 02:30"}, []string{"2026-01-05 03:30", "2026-01-05 02:31"}},
+		{"0 9-17/4 * * *", []string{"2026-01-05 09:00", "2026-01-05 13:00", "2026-01-05 17:00"}, []string{"2026-01-05 11:00", "2026-01-05 18:00"}},
+		{"5/20 * * * *", []string{"2026-01-05 10:05", "2026-01-05 10:25", "2026-01-05 10:45"}, []string{"2026-01-05 10:00", "2026-01-05 10:20"}},
+		{"0 0 1,15 * *", []string{"2026-01-01 00:00", "2026-01-15 00:00"}, []string{"2026-01-02 00:00"}},
+		{"0 0 * jan,JUL *", []string{"2026-01-05 00:00", "2026-07-05 00:00"}, []string{"2026-02-05 00:00"}},
+		{"0 0 * * mon-fri", []string{"2026-01-05 00:00", "2026-01-09 00:00"}, []string{"2026-01-10 00:00", "2026-01-11 00:00"}},
+		// Sunday is 0 or 7
+		{"0 0 * * 7", []string{"2026-01-11 00:00"}, []string{"2026-01-10 00:00"}},
+		{"0 0 * * 5-7", []string{"2026-01-09 00:00", "2026-01-11 00:00"}, []string{"2026-01-05 00:00"}},
+		// With both day fields restricted, either one matching is enough
+		{"0 0 13 * fri", []string{"2026-01-13 00:00", "2026-01-09 00:00", "2026-02-13 00:00"}, []string{"2026-01-12 00:00"}},
+		// With one of them *, only the other counts
+		{"0 0 13 * *", []string{"2026-01-13 00:00"}, []string{"2026-01-09 00:00"}},
+		{"0 0 */2 * fri", []string{"2026-01-09 00:00"}, []string{"2026-01-16 00:00", "2026-01-13 00:00"}},
+		{"@daily", []string{"2026-01-05 00:00"}, []string{"2026-01-05 01:00"}},
+		{"@WEEKLY", []string{"2026-01-11 00:00"}, []string{"2026-01-05 00:00"}},
+		{"@hourly", []string{"2026-01-05 07:00"}, []string{"2026-01-05 07:30"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, at := range tt.at {
+				if !c.matches(parseMinute(t, at, time.UTC)) {
+					t.Errorf("doesn't match %s", at)
+				}
+			}
+			for _, at := range tt.notAt {
+				if c.matches(parseMinute(t, at, time.UTC)) {
+					t.Errorf("matches %s", at)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * foo *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"10-5 * * * *",
+		"1-x * * * *",
+		"@reboot",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	tests := []struct {
+		expr string
+		loc  *time.Location
+		from string
+		want string // "" for never
+	}{
+		{"*/15 * * * *", time.UTC, "2026-01-05 10:00", "2026-01-05 10:15"},
+		{"*/15 * * * *", time.UTC, "2026-01-05 10:14", "2026-01-05 10:15"},
+		{"30 2 * * *", time.UTC, "2026-01-05 02:30", "2026-01-06 02:30"},
+		{"0 0 1 * *", time.UTC, "2026-12-15 08:00", "2027-01-01 00:00"},
+		{"0 0 29 2 *", time.UTC, "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 13 * fri", time.UTC, "2026-01-10 00:00", "2026-01-13 00:00"},
+		{"0 0 30 2 *", time.UTC, "2026-01-01 00:00", ""},
+
+		// Clocks go from 02:00 to 03:00 on 2026-03-29: 02:30 doesn't happen
+		// that day
+		{"30 2 * * *", berlin, "2026-03-28 12:00", "2026-03-30 02:30"},
+		{"*/30 * * * *", berlin, "2026-03-29 01:45", "2026-03-29 03:00"},
+		// They go back from 03:00 to 02:00 on 2026-10-25: 02:30 happens
+		// twice, once in summer time and once in winter time
+		{"30 2 * * *", berlin, "2026-10-25 00:00", "2026-10-25 02:30 +0200"},
+		{"30 2 * * *", berlin, "2026-10-25 02:30 +0200", "2026-10-25 02:30 +0100"},
+		{"30 2 * * *", berlin, "2026-10-25 02:30 +0100", "2026-10-26 02:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" from "+tt.from, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := c.next(parseMinute(t, tt.from, tt.loc))
+			if tt.want == "" {
+				if ok {
+					t.Errorf("next = %v, want never", got)
+				}
+				return
+			}
+			if want := parseMinute(t, tt.want, tt.loc); !ok || !got.Equal(want) {
+				t.Errorf("next = %v, %v; want %v", got, ok, want)
+			}
+			if got.Location() != tt.loc {
+				t.Errorf("next is in %v, want %v", got.Location(), tt.loc)
+			}
+		})
+	}
+}
+
+// TestCronAcrossDST walks the minutes of the days clocks change, as the
+// scheduler's loop does, and counts the runs
+func TestCronAcrossDST(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	tests := []struct {
+		expr string
+		day  string
+		runs int
+	}{
+		{"30 2 * * *", "2026-03-29", 0},
+		{"30 3 * * *", "2026-03-29", 1},
+		{"0 * * * *", "2026-03-29", 23},
+		{"30 2 * * *", "2026-10-25", 2},
+		{"0 * * * *", "2026-10-25", 25},
+		{"30 2 * * *", "2026-01-05", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" on "+tt.day, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := parseMinute(t, tt.day+" 00:00", berlin)
+			end := start.AddDate(0, 0, 1)
+			runs := 0
+			for at := start.UTC(); at.Before(end); at = at.Add(time.Minute) {
+				if c.matches(at.In(berlin)) {
+					runs++
+				}
+			}
+			if runs != tt.runs {
+				t.Errorf("%d runs, want %d", runs, tt.runs)
+			}
+		})
+	}
+}
+
+func TestScheduleSkipsOverlappingRuns(t *testing.T) {
+	useConfig(t, "")
+	s := newScheduler()
+	sch := &Schedule{ID: "backup", Cron: "* * * * *", Host: "db01:22", User: "backup", Command: "backup.sh", Source: "config"}
+	at := time.Date(2026, 1, 5, 2, 30, 0, 0, time.UTC)
+
+	// A run of the schedule is still going
+	s.running[sch.ID] = true
+	s.trigger(sch, at)
+	runs, running := s.history(sch.ID)
+	if !running || len(runs) != 1 {
+		t.Fatalf("runs %+v, running %v; want one skipped run while the other goes on", runs, running)
+	}
+	if run := runs[0]; run.Status != scheduleSkipped || !run.Scheduled.Equal(at) || run.Error != "the previous run is still running" {
+		t.Errorf("run %+v, want skipped at %v", run, at)
+	}
+	if run := runs[0]; run.failed() {
+		t.Error("a skipped run counts as failed")
+	}
+}
+
+// parseMinute reads "2006-01-02 15:04", with an optional UTC offset to
+// tell the repeated hour apart, in loc
+func parseMinute(t *testing.T, s string, loc *time.Location) time.Time {
+	t.Helper()
+	if at, err := time.ParseInLocation("2006-01-02 15:04 -0700", s, loc); err == nil {
+		return at.In(loc)
+	}
+	at, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s: %v", name, err)
+	}
+	return loc
+}
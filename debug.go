@@ -0,0 +1,57 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+)
+
+// openSSHClients counts SSH connections to target hosts that are still open
+var openSSHClients atomic.Int64
+
+// publishDebugVars adds gossh's own counters to /debug/vars
+func publishDebugVars() {
+	expvar.Publish("gossh_active_sessions", expvar.Func(func() any {
+		return sessions.count()
+	}))
+	expvar.Publish("gossh_ssh_clients", expvar.Func(func() any {
+		return openSSHClients.Load()
+	}))
+	// Messages waiting to be written to the terminals' WebSockets. A
+	// growing queue means browsers aren't keeping up with the output.
+	// Session IDs are left out, as they let their holder use the session.
+	expvar.Publish("gossh_ws_write_queue", expvar.Func(func() any {
+		var total, largest, waiting int32
+		for _, s := range sessions.snapshot() {
+			n := s.out.pending.Load()
+			total += n
+			largest = max(largest, n)
+			if n > 0 {
+				waiting++
+			}
+		}
+		return map[string]int32{"total": total, "max": largest, "sessions": waiting}
+	}))
+}
+
+// handleDebug registers pprof and expvar under /debug/ when
+// server.debug_endpoints is set. Listeners with the metrics role serve them
+// openly, as they are meant to be internal; elsewhere they need an admin key.
+func handleDebug(mux *http.ServeMux, role string) {
+	if !currentConfig().Server.DebugEndpoints || (role != roleAll && role != roleMetrics) {
+		return
+	}
+	wrap := func(h http.HandlerFunc) http.HandlerFunc {
+		if role == roleMetrics {
+			return h
+		}
+		return apiKeyAuth(scopeAdmin, h)
+	}
+	mux.HandleFunc("/debug/pprof/", wrap(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", wrap(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", wrap(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", wrap(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", wrap(pprof.Trace))
+	mux.HandleFunc("/debug/vars", wrap(expvar.Handler().ServeHTTP))
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fernet/fernet-go"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Credentials accepted by the demo server
+const (
+	demoUser     = "demo"
+	demoPassword = "demo"
+)
+
+// demoHome is the demo user's home directory inside the demo filesystem
+const demoHome = "/home/" + demoUser
+
+const demoWarning = `
+  *****************************************************************
+  *  DEMO MODE: the built-in SSH server at %s is not a real host.
+  *  It runs a toy shell on a temporary directory that is deleted
+  *  on exit. Log in as %s / %s. Do not expose this instance.
+  *****************************************************************
+
+`
+
+// demo is the embedded SSH server when running with -demo
+var demo *demoServer
+
+// demoServer is an in-process SSH server for trying gossh without a real
+// host. It offers a PTY shell, exec for the commands gossh's transfers use,
+// and SFTP, all confined to a temporary directory.
+type demoServer struct {
+	addr   string
+	dir    string
+	root   *os.Root
+	ln     net.Listener
+	config *ssh.ServerConfig
+}
+
+// demoLogin pre-fills the login form in demo mode
+type demoLogin struct {
+	Host     string
+	User     string
+	Password string
+}
+
+// demoRequested reports whether gossh was started with -demo
+func demoRequested() bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "-demo" || arg == "--demo" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDemoConfig writes a throwaway configuration for running -demo
+// without a config.yaml: a fresh Fernet key and a listener on localhost
+func writeDemoConfig() (string, error) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "gossh-demo-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "server:\n  address: 127.0.0.1\n  port: 8022\nsecurity:\n  fernet_key: %s\n", key.Encode())
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// startDemoServer creates the demo filesystem and starts accepting SSH
+// connections on a free localhost port
+func startDemoServer() (*demoServer, error) {
+	dir, err := os.MkdirTemp("", "gossh-demo-")
+	if err != nil {
+		return nil, err
+	}
+	d := &demoServer{dir: dir}
+	if err := d.setup(); err != nil {
+		d.close()
+		return nil, err
+	}
+	go d.serve()
+	return d, nil
+}
+
+func (d *demoServer) setup() error {
+	for _, sub := range []string{"tmp", "opt", strings.TrimPrefix(demoHome, "/")} {
+		if err := os.MkdirAll(filepath.Join(d.dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	readme := "This is the gossh demo server. Files you upload land in /tmp;\n" +
+		"download them again with the download button. Type help for the\n" +
+		"commands the demo shell understands.\n"
+	if err := os.WriteFile(filepath.Join(d.dir, demoHome, "README.txt"), []byte(readme), 0644); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(d.dir)
+	if err != nil {
+		return err
+	}
+	d.root = root
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return err
+	}
+	d.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == demoUser && string(password) == demoPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("demo server only accepts %s/%s", demoUser, demoPassword)
+		},
+		BannerCallback: func(c ssh.ConnMetadata) string {
+			return "gossh demo server: not a real host\n"
+		},
+	}
+	d.config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	d.ln = ln
+	d.addr = ln.Addr().String()
+	return nil
+}
+
+// close stops the server and deletes the demo filesystem
+func (d *demoServer) close() {
+	if d.ln != nil {
+		d.ln.Close()
+	}
+	if d.root != nil {
+		d.root.Close()
+	}
+	os.RemoveAll(d.dir)
+}
+
+func (d *demoServer) login() *demoLogin {
+	return &demoLogin{Host: d.addr, User: demoUser, Password: demoPassword}
+}
+
+func (d *demoServer) serve() {
+	for {
+		conn, err := d.ln.Accept()
+		if err != nil {
+			return
+		}
+		go d.handleConn(conn)
+	}
+}
+
+func (d *demoServer) handleConn(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, d.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		go d.handleSession(nc)
+	}
+}
+
+// ptyRequest is the payload of a pty-req channel request (RFC 4254 6.2)
+type ptyRequest struct {
+	Term          string
+	Cols, Rows    uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// windowChange is the payload of a window-change channel request
+type windowChange struct {
+	Cols, Rows    uint32
+	Width, Height uint32
+}
+
+func (d *demoServer) handleSession(nc ssh.NewChannel) {
+	channel, requests, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	var pty *ptyRequest
+	var terminal *term.Terminal
+	started := false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			var p ptyRequest
+			if ssh.Unmarshal(req.Payload, &p) == nil {
+				pty, ok = &p, true
+			}
+		case "window-change":
+			var w windowChange
+			if ssh.Unmarshal(req.Payload, &w) == nil && pty != nil {
+				pty.Cols, pty.Rows = w.Cols, w.Rows
+				if terminal != nil {
+					terminal.SetSize(int(w.Cols), int(w.Rows))
+				}
+				ok = true
+			}
+		case "env":
+			ok = true
+		case "shell":
+			if !started {
+				started, ok = true, true
+				terminal = term.NewTerminal(channel, "")
+				if pty != nil {
+					terminal.SetSize(int(pty.Cols), int(pty.Rows))
+				}
+				go d.runShell(channel, terminal)
+			}
+		case "exec":
+			var cmd struct{ Command string }
+			if !started && ssh.Unmarshal(req.Payload, &cmd) == nil {
+				started, ok = true, true
+				go d.runExec(channel, cmd.Command, pty != nil)
+			}
+		case "subsystem":
+			var sub struct{ Name string }
+			if !started && ssh.Unmarshal(req.Payload, &sub) == nil && sub.Name == "sftp" {
+				started, ok = true, true
+				go d.runSFTP(channel)
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// exitChannel reports the exit status and closes the channel
+func exitChannel(channel ssh.Channel, status int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	channel.Close()
+}
+
+func (d *demoServer) runShell(channel ssh.Channel, terminal *term.Terminal) {
+	fmt.Fprint(terminal, "Welcome to the gossh demo server.\n"+
+		"This is NOT a real host: commands run in a toy shell and files live in a\n"+
+		"temporary directory that is deleted when gossh exits. Type help to begin.\n\n")
+	sh := &demoShell{root: d.root, cwd: demoHome, stdout: terminal, stderr: terminal, interactive: true}
+	status := 0
+	for !sh.exited {
+		terminal.SetPrompt(sh.prompt())
+		line, err := terminal.ReadLine()
+		if err != nil {
+			break
+		}
+		status = sh.run(line)
+	}
+	exitChannel(channel, status)
+}
+
+func (d *demoServer) runExec(channel ssh.Channel, command string, pty bool) {
+	sh := &demoShell{root: d.root, cwd: demoHome, stdin: channel, stdout: channel, stderr: channel.Stderr()}
+	if pty {
+		// A terminal expects CRLF line endings
+		out := crlfWriter{channel}
+		sh.stdout, sh.stderr = out, out
+	}
+	slog.Debug("Demo server exec", "command", command)
+	exitChannel(channel, sh.run(command))
+}
+
+func (d *demoServer) runSFTP(channel ssh.Channel) {
+	server := sftp.NewRequestServer(channel, demoSFTPHandlers(d.root), sftp.WithStartDirectory(demoHome))
+	if err := server.Serve(); err != nil && err != io.EOF {
+		slog.Debug("Demo SFTP session ended", "err", err)
+	}
+	server.Close()
+	exitChannel(channel, 0)
+}
+
+// crlfWriter translates \n to \r\n for output to a PTY
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write([]byte(strings.ReplaceAll(string(p), "\n", "\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const demoHelp = `The demo shell understands:
+  cat [FILE...]        print files, or copy stdin when none are given
+  cd [DIR]             change directory (default ~)
+  clear                clear the screen
+  date                 print the current time
+  echo [-n] [ARG...]   print arguments
+  exit [N]             leave the shell
+  help                 show this help
+  hostname, whoami     print the host and user name
+  ls [-a] [-l] [PATH]  list a directory
+  mkdir [-p] DIR...    create directories
+  pwd                  print the working directory
+  rm [-r] [-f] PATH... remove files or directories
+  stat [-c FMT] FILE   show a file's size (FMT may use %s, %n and %F)
+  test EXPR, [ EXPR ]  check -e, -f or -d PATH
+  touch FILE...        create empty files
+  uname [-a]           print the system name
+Commands can be joined with &&, || and ;, and output redirected with > or >>.
+`
+
+// demoShell interprets the small command language of the demo server.
+// Paths are absolute within the demo filesystem and resolved through an
+// os.Root, so nothing outside it can be reached.
+type demoShell struct {
+	root        *os.Root
+	cwd         string
+	stdin       io.Reader
+	stdout      io.Writer
+	stderr      io.Writer
+	interactive bool
+	exited      bool
+}
+
+// shellToken is a word, or an operator when op is set
+type shellToken struct {
+	text string
+	op   bool
+}
+
+// tokenizeShell splits a command line into words and operators. Single and
+// double quotes and backslash escapes work as in sh; variables and globs
+// are not expanded.
+func tokenizeShell(line string) ([]shellToken, error) {
+	var tokens []shellToken
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			tokens = append(tokens, shellToken{text: word.String()})
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '#' && !inWord:
+			flush()
+			return tokens, nil
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case c == '"':
+			inWord = true
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errors.New("unterminated quote")
+				}
+				if line[i] == '"' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte(`"\$`+"`", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+		case c == '\\':
+			if i+1 < len(line) {
+				i++
+				word.WriteByte(line[i])
+				inWord = true
+			}
+		case c == '&' || c == '|' || c == ';' || c == '>':
+			flush()
+			op := string(c)
+			if i+1 < len(line) && line[i+1] == c && c != ';' {
+				op += string(c)
+				i++
+			}
+			switch op {
+			case "&":
+				return nil, errors.New("background jobs are not supported")
+			case "|":
+				return nil, errors.New("pipes are not supported")
+			}
+			tokens = append(tokens, shellToken{text: op, op: true})
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+// run executes a command line and returns its exit status
+func (s *demoShell) run(line string) int {
+	tokens, err := tokenizeShell(line)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "demo-sh: %v\n", err)
+		return 2
+	}
+	status := 0
+	skip := false
+	var cmd []shellToken
+	for i := 0; i <= len(tokens) && !s.exited; i++ {
+		if i < len(tokens) {
+			if t := tokens[i]; !t.op || t.text == ">" || t.text == ">>" {
+				cmd = append(cmd, t)
+				continue
+			}
+		}
+		if len(cmd) > 0 && !skip {
+			status = s.runCommand(cmd)
+		}
+		cmd = nil
+		if i < len(tokens) {
+			switch tokens[i].text {
+			case "&&":
+				skip = status != 0
+			case "||":
+				skip = status == 0
+			default:
+				skip = false
+			}
+		}
+	}
+	return status
+}
+
+// runCommand runs one simple command with its redirections
+func (s *demoShell) runCommand(tokens []shellToken) int {
+	var args []string
+	out := s.stdout
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if !t.op {
+			args = append(args, t.text)
+			continue
+		}
+		if i+1 >= len(tokens) || tokens[i+1].op {
+			fmt.Fprintf(s.stderr, "demo-sh: %s needs a file name\n", t.text)
+			return 2
+		}
+		i++
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if t.text == ">>" {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		_, rel := s.resolve(tokens[i].text)
+		f, err := s.root.OpenFile(rel, flags, 0644)
+		if err != nil {
+			s.fail("demo-sh", tokens[i].text, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if len(args) == 0 {
+		return 0
+	}
+
+	c := &demoCommand{shell: s, name: args[0], args: args[1:], out: out}
+	switch args[0] {
+	case "help":
+		io.WriteString(out, demoHelp)
+	case "echo":
+		return c.echo()
+	case "pwd":
+		fmt.Fprintln(out, s.cwd)
+	case "cd":
+		return c.cd()
+	case "ls":
+		return c.ls()
+	case "cat":
+		return c.cat()
+	case "touch":
+		return c.touch()
+	case "mkdir":
+		return c.mkdir()
+	case "rm":
+		return c.rm()
+	case "stat":
+		return c.stat()
+	case "test":
+		return c.test(c.args)
+	case "[":
+		if len(c.args) == 0 || c.args[len(c.args)-1] != "]" {
+			fmt.Fprintln(s.stderr, "[: missing ]")
+			return 2
+		}
+		return c.test(c.args[:len(c.args)-1])
+	case "true", ":":
+	case "false":
+		return 1
+	case "whoami":
+		fmt.Fprintln(out, demoUser)
+	case "hostname":
+		fmt.Fprintln(out, "gossh-demo")
+	case "uname":
+		if len(c.args) > 0 && c.args[0] == "-a" {
+			fmt.Fprintf(out, "GosshDemo gossh-demo %s demo-shell\n", build.Version)
+		} else {
+			fmt.Fprintln(out, "GosshDemo")
+		}
+	case "date":
+		fmt.Fprintln(out, time.Now().Format(time.UnixDate))
+	case "clear":
+		fmt.Fprint(out, "\x1b[H\x1b[2J")
+	case "exit":
+		s.exited = true
+		if len(c.args) > 0 {
+			n, err := strconv.Atoi(c.args[0])
+			if err != nil {
+				return 2
+			}
+			return n
+		}
+	default:
+		fmt.Fprintf(s.stderr, "demo-sh: %s: command not found (this is the gossh demo shell; type help)\n", args[0])
+		return 127
+	}
+	return 0
+}
+
+// prompt shows the working directory with the home directory as ~
+func (s *demoShell) prompt() string {
+	dir := s.cwd
+	if dir == demoHome || strings.HasPrefix(dir, demoHome+"/") {
+		dir = "~" + dir[len(demoHome):]
+	}
+	return demoUser + "@gossh-demo:" + dir + "$ "
+}
+
+// resolve returns the absolute path of p within the demo filesystem and
+// the corresponding name relative to its root
+func (s *demoShell) resolve(p string) (string, string) {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = demoHome + p[1:]
+	}
+	abs := p
+	if !path.IsAbs(p) {
+		abs = path.Join(s.cwd, p)
+	}
+	abs = path.Clean(abs)
+	return abs, rootPath(abs)
+}
+
+// rootPath converts an absolute demo path to a name for os.Root
+func rootPath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// fail prints an error the way coreutils do: "cmd: path: No such file..."
+func (s *demoShell) fail(cmd, arg string, err error) {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	msg := err.Error()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		msg = "No such file or directory"
+	case errors.Is(err, fs.ErrExist):
+		msg = "File exists"
+	case errors.Is(err, fs.ErrPermission):
+		msg = "Permission denied"
+	}
+	fmt.Fprintf(s.stderr, "%s: %s: %s\n", cmd, arg, msg)
+}
+
+// demoCommand is a builtin being run
+type demoCommand struct {
+	shell *demoShell
+	name  string
+	args  []string
+	out   io.Writer
+}
+
+// flags splits leading single-letter options from the operands
+func (c *demoCommand) flags(allowed string) (map[byte]bool, []string, bool) {
+	set := map[byte]bool{}
+	args := c.args
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		for i := 1; i < len(args[0]); i++ {
+			if strings.IndexByte(allowed, args[0][i]) < 0 {
+				fmt.Fprintf(c.shell.stderr, "%s: invalid option -- '%c'\n", c.name, args[0][i])
+				return nil, nil, false
+			}
+			set[args[0][i]] = true
+		}
+		args = args[1:]
+	}
+	return set, args, true
+}
+
+func (c *demoCommand) echo() int {
+	args := c.args
+	newline := true
+	if len(args) > 0 && args[0] == "-n" {
+		newline = false
+		args = args[1:]
+	}
+	fmt.Fprint(c.out, strings.Join(args, " "))
+	if newline {
+		fmt.Fprintln(c.out)
+	}
+	return 0
+}
+
+func (c *demoCommand) cd() int {
+	dir := demoHome
+	if len(c.args) > 0 {
+		dir = c.args[0]
+	}
+	abs, rel := c.shell.resolve(dir)
+	info, err := c.shell.root.Stat(rel)
+	if err != nil {
+		c.shell.fail(c.name, dir, err)
+		return 1
+	}
+	if !info.IsDir() {
+		fmt.Fprintf(c.shell.stderr, "%s: %s: Not a directory\n", c.name, dir)
+		return 1
+	}
+	c.shell.cwd = abs
+	return 0
+}
+
+func (c *demoCommand) ls() int {
+	opts, args, ok := c.flags("al")
+	if !ok {
+		return 2
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	status := 0
+	for _, arg := range args {
+		_, rel := c.shell.resolve(arg)
+		info, err := c.shell.root.Stat(rel)
+		if err != nil {
+			c.shell.fail(c.name, arg, err)
+			status = 2
+			continue
+		}
+		entries := []fs.FileInfo{info}
+		if info.IsDir() {
+			if len(args) > 1 {
+				fmt.Fprintf(c.out, "%s:\n", arg)
+			}
+			entries, err = c.readDir(rel)
+			if err != nil {
+				c.shell.fail(c.name, arg, err)
+				status = 2
+				continue
+			}
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") && !opts['a'] {
+				continue
+			}
+			if opts['l'] {
+				fmt.Fprintf(c.out, "%s %-6s %8d %s %s\n", e.Mode(), demoUser, e.Size(), e.ModTime().Format("Jan _2 15:04"), e.Name())
+			} else {
+				fmt.Fprintln(c.out, e.Name())
+			}
+		}
+	}
+	return status
+}
+
+func (c *demoCommand) readDir(rel string) ([]fs.FileInfo, error) {
+	dir, err := c.shell.root.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	entries, err := dir.Readdir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+func (c *demoCommand) cat() int {
+	if len(c.args) == 0 {
+		if c.shell.interactive || c.shell.stdin == nil {
+			fmt.Fprintf(c.shell.stderr, "%s: reading the terminal is not supported in the demo shell\n", c.name)
+			return 1
+		}
+		if _, err := io.Copy(c.out, c.shell.stdin); err != nil {
+			return 1
+		}
+		return 0
+	}
+	status := 0
+	for _, arg := range c.args {
+		_, rel := c.shell.resolve(arg)
+		f, err := c.shell.root.Open(rel)
+		if err == nil {
+			_, err = io.Copy(c.out, f)
+			f.Close()
+		}
+		if err != nil {
+			c.shell.fail(c.name, arg, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func (c *demoCommand) touch() int {
+	status := 0
+	for _, arg := range c.args {
+		_, rel := c.shell.resolve(arg)
+		f, err := c.shell.root.OpenFile(rel, os.O_WRONLY|os.O_CREATE, 0644)
+		if err == nil {
+			f.Close()
+			now := time.Now()
+			err = c.shell.root.Chtimes(rel, now, now)
+		}
+		if err != nil {
+			c.shell.fail(c.name, arg, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func (c *demoCommand) mkdir() int {
+	opts, args, ok := c.flags("p")
+	if !ok {
+		return 2
+	}
+	status := 0
+	for _, arg := range args {
+		_, rel := c.shell.resolve(arg)
+		var err error
+		if opts['p'] {
+			err = c.shell.root.MkdirAll(rel, 0755)
+		} else {
+			err = c.shell.root.Mkdir(rel, 0755)
+		}
+		if err != nil {
+			c.shell.fail(c.name, arg, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func (c *demoCommand) rm() int {
+	opts, args, ok := c.flags("rRf")
+	if !ok {
+		return 2
+	}
+	status := 0
+	for _, arg := range args {
+		abs, rel := c.shell.resolve(arg)
+		if abs == "/" {
+			fmt.Fprintf(c.shell.stderr, "%s: refusing to remove /\n", c.name)
+			status = 1
+			continue
+		}
+		var err error
+		if opts['r'] || opts['R'] {
+			if _, err = c.shell.root.Lstat(rel); err == nil {
+				err = c.shell.root.RemoveAll(rel)
+			}
+		} else {
+			err = c.shell.root.Remove(rel)
+		}
+		if err != nil && !(opts['f'] && errors.Is(err, fs.ErrNotExist)) {
+			c.shell.fail(c.name, arg, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func (c *demoCommand) stat() int {
+	args := c.args
+	format := ""
+	if len(args) > 1 && args[0] == "-c" {
+		format, args = args[1], args[2:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(c.shell.stderr, "%s: missing operand\n", c.name)
+		return 1
+	}
+	status := 0
+	for _, arg := range args {
+		_, rel := c.shell.resolve(arg)
+		info, err := c.shell.root.Stat(rel)
+		if err != nil {
+			c.shell.fail(c.name, "cannot stat '"+arg+"'", err)
+			status = 1
+			continue
+		}
+		kind := "regular file"
+		if info.IsDir() {
+			kind = "directory"
+		}
+		if format == "" {
+			fmt.Fprintf(c.out, "  File: %s\n  Size: %d\n  Type: %s\nModify: %s\n", arg, info.Size(), kind, info.ModTime().Format(time.RFC3339))
+			continue
+		}
+		fmt.Fprintln(c.out, strings.NewReplacer("%s", strconv.FormatInt(info.Size(), 10), "%n", arg, "%F", kind, "%%", "%").Replace(format))
+	}
+	return status
+}
+
+func (c *demoCommand) test(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(c.shell.stderr, "%s: only -e, -f and -d PATH are supported\n", c.name)
+		return 2
+	}
+	_, rel := c.shell.resolve(args[1])
+	info, err := c.shell.root.Stat(rel)
+	var ok bool
+	switch args[0] {
+	case "-e":
+		ok = err == nil
+	case "-f":
+		ok = err == nil && info.Mode().IsRegular()
+	case "-d":
+		ok = err == nil && info.IsDir()
+	default:
+		fmt.Fprintf(c.shell.stderr, "%s: unsupported test %s\n", c.name, args[0])
+		return 2
+	}
+	if ok {
+		return 0
+	}
+	return 1
+}
+
+// demoFS serves SFTP requests from the demo filesystem
+type demoFS struct {
+	root *os.Root
+}
+
+func demoSFTPHandlers(root *os.Root) sftp.Handlers {
+	h := demoFS{root: root}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (d demoFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return d.root.Open(rootPath(r.Filepath))
+}
+
+func (d demoFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	// Writes carry explicit offsets, so O_APPEND (which WriteAt rejects)
+	// is not passed on
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return d.root.OpenFile(rootPath(r.Filepath), flags, 0644)
+}
+
+func (d demoFS) Filecmd(r *sftp.Request) error {
+	name := rootPath(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		attrs := r.AttrFlags()
+		if attrs.Permissions {
+			if err := d.root.Chmod(name, r.Attributes().FileMode().Perm()); err != nil {
+				return err
+			}
+		}
+		if attrs.Size {
+			f, err := d.root.OpenFile(name, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return f.Truncate(int64(r.Attributes().Size))
+		}
+		return nil
+	case "Rename":
+		return d.root.Rename(name, rootPath(r.Target))
+	case "Rmdir", "Remove":
+		return d.root.Remove(name)
+	case "Mkdir":
+		return d.root.Mkdir(name, 0755)
+	}
+	// Links could point out of the demo filesystem
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (d demoFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := rootPath(r.Filepath)
+	switch r.Method {
+	case "List":
+		dir, err := d.root.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		entries, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return demoListerAt(entries), nil
+	case "Stat":
+		info, err := d.root.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return demoListerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (d demoFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := d.root.Lstat(rootPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return demoListerAt{info}, nil
+}
+
+// demoListerAt pages directory listings out to the SFTP server
+type demoListerAt []fs.FileInfo
+
+func (l demoListerAt) ListAt(ls []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Values of ssh.ip_family
+const (
+	ipFamilyAny        = "any"
+	ipFamilyIPv4       = "ipv4"
+	ipFamilyIPv6       = "ipv6"
+	ipFamilyPreferIPv4 = "prefer-ipv4"
+	ipFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// defaultAttemptTimeout bounds each TCP connect before the next address is
+// tried
+const defaultAttemptTimeout = 3 * time.Second
+
+func validateIPFamily(family string) error {
+	switch family {
+	case ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6, ipFamilyPreferIPv4, ipFamilyPreferIPv6:
+		return nil
+	}
+	return fmt.Errorf("ssh.ip_family %q: want any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6", family)
+}
+
+// orderAddresses filters and orders the addresses host resolved to per
+// ssh.ip_family. Resolver order is kept within each family.
+func orderAddresses(host string, addrs []string, family string) ([]string, error) {
+	if family == ipFamilyAny {
+		return addrs, nil
+	}
+	var v4, v6 []string
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() == nil {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	var ordered []string
+	switch family {
+	case ipFamilyIPv4:
+		ordered = v4
+	case ipFamilyIPv6:
+		ordered = v6
+	case ipFamilyPreferIPv4:
+		ordered = append(v4, v6...)
+	case ipFamilyPreferIPv6:
+		ordered = append(v6, v4...)
+	}
+	if len(ordered) == 0 {
+		return nil, &net.DNSError{Err: "no " + family + " address", Name: host, IsNotFound: true}
+	}
+	return ordered, nil
+}
+
+// attemptTimeout is how long to try the i-th of n addresses. Every address
+// but the last gets at most the attempt timeout; the last one gets what is
+// left of the connect timeout.
+func attemptTimeout(i, n int, attempt time.Duration, deadline time.Time) time.Duration {
+	var remaining time.Duration
+	if !deadline.IsZero() {
+		remaining = time.Until(deadline)
+		if remaining <= 0 {
+			remaining = time.Millisecond
+		}
+	}
+	if i == n-1 || (remaining > 0 && remaining < attempt) {
+		return remaining
+	}
+	return attempt
+}
+
+// validateSourceAddress checks that source is an address of this host, or
+// the name of an interface with addresses
+func validateSourceAddress(source string) error {
+	if source == "" {
+		return nil
+	}
+	if ip := net.ParseIP(source); ip != nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not an address of any interface", source)
+	}
+	ips, err := interfaceIPs(source)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("interface %s has no addresses", source)
+	}
+	return nil
+}
+
+func interfaceIPs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor an interface: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips, nil
+}
+
+// sourceAddress picks the local address to connect to target from, or nil
+// when source is empty. Interface addresses are looked up on every dial;
+// link-local ones are skipped.
+func sourceAddress(source, target string) (net.Addr, error) {
+	if source == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(target)
+	ips := []net.IP{net.ParseIP(source)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = interfaceIPs(source); err != nil {
+			return nil, err
+		}
+	}
+	for _, local := range ips {
+		if (local.To4() == nil) == (ip.To4() == nil) && !local.IsLinkLocalUnicast() {
+			return &net.TCPAddr{IP: local}, nil
+		}
+	}
+	return nil, fmt.Errorf("source address %s can't reach %s: no address of the same family", source, target)
+}
+
+// bindError names the source address when the connection couldn't be
+// bound to it
+func bindError(err error, local net.Addr) error {
+	if err == nil || local == nil {
+		return err
+	}
+	if errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("can't bind source address %s: %w", local.(*net.TCPAddr).IP, err)
+	}
+	return err
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// /api/files/df tells how full the filesystem holding a path is, and
+// /api/files/du how large the entries of a directory are, so the file
+// browser can warn before uploads fail and show folder sizes.
+
+// duProbeCommand succeeds on hosts with the commands du sizes entries with
+const duProbeCommand = `command -v du >/dev/null 2>&1 && command -v find >/dev/null 2>&1 && command -v xargs >/dev/null 2>&1`
+
+// duListCommand lists the NUL-separated entries of a directory, its
+// subdirectories or the rest
+const duListCommand = `find %s -mindepth 1 -maxdepth 1 %s -type d -print0`
+
+// dfResponse is the body of a successful /api/files/df
+type dfResponse struct {
+	Path string `json:"path"`
+	transfer.FSUsage
+}
+
+// duEntry is an entry of the directory /api/files/du sizes
+type duEntry struct {
+	Name string `json:"name"`
+	Dir  bool   `json:"dir"`
+	Size int64  `json:"size"`
+	// Partial is set when Size counts only part of the entry, or none of
+	// it, as a limit ended the sizing first
+	Partial bool `json:"partial,omitempty"`
+}
+
+// duResponse is the body of a successful /api/files/du. Entries are
+// ordered from the largest.
+type duResponse struct {
+	Path    string    `json:"path"`
+	Method  string    `json:"method"` // du or sftp
+	Total   int64     `json:"total"`
+	Entries []duEntry `json:"entries"`
+	// Truncated is set when Entries leaves out entries or counts some only
+	// in part; Stopped names the limit: entries, files or timeout
+	Truncated bool   `json:"truncated"`
+	Stopped   string `json:"stopped,omitempty"`
+}
+
+// diskTarget resolves and authorizes the target of a df or du request,
+// returning it with the path asked about
+func diskTarget(r *http.Request) (*transferTarget, string, error) {
+	if err := maintenance.check(); err != nil {
+		return nil, "", err
+	}
+	remotePath := r.URL.Query().Get("path")
+	target, err := resolveTransferTarget(r, opDownload, r.URL.Query().Get)
+	if err == nil && remotePath == "" {
+		err = httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := authorize(r, target.Host, target.User, opDownload); err != nil {
+		return nil, "", err
+	}
+	return target, remotePath, nil
+}
+
+func dfHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	target, remotePath, err := diskTarget(r)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "files.df")
+	var resp dfResponse
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		if resp.Path, err = transfer.HostDownloadPath(sshConn, remotePath); err == nil {
+			p := resp.Path
+			if transfer.Platform(sshConn) == transfer.Windows {
+				p = "/" + p
+			}
+			resp.FSUsage, err = transfer.FilesystemUsage(sshConn, nil, p)
+		}
+		release()
+	}
+	endSpan(span, err)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.TransferFailed)
+		return
+	}
+	httpapi.JSON(w, resp)
+}
+
+func duHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	target, remotePath, err := diskTarget(r)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "files.du")
+	var resp duResponse
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		if resp.Path, err = transfer.HostDownloadPath(sshConn, remotePath); err == nil {
+			cfg := currentConfig().Transfers
+			duCtx, cancel := context.WithTimeout(ctx, cfg.DUTimeout)
+			err = diskUsage(duCtx, sshConn, &resp, cfg.DUMaxEntries, cfg.DUMaxFiles)
+			if duCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				resp.Truncated, resp.Stopped = true, "timeout"
+			}
+			cancel()
+		}
+		release()
+	}
+	endSpan(span, err)
+	if err != nil {
+		meta.Log.Error("Disk usage failed", "host", target.Host, "ssh_user", target.User, "path", remotePath, "err", err)
+		responder.Error(w, r, err, httpapi.TransferFailed)
+		return
+	}
+
+	sort.SliceStable(resp.Entries, func(a, b int) bool { return resp.Entries[a].Size > resp.Entries[b].Size })
+	for _, e := range resp.Entries {
+		resp.Total += e.Size
+		resp.Truncated = resp.Truncated || e.Partial
+	}
+	if resp.Entries == nil {
+		resp.Entries = []duEntry{}
+	}
+	httpapi.JSON(w, resp)
+}
+
+// diskUsage sizes up to maxEntries entries of resp.Path with du where the
+// host has it, and over SFTP otherwise, until ctx ends
+func diskUsage(ctx context.Context, sshConn *ssh.Client, resp *duResponse, maxEntries, maxFiles int) error {
+	if transfer.Platform(sshConn) != transfer.Windows {
+		if _, err := transfer.CommandOutput(sshConn, duProbeCommand, transfer.ProbeTimeout); err == nil {
+			resp.Method = "du"
+			return duViaSSH(ctx, sshConn, resp, maxEntries)
+		}
+	}
+	resp.Method = "sftp"
+	client, err := sftp.NewClient(sshConn)
+	if err != nil {
+		return fmt.Errorf("the host has neither du nor SFTP: %v", err)
+	}
+	defer client.Close()
+	dir := resp.Path
+	if transfer.Platform(sshConn) == transfer.Windows {
+		dir = "/" + dir
+	}
+	return duViaSFTP(ctx, client, dir, resp, maxEntries, maxFiles)
+}
+
+// duViaSSH lists the entries with find and sizes them with du -sk, in
+// 1024-byte blocks of disk used
+func duViaSSH(ctx context.Context, sshConn *ssh.Client, resp *duResponse, maxEntries int) error {
+	dir := transfer.ShellQuote(resp.Path)
+	dirs, more, err := listNames(ctx, sshConn, fmt.Sprintf(duListCommand, dir, ""), maxEntries)
+	if err != nil {
+		return err
+	}
+	var files []string
+	if !more {
+		files, more, err = listNames(ctx, sshConn, fmt.Sprintf(duListCommand, dir, "!"), maxEntries-len(dirs))
+		if err != nil {
+			return err
+		}
+	}
+	if more {
+		resp.Truncated, resp.Stopped = true, "entries"
+	}
+
+	names := append(dirs, files...)
+	if len(names) == 0 {
+		return nil
+	}
+	resp.Entries = make([]duEntry, len(names))
+	byPath := make(map[string]*duEntry)
+	for i, name := range names {
+		resp.Entries[i] = duEntry{Name: path.Base(name), Dir: i < len(dirs), Partial: true}
+		byPath[name] = &resp.Entries[i]
+	}
+
+	session, err := sshConn.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdin pipe: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	if err := session.Start("xargs -0 du -sk --"); err != nil {
+		return fmt.Errorf("failed to start du: %v", err)
+	}
+	stop := closeOnDone(ctx, session)
+	defer stop()
+	go func() {
+		defer stdin.Close()
+		for _, name := range names {
+			if _, err := io.WriteString(stdin, name+"\x00"); err != nil {
+				return
+			}
+		}
+	}()
+
+	sizes, err := parseDU(stdout)
+	for name, size := range sizes {
+		if e, ok := byPath[name]; ok {
+			e.Size, e.Partial = size, false
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to read du output: %v", err)
+	}
+	session.Wait()
+	return nil
+}
+
+// parseDU reads the lines of du -sk, as GNU and BusyBox write them: the
+// 1024-byte blocks used, a tab and the path. Lines it can't read, such as
+// those of paths with newlines in them, are skipped.
+func parseDU(r io.Reader) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		blocks, name, ok := strings.Cut(sc.Text(), "\t")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(blocks), 10, 64)
+		if err != nil {
+			continue
+		}
+		sizes[name] = n << 10
+	}
+	return sizes, sc.Err()
+}
+
+// listNames runs command, returning up to limit of the NUL-separated names
+// it prints, and whether there were more
+func listNames(ctx context.Context, sshConn *ssh.Client, command string, limit int) ([]string, bool, error) {
+	session, err := sshConn.NewSession()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	stderr := &cappedBuffer{max: 1024}
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return nil, false, fmt.Errorf("failed to list directory: %v", err)
+	}
+	stop := closeOnDone(ctx, session)
+	defer stop()
+
+	var names []string
+	br := bufio.NewReader(stdout)
+	for {
+		name, err := br.ReadString(0)
+		if err != nil {
+			break
+		}
+		if len(names) == limit {
+			return names, true, nil
+		}
+		names = append(names, strings.TrimSuffix(name, "\x00"))
+	}
+	if err := session.Wait(); err != nil && ctx.Err() == nil && len(names) == 0 {
+		return nil, false, fmt.Errorf("failed to list directory: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return names, false, nil
+}
+
+// closeOnDone closes session once ctx ends, which stops its command and
+// unblocks its pipes. The returned func stops watching.
+func closeOnDone(ctx context.Context, session *ssh.Session) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// duViaSFTP sizes the entries of dir by walking them, adding up the sizes
+// of their files until maxFiles have been seen
+func duViaSFTP(ctx context.Context, client *sftp.Client, dir string, resp *duResponse, maxEntries, maxFiles int) error {
+	infos, err := client.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list directory: %v", err)
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Name() < infos[b].Name() })
+	if len(infos) > maxEntries {
+		infos = infos[:maxEntries]
+		resp.Truncated, resp.Stopped = true, "entries"
+	}
+
+	files := 0
+	for _, info := range infos {
+		e := duEntry{Name: info.Name(), Dir: info.IsDir(), Size: info.Size()}
+		if e.Dir {
+			e.Size, e.Partial = 0, true
+			if ctx.Err() == nil && files < maxFiles {
+				walker := client.Walk(path.Join(dir, info.Name()))
+				for walker.Step() {
+					if ctx.Err() != nil {
+						break
+					}
+					if walker.Err() != nil || !walker.Stat().Mode().IsRegular() {
+						continue
+					}
+					if files == maxFiles {
+						resp.Truncated, resp.Stopped = true, "files"
+						break
+					}
+					files++
+					e.Size += walker.Stat().Size()
+				}
+				e.Partial = ctx.Err() != nil || resp.Stopped == "files"
+			}
+		}
+		resp.Entries = append(resp.Entries, e)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Output of du -sk -- captured on GNU coreutils and BusyBox hosts; both
+// separate the size and the path with a tab
+const (
+	duGNU = "4\t/home/tester/.ssh\n1048580\t/home/tester/backups\n0\t/home/tester/empty file\n12\t/home/tester/notes.txt\n"
+	// A tab in a path is written as it is
+	duBusyBox = "8\t/root/.ash_history\n2052\t/root/dist\n4\t/root/tab\there\n"
+)
+
+func TestParseDU(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want map[string]int64
+	}{
+		{"GNU", duGNU, map[string]int64{
+			"/home/tester/.ssh":       4 << 10,
+			"/home/tester/backups":    1048580 << 10,
+			"/home/tester/empty file": 0,
+			"/home/tester/notes.txt":  12 << 10,
+		}},
+		{"BusyBox", duBusyBox, map[string]int64{
+			"/root/.ash_history": 8 << 10,
+			"/root/dist":         2052 << 10,
+			"/root/tab\there":    4 << 10,
+		}},
+		// A path with a newline splits over two lines that aren't
+		// size-tab-path; the part that looks like one is read as such
+		{"newline in a path", "16\t/srv/odd\nname\n4\t/srv/ok\n", map[string]int64{
+			"/srv/odd": 16 << 10,
+			"/srv/ok":  4 << 10,
+		}},
+		{"noise", "du: cannot read directory '/root/x': Permission denied\n4\t/root/y\n", map[string]int64{
+			"/root/y": 4 << 10,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDU(strings.NewReader(tt.out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
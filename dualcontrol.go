@@ -0,0 +1,530 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+const (
+	defaultDualControlTimeout = 10 * time.Minute
+	defaultDualControlGrace   = time.Minute
+	// participantWriteTimeout drops participants whose page stops taking
+	// output, so they can't stall the session
+	participantWriteTimeout = 10 * time.Second
+)
+
+// DualControlConfig has the terminal sessions of a host policy start only
+// once a second user has joined them, and end when that user leaves
+type DualControlConfig struct {
+	// Role is what the second participant may do: read (default), watching
+	// only, or write, typing as well
+	Role string `yaml:"role"`
+	// Timeout is how long a session waits for the second participant
+	Timeout time.Duration `yaml:"timeout"`
+	// Grace is how long a session goes on, warned, once the second
+	// participant has left
+	Grace time.Duration `yaml:"grace"`
+}
+
+func (c *DualControlConfig) parse() error {
+	switch c.Role {
+	case "":
+		c.Role = "read"
+	case "read", "write":
+	default:
+		return fmt.Errorf("role must be read or write, not %q", c.Role)
+	}
+	if c.Timeout < 0 || c.Grace < 0 {
+		return fmt.Errorf("timeout and grace can't be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultDualControlTimeout
+	}
+	if c.Grace == 0 {
+		c.Grace = defaultDualControlGrace
+	}
+	return nil
+}
+
+// dualControlPolicy returns the first policy of host requiring a second
+// participant
+func dualControlPolicy(host string) *HostPolicy {
+	for _, p := range hostPolicies(&currentConfig().Authz, host) {
+		if p.DualControl != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// sharedTerminal is the client end of a terminal session that other users
+// have joined. It stands in for the owner's connection: the session's
+// output goes to everyone, and the input of participants who may write
+// comes in alongside the owner's.
+type sharedTerminal struct {
+	ID       string
+	owner    sshbridge.Conn
+	identity string // the owner, as the authentication proxy names them
+	clientIP string
+	host     string
+	sshUser  string
+	readOnly bool
+	policy   *HostPolicy
+
+	// in carries the owner's messages and participants' input
+	in chan sharedMessage
+	// ownerGone is closed once reading from the owner fails, with the
+	// error in ownerErr
+	ownerGone chan struct{}
+	ownerErr  error
+	// joined is closed when the first participant joins
+	joined    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	// ownerMu serializes writes to the owner, which the session and the
+	// participants' banners share
+	ownerMu sync.Mutex
+
+	mu           sync.Mutex
+	participants []*participant
+	// everyone is each user who has joined, in order
+	everyone []string
+	session  *activeSession
+	// alone ends the session once the last participant has been gone
+	// for the policy's grace
+	alone *time.Timer
+}
+
+type sharedMessage struct {
+	messageType int
+	data        []byte
+}
+
+// participant is a user who joined a shared terminal
+type participant struct {
+	conn  sshbridge.Conn
+	user  string
+	write bool
+	mu    sync.Mutex
+}
+
+// send writes a message to the participant's page
+func (p *participant) send(messageType int, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(participantWriteTimeout))
+	return p.conn.WriteMessage(messageType, data)
+}
+
+func (p *participant) role() string {
+	if p.write {
+		return "write"
+	}
+	return "read"
+}
+
+// sharedTerminals are the shared terminals that may be joined, by ID
+var sharedTerminals = struct {
+	mu   sync.Mutex
+	byID map[string]*sharedTerminal
+}{byID: map[string]*sharedTerminal{}}
+
+// newSharedTerminal shares owner's terminal. It reads from owner from now
+// on; the session reads through the shared terminal instead.
+func newSharedTerminal(owner sshbridge.Conn, r *http.Request, host, sshUser string, readOnly bool, policy *HostPolicy) (*sharedTerminal, error) {
+	id, err := randomID(8)
+	if err != nil {
+		return nil, err
+	}
+	t := &sharedTerminal{
+		ID:        id,
+		owner:     owner,
+		identity:  proxyIdentity(r).User,
+		clientIP:  clientIP(r),
+		host:      host,
+		sshUser:   sshUser,
+		readOnly:  readOnly,
+		policy:    policy,
+		in:        make(chan sharedMessage),
+		ownerGone: make(chan struct{}),
+		joined:    make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	sharedTerminals.mu.Lock()
+	sharedTerminals.byID[id] = t
+	sharedTerminals.mu.Unlock()
+	go t.readOwner()
+	return t, nil
+}
+
+func (t *sharedTerminal) readOwner() {
+	defer close(t.ownerGone)
+	for {
+		messageType, data, err := t.owner.ReadMessage()
+		if err != nil {
+			t.ownerErr = err
+			return
+		}
+		select {
+		case t.in <- sharedMessage{messageType, data}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// conn returns the shared terminal as the session's connection, keeping
+// the owner's connection's optional behaviours
+func (t *sharedTerminal) conn() sshbridge.Conn {
+	if _, ok := t.owner.(promptlessConn); ok {
+		return promptlessSharedTerminal{t}
+	}
+	return t
+}
+
+type promptlessSharedTerminal struct {
+	*sharedTerminal
+}
+
+func (promptlessSharedTerminal) promptless() {}
+
+func (t *sharedTerminal) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-t.in:
+		return m.messageType, m.data, nil
+	case <-t.ownerGone:
+		return 0, nil, t.ownerErr
+	}
+}
+
+// WriteMessage writes to the owner, and terminal output to the
+// participants as well. The owner's page alone gets the session's
+// messages.
+func (t *sharedTerminal) WriteMessage(messageType int, data []byte) error {
+	t.ownerMu.Lock()
+	err := t.owner.WriteMessage(messageType, data)
+	t.ownerMu.Unlock()
+	if messageType == websocket.BinaryMessage {
+		for _, p := range t.present() {
+			if err := p.send(messageType, data); err != nil {
+				p.conn.Close()
+			}
+		}
+	}
+	return err
+}
+
+func (t *sharedTerminal) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return t.owner.WriteControl(messageType, data, deadline)
+}
+
+func (t *sharedTerminal) SetWriteDeadline(deadline time.Time) error {
+	t.ownerMu.Lock()
+	defer t.ownerMu.Unlock()
+	return t.owner.SetWriteDeadline(deadline)
+}
+
+// Close ends the sharing, closing the owner's and the participants'
+// connections
+func (t *sharedTerminal) Close() error {
+	err := t.owner.Close()
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		sharedTerminals.mu.Lock()
+		delete(sharedTerminals.byID, t.ID)
+		sharedTerminals.mu.Unlock()
+		t.mu.Lock()
+		if t.alone != nil {
+			t.alone.Stop()
+		}
+		present := t.participants
+		t.mu.Unlock()
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session ended")
+		for _, p := range present {
+			p.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			p.conn.Close()
+		}
+	})
+	return err
+}
+
+func (t *sharedTerminal) ReportExit(err error) {
+	if reporter, ok := t.owner.(sshbridge.ExitReporter); ok {
+		reporter.ReportExit(err)
+	}
+}
+
+func (t *sharedTerminal) present() []*participant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.participants)
+}
+
+// participantNames returns each user who has joined, in order. A nil
+// shared terminal has none.
+func (t *sharedTerminal) participantNames() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.everyone)
+}
+
+// banner tells the owner and the participants about the sharing
+func (t *sharedTerminal) banner(text string) {
+	t.WriteMessage(websocket.BinaryMessage, []byte("\r\n\x1b[1;33m["+text+"]\x1b[0m\r\n"))
+}
+
+// attach notes the session the shared terminal carries, once it has
+// started
+func (t *sharedTerminal) attach(s *activeSession) {
+	t.mu.Lock()
+	t.session = s
+	t.mu.Unlock()
+}
+
+// join adds a participant, who stays until their connection fails. It
+// reports false when the session has already ended.
+func (t *sharedTerminal) join(p *participant) bool {
+	t.mu.Lock()
+	select {
+	case <-t.closed:
+		t.mu.Unlock()
+		return false
+	default:
+	}
+	first := t.everyone == nil
+	t.participants = append(t.participants, p)
+	if !slices.Contains(t.everyone, p.user) {
+		t.everyone = append(t.everyone, p.user)
+	}
+	rejoined := t.alone != nil && t.alone.Stop()
+	t.alone = nil
+	s := t.session
+	t.mu.Unlock()
+	if first {
+		close(t.joined)
+	}
+	if s != nil {
+		s.recording.participants(t.participantNames())
+	}
+	text := p.user + " joined the session"
+	if !p.write {
+		text += ", watching"
+	}
+	if rejoined {
+		text += "; it goes on"
+	}
+	t.banner(text)
+	return true
+}
+
+// leave removes a participant. Once the last one has gone the session is
+// warned, and ended unless someone joins within the policy's grace.
+func (t *sharedTerminal) leave(p *participant) {
+	select {
+	case <-t.closed:
+		return
+	default:
+	}
+	t.mu.Lock()
+	t.participants = slices.DeleteFunc(t.participants, func(q *participant) bool { return q == p })
+	alone := len(t.participants) == 0
+	grace := t.policy.DualControl.Grace
+	if alone && t.alone == nil {
+		t.alone = time.AfterFunc(grace, t.end)
+	}
+	t.mu.Unlock()
+	text := p.user + " left the session"
+	if alone {
+		text += fmt.Sprintf("; it ends in %s unless a second participant joins", formatDuration(grace))
+	}
+	t.banner(text)
+}
+
+// end closes a session whose second participant didn't come back
+func (t *sharedTerminal) end() {
+	t.mu.Lock()
+	s := t.session
+	t.mu.Unlock()
+	reason := "The second participant left the session"
+	slog.Info("Ending dual-control session without a second participant", "shared", t.ID, "user", t.identity, "host", hostname(t.host))
+	audit.Emit(AuditEvent{
+		Event:        auditSessionJoin,
+		Outcome:      outcomeFailure,
+		ClientIP:     t.clientIP,
+		User:         t.identity,
+		Host:         hostname(t.host),
+		SSHUser:      t.sshUser,
+		Action:       "end",
+		Target:       t.ID,
+		Rule:         "host_policies/" + t.policy.Name,
+		Participants: t.participantNames(),
+	})
+	t.WriteMessage(websocket.TextMessage, []byte("Error: "+reason))
+	if s != nil {
+		s.close(reason)
+		return
+	}
+	t.Close()
+}
+
+// awaitParticipant shares the owner's terminal to a host of policy and
+// holds it until a second user joins, returning the shared terminal the
+// session runs over, or why no one did
+func awaitParticipant(owner sshbridge.Conn, r *http.Request, host, sshUser string, readOnly bool, policy *HostPolicy) (*sharedTerminal, error) {
+	if _, err := participantIdentity(r); err != nil {
+		return nil, fmt.Errorf("%s requires a second participant, which %s", hostname(host), err)
+	}
+	t, err := newSharedTerminal(owner, r, host, sshUser, readOnly, policy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to share the session: %v", err)
+	}
+	timeout := policy.DualControl.Timeout
+	requestLogger(r).Info("Session waiting for a second participant", "shared", t.ID, "host", hostname(host), "policy", policy.Name)
+	t.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("\x1b[1;33m[%s requires a second participant. Waiting for someone to join at %s/terminal?join=%s (expires in %s)…]\x1b[0m\r\n",
+		hostname(host), currentConfig().Server.BasePath, t.ID, formatDuration(timeout))))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.joined:
+		return t, nil
+	case <-timer.C:
+		t.Close()
+		return nil, fmt.Errorf("No second participant joined within %s", formatDuration(timeout))
+	case <-t.ownerGone:
+		t.Close()
+		return nil, fmt.Errorf("Session cancelled")
+	}
+}
+
+// participantIdentity returns the person making r, as the authentication
+// proxy names them. The two people a dual-control session needs are told
+// apart by these identities; an API key's name says nothing about who holds
+// it, and a user header that didn't come through server.trusted_proxies
+// could name anyone, so both are refused.
+func participantIdentity(r *http.Request) (Identity, error) {
+	id := proxyIdentity(r)
+	if id.User == "" || !fromTrustedProxy(r) {
+		return Identity{}, errors.New("needs a user identified by the authentication proxy")
+	}
+	return id, nil
+}
+
+// joinHandler joins a user to a shared terminal on /ws-join?session=<id>.
+// They must be identified by the authentication proxy as someone other than
+// its owner, and allowed terminal sessions to its host, with an API key
+// with the terminal scope if they send one; mode=read has them watch even
+// when the policy lets them type.
+func joinHandler(w http.ResponseWriter, r *http.Request) {
+	if secret := bearerToken(r); secret != "" {
+		key := lookupAPIKey(secret)
+		switch {
+		case key == nil:
+			responder.ErrorCode(w, r, httpapi.InvalidAPIKey, "Invalid API key")
+			return
+		case !key.hasScope(scopeTerminal):
+			responder.ErrorCode(w, r, httpapi.Forbidden, fmt.Sprintf("API key lacks the %q scope", scopeTerminal))
+			return
+		}
+		r = withAPIKey(r, key)
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		requestLogger(r).Warn("Failed to upgrade connection", "err", err)
+		return
+	}
+	defer ws.Close()
+	conn := sshbridge.Negotiate(ws)
+
+	if currentConfig().UI.RequireConsent && !hasConsent(r) {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: The usage notice must be accepted before connecting"))
+		return
+	}
+	sharedTerminals.mu.Lock()
+	t, ok := sharedTerminals.byID[r.URL.Query().Get("session")]
+	sharedTerminals.mu.Unlock()
+	if !ok {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Session not found or no longer shared"))
+		return
+	}
+	id, err := participantIdentity(r)
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Joining a session "+err.Error()))
+		return
+	}
+	user := id.User
+	if user == t.identity {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: The second participant must be someone other than the session's owner"))
+		return
+	}
+	if err := authorize(r, t.host, t.sshUser, opTerminal); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+		return
+	}
+
+	p := &participant{
+		conn:  conn,
+		user:  user,
+		write: t.policy.DualControl.Role == "write" && !t.readOnly && r.URL.Query().Get("mode") != "read",
+	}
+	joinEvent := AuditEvent{
+		Event:        auditSessionJoin,
+		Outcome:      outcomeSuccess,
+		ClientIP:     clientIP(r),
+		User:         user,
+		Host:         hostname(t.host),
+		SSHUser:      t.sshUser,
+		ReadOnly:     !p.write,
+		Action:       "join",
+		Target:       t.ID,
+		Rule:         "host_policies/" + t.policy.Name,
+		Participants: []string{t.identity},
+	}
+	if !t.join(p) {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Session not found or no longer shared"))
+		return
+	}
+	audit.Emit(joinEvent)
+	requestLogger(r).Info("Joined shared session", "shared", t.ID, "owner", t.identity, "role", p.role())
+
+	notified := false
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		msg, err := sshbridge.DecodeClientMessage(messageType, message)
+		if err != nil || msg.Type != "input" {
+			// The owner's page sizes the terminal and moves files
+			continue
+		}
+		if !p.write {
+			if !notified {
+				notified = true
+				p.send(websocket.BinaryMessage, []byte("\r\n\x1b[1;33m[watching: input is disabled]\x1b[0m\r\n"))
+			}
+			continue
+		}
+		select {
+		case t.in <- sharedMessage{messageType, message}:
+		case <-t.closed:
+		}
+	}
+	t.leave(p)
+	joinEvent.Action = "leave"
+	audit.Emit(joinEvent)
+	requestLogger(r).Info("Left shared session", "shared", t.ID)
+}
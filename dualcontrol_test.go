@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshtest"
+)
+
+func TestParticipantIdentity(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+authz:
+  user_header: X-User
+`)
+	sum := sha256.Sum256([]byte("secret"))
+	key, err := newAPIKey("ci", sum[:], []string{scopeTerminal}, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		peer   string
+		header string
+		key    *apiKey
+		want   string
+	}{
+		{"header from a trusted proxy", "10.0.0.1:4000", "alice", nil, "alice"},
+		{"header from another peer", "10.0.0.2:4000", "alice", nil, ""},
+		{"API key through a trusted proxy", "10.0.0.1:4000", "alice", key, "alice"},
+		// An API key's name says nothing about who holds it
+		{"API key alone", "10.0.0.1:4000", "", key, ""},
+		{"API key from another peer", "10.0.0.2:4000", "alice", key, ""},
+		{"anonymous", "10.0.0.1:4000", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws-join", nil)
+			r.RemoteAddr = tt.peer
+			r.Header.Set("X-User", tt.header)
+			if tt.key != nil {
+				r = withAPIKey(r, tt.key)
+			}
+			id, err := participantIdentity(r)
+			if id.User != tt.want || (err == nil) != (tt.want != "") {
+				t.Errorf("participantIdentity = %+v, %v; want user %q", id, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinNeedsAnotherPerson(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [127.0.0.1]
+authz:
+  user_header: X-User
+  host_policies:
+    - name: four-eyes
+      hosts: ["127.0.0.1"]
+      dual_control:
+        role: read
+`)
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+	secret, _, err := mintAPIKey("join-terminal", []string{scopeTerminal}, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(path string, header http.Header) *websocket.Conn {
+		header.Set("Origin", srv.URL)
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	query := url.Values{"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password}}
+	owner := &testPage{conn: dial("/ws?"+query.Encode(), http.Header{"X-User": {"alice"}})}
+	var shared string
+	owner.readUntil(t, func() bool {
+		sharedTerminals.mu.Lock()
+		defer sharedTerminals.mu.Unlock()
+		for id := range sharedTerminals.byID {
+			shared = id
+		}
+		return shared != ""
+	})
+
+	refused := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"owner with an API key", http.Header{"X-User": {"alice"}, "Authorization": {"Bearer " + secret}}, "someone other than the session's owner"},
+		{"API key alone", http.Header{"Authorization": {"Bearer " + secret}}, "identified by the authentication proxy"},
+		{"anonymous", http.Header{}, "identified by the authentication proxy"},
+	}
+	for _, tt := range refused {
+		conn := dial("/ws-join?session="+shared, tt.header)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil || !bytes.Contains(msg, []byte(tt.want)) {
+			t.Errorf("%s: got %q, %v; want an error saying %q", tt.name, msg, err, tt.want)
+		}
+		conn.Close()
+	}
+
+	dial("/ws-join?session="+shared, http.Header{"X-User": {"bob"}, "Authorization": {"Bearer " + secret}})
+	owner.readUntil(t, func() bool { return bytes.Contains(owner.output, []byte("bob joined the session")) })
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvOverridesPrecedence(t *testing.T) {
+	t.Setenv("GOSSH_SERVER_PORT", "9022")
+	t.Setenv("GOSSH_WS_WRITE_TIMEOUT", "45s")
+	cfg := useConfig(t, `
+server:
+  port: 8023
+  shutdown_grace: 10s
+ws:
+  write_timeout: 5s
+  slow_writes: 5
+`)
+	// env > file > defaults
+	if cfg.Server.Port != 9022 {
+		t.Errorf("server.port %d, want 9022 from the environment", cfg.Server.Port)
+	}
+	if cfg.WebSocket.WriteTimeout != 45*time.Second {
+		t.Errorf("ws.write_timeout %v, want 45s from the environment", cfg.WebSocket.WriteTimeout)
+	}
+	if cfg.WebSocket.SlowWrites != 5 || cfg.Server.ShutdownGrace != 10*time.Second {
+		t.Errorf("file values lost: slow_writes %d, shutdown_grace %v", cfg.WebSocket.SlowWrites, cfg.Server.ShutdownGrace)
+	}
+	if cfg.WebSocket.ReadBuffer != 1024 {
+		t.Errorf("ws.read_buffer %d, want the default 1024", cfg.WebSocket.ReadBuffer)
+	}
+}
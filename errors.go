@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+
+	"gossh/internal/httpapi"
+)
+
+// responder writes the error responses of every handler, showing browsers
+// error.html instead of JSON
+var responder = httpapi.NewResponder(requestID, renderErrorPage)
+
+// errorPageData is rendered into error.html
+type errorPageData struct {
+	pageData
+	Status int
+	Error  httpapi.ErrorBody
+}
+
+func renderErrorPage(w http.ResponseWriter, r *http.Request, status int, body httpapi.ErrorBody) {
+	renderTemplate(w, r, "error.html", errorPageData{pageData: newPageData(r), Status: status, Error: body})
+}
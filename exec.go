@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+)
+
+const (
+	defaultExecTimeout    = time.Minute
+	defaultExecMaxTimeout = 10 * time.Minute
+	defaultExecMaxOutput  = 1 << 20
+	// execKillGrace is how long a killed command has to go away before its
+	// channel is closed
+	execKillGrace = 5 * time.Second
+)
+
+// ExecConfig limits commands run through /api/exec
+type ExecConfig struct {
+	// Timeout applies when a request sets none; MaxTimeout caps the ones
+	// requests set
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+	// MaxOutput is how many bytes of stdout, and of stderr, are returned;
+	// the rest is discarded
+	MaxOutput int `yaml:"max_output"`
+}
+
+func (c *ExecConfig) applyDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultExecTimeout
+	}
+	if c.MaxTimeout <= 0 {
+		c.MaxTimeout = defaultExecMaxTimeout
+	}
+	if c.MaxOutput <= 0 {
+		c.MaxOutput = defaultExecMaxOutput
+	}
+}
+
+func validateExecConfig(cfg ExecConfig) error {
+	if cfg.Timeout > cfg.MaxTimeout {
+		return fmt.Errorf("exec.timeout %s exceeds exec.max_timeout %s", cfg.Timeout, cfg.MaxTimeout)
+	}
+	return nil
+}
+
+// envName is what a variable passed to a command may be called
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// targetRequest names the target of an API request in JSON, like the
+// parameters of transfers: a terminal session, an access token, or a host
+// and credentials
+type targetRequest struct {
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	PrivateKey  string `json:"private_key"` // base64
+	Credentials string `json:"credentials"`
+	Access      string `json:"access"`
+	Session     string `json:"session"`
+	SessionKey  string `json:"session_key"`
+}
+
+// execRequest is the body of POST /api/exec
+type execRequest struct {
+	targetRequest
+	Command string            `json:"command"`
+	Timeout string            `json:"timeout"` // e.g. "30s"
+	Env     map[string]string `json:"env"`
+}
+
+// param returns the target parameter name, as resolveTransferTarget reads it
+func (req *targetRequest) param(name string) string {
+	switch name {
+	case "host":
+		return req.Host
+	case "user":
+		return req.User
+	case "password":
+		return req.Password
+	case "privatekey":
+		return req.PrivateKey
+	case "credentials":
+		return req.Credentials
+	case "access":
+		return req.Access
+	case "session":
+		return req.Session
+	case "session_key":
+		return req.SessionKey
+	}
+	return ""
+}
+
+// execResponse is the result of a command that ran
+type execResponse struct {
+	// ExitCode is -1 when the command was killed by a signal or timed out
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Truncated is set when output beyond exec.max_output was discarded
+	Truncated bool `json:"truncated,omitempty"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+}
+
+// decodeExecRequest reads the body of an exec or job request and resolves
+// its target. A request without a timeout gets defaultTimeout.
+func decodeExecRequest(w http.ResponseWriter, r *http.Request, defaultTimeout, maxTimeout time.Duration) (*execRequest, time.Duration, *transferTarget, error) {
+	var req execRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		return nil, 0, nil, httpapi.Errorf(httpapi.BadRequest, "Invalid JSON body: %v", err)
+	}
+	if req.Command == "" {
+		return nil, 0, nil, httpapi.Errorf(httpapi.MissingParams, "Missing command")
+	}
+	timeout := defaultTimeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			return nil, 0, nil, httpapi.Errorf(httpapi.BadRequest, "Invalid timeout %q", req.Timeout)
+		}
+		if d > maxTimeout {
+			return nil, 0, nil, httpapi.Errorf(httpapi.BadRequest, "Timeout exceeds the maximum of %s", maxTimeout)
+		}
+		timeout = d
+	}
+	for name := range req.Env {
+		if !envName.MatchString(name) {
+			return nil, 0, nil, httpapi.Errorf(httpapi.BadRequest, "Invalid environment variable name %q", name)
+		}
+	}
+
+	// Commands need an API key or an access token even when api.require_key
+	// is off, and can't borrow a terminal session's connection
+	if req.Session != "" {
+		return nil, 0, nil, httpapi.Errorf(httpapi.BadRequest, "Commands can't run through a terminal session; name the host or an access token")
+	}
+	if apiKeyFromContext(r.Context()) == nil && req.Access == "" {
+		return nil, 0, nil, httpapi.Errorf(httpapi.APIKeyRequired, "API key or access token required")
+	}
+
+	target, err := resolveTransferTarget(r, opExec, req.param)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return &req, timeout, target, nil
+}
+
+// execHandler runs one command and returns its output and exit code
+func execHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+
+	cfg := currentConfig().Exec
+	req, timeout, target, err := decodeExecRequest(w, r, cfg.Timeout, cfg.MaxTimeout)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	if err := authorize(r, target.Host, target.User, opExec); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "exec.run")
+	var result execResponse
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		stdout := &cappedBuffer{max: cfg.MaxOutput}
+		stderr := &cappedBuffer{max: cfg.MaxOutput}
+		result, err = runCommand(ctx, meta, sshConn, req.Command, req.Env, timeout, stdout, stderr)
+		release()
+	}
+	span.SetAttributes(attribute.Int("gossh.exec.exit_code", result.ExitCode), attribute.Bool("gossh.exec.timed_out", result.TimedOut))
+	endSpan(span, err)
+	audit.Emit(execAuditEvent(meta, target, req.Command, result, timeout, err))
+
+	if err != nil {
+		meta.Log.Warn("Command failed to run", "host", target.Host, "ssh_user", target.User, "err", err)
+		responder.Error(w, r, err, httpapi.ConnectFailed)
+		return
+	}
+	meta.Log.Info("Command ran", "host", target.Host, "ssh_user", target.User, "exit_code", result.ExitCode, "timed_out", result.TimedOut, "duration", time.Duration(result.Duration*float64(time.Second)))
+	httpapi.JSON(w, result)
+}
+
+// execAuditEvent records a command run for meta on target
+func execAuditEvent(meta requestMeta, target *transferTarget, command string, result execResponse, timeout time.Duration, err error) AuditEvent {
+	ev := AuditEvent{
+		Event:      auditExec,
+		Outcome:    outcomeOf(err),
+		ClientIP:   meta.ClientIP,
+		User:       meta.User,
+		Host:       target.Host,
+		SSHUser:    target.User,
+		Command:    command,
+		DurationMS: int64(result.Duration * 1000),
+		BytesOut:   int64(len(result.Stdout) + len(result.Stderr)),
+		Error:      errorString(err),
+	}
+	if err == nil {
+		ev.ExitCode = &result.ExitCode
+		if result.TimedOut {
+			ev.Outcome = outcomeFailure
+			ev.Error = fmt.Sprintf("timed out after %s", timeout)
+		}
+	}
+	return ev
+}
+
+// runCommand runs command in a new session on sshConn, writing its output
+// to stdout and stderr and killing it after timeout. An error means the
+// command could not be run; a command that ran, failed or timed out is
+// described by the result. When ctx ends the command is killed too, and
+// the result comes with ctx's error.
+func runCommand(ctx context.Context, meta requestMeta, sshConn *ssh.Client, command string, env map[string]string, timeout time.Duration, stdout, stderr *cappedBuffer) (execResponse, error) {
+	var result execResponse
+	session, err := sshConn.NewSession()
+	if err != nil {
+		return result, fmt.Errorf("Failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	for name, value := range env {
+		if err := session.Setenv(name, value); err != nil {
+			return result, httpapi.Errorf(httpapi.BadRequest, "Host refused environment variable %s; it must be listed in the server's AcceptEnv", name)
+		}
+	}
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	start := time.Now()
+	if err := session.Start(command); err != nil {
+		return result, fmt.Errorf("Failed to start command: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	// kill signals the command and waits for it to go away
+	kill := func() error {
+		session.Signal(ssh.SIGKILL)
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(execKillGrace):
+			// The server ignored the signal; closing the channel is all
+			// that is left
+			session.Close()
+			return <-done
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var stopped error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		result.TimedOut = true
+		meta.Log.Warn("Command timed out, killing it", "command", command, "timeout", timeout)
+		err = kill()
+	case <-ctx.Done():
+		stopped = context.Cause(ctx)
+		err = kill()
+	}
+	result.Duration = time.Since(start).Seconds()
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.isTruncated() || stderr.isTruncated()
+
+	var exitErr *ssh.ExitError
+	var missing *ssh.ExitMissingError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+		result.Signal = exitErr.Signal()
+		if result.Signal != "" {
+			result.ExitCode = -1
+		}
+	case errors.As(err, &missing) || result.TimedOut || stopped != nil:
+		result.ExitCode = -1
+	default:
+		return result, fmt.Errorf("Command failed: %v", err)
+	}
+	if result.TimedOut || stopped != nil {
+		result.ExitCode = -1
+	}
+	return result, stopped
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the
+// rest, so a chatty command can't exhaust memory or stall
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - len(b.buf); room < len(p) {
+		b.buf = append(b.buf, p[:max(room, 0)]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
+
+// readAt returns up to limit bytes of the output from offset on, and the
+// size of the output so far
+func (b *cappedBuffer) readAt(offset, limit int) ([]byte, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offset = min(max(offset, 0), len(b.buf))
+	end := min(offset+limit, len(b.buf))
+	return append([]byte(nil), b.buf[offset:end]...), len(b.buf)
+}
+
+func (b *cappedBuffer) isTruncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.truncated
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/sshtest"
+)
+
+// TestExecNeedsKeyOrToken runs commands with api.require_key off, as it is
+// by default
+func TestExecNeedsKeyOrToken(t *testing.T) {
+	useConfig(t, "")
+	// Access tokens carry a key rather than a password
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := sshtest.Start(t, func(c *ssh.ServerConfig) {
+		c.PublicKeyCallback = func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil }
+	})
+	srv := startTestGateway(t)
+	key, _, err := mintAPIKey("ci", []string{scopeExec}, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(pemBlock))
+	token := testAccessToken(t, url.Values{"hostname": {server.Addr}, "username": {sshtest.User}, "privatekey": {privateKey}})
+	addTestSession(t, "s1", &activeSession{Host: server.Addr, SSHUser: sshtest.User, key: "k1"})
+	direct := targetRequest{Host: server.Addr, User: sshtest.User, Password: sshtest.Password}
+
+	tests := []struct {
+		name   string
+		path   string
+		key    string
+		target targetRequest
+		status int // 0 when the command runs
+	}{
+		{"no key", "/api/exec", "", direct, http.StatusUnauthorized},
+		{"job without a key", "/api/jobs", "", direct, http.StatusUnauthorized},
+		{"terminal session", "/api/exec", "", targetRequest{Session: "s1", SessionKey: "k1"}, http.StatusBadRequest},
+		{"terminal session with a key", "/api/exec", key, targetRequest{Session: "s1", SessionKey: "k1"}, http.StatusBadRequest},
+		{"job through a terminal session", "/api/jobs", key, targetRequest{Session: "s1", SessionKey: "k1"}, http.StatusBadRequest},
+		{"key", "/api/exec", key, direct, 0},
+		{"access token", "/api/exec", "", targetRequest{Access: token}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := execRequest{targetRequest: tt.target, Command: "echo ran"}
+			status, data := callAPI(t, apiRequest(t, srv, "POST", tt.path, tt.key, body))
+			if tt.status != 0 {
+				if status != tt.status {
+					t.Errorf("status %d, want %d: %s", status, tt.status, data)
+				}
+				return
+			}
+			var result execResponse
+			if err := json.Unmarshal(data, &result); status != http.StatusOK || err != nil {
+				t.Fatalf("status %d: %s", status, data)
+			}
+			if result.ExitCode != 0 || strings.TrimSpace(result.Stdout) != "ran" {
+				t.Errorf("result %+v", result)
+			}
+		})
+	}
+}
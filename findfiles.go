@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// Finds list the files under a directory of a host by name, type, size
+// and modification time, for the file browser's search box. They run GNU
+// find where the host has it, and otherwise walk the directory over SFTP.
+
+// findProbeCommand succeeds on hosts with a find that understands -printf
+// and -newermt
+const findProbeCommand = `find / -maxdepth 0 -newermt @0 -printf '' >/dev/null 2>&1`
+
+// findPrintf formats each entry find prints: type, size, modification
+// time, permissions and path, NUL-terminated
+const findPrintf = `%y\t%s\t%T@\t%m\t%p\0`
+
+// findRequest is the body of POST /api/files/find
+type findRequest struct {
+	targetRequest
+	Root string `json:"root"`
+	// Name is a glob the names of entries must match
+	Name       string `json:"name"`
+	IgnoreCase bool   `json:"ignore_case"`
+	Type       string `json:"type"` // file or dir, or either
+	// ModifiedAfter and ModifiedBefore bound the modification time, in
+	// RFC 3339
+	ModifiedAfter  string `json:"modified_after"`
+	ModifiedBefore string `json:"modified_before"`
+	// MinSize and MaxSize bound the size in bytes, inclusive
+	MinSize *int64 `json:"min_size"`
+	MaxSize *int64 `json:"max_size"`
+	// FollowLinks descends into linked directories; loops are only ended
+	// by the depth limit
+	FollowLinks bool   `json:"follow_links"`
+	MaxDepth    int    `json:"max_depth"`
+	MaxResults  int    `json:"max_results"`
+	Timeout     string `json:"timeout"`
+}
+
+// findEntry is a line of the response for each entry found
+type findEntry struct {
+	Event    string    `json:"event"` // "entry"
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"` // file, dir, link or other
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"` // permissions in octal
+	Modified time.Time `json:"modified"`
+}
+
+// findSummary is the last line of the response
+type findSummary struct {
+	Event   string `json:"event"`  // "summary"
+	Method  string `json:"method"` // find or sftp
+	Entries int    `json:"entries"`
+	// Stopped names the limit that ended the listing early: entries or
+	// timeout
+	Stopped  string  `json:"stopped,omitempty"`
+	Duration float64 `json:"duration"` // in seconds
+	// Warning is the first complaint of find or the walk, such as a
+	// directory that couldn't be read
+	Warning string             `json:"warning,omitempty"`
+	Error   *httpapi.ErrorBody `json:"error,omitempty"`
+}
+
+// fileFind is a listing in progress, written to the response as it goes
+type fileFind struct {
+	root          string
+	name          string
+	ignoreCase    bool
+	typ           string
+	after, before time.Time
+	minSize       int64
+	maxSize       int64
+	followLinks   bool
+	maxDepth      int
+	maxResults    int
+	// driveRoot is set for Windows hosts, whose paths SFTP names /C:/...
+	// and which are reported as C:/...
+	driveRoot bool
+
+	summary findSummary
+	enc     *json.Encoder
+	flush   func() error
+}
+
+// findHandler streams the entries under a directory that match a request,
+// as NDJSON
+func findHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+
+	var req findRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		responder.ErrorCode(w, r, httpapi.BadRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+	f, timeout, err := newFileFind(&req)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	target, err := resolveTransferTarget(r, opDownload, req.param)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	if err := authorize(r, target.Host, target.User, opDownload); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "files.find")
+	sshConn, release, err := target.connect(ctx, meta)
+	if err != nil {
+		endSpan(span, err)
+		responder.Error(w, r, err, httpapi.ConnectFailed)
+		return
+	}
+	defer release()
+	if f.root, err = transfer.HostDownloadPath(sshConn, f.root); err != nil {
+		endSpan(span, err)
+		responder.Error(w, r, err, httpapi.PathNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	f.enc = json.NewEncoder(w)
+	f.flush = http.NewResponseController(w).Flush
+
+	start := time.Now()
+	findCtx, cancel := context.WithTimeout(ctx, timeout)
+	err = f.run(findCtx, meta.Log, sshConn)
+	if findCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		f.summary.Stopped, err = "timeout", nil
+	}
+	cancel()
+	f.summary.Event = "summary"
+	f.summary.Duration = time.Since(start).Seconds()
+	if err != nil {
+		body := responder.Body(r, err, httpapi.TransferFailed)
+		f.summary.Error = &body
+	}
+	f.enc.Encode(f.summary)
+
+	span.SetAttributes(attribute.Int("gossh.find.entries", f.summary.Entries))
+	endSpan(span, err)
+	if err != nil {
+		meta.Log.Error("Find failed", "host", target.Host, "ssh_user", target.User, "root", f.root, "err", err)
+	}
+}
+
+// newFileFind checks a find request, returning the listing and how long it
+// may run
+func newFileFind(req *findRequest) (*fileFind, time.Duration, error) {
+	cfg := currentConfig().Transfers
+	if req.Root == "" {
+		return nil, 0, httpapi.Errorf(httpapi.MissingParams, "Missing root")
+	}
+	f := &fileFind{
+		root:        req.Root,
+		name:        req.Name,
+		ignoreCase:  req.IgnoreCase,
+		typ:         req.Type,
+		minSize:     -1,
+		maxSize:     -1,
+		followLinks: req.FollowLinks,
+		maxDepth:    cfg.FindMaxDepth,
+		maxResults:  cfg.FindMaxResults,
+	}
+	if _, err := path.Match(req.Name, ""); err != nil || strings.Contains(req.Name, "/") {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid name %q: expected a file name glob", req.Name)
+	}
+	if req.Type != "" && req.Type != "file" && req.Type != "dir" {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid type %q: expected file or dir", req.Type)
+	}
+	for _, bound := range []struct {
+		value string
+		t     *time.Time
+	}{{req.ModifiedAfter, &f.after}, {req.ModifiedBefore, &f.before}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid time %q: expected RFC 3339", bound.value)
+		}
+		*bound.t = t
+	}
+	if req.MinSize != nil {
+		f.minSize = *req.MinSize
+	}
+	if req.MaxSize != nil {
+		f.maxSize = *req.MaxSize
+	}
+	if (req.MinSize != nil && f.minSize < 0) || (req.MaxSize != nil && f.maxSize < 0) {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "min_size and max_size can't be negative")
+	}
+	if req.MaxDepth < 0 || req.MaxResults < 0 {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "max_depth and max_results can't be negative")
+	}
+	if req.MaxDepth > 0 {
+		f.maxDepth = min(req.MaxDepth, f.maxDepth)
+	}
+	if req.MaxResults > 0 {
+		f.maxResults = min(req.MaxResults, f.maxResults)
+	}
+	timeout := cfg.FindTimeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid timeout %q", req.Timeout)
+		}
+		timeout = min(d, timeout)
+	}
+	return f, timeout, nil
+}
+
+// run lists with find where the host has GNU find, and over SFTP otherwise
+func (f *fileFind) run(ctx context.Context, logger *slog.Logger, sshConn *ssh.Client) error {
+	if transfer.Platform(sshConn) != transfer.Windows {
+		_, err := transfer.CommandOutput(sshConn, findProbeCommand, transfer.ProbeTimeout)
+		if err == nil {
+			f.summary.Method = "find"
+			return f.find(ctx, sshConn)
+		}
+		logger.Debug("GNU find unavailable, walking over SFTP", "err", err)
+	}
+	f.summary.Method = "sftp"
+	client, err := sftp.NewClient(sshConn)
+	if err != nil {
+		return fmt.Errorf("the host has neither GNU find nor SFTP: %v", err)
+	}
+	defer client.Close()
+	root := f.root
+	if transfer.Platform(sshConn) == transfer.Windows {
+		root = "/" + root
+		f.driveRoot = true
+	}
+	return f.walk(ctx, client, root, 0)
+}
+
+// found reports an entry, telling whether the listing goes on
+func (f *fileFind) found(e findEntry) bool {
+	if f.summary.Entries >= f.maxResults {
+		f.summary.Stopped = "entries"
+		return false
+	}
+	f.summary.Entries++
+	e.Event = "entry"
+	if f.driveRoot {
+		e.Path = strings.TrimPrefix(e.Path, "/")
+	}
+	f.enc.Encode(e)
+	f.flush()
+	return true
+}
+
+// findArgs builds the arguments of find for the request, each quoted for
+// the shell
+func (f *fileFind) findArgs() []string {
+	args := []string{"find"}
+	if f.followLinks {
+		args = append(args, "-L")
+	}
+	args = append(args, transfer.ShellQuote(f.root), "-mindepth", "1", "-maxdepth", strconv.Itoa(f.maxDepth))
+	if f.name != "" {
+		test := "-name"
+		if f.ignoreCase {
+			test = "-iname"
+		}
+		args = append(args, test, transfer.ShellQuote(f.name))
+	}
+	switch f.typ {
+	case "file":
+		args = append(args, "-type", "f")
+	case "dir":
+		args = append(args, "-type", "d")
+	}
+	if f.minSize > 0 {
+		args = append(args, "-size", fmt.Sprintf("+%dc", f.minSize-1))
+	}
+	if f.maxSize >= 0 {
+		args = append(args, "-size", fmt.Sprintf("-%dc", f.maxSize+1))
+	}
+	if !f.after.IsZero() {
+		args = append(args, "-newermt", fmt.Sprintf("@%d", f.after.Unix()))
+	}
+	if !f.before.IsZero() {
+		args = append(args, `\!`, "-newermt", fmt.Sprintf("@%d", f.before.Unix()))
+	}
+	return append(args, "-printf", transfer.ShellQuote(findPrintf))
+}
+
+// find lists the entries with GNU find
+func (f *fileFind) find(ctx context.Context, sshConn *ssh.Client) error {
+	session, err := sshConn.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	stderr := &cappedBuffer{max: 1024}
+	session.Stderr = stderr
+	if err := session.Start(strings.Join(f.findArgs(), " ")); err != nil {
+		return fmt.Errorf("failed to start find: %v", err)
+	}
+	stop := closeOnDone(ctx, session)
+	defer stop()
+
+	br := bufio.NewReader(stdout)
+	for {
+		line, err := br.ReadString(0)
+		if err != nil {
+			break
+		}
+		e, ok := parseFindEntry(strings.TrimSuffix(line, "\x00"))
+		if !ok {
+			continue
+		}
+		if !f.found(e) {
+			session.Signal(ssh.SIGKILL)
+			return nil
+		}
+	}
+	session.Wait()
+	if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); msg != "" {
+		f.summary.Warning = msg
+	}
+	return nil
+}
+
+// parseFindEntry reads an entry printed with findPrintf
+func parseFindEntry(line string) (findEntry, bool) {
+	fields := strings.SplitN(line, "\t", 5)
+	if len(fields) < 5 {
+		return findEntry{}, false
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return findEntry{}, false
+	}
+	mtime, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return findEntry{}, false
+	}
+	mode, err := strconv.ParseUint(fields[3], 8, 32)
+	if err != nil {
+		return findEntry{}, false
+	}
+	e := findEntry{
+		Path:     fields[4],
+		Name:     path.Base(fields[4]),
+		Size:     size,
+		Mode:     fmt.Sprintf("%04o", mode),
+		Modified: time.Unix(0, int64(mtime*1e9)).UTC(),
+	}
+	switch fields[0] {
+	case "f":
+		e.Type = "file"
+	case "d":
+		e.Type = "dir"
+	case "l":
+		e.Type = "link"
+	default:
+		e.Type = "other"
+	}
+	return e, true
+}
+
+// walk lists the entries under dir, depth levels below the root, over SFTP
+func (f *fileFind) walk(ctx context.Context, client *sftp.Client, dir string, depth int) error {
+	infos, err := client.ReadDir(dir)
+	if err != nil {
+		if depth == 0 {
+			return fmt.Errorf("failed to list directory: %v", err)
+		}
+		if f.summary.Warning == "" {
+			f.summary.Warning = fmt.Sprintf("%s: %v", dir, err)
+		}
+		return nil
+	}
+	for _, info := range infos {
+		if ctx.Err() != nil || f.summary.Stopped != "" {
+			return nil
+		}
+		p := path.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 && f.followLinks {
+			if target, err := client.Stat(p); err == nil {
+				info = target
+			}
+		}
+		if f.matches(info) && !f.found(sftpFindEntry(p, info)) {
+			return nil
+		}
+		if info.IsDir() && depth+1 < f.maxDepth {
+			if err := f.walk(ctx, client, p, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matches tells whether an entry found over SFTP passes the filters, which
+// find applies itself
+func (f *fileFind) matches(info os.FileInfo) bool {
+	if f.name != "" {
+		name, glob := info.Name(), f.name
+		if f.ignoreCase {
+			name, glob = strings.ToLower(name), strings.ToLower(glob)
+		}
+		if ok, _ := path.Match(glob, name); !ok {
+			return false
+		}
+	}
+	switch {
+	case f.typ == "file" && !info.Mode().IsRegular(),
+		f.typ == "dir" && !info.IsDir(),
+		f.minSize > 0 && info.Size() < f.minSize,
+		f.maxSize >= 0 && info.Size() > f.maxSize,
+		!f.after.IsZero() && !info.ModTime().After(f.after),
+		!f.before.IsZero() && info.ModTime().After(f.before):
+		return false
+	}
+	return true
+}
+
+// sftpFindEntry describes an entry found over SFTP
+func sftpFindEntry(p string, info os.FileInfo) findEntry {
+	e := findEntry{
+		Path:     p,
+		Name:     info.Name(),
+		Size:     info.Size(),
+		Mode:     fmt.Sprintf("%04o", info.Mode().Perm()),
+		Modified: info.ModTime().UTC(),
+		Type:     "other",
+	}
+	switch {
+	case info.Mode().IsRegular():
+		e.Type = "file"
+	case info.IsDir():
+		e.Type = "dir"
+	case info.Mode()&os.ModeSymlink != 0:
+		e.Type = "link"
+	}
+	return e
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshbridge"
+	"gossh/internal/sshtest"
+)
+
+// startTestGateway serves every endpoint, as a listener of role all does
+func startTestGateway(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newMux(roleAll))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testPage is the terminal page's end of a session: a WebSocket client of
+// /ws and what the server sent it
+type testPage struct {
+	conn    *websocket.Conn
+	session sshbridge.SessionMessage
+	output  []byte
+	texts   [][]byte
+}
+
+// openTestPage connects to /ws with query and waits for the session to
+// start
+func openTestPage(t *testing.T, srv *httptest.Server, query url.Values) *testPage {
+	t.Helper()
+	return openTestPageWith(t, srv, query, nil)
+}
+
+// openTestPageWith is openTestPage sending header too, such as the user
+// an authentication proxy names
+func openTestPageWith(t *testing.T, srv *httptest.Server, query url.Values, header http.Header) *testPage {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?" + query.Encode()
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Origin", srv.URL)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &testPage{conn: conn}
+	p.readUntil(t, func() bool {
+		for _, text := range p.texts {
+			if json.Unmarshal(text, &p.session) == nil && p.session.Type == "session" {
+				return true
+			}
+		}
+		return false
+	})
+	return p
+}
+
+func (p *testPage) send(t *testing.T, msg sshbridge.ClientMessage) {
+	t.Helper()
+	if err := p.conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readUntil reads what the server sends until done is true
+func (p *testPage) readUntil(t *testing.T, done func() bool) {
+	t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for !done() {
+		messageType, data, err := p.conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%v; the page got %q and %q", err, p.output, p.texts)
+		}
+		if messageType == websocket.BinaryMessage {
+			p.output = append(p.output, data...)
+		} else {
+			p.texts = append(p.texts, data)
+		}
+	}
+}
+
+// uploadResponse returns the page's answer to the upload with id, if any
+func (p *testPage) uploadResponse(id string) (sshbridge.UploadResponse, bool) {
+	for _, text := range p.texts {
+		var resp sshbridge.UploadResponse
+		if json.Unmarshal(text, &resp) == nil && resp.Type == "upload_response" && resp.ID == id {
+			return resp, true
+		}
+	}
+	return sshbridge.UploadResponse{}, false
+}
+
+// waitSessionEnded waits for the session with id to be unregistered
+func waitSessionEnded(t *testing.T, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := sessions.get(id); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// apiRequest returns a request to path on srv, with body sent as JSON and
+// key as the bearer token when they are set
+func apiRequest(t *testing.T, srv *httptest.Server, method, path, key string, body interface{}) *http.Request {
+	t.Helper()
+	var data io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = bytes.NewReader(b)
+	}
+	r, err := http.NewRequest(method, srv.URL+path, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	return r
+}
+
+// callAPI sends r and returns the status and body of the response
+func callAPI(t *testing.T, r *http.Request) (int, []byte) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestTerminalSession(t *testing.T) {
+	useConfig(t, "")
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+	page := openTestPage(t, srv, url.Values{"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password}})
+	if page.session.SessionID == "" || page.session.User != sshtest.User || page.session.SessionKey == "" {
+		t.Errorf("session %+v", page.session)
+	}
+
+	page.send(t, sshbridge.ClientMessage{Type: "input", Data: "echo hello-$((40 + 2))\n"})
+	page.readUntil(t, func() bool { return bytes.Contains(page.output, []byte("hello-42")) })
+
+	page.send(t, sshbridge.ClientMessage{Type: "resize", Cols: 132, Rows: 43})
+	deadline := time.Now().Add(5 * time.Second)
+	for resized := false; !resized; {
+		for _, w := range server.WindowChanges() {
+			resized = resized || (w.Cols == 132 && w.Rows == 43)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("window changes %+v, want 132x43", server.WindowChanges())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An upload from the page lands in /tmp on the host
+	name := fmt.Sprintf("gossh-test-%d.txt", time.Now().UnixNano())
+	t.Cleanup(func() { os.Remove(filepath.Join("/tmp", name)) })
+	content := []byte("uploaded through the page\n")
+	page.send(t, sshbridge.ClientMessage{Type: "upload", ID: "u1", Filename: name, Data: base64.StdEncoding.EncodeToString(content)})
+	var resp sshbridge.UploadResponse
+	page.readUntil(t, func() bool {
+		var ok bool
+		resp, ok = page.uploadResponse("u1")
+		return ok
+	})
+	if !resp.Success || resp.Path != "/tmp/"+name {
+		t.Fatalf("upload response %+v", resp)
+	}
+	if got, err := os.ReadFile(resp.Path); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("uploaded file has %q: %v", got, err)
+	}
+
+	// A download through the session
+	report := filepath.Join(t.TempDir(), "report.csv")
+	if err := os.WriteFile(report, []byte("id,name\n1,web01\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"session": {page.session.SessionID}, "session_key": {page.session.SessionKey}, "path": {report}}
+	download, err := http.Get(srv.URL + "/download?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(download.Body)
+	download.Body.Close()
+	if download.StatusCode != http.StatusOK || string(body) != "id,name\n1,web01\n" {
+		t.Errorf("download got %d %q", download.StatusCode, body)
+	}
+	// Without the session key it is someone else's session
+	query.Del("session_key")
+	refused, err := http.Get(srv.URL + "/download?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Body.Close()
+	if refused.StatusCode != http.StatusForbidden {
+		t.Errorf("download without the session key got %d, want 403", refused.StatusCode)
+	}
+
+	// The page going away ends the session
+	page.conn.Close()
+	waitSessionEnded(t, page.session.SessionID)
+}
+
+func TestTerminalSessionEndsWithShell(t *testing.T) {
+	useConfig(t, "")
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+	page := openTestPage(t, srv, url.Values{"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password}})
+
+	page.send(t, sshbridge.ClientMessage{Type: "input", Data: "exit\n"})
+	page.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := page.conn.ReadMessage(); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatal("the page wasn't disconnected when the shell exited")
+			}
+			break
+		}
+	}
+	waitSessionEnded(t, page.session.SessionID)
+}
+
+func TestTerminalLoginFails(t *testing.T) {
+	useConfig(t, "")
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Without query parameters the page sends host|user|password
+	conn.WriteMessage(websocket.TextMessage, []byte(server.Addr+"|"+sshtest.User+"|wrong"))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil || !strings.HasPrefix(string(msg), "Error: ") {
+		t.Errorf("got %q, %v, want an error", msg, err)
+	}
+}
@@ -7,11 +7,14 @@ from cryptography.fernet import Fernet
 import base64
 import sys
 import argparse
+from urllib.parse import urlencode
 
 # Default key - should match the one in main.go
 DEFAULT_KEY = b'boFzsBC8_fuLeMR2JM75_ZyeQEcm_simjV81EURjxew='
 
-def generate_access_token(user, host, private_key_path=None, key=DEFAULT_KEY):
+def generate_access_token(user, host, private_key_path=None, key=DEFAULT_KEY, commands=None,
+                          read_only=False, initial_command=None, credentials=None, operations=None,
+                          quota_mb=None, remote_forwards=None, protocol=None):
     """Generate an encrypted access token"""
     f = Fernet(key)
     
@@ -25,6 +28,36 @@ def generate_access_token(user, host, private_key_path=None, key=DEFAULT_KEY):
             private_key_b64 = base64.b64encode(private_key_content).decode()
             parts.append(f"privatekey={private_key_b64}")
     
+    # Restrict the session to these command patterns
+    for command in commands or []:
+        parts.append(urlencode({"command": command}))
+    
+    # Fetch the SSH credentials from Vault instead, e.g. vault:secret/data/ssh/db01
+    if credentials:
+        parts.append(urlencode({"credentials": credentials}))
+    
+    # Limit what the token may be used for: terminal, upload, download, tunnel
+    for operation in operations or []:
+        parts.append(urlencode({"operation": operation}))
+    
+    # Expose services near gossh on the SSH host, REMOTE_PORT:HOST:PORT
+    for forward in remote_forwards or []:
+        parts.append(urlencode({"remote_forward": forward}))
+    
+    # Telnet devices log in at their own prompt; telnet.enabled must be set
+    if protocol and protocol != "ssh":
+        parts.append(urlencode({"protocol": protocol}))
+    
+    # Cap the MiB this token may transfer per quotas.window
+    if quota_mb:
+        parts.append(f"quota_mb={quota_mb}")
+    
+    # View-only session, optionally running a command instead of the shell
+    if read_only:
+        parts.append("read_only=true")
+    if initial_command:
+        parts.append(urlencode({"initial_command": initial_command}))
+    
     data = "&".join(parts)
     data_b64 = base64.b64encode(data.encode()).decode()
     
@@ -43,8 +76,19 @@ if __name__ == "__main__":
     parser.add_argument('--user', help='SSH username')
     parser.add_argument('--host', help='SSH host')
     parser.add_argument('--key', help='Path to private key file')
+    parser.add_argument('--command', action='append', help='Allowed command pattern for a restricted session (repeatable)')
+    parser.add_argument('--read-only', action='store_true', help='Open a view-only session that ignores keyboard input')
+    parser.add_argument('--initial-command', help='Command to run instead of the login shell, e.g. "journalctl -f"')
+    parser.add_argument('--credentials', help='Credential source, e.g. vault:secret/data/ssh/db01 or vault-ssh:<role>')
+    parser.add_argument('--operation', action='append', choices=['terminal', 'upload', 'download', 'tunnel'],
+                        help='Operation the token permits (repeatable, default all)')
+    parser.add_argument('--quota-mb', type=int, help='Transfer quota of the token in MiB per quotas.window')
+    parser.add_argument('--remote-forward', action='append',
+                        help='Expose a local address on the SSH host, REMOTE_PORT:HOST:PORT (repeatable)')
+    parser.add_argument('--protocol', choices=['ssh', 'telnet'], default='ssh',
+                        help='Connection protocol; telnet is unencrypted and needs no --user')
     parser.add_argument('--fernet-key', help='Custom Fernet encryption key')
-    parser.add_argument('--base-url', default='http://localhost:8088', help='Base URL of the bastion server')
+    parser.add_argument('--base-url', default='http://localhost:8022', help='Base URL of the bastion server')
     
     args = parser.parse_args()
     
@@ -53,7 +97,7 @@ if __name__ == "__main__":
         print(generate_new_key())
         sys.exit(0)
     
-    if not args.user or not args.host:
+    if not args.host or (not args.user and args.protocol != 'telnet'):
         parser.print_help()
         print("\nExample usage:")
         print("  python3 generate_url.py --user root --host example.com --key ~/.ssh/id_rsa")
@@ -61,8 +105,11 @@ if __name__ == "__main__":
     
     fernet_key = args.fernet_key.encode() if args.fernet_key else DEFAULT_KEY
     
-    token = generate_access_token(args.user, args.host, args.key, fernet_key)
-    url = f"{args.base_url}/?access={token}"
+    token = generate_access_token(args.user or '', args.host, args.key, fernet_key, args.command,
+                                  args.read_only, args.initial_command, args.credentials,
+                                  args.operation, args.quota_mb, args.remote_forward,
+                                  args.protocol)
+    url = f"{args.base_url}/access#{token}"
     
     print("Encrypted Access URL:")
     print(url)
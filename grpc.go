@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"gossh/internal/sshbridge"
+	"gossh/terminalpb"
+)
+
+// inheritedGRPCPrefix marks the gRPC listener among handed-over sockets
+const inheritedGRPCPrefix = "grpc:"
+
+// GRPCConfig serves the terminal API for gRPC clients on a listener of its
+// own. Changes require a restart.
+type GRPCConfig struct {
+	// Listen is host:port; empty disables the API
+	Listen string    `yaml:"listen"`
+	TLS    TLSConfig `yaml:"tls"`
+}
+
+func validateGRPCConfig(cfg GRPCConfig) []string {
+	if cfg.Listen == "" {
+		return nil
+	}
+	var problems []string
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("grpc.listen: %v", err))
+	}
+	if !cfg.TLS.Enabled() {
+		problems = append(problems, "grpc.listen requires grpc.tls; clients send API keys and SSH credentials")
+	}
+	return append(problems, validateTLSConfig("grpc.tls", cfg.TLS)...)
+}
+
+// grpcRequestKey stores the HTTP request a gRPC call arrived in
+type grpcRequestKey struct{}
+
+// startGRPCServer starts serving the gRPC API and returns the server so
+// shutdown can drain it.
+func startGRPCServer(cfg *Config) (*http.Server, boundListener, *certReloader, error) {
+	tlsConfig, reloader, err := newTLSConfig(&cfg.GRPC.TLS)
+	if err != nil {
+		return nil, boundListener{}, nil, err
+	}
+
+	key := inheritedGRPCPrefix + cfg.GRPC.Listen
+	var ln net.Listener
+	if f, ok := inheritedListeners[key]; ok {
+		delete(inheritedListeners, key)
+		ln, err = adoptListener(f)
+	} else {
+		ln, err = net.Listen("tcp", cfg.GRPC.Listen)
+	}
+	if err != nil {
+		return nil, boundListener{}, nil, err
+	}
+
+	server := newHTTPServer(newGRPCHandler(), cfg.Server.Timeouts)
+	server.TLSConfig = tlsConfig
+
+	slog.Info("gRPC API listening", "addr", ln.Addr().String())
+	go func() {
+		if err := server.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+			fatal("gRPC API stopped", "addr", ln.Addr().String(), "err", err)
+		}
+	}()
+	return server, boundListener{ListenerConfig: ListenerConfig{Address: key}, ln: ln}, reloader, nil
+}
+
+// newGRPCHandler serves the terminal service to HTTP/2 requests, behind
+// the same allowlist, rate limit, identity header check and access log as
+// the HTTP listeners. Metadata arrives as headers, so a client could
+// otherwise name itself in authz.user_header.
+func newGRPCHandler() http.Handler {
+	grpcServer := grpc.NewServer()
+	terminalpb.RegisterTerminalServer(grpcServer, terminalService{})
+	return withAccessLog(withRecovery(withClientAllowlist(withRateLimit(withIdentityHeaders(withoutDeadlines(func(w http.ResponseWriter, r *http.Request) {
+		grpcServer.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grpcRequestKey{}, r)))
+	}))))))
+}
+
+// terminalService opens terminal sessions for gRPC clients
+type terminalService struct {
+	terminalpb.UnimplementedTerminalServer
+}
+
+// Stream authenticates the call, reads the connect message and runs the
+// session as a WebSocket session would be run
+func (terminalService) Stream(stream terminalpb.Terminal_StreamServer) error {
+	r, err := authenticateStream(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := maintenance.check(); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	connect := first.GetConnect()
+	if connect == nil {
+		return status.Error(codes.InvalidArgument, "The first message must be a connect")
+	}
+
+	var creds SSHCredentials
+	if connect.Access != "" {
+		creds, err = decryptAccessRequest(r, connect.Access)
+		if err != nil {
+			requestLogger(r).Warn("Failed to decrypt access token", "err", err)
+			return status.Error(codes.InvalidArgument, "Invalid access token")
+		}
+	} else {
+		creds = SSHCredentials{
+			Host:     connect.Host,
+			User:     connect.User,
+			Password: connect.Password,
+			Source:   connect.Credentials,
+			Protocol: connect.Protocol,
+		}
+		if len(connect.PrivateKey) > 0 {
+			creds.PrivateKey = base64.StdEncoding.EncodeToString(connect.PrivateKey)
+		}
+		creds.Host, creds.User = resolveHost(creds.Host, creds.User)
+	}
+	if creds.Host == "" || (creds.User == "" && creds.Source == "" && creds.Protocol != protocolTelnet) {
+		return status.Error(codes.InvalidArgument, "Missing host or user")
+	}
+
+	conn := newStreamConn(stream)
+	connectWithCredentials(conn, r, creds)
+	conn.finish()
+	return nil
+}
+
+// authenticateStream returns the HTTP request of a call, authenticated by
+// its API key. Unlike the HTTP API, the gRPC API always requires one.
+func authenticateStream(ctx context.Context) (*http.Request, error) {
+	r, ok := ctx.Value(grpcRequestKey{}).(*http.Request)
+	if !ok {
+		return nil, status.Error(codes.Internal, "request not available")
+	}
+	secret := bearerToken(r)
+	if secret == "" {
+		return nil, status.Error(codes.Unauthenticated, "API key required")
+	}
+	key := lookupAPIKey(secret)
+	if key == nil {
+		requestLogger(r).Warn("Rejected invalid API key", "path", r.URL.Path)
+		return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+	}
+	if !key.hasScope(scopeTerminal) {
+		requestLogger(r).Warn("API key denied: missing scope", "api_key", key.Name, "scope", scopeTerminal, "path", r.URL.Path)
+		return nil, status.Errorf(codes.PermissionDenied, "API key lacks the %q scope", scopeTerminal)
+	}
+	if key.limiter != nil && !key.limiter.Allow() {
+		return nil, status.Error(codes.ResourceExhausted, "API key rate limit exceeded")
+	}
+	return withAPIKey(r, key), nil
+}
+
+// streamConn runs a terminal session over a gRPC stream, translating
+// between the protobuf messages and the WebSocket messages the session
+// speaks
+type streamConn struct {
+	stream terminalpb.Terminal_StreamServer
+	in     chan streamFrame
+
+	// mu serializes sends; nothing is sent once finished
+	mu       sync.Mutex
+	finished bool
+	exit     *terminalpb.Exit
+
+	// done ends reading once the session closes the connection
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newStreamConn(stream terminalpb.Terminal_StreamServer) *streamConn {
+	c := &streamConn{
+		stream: stream,
+		in:     make(chan streamFrame),
+		exit:   &terminalpb.Exit{Status: -1},
+		done:   make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+// streamFrame is a client message in its WebSocket form
+type streamFrame struct {
+	messageType int
+	data        []byte
+}
+
+// receive turns input and resize messages into their WebSocket form until
+// the client stops sending
+func (c *streamConn) receive() {
+	defer close(c.in)
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return
+		}
+		var frame streamFrame
+		switch m := msg.Msg.(type) {
+		case *terminalpb.ClientMessage_Input:
+			frame = streamFrame{websocket.BinaryMessage, m.Input.GetData()}
+		case *terminalpb.ClientMessage_Resize:
+			data, _ := json.Marshal(sshbridge.ClientMessage{Type: "resize", Cols: int(m.Resize.GetCols()), Rows: int(m.Resize.GetRows())})
+			frame = streamFrame{websocket.TextMessage, data}
+		default:
+			continue
+		}
+		select {
+		case c.in <- frame:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *streamConn) ReadMessage() (int, []byte, error) {
+	select {
+	case frame, ok := <-c.in:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		return frame.messageType, frame.data, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteMessage sends output, errors and the session message. Other text
+// messages, such as upload responses, have no counterpart in the API.
+func (c *streamConn) WriteMessage(messageType int, data []byte) error {
+	msg := &terminalpb.ServerMessage{}
+	switch {
+	case messageType == websocket.BinaryMessage:
+		msg.Msg = &terminalpb.ServerMessage_Output{Output: &terminalpb.Output{Data: data}}
+	case bytes.HasPrefix(data, []byte("Error: ")):
+		text := strings.TrimSpace(strings.TrimPrefix(string(data), "Error: "))
+		msg.Msg = &terminalpb.ServerMessage_Error{Error: &terminalpb.Error{Message: text}}
+	default:
+		var session sshbridge.SessionMessage
+		if err := json.Unmarshal(data, &session); err != nil || session.Type != "session" {
+			return nil
+		}
+		msg.Msg = &terminalpb.ServerMessage_Session{Session: &terminalpb.Session{
+			SessionId: session.SessionID,
+			Host:      session.Host,
+			User:      session.User,
+			ReadOnly:  session.ReadOnly,
+			Protocol:  session.Protocol,
+			Insecure:  session.Insecure,
+		}}
+	}
+	return c.send(msg)
+}
+
+// WriteControl reports the reason of a close message as an error
+func (c *streamConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != websocket.CloseMessage || len(data) <= 2 {
+		return nil
+	}
+	return c.send(&terminalpb.ServerMessage{Msg: &terminalpb.ServerMessage_Error{Error: &terminalpb.Error{Message: string(data[2:])}}})
+}
+
+// SetWriteDeadline does nothing; a stalled client is left to gRPC flow
+// control and keepalives
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close stops reading input. The stream stays open until the session has
+// ended and the exit status is sent.
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// promptless: the API has no messages for keyboard-interactive prompts
+func (c *streamConn) promptless() {}
+
+// rawOutput: API clients get rz and sz as they are, to run ZMODEM themselves
+func (c *streamConn) rawOutput() {}
+
+func (c *streamConn) ReportExit(err error) {
+	exit := &terminalpb.Exit{}
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		exit.Status = int32(exitErr.ExitStatus())
+		exit.Signal = exitErr.Signal()
+	default:
+		exit.Status = -1
+	}
+	c.mu.Lock()
+	c.exit = exit
+	c.mu.Unlock()
+}
+
+func (c *streamConn) send(msg *terminalpb.ServerMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		return net.ErrClosed
+	}
+	return c.stream.Send(msg)
+}
+
+// finish sends the exit message, which ends the stream; the session's
+// goroutines may still be winding down, so later messages are dropped
+func (c *streamConn) finish() {
+	c.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.finished {
+		c.finished = true
+		c.stream.Send(&terminalpb.ServerMessage{Msg: &terminalpb.ServerMessage_Exit{Exit: c.exit}})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"gossh/internal/sshtest"
+	"gossh/terminalclient"
+	"gossh/terminalpb"
+)
+
+// startGRPCAPI serves the gRPC API over TLS and returns a client using an
+// API key with the given scopes
+func startGRPCAPI(t *testing.T, scopes ...string) *terminalclient.Client {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(newGRPCHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	secret, _, err := mintAPIKey("grpc-"+strings.Join(scopes, "-"), scopes, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	client, err := terminalclient.Dial(strings.TrimPrefix(srv.URL, "https://"), secret, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// readUntil reads session output until it contains want
+func readUntil(t *testing.T, s *terminalclient.Session, want string) string {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, 4096)
+	for !strings.Contains(string(out), want) {
+		n, err := s.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			t.Fatalf("%v before %q in the output %q", err, want, out)
+		}
+	}
+	return string(out)
+}
+
+func TestGRPCTerminalEndToEnd(t *testing.T) {
+	useConfig(t, "")
+	server := sshtest.Start(t, nil)
+	client := startGRPCAPI(t, scopeTerminal)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session, err := client.Open(ctx, &terminalpb.Connect{Host: server.Addr, User: sshtest.User, Password: sshtest.Password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Info.GetSessionId() == "" || session.Info.GetUser() != sshtest.User {
+		t.Errorf("session %+v", session.Info)
+	}
+
+	if err := session.Resize(132, 43); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(session, "echo hello-$((40 + 2))\n")
+	readUntil(t, session, "hello-42")
+	resized := false
+	for _, w := range server.WindowChanges() {
+		resized = resized || (w.Cols == 132 && w.Rows == 43)
+	}
+	if !resized {
+		t.Errorf("window changes %+v, want 132x43", server.WindowChanges())
+	}
+
+	io.WriteString(session, "exit 3\n")
+	if _, err := io.ReadAll(session); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.Exit().GetStatus(); got != 3 {
+		t.Errorf("exit status %d, want 3", got)
+	}
+}
+
+func TestGRPCTerminalErrors(t *testing.T) {
+	useConfig(t, "")
+	server := sshtest.Start(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := startGRPCAPI(t, scopeTerminal)
+	_, err := client.Open(ctx, &terminalpb.Connect{Host: server.Addr, User: sshtest.User, Password: "wrong"})
+	var sessionErr *terminalclient.SessionError
+	if !errors.As(err, &sessionErr) {
+		t.Errorf("wrong password: got %v, want a session error", err)
+	}
+	_, err = client.Open(ctx, &terminalpb.Connect{Host: server.Addr})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("no user: got %v, want InvalidArgument", err)
+	}
+
+	download := startGRPCAPI(t, scopeDownload)
+	_, err = download.Open(ctx, &terminalpb.Connect{Host: server.Addr, User: sshtest.User, Password: sshtest.Password})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("key without the terminal scope: got %v, want PermissionDenied", err)
+	}
+}
+
+func TestGRPCDropsForgedIdentityMetadata(t *testing.T) {
+	useConfig(t, `
+authz:
+  user_header: X-User
+  host_policies:
+    - name: restricted
+      hosts: ["127.0.0.1"]
+      require_approval: true
+`)
+	server := sshtest.Start(t, nil)
+	client := startGRPCAPI(t, scopeTerminal)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The test server's peer isn't in server.trusted_proxies
+	forged := metadata.AppendToOutgoingContext(ctx, "x-user", "mallory")
+	_, err := client.Open(forged, &terminalpb.Connect{Host: server.Addr, User: sshtest.User, Password: sshtest.Password})
+	if err == nil || !strings.Contains(err.Error(), "identified by the authentication proxy") {
+		t.Errorf("session opened as mallory: got %v, want refused for want of an identified user", err)
+	}
+	if pending := approvals.list(approvalPending); len(pending) != 0 {
+		t.Errorf("requests filed: %+v", pending)
+	}
+}
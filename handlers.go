@@ -0,0 +1,722 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fernet/fernet-go"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+	"gossh/internal/transfer"
+)
+
+type SSHCredentials struct {
+	Host       string
+	User       string
+	Password   string
+	PrivateKey string
+	Commands   []string // restricts the session to these command patterns
+	ReadOnly   bool     // view-only session, input is dropped
+	// InitialCommand runs instead of the login shell
+	InitialCommand string
+	// Source names where to fetch the credentials from instead, e.g.
+	// "vault:secret/data/ssh/db01"
+	Source string
+	// Operations limits what the token may be used for; empty allows all
+	Operations []string
+	// Token identifies the access token for transfer quotas
+	Token quotaToken
+	// RemoteForwards are opened on the SSH host for the session
+	RemoteForwards []remoteForward
+	// Protocol is "ssh" (or empty) or "telnet"
+	Protocol string
+}
+
+func noCacheStaticHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	http.StripPrefix("/static/", http.FileServer(http.Dir("static"))).ServeHTTP(w, r)
+}
+
+// pageData is rendered into every page. The fields are documented in the
+// README for teams maintaining their own templates.
+type pageData struct {
+	BasePath string // prefix for links, "" at the root
+	Version  string
+	UI       UIConfig
+	// Consented is set when the usage notice has been accepted
+	Consented bool
+	// Demo pre-fills the login form when running with -demo
+	Demo *demoLogin
+	// Protocols lists the connection protocols offered, SSH first.
+	// Telnet is only listed when enabled and is marked Insecure.
+	Protocols []protocolOption
+	// Hosts lists the configured host aliases by name
+	Hosts []hostOption
+	// Profiles lists the connection profiles the visitor may use
+	Profiles []Profile
+	// HostGroups lists the hosts the visitor may open terminals to by
+	// group, then those in no group under ""
+	HostGroups []hostGroupListing
+	// Recent lists the visitor's recent connections, most recent first
+	Recent []historyEntry
+	// CheckHost is set when the login form may check hosts through
+	// /api/check-host
+	CheckHost bool
+}
+
+func newPageData(r *http.Request) pageData {
+	ui := currentConfig().UI
+	id := requestIdentity(r)
+	data := pageData{
+		BasePath:   basePath(r),
+		Version:    build.Version,
+		UI:         ui,
+		Consented:  ui.RequireConsent && hasConsent(r),
+		Protocols:  protocolOptions(),
+		Hosts:      hostOptions(),
+		Profiles:   profiles.visibleTo(id),
+		HostGroups: hostGroupListings(id),
+		Recent:     recentForIdentity(id),
+		CheckHost:  len(currentConfig().checkTargets) > 0,
+	}
+	if demo != nil {
+		data.Demo = demo.login()
+	}
+	return data
+}
+
+// terminalPageData is rendered into terminal.html. It must never carry
+// credentials; access-token sessions only receive a single-use connection ID.
+type terminalPageData struct {
+	pageData
+	ConnectionID string
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	httpapi.JSON(w, map[string]interface{}{
+		"status": "ok",
+		"config": configState.status(),
+	})
+}
+
+// readyzHandler tells load balancers whether to send new work here. It
+// fails during maintenance and shutdown, while /healthz keeps passing.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	state := "ready"
+	if sessions.isDraining() {
+		status, state = http.StatusServiceUnavailable, "shutting_down"
+	} else if maintenance.check() != nil {
+		status, state = http.StatusServiceUnavailable, "maintenance"
+	}
+	httpapi.JSONStatus(w, status, map[string]interface{}{
+		"status":      state,
+		"maintenance": maintenance.status(),
+		"sessions":    sessions.count(),
+	})
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	// Access token posted by a form or the /access bounce page
+	if r.Method == "POST" {
+		token := r.PostFormValue("access")
+		if token == "" {
+			responder.ErrorCode(w, r, httpapi.MissingParams, "Missing access token")
+			return
+		}
+		handOffAccess(w, r, token)
+		return
+	}
+
+	// Access token left by the /access landing endpoint
+	if cookie, err := r.Cookie(accessCookieName); err == nil && cookie.Value != "" {
+		setAccessCookie(w, r, "")
+		handOffAccess(w, r, cookie.Value)
+		return
+	}
+
+	// Legacy links carrying the token in the query string
+	if accessParam := r.URL.Query().Get("access"); accessParam != "" {
+		if !currentConfig().Security.AllowQueryToken {
+			requestLogger(r).Warn("Rejected access token in query string")
+			responder.ErrorCode(w, r, httpapi.TokenInURL, "Access tokens in the URL are disabled; use /access#<token> instead")
+			return
+		}
+		handOffAccess(w, r, accessParam)
+		return
+	}
+
+	// Direct access mode - render terminal page for a handed-off connection
+	if connID := r.URL.Query().Get("conn"); connID != "" {
+		renderTemplate(w, r, "terminal.html", terminalPageData{pageData: newPageData(r), ConnectionID: connID})
+		return
+	}
+
+	// Normal mode - render the form page
+	renderTemplate(w, r, "index.html", newPageData(r))
+}
+
+func terminalHandler(w http.ResponseWriter, r *http.Request) {
+	// Render the terminal popup page
+	renderTemplate(w, r, "terminal.html", terminalPageData{pageData: newPageData(r)})
+}
+
+// uploadResponse is the body of a successful /upload
+type uploadResponse struct {
+	Success bool   `json:"success"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	// Skipped is set when an if_changed upload found the file already there
+	Skipped bool   `json:"skipped,omitempty"`
+	Warning string `json:"warning,omitempty"`
+	// Extracted is set when the upload was an archive sent with extract
+	Extracted *transfer.ExtractResult `json:"extracted,omitempty"`
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+
+	// Parse multipart form (max 2GB)
+	r.ParseMultipartForm(2 << 30) // 2GB
+
+	// Get file from form
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.BadRequest, "Failed to read file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	target, err := resolveTransferTarget(r, opUpload, r.FormValue)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	if err := authorize(r, target.Host, target.User, opUpload); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	if err := quotas.check(target.Quotas); err != nil {
+		responder.Error(w, r, err, httpapi.QuotaExceeded)
+		return
+	}
+
+	// A sha256 from the client is checked before the file is put in
+	// place. if_changed leaves an identical file at the destination alone,
+	// reading the sha256 from the form when the client gave none.
+	opts := transfer.UploadOptions{Size: header.Size}
+	if opts.SHA256, err = transfer.ParseChecksum(r.FormValue("sha256")); err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	opts.IfChanged, _ = strconv.ParseBool(r.FormValue("if_changed"))
+	if opts.IfChanged && opts.SHA256 == "" {
+		if opts.SHA256, err = transfer.RewoundChecksum(file); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Failed to read file: "+err.Error())
+			return
+		}
+	}
+	// extract unpacks an archive into extract_to once it is in place
+	if opts.Extract, err = transfer.ParseExtractRequest(r.FormValue, header.Filename, file, header.Size, currentConfig().Transfers.limits()); err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	// Upload file via SSH
+	meta := newRequestMeta(r)
+	mirror, err := startMirror(mirrorRecord{
+		Direction: auditUpload,
+		User:      meta.User,
+		ClientIP:  meta.ClientIP,
+		Session:   mirrorSession(meta, target.Session),
+		Filename:  header.Filename,
+	})
+	if err != nil {
+		responder.Error(w, r, err, httpapi.Internal)
+		return
+	}
+	meter := &quotaMeter{subjects: target.Quotas, meta: meta, op: opUpload}
+	ctx, span := startRequestSpan(r, "transfer.upload")
+	var result transfer.Result
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		result, err = transferHost(meta.Log, sshConn).Upload(mirror.reader(quotaReader{r: file, meter: meter}), header.Filename, opts)
+		release()
+	}
+	if result.Skipped {
+		mirror.discard()
+	} else if mirrorErr := mirror.finish([]mirrorHost{{Host: target.Host, SSHUser: target.User, Path: result.Path, Success: err == nil, Error: errorString(err)}}, err); err == nil {
+		err = mirrorErr
+	}
+	span.SetAttributes(attribute.Int64("gossh.transfer.size", result.Size))
+	endSpan(span, err)
+	audit.Emit(AuditEvent{
+		Event:    auditUpload,
+		Outcome:  outcomeOf(err),
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     target.Host,
+		SSHUser:  target.User,
+		Path:     result.Path,
+		Size:     result.Size,
+		SHA256:   result.SHA256,
+		Action:   transfer.UploadAction(result),
+		Error:    errorString(err),
+	})
+	if err != nil {
+		if meter.err != nil {
+			err = meter.err
+		}
+		responder.Error(w, r, err, httpapi.TransferFailed)
+		return
+	}
+
+	httpapi.JSON(w, uploadResponse{
+		Success:   true,
+		Path:      result.Path,
+		Size:      result.Size,
+		SHA256:    result.SHA256,
+		Skipped:   result.Skipped,
+		Warning:   result.Warning,
+		Extracted: result.Extracted,
+	})
+}
+
+func validateDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	remotePath := r.URL.Query().Get("path")
+
+	target, err := resolveTransferTarget(r, opDownload, r.URL.Query().Get)
+	if err == nil && remotePath == "" {
+		err = httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	// Validate remote path - only allow downloads from /home, /opt, and /tmp,
+	// or from Users on Windows hosts, which is checked again once the
+	// host's platform is known
+	if !transfer.DownloadPathAllowed(remotePath) {
+		responder.ErrorCode(w, r, httpapi.PathNotAllowed, "Access denied: Downloads are only allowed from /home, /opt, and /tmp directories, or from Users on Windows hosts")
+		return
+	}
+
+	if err := authorize(r, target.Host, target.User, opDownload); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	if err := quotas.check(target.Quotas); err != nil {
+		responder.Error(w, r, err, httpapi.QuotaExceeded)
+		return
+	}
+
+	// Check if file exists via SSH
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "transfer.validate")
+	var fileInfo map[string]interface{}
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		fileInfo, err = transferHost(meta.Log, sshConn).Validate(remotePath)
+		release()
+	}
+	endSpan(span, err)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.TransferFailed)
+		return
+	}
+
+	httpapi.JSON(w, map[string]interface{}{
+		"valid":    true,
+		"filename": fileInfo["filename"],
+		"size":     fileInfo["size"],
+	})
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+	remotePath := r.URL.Query().Get("path")
+
+	target, err := resolveTransferTarget(r, opDownload, r.URL.Query().Get)
+	if err == nil && remotePath == "" {
+		err = httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+
+	if err := authorize(r, target.Host, target.User, opDownload); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	if err := quotas.check(target.Quotas); err != nil {
+		responder.Error(w, r, err, httpapi.QuotaExceeded)
+		return
+	}
+
+	// Stream file from SSH server directly to response
+	meta := newRequestMeta(r)
+	mirror, err := startMirror(mirrorRecord{
+		Direction: auditDownload,
+		User:      meta.User,
+		ClientIP:  meta.ClientIP,
+		Session:   mirrorSession(meta, target.Session),
+		Filename:  transferFileName(remotePath),
+	})
+	if err != nil {
+		responder.Error(w, r, err, httpapi.Internal)
+		return
+	}
+	meter := &quotaMeter{subjects: target.Quotas, meta: meta, op: opDownload}
+	ctx, span := startRequestSpan(r, "transfer.download")
+	var result transfer.Result
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		result, err = transferHost(meta.Log, sshConn).Download(mirror.responseWriter(quotaResponseWriter{ResponseWriter: w, meter: meter}), remotePath, transfer.DownloadChecksum(r))
+		release()
+	}
+	if mirrorErr := mirror.finish([]mirrorHost{{Host: target.Host, SSHUser: target.User, Path: remotePath, Success: err == nil, Error: errorString(err)}}, err); err == nil {
+		err = mirrorErr
+	}
+	span.SetAttributes(attribute.Int64("gossh.transfer.size", result.Size))
+	endSpan(span, err)
+	audit.Emit(AuditEvent{
+		Event:    auditDownload,
+		Outcome:  outcomeOf(err),
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     target.Host,
+		SSHUser:  target.User,
+		Path:     remotePath,
+		Size:     result.Size,
+		SHA256:   result.SHA256,
+		Error:    errorString(err),
+	})
+	if err != nil {
+		meta.Log.Error("Download failed", "host", target.Host, "ssh_user", target.User, "path", remotePath, "err", err)
+		if meter.err != nil {
+			err = meter.err
+		}
+		responder.Error(w, r, fmt.Errorf("Download failed: %w", err), httpapi.TransferFailed)
+		return
+	}
+}
+
+func decryptAccessRequest(r *http.Request, encrypted string) (SSHCredentials, error) {
+	creds, err := decryptAccess(encrypted)
+	if err == nil {
+		creds.Host, creds.User = resolveHost(creds.Host, creds.User)
+	}
+	meta := newRequestMeta(r)
+	audit.Emit(AuditEvent{
+		Event:     auditTokenUse,
+		Outcome:   outcomeOf(err),
+		ClientIP:  meta.ClientIP,
+		User:      meta.User,
+		Host:      creds.Host,
+		SSHUser:   creds.User,
+		TokenType: "access_token",
+		Target:    r.URL.Path,
+		Error:     errorString(err),
+	})
+	return creds, err
+}
+
+func decryptAccess(encrypted string) (SSHCredentials, error) {
+	var creds SSHCredentials
+
+	// Get and validate Fernet key
+	fernetKey := getDefaultFernetKey()
+	if fernetKey == "" {
+		return creds, fmt.Errorf("fernet key not configured")
+	}
+
+	// Decode the Fernet token
+	key, err := fernet.DecodeKeys(fernetKey)
+	if err != nil {
+		return creds, fmt.Errorf("invalid fernet key: %v", err)
+	}
+
+	token_64 := fernet.VerifyAndDecrypt([]byte(encrypted), 0, key)
+	if token_64 == nil {
+		return creds, fmt.Errorf("failed to decrypt access token")
+	}
+
+	token, err := base64.StdEncoding.DecodeString(string(token_64))
+	if err != nil {
+		return creds, err
+	}
+
+	// Parse the decrypted data
+	values, err := url.ParseQuery(string(token))
+	if err != nil {
+		return creds, err
+	}
+
+	creds.User = values.Get("username")
+	creds.Host = values.Get("hostname")
+	creds.PrivateKey = values.Get("privatekey")
+	creds.Commands = values["command"]
+	creds.ReadOnly, _ = strconv.ParseBool(values.Get("read_only"))
+	creds.InitialCommand = values.Get("initial_command")
+	creds.Source = values.Get("credentials")
+	creds.Operations = values["operation"]
+	creds.Protocol = values.Get("protocol")
+	creds.Token = quotaToken{ID: accessTokenID(encrypted)}
+	for _, value := range values["remote_forward"] {
+		forward, err := parseRemoteForward(value)
+		if err != nil {
+			return creds, err
+		}
+		creds.RemoteForwards = append(creds.RemoteForwards, forward)
+	}
+	if quota := values.Get("quota_mb"); quota != "" {
+		if creds.Token.QuotaMB, err = strconv.ParseInt(quota, 10, 64); err != nil || creds.Token.QuotaMB < 0 {
+			return creds, fmt.Errorf("invalid quota_mb in access token")
+		}
+	}
+
+	return creds, nil
+}
+
+// getDefaultFernetKey returns the Fernet key from configuration
+func getDefaultFernetKey() string {
+	return currentConfig().Security.FernetKey
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		requestLogger(r).Warn("Failed to upgrade connection", "err", err)
+		return
+	}
+	defer ws.Close()
+	conn := sshbridge.Negotiate(ws)
+
+	// Established sessions are not affected by maintenance mode
+	if err := maintenance.check(); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+		return
+	}
+
+	if currentConfig().UI.RequireConsent && !hasConsent(r) {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: The usage notice must be accepted before connecting"))
+		return
+	}
+
+	// Check for a connection ID handed off by indexHandler
+	if connID := r.URL.Query().Get("conn"); connID != "" {
+		creds, ok := handoffs.take(connID)
+		if !ok {
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: Connection ID is invalid or has expired"))
+			return
+		}
+		// The connection is bound to the token's host and user
+		if err := checkBoundTarget(r.URL.Query().Get, creds.Host, creds.User); err != nil {
+			requestLogger(r).Warn("Refused handoff", "err", err)
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			return
+		}
+		connectWithCredentials(conn, r, creds)
+		return
+	}
+
+	// Check if using access token, which is only accepted in the URL where
+	// the index page would accept it too
+	accessParam := r.URL.Query().Get("access")
+	if accessParam != "" {
+		if !currentConfig().Security.AllowQueryToken {
+			requestLogger(r).Warn("Rejected access token in query string")
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: Access tokens in the URL are disabled; use /access#<token> instead"))
+			return
+		}
+		// Decrypt access token to get credentials
+		creds, err := decryptAccessRequest(r, accessParam)
+		if err != nil {
+			requestLogger(r).Warn("Failed to decrypt access token", "err", err)
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: Invalid access token"))
+			return
+		}
+		if err := checkBoundTarget(r.URL.Query().Get, creds.Host, creds.User); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			return
+		}
+		connectWithCredentials(conn, r, creds)
+		return
+	}
+
+	// Get credentials from query params or initial message
+	creds := SSHCredentials{
+		Host:       r.URL.Query().Get("host"),
+		User:       r.URL.Query().Get("user"),
+		Password:   r.URL.Query().Get("password"),
+		PrivateKey: r.URL.Query().Get("privatekey"),
+		Source:     r.URL.Query().Get("credentials"),
+		Protocol:   r.URL.Query().Get("protocol"),
+	}
+	// A profile supplies the host, the default user and any credential
+	// source; the values are copied, so deleting it later doesn't matter
+	if profileID := r.URL.Query().Get("profile"); profileID != "" {
+		if err := applyProfile(r, &creds, profileID); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			return
+		}
+	}
+
+	if creds.PrivateKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(creds.PrivateKey); err != nil {
+			requestLogger(r).Warn("Failed to decode private key", "err", err)
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: Invalid private key encoding"))
+			return
+		}
+	}
+
+	// If no credentials in query, wait for initial message with credentials
+	if creds.Host == "" {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			requestLogger(r).Warn("Failed to read credentials", "err", err)
+			return
+		}
+
+		// Parse credentials from message (format: host|user|password|privatekey_base64)
+		parts := strings.Split(string(msg), "|")
+		if len(parts) >= 2 {
+			creds.Host = parts[0]
+			creds.User = parts[1]
+			if len(parts) > 2 {
+				creds.Password = parts[2]
+			}
+			if len(parts) > 3 {
+				creds.PrivateKey = parts[3]
+			}
+		}
+	}
+
+	creds.Host, creds.User = resolveHost(creds.Host, creds.User)
+
+	// Telnet logins happen in the terminal
+	if creds.Host == "" || (creds.User == "" && creds.Source == "" && creds.Protocol != protocolTelnet) {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Missing host or user"))
+		return
+	}
+
+	connectWithCredentials(conn, r, creds)
+}
+
+// connectWithCredentials authorizes and opens a terminal session
+func connectWithCredentials(conn sshbridge.Conn, r *http.Request, creds SSHCredentials) {
+	ctx, span := startRequestSpan(r, "terminal.session")
+	defer span.End()
+	span.SetAttributes(attribute.String("server.address", hostname(creds.Host)))
+
+	if !permitsOperation(creds.Operations, opTerminal) {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Access token does not permit terminal sessions"))
+		return
+	}
+	if err := checkProtocol(creds.Protocol); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+		return
+	}
+	if err := authorize(r, creds.Host, creds.User, opTerminal); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+		return
+	}
+
+	var privateKey []byte
+	if creds.PrivateKey != "" {
+		privateKey, _ = base64.StdEncoding.DecodeString(creds.PrivateKey)
+	}
+	opts := sessionOptions{
+		AllowedCommands: sessionCommandPolicy(r, creds.Host, creds.Commands),
+		ReadOnly:        creds.ReadOnly,
+		InitialCommand:  creds.InitialCommand,
+		Operations:      creds.Operations,
+		Token:           creds.Token,
+		Quotas:          requestQuotas(r, creds.Token),
+		Identity:        requestIdentity(r),
+		RemoteForwards:  creds.RemoteForwards,
+		AutoResponses:   sessionAutoResponses(r, creds.Host),
+	}
+	if !hostPolicyTransfers(creds.Host) {
+		opts.Operations = withoutFileTransfer(opts.Operations)
+	}
+	if policy := approvalPolicy(creds.Host); policy != nil {
+		if err := awaitApproval(conn, r, creds.Host, creds.User, policy); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			return
+		}
+	}
+	if policy := dualControlPolicy(creds.Host); policy != nil {
+		shared, err := awaitParticipant(conn, r, creds.Host, creds.User, creds.ReadOnly, policy)
+		if err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			return
+		}
+		defer shared.Close()
+		conn, opts.Shared = shared.conn(), shared
+	}
+
+	if creds.Protocol == protocolTelnet {
+		// Nothing but a plain terminal can be offered over telnet
+		if len(opts.AllowedCommands) > 0 || opts.InitialCommand != "" || creds.Source != "" || len(opts.RemoteForwards) > 0 {
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: Restricted commands, initial commands, stored credentials and port forwards are not available over telnet"))
+			return
+		}
+		handleTelnetConnection(ctx, conn, newRequestMeta(r), creds.Host, opts)
+		return
+	}
+
+	// Fetch stored credentials only once the user may reach the host
+	if creds.Source != "" {
+		stored, err := lookupCredentialSource(newRequestMeta(r), requestIdentity(r), creds.Source, creds.Host, creds.User)
+		if err != nil {
+			span.SetStatus(codes.Error, redact(err.Error()))
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+			return
+		}
+		defer stored.Wipe()
+		if stored.User != "" {
+			creds.User = stored.User
+			if err := authorizeLogin(requestLogger(r), clientIP(r), requestIdentity(r).User, creds.Host, creds.User, opTerminal); err != nil {
+				conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+				return
+			}
+		}
+		creds.Password = stored.Password
+		privateKey = stored.PrivateKey
+		opts.Signer = stored.Signer
+	}
+	if creds.User == "" {
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Missing host or user"))
+		return
+	}
+	handleSSHConnection(ctx, conn, newRequestMeta(r), creds.Host, creds.User, creds.Password, privateKey, opts)
+}
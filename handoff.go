@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// handoffTTL bounds how long decrypted credentials wait for the browser to
+// open its WebSocket
+const handoffTTL = time.Minute
+
+type handoffEntry struct {
+	creds   SSHCredentials
+	expires time.Time
+}
+
+// handoffStore keeps decrypted access-token credentials server-side so that
+// only an opaque, single-use connection ID is rendered into the page
+type handoffStore struct {
+	mu      sync.Mutex
+	entries map[string]*handoffEntry
+}
+
+var handoffs = newHandoffStore()
+
+func newHandoffStore() *handoffStore {
+	s := &handoffStore{entries: make(map[string]*handoffEntry)}
+	go s.janitor()
+	return s
+}
+
+// randomID returns a random hex identifier with n bytes of entropy
+func randomID(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// put stores creds and returns the connection ID that redeems them
+func (s *handoffStore) put(creds SSHCredentials) (string, error) {
+	id, err := randomID(16)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.entries[id] = &handoffEntry{creds: creds, expires: time.Now().Add(handoffTTL)}
+	s.mu.Unlock()
+	return id, nil
+}
+
+// take redeems a connection ID. Entries are removed on first use whether or
+// not they have expired.
+func (s *handoffStore) take(id string) (SSHCredentials, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[id]
+	if !ok {
+		return SSHCredentials{}, false
+	}
+	delete(s.entries, id)
+	if time.Now().After(entry.expires) {
+		return SSHCredentials{}, false
+	}
+	return entry.creds, true
+}
+
+// janitor drops entries that were never redeemed
+func (s *handoffStore) janitor() {
+	for range time.Tick(handoffTTL / 2) {
+		now := time.Now()
+		s.mu.Lock()
+		for id, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
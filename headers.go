@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultSecurityHeaders are set on every HTML response. xterm.js is loaded
+// from jsDelivr and the terminal page uses an inline script, hence the
+// script-src and style-src allowances.
+var defaultSecurityHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'self'; " +
+		"script-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+		"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+		"connect-src 'self'; img-src 'self' data:; object-src 'none'; " +
+		"base-uri 'none'; form-action 'self'; frame-ancestors 'none'",
+	"X-Frame-Options":        "DENY",
+	"Referrer-Policy":        "no-referrer",
+	"X-Content-Type-Options": "nosniff",
+}
+
+const hstsHeader = "max-age=31536000; includeSubDomains"
+
+// securityHeaders returns the headers for r: the defaults, HSTS over TLS
+// and the ui.logo_url host, with security.headers applied on top; an empty
+// override removes a header
+func securityHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string, len(defaultSecurityHeaders)+1)
+	for k, v := range defaultSecurityHeaders {
+		headers[k] = v
+	}
+	if tlsEnabled(r) {
+		headers["Strict-Transport-Security"] = hstsHeader
+	}
+	if origin := logoOrigin(currentConfig().UI.LogoURL); origin != "" {
+		csp := headers["Content-Security-Policy"]
+		headers["Content-Security-Policy"] = strings.Replace(csp, "img-src 'self' data:", "img-src 'self' data: "+origin, 1)
+	}
+	for k, v := range currentConfig().Security.Headers {
+		k = http.CanonicalHeaderKey(k)
+		if v == "" {
+			delete(headers, k)
+			continue
+		}
+		headers[k] = v
+	}
+	return headers
+}
+
+// withSecurityHeaders wraps a handler that renders HTML pages
+func withSecurityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range securityHeaders(r) {
+			w.Header().Set(k, v)
+		}
+		next(w, r)
+	}
+}
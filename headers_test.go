@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pageHeaders serves a page behind withSecurityHeaders and returns the
+// response headers
+func pageHeaders(t *testing.T, r *http.Request) http.Header {
+	t.Helper()
+	page := withSecurityHeaders(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<!doctype html>"))
+	})
+	w := httptest.NewRecorder()
+	page(w, r)
+	return w.Result().Header
+}
+
+func TestSecurityHeadersDefaults(t *testing.T) {
+	useConfig(t, "")
+	h := pageHeaders(t, httptest.NewRequest("GET", "/terminal", nil))
+	for k, want := range defaultSecurityHeaders {
+		if got := h.Get(k); got != want {
+			t.Errorf("%s: %q, want %q", k, got, want)
+		}
+	}
+	if got := h.Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("HSTS sent without TLS: %q", got)
+	}
+
+	r := httptest.NewRequest("GET", "/terminal", nil)
+	r.TLS = &tls.ConnectionState{}
+	if got := pageHeaders(t, r).Get("Strict-Transport-Security"); got != hstsHeader {
+		t.Errorf("HSTS over TLS: %q, want %q", got, hstsHeader)
+	}
+}
+
+func TestSecurityHeadersOverrides(t *testing.T) {
+	useConfig(t, `security:
+  fernet_key: `+testFernetKey+`
+  headers:
+    x-frame-options: SAMEORIGIN
+    Referrer-Policy: ""
+    Permissions-Policy: "clipboard-write=(self)"
+ui:
+  logo_url: https://cdn.example.com/brand/logo.svg
+`)
+	h := pageHeaders(t, httptest.NewRequest("GET", "/", nil))
+	if got := h.Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options %q, want SAMEORIGIN", got)
+	}
+	if _, ok := h["Referrer-Policy"]; ok {
+		t.Errorf("Referrer-Policy sent though removed: %q", h.Get("Referrer-Policy"))
+	}
+	if got := h.Get("Permissions-Policy"); got != "clipboard-write=(self)" {
+		t.Errorf("Permissions-Policy %q, want the configured one", got)
+	}
+	if csp := h.Get("Content-Security-Policy"); !strings.Contains(csp, "img-src 'self' data: https://cdn.example.com;") {
+		t.Errorf("logo origin missing from img-src: %s", csp)
+	}
+}
+
+func TestSecurityHeadersOnPages(t *testing.T) {
+	useConfig(t, "")
+	mux := newMux(roleAll)
+	for _, path := range []string{"/", "/terminal", "/access"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Result().Header.Get("X-Frame-Options"); got != "DENY" {
+			t.Errorf("%s: X-Frame-Options %q, want DENY", path, got)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if got := w.Result().Header.Get("Content-Security-Policy"); got != "" {
+		t.Errorf("/healthz has a CSP: %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gossh/internal/httpapi"
+)
+
+const defaultHistoryMaxEntries = 10
+
+// How access-token sessions enter the connection history
+const (
+	historyExclude   = "exclude"   // not at all
+	historyAnonymous = "anonymous" // counted together, under no user
+)
+
+// HistoryConfig keeps each user's recent connections for the login form
+// and /api/recent. Only sessions of identified users are recorded.
+type HistoryConfig struct {
+	// File keeps the history across restarts. Empty keeps it in memory
+	// only. Changes require a restart.
+	File string `yaml:"file"`
+	// MaxEntries is how many hosts are remembered per user
+	MaxEntries int `yaml:"max_entries"`
+	// AccessTokens is exclude or anonymous
+	AccessTokens string `yaml:"access_tokens"`
+}
+
+func (c *HistoryConfig) applyDefaults() {
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaultHistoryMaxEntries
+	}
+	if c.AccessTokens == "" {
+		c.AccessTokens = historyExclude
+	}
+}
+
+func validateHistoryConfig(cfg HistoryConfig) error {
+	switch cfg.AccessTokens {
+	case historyExclude, historyAnonymous:
+		return nil
+	}
+	return fmt.Errorf("history.access_tokens must be %q or %q, not %q", historyExclude, historyAnonymous, cfg.AccessTokens)
+}
+
+// historyEntry is a host a user connected to. No credentials are kept.
+type historyEntry struct {
+	Host     string    `yaml:"host" json:"host"`
+	SSHUser  string    `yaml:"ssh_user" json:"ssh_user"`
+	LastUsed time.Time `yaml:"last_used" json:"last_used"`
+	Count    int       `yaml:"count" json:"count"`
+}
+
+// historyStore holds the recent connections of each user, most recent
+// first. Anonymously counted access-token sessions are under "".
+type historyStore struct {
+	mu      sync.Mutex
+	entries map[string][]historyEntry
+	// file is history.file as of startup
+	file string
+}
+
+var history = &historyStore{entries: make(map[string][]historyEntry)}
+
+// open loads the history kept in file, which need not exist yet
+func (h *historyStore) open(file string) error {
+	if file == "" {
+		return nil
+	}
+	h.file = file
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("history %s: %v", file, err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := yaml.Unmarshal(data, &h.entries); err != nil {
+		return fmt.Errorf("history %s: %v", file, err)
+	}
+	if h.entries == nil {
+		h.entries = make(map[string][]historyEntry)
+	}
+	return nil
+}
+
+// save writes the history to the file, replacing it atomically. The caller
+// holds mu.
+func (h *historyStore) save() error {
+	if h.file == "" {
+		return nil
+	}
+	data, err := yaml.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(h.file), ".history-*")
+	if err != nil {
+		return fmt.Errorf("Failed to store history: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), h.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to store history: %v", err)
+	}
+	return nil
+}
+
+// record notes a session to host as sshUser opened by id. Sessions of
+// anonymous users aren't recorded, and access-token ones only as
+// history.access_tokens says.
+func (h *historyStore) record(id Identity, accessToken bool, host, sshUser string) {
+	cfg := currentConfig().History
+	owner := id.User
+	if accessToken {
+		if cfg.AccessTokens != historyAnonymous {
+			return
+		}
+		owner = ""
+	} else if owner == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry := historyEntry{Host: host, SSHUser: sshUser, LastUsed: time.Now(), Count: 1}
+	list := h.entries[owner]
+	for i, e := range list {
+		if strings.EqualFold(e.Host, host) && e.SSHUser == sshUser {
+			entry.Count = e.Count + 1
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	list = append([]historyEntry{entry}, list...)
+	if len(list) > cfg.MaxEntries {
+		list = list[:cfg.MaxEntries]
+	}
+	h.entries[owner] = list
+	if err := h.save(); err != nil {
+		slog.Warn("Failed to record connection history", "err", err)
+	}
+}
+
+// recent returns owner's recent connections, most recent first, up to
+// history.max_entries
+func (h *historyStore) recent(owner string) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := h.entries[owner]
+	list = list[:min(len(list), currentConfig().History.MaxEntries)]
+	return append([]historyEntry{}, list...)
+}
+
+// clear forgets owner's history
+func (h *historyStore) clear(owner string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev, ok := h.entries[owner]
+	if !ok {
+		return nil
+	}
+	delete(h.entries, owner)
+	if err := h.save(); err != nil {
+		h.entries[owner] = prev
+		return err
+	}
+	return nil
+}
+
+// recentForIdentity lists the recent connections the login form offers id
+func recentForIdentity(id Identity) []historyEntry {
+	if id.User == "" {
+		return nil
+	}
+	return history.recent(id.User)
+}
+
+// recentHandler returns the caller's recent connections on GET
+// /api/recent and clears them on DELETE. An admin key passes
+// anonymous=true for the access-token sessions counted anonymously.
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	owner := requestIdentity(r).User
+	if r.URL.Query().Get("anonymous") == "true" {
+		if key := apiKeyFromContext(r.Context()); key == nil || !key.hasScope(scopeAdmin) {
+			responder.ErrorCode(w, r, httpapi.Forbidden, "Anonymous history requires an admin key")
+			return
+		}
+		owner = ""
+	} else if owner == "" {
+		responder.ErrorCode(w, r, httpapi.Forbidden, "Connection history is only kept for identified users")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+			"recent":  history.recent(owner),
+		})
+
+	case "DELETE":
+		if err := history.clear(owner); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		requestLogger(r).Info("Connection history cleared", "user", requestIdentity(r).String())
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+		})
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+const (
+	defaultHostCheckTimeout = 5 * time.Second
+	// minHostCheckInterval keeps the prober from hammering hosts
+	minHostCheckInterval = 30 * time.Second
+	// hostCheckUser is who background checks use stored credentials as
+	hostCheckUser = "host_checks"
+)
+
+// Stages of a host check, in the order they run
+const (
+	stageCredentials = "credentials"
+	stageDNS         = "dns"
+	stageTCP         = "tcp"
+	stageHandshake   = "handshake"
+	stageAuth        = "auth"
+	stageSession     = "session"
+)
+
+// HostChecksConfig configures the background checks of hosts, whose last
+// results /api/hosts and /metrics report
+type HostChecksConfig struct {
+	// Interval between checks of every target; 0 disables them
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds the connect and the handshake of each check
+	Timeout time.Duration `yaml:"timeout"`
+	// Credentials is the stored: credential targets log in with unless
+	// they name their own
+	Credentials string            `yaml:"credentials"`
+	Targets     []HostCheckTarget `yaml:"targets"`
+}
+
+// HostCheckTarget is a host alias, address or profile to check
+type HostCheckTarget struct {
+	Host    string `yaml:"host"`
+	User    string `yaml:"user"`
+	Profile string `yaml:"profile"`
+	// Credentials must be a stored: credential; checks never log in with
+	// secrets from the configuration
+	Credentials string `yaml:"credentials"`
+}
+
+func (c *HostChecksConfig) applyDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultHostCheckTimeout
+	}
+}
+
+func validateHostChecksConfig(c HostChecksConfig) error {
+	if c.Interval < 0 || (c.Interval > 0 && c.Interval < minHostCheckInterval) {
+		return fmt.Errorf("interval must be at least %s", minHostCheckInterval)
+	}
+	if c.Credentials != "" && !strings.HasPrefix(c.Credentials, storedSourcePrefix) {
+		return fmt.Errorf("credentials %q must name a %s credential", c.Credentials, storedSourcePrefix)
+	}
+	for i, t := range c.Targets {
+		switch {
+		case (t.Host == "") == (t.Profile == ""):
+			return fmt.Errorf("targets[%d]: set either host or profile", i)
+		case t.Credentials != "" && !strings.HasPrefix(t.Credentials, storedSourcePrefix):
+			return fmt.Errorf("targets[%d]: credentials %q must name a %s credential", i, t.Credentials, storedSourcePrefix)
+		case t.Host != "" && t.Credentials == "" && c.Credentials == "":
+			return fmt.Errorf("targets[%d]: no credentials to log in to %s with", i, t.Host)
+		}
+	}
+	return nil
+}
+
+// checkStage is how one stage of a host check went. Ms is how long it
+// took; the handshake's includes authentication.
+type checkStage struct {
+	Stage string  `json:"stage"`
+	OK    bool    `json:"ok"`
+	Ms    float64 `json:"ms,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// hostCheckResult is the outcome of a dry run of a connection: every stage
+// up to the first that failed
+type hostCheckResult struct {
+	Host    string       `json:"host"`
+	User    string       `json:"user"`
+	OK      bool         `json:"ok"`
+	Checked time.Time    `json:"checked"`
+	Stages  []checkStage `json:"stages"`
+	// Failure is the class of failure, as in connection logs
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// stageOf maps a connection failure class to the stage it failed in
+func stageOf(failure string) string {
+	switch failure {
+	case failureDNS:
+		return stageDNS
+	case failureBanner, failureHostKey, failureHandshake:
+		return stageHandshake
+	case failureAuth:
+		return stageAuth
+	}
+	return stageTCP
+}
+
+// dryRunConnection logs in to host as user, opens a session and closes it
+// again, timing each stage. The connection is never pooled, and timeout
+// bounds the connect and the handshake.
+func dryRunConnection(ctx context.Context, meta requestMeta, id Identity, creds SSHCredentials, timeout time.Duration) hostCheckResult {
+	result := hostCheckResult{Host: creds.Host, User: creds.User, Checked: time.Now(), Stages: []checkStage{}}
+	fail := func(stage, failure string, err error) hostCheckResult {
+		result.Stages = append(result.Stages, checkStage{Stage: stage, Error: err.Error()})
+		result.Failure, result.Error = failure, err.Error()
+		return result
+	}
+
+	password, privateKey := creds.Password, []byte(nil)
+	if creds.PrivateKey != "" {
+		var err error
+		if privateKey, err = base64.StdEncoding.DecodeString(creds.PrivateKey); err != nil {
+			return fail(stageCredentials, "", fmt.Errorf("Invalid private key encoding"))
+		}
+	}
+	stored := &vaultCredentials{}
+	if creds.Source != "" {
+		var err error
+		if stored, err = lookupCredentialSource(meta, id, creds.Source, creds.Host, creds.User); err != nil {
+			return fail(stageCredentials, "", err)
+		}
+		defer stored.Wipe()
+		if stored.User != "" {
+			creds.User, result.User = stored.User, stored.User
+		}
+		password, privateKey = stored.Password, stored.PrivateKey
+		result.Stages = append(result.Stages, checkStage{Stage: stageCredentials, OK: true})
+	}
+	if creds.User == "" {
+		return fail(stageCredentials, "", fmt.Errorf("Missing user"))
+	}
+	clientConfig, auth, err := newSSHClientConfig(creds.User, password, privateKey)
+	if err != nil {
+		return fail(stageCredentials, "", err)
+	}
+	if stored.Signer != nil {
+		clientConfig.Auth = append(clientConfig.Auth, auth.publicKeys(stored.Signer))
+	}
+	clientConfig.Timeout = timeout
+
+	ctx, cancel := context.WithTimeout(ctx, 3*timeout)
+	defer cancel()
+	var rec *connectRecord
+	sshConn, err := dialSSH(context.WithValue(ctx, connectRecordKey{}, &rec), meta, creds.Host, clientConfig, auth)
+	failure := ""
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		failure = connectErr.Failure
+	}
+	if rec != nil {
+		reached := []string{stageDNS, stageTCP, stageHandshake, stageAuth}
+		times := map[string]time.Duration{stageDNS: rec.dns, stageTCP: rec.tcp, stageHandshake: rec.handshake}
+		for _, stage := range reached {
+			if err != nil && stage == stageOf(failure) {
+				break
+			}
+			result.Stages = append(result.Stages, checkStage{Stage: stage, OK: true, Ms: millis(times[stage])})
+		}
+	}
+	if err != nil {
+		if connectErr == nil {
+			// Refused before dialing, by the lockout
+			return fail(stageAuth, "", err)
+		}
+		return fail(stageOf(failure), failure, err)
+	}
+	defer sshConn.Close()
+
+	start := time.Now()
+	session, err := sshConn.NewSession()
+	if err != nil {
+		return fail(stageSession, "", fmt.Errorf("Failed to open a session: %v", err))
+	}
+	session.Close()
+	result.Stages = append(result.Stages, checkStage{Stage: stageSession, OK: true, Ms: millis(time.Since(start))})
+	result.OK = true
+	return result
+}
+
+// hostCheckRequest is the body of POST /api/hosts/check: a host and
+// credentials, an access token, or a profile
+type hostCheckRequest struct {
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	PrivateKey  string `json:"private_key"` // base64
+	Credentials string `json:"credentials"`
+	Access      string `json:"access"`
+	Profile     string `json:"profile"`
+}
+
+// hostCheckHandler dry-runs a connection, so a direct-access link or a
+// profile can be tested before it is handed out
+func hostCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req hostCheckRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	creds := SSHCredentials{Host: req.Host, User: req.User, Password: req.Password, PrivateKey: req.PrivateKey, Source: req.Credentials}
+	switch {
+	case req.Access != "":
+		var err error
+		if creds, err = decryptAccessRequest(r, req.Access); err != nil {
+			responder.ErrorCode(w, r, httpapi.InvalidToken, "Invalid access token")
+			return
+		}
+	case req.Profile != "":
+		if err := applyProfile(r, &creds, req.Profile); err != nil {
+			responder.ErrorCode(w, r, httpapi.NotFound, err.Error())
+			return
+		}
+	}
+	if creds.Protocol == protocolTelnet {
+		responder.ErrorCode(w, r, httpapi.BadRequest, "Host checks are only available over SSH")
+		return
+	}
+	creds.Host, creds.User = resolveHost(creds.Host, creds.User)
+	if creds.Host == "" || (creds.User == "" && creds.Source == "") {
+		responder.ErrorCode(w, r, httpapi.MissingParams, "Missing host or user")
+		return
+	}
+	if err := authorize(r, creds.Host, creds.User, opTerminal); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	result := dryRunConnection(r.Context(), meta, requestIdentity(r), creds, currentConfig().HostChecks.Timeout)
+	meta.Log.Info("Checked host", "host", result.Host, "ssh_user", result.User, "ok", result.OK, "failure", result.Failure)
+	httpapi.JSON(w, result)
+}
+
+// hostStatus is a check target as /api/hosts reports it, with its last
+// result
+type hostStatus struct {
+	Name    string           `json:"name"`
+	Host    string           `json:"host"`
+	User    string           `json:"user,omitempty"`
+	Profile string           `json:"profile,omitempty"`
+	Last    *hostCheckResult `json:"last,omitempty"`
+	// Problem is why the target can't be checked
+	Problem string `json:"problem,omitempty"`
+
+	source string
+}
+
+// hostProber checks host_checks.targets every interval
+type hostProber struct {
+	mu      sync.Mutex
+	results map[string]hostCheckResult
+}
+
+var hostChecks = &hostProber{results: make(map[string]hostCheckResult)}
+
+// targets resolves the configured targets, with their last results.
+// Profiles that no longer exist or have no stored credentials to log in
+// with carry a problem.
+func (p *hostProber) targets() []hostStatus {
+	cfg := currentConfig().HostChecks
+	list := make([]hostStatus, 0, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		st := hostStatus{Name: t.Host, Profile: t.Profile, source: t.Credentials}
+		st.Host, st.User = resolveHost(t.Host, t.User)
+		if t.Profile != "" {
+			st.Name = t.Profile
+			if prof, ok := profiles.lookup(t.Profile); !ok {
+				st.Problem = "profile not found"
+			} else {
+				st.Name = prof.Name
+				st.Host, st.User = prof.target()
+				if t.User != "" {
+					st.User = t.User
+				}
+				if st.source == "" && strings.HasPrefix(prof.Credentials, storedSourcePrefix) {
+					st.source = prof.Credentials
+				}
+				st.Problem = prof.Problem
+			}
+		}
+		if st.source == "" {
+			st.source = cfg.Credentials
+		}
+		if st.source == "" && st.Problem == "" {
+			st.Problem = "no stored credentials to log in with"
+		}
+		p.mu.Lock()
+		if last, ok := p.results[st.key()]; ok {
+			st.Last = &last
+		}
+		p.mu.Unlock()
+		list = append(list, st)
+	}
+	return list
+}
+
+// key identifies a target's results across reloads
+func (st *hostStatus) key() string {
+	if st.Profile != "" {
+		return "profile:" + st.Profile
+	}
+	return st.User + "@" + st.Host
+}
+
+// run checks every target once, all at the same time
+func (p *hostProber) run() {
+	cfg := currentConfig().HostChecks
+	meta := requestMeta{User: hostCheckUser, Log: slog.With("component", "host_checks")}
+	var wg sync.WaitGroup
+	for _, st := range p.targets() {
+		if st.Problem != "" {
+			meta.Log.Warn("Host can't be checked", "target", st.Name, "problem", st.Problem)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds := SSHCredentials{Host: st.Host, User: st.User, Source: st.source}
+			result := dryRunConnection(context.Background(), meta, Identity{User: hostCheckUser}, creds, cfg.Timeout)
+			if !result.OK {
+				meta.Log.Warn("Host check failed", "target", st.Name, "host", result.Host, "failure", result.Failure, "err", result.Error)
+			}
+			p.mu.Lock()
+			p.results[st.key()] = result
+			p.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// loop runs the checks every host_checks.interval, picking up reloads
+func (p *hostProber) loop() {
+	for {
+		interval := currentConfig().HostChecks.Interval
+		if interval > 0 && maintenance.check() == nil {
+			p.run()
+		}
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gossh/internal/httpapi"
+)
+
+// Pages of GET /api/hosts
+const (
+	defaultHostPage = 100
+	maxHostPage     = 1000
+)
+
+// HostGroupConfig is an entry of host_groups: the hosts it lists, and
+// those whose tags match an expression. A group also holds every host
+// tagged with its name.
+type HostGroupConfig struct {
+	// Members are alias or profile names, or addresses
+	Members []string `yaml:"members"`
+	// Tags is an expression over host tags with and, or, not and
+	// parentheses, such as "web and not canary"
+	Tags string `yaml:"tags"`
+}
+
+// hostGroup is a parsed host group
+type hostGroup struct {
+	// names are the members by alias or profile name, hosts by hostname
+	names map[string]bool
+	hosts map[string]bool
+	match func(tags []string) bool
+	// addrs are the hostnames of the configured hosts in the group, its
+	// aliases and the addresses it lists. Authorization rules and host
+	// policies only see these: profile tags are up to their owners.
+	addrs map[string]bool
+}
+
+// parseHostGroups checks host_groups and returns every group the
+// configuration knows of, including those only named by aliases' groups
+func parseHostGroups(defs map[string]HostGroupConfig, aliases map[string]HostAlias) (map[string]*hostGroup, error) {
+	groups := make(map[string]*hostGroup)
+	for _, name := range slices.Sorted(maps.Keys(defs)) {
+		def := defs[name]
+		if name == "" || strings.ContainsAny(name, " \t,()") {
+			return nil, fmt.Errorf("invalid group name %q", name)
+		}
+		if len(def.Members) == 0 && def.Tags == "" {
+			return nil, fmt.Errorf("%s: members or tags is required", name)
+		}
+		g := &hostGroup{names: make(map[string]bool), hosts: make(map[string]bool), addrs: make(map[string]bool)}
+		for _, m := range def.Members {
+			if m == "" {
+				return nil, fmt.Errorf("%s: members must not be empty", name)
+			}
+			g.names[m] = true
+			if _, ok := aliases[m]; !ok {
+				g.hosts[hostname(m)] = true
+				g.addrs[hostname(m)] = true
+			}
+		}
+		if def.Tags != "" {
+			var err error
+			if g.match, err = parseTagExpr(def.Tags); err != nil {
+				return nil, fmt.Errorf("%s: tags: %v", name, err)
+			}
+		}
+		groups[name] = g
+	}
+	for _, alias := range sortedAliases(aliases) {
+		for _, tag := range aliases[alias].Groups {
+			if groups[tag] == nil {
+				groups[tag] = &hostGroup{addrs: make(map[string]bool)}
+			}
+		}
+	}
+	for name, g := range groups {
+		for alias, a := range aliases {
+			if g.has(name, alias, a.Address, a.Groups) {
+				g.addrs[hostname(a.Address)] = true
+			}
+		}
+	}
+	return groups, nil
+}
+
+// has reports whether the group called group, which may be nil when only
+// tags name it, holds the host with the given name, address and tags
+func (g *hostGroup) has(group, name, host string, tags []string) bool {
+	if slices.Contains(tags, group) {
+		return true
+	}
+	return g != nil && (g.names[name] || g.hosts[hostname(host)] || (g.match != nil && g.match(tags)))
+}
+
+// policyHosts returns the hostnames of the configured hosts in the named
+// groups, for authorization rules and host policies
+func policyHosts(groups map[string]*hostGroup, names []string) (map[string]bool, error) {
+	// Without groups host_groups failed to parse, which is reported already
+	if len(names) == 0 || groups == nil {
+		return nil, nil
+	}
+	hosts := make(map[string]bool)
+	for _, name := range names {
+		g, ok := groups[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown host group %q", name)
+		}
+		maps.Copy(hosts, g.addrs)
+	}
+	return hosts, nil
+}
+
+// parseTagExpr parses an expression such as "web and (prod or staging)
+// and not canary" into a test of a host's tags
+func parseTagExpr(s string) (func(tags []string) bool, error) {
+	p := &tagExprParser{tokens: strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(s))}
+	match, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return match, err
+}
+
+type tagExprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *tagExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *tagExprParser) or() (func([]string) bool, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "or" {
+		p.pos++
+		var right func([]string) bool
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(tags []string) bool { return l(tags) || right(tags) }
+		}
+	}
+	return left, err
+}
+
+func (p *tagExprParser) and() (func([]string) bool, error) {
+	left, err := p.not()
+	for err == nil && p.peek() == "and" {
+		p.pos++
+		var right func([]string) bool
+		if right, err = p.not(); err == nil {
+			l := left
+			left = func(tags []string) bool { return l(tags) && right(tags) }
+		}
+	}
+	return left, err
+}
+
+func (p *tagExprParser) not() (func([]string) bool, error) {
+	switch tok := p.peek(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "not":
+		p.pos++
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(tags []string) bool { return !m(tags) }, nil
+	case "(":
+		p.pos++
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return m, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	tag := p.tokens[p.pos]
+	p.pos++
+	return func(tags []string) bool { return slices.Contains(tags, tag) }, nil
+}
+
+// Kinds of hosts
+const (
+	hostKindAlias   = "alias"
+	hostKindProfile = "profile"
+	hostKindHost    = "host" // an address in a group or host_checks.targets
+)
+
+// hostEntry is a host gossh knows of, as GET /api/hosts lists it
+type hostEntry struct {
+	ID      string   `json:"id"`
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Host    string   `json:"host"`
+	User    string   `json:"user,omitempty"`
+	Profile string   `json:"profile,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	// Groups are the groups the host is in, including one per tag
+	Groups []string `json:"groups,omitempty"`
+	// Last is the last background check of the host
+	Last    *hostCheckResult `json:"last,omitempty"`
+	Problem string           `json:"problem,omitempty"`
+}
+
+// knownHosts lists, by name, the aliases, the profiles id may use, and
+// the addresses named by host groups and host_checks.targets, with the
+// groups each is in
+func knownHosts(id Identity) []hostEntry {
+	cfg := currentConfig()
+	var list []hostEntry
+	index := make(map[string]int)
+	add := func(e hostEntry) {
+		index[e.ID] = len(list)
+		list = append(list, e)
+	}
+	for _, name := range sortedAliases(cfg.Hosts) {
+		a := cfg.Hosts[name]
+		add(hostEntry{ID: hostKindAlias + ":" + name, Kind: hostKindAlias, Name: name, Host: a.addr(), User: a.User, Tags: a.Groups})
+	}
+	for _, p := range profiles.visibleTo(id) {
+		add(hostEntry{ID: hostKindProfile + ":" + p.ID, Kind: hostKindProfile, Name: p.Name, Host: p.address(), User: p.User, Profile: p.ID, Tags: p.Tags, Problem: p.Problem})
+	}
+
+	// Members of groups that name no alias or profile are addresses
+	for _, name := range slices.Sorted(maps.Keys(cfg.HostGroups)) {
+		for _, m := range cfg.HostGroups[name].Members {
+			if _, ok := cfg.Hosts[m]; ok {
+				continue
+			}
+			if _, ok := profiles.named(m); ok {
+				continue
+			}
+			if _, ok := index[hostKindHost+":"+m]; !ok {
+				host, user := resolveHost(m, "")
+				add(hostEntry{ID: hostKindHost + ":" + m, Kind: hostKindHost, Name: m, Host: host, User: user})
+			}
+		}
+	}
+
+	for _, st := range hostChecks.targets() {
+		key := hostKindHost + ":" + st.Name
+		if st.Profile != "" {
+			key = hostKindProfile + ":" + st.Profile
+		} else if _, ok := cfg.Hosts[st.Name]; ok {
+			key = hostKindAlias + ":" + st.Name
+		}
+		i, ok := index[key]
+		if !ok {
+			if st.Profile != "" {
+				continue
+			}
+			add(hostEntry{ID: key, Kind: hostKindHost, Name: st.Name, Host: st.Host, User: st.User})
+			i = len(list) - 1
+		}
+		list[i].Last = st.Last
+		list[i].Problem = cmp.Or(list[i].Problem, st.Problem)
+	}
+
+	for i := range list {
+		e := &list[i]
+		groups := slices.Clone(e.Tags)
+		for name, g := range cfg.hostGroups {
+			if g.has(name, e.Name, e.Host, e.Tags) {
+				groups = append(groups, name)
+			}
+		}
+		slices.Sort(groups)
+		e.Groups = slices.Compact(groups)
+	}
+	slices.SortStableFunc(list, func(a, b hostEntry) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.ID, b.ID))
+	})
+	return list
+}
+
+// reachableHosts lists the known hosts id may open terminals to
+func reachableHosts(id Identity) []hostEntry {
+	authz := &currentConfig().Authz
+	list := []hostEntry{}
+	for _, e := range knownHosts(id) {
+		if allowed, _ := evaluateAuthz(authz, id, e.Host, opTerminal); allowed {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// groupHosts lists the known hosts in group, reporting whether the group
+// exists: whether host_groups or an alias defines it, or a host is in it
+func groupHosts(group string, id Identity) ([]hostEntry, bool) {
+	var list []hostEntry
+	for _, e := range knownHosts(id) {
+		if slices.Contains(e.Groups, group) {
+			list = append(list, e)
+		}
+	}
+	_, defined := currentConfig().hostGroups[group]
+	return list, defined || len(list) > 0
+}
+
+// hostGroupListing is a group of hosts offered by the login form
+type hostGroupListing struct {
+	// Name is "" for the hosts in no group
+	Name  string
+	Hosts []hostEntry
+}
+
+// hostGroupListings lists the hosts id may open terminals to by group, in
+// name order, and then those in none. A host is listed under each of its
+// groups.
+func hostGroupListings(id Identity) []hostGroupListing {
+	byGroup := make(map[string][]hostEntry)
+	var ungrouped []hostEntry
+	for _, e := range reachableHosts(id) {
+		for _, g := range e.Groups {
+			byGroup[g] = append(byGroup[g], e)
+		}
+		if len(e.Groups) == 0 {
+			ungrouped = append(ungrouped, e)
+		}
+	}
+	var listings []hostGroupListing
+	for _, name := range slices.Sorted(maps.Keys(byGroup)) {
+		listings = append(listings, hostGroupListing{Name: name, Hosts: byGroup[name]})
+	}
+	if len(ungrouped) > 0 {
+		listings = append(listings, hostGroupListing{Hosts: ungrouped})
+	}
+	return listings
+}
+
+// hostsHandler lists the hosts the caller may open terminals to on GET
+// /api/hosts, with how their last background check went. tag (repeated
+// for several, all of which must match), group and q, words to find in
+// the names, addresses, users, tags and groups, narrow the list. Each page
+// holds limit of them; the next is asked for with after set to the last
+// one's ID.
+func hostsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultHostPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxHostPage)
+	}
+	tags := q["tag"]
+	group := q.Get("group")
+	terms := strings.Fields(strings.ToLower(q.Get("q")))
+
+	list := []hostEntry{}
+	for _, e := range reachableHosts(requestIdentity(r)) {
+		if !containsAll(e.Tags, tags) || (group != "" && !slices.Contains(e.Groups, group)) {
+			continue
+		}
+		if len(terms) > 0 {
+			fields := append([]string{e.Name, e.Host, e.User}, e.Groups...)
+			text := strings.ToLower(strings.Join(fields, " "))
+			if !allSubstrings(text, terms) {
+				continue
+			}
+		}
+		list = append(list, e)
+	}
+
+	start := 0
+	if after := q.Get("after"); after != "" {
+		i := slices.IndexFunc(list, func(e hostEntry) bool { return e.ID == after })
+		if i < 0 {
+			responder.ErrorCode(w, r, httpapi.BadRequest, fmt.Sprintf("Unknown host %q in after", after))
+			return
+		}
+		start = i + 1
+	}
+	end := min(start+limit, len(list))
+	resp := map[string]interface{}{
+		"success": true,
+		"hosts":   list[start:end],
+		"total":   len(list),
+	}
+	if end < len(list) {
+		resp["next"] = list[end-1].ID
+	}
+	httpapi.JSON(w, resp)
+}
+
+// containsAll reports whether list holds every one of want
+func containsAll(list, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(list, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// allSubstrings reports whether every term appears in text
+func allSubstrings(text string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	tests := []struct {
+		expr string
+		tags []string
+		want bool
+	}{
+		{"web", []string{"web"}, true},
+		{"web", []string{"db"}, false},
+		{"web", nil, false},
+		// Tags are matched exactly, the operators in any case
+		{"web", []string{"Web"}, false},
+		{"web AND prod", []string{"web", "prod"}, true},
+		{"web and prod", []string{"web"}, false},
+		{"web Or db", []string{"db"}, true},
+		{"web or db", []string{"cache"}, false},
+		{"not canary", nil, true},
+		{"not canary", []string{"canary"}, false},
+		{"not not canary", []string{"canary"}, true},
+		// and binds tighter than or, and not tighter than both
+		{"web or db and prod", []string{"web"}, true},
+		{"web or db and prod", []string{"db"}, false},
+		{"(web or db) and prod", []string{"web"}, false},
+		{"(web or db) and prod", []string{"db", "prod"}, true},
+		{"not web and prod", []string{"prod"}, true},
+		{"not web and prod", []string{"web", "prod"}, false},
+		{"not (web and prod)", []string{"web"}, true},
+		{"web and prod and not canary", []string{"web", "prod"}, true},
+		{"web and prod and not canary", []string{"web", "prod", "canary"}, false},
+		{"web and (prod or staging) and not canary", []string{"web", "staging"}, true},
+		{"((web))", []string{"web"}, true},
+		{"web and(prod)", []string{"web", "prod"}, true},
+	}
+	for _, tt := range tests {
+		match, err := parseTagExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parseTagExpr(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := match(tt.tags); got != tt.want {
+			t.Errorf("%q matches %q: %v, want %v", tt.expr, tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestParseTagExprErrors(t *testing.T) {
+	tests := map[string]string{
+		"":             "unexpected end",
+		"web and":      "unexpected end",
+		"not":          "unexpected end",
+		"and web":      `unexpected "and"`,
+		"web or or db": `unexpected "or"`,
+		"web db":       `unexpected "db"`,
+		"(web":         "missing )",
+		"web)":         `unexpected ")"`,
+		"()":           `unexpected ")"`,
+	}
+	for expr, want := range tests {
+		if _, err := parseTagExpr(expr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseTagExpr(%q) = %v, want %q", expr, err, want)
+		}
+	}
+}
+
+func TestParseHostGroupsErrors(t *testing.T) {
+	tests := []struct {
+		defs map[string]HostGroupConfig
+		want string
+	}{
+		{map[string]HostGroupConfig{"a b": {Members: []string{"db"}}}, "invalid group name"},
+		{map[string]HostGroupConfig{"web": {}}, "members or tags is required"},
+		{map[string]HostGroupConfig{"web": {Members: []string{""}}}, "members must not be empty"},
+		{map[string]HostGroupConfig{"web": {Tags: "web and"}}, "web: tags: unexpected end"},
+	}
+	for _, tt := range tests {
+		if _, err := parseHostGroups(tt.defs, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseHostGroups(%v) = %v, want %q", tt.defs, err, tt.want)
+		}
+	}
+}
+
+const testHostsConfig = `
+hosts:
+  web1: {address: 10.0.1.1, groups: [web, prod]}
+  web2: {address: 10.0.1.2, groups: [web, prod, canary]}
+  web3: {address: 10.0.1.3, groups: [web, staging]}
+  db: {address: 10.0.2.1, groups: [prod]}
+host_groups:
+  prod-web:
+    tags: "web and prod and not canary"
+  payments:
+    members: [db, 10.0.8.21]
+`
+
+// listHosts gets a page of /api/hosts
+func listHosts(t *testing.T, srvURL string, query url.Values) (ids []string, total int, next string) {
+	t.Helper()
+	resp, err := http.Get(srvURL + "/api/hosts?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page struct {
+		Hosts []hostEntry `json:"hosts"`
+		Total int         `json:"total"`
+		Next  string      `json:"next"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("%s: status %d, %v", query.Encode(), resp.StatusCode, err)
+	}
+	for _, e := range page.Hosts {
+		ids = append(ids, e.ID)
+	}
+	return ids, page.Total, page.Next
+}
+
+func TestHostGroupMembership(t *testing.T) {
+	useConfig(t, testHostsConfig)
+	freshProfiles(t)
+
+	groups := make(map[string][]string)
+	for _, e := range knownHosts(Identity{}) {
+		groups[e.ID] = e.Groups
+	}
+	want := map[string][]string{
+		"host:10.0.8.21": {"payments"},
+		"alias:db":       {"payments", "prod"},
+		"alias:web1":     {"prod", "prod-web", "web"},
+		"alias:web2":     {"canary", "prod", "web"},
+		"alias:web3":     {"staging", "web"},
+	}
+	for id, w := range want {
+		if !slices.Equal(groups[id], w) {
+			t.Errorf("%s is in %q, want %q", id, groups[id], w)
+		}
+	}
+	if len(groups) != len(want) {
+		t.Errorf("hosts %v, want %d", groups, len(want))
+	}
+}
+
+func TestHostsPaging(t *testing.T) {
+	useConfig(t, testHostsConfig)
+	freshProfiles(t)
+	srv := startTestGateway(t)
+
+	all := []string{"host:10.0.8.21", "alias:db", "alias:web1", "alias:web2", "alias:web3"}
+	ids, total, next := listHosts(t, srv.URL, nil)
+	if !slices.Equal(ids, all) || total != 5 || next != "" {
+		t.Fatalf("hosts %q of %d, next %q; want %q of 5 and no next", ids, total, next, all)
+	}
+
+	// Pages of two follow on from each other and end without a next
+	var paged []string
+	query := url.Values{"limit": {"2"}}
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("more than 3 pages: %q", paged)
+		}
+		ids, total, next := listHosts(t, srv.URL, query)
+		if total != 5 || len(ids) > 2 {
+			t.Fatalf("page %q of %d", ids, total)
+		}
+		paged = append(paged, ids...)
+		if next == "" {
+			break
+		}
+		if next != ids[len(ids)-1] {
+			t.Fatalf("next %q, want the last of %q", next, ids)
+		}
+		query.Set("after", next)
+	}
+	if !slices.Equal(paged, all) {
+		t.Errorf("paged through %q, want %q", paged, all)
+	}
+
+	// Filters narrow the list before it is paged
+	tests := []struct {
+		query url.Values
+		want  []string
+	}{
+		{url.Values{"group": {"prod-web"}}, []string{"alias:web1"}},
+		{url.Values{"group": {"payments"}}, []string{"host:10.0.8.21", "alias:db"}},
+		{url.Values{"tag": {"web", "prod"}}, []string{"alias:web1", "alias:web2"}},
+		{url.Values{"q": {"WEB 10.0.1.3"}}, []string{"alias:web3"}},
+		{url.Values{"group": {"prod"}, "limit": {"1"}, "after": {"alias:db"}}, []string{"alias:web1"}},
+	}
+	for _, tt := range tests {
+		if ids, _, _ := listHosts(t, srv.URL, tt.query); !slices.Equal(ids, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.query.Encode(), ids, tt.want)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "after=alias:nowhere"} {
+		resp, err := http.Get(srv.URL + "/api/hosts?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
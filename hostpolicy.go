@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+)
+
+const defaultPolicyGrace = 5 * time.Minute
+
+// HostPolicy limits when hosts matching its patterns may be reached, how
+// long their terminal sessions last and whether files may be moved. Every
+// policy matching a host applies.
+type HostPolicy struct {
+	Name  string   `yaml:"name"`
+	Hosts []string `yaml:"hosts"`
+	// HostGroups name host groups in host_groups or aliases' groups whose
+	// hosts the policy applies to as well
+	HostGroups []string `yaml:"host_groups"`
+	// Windows are when the hosts may be reached, read in Timezone; none
+	// means at any time
+	Windows  []TimeWindowConfig `yaml:"windows"`
+	Timezone string             `yaml:"timezone"`
+	// MaxSessionDuration replaces session.max_duration for the hosts'
+	// terminal sessions
+	MaxSessionDuration time.Duration `yaml:"max_session_duration"`
+	// FileTransfer false refuses uploads and downloads, including those
+	// through terminal sessions
+	FileTransfer *bool `yaml:"file_transfer"`
+	// Grace is how long a session is warned before it is ended, once its
+	// window closes or as it nears its maximum duration
+	Grace time.Duration `yaml:"grace"`
+	// RequireApproval holds terminal sessions to the hosts until an admin
+	// approves them, and refuses the API's transfers and commands, which
+	// can't wait
+	RequireApproval bool `yaml:"require_approval"`
+	// DualControl starts the hosts' terminal sessions only once a second
+	// user has joined them, and ends them when that user leaves
+	DualControl *DualControlConfig `yaml:"dual_control"`
+
+	loc        *time.Location
+	windows    []timeWindow
+	groupHosts map[string]bool
+}
+
+// TimeWindowConfig is a time of day on some days of the week
+type TimeWindowConfig struct {
+	// Days are names such as mon and ranges such as mon-fri; none means
+	// every day
+	Days []string `yaml:"days"`
+	// Hours is a range such as 09:00-18:00, which ends as 18:00 begins.
+	// One ending before it starts, such as 22:00-06:00, runs past
+	// midnight into the day after each of Days. Empty means all day.
+	Hours string `yaml:"hours"`
+}
+
+// timeWindow is a parsed TimeWindowConfig: a bit per weekday, Sunday
+// first, and the minutes of the day it starts and ends at
+type timeWindow struct {
+	days       uint8
+	start, end int
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseTimeWindow(c TimeWindowConfig) (timeWindow, error) {
+	w := timeWindow{start: 0, end: 24 * 60}
+	if len(c.Days) == 0 {
+		w.days = 1<<7 - 1
+	}
+	day := func(name string) (int, error) {
+		for i, n := range weekdayNames {
+			if strings.EqualFold(strings.TrimSpace(name), n) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown day %q", name)
+	}
+	for _, spec := range c.Days {
+		from, to, isRange := strings.Cut(spec, "-")
+		first, err := day(from)
+		if err != nil {
+			return w, err
+		}
+		last := first
+		if isRange {
+			if last, err = day(to); err != nil {
+				return w, err
+			}
+		}
+		// fri-mon wraps over the weekend
+		for d := first; ; d = (d + 1) % 7 {
+			w.days |= 1 << d
+			if d == last {
+				break
+			}
+		}
+	}
+	if c.Hours != "" {
+		from, to, ok := strings.Cut(c.Hours, "-")
+		var err error
+		if !ok {
+			return w, fmt.Errorf("hours %q: expected HH:MM-HH:MM", c.Hours)
+		}
+		if w.start, err = parseTimeOfDay(from, false); err == nil {
+			w.end, err = parseTimeOfDay(to, true)
+		}
+		if err != nil {
+			return w, fmt.Errorf("hours %q: %v", c.Hours, err)
+		}
+		if w.start == w.end {
+			return w, fmt.Errorf("hours %q is empty; leave hours out for all day", c.Hours)
+		}
+	}
+	return w, nil
+}
+
+// parseTimeOfDay reads HH:MM as minutes after midnight. 24:00 may end a
+// range.
+func parseTimeOfDay(s string, end bool) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || minute < 0 || minute > 59 || hour < 0 || hour > 24 || (hour == 24 && (minute != 0 || !end)) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// contains reports whether the window holds t, read on t's wall clock
+func (w timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := w.days&(1<<t.Weekday()) != 0
+	if w.start < w.end {
+		return today && minute >= w.start && minute < w.end
+	}
+	yesterday := w.days&(1<<((t.Weekday()+6)%7)) != 0
+	return (today && minute >= w.start) || (yesterday && minute < w.end)
+}
+
+// parse checks the policy and readies its windows and host groups
+func (p *HostPolicy) parse(groups map[string]*hostGroup) error {
+	if len(p.Hosts) == 0 && len(p.HostGroups) == 0 {
+		return fmt.Errorf("hosts or host_groups is required")
+	}
+	for _, pattern := range p.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q", pattern)
+		}
+	}
+	var err error
+	if p.groupHosts, err = policyHosts(groups, p.HostGroups); err != nil {
+		return err
+	}
+	p.loc = time.Local
+	if p.Timezone != "" {
+		if p.loc, err = time.LoadLocation(p.Timezone); err != nil {
+			return fmt.Errorf("timezone: %v", err)
+		}
+	}
+	p.windows = nil
+	for i, c := range p.Windows {
+		w, err := parseTimeWindow(c)
+		if err != nil {
+			return fmt.Errorf("window #%d: %v", i+1, err)
+		}
+		p.windows = append(p.windows, w)
+	}
+	if p.MaxSessionDuration < 0 || p.Grace < 0 {
+		return fmt.Errorf("max_session_duration and grace can't be negative")
+	}
+	if p.Grace == 0 {
+		p.Grace = defaultPolicyGrace
+	}
+	if p.DualControl != nil {
+		if err := p.DualControl.parse(); err != nil {
+			return fmt.Errorf("dual_control: %v", err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to host, a hostname as
+// hostname gives it
+func (p *HostPolicy) matches(host string) bool {
+	if p.groupHosts[host] {
+		return true
+	}
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// open reports whether the policy lets its hosts be reached at t
+func (p *HostPolicy) open(t time.Time) bool {
+	if len(p.windows) == 0 {
+		return true
+	}
+	t = t.In(p.loc)
+	for _, w := range p.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe names the policy and its windows for error messages
+func (p *HostPolicy) describe() string {
+	var windows []string
+	for _, w := range p.Windows {
+		days := "every day"
+		if len(w.Days) > 0 {
+			days = strings.Join(w.Days, ",")
+		}
+		hours := "all day"
+		if w.Hours != "" {
+			hours = w.Hours
+		}
+		windows = append(windows, days+" "+hours)
+	}
+	return fmt.Sprintf("%s (%s, %s)", p.Name, strings.Join(windows, "; "), p.loc)
+}
+
+// hostPolicies returns the policies that apply to host
+func hostPolicies(authz *AuthzConfig, host string) []*HostPolicy {
+	host = hostname(host)
+	var list []*HostPolicy
+	for i := range authz.HostPolicies {
+		if p := &authz.HostPolicies[i]; p.matches(host) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// policiesOpen reports whether every policy lets its hosts be reached at t
+func policiesOpen(policies []*HostPolicy, t time.Time) bool {
+	for _, p := range policies {
+		if !p.open(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// policiesClose returns the first minute after t at which the policies
+// stop letting their hosts be reached, looking a week ahead. Stepping
+// through real minutes rather than wall-clock ones keeps it right across
+// daylight saving changes.
+func policiesClose(policies []*HostPolicy, t time.Time) (time.Time, bool) {
+	var windowed []*HostPolicy
+	for _, p := range policies {
+		if len(p.windows) > 0 {
+			windowed = append(windowed, p)
+		}
+	}
+	if len(windowed) == 0 {
+		return time.Time{}, false
+	}
+	next := t.Truncate(time.Minute)
+	for limit := t.Add(8 * 24 * time.Hour); next.Before(limit); {
+		next = next.Add(time.Minute)
+		if !policiesOpen(windowed, next) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// authorizeHostPolicy refuses hosts outside their policies' windows, and
+// file transfers to hosts whose policy forbids them. op may be unknown
+// when it runs again at connect.
+func authorizeHostPolicy(logger *slog.Logger, clientIP, identity, host, op string) error {
+	now := time.Now()
+	for _, p := range hostPolicies(&currentConfig().Authz, host) {
+		var err error
+		switch {
+		case !p.open(now):
+			err = httpapi.Errorf(httpapi.OutsideWindow, "%s may only be reached during the access hours of %s", hostname(host), p.describe())
+		case (op == opUpload || op == opDownload) && p.FileTransfer != nil && !*p.FileTransfer:
+			err = httpapi.Errorf(httpapi.Forbidden, "File transfers to %s are not allowed by host policy %s", hostname(host), p.Name)
+		case p.RequireApproval && op != opTerminal && op != opTunnel:
+			err = httpapi.Errorf(httpapi.Forbidden, "%s requires approval, which only terminal sessions can wait for", hostname(host))
+		case p.DualControl != nil && op != opTerminal && op != opTunnel:
+			err = httpapi.Errorf(httpapi.Forbidden, "%s requires a second participant, which only terminal sessions can have", hostname(host))
+		default:
+			continue
+		}
+		logger.Warn("Denied by host policy", "user", identity, "host", hostname(host), "operation", op, "policy", p.Name, "err", err)
+		audit.Emit(AuditEvent{
+			Event:     auditAccessDenied,
+			Outcome:   outcomeDenied,
+			ClientIP:  clientIP,
+			User:      identity,
+			Host:      hostname(host),
+			Operation: op,
+			Rule:      "host_policies/" + p.Name,
+		})
+		return err
+	}
+	return nil
+}
+
+// hostPolicyTransfers reports whether the policies of host let files be
+// moved
+func hostPolicyTransfers(host string) bool {
+	for _, p := range hostPolicies(&currentConfig().Authz, host) {
+		if p.FileTransfer != nil && !*p.FileTransfer {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutFileTransfer takes uploads and downloads out of the operations a
+// session grants, all of them when it grants every one
+func withoutFileTransfer(ops []string) []string {
+	if len(ops) == 0 || permitsOperation(ops, "*") {
+		return []string{opTerminal, opExec, opTunnel}
+	}
+	var kept []string
+	for _, op := range ops {
+		if op != opUpload && op != opDownload {
+			kept = append(kept, op)
+		}
+	}
+	if len(kept) == 0 {
+		// An empty list would grant every operation
+		kept = []string{opTerminal}
+	}
+	return kept
+}
+
+// sessionLimit ends a terminal session at its maximum duration, or grace
+// after its host's access window closes, warning the user beforehand.
+// Limits are worked out when the session starts. A nil limit does
+// nothing.
+type sessionLimit struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// startSessionLimit works out when s must end, if ever, and arranges it
+func startSessionLimit(s *activeSession) *sessionLimit {
+	cfg := currentConfig()
+	policies := hostPolicies(&cfg.Authz, s.Host)
+	maxDuration := cfg.Session.MaxDuration
+	grace := defaultPolicyGrace
+	overridden := false
+	for _, p := range policies {
+		if p.MaxSessionDuration > 0 && (!overridden || p.MaxSessionDuration < maxDuration) {
+			maxDuration, overridden = p.MaxSessionDuration, true
+		}
+		grace = min(grace, p.Grace)
+	}
+
+	var end, warn time.Time
+	var warning, reason string
+	if maxDuration > 0 {
+		end = s.Started.Add(maxDuration)
+		warn = end.Add(-grace)
+		warning = fmt.Sprintf("This session reaches its time limit of %s and will be ended in %s", formatDuration(maxDuration), formatDuration(min(grace, maxDuration)))
+		reason = "session time limit reached"
+	}
+	if closes, ok := policiesClose(policies, s.Started); ok && (end.IsZero() || closes.Add(grace).Before(end)) {
+		end, warn = closes.Add(grace), closes
+		warning = fmt.Sprintf("The access window for %s has closed; this session will be ended in %s", hostname(s.Host), formatDuration(grace))
+		reason = "access window closed"
+	}
+	if end.IsZero() {
+		return nil
+	}
+
+	l := &sessionLimit{}
+	notice := func(text string) {
+		s.out.WriteMessage(websocket.BinaryMessage, []byte("\r\n\x1b[1;33m["+text+"]\x1b[0m\r\n"))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timer = time.AfterFunc(max(time.Until(warn), 0), func() {
+		if !l.next(max(time.Until(end), 0), func() {
+			if l.next(0, nil) {
+				slog.Info("Ending session at its limit", "session_id", s.ID, "host", hostname(s.Host), "reason", reason)
+				notice("Session ended: " + reason)
+				s.close(reason)
+			}
+		}) {
+			return
+		}
+		notice(warning)
+	})
+	return l
+}
+
+// next sets the timer to run f after d, unless the limit was stopped,
+// which it reports. A nil f only checks.
+func (l *sessionLimit) next(d time.Duration, f func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	if f != nil {
+		l.timer = time.AfterFunc(d, f)
+	}
+	return true
+}
+
+// formatDuration writes d without trailing zero units, as 30m or 1h30m
+func formatDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func (l *sessionLimit) stop() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	l.timer.Stop()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // the tests don't depend on the machine's zoneinfo
+)
+
+// testPolicy parses a policy with the windows, read in timezone
+func testPolicy(t *testing.T, timezone string, windows ...TimeWindowConfig) *HostPolicy {
+	t.Helper()
+	p := &HostPolicy{Name: "test", Hosts: []string{"*"}, Timezone: timezone, Windows: windows}
+	if err := p.parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// at reads a time in loc
+func at(t *testing.T, loc, value string) time.Time {
+	t.Helper()
+	l, err := time.LoadLocation(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := time.ParseInLocation("2006-01-02 15:04", value, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestHostPolicyOpen(t *testing.T) {
+	const berlin = "Europe/Berlin"
+	businessHours := TimeWindowConfig{Days: []string{"mon-fri"}, Hours: "09:00-18:00"}
+	overnight := TimeWindowConfig{Days: []string{"mon-fri"}, Hours: "22:00-06:00"}
+	untilMidnight := TimeWindowConfig{Days: []string{"sat"}, Hours: "20:00-24:00"}
+	weekend := TimeWindowConfig{Days: []string{"fri-mon"}}
+	earlyHours := TimeWindowConfig{Hours: "01:00-03:00"}
+
+	// 2026-10-09 is a Friday. Berlin moves to CEST at 02:00 on 2026-03-29
+	// and back to CET at 03:00 on 2026-10-25.
+	tests := []struct {
+		name   string
+		window TimeWindowConfig
+		t      time.Time
+		want   bool
+	}{
+		{"business hours start", businessHours, at(t, berlin, "2026-10-09 09:00"), true},
+		{"business hours last minute", businessHours, at(t, berlin, "2026-10-09 17:59"), true},
+		{"business hours end", businessHours, at(t, berlin, "2026-10-09 18:00"), false},
+		{"business hours on saturday", businessHours, at(t, berlin, "2026-10-10 10:00"), false},
+		{"business hours read in the policy's timezone", businessHours, at(t, "America/New_York", "2026-10-09 11:30"), true},
+		{"business hours after they end in the policy's timezone", businessHours, at(t, "America/New_York", "2026-10-09 12:00"), false},
+
+		{"overnight before midnight", overnight, at(t, berlin, "2026-10-09 23:59"), true},
+		{"overnight at midnight", overnight, at(t, berlin, "2026-10-10 00:00"), true},
+		{"overnight into saturday from friday", overnight, at(t, berlin, "2026-10-10 05:59"), true},
+		{"overnight end", overnight, at(t, berlin, "2026-10-10 06:00"), false},
+		{"overnight saturday evening", overnight, at(t, berlin, "2026-10-10 22:00"), false},
+		{"overnight into monday from sunday", overnight, at(t, berlin, "2026-10-12 01:00"), false},
+		{"overnight into tuesday from monday", overnight, at(t, berlin, "2026-10-13 01:00"), true},
+
+		{"until midnight last minute", untilMidnight, at(t, berlin, "2026-10-10 23:59"), true},
+		{"until midnight at midnight", untilMidnight, at(t, berlin, "2026-10-11 00:00"), false},
+
+		{"weekend range over sunday", weekend, at(t, berlin, "2026-10-11 12:00"), true},
+		{"weekend range on tuesday", weekend, at(t, berlin, "2026-10-13 12:00"), false},
+
+		{"spring forward before the gap", earlyHours, time.Date(2026, 3, 29, 0, 59, 0, 0, time.UTC), true}, // 01:59 CET
+		{"spring forward after the gap", earlyHours, time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC), false},  // 03:00 CEST
+		{"fall back first 02:30", earlyHours, time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC), true},        // 02:30 CEST
+		{"fall back second 02:30", earlyHours, time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC), true},       // 02:30 CET
+		{"fall back end", earlyHours, time.Date(2026, 10, 25, 2, 0, 0, 0, time.UTC), false},                // 03:00 CET
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPolicy(t, berlin, tt.window)
+			if got := p.open(tt.t); got != tt.want {
+				t.Errorf("open at %s: %v, want %v", tt.t.In(p.loc).Format("Mon 2006-01-02 15:04 MST"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoliciesClose(t *testing.T) {
+	const berlin = "Europe/Berlin"
+	overnight := TimeWindowConfig{Hours: "22:00-06:00"}
+	tests := []struct {
+		name     string
+		policies []*HostPolicy
+		from     time.Time
+		want     time.Duration
+	}{
+		{"business hours", []*HostPolicy{testPolicy(t, berlin, TimeWindowConfig{Days: []string{"mon-fri"}, Hours: "09:00-18:00"})},
+			at(t, berlin, "2026-10-09 16:30"), 90 * time.Minute},
+		{"over midnight", []*HostPolicy{testPolicy(t, berlin, overnight)},
+			at(t, berlin, "2026-10-09 23:00"), 7 * time.Hour},
+		// The night the clocks go back is an hour longer
+		{"over the fall back", []*HostPolicy{testPolicy(t, berlin, overnight)},
+			at(t, berlin, "2026-10-24 23:00"), 8 * time.Hour},
+		// and the night they go forward an hour shorter
+		{"over the spring forward", []*HostPolicy{testPolicy(t, berlin, overnight)},
+			at(t, berlin, "2026-03-28 23:00"), 6 * time.Hour},
+		{"the earliest closing of two", []*HostPolicy{
+			testPolicy(t, berlin, overnight),
+			testPolicy(t, "UTC", TimeWindowConfig{Hours: "20:00-23:00"}),
+		}, at(t, berlin, "2026-10-09 23:30"), 90 * time.Minute}, // 23:00 UTC is 01:00 CEST
+		{"windows that join up", []*HostPolicy{testPolicy(t, berlin,
+			TimeWindowConfig{Days: []string{"fri"}, Hours: "18:00-24:00"},
+			TimeWindowConfig{Days: []string{"sat"}, Hours: "00:00-02:00"},
+		)}, at(t, berlin, "2026-10-09 23:00"), 3 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closes, ok := policiesClose(tt.policies, tt.from)
+			if !ok {
+				t.Fatal("the policies never close")
+			}
+			if got := closes.Sub(tt.from); got != tt.want {
+				t.Errorf("closes after %s at %s, want after %s", got, closes, tt.want)
+			}
+		})
+	}
+
+	if _, ok := policiesClose([]*HostPolicy{testPolicy(t, berlin)}, at(t, berlin, "2026-10-09 23:00")); ok {
+		t.Error("a policy without windows closes")
+	}
+	if _, ok := policiesClose([]*HostPolicy{testPolicy(t, berlin, TimeWindowConfig{})}, at(t, berlin, "2026-10-09 23:00")); ok {
+		t.Error("an all-week window closes")
+	}
+}
+
+func TestParseTimeWindowErrors(t *testing.T) {
+	for _, c := range []TimeWindowConfig{
+		{Days: []string{"funday"}},
+		{Days: []string{"mon-"}},
+		{Hours: "09:00"},
+		{Hours: "09:00-09:00"},
+		{Hours: "24:00-06:00"},
+		{Hours: "09:60-10:00"},
+		{Hours: "9-17"},
+	} {
+		if _, err := parseTimeWindow(c); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
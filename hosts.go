@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostAlias is an entry of the hosts section: a short name users may type
+// instead of a host's address
+type HostAlias struct {
+	// Address is the host name or IP address, without a port
+	Address string `yaml:"address"`
+	// Port defaults to that of the protocol, 22 for SSH
+	Port int `yaml:"port"`
+	// User is connected as when the request names none
+	User string `yaml:"user"`
+	// HostKey pins the host's key, in authorized_keys format
+	// ("ssh-ed25519 AAAA..."); any other key is refused
+	HostKey string `yaml:"host_key"`
+	// JumpHost is an alias or host[:port] the connection is tunneled
+	// through, logging in with the same credentials. SSH only.
+	JumpHost string `yaml:"jump_host"`
+	// Groups are the alias's tags, each naming a host group it is in;
+	// see host_groups
+	Groups []string `yaml:"groups"`
+}
+
+// addr returns where the alias points, with the port when it has one
+func (a *HostAlias) addr() string {
+	if a.Port > 0 {
+		return joinPort(a.Address, strconv.Itoa(a.Port))
+	}
+	return joinPort(a.Address, "")
+}
+
+// aliasedHost is the dial-time settings of an aliased address
+type aliasedHost struct {
+	hostKey  ssh.PublicKey
+	jumpHost string
+	// identityFiles come from ssh.config_file
+	identityFiles []string
+}
+
+// parseHostAliases checks the hosts section and returns the settings the
+// dial path applies, by SSH address
+func parseHostAliases(aliases map[string]HostAlias) (map[string]*aliasedHost, error) {
+	byAddr := make(map[string]*aliasedHost)
+	owner := make(map[string]string)
+	for _, name := range sortedAliases(aliases) {
+		a := aliases[name]
+		if name == "" || strings.ContainsAny(name, ": \t/@") {
+			return nil, fmt.Errorf("invalid alias %q", name)
+		}
+		if a.Address == "" {
+			return nil, fmt.Errorf("%s: address is required", name)
+		}
+		if _, _, err := net.SplitHostPort(a.Address); err == nil {
+			return nil, fmt.Errorf("%s: address must not include a port; set port", name)
+		}
+		if a.Port < 0 || a.Port > 65535 {
+			return nil, fmt.Errorf("%s: invalid port %d", name, a.Port)
+		}
+		for _, g := range a.Groups {
+			if g == "" || strings.ContainsAny(g, " \t,") {
+				return nil, fmt.Errorf("%s: invalid group %q", name, g)
+			}
+		}
+
+		host := &aliasedHost{jumpHost: a.JumpHost}
+		if a.HostKey != "" {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a.HostKey))
+			if err != nil {
+				return nil, fmt.Errorf("%s: host_key: %v", name, err)
+			}
+			host.hostKey = key
+		}
+		if a.JumpHost != "" {
+			if err := checkJumpChain(aliases, name); err != nil {
+				return nil, err
+			}
+		}
+
+		addr := sshAddress(strings.ToLower(a.addr()))
+		if prev, ok := byAddr[addr]; ok {
+			if !sameAliasedHost(prev, host) {
+				return nil, fmt.Errorf("%s and %s point at %s with different host_key or jump_host", owner[addr], name, addr)
+			}
+			continue
+		}
+		byAddr[addr] = host
+		owner[addr] = name
+	}
+	return byAddr, nil
+}
+
+// checkJumpChain refuses jump hosts that lead back to name
+func checkJumpChain(aliases map[string]HostAlias, name string) error {
+	seen := map[string]bool{name: true}
+	for next := aliases[name].JumpHost; next != ""; {
+		a, ok := aliases[next]
+		if !ok {
+			return nil
+		}
+		if seen[next] {
+			return fmt.Errorf("%s: jump_host loops back through %s", name, next)
+		}
+		seen[next] = true
+		next = a.JumpHost
+	}
+	return nil
+}
+
+func sameAliasedHost(a, b *aliasedHost) bool {
+	if a.jumpHost != b.jumpHost || (a.hostKey == nil) != (b.hostKey == nil) {
+		return false
+	}
+	return a.hostKey == nil || string(a.hostKey.Marshal()) == string(b.hostKey.Marshal())
+}
+
+func sortedAliases(aliases map[string]HostAlias) []string {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sshAddress adds the default SSH port to host unless it has one
+func sshAddress(host string) string {
+	if !containsPort(host) {
+		return host + ":22"
+	}
+	return host
+}
+
+// hostKeyAlgorithms are the algorithms to negotiate so the server presents
+// key rather than another of its keys
+func hostKeyAlgorithms(key ssh.PublicKey) []string {
+	if key.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{key.Type()}
+}
+
+// resolveHost returns the address for host, which may be an alias or a
+// Host of ssh.config_file, and the user to connect as: user, or the
+// default for host when user is empty. Everything that takes a host from a
+// request or token resolves it here, before authorization, so rules and
+// logs always see the address.
+func resolveHost(host, user string) (string, string) {
+	cfg := currentConfig()
+	a, ok := cfg.Hosts[host]
+	if !ok {
+		if cfg.sshConfigFile != nil {
+			return cfg.sshConfigFile.resolve(host, user)
+		}
+		return host, user
+	}
+	if user == "" {
+		user = a.User
+	}
+	return a.addr(), user
+}
+
+// aliasedHostAt returns the settings of an aliased SSH address, or nil.
+// Aliases take precedence over ssh.config_file.
+func aliasedHostAt(addr string) *aliasedHost {
+	cfg := currentConfig()
+	if a, ok := cfg.aliasedHosts[strings.ToLower(addr)]; ok {
+		return a
+	}
+	if cfg.sshConfigFile != nil {
+		return cfg.sshConfigFile.dialSettings(addr)
+	}
+	return nil
+}
+
+// hostOption is an alias offered by the login form
+type hostOption struct {
+	Name string
+	User string
+}
+
+// hostOptions lists the aliases in name order
+func hostOptions() []hostOption {
+	aliases := currentConfig().Hosts
+	options := make([]hostOption, 0, len(aliases))
+	for _, name := range sortedAliases(aliases) {
+		options = append(options, hostOption{Name: name, User: aliases[name].User})
+	}
+	return options
+}
+
+// maxJumpHosts bounds chains of jump hosts, which may be configured in a
+// loop through ssh.config_file patterns
+const maxJumpHosts = 5
+
+// jumpDepthKey counts the jump hosts a connection is already going through
+type jumpDepthKey struct{}
+
+// dialJumpHost connects to addr through an SSH connection to jump,
+// [user@]host[:port], made with the same credentials
+func dialJumpHost(ctx context.Context, meta requestMeta, jump, addr string, clientConfig *ssh.ClientConfig, auth *authRecorder, rec *connectRecord) (net.Conn, error) {
+	depth, _ := ctx.Value(jumpDepthKey{}).(int)
+	if depth >= maxJumpHosts {
+		return nil, fmt.Errorf("more than %d jump hosts", maxJumpHosts)
+	}
+	ctx = context.WithValue(ctx, jumpDepthKey{}, depth+1)
+
+	user, host, ok := strings.Cut(jump, "@")
+	if !ok {
+		user, host = "", jump
+	}
+	jumpAddr, jumpUser := resolveHost(host, user)
+	config := *clientConfig
+	if jumpUser != "" {
+		config.User = jumpUser
+	}
+	rec.Proxy = jumpAddr
+	client, err := dialSSH(ctx, meta, jumpAddr, &config, auth)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jump, err)
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("jump host %s: %w", jump, err)
+	}
+	return &jumpConn{Conn: conn, client: client}, nil
+}
+
+// jumpConn is a connection tunneled through a jump host, which is
+// disconnected along with it
+type jumpConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
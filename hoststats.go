@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// MetricsConfig controls the connection statistics kept per target host
+type MetricsConfig struct {
+	// MaxHosts caps the hosts tracked individually; connections to further
+	// hosts are counted under "other"
+	MaxHosts int `yaml:"max_hosts"`
+}
+
+func (c *MetricsConfig) applyDefaults() {
+	if c.MaxHosts <= 0 {
+		c.MaxHosts = 200
+	}
+}
+
+// otherHosts is the bucket for hosts beyond metrics.max_hosts
+const otherHosts = "other"
+
+// Outcomes of an SSH connection attempt
+const (
+	connectSuccess        = "success"
+	connectAuthFailure    = "auth_failure"
+	connectDialTimeout    = "dial_timeout"
+	connectDialError      = "dial_error"
+	connectHandshakeError = "handshake_error"
+)
+
+var connectOutcomes = []string{connectSuccess, connectAuthFailure, connectDialTimeout, connectDialError, connectHandshakeError}
+
+// hostCounters are the connection statistics of one target host
+type hostCounters struct {
+	attempts  int64
+	outcomes  map[string]int64
+	handshake time.Duration // total over successful connections
+}
+
+// hostStatsRegistry aggregates connection attempts per target host. It is
+// not part of the configuration, so the counts survive reloads.
+type hostStatsRegistry struct {
+	mu    sync.Mutex
+	hosts map[string]*hostCounters
+}
+
+var hostStats = &hostStatsRegistry{hosts: make(map[string]*hostCounters)}
+
+// bucket returns the counters for host, creating them while there is room.
+// The caller holds mu.
+func (r *hostStatsRegistry) bucket(host string) *hostCounters {
+	key := hostname(host)
+	c, ok := r.hosts[key]
+	if !ok {
+		if len(r.hosts) >= currentConfig().Metrics.MaxHosts {
+			key = otherHosts
+			c, ok = r.hosts[key]
+		}
+		if !ok {
+			c = &hostCounters{outcomes: make(map[string]int64)}
+			r.hosts[key] = c
+		}
+	}
+	return c
+}
+
+// key is the name host is reported under
+func (r *hostStatsRegistry) key(host string) string {
+	key := hostname(host)
+	if _, ok := r.hosts[key]; !ok {
+		return otherHosts
+	}
+	return key
+}
+
+func (r *hostStatsRegistry) recordAttempt(host string) {
+	r.mu.Lock()
+	r.bucket(host).attempts++
+	r.mu.Unlock()
+}
+
+// recordOutcome counts how an attempt ended. handshake is the time from
+// the TCP connection to the end of authentication, for successes.
+func (r *hostStatsRegistry) recordOutcome(host, outcome string, handshake time.Duration) {
+	r.mu.Lock()
+	c := r.bucket(host)
+	c.outcomes[outcome]++
+	if outcome == connectSuccess {
+		c.handshake += handshake
+	}
+	r.mu.Unlock()
+}
+
+// hostStat is the JSON form of one host's statistics
+type hostStat struct {
+	Host              string           `json:"host"`
+	Attempts          int64            `json:"attempts"`
+	Successes         int64            `json:"successes"`
+	AuthFailures      int64            `json:"auth_failures"`
+	DialTimeouts      int64            `json:"dial_timeouts"`
+	Errors            map[string]int64 `json:"errors"`
+	MeanHandshakeMs   float64          `json:"mean_handshake_ms"`
+	OpenSessions      int              `json:"open_sessions"`
+	handshakeDuration time.Duration
+}
+
+// snapshot returns the statistics of every tracked host, busiest first
+func (r *hostStatsRegistry) snapshot() []hostStat {
+	active := sessions.snapshot()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	open := map[string]int{}
+	for _, s := range active {
+		open[r.key(s.Host)]++
+	}
+	stats := make([]hostStat, 0, len(r.hosts))
+	for host, c := range r.hosts {
+		st := hostStat{
+			Host:              host,
+			Attempts:          c.attempts,
+			Successes:         c.outcomes[connectSuccess],
+			AuthFailures:      c.outcomes[connectAuthFailure],
+			DialTimeouts:      c.outcomes[connectDialTimeout],
+			Errors:            map[string]int64{},
+			OpenSessions:      open[host],
+			handshakeDuration: c.handshake,
+		}
+		for _, outcome := range connectOutcomes {
+			if outcome != connectSuccess {
+				st.Errors[outcome] = c.outcomes[outcome]
+			}
+		}
+		if st.Successes > 0 {
+			st.MeanHandshakeMs = float64(c.handshake.Microseconds()) / 1000 / float64(st.Successes)
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Attempts != stats[j].Attempts {
+			return stats[i].Attempts > stats[j].Attempts
+		}
+		return stats[i].Host < stats[j].Host
+	})
+	return stats
+}
+
+func hostStatsHandler(w http.ResponseWriter, r *http.Request) {
+	httpapi.JSON(w, map[string]interface{}{
+		"hosts":     hostStats.snapshot(),
+		"max_hosts": currentConfig().Metrics.MaxHosts,
+	})
+}
+
+// metricsHandler serves the counters in the Prometheus text format. The
+// host label is bounded by metrics.max_hosts.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	stats := hostStats.snapshot()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("gossh_active_sessions", "gauge", "Open terminal sessions.")
+	fmt.Fprintf(w, "gossh_active_sessions %d\n", sessions.count())
+	metric("gossh_ssh_clients", "gauge", "Open SSH connections to target hosts.")
+	fmt.Fprintf(w, "gossh_ssh_clients %d\n", openSSHClients.Load())
+
+	metric("gossh_session_memory_bytes", "gauge", "Memory held by the buffers of open terminal sessions.")
+	var held int64
+	for _, s := range sessions.snapshot() {
+		if m := s.out.mem.info(); m != nil {
+			held += m.Total
+		}
+	}
+	fmt.Fprintf(w, "gossh_session_memory_bytes %d\n", held)
+	metric("gossh_session_memory_limited_total", "counter", "Times a session gave way at session.memory_limit_bytes, by what gave way.")
+	for _, action := range memDegradations {
+		fmt.Fprintf(w, "gossh_session_memory_limited_total{action=\"%s\"} %d\n", action, sessionMemoryLimited[action].Load())
+	}
+
+	metric("gossh_ws_slow_disconnects_total", "counter", "WebSocket clients disconnected for not keeping up with their output.")
+	fmt.Fprintf(w, "gossh_ws_slow_disconnects_total %d\n", slowClientDisconnects.Load())
+
+	metric("gossh_http_throttled_total", "counter", "Requests refused by security.rate_limit per route group.")
+	for _, group := range routeGroups {
+		fmt.Fprintf(w, "gossh_http_throttled_total{group=\"%s\"} %d\n", group, rateLimits.throttled[group].Load())
+	}
+
+	metric("gossh_host_connect_attempts_total", "counter", "SSH connection attempts per target host.")
+	for _, st := range stats {
+		fmt.Fprintf(w, "gossh_host_connect_attempts_total{host=\"%s\"} %d\n", promLabel(st.Host), st.Attempts)
+	}
+	metric("gossh_host_connects_total", "counter", "Finished SSH connection attempts per target host and outcome.")
+	for _, st := range stats {
+		counts := map[string]int64{connectSuccess: st.Successes}
+		for outcome, n := range st.Errors {
+			counts[outcome] = n
+		}
+		for _, outcome := range connectOutcomes {
+			fmt.Fprintf(w, "gossh_host_connects_total{host=\"%s\",outcome=\"%s\"} %d\n", promLabel(st.Host), outcome, counts[outcome])
+		}
+	}
+	metric("gossh_host_handshake_seconds", "summary", "SSH handshake and authentication time of successful connections.")
+	for _, st := range stats {
+		fmt.Fprintf(w, "gossh_host_handshake_seconds_sum{host=\"%s\"} %g\n", promLabel(st.Host), st.handshakeDuration.Seconds())
+		fmt.Fprintf(w, "gossh_host_handshake_seconds_count{host=\"%s\"} %d\n", promLabel(st.Host), st.Successes)
+	}
+	metric("gossh_host_sessions_open", "gauge", "Open terminal sessions per target host.")
+	for _, st := range stats {
+		fmt.Fprintf(w, "gossh_host_sessions_open{host=\"%s\"} %d\n", promLabel(st.Host), st.OpenSessions)
+	}
+	metric("gossh_host_check_up", "gauge", "Whether the last check of a host_checks target succeeded.")
+	for _, st := range hostChecks.targets() {
+		if st.Last != nil {
+			up := 0
+			if st.Last.OK {
+				up = 1
+			}
+			fmt.Fprintf(w, "gossh_host_check_up{target=\"%s\",host=\"%s\"} %d\n", promLabel(st.Name), promLabel(hostname(st.Host)), up)
+		}
+	}
+}
+
+// promLabel escapes a label value; host names come from users
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// handleMetrics registers /metrics and the /api/stats endpoints, open on a
+// metrics listener like the debug endpoints and admin-only elsewhere
+func handleMetrics(mux *http.ServeMux, role string) {
+	switch role {
+	case roleMetrics:
+		mux.HandleFunc("/metrics", metricsHandler)
+		mux.HandleFunc("/api/stats/hosts", hostStatsHandler)
+		mux.HandleFunc("/api/stats/connections", connectLogHandler)
+	case roleAll:
+		mux.HandleFunc("/metrics", apiKeyAuth(scopeAdmin, metricsHandler))
+		mux.HandleFunc("/api/stats/hosts", apiKeyAuth(scopeAdmin, hostStatsHandler))
+		mux.HandleFunc("/api/stats/connections", apiKeyAuth(scopeAdmin, connectLogHandler))
+	}
+}
@@ -0,0 +1,134 @@
+// Package config reads gossh's YAML configuration into the caller's types:
+// unknown keys are errors that suggest the key that was probably meant,
+// and environment variables override the file.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problems lists every problem found in a configuration
+type Problems []string
+
+func (p Problems) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(p, "\n  - ")
+}
+
+// Load decodes the YAML file filename into cfg, a pointer to a struct, then
+// overlays the environment variables starting with envPrefix as ApplyEnv
+// does. It returns the names of the variables that were applied.
+func Load(filename string, cfg interface{}, envPrefix string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	if err := Decode(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", filename, err)
+	}
+
+	// Environment variables take precedence over the file
+	return ApplyEnv(cfg, envPrefix)
+}
+
+// Decode decodes YAML data into cfg, a pointer to a struct. Keys cfg has no
+// field for are errors.
+func Decode(data []byte, cfg interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return describeYAMLError(err, reflect.TypeOf(cfg))
+	}
+	return nil
+}
+
+var unknownFieldPattern = regexp.MustCompile(`^line (\d+): field (\S+) not found in type .*$`)
+
+// describeYAMLError rewrites unknown-field errors from the decoder into
+// "line N: unknown key" messages, suggesting the closest key of t
+func describeYAMLError(err error, t reflect.Type) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	known := configKeys(t, nil)
+	msgs := make([]string, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		m := unknownFieldPattern.FindStringSubmatch(msg)
+		if m == nil {
+			msgs = append(msgs, msg)
+			continue
+		}
+		msg = fmt.Sprintf("line %s: unknown key %q", m[1], m[2])
+		if suggestion := closestKey(m[2], known); suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		msgs = append(msgs, msg)
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// configKeys collects the yaml keys used anywhere in a config type
+func configKeys(t reflect.Type, keys []string) []string {
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Map || t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == durationType {
+		return keys
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if key := strings.Split(field.Tag.Get("yaml"), ",")[0]; key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+		keys = configKeys(field.Type, keys)
+	}
+	return keys
+}
+
+// closestKey returns the known key nearest to key by edit distance, or ""
+// if none is close enough to be a likely typo
+func closestKey(key string, known []string) string {
+	best, bestDist := "", 3
+	for _, k := range known {
+		if d := editDistance(key, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
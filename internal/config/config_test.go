@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeUnknownKeys(t *testing.T) {
+	tests := []struct {
+		yml, want string
+	}{
+		{"server:\n  prot: 8022\n", `line 2: unknown key "prot" (did you mean "port"?)`},
+		{"server:\n  port: 8022\nsecurty:\n  fernet_key: k\n", `line 3: unknown key "securty" (did you mean "security"?)`},
+		{"wat: 1\n", `line 1: unknown key "wat"`},
+		{"server:\n  port: eighty\n", "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		var cfg testConfig
+		err := Decode([]byte(tt.yml), &cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Decode(%q) = %v, want %s", tt.yml, err, tt.want)
+			continue
+		}
+		if strings.Contains(err.Error(), "not found in type") {
+			t.Errorf("Decode(%q) = %v, leaks the Go type", tt.yml, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("server:\n  port: 8023\n  dev_mode: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOSSH_SERVER_PORT", "9022")
+	var cfg testConfig
+	applied, err := Load(file, &cfg, "GOSSH_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9022 || !cfg.Server.DevMode {
+		t.Errorf("port %d, dev_mode %v; want 9022 from the environment and true from the file", cfg.Server.Port, cfg.Server.DevMode)
+	}
+	if len(applied) != 1 || applied[0] != "GOSSH_SERVER_PORT" {
+		t.Errorf("applied %v", applied)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), &cfg, "GOSSH_"); err == nil || !strings.HasPrefix(err.Error(), "error opening config file") {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestProblems(t *testing.T) {
+	err := error(Problems{"server.port 0 is out of range", "security.fernet_key is not set"})
+	want := "invalid configuration:\n  - server.port 0 is out of range\n  - security.fernet_key is not set"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
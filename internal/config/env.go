@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ApplyEnv overlays environment variables on cfg, a pointer to a struct.
+// Variable names are prefix followed by the yaml keys: with the prefix
+// GOSSH_, server.port is GOSSH_SERVER_PORT and security.fernet_key is
+// GOSSH_SECURITY_FERNET_KEY. String lists take comma separated values; maps
+// and lists of objects take YAML or JSON. It returns the names of the
+// variables that were applied.
+func ApplyEnv(cfg interface{}, prefix string) ([]string, error) {
+	var applied []string
+	err := overlayEnv(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(prefix, "_"), &applied)
+	return applied, err
+}
+
+func overlayEnv(v reflect.Value, prefix string, applied *[]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		fv := v.Field(i)
+
+		// Nested sections are walked; a section can't be set as a whole
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			if err := overlayEnv(fv, name, applied); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, value); err != nil {
+			return fmt.Errorf("environment variable %s: %v", name, err)
+		}
+		*applied = append(*applied, name)
+	}
+	return nil
+}
+
+// setFromEnv converts value to the type of v and stores it. Values are left
+// out of error messages since they may be secrets.
+func setFromEnv(v reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s or 5m")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a non-negative integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "[") {
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		}
+		return setFromYAML(v, value)
+	case reflect.Map:
+		return setFromYAML(v, value)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// setFromYAML replaces v with value decoded as YAML (or JSON)
+func setFromYAML(v reflect.Value, value string) error {
+	decoded := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+		return fmt.Errorf("expected YAML or JSON for %s", v.Type())
+	}
+	v.Set(decoded.Elem())
+	return nil
+}
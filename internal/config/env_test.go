@@ -0,0 +1,94 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig has a setting of each kind a configuration uses
+type testConfig struct {
+	Server struct {
+		Port                 int                 `yaml:"port"`
+		ShutdownGrace        time.Duration       `yaml:"shutdown_grace"`
+		DevMode              bool                `yaml:"dev_mode"`
+		DebugEndpoints       bool                `yaml:"debug_endpoints"`
+		TrustedProxies       []string            `yaml:"trusted_proxies"`
+		ClientCIDRExceptions map[string][]string `yaml:"client_cidr_exceptions"`
+	} `yaml:"server"`
+	Security struct {
+		FernetKey string            `yaml:"fernet_key"`
+		Headers   map[string]string `yaml:"headers"`
+	} `yaml:"security"`
+	API struct {
+		Keys []testAPIKey `yaml:"keys"`
+	} `yaml:"api"`
+	WebSocket struct {
+		MaxMessageSize int64 `yaml:"max_message_size"`
+	} `yaml:"ws"`
+}
+
+type testAPIKey struct {
+	Name      string   `yaml:"name"`
+	Scopes    []string `yaml:"scopes"`
+	RateLimit float64  `yaml:"rate_limit"`
+}
+
+func TestEnvOverridesTypes(t *testing.T) {
+	t.Setenv("GOSSH_SECURITY_FERNET_KEY", "fernet-key")
+	t.Setenv("GOSSH_SERVER_DEBUG_ENDPOINTS", "true")
+	t.Setenv("GOSSH_SERVER_TRUSTED_PROXIES", "10.0.0.1, 10.0.0.0/24,")
+	t.Setenv("GOSSH_SERVER_CLIENT_CIDR_EXCEPTIONS", `{"ops": ["0.0.0.0/0"]}`)
+	t.Setenv("GOSSH_SECURITY_HEADERS", "X-Frame-Options: SAMEORIGIN")
+	t.Setenv("GOSSH_API_KEYS", `[{"name": "ci", "scopes": ["exec", "upload"], "rate_limit": 1.5}]`)
+	t.Setenv("GOSSH_WS_MAX_MESSAGE_SIZE", "65536")
+
+	var cfg testConfig
+	applied, err := ApplyEnv(&cfg, "GOSSH_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 7 {
+		t.Errorf("applied %v, want all 7 variables", applied)
+	}
+	if cfg.Security.FernetKey != "fernet-key" || !cfg.Server.DebugEndpoints || cfg.WebSocket.MaxMessageSize != 65536 {
+		t.Errorf("scalars not set: %q %v %d", cfg.Security.FernetKey, cfg.Server.DebugEndpoints, cfg.WebSocket.MaxMessageSize)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.0/24"}; !reflect.DeepEqual(cfg.Server.TrustedProxies, want) {
+		t.Errorf("trusted_proxies %q, want %q", cfg.Server.TrustedProxies, want)
+	}
+	if want := map[string][]string{"ops": {"0.0.0.0/0"}}; !reflect.DeepEqual(cfg.Server.ClientCIDRExceptions, want) {
+		t.Errorf("client_cidr_exceptions %v, want %v", cfg.Server.ClientCIDRExceptions, want)
+	}
+	if cfg.Security.Headers["X-Frame-Options"] != "SAMEORIGIN" {
+		t.Errorf("headers %v", cfg.Security.Headers)
+	}
+	if want := []testAPIKey{{Name: "ci", Scopes: []string{"exec", "upload"}, RateLimit: 1.5}}; !reflect.DeepEqual(cfg.API.Keys, want) {
+		t.Errorf("api.keys %+v, want %+v", cfg.API.Keys, want)
+	}
+}
+
+func TestEnvOverridesErrors(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"GOSSH_SERVER_PORT", "eighty", "environment variable GOSSH_SERVER_PORT: expected an integer"},
+		{"GOSSH_SERVER_SHUTDOWN_GRACE", "10", "environment variable GOSSH_SERVER_SHUTDOWN_GRACE: expected a duration"},
+		{"GOSSH_SERVER_DEV_MODE", "yes please", "environment variable GOSSH_SERVER_DEV_MODE: expected true or false"},
+		{"GOSSH_API_KEYS", "[{name: ci", "environment variable GOSSH_API_KEYS: expected YAML or JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := ApplyEnv(&testConfig{}, "GOSSH_")
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Fatalf("got %v, want %s", err, tt.want)
+			}
+			// The value may be a secret
+			if strings.Contains(err.Error(), tt.value) {
+				t.Errorf("error %q repeats the value", err)
+			}
+		})
+	}
+}
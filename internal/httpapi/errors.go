@@ -0,0 +1,98 @@
+// Package httpapi holds the vocabulary of gossh's HTTP API: the codes
+// failures are reported under and the JSON and HTML responses that carry
+// them.
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Code identifies a kind of failure in error responses and carries the
+// HTTP status it is reported with
+type Code struct {
+	Name   string
+	Status int
+}
+
+// Codes reported in the "code" field of error responses
+var (
+	BadRequest       = Code{"bad_request", http.StatusBadRequest}
+	MissingParams    = Code{"missing_parameters", http.StatusBadRequest}
+	InvalidToken     = Code{"invalid_token", http.StatusBadRequest}
+	TokenInURL       = Code{"token_in_url", http.StatusBadRequest}
+	APIKeyRequired   = Code{"api_key_required", http.StatusUnauthorized}
+	InvalidAPIKey    = Code{"invalid_api_key", http.StatusUnauthorized}
+	Forbidden        = Code{"forbidden", http.StatusForbidden}
+	PathNotAllowed   = Code{"path_not_allowed", http.StatusForbidden}
+	LoginDenied      = Code{"login_denied", http.StatusForbidden}
+	OutsideWindow    = Code{"outside_access_window", http.StatusForbidden}
+	NotFound         = Code{"not_found", http.StatusNotFound}
+	MethodNotAllowed = Code{"method_not_allowed", http.StatusMethodNotAllowed}
+	Conflict         = Code{"conflict", http.StatusConflict}
+	TooLarge         = Code{"too_large", http.StatusRequestEntityTooLarge}
+	RateLimited      = Code{"rate_limited", http.StatusTooManyRequests}
+	LockedOut        = Code{"locked_out", http.StatusTooManyRequests}
+	QuotaExceeded    = Code{"quota_exceeded", http.StatusTooManyRequests}
+	Internal         = Code{"internal_error", http.StatusInternalServerError}
+	NoSpace          = Code{"insufficient_space", http.StatusInsufficientStorage}
+	TransferFailed   = Code{"transfer_failed", http.StatusBadGateway}
+	ConnectFailed    = Code{"connect_failed", http.StatusBadGateway}
+	DeployFailed     = Code{"deploy_failed", http.StatusBadGateway}
+	Maintenance      = Code{"maintenance", http.StatusServiceUnavailable}
+)
+
+// Coded is implemented by errors that choose the code they are reported
+// under. A positive retry-after tells the client how long to wait before
+// trying again.
+type Coded interface {
+	error
+	ErrorCode() (code Code, retryAfter time.Duration)
+}
+
+// codedError is the error Errorf returns
+type codedError struct {
+	code Code
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+func (e *codedError) ErrorCode() (Code, time.Duration) {
+	return e.code, 0
+}
+
+// Errorf returns an error reported under code
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// Classify returns the code err is reported under, and how long to wait
+// before retrying when it says. The code comes from err when it carries
+// one, and is fallback otherwise.
+func Classify(err error, fallback Code) (Code, time.Duration) {
+	var coded Coded
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return fallback, 0
+}
+
+// ErrorBody is the body of every error response:
+// {"error": {"code": ..., "message": ..., "request_id": ...}}
+type ErrorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	// RetryAfter is set for lockouts, quotas and rate limits, in seconds
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Envelope wraps ErrorBody in error responses
+type Envelope struct {
+	Error ErrorBody `json:"error"`
+}
@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSON writes data as a JSON response
+func JSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// JSONStatus writes a JSON response with a non-200 status code
+func JSONStatus(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// Responder writes error responses
+type Responder struct {
+	requestID func(*http.Request) string
+	page      func(w http.ResponseWriter, r *http.Request, status int, body ErrorBody)
+}
+
+// NewResponder returns a Responder that names requests in error bodies by
+// requestID, and shows browsers that navigated to a failing URL the page
+// renders, after the status line and Content-Type have been written
+func NewResponder(requestID func(*http.Request) string, page func(w http.ResponseWriter, r *http.Request, status int, body ErrorBody)) *Responder {
+	return &Responder{requestID: requestID, page: page}
+}
+
+// Body returns the error body for err, under the code Classify gives it
+func (rs *Responder) Body(r *http.Request, err error, fallback Code) ErrorBody {
+	code, _ := Classify(err, fallback)
+	return ErrorBody{Code: code.Name, Message: err.Error(), RequestID: rs.requestID(r)}
+}
+
+// Error writes an error response for err, under the code Classify gives it
+func (rs *Responder) Error(w http.ResponseWriter, r *http.Request, err error, fallback Code) {
+	code, retryAfter := Classify(err, fallback)
+	body := ErrorBody{Code: code.Name, Message: err.Error(), RequestID: rs.requestID(r)}
+	if retryAfter > 0 {
+		body.RetryAfter = int(retryAfter.Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(body.RetryAfter))
+	}
+	rs.write(w, r, code.Status, body)
+}
+
+// ErrorCode writes an error response with the given code and message
+func (rs *Responder) ErrorCode(w http.ResponseWriter, r *http.Request, code Code, message string) {
+	rs.write(w, r, code.Status, ErrorBody{Code: code.Name, Message: message, RequestID: rs.requestID(r)})
+}
+
+// write sends body as JSON, or as an HTML page when a browser navigated to
+// the URL
+func (rs *Responder) write(w http.ResponseWriter, r *http.Request, status int, body ErrorBody) {
+	if WantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		rs.page(w, r, status, body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Envelope{Error: body})
+}
+
+// WantsHTML reports whether r is a browser navigation rather than a fetch
+// or API call
+func WantsHTML(r *http.Request) bool {
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/json")
+}
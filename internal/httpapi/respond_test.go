@@ -0,0 +1,92 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitError asks clients to come back later
+type waitError struct{ wait time.Duration }
+
+func (e *waitError) Error() string { return "slow down" }
+
+func (e *waitError) ErrorCode() (Code, time.Duration) { return RateLimited, e.wait }
+
+func testResponder() *Responder {
+	return NewResponder(func(*http.Request) string { return "req-1" }, func(w http.ResponseWriter, r *http.Request, status int, body ErrorBody) {
+		fmt.Fprintf(w, "<p>%d %s</p>", status, body.Code)
+	})
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		code  Code
+		retry time.Duration
+	}{
+		{"plain error", errors.New("boom"), Internal, 0},
+		{"coded", Errorf(NotFound, "no such host"), NotFound, 0},
+		{"wrapped", fmt.Errorf("upload: %w", Errorf(TooLarge, "too big")), TooLarge, 0},
+		{"retry after", &waitError{wait: 3 * time.Second}, RateLimited, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		code, retry := Classify(tt.err, Internal)
+		if code != tt.code || retry != tt.retry {
+			t.Errorf("%s: Classify = %v, %v; want %v, %v", tt.name, code, retry, tt.code, tt.retry)
+		}
+	}
+}
+
+func TestResponderError(t *testing.T) {
+	w := httptest.NewRecorder()
+	testResponder().Error(w, httptest.NewRequest("GET", "/api/x", nil), &waitError{wait: 1500 * time.Millisecond}, Internal)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After %q, want 2", got)
+	}
+	var env Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	want := ErrorBody{Code: "rate_limited", Message: "slow down", RequestID: "req-1", RetryAfter: 2}
+	if env.Error != want {
+		t.Errorf("body %+v, want %+v", env.Error, want)
+	}
+}
+
+func TestResponderPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		html    bool
+	}{
+		{"navigation", map[string]string{"Sec-Fetch-Mode": "navigate"}, true},
+		{"fetch", map[string]string{"Sec-Fetch-Mode": "cors", "Accept": "text/html"}, false},
+		{"old browser", map[string]string{"Accept": "text/html,*/*"}, true},
+		{"API client", map[string]string{"Accept": "application/json, text/html"}, false},
+		{"no headers", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/terminal", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		testResponder().ErrorCode(w, r, Forbidden, "no")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d", tt.name, w.Code)
+		}
+		html := w.Body.String() == "<p>403 forbidden</p>"
+		if html != tt.html {
+			t.Errorf("%s: body %q, want page %v", tt.name, w.Body.String(), tt.html)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package sshbridge
+
+import "gossh/internal/transfer"
+
+// ClientMessage is a message from the page, or a gRPC client speaking the
+// same protocol
+type ClientMessage struct {
+	Type     string `json:"type"`
+	Data     string `json:"data"`
+	Cols     int    `json:"cols"`
+	Rows     int    `json:"rows"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	// Bytes is how much output a replay asks for; 0 is all there is
+	Bytes int `json:"bytes"`
+	// Answers reply to an auth_prompt
+	Answers []string `json:"answers"`
+	// ID names an upload, to follow or cancel it in the queue
+	ID string `json:"id"`
+	// Extract unpacks an uploaded archive into ExtractTo
+	Extract   bool   `json:"extract"`
+	ExtractTo string `json:"extract_to"`
+}
+
+// SessionMessage tells the terminal page which session it is attached to
+type SessionMessage struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+	Host      string `json:"host"`
+	User      string `json:"user"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+	// Protocol is "telnet" for telnet sessions, which are Insecure
+	Protocol string `json:"protocol,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+	// Platform is the host's, e.g. "linux" or "windows", when it is known
+	Platform string `json:"platform,omitempty"`
+	// SessionKey lets the page use the session for transfers, tunnels and
+	// unlocking when it has no identity
+	SessionKey string `json:"session_key,omitempty"`
+}
+
+// UploadResponse tells the page how an upload ended
+type UploadResponse struct {
+	Type    string `json:"type"`
+	Success bool   `json:"success"`
+	Path    string `json:"path"`
+	Error   string `json:"error"`
+	Warning string `json:"warning,omitempty"`
+	// ID is the upload's in the queue
+	ID string `json:"id,omitempty"`
+	// Extracted is set when the upload was an archive sent with extract
+	Extracted *transfer.ExtractResult `json:"extracted,omitempty"`
+}
+
+// UploadStatusMessage follows an upload from the page through the queue.
+// Events:
+//
+//	queued    the upload was accepted; Position uploads are ahead of it
+//	started   the upload is being written to the host
+//	progress  Bytes of Size have been written
+//	finished  the upload is over, as Success, Path, Error and Warning tell
+//
+// An upload_response follows finished, for clients that predate the queue.
+type UploadStatusMessage struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Event    string `json:"event"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Position int    `json:"position,omitempty"`
+	Success  bool   `json:"success,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+}
+
+// ReplayMessage brackets output the page asked to see again, so it can be
+// told apart from live output: "replay" before it, "replay_end" after
+type ReplayMessage struct {
+	Type  string `json:"type"`
+	Bytes int    `json:"bytes,omitempty"`
+}
+
+// ClipboardMessage hands the page a clipboard write from the session
+type ClipboardMessage struct {
+	Type string `json:"type"` // "clipboard"
+	Data string `json:"data"` // base64
+}
+
+// AuthPromptMessage asks the page for the answers of a keyboard-interactive
+// round. Rounds without prompts only carry a message for the user, such as
+// why a new password was rejected.
+type AuthPromptMessage struct {
+	Type        string       `json:"type"` // "auth_prompt"
+	Name        string       `json:"name,omitempty"`
+	Instruction string       `json:"instruction,omitempty"`
+	Prompts     []AuthPrompt `json:"prompts"`
+	// PasswordChange is set when the server asks for a new password
+	PasswordChange bool `json:"password_change,omitempty"`
+}
+
+// AuthPrompt is one question of a keyboard-interactive round. Answers to
+// prompts without echo are to be masked.
+type AuthPrompt struct {
+	Text string `json:"text"`
+	Echo bool   `json:"echo"`
+}
+
+// TransferMessage tells the page about a transfer in the session; Type is
+// the protocol, "zmodem" or "trzsz". Events:
+//
+//	download        the host started sending Filename, of Size bytes when
+//	                known
+//	data            the next part of the download, as base64 Data
+//	download_end    the download is complete and may be saved
+//	upload_request  the host waits for a file; the page answers with
+//	                <type>_upload or <type>_cancel
+//	progress        Bytes of the upload have been sent
+//	upload_end      the upload is complete
+//	end             the terminal is back to normal
+//	error           the transfer failed or was cancelled, as Error tells
+type TransferMessage struct {
+	Type     string `json:"type"`
+	Event    string `json:"event"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Data     string `json:"data,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LockMessage tells the page that its session was locked or unlocked
+type LockMessage struct {
+	Type string `json:"type"` // "locked" or "unlocked"
+	// Methods are the ways the session can be unlocked
+	Methods []string `json:"methods,omitempty"`
+	// SignInURL is where to sign in again, session.lock_sign_in_url
+	SignInURL string `json:"sign_in_url,omitempty"`
+}
+
+// ActivityMessage tells the page about a change in a session's output
+type ActivityMessage struct {
+	Type string `json:"type"` // "activity"
+	// Event is "command_finished", "output_resumed", "inactive" or
+	// "active"
+	Event string `json:"event"`
+	// IdleSeconds is how long the output had been quiet
+	IdleSeconds float64 `json:"idle_seconds"`
+	// BusySeconds is how long the finished command ran
+	BusySeconds float64 `json:"busy_seconds,omitempty"`
+}
@@ -0,0 +1,77 @@
+package sshbridge
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Pacer writes to a Conn, cutting off a client that stops keeping up with
+// its output. Its methods must not be called concurrently.
+type Pacer struct {
+	conn Conn
+	// deadline is how long a write may take before it counts as slow;
+	// slowWrites of them in a row, or one write stalled slowWrites times
+	// as long, cut the client off
+	deadline   time.Duration
+	slowWrites int
+	slow       int
+	cutOff     bool
+	onCutOff   func()
+}
+
+// NewPacer returns a Pacer writing to conn. onCutOff is called once, by the
+// write that finds the client too slow, and must close the connection
+// without blocking, as CloseSlow does. A deadline of 0 never cuts clients
+// off.
+func NewPacer(conn Conn, deadline time.Duration, slowWrites int, onCutOff func()) *Pacer {
+	return &Pacer{conn: conn, deadline: deadline, slowWrites: slowWrites, onCutOff: onCutOff}
+}
+
+// Deadline is how long a write may take before it counts as slow
+func (p *Pacer) Deadline() time.Duration {
+	return p.deadline
+}
+
+// Write sends a message
+func (p *Pacer) Write(messageType int, data []byte) error {
+	if p.deadline <= 0 {
+		return p.conn.WriteMessage(messageType, data)
+	}
+	// A write that times out leaves the connection unusable, so the
+	// deadline covers as many slow writes as the client is allowed
+	start := time.Now()
+	p.conn.SetWriteDeadline(start.Add(p.deadline * time.Duration(max(p.slowWrites, 1))))
+	err := p.conn.WriteMessage(messageType, data)
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		p.cut()
+	case time.Since(start) > p.deadline:
+		if p.slow++; p.slow >= p.slowWrites {
+			p.cut()
+		}
+	default:
+		p.slow = 0
+	}
+	return err
+}
+
+func (p *Pacer) cut() {
+	if p.cutOff {
+		return
+	}
+	p.cutOff = true
+	p.onCutOff()
+}
+
+// CloseSlow closes conn as too slow, in the background
+func CloseSlow(conn Conn) {
+	go func() {
+		msg := websocket.FormatCloseMessage(CloseClientTooSlow, "client too slow")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.Close()
+	}()
+}
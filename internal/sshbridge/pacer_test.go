@@ -0,0 +1,66 @@
+package sshbridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// delayedConn is a Conn whose writes take delay each
+type delayedConn struct {
+	Conn
+	delay  time.Duration
+	writes int
+}
+
+func (c *delayedConn) WriteMessage(messageType int, data []byte) error {
+	time.Sleep(c.delay)
+	c.writes++
+	return nil
+}
+
+func (c *delayedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestPacerCutsOffSlowClient(t *testing.T) {
+	conn := &delayedConn{delay: 20 * time.Millisecond}
+	cutOffs := 0
+	p := NewPacer(conn, 5*time.Millisecond, 3, func() { cutOffs++ })
+	for i := 0; i < 2; i++ {
+		p.Write(websocket.BinaryMessage, []byte("x"))
+	}
+	if cutOffs != 0 {
+		t.Fatalf("cut off after 2 slow writes of 3")
+	}
+	for i := 0; i < 3; i++ {
+		p.Write(websocket.BinaryMessage, []byte("x"))
+	}
+	if cutOffs != 1 {
+		t.Errorf("cut off %d times, want once", cutOffs)
+	}
+	if conn.writes != 5 {
+		t.Errorf("%d writes reached the connection, want 5", conn.writes)
+	}
+}
+
+func TestPacerFastWritesResetCount(t *testing.T) {
+	conn := &delayedConn{delay: 20 * time.Millisecond}
+	cutOffs := 0
+	p := NewPacer(conn, 5*time.Millisecond, 2, func() { cutOffs++ })
+	for i := 0; i < 4; i++ {
+		conn.delay = 20 * time.Millisecond
+		p.Write(websocket.BinaryMessage, []byte("x"))
+		conn.delay = 0
+		p.Write(websocket.BinaryMessage, []byte("x"))
+	}
+	if cutOffs != 0 {
+		t.Errorf("a client keeping up between slow writes was cut off")
+	}
+
+	// Without a deadline nothing is slow
+	p = NewPacer(&delayedConn{delay: 20 * time.Millisecond}, 0, 1, func() { cutOffs++ })
+	p.Write(websocket.BinaryMessage, []byte("x"))
+	if cutOffs != 0 {
+		t.Errorf("cut off with no deadline")
+	}
+}
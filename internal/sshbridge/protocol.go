@@ -0,0 +1,135 @@
+// Package sshbridge speaks the terminal protocol between gossh and the
+// page: the WebSocket subprotocol versions, the messages each side sends,
+// and the pacing of output to clients that fall behind. Bridging a session
+// to its host is left to package main, which holds the sessions.
+package sshbridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Versions of the terminal WebSocket protocol, negotiated as subprotocols.
+// A page that asks for none speaks gossh.v1.
+//
+// gossh.v1: the page sends ClientMessage JSON (input, resize, upload,
+// upload_cancel, replay, clear_scrollback, auth_response, zmodem_upload,
+// zmodem_cancel, trzsz_upload, trzsz_cancel) as text; binary frames are
+// dropped.
+// The server sends terminal output as binary frames, SessionMessage,
+// UploadResponse, UploadStatusMessage, ReplayMessage, ClipboardMessage,
+// AuthPromptMessage, TransferMessage, LockMessage and ActivityMessage JSON
+// as text, and errors as
+// "Error: <message>" text.
+//
+// gossh.v2: as v1, except that the page may send terminal input as binary
+// frames, and errors arrive as ErrorMessage JSON.
+const (
+	ProtocolV1 = "gossh.v1"
+	ProtocolV2 = "gossh.v2"
+)
+
+// Protocols are the versions the server speaks, newest first; the newest
+// one the page also offers is picked
+var Protocols = []string{ProtocolV2, ProtocolV1}
+
+// CloseClientTooSlow is the close code of a connection cut off for not
+// keeping up with its output, in the range for applications
+const CloseClientTooSlow = 4008
+
+// Conn is the client end of a terminal session: the page's WebSocket, or a
+// gRPC stream speaking the same messages. Text messages carry JSON and
+// "Error: " notices, binary messages terminal output.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// ExitReporter is implemented by connections that tell the client how the
+// shell or command ended; the page just sees the connection close
+type ExitReporter interface {
+	ReportExit(err error)
+}
+
+// NewUpgrader returns an upgrader offering Protocols and then extra, with
+// buffers of the given sizes pooled across its connections
+func NewUpgrader(readBuffer, writeBuffer int, handshakeTimeout time.Duration, extra []string, checkOrigin func(*http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:   readBuffer,
+		WriteBufferSize:  writeBuffer,
+		WriteBufferPool:  &sync.Pool{},
+		HandshakeTimeout: handshakeTimeout,
+		Subprotocols:     append(Protocols[:len(Protocols):len(Protocols)], extra...),
+		CheckOrigin:      checkOrigin,
+	}
+}
+
+// ErrorMessage reports an error to a gossh.v2 page
+type ErrorMessage struct {
+	Type    string `json:"type"` // "error"
+	Message string `json:"message"`
+}
+
+// Negotiate returns conn speaking the version agreed at upgrade. The
+// session code takes binary frames as input, as gossh.v2 sends it; other
+// versions are translated.
+func Negotiate(conn *websocket.Conn) Conn {
+	if conn.Subprotocol() == ProtocolV2 {
+		return v2Conn{conn}
+	}
+	return &v1Conn{Conn: conn}
+}
+
+// v1Conn speaks gossh.v1 to the page, which sends only text. Binary frames
+// are dropped rather than typed into the session: a page that never
+// negotiated v2 has no business sending them.
+type v1Conn struct {
+	*websocket.Conn
+	warned bool
+}
+
+func (c *v1Conn) ReadMessage() (int, []byte, error) {
+	for {
+		messageType, data, err := c.Conn.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			return messageType, data, err
+		}
+		if !c.warned {
+			slog.Warn("Dropped binary frames from a gossh.v1 page", "client", c.RemoteAddr().String())
+			c.warned = true
+		}
+	}
+}
+
+// v2Conn speaks gossh.v2 to the page
+type v2Conn struct {
+	*websocket.Conn
+}
+
+func (c v2Conn) WriteMessage(messageType int, data []byte) error {
+	if text, ok := bytes.CutPrefix(data, []byte("Error: ")); ok && messageType == websocket.TextMessage {
+		data, _ = json.Marshal(ErrorMessage{Type: "error", Message: strings.TrimSpace(string(text))})
+	}
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// DecodeClientMessage decodes a message from the page. Binary frames, which
+// only gossh.v2 pages and gRPC clients get this far with, are terminal input.
+func DecodeClientMessage(messageType int, data []byte) (ClientMessage, error) {
+	if messageType == websocket.BinaryMessage {
+		return ClientMessage{Type: "input", Data: string(data)}, nil
+	}
+	var msg ClientMessage
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
@@ -0,0 +1,128 @@
+package sshbridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startProtocolServer upgrades with Negotiate, sends an error, then echoes
+// each decoded client message back as ClientMessage JSON
+func startProtocolServer(t *testing.T) string {
+	t.Helper()
+	upgrader := NewUpgrader(1024, 1024, time.Second, nil, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conn := Negotiate(ws)
+		conn.WriteMessage(websocket.TextMessage, []byte("Error: Host unreachable\n"))
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := DecodeClientMessage(messageType, data)
+			if err != nil {
+				continue
+			}
+			echo, _ := json.Marshal(msg)
+			conn.WriteMessage(websocket.TextMessage, echo)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestWebSocketProtocolVersions(t *testing.T) {
+	url := startProtocolServer(t)
+	tests := []struct {
+		name    string
+		offered []string
+		want    string
+		// binaryInput is set when binary frames are taken as input
+		binaryInput bool
+		wantError   string
+	}{
+		{"none", nil, "", false, "Error: Host unreachable\n"},
+		{"v1", []string{ProtocolV1}, ProtocolV1, false, "Error: Host unreachable\n"},
+		{"v2", []string{ProtocolV2}, ProtocolV2, true, `{"type":"error","message":"Host unreachable"}`},
+		{"newest common", []string{ProtocolV1, ProtocolV2}, ProtocolV2, true, `{"type":"error","message":"Host unreachable"}`},
+		{"unknown only", []string{"gossh.v9"}, "", false, "Error: Host unreachable\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tt.offered}
+			client, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if got := client.Subprotocol(); got != tt.want {
+				t.Errorf("negotiated %q, want %q", got, tt.want)
+			}
+
+			read := func() string {
+				t.Helper()
+				_, data, err := client.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(data)
+			}
+			if got := read(); got != tt.wantError {
+				t.Errorf("error message %q, want %q", got, tt.wantError)
+			}
+
+			// The binary frame is echoed back only if it is taken as
+			// input; the text message that follows always is
+			client.WriteMessage(websocket.BinaryMessage, []byte("ls\r"))
+			client.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":120,"rows":40}`))
+			var msg ClientMessage
+			if tt.binaryInput {
+				if err := json.Unmarshal([]byte(read()), &msg); err != nil || msg.Type != "input" || msg.Data != "ls\r" {
+					t.Errorf("binary frame decoded as %+v, %v; want input", msg, err)
+				}
+			}
+			msg = ClientMessage{}
+			if err := json.Unmarshal([]byte(read()), &msg); err != nil || msg.Type != "resize" || msg.Cols != 120 || msg.Rows != 40 {
+				t.Errorf("got %+v, %v; want the resize", msg, err)
+			}
+		})
+	}
+}
+
+func TestDecodeClientMessage(t *testing.T) {
+	tests := []struct {
+		messageType int
+		data        string
+		want        ClientMessage
+	}{
+		{websocket.TextMessage, `{"type":"input","data":"ls\r"}`, ClientMessage{Type: "input", Data: "ls\r"}},
+		{websocket.TextMessage, `{"type":"resize","cols":80,"rows":24}`, ClientMessage{Type: "resize", Cols: 80, Rows: 24}},
+		{websocket.TextMessage, `{"type":"auth_response","answers":["123456"]}`, ClientMessage{Type: "auth_response", Answers: []string{"123456"}}},
+		{websocket.BinaryMessage, "\x1b[A", ClientMessage{Type: "input", Data: "\x1b[A"}},
+	}
+	for _, tt := range tests {
+		got, err := DecodeClientMessage(tt.messageType, []byte(tt.data))
+		if err != nil {
+			t.Errorf("%q: %v", tt.data, err)
+			continue
+		}
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(tt.want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%q decoded as %s, want %s", tt.data, gotJSON, wantJSON)
+		}
+	}
+	if _, err := DecodeClientMessage(websocket.TextMessage, []byte("ls\r")); err == nil {
+		t.Error("text that isn't JSON was decoded")
+	}
+}
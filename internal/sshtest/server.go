@@ -0,0 +1,324 @@
+// Package sshtest runs in-process SSH servers for tests.
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Credentials the Server accepts
+const (
+	User     = "tester"
+	Password = "secret"
+)
+
+// WindowChange is the payload of a window-change request
+type WindowChange struct {
+	Cols, Rows    uint32
+	Width, Height uint32
+}
+
+// Server is an SSH server for tests. Exec requests and the shell run
+// /bin/sh on the machine running the tests, without a PTY; SFTP serves the
+// real filesystem, and port forwards reach the machine's network.
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr   string
+	config *ssh.ServerConfig
+
+	// OnExec, when set, is called with each exec command before it runs.
+	// Returning false fails the command without running it.
+	OnExec func(command string) bool
+	// Shell, when set, serves shell requests instead of /bin/sh
+	Shell func(ch ssh.Channel)
+
+	ln      net.Listener
+	mu      sync.Mutex
+	noSFTP  bool
+	conns   []ssh.Conn
+	resizes []WindowChange
+	execs   []string
+	wg      sync.WaitGroup
+}
+
+// Start starts a server accepting User and Password.
+// configure, when set, changes the server config before it starts. The
+// server is stopped when the test ends.
+func Start(t testing.TB, configure func(*ssh.ServerConfig)) *Server {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == User && string(password) == Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password")
+		},
+	}
+	s.config.AddHostKey(signer)
+	if configure != nil {
+		configure(s.config)
+	}
+
+	s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = s.ln.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// close stops the server and drops its connections
+func (s *Server) close() {
+	s.ln.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// DropConnections closes every connection to the server, as a network
+// failure would
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// DisableSFTP refuses the sftp subsystem from now on, as hosts without an
+// SFTP server do, so that files are reached with commands instead
+func (s *Server) DisableSFTP() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noSFTP = true
+}
+
+func (s *Server) sftpEnabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.noSFTP
+}
+
+// WindowChanges returns the window sizes clients have asked for
+func (s *Server) WindowChanges() []WindowChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]WindowChange(nil), s.resizes...)
+}
+
+// Commands returns the exec commands run so far
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.execs...)
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, sshConn)
+	s.mu.Unlock()
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go s.handleSession(nc)
+		case "direct-tcpip":
+			go handleDirectTCPIP(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "only session and direct-tcpip channels are supported")
+		}
+	}
+}
+
+// handleDirectTCPIP forwards a port forward to its destination, as
+// reached from the machine running the tests
+func handleDirectTCPIP(nc ssh.NewChannel) {
+	var dest struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &dest); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	remote, err := net.Dial("tcp", net.JoinHostPort(dest.Host, fmt.Sprint(dest.Port)))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := nc.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		io.Copy(remote, channel)
+		remote.Close()
+	}()
+	io.Copy(channel, remote)
+	channel.Close()
+}
+
+func (s *Server) handleSession(nc ssh.NewChannel) {
+	channel, requests, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	started := false
+	start := func(run func()) bool {
+		if started {
+			return false
+		}
+		started = true
+		go run()
+		return true
+	}
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req", "env":
+			ok = true
+		case "window-change":
+			var w WindowChange
+			if ssh.Unmarshal(req.Payload, &w) == nil {
+				s.mu.Lock()
+				s.resizes = append(s.resizes, w)
+				s.mu.Unlock()
+				ok = true
+			}
+		case "shell":
+			if s.Shell != nil {
+				ok = start(func() { s.Shell(channel) })
+			} else {
+				ok = start(func() { runTestCommand(channel, "/bin/sh") })
+			}
+		case "exec":
+			var cmd struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &cmd) == nil {
+				s.mu.Lock()
+				s.execs = append(s.execs, cmd.Command)
+				s.mu.Unlock()
+				if s.OnExec != nil && !s.OnExec(cmd.Command) {
+					ok = start(func() { exitChannel(channel, 1) })
+				} else {
+					ok = start(func() { runTestCommand(channel, "/bin/sh", "-c", cmd.Command) })
+				}
+			}
+		case "subsystem":
+			var sub struct{ Name string }
+			if ssh.Unmarshal(req.Payload, &sub) == nil && sub.Name == "sftp" && s.sftpEnabled() {
+				ok = start(func() {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+						server.Close()
+					}
+					exitChannel(channel, 0)
+				})
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// runTestCommand runs a command with its standard streams connected to
+// channel and reports its exit status
+func runTestCommand(channel ssh.Channel, name string, args ...string) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		exitChannel(channel, 127)
+		return
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	status := 0
+	if err := cmd.Wait(); err != nil {
+		status = 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			status = exitErr.ExitCode()
+		}
+	}
+	exitChannel(channel, status)
+}
+
+// Dial opens a client connection to the server, closed when the test ends
+func (s *Server) Dial(t testing.TB) *ssh.Client {
+	t.Helper()
+	client, err := ssh.Dial("tcp", s.Addr, &ssh.ClientConfig{
+		User:            User,
+		Auth:            []ssh.AuthMethod{ssh.Password(Password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// exitChannel reports status as the exit status of channel and closes it
+func exitChannel(channel ssh.Channel, status int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	channel.Close()
+}
@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+)
+
+// Uploads with if_changed=true leave an identical file at the destination
+// alone instead of sending it again, and downloads with precompute=1 hash
+// the file before sending it.
+
+// Exit codes of remoteHashCommand that tell the file differs, rather than
+// that it couldn't be hashed
+const (
+	HashExitMissing = 3
+	hashExitSize    = 4
+)
+
+// UploadAction marks the audit events of uploads that were extracted or
+// skipped
+func UploadAction(result Result) string {
+	if result.Extracted != nil {
+		return "extracted"
+	}
+	if result.Skipped {
+		return "skipped"
+	}
+	return ""
+}
+
+// sha256Pattern matches a hex-encoded SHA-256
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ParseChecksum reads a sha256 given with an upload, "" when none was
+func ParseChecksum(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s != "" && !sha256Pattern.MatchString(s) {
+		return "", httpapi.Errorf(httpapi.BadRequest, "Invalid sha256: expected 64 hex digits")
+	}
+	return s, nil
+}
+
+// RewoundChecksum returns the sha256 of f, leaving it at the start again
+func RewoundChecksum(f io.ReadSeeker) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// remoteHashCommand prints the SHA-256 of a regular file of the expected
+// size, exiting early when it is missing or of another size. The path is
+// passed through ShellQuote.
+const remoteHashCommand = `f=%s; [ -f "$f" ] || exit 3; [ "$(wc -c < "$f")" -eq %d ] || exit 4; sha256sum "$f" 2>/dev/null || shasum -a 256 "$f"`
+
+// remoteFileMatches tells whether the file at remotePath on the host has
+// size bytes with the given sha256. Anything that goes wrong counts as a
+// difference, so the upload goes ahead. client is an SFTP connection
+// already open to the host, if any.
+func (h *Host) remoteFileMatches(client *sftp.Client, remotePath string, size int64, sum string) bool {
+	got, err := h.remoteChecksum(client, remotePath, size)
+	if err != nil {
+		h.log.Debug("Remote checksum failed", "path", remotePath, "err", err)
+		return false
+	}
+	return got == sum
+}
+
+// remoteChecksum returns the sha256 of the file at remotePath on the host,
+// which must be a regular file of size bytes. It is hashed with sha256sum
+// where the host has it and read over SFTP otherwise, within the Host's
+// ChecksumTimeout. client is an SFTP connection already open to the host,
+// if any.
+func (h *Host) remoteChecksum(client *sftp.Client, remotePath string, size int64) (string, error) {
+	timeout := h.limits.ChecksumTimeout
+	if client == nil {
+		out, err := CommandOutput(h.client, fmt.Sprintf(remoteHashCommand, ShellQuote(remotePath), size), timeout)
+		var exitErr *ssh.ExitError
+		switch {
+		case err == nil:
+			if fields := strings.Fields(out); len(fields) > 0 && sha256Pattern.MatchString(fields[0]) {
+				return fields[0], nil
+			}
+			err = fmt.Errorf("unexpected output %q", out)
+		case errors.As(err, &exitErr) && (exitErr.ExitStatus() == HashExitMissing || exitErr.ExitStatus() == hashExitSize):
+			return "", fmt.Errorf("%s is not a regular file of %d bytes", remotePath, size)
+		}
+		h.log.Debug("Remote checksum failed, reading the file over SFTP", "path", remotePath, "err", err)
+
+		c, err := sftp.NewClient(h.client)
+		if err != nil {
+			return "", fmt.Errorf("failed to start SFTP: %v", err)
+		}
+		defer c.Close()
+		client = c
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return hashFileViaSFTP(ctx, client, remotePath, size)
+}
+
+// hashFileViaSFTP returns the SHA-256 of the file at remotePath, which
+// must be a regular file of size bytes
+func hashFileViaSFTP(ctx context.Context, client *sftp.Client, remotePath string, size int64) (string, error) {
+	info, err := client.Stat(remotePath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return "", fmt.Errorf("%s is not a regular file of %d bytes", remotePath, size)
+	}
+	f, err := client.Open(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Copying to the hasher lets the file read ahead concurrently
+	hasher := sha256.New()
+	if _, err := io.Copy(contextWriter{ctx: ctx, w: hasher}, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// contextWriter stops taking writes once ctx is done
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
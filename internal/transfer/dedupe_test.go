@@ -0,0 +1,45 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gossh/internal/sshtest"
+)
+
+// TestRemoteChecksumQuotesPath hashes a file whose name the shell would
+// change if it saw it unquoted, so the file would not be found
+func TestRemoteChecksumQuotesPath(t *testing.T) {
+	remotePath := filepath.Join(t.TempDir(), "it's a $(echo x) `echo y` $HOME file")
+	content := []byte("checksummed over exec\n")
+	if err := os.WriteFile(remotePath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+
+	server := sshtest.Start(t, nil)
+	server.DisableSFTP()
+	h := NewHost(server.Dial(t), discardLogger, Limits{ChecksumTimeout: 10 * time.Second})
+	got, err := h.remoteChecksum(nil, remotePath, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum %s, want %x", got, sum)
+	}
+	ran := false
+	for _, command := range server.Commands() {
+		ran = ran || strings.Contains(command, ShellQuote(remotePath))
+	}
+	if !ran {
+		t.Errorf("no command named the quoted path: %q", server.Commands())
+	}
+	if h.remoteFileMatches(nil, remotePath, int64(len(content))+1, got) {
+		t.Error("a file of another size matched")
+	}
+}
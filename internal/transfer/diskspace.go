@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+)
+
+// freeSpaceUnknown is noted in upload responses when the destination's free
+// space couldn't be told and the upload went ahead regardless
+const freeSpaceUnknown = "Free space on the destination could not be checked"
+
+// checkFreeSpace refuses an upload of size bytes into dir when the
+// filesystem holding it lacks room for the file and the margin. When the
+// free space can't be told it returns a note instead, and the upload goes
+// ahead. client is an SFTP connection already open to the host, if any.
+func (h *Host) checkFreeSpace(client *sftp.Client, dir string, size int64) (string, error) {
+	if size < 0 {
+		return "", nil
+	}
+	free, err := freeSpace(h.client, client, dir)
+	if err != nil {
+		h.log.Debug("Free space check failed", "dir", dir, "err", err)
+		return freeSpaceUnknown, nil
+	}
+	margin := h.limits.FreeSpaceMarginMB << 20
+	if free-margin >= size {
+		return "", nil
+	}
+	if free >= size {
+		return "", httpapi.Errorf(httpapi.NoSpace, "Destination has only %s free, file is %s and %s must be kept free", FormatSize(free), FormatSize(size), FormatSize(margin))
+	}
+	return "", httpapi.Errorf(httpapi.NoSpace, "Destination has only %s free, file is %s", FormatSize(free), FormatSize(size))
+}
+
+// freeSpace returns the bytes available to the user on the filesystem
+// holding dir
+func freeSpace(sshConn *ssh.Client, client *sftp.Client, dir string) (int64, error) {
+	fs, err := FilesystemUsage(sshConn, client, dir)
+	return fs.Available, err
+}
+
+// FSUsage describes the filesystem holding a path, in bytes. Available is
+// what the user may still write, which may be less than Total less Used.
+type FSUsage struct {
+	Filesystem string `json:"filesystem,omitempty"`
+	Mount      string `json:"mount,omitempty"`
+	Total      int64  `json:"total"`
+	Used       int64  `json:"used"`
+	Available  int64  `json:"available"`
+	Method     string `json:"method"` // statvfs or df
+}
+
+// FilesystemUsage describes the filesystem holding dir. SFTP's
+// statvfs@openssh.com extension tells directly; without it, Unix hosts are
+// asked with df. client is an SFTP connection already open to the host, if
+// any.
+func FilesystemUsage(sshConn *ssh.Client, client *sftp.Client, dir string) (FSUsage, error) {
+	if client == nil {
+		if c, err := sftp.NewClient(sshConn); err == nil {
+			defer c.Close()
+			client = c
+		}
+	}
+	if client != nil {
+		if st, err := client.StatVFS(dir); err == nil {
+			frsize := st.Frsize
+			if frsize == 0 {
+				frsize = st.Bsize
+			}
+			return FSUsage{
+				Total:     int64(st.Blocks * frsize),
+				Used:      int64((st.Blocks - st.Bfree) * frsize),
+				Available: int64(st.Bavail * frsize),
+				Method:    "statvfs",
+			}, nil
+		}
+	}
+	if platforms.of(sshConn) == Windows {
+		return FSUsage{}, errors.New("the SFTP server doesn't report free space")
+	}
+	out, err := probePlatform(sshConn, "LC_ALL=C df -Pk "+ShellQuote(dir))
+	if err != nil {
+		return FSUsage{}, fmt.Errorf("df failed: %v", err)
+	}
+	return parseDF(out)
+}
+
+// parseDF reads the output of df -Pk, as GNU and BusyBox write it: a
+// header, then one line of filesystem, size, used and available 1024-byte
+// blocks, capacity and mount point
+func parseDF(out string) (FSUsage, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return FSUsage{}, fmt.Errorf("unexpected df output %q", out)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return FSUsage{}, fmt.Errorf("unexpected df output %q", out)
+	}
+	var blocks [3]int64
+	for i := range blocks {
+		n, err := strconv.ParseInt(fields[1+i], 10, 64)
+		if err != nil {
+			return FSUsage{}, fmt.Errorf("unexpected df output %q", out)
+		}
+		blocks[i] = n << 10
+	}
+	return FSUsage{
+		Filesystem: fields[0],
+		Mount:      strings.Join(fields[5:], " "),
+		Total:      blocks[0],
+		Used:       blocks[1],
+		Available:  blocks[2],
+		Method:     "df",
+	}, nil
+}
+
+// FormatSize writes n bytes for people, e.g. 1.5 GiB
+func FormatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
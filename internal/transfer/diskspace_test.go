@@ -0,0 +1,58 @@
+package transfer
+
+import (
+	"testing"
+)
+
+// Output of LC_ALL=C df -Pk captured on GNU coreutils and BusyBox hosts
+const (
+	dfGNU = `Filesystem     1024-blocks     Used Available Capacity Mounted on
+/dev/nvme0n1p2   490617784 87366004 378255752      19% /
+`
+	dfGNULongName = `Filesystem                                          1024-blocks    Used Available Capacity Mounted on
+/dev/mapper/ubuntu--vg-ubuntu--lv--with--a--long--name   102626232 9613892  87753076      10% /srv/backup disk
+`
+	dfBusyBox = `Filesystem           1024-blocks    Used Available Capacity Mounted on
+/dev/root              7574940   3202808   4023572  44% /
+`
+	dfBusyBoxOverlay = `Filesystem           1024-blocks    Used Available Capacity Mounted on
+overlay                 59554168  21626348  34880432  38% /
+`
+)
+
+func TestParseDF(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want FSUsage
+	}{
+		{"GNU", dfGNU, FSUsage{Filesystem: "/dev/nvme0n1p2", Mount: "/", Total: 490617784 << 10, Used: 87366004 << 10, Available: 378255752 << 10, Method: "df"}},
+		{"GNU mount with a space", dfGNULongName, FSUsage{Filesystem: "/dev/mapper/ubuntu--vg-ubuntu--lv--with--a--long--name", Mount: "/srv/backup disk", Total: 102626232 << 10, Used: 9613892 << 10, Available: 87753076 << 10, Method: "df"}},
+		{"BusyBox", dfBusyBox, FSUsage{Filesystem: "/dev/root", Mount: "/", Total: 7574940 << 10, Used: 3202808 << 10, Available: 4023572 << 10, Method: "df"}},
+		{"BusyBox overlay", dfBusyBoxOverlay, FSUsage{Filesystem: "overlay", Mount: "/", Total: 59554168 << 10, Used: 21626348 << 10, Available: 34880432 << 10, Method: "df"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDF(tt.out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDFRejectsOtherOutput(t *testing.T) {
+	for _, out := range []string{
+		"",
+		"Filesystem     1024-blocks     Used Available Capacity Mounted on\n",
+		"df: /nonexistent: No such file or directory\n",
+		"Filesystem 1K-blocks Used Available Use% Mounted on\n/dev/sda1 41G 18G 20G 49% /\n",
+	} {
+		if got, err := parseDF(out); err == nil {
+			t.Errorf("%q parsed as %+v", out, got)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package transfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"gossh/internal/httpapi"
+)
+
+// Uploads with UploadOptions.Extract are archives unpacked on the host once
+// they are in place and their checksum verifies. gossh reads its own copy
+// of the archive first and refuses it, before any of it is sent, when a
+// member would land outside the target directory or the files add up to
+// more than Limits.ExtractMaxMB.
+
+// archiveFormats are the archives uploads are unpacked from, by the suffix
+// of their name
+var archiveFormats = []struct{ suffix, format string }{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar.bz2", "tar.bz2"},
+	{".tbz2", "tar.bz2"},
+	{".tbz", "tar.bz2"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// extractProbeCommands succeed on hosts with the commands that unpack each
+// format
+var extractProbeCommands = map[string]string{
+	"tar":     `command -v tar >/dev/null 2>&1`,
+	"tar.gz":  `command -v tar >/dev/null 2>&1 && command -v gzip >/dev/null 2>&1`,
+	"tar.bz2": `command -v tar >/dev/null 2>&1 && command -v bzip2 >/dev/null 2>&1`,
+	"zip":     `command -v unzip >/dev/null 2>&1`,
+}
+
+// extractCommands unpack an archive into a directory, which is created
+// first. tar -o leaves the files to the SSH user rather than the owners the
+// archive names.
+var extractCommands = map[string]string{
+	"tar":     `mkdir -p -- %[2]s && tar -xo -f %[1]s -C %[2]s 2>&1`,
+	"tar.gz":  `mkdir -p -- %[2]s && tar -xzo -f %[1]s -C %[2]s 2>&1`,
+	"tar.bz2": `mkdir -p -- %[2]s && tar -xjo -f %[1]s -C %[2]s 2>&1`,
+	"zip":     `mkdir -p -- %[2]s && unzip -qo %[1]s -d %[2]s 2>&1`,
+}
+
+// extractPathDenied refuses to unpack archives where downloads aren't
+// allowed from
+const extractPathDenied = "Access denied: archives are only extracted under /home, /opt, and /tmp, or under Users on Windows hosts"
+
+// Kinds of archive member
+const (
+	memberFile    = "file"
+	memberDir     = "dir"
+	memberSymlink = "symlink"
+	memberLink    = "link" // a hard link to an earlier member
+	memberOther   = "other"
+)
+
+// ExtractResult tells where an uploaded archive was unpacked and what it
+// held
+type ExtractResult struct {
+	To     string `json:"to"`
+	Method string `json:"method"` // tar, unzip or sftp
+	// Size adds up the sizes of the files; Files lists the members relative
+	// to To in the archive's order, directories ending in /
+	Size  int64    `json:"size"`
+	Files []string `json:"files"`
+}
+
+// archiveMember is an entry of an archive
+type archiveMember struct {
+	Name string
+	Kind string
+	// Link is where a symlink points, or the member a hard link is to
+	Link string
+	Mode os.FileMode
+}
+
+// Archive is an inspected archive to unpack once it is uploaded
+type Archive struct {
+	// archive is gossh's copy of the upload, of size bytes
+	archive io.ReaderAt
+	size    int64
+	format  string
+	// to is the directory the request asked for, "" for one named after
+	// the archive next to it
+	to string
+
+	members []archiveMember
+	total   int64
+}
+
+// ParseExtractRequest reads whether an upload is to be unpacked, and
+// where, from its extract and extract_to fields. It returns nil when it
+// isn't, and the inspected archive when it is.
+func ParseExtractRequest(get func(string) string, filename string, archive io.ReaderAt, size int64, limits Limits) (*Archive, error) {
+	if extract, _ := strconv.ParseBool(get("extract")); !extract {
+		return nil, nil
+	}
+	return NewArchive(filename, get("extract_to"), archive, size, limits)
+}
+
+// NewArchive inspects archive, the content of an upload named
+// filename, to be unpacked into to
+func NewArchive(filename, to string, archive io.ReaderAt, size int64, limits Limits) (*Archive, error) {
+	if to != "" && !DownloadPathAllowed(path.Clean(to)) {
+		return nil, httpapi.Errorf(httpapi.PathNotAllowed, extractPathDenied)
+	}
+	x := &Archive{archive: archive, size: size, format: archiveFormat(filename), to: to}
+	if x.format == "" {
+		return nil, httpapi.Errorf(httpapi.BadRequest, "%s is not an archive that can be extracted: expected .tar, .tar.gz, .tgz, .tar.bz2 or .zip", filename)
+	}
+	if err := x.inspect(limits.ExtractMaxMB, limits.ExtractMaxFiles); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// archiveFormat returns the format of an archive by its name, "" when it
+// isn't one
+func archiveFormat(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, f := range archiveFormats {
+		if strings.HasSuffix(lower, f.suffix) && len(lower) > len(f.suffix) {
+			return f.format
+		}
+	}
+	return ""
+}
+
+// inspect lists the members of the archive, refusing it at the first that
+// would land outside the directory it is unpacked in or that isn't a file,
+// directory or link, and when it holds more than maxFiles members or maxMB
+// of files. The files are read in full, so a zip whose headers understate
+// their size is caught too.
+//
+// Symlinks may not point up with .., and no member may be placed through a
+// symlink of the archive, so links can't be chained out of the directory.
+func (x *Archive) inspect(maxMB int64, maxFiles int) error {
+	limit := maxMB << 20
+	symlinks := map[string]bool{}
+	return x.walk(func(m archiveMember, body io.Reader) error {
+		name, err := memberPath(m.Name)
+		if err != nil {
+			return httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: %v", m.Name, err)
+		}
+		if name == "" {
+			return nil
+		}
+		if link := symlinkParent(name, symlinks); link != "" {
+			return httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: it is placed through the symlink %s", m.Name, link)
+		}
+		switch m.Kind {
+		case memberFile:
+			n, err := io.Copy(io.Discard, io.LimitReader(body, limit-x.total+1))
+			if err != nil {
+				return httpapi.Errorf(httpapi.BadRequest, "Invalid archive: %v", err)
+			}
+			if x.total += n; x.total > limit {
+				return httpapi.Errorf(httpapi.TooLarge, "The archive holds more than %d MB of files", maxMB)
+			}
+		case memberSymlink:
+			if err := checkSymlinkTarget(m.Link); err != nil {
+				return httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: it links to %s, %v", m.Name, m.Link, err)
+			}
+			symlinks[name] = true
+		case memberLink:
+			if m.Link, err = memberPath(m.Link); err != nil || m.Link == "" {
+				return httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: it links outside the target directory", m.Name)
+			}
+			if symlinks[m.Link] || symlinkParent(m.Link, symlinks) != "" {
+				return httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: it links through a symlink", m.Name)
+			}
+		case memberOther:
+			return httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: it is neither a file, a directory nor a link", m.Name)
+		}
+		if len(x.members) == maxFiles {
+			return httpapi.Errorf(httpapi.TooLarge, "The archive holds more than %d members", maxFiles)
+		}
+		m.Name = name
+		x.members = append(x.members, m)
+		return nil
+	})
+}
+
+// memberPath cleans the name of an archive member relative to the directory
+// it is unpacked in, "" for that directory itself. Absolute names and names
+// with .. in them are refused.
+func memberPath(name string) (string, error) {
+	if path.IsAbs(name) || (len(name) >= 2 && name[1] == ':') {
+		return "", fmt.Errorf("it is an absolute path")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("it climbs out of the target directory with ..")
+		}
+	}
+	if p := path.Clean(name); p != "." {
+		return p, nil
+	}
+	return "", nil
+}
+
+// checkSymlinkTarget refuses symlink targets that are absolute or climb
+// with .., wherever the link is in the archive
+func checkSymlinkTarget(target string) error {
+	if path.IsAbs(target) || (len(target) >= 2 && target[1] == ':') {
+		return fmt.Errorf("an absolute path")
+	}
+	for _, part := range strings.Split(strings.ReplaceAll(target, `\`, "/"), "/") {
+		if part == ".." {
+			return fmt.Errorf("which climbs with ..")
+		}
+	}
+	return nil
+}
+
+// symlinkParent returns the first directory of name that is one of
+// symlinks, "" when none is
+func symlinkParent(name string, symlinks map[string]bool) string {
+	for i := range len(name) {
+		if name[i] == '/' && symlinks[name[:i]] {
+			return name[:i]
+		}
+	}
+	return ""
+}
+
+// walk calls fn with each member of the archive, in order, and a reader of
+// its content
+func (x *Archive) walk(fn func(m archiveMember, body io.Reader) error) error {
+	r := io.NewSectionReader(x.archive, 0, x.size)
+	if x.format == "zip" {
+		return walkZip(r, x.size, fn)
+	}
+	var stream io.Reader = r
+	switch x.format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid archive: %v", err)
+		}
+		defer gz.Close()
+		stream = gz
+	case "tar.bz2":
+		stream = bzip2.NewReader(r)
+	}
+
+	tr := tar.NewReader(stream)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid archive: %v", err)
+		}
+		m := archiveMember{Name: h.Name, Link: h.Linkname, Mode: h.FileInfo().Mode().Perm()}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			m.Kind = memberFile
+		case tar.TypeDir:
+			m.Kind = memberDir
+		case tar.TypeSymlink:
+			m.Kind = memberSymlink
+		case tar.TypeLink:
+			m.Kind = memberLink
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			m.Kind = memberOther
+		}
+		if err := fn(m, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// walkZip is walk for zip archives. Names are read with \ as a separator,
+// as unzip does for archives made on Windows.
+func walkZip(r io.ReaderAt, size int64, fn func(m archiveMember, body io.Reader) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return httpapi.Errorf(httpapi.BadRequest, "Invalid archive: %v", err)
+	}
+	for _, f := range zr.File {
+		m := archiveMember{Name: strings.ReplaceAll(f.Name, `\`, "/"), Mode: f.Mode().Perm()}
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			m.Kind = memberDir
+		case mode&os.ModeSymlink != 0:
+			m.Kind = memberSymlink
+		case mode.IsRegular():
+			m.Kind = memberFile
+		default:
+			m.Kind = memberOther
+		}
+		body, err := f.Open()
+		if err != nil {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid archive: %s: %v", f.Name, err)
+		}
+		if m.Kind == memberSymlink {
+			link, err := io.ReadAll(io.LimitReader(body, 4096))
+			if err != nil {
+				body.Close()
+				return httpapi.Errorf(httpapi.BadRequest, "Invalid archive: %s: %v", f.Name, err)
+			}
+			m.Link = string(link)
+		}
+		err = fn(m, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadAndExtract uploads file, then unpacks it as opts.Extract says.
+// An upload skipped as unchanged is unpacked too.
+func (h *Host) uploadAndExtract(file io.Reader, filename string, opts UploadOptions) (Result, error) {
+	x := opts.Extract
+	opts.Extract = nil
+	result, err := h.Upload(file, filename, opts)
+	if err != nil {
+		return result, err
+	}
+	result.Extracted, err = h.extract(x, result.Path)
+	return result, err
+}
+
+// extract unpacks the archive uploaded to archivePath with tar or unzip,
+// or over SFTP from gossh's copy on Windows hosts and hosts without them
+func (h *Host) extract(x *Archive, archivePath string) (*ExtractResult, error) {
+	to := x.to
+	if to == "" {
+		to = archivePath[:len(archivePath)-len(archiveSuffix(archivePath))]
+	}
+	dest, err := HostDownloadPath(h.client, to)
+	if err != nil {
+		return nil, httpapi.Errorf(httpapi.PathNotAllowed, extractPathDenied)
+	}
+	result := &ExtractResult{To: dest, Size: x.total, Files: make([]string, len(x.members))}
+	for i, m := range x.members {
+		result.Files[i] = m.Name
+		if m.Kind == memberDir {
+			result.Files[i] += "/"
+		}
+	}
+
+	windows := platforms.of(h.client) == Windows
+	if !windows {
+		if _, err := CommandOutput(h.client, extractProbeCommands[x.format], ProbeTimeout); err == nil {
+			result.Method = "tar"
+			if x.format == "zip" {
+				result.Method = "unzip"
+			}
+			command := fmt.Sprintf(extractCommands[x.format], ShellQuote(archivePath), ShellQuote(dest))
+			if out, err := CommandOutput(h.client, command, h.limits.ExtractTimeout); err != nil {
+				return nil, fmt.Errorf("failed to extract %s: %v %s", archivePath, err, strings.TrimSpace(out))
+			}
+			h.log.Info("Archive extracted", "path", archivePath, "to", dest, "files", len(x.members), "size", x.total, "method", result.Method)
+			return result, nil
+		}
+	}
+
+	result.Method = "sftp"
+	client, err := sftp.NewClient(h.client)
+	if err != nil {
+		return nil, fmt.Errorf("the host has neither the commands to extract %s nor SFTP: %v", x.format, err)
+	}
+	defer client.Close()
+	if windows {
+		for _, m := range x.members {
+			for _, part := range strings.Split(m.Name, "/") {
+				if err := checkWindowsName(part); err != nil {
+					return nil, httpapi.Errorf(httpapi.BadRequest, "Archive member %q is refused: %v", m.Name, err)
+				}
+			}
+		}
+		dest = "/" + dest
+	}
+	if err := x.extractViaSFTP(client, dest, windows); err != nil {
+		return nil, fmt.Errorf("failed to extract %s: %v", archivePath, err)
+	}
+	h.log.Info("Archive extracted", "path", archivePath, "to", result.To, "files", len(x.members), "size", x.total, "method", result.Method)
+	return result, nil
+}
+
+// archiveSuffix returns the suffix archiveFormat knows p's format by
+func archiveSuffix(p string) string {
+	lower := strings.ToLower(p)
+	for _, f := range archiveFormats {
+		if strings.HasSuffix(lower, f.suffix) {
+			return p[len(p)-len(f.suffix):]
+		}
+	}
+	return ""
+}
+
+// extractViaSFTP writes the members of the archive under dest. File modes
+// aren't kept on Windows, which has none.
+func (x *Archive) extractViaSFTP(client *sftp.Client, dest string, windows bool) error {
+	if err := client.MkdirAll(dest); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dest, err)
+	}
+	return x.walk(func(m archiveMember, body io.Reader) error {
+		name, err := memberPath(m.Name)
+		if err != nil || name == "" {
+			return err
+		}
+		p := path.Join(dest, name)
+		if m.Kind != memberDir {
+			if err := client.MkdirAll(path.Dir(p)); err != nil {
+				return fmt.Errorf("failed to create %s: %v", path.Dir(name), err)
+			}
+		}
+		switch m.Kind {
+		case memberDir:
+			if err := client.MkdirAll(p); err != nil {
+				return fmt.Errorf("failed to create %s: %v", name, err)
+			}
+		case memberFile:
+			f, err := client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %v", name, err)
+			}
+			_, err = io.Copy(f, body)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write %s: %v", name, err)
+			}
+			if !windows {
+				if err := client.Chmod(p, m.Mode); err != nil {
+					return fmt.Errorf("failed to set the mode of %s: %v", name, err)
+				}
+			}
+		case memberSymlink, memberLink:
+			client.Remove(p)
+			if m.Kind == memberSymlink {
+				err = client.Symlink(m.Link, p)
+			} else if link, _ := memberPath(m.Link); link != "" {
+				err = client.Link(path.Join(dest, link), p)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to link %s: %v", name, err)
+			}
+		}
+		return nil
+	})
+}
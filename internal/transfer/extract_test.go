@@ -0,0 +1,149 @@
+package transfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"gossh/internal/httpapi"
+)
+
+func TestMemberPath(t *testing.T) {
+	tests := []struct {
+		name, want string
+		refused    bool
+	}{
+		{"a/b.txt", "a/b.txt", false},
+		{"./a//b/", "a/b", false},
+		{".", "", false},
+		{"./", "", false},
+		{"/etc/passwd", "", true},
+		{"C:/Windows/win.ini", "", true},
+		{"../evil", "", true},
+		{"a/../../evil", "", true},
+		// Refused although it stays inside: .. is never trusted
+		{"a/../b", "", true},
+	}
+	for _, tt := range tests {
+		got, err := memberPath(tt.name)
+		if (err != nil) != tt.refused || got != tt.want {
+			t.Errorf("memberPath(%q) = %q, %v; want %q, refused %v", tt.name, got, err, tt.want, tt.refused)
+		}
+	}
+}
+
+// tarMember is a member of an archive built by testTar
+type tarMember struct {
+	name string
+	kind byte
+	link string
+	body string
+}
+
+func testTar(t *testing.T, members []tarMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		h := &tar.Header{Name: m.name, Typeflag: m.kind, Linkname: m.link, Mode: 0o644, Size: int64(len(m.body))}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func inspectArchive(format string, archive []byte, maxMB int64, maxFiles int) (*Archive, error) {
+	x := &Archive{archive: bytes.NewReader(archive), size: int64(len(archive)), format: format}
+	return x, x.inspect(maxMB, maxFiles)
+}
+
+func TestInspectArchiveLinks(t *testing.T) {
+	file := func(name string) tarMember { return tarMember{name: name, kind: tar.TypeReg, body: "x"} }
+	symlink := func(name, target string) tarMember { return tarMember{name: name, kind: tar.TypeSymlink, link: target} }
+	tests := []struct {
+		name    string
+		members []tarMember
+		refused bool
+	}{
+		{"link to a sibling", []tarMember{file("a/f"), symlink("a/l", "f")}, false},
+		{"link into a subdirectory", []tarMember{file("a/b/f"), symlink("l", "a/b/f")}, false},
+		{"hard link", []tarMember{file("a/f"), {name: "h", kind: tar.TypeLink, link: "a/f"}}, false},
+		{"absolute link", []tarMember{symlink("l", "/etc")}, true},
+		{"link out of the directory", []tarMember{symlink("l", "../etc")}, true},
+		{"link up that stays inside", []tarMember{symlink("a/l", "../f")}, true},
+		{"chained links", []tarMember{symlink("a/l", ".."), symlink("x", "a/l/.."), file("x/evil")}, true},
+		{"file through a link", []tarMember{symlink("l", "a"), file("l/evil")}, true},
+		{"directory through a link", []tarMember{symlink("l", "a"), {name: "l/d/", kind: tar.TypeDir}}, true},
+		{"hard link through a symlink", []tarMember{file("a/f"), symlink("l", "a"), {name: "h", kind: tar.TypeLink, link: "l/f"}}, true},
+		{"hard link to a symlink", []tarMember{symlink("l", "a"), {name: "h", kind: tar.TypeLink, link: "l"}}, true},
+		{"hard link out of the directory", []tarMember{{name: "h", kind: tar.TypeLink, link: "../etc/passwd"}}, true},
+		{"device", []tarMember{{name: "dev", kind: tar.TypeChar}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := inspectArchive("tar", testTar(t, tt.members), 1, 100)
+			if (err != nil) != tt.refused {
+				t.Errorf("inspect: %v, want refused %v", err, tt.refused)
+			}
+		})
+	}
+}
+
+func TestInspectZipLinks(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	h := &zip.FileHeader{Name: `a\l`}
+	h.SetMode(os.ModeSymlink | 0o777)
+	w, err := zw.CreateHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(`..\..\etc`))
+	zw.Close()
+	if _, err := inspectArchive("zip", buf.Bytes(), 1, 100); err == nil {
+		t.Error("zip symlink climbing with backslashes was accepted")
+	}
+}
+
+func TestInspectArchiveLimits(t *testing.T) {
+	big := strings.Repeat("x", 1<<20)
+	file := func(name, body string) tarMember { return tarMember{name: name, kind: tar.TypeReg, body: body} }
+	tests := []struct {
+		name    string
+		members []tarMember
+		refused bool
+		total   int64
+	}{
+		{"within the limits", []tarMember{file("a", big), file("b", "")}, false, 1 << 20},
+		{"too large", []tarMember{file("a", big), file("b", "x")}, true, 0},
+		{"too many members", []tarMember{file("a", ""), file("b", ""), {name: "c/", kind: tar.TypeDir}}, true, 0},
+		{"the directory itself isn't counted", []tarMember{{name: "./", kind: tar.TypeDir}, file("a", "x"), file("b", "x")}, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := inspectArchive("tar", testTar(t, tt.members), 1, 2)
+			if tt.refused {
+				if code, _ := httpapi.Classify(err, httpapi.Internal); err == nil || code != httpapi.TooLarge {
+					t.Errorf("inspect: %v, want a %s error", err, httpapi.TooLarge.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("inspect: %v", err)
+			}
+			if x.total != tt.total {
+				t.Errorf("total %d, want %d", x.total, tt.total)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+)
+
+// Windows is the platform of hosts running Windows. Other platforms
+// are named after `uname -s`, such as "linux"; an empty platform is one that
+// couldn't be told, which is treated like any Unix.
+const Windows = "windows"
+
+// ProbeTimeout bounds each command run to tell a host's platform
+const ProbeTimeout = 10 * time.Second
+
+// windowsTempDir is where uploads to Windows hosts land, relative to the
+// user's profile
+const windowsTempDir = "AppData/Local/Temp"
+
+// WindowsDrivePath matches the start of an absolute Windows path, C:\ or
+// C:/, as SFTP servers on Windows also write it: /C:/
+var WindowsDrivePath = regexp.MustCompile(`^/?([A-Za-z]):[/\\]`)
+
+// windowsDeviceName matches names that open a device in any directory,
+// with or without an extension
+var windowsDeviceName = regexp.MustCompile(`(?i)^(con|prn|aux|nul|conin\$|conout\$|com[0-9¹²³]|lpt[0-9¹²³])(\..*)?$`)
+
+// platformCache remembers the platform of each open SSH connection, so it is
+// only probed once however many transfers share the connection
+type platformCache struct {
+	mu      sync.Mutex
+	clients map[*ssh.Client]*platformEntry
+}
+
+type platformEntry struct {
+	once     sync.Once
+	platform string
+}
+
+var platforms = &platformCache{clients: make(map[*ssh.Client]*platformEntry)}
+
+// of returns the platform of the host client is connected to, detecting it
+// on first use
+func (c *platformCache) of(client *ssh.Client) string {
+	c.mu.Lock()
+	e, ok := c.clients[client]
+	if !ok {
+		e = &platformEntry{}
+		c.clients[client] = e
+		go func() {
+			client.Wait()
+			c.mu.Lock()
+			delete(c.clients, client)
+			c.mu.Unlock()
+		}()
+	}
+	c.mu.Unlock()
+	e.once.Do(func() { e.platform = detectPlatform(client) })
+	return e.platform
+}
+
+// Platform returns the platform of the host client is connected to,
+// detecting it on first use
+func Platform(client *ssh.Client) string {
+	return platforms.of(client)
+}
+
+// BannerPlatform tells the platform from the server's version string, which
+// Windows' own OpenSSH announces as OpenSSH_for_Windows
+func BannerPlatform(client *ssh.Client) string {
+	if strings.Contains(strings.ToLower(string(client.ServerVersion())), "windows") {
+		return Windows
+	}
+	return ""
+}
+
+// detectPlatform asks the host when its version string doesn't tell: `uname`
+// answers on Unix and in Cygwin-like environments, `ver` in cmd.exe and
+// PowerShell
+func detectPlatform(client *ssh.Client) string {
+	if p := BannerPlatform(client); p != "" {
+		return p
+	}
+	if out, err := probePlatform(client, "uname -s"); err == nil {
+		if name := strings.ToLower(strings.TrimSpace(out)); name != "" && !strings.ContainsAny(name, " \t\r\n") {
+			return name
+		}
+	}
+	if out, err := probePlatform(client, "cmd /c ver"); err == nil && strings.Contains(out, "Windows") {
+		return Windows
+	}
+	return ""
+}
+
+// probePlatform runs command and returns its output
+func probePlatform(client *ssh.Client, command string) (string, error) {
+	return CommandOutput(client, command, ProbeTimeout)
+}
+
+// CommandOutput runs command and returns its output, giving up after timeout
+func CommandOutput(client *ssh.Client, command string, timeout time.Duration) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := session.Output(command)
+		done <- result{out, err}
+	}()
+	select {
+	case r := <-done:
+		return string(r.out), r.err
+	case <-time.After(timeout):
+		return "", fmt.Errorf("%s timed out", command)
+	}
+}
+
+// checkWindowsName refuses a file or directory name Windows would read as
+// something else: a device, an alternate data stream, a name it silently
+// trims, or one with reserved characters
+func checkWindowsName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("%q is not a file name", name)
+	case strings.ContainsAny(name, `<>:"/\|?*`):
+		return fmt.Errorf("%q contains characters Windows doesn't allow in file names", name)
+	case strings.HasSuffix(name, ".") || strings.HasSuffix(name, " "):
+		return fmt.Errorf("%q ends with a dot or space", name)
+	case windowsDeviceName.MatchString(name):
+		return fmt.Errorf("%q is a reserved device name", name)
+	}
+	for _, r := range name {
+		if r < 0x20 {
+			return fmt.Errorf("%q contains control characters", name)
+		}
+	}
+	return nil
+}
+
+// WindowsDownloadPath checks a download path on a Windows host, which may be
+// written C:\Users\bob\report.txt, C:/Users/bob/report.txt or
+// /C:/Users/bob/report.txt, and returns it with forward slashes. Like /home
+// elsewhere, only files under a drive's Users directory may be downloaded.
+func WindowsDownloadPath(p string) (string, error) {
+	m := WindowsDrivePath.FindStringSubmatch(p)
+	if m == nil {
+		return "", httpapi.Errorf(httpapi.PathNotAllowed, "Access denied: %q is not an absolute path with a drive letter", p)
+	}
+	parts := strings.Split(strings.ReplaceAll(p[len(m[0]):], `\`, "/"), "/")
+	for _, part := range parts {
+		if err := checkWindowsName(part); err != nil {
+			return "", httpapi.Errorf(httpapi.PathNotAllowed, "Access denied: %v", err)
+		}
+	}
+	if len(parts) < 2 || !strings.EqualFold(parts[0], "Users") {
+		return "", httpapi.Errorf(httpapi.PathNotAllowed, "Access denied: downloads from Windows hosts are only allowed from the Users directory")
+	}
+	return strings.ToUpper(m[1]) + ":/" + strings.Join(parts, "/"), nil
+}
+
+// UnixDownloadPath checks a download path on hosts other than Windows,
+// which must be under /home, /opt or /tmp once .. is resolved, and returns
+// it cleaned
+func UnixDownloadPath(p string) (string, error) {
+	p = path.Clean(p)
+	for _, prefix := range []string{"/home/", "/opt/", "/tmp/"} {
+		if strings.HasPrefix(p+"/", prefix) {
+			return p, nil
+		}
+	}
+	return "", httpapi.Errorf(httpapi.PathNotAllowed, "Access denied: downloads are only allowed from /home, /opt, and /tmp directories")
+}
+
+// HostDownloadPath checks a download path by the rules of the host's
+// platform, returning it cleaned: C:/Users/... on Windows hosts, which SFTP
+// names /C:/Users/...
+func HostDownloadPath(sshConn *ssh.Client, p string) (string, error) {
+	if platforms.of(sshConn) == Windows {
+		return WindowsDownloadPath(p)
+	}
+	return UnixDownloadPath(p)
+}
+
+// DownloadPathAllowed tells whether a download path may be allowed on some
+// platform, before the host is connected to find out which
+func DownloadPathAllowed(p string) bool {
+	if _, err := UnixDownloadPath(p); err == nil {
+		return true
+	}
+	_, err := WindowsDownloadPath(p)
+	return err == nil
+}
+
+// nativeWindowsPath writes an SFTP path such as /C:/Users/bob the way
+// Windows users do: C:\Users\bob
+func nativeWindowsPath(p string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(p, "/"), "/", `\`)
+}
+
+// uploadViaSFTP writes file to the user's temp directory on a Windows
+// host. Windows hosts have no /tmp, and their shell doesn't understand the
+// quoting of the cat upload, so SFTP is the only way there. As there, the
+// file is renamed into place once complete.
+func (h *Host) uploadViaSFTP(file io.Reader, filename string, opts UploadOptions) (Result, error) {
+	var result Result
+	if err := checkWindowsName(filename); err != nil {
+		return result, httpapi.Errorf(httpapi.BadRequest, "Invalid file name: %v", err)
+	}
+
+	client, err := sftp.NewClient(h.client)
+	if err != nil {
+		return result, fmt.Errorf("failed to start SFTP: %v", err)
+	}
+	defer client.Close()
+
+	home, err := client.Getwd()
+	if err != nil {
+		return result, fmt.Errorf("failed to find the user's profile: %v", err)
+	}
+	remotePath := path.Join("/", home, windowsTempDir, filename)
+	if !WindowsDrivePath.MatchString(remotePath) {
+		return result, fmt.Errorf("unexpected profile directory %s", home)
+	}
+	result.Path = nativeWindowsPath(remotePath)
+
+	if opts.IfChanged && opts.SHA256 != "" && opts.Size >= 0 && h.remoteFileMatches(client, remotePath, opts.Size, opts.SHA256) {
+		h.log.Info("Upload skipped, file is unchanged", "path", result.Path, "size", opts.Size, "platform", Windows)
+		return Result{Path: result.Path, Size: opts.Size, SHA256: opts.SHA256, Skipped: true}, nil
+	}
+
+	result.Warning, err = h.checkFreeSpace(client, path.Dir(remotePath), opts.Size)
+	if err != nil {
+		return result, err
+	}
+
+	partial, err := partialUploadPath(remotePath)
+	if err != nil {
+		return result, err
+	}
+	remote, err := client.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return result, fmt.Errorf("failed to create %s: %v", nativeWindowsPath(partial), err)
+	}
+	defer remote.Close()
+	placed := false
+	defer func() {
+		if !placed {
+			remote.Close()
+			if err := client.Remove(partial); err != nil {
+				h.log.Warn("Failed to remove partial upload", "path", nativeWindowsPath(partial), "err", err)
+			}
+		}
+	}()
+
+	hasher := sha256.New()
+	n, err := io.Copy(remote, io.TeeReader(file, hasher))
+	result.Size = n
+	result.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	if err != nil {
+		return result, fmt.Errorf("failed to write file data: %v", err)
+	}
+	if err := remote.Close(); err != nil {
+		return result, fmt.Errorf("failed to upload file: %v", err)
+	}
+	if err := verifyUpload(result, opts); err != nil {
+		return result, err
+	}
+	if err := renameReplacing(client, partial, remotePath); err != nil {
+		return result, fmt.Errorf("failed to move the upload into place: %v", err)
+	}
+	placed = true
+
+	h.log.Info("File uploaded", "path", result.Path, "size", result.Size, "platform", Windows)
+	return result, nil
+}
+
+// renameReplacing renames from to to, replacing any file there. Servers
+// without the posix-rename@openssh.com extension refuse to rename over a
+// file, so it is removed first, which leaves a moment without either.
+func renameReplacing(client *sftp.Client, from, to string) error {
+	err := client.PosixRename(from, to)
+	if err == nil {
+		return nil
+	}
+	if err := client.Rename(from, to); err == nil {
+		return nil
+	}
+	if rmErr := client.Remove(to); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(from, to)
+}
+
+// statFileViaSFTP returns the size of a regular file on a Windows host
+func statFileViaSFTP(client *sftp.Client, remotePath string) (int64, error) {
+	info, err := client.Stat(remotePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("file not found or not a regular file: %s", nativeWindowsPath(remotePath))
+	}
+	return info.Size(), nil
+}
+
+// validateViaSFTP is Validate for Windows hosts
+func (h *Host) validateViaSFTP(remotePath string) (map[string]interface{}, error) {
+	p, err := WindowsDownloadPath(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(h.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SFTP: %v", err)
+	}
+	defer client.Close()
+
+	fileSize, err := statFileViaSFTP(client, "/"+p)
+	if err != nil {
+		return nil, err
+	}
+	h.log.Debug("Validated download", "path", p, "size", fileSize, "platform", Windows)
+	return map[string]interface{}{
+		"filename": path.Base(p),
+		"size":     fileSize,
+	}, nil
+}
+
+// downloadViaSFTP is Download for Windows hosts
+func (h *Host) downloadViaSFTP(w http.ResponseWriter, remotePath string, opts DownloadOptions) (Result, error) {
+	result := Result{Path: remotePath}
+	p, err := WindowsDownloadPath(remotePath)
+	if err != nil {
+		return result, err
+	}
+	client, err := sftp.NewClient(h.client)
+	if err != nil {
+		return result, fmt.Errorf("failed to start SFTP: %v", err)
+	}
+	defer client.Close()
+
+	fileSize, err := statFileViaSFTP(client, "/"+p)
+	if err != nil {
+		return result, err
+	}
+	var sum string
+	if opts.Precompute {
+		if sum, err = h.remoteChecksum(client, "/"+p, fileSize); err != nil {
+			return result, fmt.Errorf("failed to compute the file's checksum: %v", err)
+		}
+	}
+	remote, err := client.Open("/" + p)
+	if err != nil {
+		return result, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer remote.Close()
+
+	startDownload(w, path.Base(p), fileSize, sum, opts)
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hasher), remote)
+	result.Size = n
+	result.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	if err != nil {
+		return result, fmt.Errorf("failed to stream file data: %v", err)
+	}
+	if err := FinishDownload(w, result, sum, opts); err != nil {
+		return result, err
+	}
+
+	h.log.Info("File downloaded", "path", p, "size", result.Size, "platform", Windows)
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package transfer
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshtest"
+)
+
+func TestDownloadPathAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"/home/alice/report.txt":      true,
+		"/opt/app/log/today.log":      true,
+		"/tmp/../tmp/x":               true,
+		"/home/../etc/shadow":         false,
+		"/tmp/../../etc/passwd":       false,
+		"/opt/./../root/.ssh/id_rsa":  false,
+		"/homework/notes":             false,
+		"/etc/passwd":                 false,
+		"relative/home/x":             false,
+		`C:\Users\bob\report.txt`:     true,
+		`C:\Users\..\Windows\win.ini`: false,
+	}
+	for p, want := range tests {
+		if got := DownloadPathAllowed(p); got != want {
+			t.Errorf("%s allowed %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestDownloadRefusesTraversal(t *testing.T) {
+	denied := func(err error) bool {
+		code, _ := httpapi.Classify(err, httpapi.Internal)
+		return code == httpapi.PathNotAllowed
+	}
+	server := sshtest.Start(t, nil)
+	host := NewHost(server.Dial(t), discardLogger, Limits{})
+
+	// The file exists outside the allowed roots, wherever the tests run,
+	// so only the path check keeps it from being read
+	const outside = "/proc/self/status"
+	if _, err := os.Stat(outside); err != nil {
+		t.Skip(err)
+	}
+	sneaky := "/home/.." + outside
+
+	if _, err := host.Validate(sneaky); !denied(err) {
+		t.Errorf("validate %s: got %v, want path_not_allowed", sneaky, err)
+	}
+	w := httptest.NewRecorder()
+	if _, err := host.Download(w, sneaky, DownloadOptions{}); !denied(err) {
+		t.Errorf("download %s: got %v, want path_not_allowed", sneaky, err)
+	}
+	if w.Body.Len() > 0 {
+		t.Errorf("download sent %d bytes", w.Body.Len())
+	}
+
+	// A path under /tmp after .. is resolved is fine
+	dir, err := os.MkdirTemp("/tmp", "gossh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(file, []byte("report"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	result, err := host.Download(w, "/home/../tmp/./"+file[len("/tmp/"):], DownloadOptions{})
+	if err != nil || w.Body.String() != "report" || result.Path != file {
+		t.Errorf("download got %q and %+v: %v", w.Body, result, err)
+	}
+}
@@ -0,0 +1,405 @@
+// Package transfer moves files to and from SSH hosts: uploads, downloads,
+// archive extraction and the checks around them, over a shell where the
+// host has one and over SFTP on Windows.
+package transfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+)
+
+// Limits bound the transfers of a Host
+type Limits struct {
+	// FreeSpaceMarginMB is left free on the destination filesystem:
+	// uploads that would leave less are refused before they start
+	FreeSpaceMarginMB int64
+	// ChecksumTimeout bounds hashing the file at the destination of an
+	// IfChanged upload; once it passes the file is sent regardless
+	ChecksumTimeout time.Duration
+	// Archives to extract may hold at most ExtractMaxFiles members and
+	// ExtractMaxMB of files, and are unpacked within ExtractTimeout
+	ExtractMaxMB    int64
+	ExtractMaxFiles int
+	ExtractTimeout  time.Duration
+}
+
+// Host moves files to and from the host an SSH client is connected to
+type Host struct {
+	client *ssh.Client
+	log    *slog.Logger
+	limits Limits
+}
+
+// NewHost returns a Host transferring over client, logging to logger
+func NewHost(client *ssh.Client, logger *slog.Logger, limits Limits) *Host {
+	return &Host{client: client, log: logger, limits: limits}
+}
+
+// ShellQuote quotes s as a single word for a POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Result describes a completed file transfer
+type Result struct {
+	Path   string
+	Size   int64
+	SHA256 string
+	// Warning is a note for the user about a transfer that went ahead
+	Warning string
+	// Skipped is set when an identical file was already at the destination
+	Skipped bool
+	// Extracted tells where an archive uploaded with extract was unpacked
+	Extracted *ExtractResult
+}
+
+// UploadOptions describe the file of an upload
+type UploadOptions struct {
+	// Size is the file's length when known, or -1. It is checked against the
+	// free space at the destination and against what was sent.
+	Size int64
+	// SHA256, when known, is checked against what was sent before the file
+	// is put in place
+	SHA256 string
+	// IfChanged leaves a file with that SHA256 already at the destination as
+	// it is
+	IfChanged bool
+	// Extract, when set, unpacks the file once it is in place
+	Extract *Archive
+}
+
+// PartialUploadSuffix marks a file being uploaded, which is renamed to its
+// destination only once it is complete
+const PartialUploadSuffix = ".gossh-partial-"
+
+// partialUploadPath returns where an upload to dest is written first
+func partialUploadPath(dest string) (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return dest + PartialUploadSuffix + hex.EncodeToString(id), nil
+}
+
+// verifyUpload checks what was sent against what the client said it would
+// send
+func verifyUpload(result Result, opts UploadOptions) error {
+	if opts.Size >= 0 && result.Size != opts.Size {
+		return fmt.Errorf("sent %d bytes of a %d-byte file", result.Size, opts.Size)
+	}
+	if opts.SHA256 != "" && result.SHA256 != opts.SHA256 {
+		return httpapi.Errorf(httpapi.BadRequest, "File doesn't match its sha256: received %s", result.SHA256)
+	}
+	return nil
+}
+
+// Upload writes file to /tmp on the host. It is written next to
+// its destination and moved into place, replacing any file there, once
+// complete, so an interrupted upload leaves nothing at the destination.
+func (h *Host) Upload(file io.Reader, filename string, opts UploadOptions) (Result, error) {
+	if opts.Extract != nil {
+		return h.uploadAndExtract(file, filename, opts)
+	}
+	if platforms.of(h.client) == Windows {
+		return h.uploadViaSFTP(file, filename, opts)
+	}
+	var result Result
+
+	// Create remote file path
+	remotePath := fmt.Sprintf("/tmp/%s", filename)
+	result.Path = remotePath
+
+	if opts.IfChanged && opts.SHA256 != "" && opts.Size >= 0 && h.remoteFileMatches(nil, remotePath, opts.Size, opts.SHA256) {
+		h.log.Info("Upload skipped, file is unchanged", "path", remotePath, "size", opts.Size)
+		return Result{Path: remotePath, Size: opts.Size, SHA256: opts.SHA256, Skipped: true}, nil
+	}
+
+	warning, err := h.checkFreeSpace(nil, "/tmp", opts.Size)
+	if err != nil {
+		return result, err
+	}
+	result.Warning = warning
+
+	partial, err := partialUploadPath(remotePath)
+	if err != nil {
+		return result, err
+	}
+	placed := false
+	defer func() {
+		if !placed {
+			if _, err := CommandOutput(h.client, "rm -f "+ShellQuote(partial), ProbeTimeout); err != nil {
+				h.log.Warn("Failed to remove partial upload", "path", partial, "err", err)
+			}
+		}
+	}()
+
+	// Create a new session to write the file
+	uploadSession, err := h.client.NewSession()
+	if err != nil {
+		return result, fmt.Errorf("failed to create upload session: %v", err)
+	}
+	defer uploadSession.Close()
+
+	// Get stdin pipe
+	stdinPipe, err := uploadSession.StdinPipe()
+	if err != nil {
+		return result, fmt.Errorf("failed to get stdin pipe: %v", err)
+	}
+
+	// Get stderr to capture any errors
+	stderrPipe, err := uploadSession.StderrPipe()
+	if err != nil {
+		return result, fmt.Errorf("failed to get stderr pipe: %v", err)
+	}
+
+	// Use cat to write the file - properly quote the filename
+	if err := uploadSession.Start("cat > " + ShellQuote(partial)); err != nil {
+		return result, fmt.Errorf("failed to start upload command: %v", err)
+	}
+
+	// Copy file data to stdin, hashing it on the way
+	hasher := sha256.New()
+	n, err := io.Copy(stdinPipe, io.TeeReader(file, hasher))
+	result.Size = n
+	result.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	if err != nil {
+		// Let cat end before the partial file is removed, or the shell may
+		// still create it after the rm
+		stdinPipe.Close()
+		done := make(chan struct{})
+		go func() { uploadSession.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(ProbeTimeout):
+		}
+		return result, fmt.Errorf("failed to write file data: %v", err)
+	}
+	stdinPipe.Close()
+
+	// Wait for command to complete
+	if err := uploadSession.Wait(); err != nil {
+		stderrData, _ := io.ReadAll(stderrPipe)
+		return result, fmt.Errorf("failed to upload file: %v - %s", err, string(stderrData))
+	}
+	if err := verifyUpload(result, opts); err != nil {
+		return result, err
+	}
+
+	// Move the complete file into place
+	if out, err := CommandOutput(h.client, fmt.Sprintf("mv -f %s %s 2>&1", ShellQuote(partial), ShellQuote(remotePath)), ProbeTimeout); err != nil {
+		return result, fmt.Errorf("failed to move the upload into place: %v %s", err, strings.TrimSpace(out))
+	}
+	placed = true
+
+	h.log.Info("File uploaded", "path", remotePath, "size", result.Size)
+	return result, nil
+}
+
+func (h *Host) Validate(remotePath string) (map[string]interface{}, error) {
+	if platforms.of(h.client) == Windows {
+		return h.validateViaSFTP(remotePath)
+	}
+	// Validate remote path - only allow downloads from /home, /opt, and /tmp
+	remotePath, err := UnixDownloadPath(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a session to check file
+	session, err := h.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	// Check if file exists and get its size using stat
+	output, err := session.CombinedOutput(fmt.Sprintf("test -f %s && stat -c '%%s' %s || echo 'NOT_FOUND'", ShellQuote(remotePath), ShellQuote(remotePath)))
+	if err != nil || strings.TrimSpace(string(output)) == "NOT_FOUND" {
+		return nil, fmt.Errorf("file not found or not a regular file: %s", remotePath)
+	}
+
+	// Parse file size
+	var fileSize int64
+	if _, err := fmt.Sscanf(string(output), "%d", &fileSize); err != nil {
+		return nil, fmt.Errorf("failed to get file information: %v", err)
+	}
+
+	// Extract filename from path
+	filename := filepath.Base(remotePath)
+
+	h.log.Debug("Validated download", "path", remotePath, "size", fileSize)
+	return map[string]interface{}{
+		"filename": filename,
+		"size":     fileSize,
+	}, nil
+}
+
+// ChecksumHeader carries the sha256 of a download, as a header or a trailer
+const ChecksumHeader = "X-Checksum-SHA256"
+
+// DownloadOptions say how a download gives its sha256
+type DownloadOptions struct {
+	// Precompute hashes the file on the host first, to send the sha256 as
+	// a header
+	Precompute bool
+	// Trailer otherwise sends it as a trailer, computed while the file
+	// streams. Chunked leaves out Content-Length, without which HTTP/1.1
+	// trailers can't be sent.
+	Trailer bool
+	Chunked bool
+}
+
+// DownloadChecksum reads how a download request wants the sha256:
+// precompute=1 asks for a header. Otherwise it comes as a trailer, to HTTP/2
+// clients and HTTP/1.1 clients that send "TE: trailers".
+func DownloadChecksum(r *http.Request) DownloadOptions {
+	precompute, _ := strconv.ParseBool(r.URL.Query().Get("precompute"))
+	trailers := false
+	for _, v := range r.Header.Values("TE") {
+		for _, coding := range strings.Split(v, ",") {
+			coding, _, _ = strings.Cut(coding, ";")
+			trailers = trailers || strings.EqualFold(strings.TrimSpace(coding), "trailers")
+		}
+	}
+	return DownloadOptions{
+		Precompute: precompute,
+		Trailer:    trailers || r.ProtoMajor >= 2,
+		Chunked:    trailers && r.ProtoMajor < 2,
+	}
+}
+
+// startDownload sets the headers of a download of size bytes. sum is the
+// file's sha256 when it was precomputed.
+func startDownload(w http.ResponseWriter, filename string, size int64, sum string, opts DownloadOptions) {
+	h := w.Header()
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	h.Set("Content-Type", "application/octet-stream")
+	switch {
+	case sum != "":
+		h.Set(ChecksumHeader, sum)
+	case opts.Trailer:
+		h.Set("Trailer", ChecksumHeader)
+	}
+	if sum != "" || !opts.Chunked {
+		h.Set("Content-Length", fmt.Sprintf("%d", size))
+	}
+}
+
+// FinishDownload checks a complete download against its precomputed sum,
+// or sends the sum as a trailer
+func FinishDownload(w http.ResponseWriter, result Result, sum string, opts DownloadOptions) error {
+	if sum != "" {
+		if result.SHA256 != sum {
+			return fmt.Errorf("the file changed while it was downloaded: sent %s, expected %s", result.SHA256, sum)
+		}
+		return nil
+	}
+	if opts.Trailer {
+		w.Header().Set(ChecksumHeader, result.SHA256)
+	}
+	return nil
+}
+
+func (h *Host) Download(w http.ResponseWriter, remotePath string, opts DownloadOptions) (Result, error) {
+	if platforms.of(h.client) == Windows {
+		return h.downloadViaSFTP(w, remotePath, opts)
+	}
+	result := Result{Path: remotePath}
+
+	// Validate remote path - only allow downloads from /home, /opt, and /tmp
+	remotePath, err := UnixDownloadPath(remotePath)
+	if err != nil {
+		return result, err
+	}
+	result.Path = remotePath
+
+	// Create a new session to read the file
+	downloadSession, err := h.client.NewSession()
+	if err != nil {
+		return result, fmt.Errorf("failed to create download session: %v", err)
+	}
+	defer downloadSession.Close()
+
+	// Get stdout pipe to stream file content
+	stdoutPipe, err := downloadSession.StdoutPipe()
+	if err != nil {
+		return result, fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+
+	// Get stderr to capture any errors
+	stderrPipe, err := downloadSession.StderrPipe()
+	if err != nil {
+		return result, fmt.Errorf("failed to get stderr pipe: %v", err)
+	}
+
+	// Extract filename from path
+	filename := filepath.Base(remotePath)
+
+	// Get file size first using stat command
+	statSession, err := h.client.NewSession()
+	if err != nil {
+		return result, fmt.Errorf("failed to create stat session: %v", err)
+	}
+	statOutput, err := statSession.CombinedOutput("stat -c %s " + ShellQuote(remotePath))
+	statSession.Close()
+	if err != nil {
+		return result, fmt.Errorf("failed to get file size: %v", err)
+	}
+
+	// Parse file size
+	var fileSize int64
+	if _, err := fmt.Sscanf(string(statOutput), "%d", &fileSize); err != nil {
+		return result, fmt.Errorf("failed to parse file size: %v", err)
+	}
+
+	var sum string
+	if opts.Precompute {
+		if sum, err = h.remoteChecksum(nil, remotePath, fileSize); err != nil {
+			return result, fmt.Errorf("failed to compute the file's checksum: %v", err)
+		}
+	}
+
+	// Start the cat command - do this before setting headers
+	// so if it fails, we can still return a proper HTTP error
+	if err := downloadSession.Start("cat " + ShellQuote(remotePath)); err != nil {
+		return result, fmt.Errorf("failed to start download command: %v", err)
+	}
+
+	// Now set response headers - after this point, we're committed to streaming
+	startDownload(w, filename, fileSize, sum, opts)
+
+	// Stream file content directly to HTTP response writer
+	// This avoids loading the entire file into memory
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hasher), stdoutPipe)
+	result.Size = n
+	result.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	if err != nil {
+		return result, fmt.Errorf("failed to stream file data: %v", err)
+	}
+
+	// Wait for command to complete
+	if err := downloadSession.Wait(); err != nil {
+		stderrData, _ := io.ReadAll(stderrPipe)
+		return result, fmt.Errorf("failed to download file: %v - %s", err, string(stderrData))
+	}
+	if err := FinishDownload(w, result, sum, opts); err != nil {
+		return result, err
+	}
+
+	h.log.Info("File downloaded", "path", remotePath, "size", result.Size)
+	return result, nil
+}
@@ -0,0 +1,156 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gossh/internal/sshtest"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// interruptedReader returns data and then fails with err, after calling
+// interrupt if it is set
+type interruptedReader struct {
+	data      []byte
+	err       error
+	interrupt func()
+}
+
+func (r *interruptedReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	if r.interrupt != nil {
+		r.interrupt()
+		r.interrupt = nil
+	}
+	return 0, r.err
+}
+
+// testUploadName returns a file name for an upload to /tmp that is removed,
+// with any partial uploads next to it, when the test ends. The name has a
+// space and a quote in it to exercise the quoting of remote commands.
+func testUploadName(t *testing.T) (name, dest string) {
+	t.Helper()
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	name = "gossh test 'upload' " + hex.EncodeToString(id)
+	dest = filepath.Join("/tmp", name)
+	t.Cleanup(func() {
+		os.Remove(dest)
+		for _, p := range partialUploads(t, dest) {
+			os.Remove(p)
+		}
+	})
+	return name, dest
+}
+
+func partialUploads(t *testing.T, dest string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(dest + PartialUploadSuffix + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestUploadViaSSH(t *testing.T) {
+	u := newTestUpload(t)
+	content := []byte("complete file\n")
+	result, err := u.run(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Path != u.dest || result.Size != int64(len(content)) {
+		t.Errorf("result %+v, want path %s and size %d", result, u.dest, len(content))
+	}
+	if got, err := os.ReadFile(u.dest); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("destination holds %q, %v; want %q", got, err, content)
+	}
+	if p := partialUploads(t, u.dest); len(p) > 0 {
+		t.Errorf("partial uploads left behind: %v", p)
+	}
+}
+
+func TestInterruptedUploadViaSSH(t *testing.T) {
+	tests := []struct {
+		name string
+		// leavesPartial is set when the host can't be reached to remove
+		// the partial upload
+		leavesPartial bool
+		upload        func(u *testUpload) error
+	}{
+		{"reader fails", false, func(u *testUpload) error {
+			_, err := u.run(&interruptedReader{data: []byte("half a file"), err: errors.New("client went away")}, -1)
+			return err
+		}},
+		{"short upload", false, func(u *testUpload) error {
+			_, err := u.run(strings.NewReader("half a file"), 1000)
+			return err
+		}},
+		{"connection dropped", true, func(u *testUpload) error {
+			_, err := u.run(&interruptedReader{data: []byte("half a file"), err: io.ErrUnexpectedEOF, interrupt: u.srv.DropConnections}, -1)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpload(t)
+			if err := tt.upload(u); err == nil {
+				t.Fatal("interrupted upload succeeded")
+			}
+			if _, err := os.Stat(u.dest); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("destination exists after an interrupted upload: %v", err)
+			}
+			if p := partialUploads(t, u.dest); len(p) > 0 && !tt.leavesPartial {
+				t.Errorf("partial uploads left behind: %v", p)
+			}
+		})
+	}
+}
+
+func TestInterruptedUploadKeepsExistingFile(t *testing.T) {
+	u := newTestUpload(t)
+	old := []byte("previous version\n")
+	if err := os.WriteFile(u.dest, old, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := u.run(&interruptedReader{data: []byte("half"), err: errors.New("client went away")}, -1); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	if got, err := os.ReadFile(u.dest); err != nil || !bytes.Equal(got, old) {
+		t.Errorf("destination holds %q, %v; want the previous %q", got, err, old)
+	}
+}
+
+// testUpload is an upload to an sshtest.Server
+type testUpload struct {
+	srv        *sshtest.Server
+	host       *Host
+	name, dest string
+}
+
+func newTestUpload(t *testing.T) *testUpload {
+	srv := sshtest.Start(t, nil)
+	u := &testUpload{srv: srv, host: NewHost(srv.Dial(t), discardLogger, Limits{})}
+	u.name, u.dest = testUploadName(t)
+	return u
+}
+
+func (u *testUpload) run(r io.Reader, size int64) (Result, error) {
+	return u.host.Upload(r, u.name, UploadOptions{Size: size})
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gossh/internal/httpapi"
+)
+
+// maxInventorySize bounds an inventory file
+const maxInventorySize = 8 << 20
+
+// inventoryColumns are the columns of a CSV inventory, and the keys of a
+// YAML one
+var inventoryColumns = []string{"name", "address", "port", "user", "tags", "credentials"}
+
+// inventoryHost is a row of an inventory: a host to keep as a profile
+type inventoryHost struct {
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+	User    string `yaml:"user"`
+	// Tags are a list in YAML and separated by ";" in CSV
+	Tags        []string `yaml:"tags"`
+	Credentials string   `yaml:"credentials"`
+
+	// line is where the row starts in the file
+	line int
+}
+
+// parseInventory reads a CSV or YAML inventory. Rows that don't parse are
+// reported with the others by importInventory; only a file that can't be
+// read at all is an error.
+func parseInventory(data []byte, format string) ([]inventoryHost, []inventoryResult, error) {
+	switch format {
+	case "csv":
+		return parseInventoryCSV(data)
+	case "yaml":
+		return parseInventoryYAML(data)
+	}
+	return nil, nil, httpapi.Errorf(httpapi.BadRequest, "Unknown inventory format %q; use csv or yaml", format)
+}
+
+func parseInventoryCSV(data []byte) ([]inventoryHost, []inventoryResult, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, httpapi.Errorf(httpapi.BadRequest, "Invalid CSV header: %v", err)
+	}
+	index := make(map[string]int)
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !containsString(inventoryColumns, col) {
+			return nil, nil, httpapi.Errorf(httpapi.BadRequest, "Unknown CSV column %q; columns are %s", col, strings.Join(inventoryColumns, ", "))
+		}
+		index[col] = i
+	}
+	for _, col := range []string{"name", "address"} {
+		if _, ok := index[col]; !ok {
+			return nil, nil, httpapi.Errorf(httpapi.BadRequest, "The CSV header has no %s column", col)
+		}
+	}
+
+	var hosts []inventoryHost
+	var bad []inventoryResult
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			bad = append(bad, inventoryResult{Line: parseErr.StartLine, Action: inventoryFailed, Error: parseErr.Err.Error()})
+			continue
+		} else if err != nil {
+			return nil, nil, httpapi.Errorf(httpapi.BadRequest, "Invalid CSV: %v", err)
+		}
+		line, _ := r.FieldPos(0)
+		field := func(col string) string {
+			if i, ok := index[col]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		h := inventoryHost{Name: field("name"), Address: field("address"), User: field("user"), Credentials: field("credentials"), line: line}
+		if port := field("port"); port != "" {
+			if h.Port, err = strconv.Atoi(port); err != nil {
+				bad = append(bad, inventoryResult{Line: line, Name: h.Name, Action: inventoryFailed, Error: fmt.Sprintf("Invalid port %q", port)})
+				continue
+			}
+		}
+		for _, tag := range strings.Split(field("tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				h.Tags = append(h.Tags, tag)
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, bad, nil
+}
+
+// parseInventoryYAML reads a list of hosts, or a document with a hosts list
+func parseInventoryYAML(data []byte) ([]inventoryHost, []inventoryResult, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, httpapi.Errorf(httpapi.BadRequest, "Invalid YAML: %v", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+	list := doc.Content[0]
+	if list.Kind == yaml.MappingNode {
+		list = nil
+		for i := 0; i+1 < len(doc.Content[0].Content); i += 2 {
+			if doc.Content[0].Content[i].Value == "hosts" {
+				list = doc.Content[0].Content[i+1]
+			}
+		}
+	}
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return nil, nil, httpapi.Errorf(httpapi.BadRequest, "The YAML inventory must be a list of hosts, or have one under hosts")
+	}
+
+	var hosts []inventoryHost
+	var bad []inventoryResult
+	for _, node := range list.Content {
+		var h inventoryHost
+		if err := node.Decode(&h); err != nil {
+			bad = append(bad, inventoryResult{Line: node.Line, Action: inventoryFailed, Error: err.Error()})
+			continue
+		}
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i < len(node.Content); i += 2 {
+				if key := node.Content[i].Value; !containsString(inventoryColumns, key) {
+					bad = append(bad, inventoryResult{Line: node.Line, Name: h.Name, Action: inventoryFailed, Error: fmt.Sprintf("Unknown field %q", key)})
+					h.line = -1
+					break
+				}
+			}
+		}
+		if h.line < 0 {
+			continue
+		}
+		h.line = node.Line
+		hosts = append(hosts, h)
+	}
+	return hosts, bad, nil
+}
+
+// What an import did with a row
+const (
+	inventoryCreated   = "created"
+	inventoryUpdated   = "updated"
+	inventoryUnchanged = "unchanged"
+	inventoryFailed    = "failed"
+)
+
+// inventoryResult is what became of one row
+type inventoryResult struct {
+	Line    int    `json:"line"`
+	Name    string `json:"name,omitempty"`
+	Action  string `json:"action"`
+	Profile string `json:"profile,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// inventoryReport is the response of POST /api/inventory/import
+type inventoryReport struct {
+	Success   bool              `json:"success"`
+	DryRun    bool              `json:"dry_run"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Failed    int               `json:"failed"`
+	Rows      []inventoryResult `json:"rows"`
+}
+
+// importInventory turns each host into a profile, replacing the profile of
+// the same name the caller may change, and saves them all unless dryRun.
+// A row that fails is reported and the others are still imported.
+func importInventory(r *http.Request, hosts []inventoryHost, bad []inventoryResult, dryRun bool) (inventoryReport, error) {
+	report := inventoryReport{Success: true, DryRun: dryRun, Rows: append([]inventoryResult{}, bad...)}
+	var changed []*Profile
+	var actions []string
+	seen := make(map[string]int)
+	now := time.Now()
+	for _, h := range hosts {
+		res := inventoryResult{Line: h.line, Name: h.Name, Action: inventoryFailed}
+		fail := func(err error) {
+			res.Action, res.Error = inventoryFailed, err.Error()
+			report.Rows = append(report.Rows, res)
+		}
+		if line, dup := seen[h.Name]; dup && h.Name != "" {
+			fail(fmt.Errorf("Duplicate name; first seen on line %d", line))
+			continue
+		}
+		seen[h.Name] = h.line
+
+		authType := profileAuthPassword
+		if h.Credentials != "" {
+			authType = profileAuthCredentials
+		}
+		req := profileRequest{Name: h.Name, Host: h.Address, Port: h.Port, User: h.User, AuthType: authType, Credentials: h.Credentials, Tags: h.Tags}
+		p := &Profile{ID: newJobID(), Owner: requestIdentity(r).User, Created: now}
+		res.Action = inventoryCreated
+		if existing, ok := profiles.named(strings.TrimSpace(h.Name)); ok {
+			if !canModifyProfile(r, &existing) {
+				fail(fmt.Errorf("Profile %q belongs to someone else", existing.Name))
+				continue
+			}
+			// An inventory has no notes, so the profile keeps its own
+			prev := existing
+			p, res.Action = &existing, inventoryUpdated
+			req.Notes = prev.Notes
+			if err := req.apply(p); err != nil {
+				fail(err)
+				continue
+			}
+			if sameProfile(&prev, p) {
+				res.Action = inventoryUnchanged
+			}
+		} else if err := req.apply(p); err != nil {
+			fail(err)
+			continue
+		}
+		if err := authorizeProfile(r, p); err != nil {
+			fail(err)
+			continue
+		}
+		if !dryRun || res.Action != inventoryCreated {
+			res.Profile = p.ID
+		}
+		report.Rows = append(report.Rows, res)
+		if res.Action != inventoryUnchanged {
+			p.Updated = now
+			changed = append(changed, p)
+			actions = append(actions, res.Action)
+		}
+	}
+
+	slices.SortStableFunc(report.Rows, func(a, b inventoryResult) int { return cmp.Compare(a.Line, b.Line) })
+	for _, res := range report.Rows {
+		switch res.Action {
+		case inventoryCreated:
+			report.Created++
+		case inventoryUpdated:
+			report.Updated++
+		case inventoryUnchanged:
+			report.Unchanged++
+		default:
+			report.Failed++
+		}
+	}
+	if dryRun || len(changed) == 0 {
+		return report, nil
+	}
+	if err := profiles.put(changed...); err != nil {
+		return report, err
+	}
+	for i, p := range changed {
+		action := "profile_create"
+		if actions[i] == inventoryUpdated {
+			action = "profile_update"
+		}
+		auditProfileChange(r, action, p.ID)
+	}
+	return report, nil
+}
+
+// sameProfile reports whether an import leaves a profile as it was
+func sameProfile(a, b *Profile) bool {
+	return a.Name == b.Name && a.Host == b.Host && a.Port == b.Port && a.User == b.User &&
+		a.AuthType == b.AuthType && a.Credentials == b.Credentials && strings.Join(a.Tags, "\x00") == strings.Join(b.Tags, "\x00")
+}
+
+// inventoryFormat picks the format of an inventory from the format
+// parameter, else the content type, else the file name
+func inventoryFormat(format, contentType, filename string) string {
+	if format != "" {
+		return strings.ToLower(format)
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "text/csv":
+			return "csv"
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return "yaml"
+		}
+	}
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		return "csv"
+	}
+	return "yaml"
+}
+
+// inventoryImportHandler imports the CSV or YAML inventory in the body of
+// POST /api/inventory/import as profiles; dry_run=true only reports what
+// would change
+func inventoryImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInventorySize))
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.TooLarge, fmt.Sprintf("Inventory exceeds %d MiB", maxInventorySize>>20))
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	format := inventoryFormat(r.URL.Query().Get("format"), r.Header.Get("Content-Type"), "")
+	hosts, bad, err := parseInventory(data, format)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	report, err := importInventory(r, hosts, bad, dryRun)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.Internal)
+		return
+	}
+	requestLogger(r).Info("Inventory imported", "dry_run", dryRun, "created", report.Created, "updated", report.Updated, "unchanged", report.Unchanged, "failed", report.Failed)
+	httpapi.JSON(w, report)
+}
+
+// runInventoryCommand implements "gossh inventory import", which sends a
+// file to a running server's /api/inventory/import with the API key in
+// GOSSH_API_KEY, prints what became of each row and exits 1 if any failed
+func runInventoryCommand(args []string) {
+	fs := flag.NewFlagSet("inventory import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would change without changing anything")
+	format := fs.String("format", "", "csv or yaml; by default taken from the file name")
+	server := fs.String("url", defaultServerURL(), "URL of the gossh server")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gossh inventory import [-dry-run] [-format csv|yaml] [-url URL] <file>")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "import" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	file := fs.Arg(0)
+	key := os.Getenv("GOSSH_API_KEY")
+	if key == "" {
+		fmt.Fprintln(os.Stderr, "gossh inventory import: set GOSSH_API_KEY to a key with the profiles scope")
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gossh inventory import: %v\n", err)
+		os.Exit(1)
+	}
+	url := fmt.Sprintf("%s/api/inventory/import?format=%s&dry_run=%t", strings.TrimRight(*server, "/"), inventoryFormat(*format, "", file), *dryRun)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gossh inventory import: %v\n", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gossh inventory import: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body httpapi.Envelope
+		json.NewDecoder(resp.Body).Decode(&body)
+		fmt.Fprintf(os.Stderr, "gossh inventory import: %s: %s\n", resp.Status, body.Error.Message)
+		os.Exit(1)
+	}
+	var report inventoryReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "gossh inventory import: invalid response: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, row := range report.Rows {
+		detail := row.Profile
+		if row.Error != "" {
+			detail = row.Error
+		}
+		fmt.Printf("%s:%d\t%s\t%s\t%s\n", file, row.Line, row.Action, row.Name, detail)
+	}
+	prefix := ""
+	if report.DryRun {
+		prefix = "dry run: "
+	}
+	fmt.Printf("%s%d created, %d updated, %d unchanged, %d failed\n", prefix, report.Created, report.Updated, report.Unchanged, report.Failed)
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// defaultServerURL is where this configuration's server listens
+func defaultServerURL() string {
+	cfg := currentConfig()
+	scheme := "http"
+	if cfg.Server.TLS.Enabled() {
+		scheme = "https"
+	}
+	addr := cfg.Server.Listen
+	if addr == "" || strings.HasPrefix(addr, "unix:") {
+		addr = fmt.Sprintf(":%d", cfg.Server.Port)
+	}
+	if strings.HasPrefix(addr, ":") || strings.HasPrefix(addr, "0.0.0.0:") {
+		addr = "localhost:" + addr[strings.LastIndex(addr, ":")+1:]
+	}
+	return scheme + "://" + addr
+}
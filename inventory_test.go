@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// freshProfiles gives the test a profile store of its own, kept in memory
+func freshProfiles(t *testing.T) {
+	old := profiles
+	profiles = &profileStore{profiles: make(map[string]*Profile)}
+	t.Cleanup(func() { profiles = old })
+}
+
+// rowResult is a row of an inventory report, by what a test checks
+type rowResult struct {
+	line   int
+	name   string
+	action string
+	// error is part of the row's error, "" when it has none
+	error string
+}
+
+func checkRows(t *testing.T, got []inventoryResult, want []rowResult) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("rows %+v, want %+v", got, want)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Line != w.line || g.Name != w.name || g.Action != w.action ||
+			(w.error == "") != (g.Error == "") || !strings.Contains(g.Error, w.error) {
+			t.Errorf("row %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestParseInventoryCSV(t *testing.T) {
+	data := "Name, address,port,tags\n" +
+		"web1,10.0.0.1,22,web; prod\n" +
+		"web2,10.0.0.2,twenty-two,web\n" +
+		"web3,10.0.\"0.3,,\n" +
+		"\"db\n1\",10.0.0.4,,\n" +
+		"web4,10.0.0.5\n"
+	hosts, bad, err := parseInventory([]byte(data), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, bad, []rowResult{
+		{3, "web2", inventoryFailed, `Invalid port "twenty-two"`},
+		{4, "", inventoryFailed, "bare"},
+	})
+	if len(hosts) != 3 {
+		t.Fatalf("hosts %+v, want web1, db and web4", hosts)
+	}
+	if h := hosts[0]; h.Name != "web1" || h.Port != 22 || strings.Join(h.Tags, ",") != "web,prod" || h.line != 2 {
+		t.Errorf("web1 = %+v", h)
+	}
+	// A quoted name over two lines is on the line it starts on, and pushes
+	// the next row down
+	if h := hosts[1]; h.Name != "db\n1" || h.line != 5 {
+		t.Errorf("db = %+v, want line 5", h)
+	}
+	if h := hosts[2]; h.Name != "web4" || h.Address != "10.0.0.5" || h.line != 7 {
+		t.Errorf("web4 = %+v, want line 7", h)
+	}
+}
+
+func TestParseInventoryYAML(t *testing.T) {
+	data := `hosts:
+  - name: web1
+    address: 10.0.0.1
+    tags: [web, prod]
+  - name: web2
+    address: 10.0.0.2
+    port: twenty-two
+  - name: web3
+    address: 10.0.0.3
+    password: hunter2
+  - just a string
+  - name: web4
+    address: 10.0.0.4
+`
+	hosts, bad, err := parseInventory([]byte(data), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, bad, []rowResult{
+		{5, "", inventoryFailed, "twenty-two"},
+		{8, "web3", inventoryFailed, `Unknown field "password"`},
+		{11, "", inventoryFailed, "cannot unmarshal"},
+	})
+	if len(hosts) != 2 || hosts[0].Name != "web1" || hosts[0].line != 2 || hosts[1].Name != "web4" || hosts[1].line != 12 {
+		t.Errorf("hosts %+v, want web1 on line 2 and web4 on line 12", hosts)
+	}
+
+	// A plain list works as well as one under hosts
+	hosts, bad, err = parseInventory([]byte("- name: web1\n  address: 10.0.0.1\n"), "yaml")
+	if err != nil || len(bad) != 0 || len(hosts) != 1 || hosts[0].line != 1 {
+		t.Errorf("plain list: %+v, %+v, %v", hosts, bad, err)
+	}
+}
+
+func TestParseInventoryErrors(t *testing.T) {
+	tests := []struct {
+		format, data, want string
+	}{
+		{"csv", "name,address,password\n", `Unknown CSV column "password"`},
+		{"csv", "name,port\n", "no address column"},
+		{"csv", "", "Invalid CSV header"},
+		{"yaml", "hosts: web1\n", "must be a list of hosts"},
+		{"yaml", "web1: {address: 10.0.0.1}\n", "must be a list of hosts"},
+		{"yaml", "- [\n", "Invalid YAML"},
+		{"json", "[]", `Unknown inventory format "json"`},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseInventory([]byte(tt.data), tt.format); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s %q: err = %v, want %q", tt.format, tt.data, err, tt.want)
+		}
+	}
+}
+
+func TestInventoryImportReportsEachRow(t *testing.T) {
+	useConfig(t, "")
+	freshProfiles(t)
+	srv := startTestGateway(t)
+	importCSV := func(query, data string) inventoryReport {
+		t.Helper()
+		r, err := http.NewRequest("POST", srv.URL+"/api/inventory/import?format=csv"+query, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, body := callAPI(t, r)
+		var report inventoryReport
+		if err := json.Unmarshal(body, &report); status != http.StatusOK || err != nil {
+			t.Fatalf("status %d: %s", status, body)
+		}
+		return report
+	}
+
+	data := "name,address,port,user,credentials\n" +
+		"web1,10.0.0.1,22,deploy,\n" +
+		",10.0.0.2,,,\n" +
+		"web3,10.0.0.3:22,,,\n" +
+		"web4,10.0.0.4,70000,,\n" +
+		"web5,10.0.0.5,,,plain:secret\n" +
+		"web1,10.0.0.6,,,\n" +
+		"web7,10.0.0.7,seven,,\n" +
+		"web8,10.0.0.8,,,\n"
+	want := []rowResult{
+		{2, "web1", inventoryCreated, ""},
+		{3, "", inventoryFailed, "Missing name"},
+		{4, "web3", inventoryFailed, "must not include a port"},
+		{5, "web4", inventoryFailed, "Invalid port 70000"},
+		{6, "web5", inventoryFailed, "Credentials must name a source"},
+		{7, "web1", inventoryFailed, "Duplicate name; first seen on line 2"},
+		{8, "web7", inventoryFailed, `Invalid port "seven"`},
+		{9, "web8", inventoryCreated, ""},
+	}
+
+	report := importCSV("&dry_run=true", data)
+	checkRows(t, report.Rows, want)
+	if !report.DryRun || report.Created != 2 || report.Failed != 6 {
+		t.Errorf("dry run report %+v", report)
+	}
+	if n := len(profiles.profiles); n != 0 {
+		t.Fatalf("a dry run created %d profiles", n)
+	}
+
+	report = importCSV("", data)
+	checkRows(t, report.Rows, want)
+	if report.Created != 2 || report.Failed != 6 {
+		t.Errorf("report %+v", report)
+	}
+	if _, ok := profiles.named("web8"); !ok {
+		t.Error("a row after the failed ones wasn't imported")
+	}
+
+	// Importing again changes only what differs
+	report = importCSV("", "name,address,user\nweb1,10.0.0.1,root\nweb8,10.0.0.8,\n")
+	checkRows(t, report.Rows, []rowResult{
+		{2, "web1", inventoryUpdated, ""},
+		{3, "web8", inventoryUnchanged, ""},
+	})
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+const (
+	defaultJobTimeout       = time.Hour
+	defaultJobMaxTimeout    = 24 * time.Hour
+	defaultJobMaxOutput     = 16 << 20
+	defaultJobMaxConcurrent = 4
+	defaultJobMaxQueued     = 100
+	defaultJobRetention     = 24 * time.Hour
+	// defaultJobReadLimit and maxJobReadLimit bound the output returned by
+	// one status request, per stream
+	defaultJobReadLimit = 64 << 10
+	maxJobReadLimit     = 1 << 20
+)
+
+// JobsConfig controls commands run in the background through /api/jobs
+type JobsConfig struct {
+	// Dir keeps a file per job so results outlive the process. Empty keeps
+	// jobs in memory only. Changes require a restart.
+	Dir string `yaml:"dir"`
+	// Timeout applies when a request sets none; MaxTimeout caps the ones
+	// requests set
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+	// MaxOutput is how many bytes of stdout, and of stderr, are kept
+	MaxOutput int `yaml:"max_output"`
+	// MaxConcurrent jobs run at once; further ones wait in a queue of up to
+	// MaxQueued
+	MaxConcurrent int `yaml:"max_concurrent"`
+	MaxQueued     int `yaml:"max_queued"`
+	// Retention is how long finished jobs can be looked up
+	Retention time.Duration `yaml:"retention"`
+}
+
+func (c *JobsConfig) applyDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultJobTimeout
+	}
+	if c.MaxTimeout <= 0 {
+		c.MaxTimeout = defaultJobMaxTimeout
+	}
+	if c.MaxOutput <= 0 {
+		c.MaxOutput = defaultJobMaxOutput
+	}
+	if c.MaxConcurrent <= 0 {
+		c.MaxConcurrent = defaultJobMaxConcurrent
+	}
+	if c.MaxQueued <= 0 {
+		c.MaxQueued = defaultJobMaxQueued
+	}
+	if c.Retention <= 0 {
+		c.Retention = defaultJobRetention
+	}
+}
+
+func validateJobsConfig(cfg JobsConfig) error {
+	if cfg.Timeout > cfg.MaxTimeout {
+		return fmt.Errorf("jobs.timeout %s exceeds jobs.max_timeout %s", cfg.Timeout, cfg.MaxTimeout)
+	}
+	return nil
+}
+
+// Job states. Queued and running jobs are live; the others are final.
+const (
+	jobQueued      = "queued"
+	jobRunning     = "running"
+	jobCompleted   = "completed" // the command exited, whatever its status
+	jobTimedOut    = "timed_out"
+	jobCancelled   = "cancelled"
+	jobFailed      = "failed" // the command could not be run
+	jobInterrupted = "interrupted"
+)
+
+// Causes of a running job's end other than the command exiting
+var (
+	errJobCancelled   = errors.New("cancelled")
+	errJobInterrupted = errors.New("interrupted by a server restart")
+)
+
+// validJobID keeps job IDs, which name files in jobs.dir, to what newJobID
+// returns
+var validJobID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// jobRecord describes a job. It is what is stored in jobs.dir and, with the
+// output, what the API returns.
+type jobRecord struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Owner   string `json:"owner,omitempty"`
+	Host    string `json:"host"`
+	SSHUser string `json:"ssh_user"`
+	Command string `json:"command"`
+	Timeout string `json:"timeout"`
+
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	ExitCode  *int   `json:"exit_code,omitempty"`
+	Signal    string `json:"signal,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	// Stdout and Stderr are stored once the job has finished
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+func (j *jobRecord) live() bool {
+	return j.Status == jobQueued || j.Status == jobRunning
+}
+
+// job is a job started by this process
+type job struct {
+	record jobRecord // guarded by jobRegistry.mu
+
+	req     *execRequest
+	target  *transferTarget
+	timeout time.Duration
+	meta    requestMeta
+
+	stdout, stderr *cappedBuffer
+	ctx            context.Context
+	cancel         context.CancelCauseFunc
+}
+
+// jobRegistry runs jobs and keeps them until their retention ends. Jobs of
+// earlier processes are only in the store.
+type jobRegistry struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	queue   []*job
+	running int
+	// dir is jobs.dir as of startup
+	dir string
+	// idle is closed and replaced whenever the last running job ends
+	idle chan struct{}
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*job), idle: make(chan struct{})}
+
+// open uses dir as the store. Jobs that were live when a previous process
+// stopped are marked interrupted, and expired ones removed.
+func (reg *jobRegistry) open(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("job store %s: %v", dir, err)
+	}
+	reg.dir = dir
+	records, err := reg.loadAll()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	interrupted := 0
+	for _, rec := range records {
+		if !rec.live() {
+			continue
+		}
+		rec.Status = jobInterrupted
+		rec.Error = errJobInterrupted.Error()
+		rec.Finished = &now
+		if err := reg.save(rec); err != nil {
+			return err
+		}
+		interrupted++
+	}
+	if interrupted > 0 {
+		slog.Warn("Marked jobs of a previous process as interrupted", "jobs", interrupted)
+	}
+	reg.prune()
+	return nil
+}
+
+// path is where job id is stored
+func (reg *jobRegistry) path(id string) string {
+	return filepath.Join(reg.dir, id+".json")
+}
+
+// save writes rec to the store, replacing the previous version atomically
+func (reg *jobRegistry) save(rec *jobRecord) error {
+	if reg.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(reg.dir, ".job-*")
+	if err != nil {
+		return fmt.Errorf("Failed to store job: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), reg.path(rec.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to store job: %v", err)
+	}
+	return nil
+}
+
+// load reads job id from the store
+func (reg *jobRegistry) load(id string) (*jobRecord, error) {
+	data, err := os.ReadFile(reg.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var rec jobRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("job %s: %v", id, err)
+	}
+	return &rec, nil
+}
+
+// loadAll reads every job in the store, skipping unreadable ones
+func (reg *jobRegistry) loadAll() ([]*jobRecord, error) {
+	entries, err := os.ReadDir(reg.dir)
+	if err != nil {
+		return nil, fmt.Errorf("job store %s: %v", reg.dir, err)
+	}
+	var records []*jobRecord
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validJobID.MatchString(id) {
+			continue
+		}
+		rec, err := reg.load(id)
+		if err != nil {
+			slog.Warn("Skipping unreadable job", "job", id, "err", err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// submit queues j and starts it if a worker is free
+func (reg *jobRegistry) submit(j *job) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if len(reg.queue) >= currentConfig().Jobs.MaxQueued {
+		return httpapi.Errorf(httpapi.RateLimited, "Too many jobs are waiting to run; try again later")
+	}
+	if err := reg.save(&j.record); err != nil {
+		return err
+	}
+	reg.jobs[j.record.ID] = j
+	reg.queue = append(reg.queue, j)
+	reg.schedule()
+	return nil
+}
+
+// schedule starts queued jobs while there are free workers. The caller
+// holds mu.
+func (reg *jobRegistry) schedule() {
+	limit := currentConfig().Jobs.MaxConcurrent
+	for len(reg.queue) > 0 && reg.running < limit {
+		j := reg.queue[0]
+		reg.queue = reg.queue[1:]
+		now := time.Now()
+		j.record.Status = jobRunning
+		j.record.Started = &now
+		if err := reg.save(&j.record); err != nil {
+			j.meta.Log.Warn("Failed to store job", "job", j.record.ID, "err", err)
+		}
+		reg.running++
+		go reg.run(j)
+	}
+}
+
+// run runs a job's command and records how it ended
+func (reg *jobRegistry) run(j *job) {
+	var result execResponse
+	sshConn, release, err := j.target.connect(j.ctx, j.meta)
+	if err == nil {
+		j.meta.Log.Info("Job started", "job", j.record.ID, "host", j.target.Host, "ssh_user", j.target.User)
+		result, err = runCommand(j.ctx, j.meta, sshConn, j.req.Command, j.req.Env, j.timeout, j.stdout, j.stderr)
+		release()
+	} else if cause := context.Cause(j.ctx); cause != nil {
+		err = cause
+	}
+	ev := execAuditEvent(j.meta, j.target, j.req.Command, result, j.timeout, err)
+	ev.Target = j.record.ID
+	audit.Emit(ev)
+
+	reg.mu.Lock()
+	rec := &j.record
+	now := time.Now()
+	rec.Finished = &now
+	rec.SSHUser = j.target.User
+	switch {
+	case errors.Is(err, errJobCancelled):
+		rec.Status = jobCancelled
+	case errors.Is(err, errJobInterrupted):
+		rec.Status = jobInterrupted
+	case err != nil:
+		rec.Status = jobFailed
+	case result.TimedOut:
+		rec.Status = jobTimedOut
+	default:
+		rec.Status = jobCompleted
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	// A cancelled or interrupted command that had started was killed
+	if err == nil || (rec.Status != jobFailed && result.Duration > 0) {
+		rec.ExitCode = &result.ExitCode
+		rec.Signal = result.Signal
+	}
+	rec.Stdout, rec.Stderr = j.stdout.String(), j.stderr.String()
+	rec.Truncated = j.stdout.isTruncated() || j.stderr.isTruncated()
+	if err := reg.save(rec); err != nil {
+		j.meta.Log.Warn("Failed to store job", "job", rec.ID, "err", err)
+	}
+	reg.running--
+	if reg.running == 0 {
+		close(reg.idle)
+		reg.idle = make(chan struct{})
+	}
+	reg.schedule()
+	reg.mu.Unlock()
+
+	j.cancel(nil)
+	j.meta.Log.Info("Job finished", "job", rec.ID, "status", rec.Status, "exit_code", result.ExitCode)
+}
+
+// lookup returns a copy of job id as owner sees it. ok is false when there
+// is no such job, or it belongs to someone else.
+func (reg *jobRegistry) lookup(id, owner string) (rec jobRecord, j *job, ok bool) {
+	if !validJobID.MatchString(id) {
+		return rec, nil, false
+	}
+	reg.mu.Lock()
+	j, ok = reg.jobs[id]
+	if ok {
+		rec = j.record
+	}
+	reg.mu.Unlock()
+	if !ok {
+		if reg.dir == "" {
+			return rec, nil, false
+		}
+		stored, err := reg.load(id)
+		if err != nil {
+			return rec, nil, false
+		}
+		rec, j = *stored, nil
+	}
+	if rec.Owner != owner {
+		return rec, nil, false
+	}
+	return rec, j, true
+}
+
+// stop ends a live job with cause: a queued job right away, a running one
+// once its command has been killed
+func (reg *jobRegistry) stop(j *job, cause error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	switch j.record.Status {
+	case jobQueued:
+		for i, q := range reg.queue {
+			if q == j {
+				reg.queue = append(reg.queue[:i], reg.queue[i+1:]...)
+				break
+			}
+		}
+		now := time.Now()
+		j.record.Status = jobCancelled
+		if errors.Is(cause, errJobInterrupted) {
+			j.record.Status = jobInterrupted
+		}
+		j.record.Error = cause.Error()
+		j.record.Finished = &now
+		if err := reg.save(&j.record); err != nil {
+			j.meta.Log.Warn("Failed to store job", "job", j.record.ID, "err", err)
+		}
+		j.cancel(cause)
+	case jobRunning:
+		j.cancel(cause)
+	}
+}
+
+// interrupt stops every live job for shutdown and waits up to timeout for
+// the running ones to record their end
+func (reg *jobRegistry) interrupt(timeout time.Duration) {
+	reg.mu.Lock()
+	var live []*job
+	for _, j := range reg.jobs {
+		if j.record.live() {
+			live = append(live, j)
+		}
+	}
+	reg.mu.Unlock()
+	if len(live) == 0 {
+		return
+	}
+	slog.Info("Interrupting jobs", "jobs", len(live))
+	for _, j := range live {
+		reg.stop(j, errJobInterrupted)
+	}
+
+	reg.mu.Lock()
+	running, idle := reg.running, reg.idle
+	reg.mu.Unlock()
+	if running == 0 {
+		return
+	}
+	select {
+	case <-idle:
+	case <-time.After(timeout):
+		slog.Warn("Jobs did not stop in time", "jobs", running)
+	}
+}
+
+// prune forgets finished jobs older than jobs.retention
+func (reg *jobRegistry) prune() {
+	cutoff := time.Now().Add(-currentConfig().Jobs.Retention)
+	expired := func(rec *jobRecord) bool {
+		return !rec.live() && rec.Finished != nil && rec.Finished.Before(cutoff)
+	}
+
+	reg.mu.Lock()
+	for id, j := range reg.jobs {
+		if expired(&j.record) {
+			delete(reg.jobs, id)
+		}
+	}
+	reg.mu.Unlock()
+
+	if reg.dir == "" {
+		return
+	}
+	records, err := reg.loadAll()
+	if err != nil {
+		slog.Warn("Failed to prune jobs", "err", err)
+		return
+	}
+	for _, rec := range records {
+		if expired(rec) {
+			os.Remove(reg.path(rec.ID))
+		}
+	}
+}
+
+// pruneJobs forgets expired jobs every minute
+func pruneJobs() {
+	for range time.Tick(time.Minute) {
+		jobs.prune()
+	}
+}
+
+// jobOutput is a page of a job's stdout or stderr
+type jobOutput struct {
+	Data string `json:"data"`
+	// Offset is where Data starts and Next where the following page does;
+	// Size is the output so far
+	Offset int `json:"offset"`
+	Next   int `json:"next"`
+	Size   int `json:"size"`
+}
+
+// jobView is a job as the API returns it
+type jobView struct {
+	jobRecord
+	Stdout jobOutput `json:"stdout"`
+	Stderr jobOutput `json:"stderr"`
+}
+
+// newJobView pages the output of rec, which is read from j while it runs
+func newJobView(rec jobRecord, j *job, stdoutOffset, stderrOffset, limit int) jobView {
+	page := func(buf *cappedBuffer, stored string, offset int) jobOutput {
+		var data []byte
+		var size int
+		if rec.live() && buf != nil {
+			data, size = buf.readAt(offset, limit)
+		} else {
+			offset = min(max(offset, 0), len(stored))
+			size = len(stored)
+			data = []byte(stored[offset:min(offset+limit, size)])
+		}
+		offset = min(max(offset, 0), size)
+		return jobOutput{Data: string(data), Offset: offset, Next: offset + len(data), Size: size}
+	}
+	var stdout, stderr *cappedBuffer
+	if j != nil {
+		stdout, stderr = j.stdout, j.stderr
+	}
+	view := jobView{
+		jobRecord: rec,
+		Stdout:    page(stdout, rec.Stdout, stdoutOffset),
+		Stderr:    page(stderr, rec.Stderr, stderrOffset),
+	}
+	view.jobRecord.Stdout, view.jobRecord.Stderr = "", ""
+	return view
+}
+
+// jobsHandler creates jobs: POST /api/jobs takes the body of /api/exec and
+// returns the job without waiting for the command
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+
+	cfg := currentConfig().Jobs
+	req, timeout, target, err := decodeExecRequest(w, r, cfg.Timeout, cfg.MaxTimeout)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	if err := authorize(r, target.Host, target.User, opExec); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	j := &job{
+		record: jobRecord{
+			ID:      newJobID(),
+			Status:  jobQueued,
+			Owner:   meta.User,
+			Host:    target.Host,
+			SSHUser: target.User,
+			Command: req.Command,
+			Timeout: timeout.String(),
+			Created: time.Now(),
+		},
+		req:     req,
+		target:  target,
+		timeout: timeout,
+		meta:    meta,
+		stdout:  &cappedBuffer{max: cfg.MaxOutput},
+		stderr:  &cappedBuffer{max: cfg.MaxOutput},
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if err := jobs.submit(j); err != nil {
+		cancel(nil)
+		responder.Error(w, r, err, httpapi.Internal)
+		return
+	}
+	meta.Log.Info("Job created", "job", j.record.ID, "host", target.Host, "ssh_user", target.User)
+	rec, _, _ := jobs.lookup(j.record.ID, meta.User)
+	httpapi.JSONStatus(w, http.StatusAccepted, newJobView(rec, j, 0, 0, 0))
+}
+
+// jobHandler reports a job on GET /api/jobs/{id}, with output from the
+// stdout_offset and stderr_offset parameters on, and cancels it on DELETE
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	owner := requestIdentity(r).User
+	rec, j, ok := jobs.lookup(id, owner)
+	if !ok {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Job not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		offset := func(name string) (int, bool) {
+			v := query.Get(name)
+			if v == "" {
+				return 0, true
+			}
+			n, err := strconv.Atoi(v)
+			return n, err == nil && n >= 0
+		}
+		stdoutOffset, ok1 := offset("stdout_offset")
+		stderrOffset, ok2 := offset("stderr_offset")
+		limit, ok3 := offset("limit")
+		if !ok1 || !ok2 || !ok3 {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Offsets and limit must be non-negative integers")
+			return
+		}
+		if limit == 0 {
+			limit = defaultJobReadLimit
+		}
+		httpapi.JSON(w, newJobView(rec, j, stdoutOffset, stderrOffset, min(limit, maxJobReadLimit)))
+
+	case "DELETE":
+		if j == nil || !rec.live() {
+			responder.ErrorCode(w, r, httpapi.Conflict, "Job has already finished")
+			return
+		}
+		jobs.stop(j, errJobCancelled)
+		requestLogger(r).Info("Job cancelled", "job", id, "user", owner)
+		rec, _, _ = jobs.lookup(id, owner)
+		httpapi.JSONStatus(w, http.StatusAccepted, newJobView(rec, j, 0, 0, 0))
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
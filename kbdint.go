@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/sshbridge"
+)
+
+// authPromptTimeout bounds the wait for the user to answer a prompt of the
+// server, such as a one-time code or a new password
+var authPromptTimeout = 2 * time.Minute
+
+// passwordPrompt is the server asking for the login password, which the
+// password the user gave answers
+var passwordPrompt = regexp.MustCompile(`(?i)^\s*(\S+'s\s+)?password:\s*$`)
+
+// passwordChange tells a forced password change, as PAM runs it for an
+// expired password, from other prompts
+var passwordChange = regexp.MustCompile(`(?i)new password|password (has )?expired|change your password`)
+
+// promptlessConn is implemented by connections whose client can't answer
+// keyboard-interactive prompts
+type promptlessConn interface {
+	promptless()
+}
+
+// keyboardInteractive answers the server's password prompt with password
+// and passes any other prompts to ask, when there is one
+func (a *authRecorder) keyboardInteractive(password string, ask ssh.KeyboardInteractiveChallenge) ssh.AuthMethod {
+	passwordSent := false
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		a.method = "keyboard-interactive"
+		if len(questions) == 1 && !echos[0] && password != "" && !passwordSent && passwordPrompt.MatchString(questions[0]) {
+			passwordSent = true
+			return []string{password}, nil
+		}
+		if len(questions) == 0 && name == "" && instruction == "" {
+			return nil, nil
+		}
+		if ask == nil {
+			return nil, errors.New("the server asked for more than a password")
+		}
+		a.interactive = true
+		return ask(name, instruction, questions, echos)
+	})
+}
+
+// promptReader reads the page's messages, first for keyboard-interactive
+// prompts and then for the session. A read that a prompt stopped waiting
+// for is left outstanding, and its message goes to whoever reads next
+// rather than being lost.
+type promptReader struct {
+	sshbridge.Conn
+	mu      sync.Mutex
+	pending chan readResult
+}
+
+type readResult struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// receive returns the next message, or false once timeout fires first
+func (r *promptReader) receive(timeout <-chan time.Time) (readResult, bool) {
+	r.mu.Lock()
+	if r.pending == nil {
+		pending := make(chan readResult, 1)
+		r.pending = pending
+		go func() {
+			var res readResult
+			res.messageType, res.data, res.err = r.Conn.ReadMessage()
+			pending <- res
+		}()
+	}
+	pending := r.pending
+	r.mu.Unlock()
+	select {
+	case res := <-pending:
+		r.mu.Lock()
+		r.pending = nil
+		r.mu.Unlock()
+		return res, true
+	case <-timeout:
+		return readResult{}, false
+	}
+}
+
+func (r *promptReader) ReadMessage() (int, []byte, error) {
+	r.mu.Lock()
+	pending := r.pending
+	r.mu.Unlock()
+	if pending == nil {
+		return r.Conn.ReadMessage()
+	}
+	res, _ := r.receive(nil)
+	return res.messageType, res.data, res.err
+}
+
+// terminalAuthPrompter passes keyboard-interactive rounds to the page of a
+// terminal session, which hasn't started reading the connection yet
+type terminalAuthPrompter struct {
+	out  *wsWriter
+	conn *promptReader
+}
+
+// ask sends a round to the page and waits for its auth_response. Anything
+// else the page sends meanwhile is dropped.
+func (p *terminalAuthPrompter) ask(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	msg := sshbridge.AuthPromptMessage{Type: "auth_prompt", Name: name, Instruction: instruction, Prompts: []sshbridge.AuthPrompt{}}
+	for i, q := range questions {
+		msg.Prompts = append(msg.Prompts, sshbridge.AuthPrompt{Text: q, Echo: echos[i]})
+	}
+	msg.PasswordChange = passwordChange.MatchString(name + "\n" + instruction + "\n" + strings.Join(questions, "\n"))
+	if err := p.out.WriteJSON(msg); err != nil {
+		return nil, err
+	}
+	if len(questions) == 0 {
+		return nil, nil
+	}
+
+	timeout := time.After(authPromptTimeout)
+	for {
+		res, ok := p.conn.receive(timeout)
+		if !ok {
+			return nil, fmt.Errorf("no answer to the server's prompt after %s", authPromptTimeout)
+		}
+		if res.err != nil {
+			return nil, fmt.Errorf("no answer to the server's prompt: %v", res.err)
+		}
+		reply, err := sshbridge.DecodeClientMessage(res.messageType, res.data)
+		if err != nil || reply.Type != "auth_response" {
+			continue
+		}
+		if len(reply.Answers) != len(questions) {
+			return nil, fmt.Errorf("%d answers to %d prompts", len(reply.Answers), len(questions))
+		}
+		return reply.Answers, nil
+	}
+}
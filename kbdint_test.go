@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/sshbridge"
+	"gossh/internal/sshtest"
+)
+
+// startPasswordChangeServer starts a server whose password for sshtest.User
+// has expired, which runs the conversation PAM has sshd run over
+// keyboard-interactive: the password, the current password again, and a
+// new one twice until it is accepted. The new password is sent on changed.
+func startPasswordChangeServer(t *testing.T, changed chan<- string) *sshtest.Server {
+	return sshtest.Start(t, func(c *ssh.ServerConfig) {
+		c.PasswordCallback = nil
+		c.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			ask := func(prompt string) (string, error) {
+				answers, err := client("", "", []string{prompt}, []bool{false})
+				if err != nil {
+					return "", err
+				}
+				if len(answers) != 1 {
+					return "", errors.New("wrong number of answers")
+				}
+				return answers[0], nil
+			}
+			tell := func(text string) error {
+				_, err := client("", text, nil, nil)
+				return err
+			}
+			if a, err := ask("Password: "); err != nil || a != sshtest.Password {
+				return nil, errors.New("wrong password")
+			}
+			if err := tell("You are required to change your password immediately (password expired)"); err != nil {
+				return nil, err
+			}
+			if a, err := ask("(current) UNIX password: "); err != nil || a != sshtest.Password {
+				return nil, errors.New("wrong current password")
+			}
+			for range 3 {
+				first, err := ask("New password: ")
+				if err != nil {
+					return nil, err
+				}
+				second, err := ask("Retype new password: ")
+				if err != nil {
+					return nil, err
+				}
+				switch {
+				case first != second:
+					err = tell("Sorry, passwords do not match.")
+				case len(first) < 8:
+					err = tell("BAD PASSWORD: The password is shorter than 8 characters")
+				default:
+					changed <- first
+					return nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, errors.New("authentication token manipulation error")
+		}
+	})
+}
+
+func TestPasswordChangeAtLogin(t *testing.T) {
+	useConfig(t, "")
+	changed := make(chan string, 1)
+	srv := startPasswordChangeServer(t, changed)
+
+	conn := newFakeConn()
+	conn.notify = make(chan fakeMessage, 16)
+	input := &promptReader{Conn: conn}
+	prompter := &terminalAuthPrompter{out: newTerminalWriter(conn), conn: input}
+
+	// The user answers the prompts the page shows, getting the new
+	// password wrong twice
+	answers := map[string][]string{
+		"(current) UNIX password: ": {sshtest.Password},
+		"New password: ":            {"correct horse", "short", "correct horse battery"},
+		"Retype new password: ":     {"correct hose", "short", "correct horse battery"},
+	}
+	var shown []sshbridge.AuthPromptMessage
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range conn.notify {
+			var msg sshbridge.AuthPromptMessage
+			if json.Unmarshal(m.data, &msg) != nil || msg.Type != "auth_prompt" {
+				continue
+			}
+			shown = append(shown, msg)
+			if len(msg.Prompts) == 0 {
+				continue
+			}
+			text := msg.Prompts[0].Text
+			if len(answers[text]) == 0 {
+				t.Errorf("unexpected prompt %q", text)
+				conn.Close()
+				return
+			}
+			reply, _ := json.Marshal(sshbridge.ClientMessage{Type: "auth_response", Answers: answers[text][:1]})
+			answers[text] = answers[text][1:]
+			conn.send(websocket.TextMessage, reply)
+		}
+	}()
+
+	clientConfig, auth, err := newSSHClientConfig(sshtest.User, sshtest.Password, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.Auth = append(clientConfig.Auth, auth.keyboardInteractive(sshtest.Password, prompter.ask))
+	client, err := ssh.Dial("tcp", srv.Addr, clientConfig)
+	if err != nil {
+		t.Fatalf("login with a password change failed: %v", err)
+	}
+	client.Close()
+	close(conn.notify)
+	<-done
+
+	if got := <-changed; got != "correct horse battery" {
+		t.Errorf("password changed to %q", got)
+	}
+	var texts []string
+	for _, msg := range shown {
+		if len(msg.Prompts) > 0 {
+			if msg.Prompts[0].Echo {
+				t.Errorf("prompt %q is not masked", msg.Prompts[0].Text)
+			}
+			if strings.HasPrefix(msg.Prompts[0].Text, "New") && !msg.PasswordChange {
+				t.Errorf("prompt %q is not flagged as a password change", msg.Prompts[0].Text)
+			}
+			continue
+		}
+		texts = append(texts, msg.Instruction)
+	}
+	want := []string{
+		"You are required to change your password immediately (password expired)",
+		"Sorry, passwords do not match.",
+		"BAD PASSWORD: The password is shorter than 8 characters",
+	}
+	if strings.Join(texts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("the page was told %q, want %q", texts, want)
+	}
+}
+
+func TestUnansweredPromptKeepsLaterInput(t *testing.T) {
+	old := authPromptTimeout
+	authPromptTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { authPromptTimeout = old })
+
+	conn := newFakeConn()
+	input := &promptReader{Conn: conn}
+	out := &wsWriter{conn: conn}
+	out.pacer = sshbridge.NewPacer(conn, 0, 0, out.cutOffSlow)
+	prompter := &terminalAuthPrompter{out: out, conn: input}
+	if _, err := prompter.ask("", "", []string{"Verification code: "}, []bool{true}); err == nil {
+		t.Fatal("an unanswered prompt succeeded")
+	}
+
+	// The read the prompt left behind must hand over what comes next
+	conn.send(websocket.TextMessage, []byte(`{"type":"input","data":"ls\r"}`))
+	messageType, data, err := input.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage || !strings.Contains(string(data), "ls") {
+		t.Errorf("read %d %q, %v; want the input sent after the prompt", messageType, data, err)
+	}
+}
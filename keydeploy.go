@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// keyDeployTimeout bounds each command run while installing a key
+const keyDeployTimeout = 30 * time.Second
+
+// keyDeployRequest is the body of POST /api/keys/{id}/deploy. The password
+// or private key only serve to log in this once and are never stored.
+type keyDeployRequest struct {
+	Host       string `json:"host"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"private_key"` // base64
+}
+
+// keyDeployResult is the response of a successful deployment
+type keyDeployResult struct {
+	Success     bool   `json:"success"`
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint"`
+	// AlreadyPresent is set when authorized_keys held the key already
+	AlreadyPresent bool `json:"already_present"`
+	Verified       bool `json:"verified"`
+}
+
+// deployManagedKey installs k's public key in the authorized_keys of a user
+// on a host, the way ssh-copy-id does, then logs in with k to prove it works
+func deployManagedKey(w http.ResponseWriter, r *http.Request, k *ManagedKey) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+	var req keyDeployRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	host, user := resolveHost(req.Host, req.User)
+	if host == "" || user == "" {
+		responder.ErrorCode(w, r, httpapi.MissingParams, "Missing host or user")
+		return
+	}
+	if req.Password == "" && req.PrivateKey == "" {
+		responder.ErrorCode(w, r, httpapi.MissingParams, "Missing password or private_key to log in with")
+		return
+	}
+	var privateKey []byte
+	if req.PrivateKey != "" {
+		var err error
+		if privateKey, err = base64.StdEncoding.DecodeString(req.PrivateKey); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid private key encoding")
+			return
+		}
+		defer clear(privateKey)
+	}
+	if err := authorize(r, host, user, opExec); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "keys.deploy")
+	present, err := installPublicKey(ctx, meta, host, user, req.Password, privateKey, k.PublicKey)
+	if err == nil {
+		err = verifyManagedKey(ctx, meta, host, user, k)
+	}
+	endSpan(span, err)
+	audit.Emit(AuditEvent{
+		Event:    auditAdminAction,
+		Outcome:  outcomeOf(err),
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     hostname(host),
+		SSHUser:  user,
+		Action:   "key_deploy",
+		Target:   k.ID,
+		Error:    errorString(err),
+	})
+	if err != nil {
+		meta.Log.Warn("Failed to deploy managed key", "key", k.ID, "host", hostname(host), "ssh_user", user, "err", err)
+		responder.Error(w, r, err, httpapi.DeployFailed)
+		return
+	}
+	meta.Log.Info("Managed key deployed", "key", k.ID, "host", hostname(host), "ssh_user", user, "already_present", present)
+	httpapi.JSON(w, keyDeployResult{
+		Success:        true,
+		Host:           host,
+		User:           user,
+		Fingerprint:    k.Fingerprint,
+		AlreadyPresent: present,
+		Verified:       true,
+	})
+}
+
+// installPublicKey logs in to host as user with the temporary credentials
+// and adds publicKey to ~/.ssh/authorized_keys unless it is there already,
+// reporting whether it was. The connection is never pooled.
+func installPublicKey(ctx context.Context, meta requestMeta, host, user, password string, privateKey []byte, publicKey string) (bool, error) {
+	clientConfig, auth, err := newSSHClientConfig(user, password, privateKey)
+	if err != nil {
+		return false, httpapi.Errorf(httpapi.BadRequest, "Invalid private key: %v", err)
+	}
+	sshConn, err := dialSSH(ctx, meta, host, clientConfig, auth)
+	if err != nil {
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			return false, err
+		}
+		return false, httpapi.Errorf(httpapi.ConnectFailed, "Failed to log in to %s with the given credentials: %v", hostname(host), err)
+	}
+	defer sshConn.Close()
+
+	run := func(command string) (string, error) {
+		stdout := &cappedBuffer{max: 64 << 10}
+		stderr := &cappedBuffer{max: 64 << 10}
+		result, err := runCommand(ctx, meta, sshConn, command, nil, keyDeployTimeout, stdout, stderr)
+		switch {
+		case err != nil:
+			return "", err
+		case result.TimedOut:
+			return "", fmt.Errorf("timed out after %s", keyDeployTimeout)
+		case result.ExitCode != 0:
+			msg := strings.TrimSpace(result.Stderr)
+			if msg == "" {
+				msg = fmt.Sprintf("exit code %d", result.ExitCode)
+			}
+			return "", fmt.Errorf("%s", msg)
+		}
+		return strings.TrimSpace(result.Stdout), nil
+	}
+
+	if _, err := run(`umask 077 && mkdir -p ~/.ssh && chmod 700 ~/.ssh`); err != nil {
+		return false, httpapi.Errorf(httpapi.DeployFailed, "Failed to create ~/.ssh on %s: %v", hostname(host), err)
+	}
+	// The key is matched by its type and blob, so a different comment
+	// doesn't add it twice
+	fields := strings.Fields(publicKey)
+	blob := strings.Join(fields[:2], " ")
+	added, err := run(fmt.Sprintf(`f=~/.ssh/authorized_keys
+if [ -f "$f" ] && grep -qF %s "$f"; then echo present; exit 0; fi
+if [ -s "$f" ] && [ -n "$(tail -c 1 "$f")" ]; then echo >> "$f" || exit 1; fi
+printf '%%s\n' %s >> "$f" && echo added`, transfer.ShellQuote(blob), transfer.ShellQuote(publicKey)))
+	if err != nil {
+		return false, httpapi.Errorf(httpapi.DeployFailed, "Failed to add the key to ~/.ssh/authorized_keys on %s: %v", hostname(host), err)
+	}
+	if _, err := run(`chmod 600 ~/.ssh/authorized_keys`); err != nil {
+		return false, httpapi.Errorf(httpapi.DeployFailed, "Failed to set the mode of ~/.ssh/authorized_keys on %s: %v", hostname(host), err)
+	}
+	return added == "present", nil
+}
+
+// verifyManagedKey logs in to host as user with k, proving it was installed
+func verifyManagedKey(ctx context.Context, meta requestMeta, host, user string, k *ManagedKey) error {
+	key, err := decryptSecret(k.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt key: %v", err)
+	}
+	defer clear(key)
+	clientConfig, auth, err := newSSHClientConfig(user, "", key)
+	if err != nil {
+		return err
+	}
+	sshConn, err := dialSSH(ctx, meta, host, clientConfig, auth)
+	if err != nil {
+		return httpapi.Errorf(httpapi.DeployFailed, "The key is in ~/.ssh/authorized_keys but %s refused to log in with it: %v", hostname(host), err)
+	}
+	sshConn.Close()
+	return nil
+}
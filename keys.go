@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+
+	"gossh/internal/httpapi"
+)
+
+// managedKeySourcePrefix names a keypair gossh generated for a user, e.g.
+// "key:3f2a…"
+const managedKeySourcePrefix = "key:"
+
+// Managed key types
+const (
+	keyTypeEd25519 = "ed25519"
+	keyTypeRSA     = "rsa"
+	rsaKeyBits     = 4096
+)
+
+// ManagedKeysConfig configures the keypairs gossh generates for users, so
+// they have no personal key to paste
+type ManagedKeysConfig struct {
+	// File keeps the keys across restarts, their private halves encrypted
+	// with security.fernet_key. Empty keeps them in memory only. Changes
+	// require a restart.
+	File string `yaml:"file"`
+	// AllowExport lets owners download their private keys
+	AllowExport bool `yaml:"allow_export"`
+}
+
+// ManagedKey is a keypair generated for Owner, who alone may log in with
+// it. PrivateKey is a Fernet token of the OpenSSH PEM key.
+type ManagedKey struct {
+	ID    string `yaml:"id"`
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"`
+	Owner string `yaml:"owner"`
+	// PublicKey is the authorized_keys line
+	PublicKey   string    `yaml:"public_key"`
+	Fingerprint string    `yaml:"fingerprint"`
+	PrivateKey  string    `yaml:"private_key"`
+	Created     time.Time `yaml:"created"`
+}
+
+// managedKeyView is a managed key as the API returns it, without the
+// private key
+type managedKeyView struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Owner       string    `json:"owner"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"`
+	Created     time.Time `json:"created"`
+	// Source is what connection requests and profiles name it by
+	Source string `json:"source"`
+}
+
+func (k *ManagedKey) view() managedKeyView {
+	return managedKeyView{
+		ID:          k.ID,
+		Name:        k.Name,
+		Type:        k.Type,
+		Owner:       k.Owner,
+		PublicKey:   k.PublicKey,
+		Fingerprint: k.Fingerprint,
+		Created:     k.Created,
+		Source:      managedKeySourcePrefix + k.ID,
+	}
+}
+
+// generateManagedKey creates a keypair of keyType for owner
+func generateManagedKey(keyType, name, owner string) (*ManagedKey, error) {
+	var priv interface{}
+	switch keyType {
+	case keyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate key: %v", err)
+		}
+		priv = key
+	case keyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate key: %v", err)
+		}
+		priv = key
+	default:
+		return nil, httpapi.Errorf(httpapi.BadRequest, "type must be %q or %q", keyTypeEd25519, keyTypeRSA)
+	}
+	// The comment tells the key apart in authorized_keys
+	comment := owner + "@gossh"
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode key: %v", err)
+	}
+	encrypted, err := encryptSecret(string(pem.EncodeToMemory(block)))
+	if err != nil {
+		return nil, err
+	}
+	return &ManagedKey{
+		ID:          newJobID(),
+		Name:        name,
+		Type:        keyType,
+		Owner:       owner,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " " + comment,
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		PrivateKey:  encrypted,
+		Created:     time.Now(),
+	}, nil
+}
+
+// keyStore holds the managed keys, saving every change to
+// managed_keys.file
+type keyStore struct {
+	mu   sync.Mutex
+	keys map[string]*ManagedKey
+	// file is managed_keys.file as of startup
+	file string
+}
+
+var managedKeys = &keyStore{keys: make(map[string]*ManagedKey)}
+
+// open loads the keys kept in file, which need not exist yet
+func (s *keyStore) open(file string) error {
+	if file == "" {
+		return nil
+	}
+	s.file = file
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("key store %s: %v", file, err)
+	}
+	var list []*ManagedKey
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("key store %s: %v", file, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range list {
+		if k.ID == "" {
+			return fmt.Errorf("key store %s: key %q has no id", file, k.Name)
+		}
+		s.keys[k.ID] = k
+	}
+	slog.Info("Loaded managed keys", "file", file, "keys", len(list))
+	return nil
+}
+
+// save writes every key to the file, replacing it atomically. The caller
+// holds mu.
+func (s *keyStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	list := make([]*ManagedKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	data, err := yaml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.file), ".keys-*")
+	if err != nil {
+		return fmt.Errorf("Failed to store keys: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to store keys: %v", err)
+	}
+	return nil
+}
+
+// list returns the keys of owner by name
+func (s *keyStore) list(owner string) []managedKeyView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []managedKeyView{}
+	for _, k := range s.keys {
+		if k.Owner == owner {
+			list = append(list, k.view())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// get returns a copy of key kid
+func (s *keyStore) get(kid string) (ManagedKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[kid]
+	if !ok {
+		return ManagedKey{}, false
+	}
+	return *k, true
+}
+
+// add stores a new key
+func (s *keyStore) add(k *ManagedKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		return err
+	}
+	return nil
+}
+
+// remove deletes key kid. Sessions logged in with it keep running.
+func (s *keyStore) remove(kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.keys[kid]
+	if !ok {
+		return nil
+	}
+	delete(s.keys, kid)
+	if err := s.save(); err != nil {
+		s.keys[kid] = prev
+		return err
+	}
+	return nil
+}
+
+// lookup decrypts key kid for id to log in to host with, auditing the use
+// and any refusal
+func (s *keyStore) lookup(meta requestMeta, id Identity, kid, host, user string) (*vaultCredentials, error) {
+	k, ok := s.get(kid)
+	event := AuditEvent{
+		Event:    auditCredentialUse,
+		ClientIP: meta.ClientIP,
+		User:     id.User,
+		Host:     hostname(host),
+		SSHUser:  user,
+		Action:   "managed_key",
+		Target:   kid,
+	}
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("managed key %s does not exist", kid)
+	case id.User == "" || k.Owner != id.User:
+		err = fmt.Errorf("managed key %s belongs to someone else", kid)
+	}
+	if err != nil {
+		event.Outcome, event.Error = outcomeDenied, err.Error()
+		audit.Emit(event)
+		meta.Log.Warn("Refused managed key", "key", kid, "host", hostname(host), "err", err)
+		return nil, err
+	}
+
+	key, err := decryptSecret(k.PrivateKey)
+	if err != nil {
+		event.Outcome, event.Error = outcomeFailure, err.Error()
+		audit.Emit(event)
+		meta.Log.Error("Failed to decrypt managed key", "key", kid, "err", err)
+		return nil, fmt.Errorf("managed key %s can't be decrypted: %v", kid, err)
+	}
+	event.Outcome = outcomeSuccess
+	audit.Emit(event)
+	meta.Log.Info("Using managed key", "key", kid, "host", hostname(host))
+	return &vaultCredentials{PrivateKey: key}, nil
+}
+
+// managedKeyRequest is the body of POST /api/keys
+type managedKeyRequest struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // ed25519 (the default) or rsa
+}
+
+// keysHandler lists the caller's managed keys on GET /api/keys and
+// generates one on POST, returning its public key
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	owner := requestIdentity(r).User
+	if owner == "" {
+		responder.ErrorCode(w, r, httpapi.Forbidden, "Managed keys are only kept for identified users")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+			"keys":    managedKeys.list(owner),
+		})
+
+	case "POST":
+		var req managedKeyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid JSON body: "+err.Error())
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			responder.ErrorCode(w, r, httpapi.MissingParams, "Missing name")
+			return
+		}
+		if req.Type == "" {
+			req.Type = keyTypeEd25519
+		}
+		k, err := generateManagedKey(req.Type, strings.TrimSpace(req.Name), owner)
+		if err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		if err := managedKeys.add(k); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditProfileChange(r, "key_create", k.ID)
+		requestLogger(r).Info("Managed key created", "key", k.ID, "type", k.Type, "fingerprint", k.Fingerprint)
+		httpapi.JSONStatus(w, http.StatusCreated, k.view())
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// keyHandler returns and deletes /api/keys/{id}, and returns its private
+// key on /api/keys/{id}/export when managed_keys.allow_export is set.
+// POST /api/keys/{id}/deploy installs it on a host. Keys are their
+// owner's; admin keys may also read and delete them.
+func keyHandler(w http.ResponseWriter, r *http.Request) {
+	kid, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/keys/"), "/")
+	k, ok := managedKeys.get(kid)
+	allowed := k.Owner == requestIdentity(r).User
+	if key := apiKeyFromContext(r.Context()); key != nil && key.hasScope(scopeAdmin) && sub == "" {
+		allowed = true
+	}
+	if !ok || !allowed || (sub != "" && sub != "export" && sub != "deploy") {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Key not found")
+		return
+	}
+
+	switch sub {
+	case "export":
+		exportManagedKey(w, r, &k)
+		return
+	case "deploy":
+		deployManagedKey(w, r, &k)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, k.view())
+
+	case "DELETE":
+		if err := managedKeys.remove(k.ID); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		invalidated := profiles.usingSource(managedKeySourcePrefix + k.ID)
+		auditProfileChange(r, "key_delete", k.ID)
+		requestLogger(r).Info("Managed key deleted", "key", k.ID, "fingerprint", k.Fingerprint, "invalidated_profiles", len(invalidated))
+		httpapi.JSON(w, map[string]interface{}{
+			"success":              true,
+			"invalidated_profiles": invalidated,
+		})
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// exportManagedKey sends the owner their private key as a PEM download
+func exportManagedKey(w http.ResponseWriter, r *http.Request, k *ManagedKey) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !currentConfig().ManagedKeys.AllowExport {
+		responder.ErrorCode(w, r, httpapi.Forbidden, "Exporting keys is disabled on this server")
+		return
+	}
+	key, err := decryptSecret(k.PrivateKey)
+	if err != nil {
+		responder.Error(w, r, fmt.Errorf("Failed to decrypt key: %v", err), httpapi.Internal)
+		return
+	}
+	auditProfileChange(r, "key_export", k.ID)
+	requestLogger(r).Info("Managed key exported", "key", k.ID, "fingerprint", k.Fingerprint)
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "gossh_"+k.Type))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(key)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// Listener roles select the endpoints a listener serves
+const (
+	roleAll     = "all"
+	roleUI      = "ui"      // pages, static files and the terminal WebSocket
+	roleAPI     = "api"     // upload, download and key management
+	roleMetrics = "metrics" // health and monitoring endpoints
+)
+
+// ListenerConfig is one entry of server.listeners
+type ListenerConfig struct {
+	// Address is host:port, or unix:/path to serve on a Unix socket
+	Address string    `yaml:"address"`
+	Role    string    `yaml:"role"` // ui, api, metrics or all (default)
+	TLS     TLSConfig `yaml:"tls"`
+}
+
+func (l ListenerConfig) role() string {
+	if l.Role == "" {
+		return roleAll
+	}
+	return l.Role
+}
+
+// serverListeners returns the listeners to open: server.listeners, or a
+// single listener serving everything built from the address, port, listen
+// and tls settings
+func serverListeners(cfg *Config) []ListenerConfig {
+	if len(cfg.Server.Listeners) > 0 {
+		return cfg.Server.Listeners
+	}
+	addr := cfg.Server.Listen
+	if addr == "" {
+		addr = net.JoinHostPort(cfg.Server.Address, strconv.Itoa(cfg.Server.Port))
+	}
+	return []ListenerConfig{{Address: addr, Role: roleAll, TLS: cfg.Server.TLS}}
+}
+
+// listenAddress returns the network and address a listener is opened on
+func listenAddress(l ListenerConfig) (string, string) {
+	if path, ok := strings.CutPrefix(l.Address, unixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", l.Address
+}
+
+// viaUnixSocket reports whether r arrived on a Unix socket listener. Clients
+// are then only known from the reverse proxy's headers.
+func viaUnixSocket(r *http.Request) bool {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr != nil && addr.Network() == "unix"
+}
+
+// validateListenConfig checks the listeners and the socket settings
+func validateListenConfig(cfg *Config) []string {
+	var problems []string
+	if len(cfg.Server.Listeners) > 0 && (cfg.Server.Listen != "" || cfg.Server.TLS.Enabled()) {
+		problems = append(problems, "server.listen and server.tls can't be combined with server.listeners; set address and tls on each listener instead")
+	}
+	if len(cfg.Server.Listeners) == 0 {
+		problems = append(problems, validateTLSConfig("server.tls", cfg.Server.TLS)...)
+	}
+
+	listeners := serverListeners(cfg)
+	for i, l := range listeners {
+		name := "server.listen"
+		if len(cfg.Server.Listeners) > 0 {
+			name = fmt.Sprintf("server.listeners[%d]", i)
+			problems = append(problems, validateTLSConfig(name+".tls", l.TLS)...)
+		}
+		switch l.role() {
+		case roleAll, roleUI, roleAPI, roleMetrics:
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown role %q (use ui, api, metrics or all)", name, l.Role))
+		}
+		network, addr := listenAddress(l)
+		if network == "unix" {
+			if addr == "" {
+				problems = append(problems, name+": unix: needs a socket path")
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v (use host:port or unix:/path)", name, err))
+		}
+		for j := 0; j < i; j++ {
+			if listenersOverlap(listeners[j], l) {
+				problems = append(problems, fmt.Sprintf("%s: address %s overlaps server.listeners[%d] (%s)", name, l.Address, j, listeners[j].Address))
+			}
+		}
+	}
+
+	if cfg.Server.SocketMode != "" {
+		if _, err := parseSocketMode(cfg.Server.SocketMode); err != nil {
+			problems = append(problems, fmt.Sprintf("server.socket_mode: %v", err))
+		}
+	}
+	if cfg.Server.SocketOwner != "" {
+		if _, _, err := lookupSocketOwner(cfg.Server.SocketOwner); err != nil {
+			problems = append(problems, fmt.Sprintf("server.socket_owner: %v", err))
+		}
+	}
+	return problems
+}
+
+// listenersOverlap reports whether a and b would bind the same socket: the
+// same path, or the same port on the same or a wildcard host
+func listenersOverlap(a, b ListenerConfig) bool {
+	aNet, aAddr := listenAddress(a)
+	bNet, bAddr := listenAddress(b)
+	if aNet != bNet {
+		return false
+	}
+	if aNet == "unix" {
+		return filepath.Clean(aAddr) == filepath.Clean(bAddr)
+	}
+	aHost, aPort, errA := net.SplitHostPort(aAddr)
+	bHost, bPort, errB := net.SplitHostPort(bAddr)
+	if errA != nil || errB != nil {
+		return false
+	}
+	ap, errA := net.LookupPort("tcp", aPort)
+	bp, errB := net.LookupPort("tcp", bPort)
+	// Port 0 picks a free port each time
+	if errA != nil || errB != nil || ap != bp || ap == 0 {
+		return false
+	}
+	wildcard := func(host string) bool {
+		return host == "" || host == "0.0.0.0" || host == "::"
+	}
+	return aHost == bHost || wildcard(aHost) || wildcard(bHost)
+}
+
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal permission such as 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupSocketOwner resolves "user", "user:group" or ":group" to IDs; -1
+// leaves that ID unchanged
+func lookupSocketOwner(s string) (int, int, error) {
+	name, group, _ := strings.Cut(s, ":")
+	uid, gid := -1, -1
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// listen opens the socket for l, or adopts the one handed over by the
+// process this one replaces
+func listen(cfg *Config, l ListenerConfig) (net.Listener, error) {
+	if f, ok := inheritedListeners[l.Address]; ok {
+		delete(inheritedListeners, l.Address)
+		return adoptListener(f)
+	}
+
+	network, addr := listenAddress(l)
+	if network == "tcp" {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server.SocketMode != "" {
+		mode, _ := parseSocketMode(cfg.Server.SocketMode)
+		if err := os.Chmod(addr, mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set socket mode: %v", err)
+		}
+	}
+	if cfg.Server.SocketOwner != "" {
+		uid, gid, err := lookupSocketOwner(cfg.Server.SocketOwner)
+		if err == nil {
+			err = os.Chown(addr, uid, gid)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set socket owner: %v", err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket deletes a socket left behind by a process that is gone.
+// A socket something still listens on, or any other kind of file, is kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is listening on %s", path)
+	}
+	slog.Info("Removing stale socket", "path", path)
+	return os.Remove(path)
+}
+
+// inheritedListeners holds the sockets handed over by the previous process,
+// by listener address, until listen adopts them
+var inheritedListeners = map[string]*os.File{}
+
+// loadInheritedListeners reads the listener handoff from the environment.
+// Each line of GOSSH_LISTENER_FDS is fd=address.
+func loadInheritedListeners() error {
+	value := os.Getenv(listenerFDsEnv)
+	if value == "" {
+		return nil
+	}
+	os.Unsetenv(listenerFDsEnv)
+	for _, entry := range strings.Split(value, "\n") {
+		fd, addr, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(fd)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid %s entry %q", listenerFDsEnv, entry)
+		}
+		inheritedListeners[addr] = os.NewFile(uintptr(n), addr)
+	}
+	return nil
+}
+
+// closeInheritedListeners closes handed-over sockets no listener is
+// configured for any more
+func closeInheritedListeners() {
+	for addr, f := range inheritedListeners {
+		slog.Info("Closing inherited listener that is no longer configured", "addr", addr)
+		f.Close()
+		delete(inheritedListeners, addr)
+	}
+}
+
+func adoptListener(f *os.File) (net.Listener, error) {
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt inherited listener: %v", err)
+	}
+	// The socket file is this process's to remove now
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	slog.Info("Adopted listener from previous process", "addr", ln.Addr().String())
+	return ln, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+// A terminal session nobody has typed in for session.lock_after locks: its
+// output is kept from the page, in the scrollback, and its input ignored,
+// until the user proves who they are again on POST
+// /api/sessions/{id}/unlock. The SSH connection stays up meanwhile.
+
+// Ways a locked session can be unlocked
+const (
+	// unlockPassword takes the password the session logged in with
+	unlockPassword = "password"
+	// unlockSignIn takes a sign-in at the authentication proxy after the
+	// lock, as authz.auth_time_header tells
+	unlockSignIn = "sign_in"
+)
+
+// maxUnlockFailures ends a locked session after this many wrong passwords
+const maxUnlockFailures = 5
+
+// lockSecret keys the passwords kept for unlocking, so they can't be
+// checked against guessed passwords outside this process
+var lockSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// lockPassword keeps what is needed to check password again, nil for none
+func lockPassword(password string) []byte {
+	if password == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, lockSecret)
+	io.WriteString(mac, password)
+	return mac.Sum(nil)
+}
+
+// sessionLock locks a session once it has had no input for a while. A nil
+// lock never locks.
+type sessionLock struct {
+	s         *activeSession
+	after     time.Duration
+	methods   []string
+	signInURL string
+	// held is set while the session is locked
+	held atomic.Bool
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	since    time.Time
+	failures int
+	stopped  bool
+}
+
+// startSessionLock arranges for s to lock, unless session.lock_after is
+// off or there would be no way to unlock it. Clients other than the
+// terminal page, which can't show a lock, aren't locked either.
+func startSessionLock(s *activeSession) *sessionLock {
+	cfg := currentConfig()
+	if cfg.Session.LockAfter <= 0 {
+		return nil
+	}
+	if _, ok := s.conn.(promptlessConn); ok {
+		return nil
+	}
+	l := &sessionLock{s: s, after: cfg.Session.LockAfter, signInURL: cfg.Session.LockSignInURL}
+	if s.lockPassword != nil {
+		l.methods = append(l.methods, unlockPassword)
+	}
+	if cfg.Authz.AuthTimeHeader != "" && s.identity.Source == "header" {
+		l.methods = append(l.methods, unlockSignIn)
+	}
+	if len(l.methods) == 0 {
+		return nil
+	}
+	l.timer = time.AfterFunc(l.after, l.fire)
+	return l
+}
+
+// fire locks the session if it has had no input since the timer was set,
+// and sets it again otherwise
+func (l *sessionLock) fire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped || l.held.Load() {
+		return
+	}
+	if idle := time.Since(l.s.lastTyped()); idle < l.after {
+		l.timer.Reset(l.after - idle)
+		return
+	}
+	l.held.Store(true)
+	l.since, l.failures = time.Now(), 0
+	slog.Info("Locking idle session", "session_id", l.s.ID, "host", hostname(l.s.Host), "lock_after", l.after)
+	l.emit("lock", outcomeSuccess, "", "")
+	l.s.out.hold(sshbridge.LockMessage{Type: "locked", Methods: l.methods, SignInURL: l.signInURL})
+}
+
+// blocks reports whether a message of type typ from the page is to be
+// ignored, as all but resizes are while the session is locked
+func (l *sessionLock) blocks(typ string) bool {
+	return l != nil && l.held.Load() && typ != "resize"
+}
+
+// locked returns when the session was locked, zero when it isn't
+func (l *sessionLock) locked() time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held.Load() {
+		return time.Time{}
+	}
+	return l.since
+}
+
+// unlock checks the password, or failing that the caller's last sign-in,
+// and unlocks the session when it passes. Too many wrong passwords end the
+// session.
+func (l *sessionLock) unlock(r *http.Request, password string) (string, error) {
+	if l == nil {
+		return "", httpapi.Errorf(httpapi.Conflict, "Session is not locked")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held.Load() {
+		return "", httpapi.Errorf(httpapi.Conflict, "Session is not locked")
+	}
+	method := unlockSignIn
+	if password != "" {
+		method = unlockPassword
+	}
+	if !containsString(l.methods, method) {
+		if method == unlockPassword {
+			return "", httpapi.Errorf(httpapi.BadRequest, "This session can't be unlocked with a password; sign in again instead")
+		}
+		return "", httpapi.Errorf(httpapi.BadRequest, "password is required")
+	}
+
+	switch method {
+	case unlockPassword:
+		if !hmac.Equal(lockPassword(password), l.s.lockPassword) {
+			l.failures++
+			l.emit("unlock", outcomeDenied, method, "wrong password")
+			if l.failures >= maxUnlockFailures {
+				slog.Warn("Ending locked session after failed unlock attempts", "session_id", l.s.ID, "host", hostname(l.s.Host), "failures", l.failures)
+				go l.s.close("too many failed unlock attempts")
+				return "", httpapi.Errorf(httpapi.Forbidden, "Wrong password; the session has been ended")
+			}
+			return "", httpapi.Errorf(httpapi.Forbidden, "Wrong password")
+		}
+	case unlockSignIn:
+		at, ok := parseAuthTime(r.Header.Get(currentConfig().Authz.AuthTimeHeader))
+		if !ok || !at.After(l.since) {
+			l.emit("unlock", outcomeDenied, method, "no sign-in since the lock")
+			return "", httpapi.Errorf(httpapi.Forbidden, "Sign in again before unlocking the session")
+		}
+	}
+
+	l.held.Store(false)
+	l.timer.Reset(l.after)
+	slog.Info("Unlocked session", "session_id", l.s.ID, "host", hostname(l.s.Host), "method", method, "locked_for", time.Since(l.since))
+	l.emit("unlock", outcomeSuccess, method, "")
+	l.s.out.release(sshbridge.LockMessage{Type: "unlocked"})
+	return method, nil
+}
+
+// emit records a lock or unlock of the session. The caller holds mu.
+func (l *sessionLock) emit(action, outcome, method, reason string) {
+	ev := AuditEvent{
+		Event:      auditSessionLock,
+		Outcome:    outcome,
+		ClientIP:   l.s.ClientIP,
+		User:       l.s.User,
+		Host:       l.s.Host,
+		SSHUser:    l.s.SSHUser,
+		AuthMethod: method,
+		Action:     action,
+		Target:     l.s.ID,
+		Error:      reason,
+	}
+	if action == "unlock" && outcome == outcomeSuccess {
+		ev.DurationMS = time.Since(l.since).Milliseconds()
+	}
+	audit.Emit(ev)
+}
+
+func (l *sessionLock) stop() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	l.timer.Stop()
+}
+
+// idleTimeout ends a terminal session that nobody has typed in for
+// session.idle_timeout, whether it is locked or not. A nil timeout does
+// nothing.
+type idleTimeout struct {
+	s     *activeSession
+	after time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// startIdleTimeout arranges for s to end once idle, unless
+// session.idle_timeout is off
+func startIdleTimeout(s *activeSession) *idleTimeout {
+	after := currentConfig().Session.IdleTimeout
+	if after <= 0 {
+		return nil
+	}
+	t := &idleTimeout{s: s, after: after}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = time.AfterFunc(after, t.fire)
+	return t
+}
+
+// fire ends the session if it has had no input since the timer was set,
+// and sets it again otherwise
+func (t *idleTimeout) fire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if idle := time.Since(t.s.lastTyped()); idle < t.after {
+		t.timer.Reset(t.after - idle)
+		return
+	}
+	t.stopped = true
+	slog.Info("Ending idle session", "session_id", t.s.ID, "host", hostname(t.s.Host), "idle_timeout", t.after, "locked", !t.s.lock.locked().IsZero())
+	go t.s.close("idle timeout")
+}
+
+func (t *idleTimeout) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	t.timer.Stop()
+}
+
+// parseAuthTime reads the time of the last sign-in from the proxy, as Unix
+// seconds or RFC 3339
+func parseAuthTime(v string) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
+
+func validateLockConfig(cfg SessionConfig) error {
+	if cfg.LockAfter < 0 {
+		return fmt.Errorf("session.lock_after must not be negative")
+	}
+	if cfg.IdleTimeout < 0 {
+		return fmt.Errorf("session.idle_timeout must not be negative")
+	}
+	if cfg.IdleTimeout > 0 && cfg.LockAfter > 0 && cfg.IdleTimeout <= cfg.LockAfter {
+		return fmt.Errorf("session.idle_timeout must be longer than session.lock_after, which it bounds")
+	}
+	if cfg.LockSignInURL != "" {
+		u, err := url.Parse(cfg.LockSignInURL)
+		if err != nil || (u.IsAbs() && u.Scheme != "http" && u.Scheme != "https") || (!u.IsAbs() && !strings.HasPrefix(u.Path, "/")) {
+			return fmt.Errorf("session.lock_sign_in_url must be an http(s) URL or a path starting with /")
+		}
+	}
+	return nil
+}
+
+// hold keeps terminal output from the page from now on; the scrollback
+// still takes it. msg tells the page.
+func (w *wsWriter) hold(msg sshbridge.LockMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.held, w.heldBytes = true, 0
+	return w.writeJSON(msg)
+}
+
+// release sends the page the output held back, as much of it as the
+// scrollback kept, after msg
+func (w *wsWriter) release(msg sshbridge.LockMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.held {
+		return nil
+	}
+	w.held = false
+	var data []byte
+	if sb := w.keptScrollback(false); sb != nil {
+		data = sb.since(w.heldBytes)
+	}
+	if err := w.writeJSON(msg); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return w.write(websocket.BinaryMessage, data)
+}
+
+// unlockRequest is the body of POST /api/sessions/{id}/unlock.
+// SessionKey is the key the session's page was given, which anonymous
+// sessions must be unlocked with.
+type unlockRequest struct {
+	Password   string `json:"password"`
+	SessionKey string `json:"session_key"`
+}
+
+// unlockHandler unlocks a locked session on POST
+// /api/sessions/{id}/unlock, for the user who opened it or, when it was
+// opened anonymously, for its page
+func unlockHandler(w http.ResponseWriter, r *http.Request, s *activeSession) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	var body unlockRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		responder.ErrorCode(w, r, httpapi.BadRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+	if id := requestIdentity(r); !s.usableBy(id, body.SessionKey) {
+		requestLogger(r).Warn("Refused to unlock another user's session", "session_id", s.ID, "user", id.String(), "owner", s.identity.User)
+		responder.ErrorCode(w, r, httpapi.Forbidden, "Only the user who opened the session can unlock it")
+		return
+	}
+	method, err := s.lock.unlock(r, body.Password)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+	httpapi.JSON(w, map[string]interface{}{"success": true, "method": method})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnlockOnlyByOwner(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+authz:
+  user_header: X-User
+`)
+	owned := &activeSession{ID: "s1", User: "alice", identity: Identity{User: "alice", Source: "header"}, key: "k1"}
+	anonymous := &activeSession{ID: "s2", key: "k2"}
+	tests := []struct {
+		name string
+		s    *activeSession
+		user string
+		body string
+		want int
+	}{
+		{"owner", owned, "alice", `{}`, http.StatusConflict},
+		{"another user", owned, "bob", `{}`, http.StatusForbidden},
+		{"anonymous caller with the key", owned, "", `{"session_key": "k1"}`, http.StatusForbidden},
+		{"page of an anonymous session", anonymous, "", `{"session_key": "k2"}`, http.StatusConflict},
+		{"without the key", anonymous, "", `{}`, http.StatusForbidden},
+		{"with another session's key", anonymous, "", `{"session_key": "k1"}`, http.StatusForbidden},
+		{"identified caller without the key", anonymous, "bob", `{}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/sessions/"+tt.s.ID+"/unlock", strings.NewReader(tt.body))
+			r.RemoteAddr = "10.0.0.1:4000"
+			if tt.user != "" {
+				r.Header.Set("X-User", tt.user)
+			}
+			w := httptest.NewRecorder()
+			// Neither session is locked, so a caller allowed to unlock
+			// gets a conflict
+			unlockHandler(w, r, tt.s)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutEndsSession(t *testing.T) {
+	useConfig(t, `
+session:
+  idle_timeout: 100ms
+`)
+	conn := newFakeConn()
+	s := &activeSession{conn: conn, Started: time.Now()}
+	timeout := startIdleTimeout(s)
+	defer timeout.stop()
+
+	// Typing keeps it open past the timeout
+	for range 4 {
+		time.Sleep(40 * time.Millisecond)
+		s.typed()
+	}
+	select {
+	case <-conn.closed:
+		t.Fatal("session ended although the user was typing")
+	default:
+	}
+
+	select {
+	case <-conn.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session was not ended")
+	}
+}
+
+func TestIdleTimeoutMustOutlastLock(t *testing.T) {
+	err := validateLockConfig(SessionConfig{LockAfter: time.Hour, IdleTimeout: time.Minute})
+	if err == nil {
+		t.Error("an idle timeout shorter than lock_after was accepted")
+	}
+	if err := validateLockConfig(SessionConfig{LockAfter: time.Minute, IdleTimeout: time.Hour}); err != nil {
+		t.Error(err)
+	}
+}
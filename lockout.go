@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// LockoutConfig controls lockout after repeated SSH authentication failures
+type LockoutConfig struct {
+	Disabled    bool          `yaml:"disabled"`
+	MaxFailures int           `yaml:"max_failures"`
+	Window      time.Duration `yaml:"window"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MaxEntries  int           `yaml:"max_entries"`
+}
+
+func (c *LockoutConfig) applyDefaults() {
+	if c.MaxFailures <= 0 {
+		c.MaxFailures = 5
+	}
+	if c.Window <= 0 {
+		c.Window = 10 * time.Minute
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = 15 * time.Minute
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 10000
+	}
+}
+
+// LockedError is returned when a (client IP, host, user) tuple is locked out
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("temporarily locked: too many failed authentication attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *LockedError) ErrorCode() (httpapi.Code, time.Duration) {
+	return httpapi.LockedOut, e.RetryAfter
+}
+
+type lockoutEntry struct {
+	key         string
+	clientIP    string
+	host        string
+	user        string
+	failures    int
+	firstFail   time.Time
+	lockedUntil time.Time
+}
+
+// lockoutTracker counts failed authentications per (client IP, host, user).
+// Entries are kept in an LRU list capped at MaxEntries so the tracker's
+// memory use is bounded no matter how many tuples an attacker tries.
+type lockoutTracker struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// now is the tracker's clock, replaced in tests
+	now func() time.Time
+}
+
+var lockouts = newLockoutTracker()
+
+func newLockoutTracker() *lockoutTracker {
+	return &lockoutTracker{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func lockoutKey(clientIP, host, user string) string {
+	return clientIP + "|" + hostname(host) + "|" + user
+}
+
+// check returns a LockedError if the tuple is currently locked out
+func (t *lockoutTracker) check(cfg *LockoutConfig, clientIP, host, user string) error {
+	if cfg.Disabled {
+		return nil
+	}
+	key := lockoutKey(clientIP, host, user)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*lockoutEntry)
+	if remaining := entry.lockedUntil.Sub(t.now()); remaining > 0 {
+		return &LockedError{RetryAfter: remaining}
+	}
+	return nil
+}
+
+// recordFailure counts a failed authentication and locks the tuple once
+// MaxFailures is reached within Window
+func (t *lockoutTracker) recordFailure(cfg *LockoutConfig, clientIP, host, user string) {
+	if cfg.Disabled {
+		return
+	}
+	key := lockoutKey(clientIP, host, user)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var entry *lockoutEntry
+	if elem, ok := t.entries[key]; ok {
+		entry = elem.Value.(*lockoutEntry)
+		t.lru.MoveToFront(elem)
+	} else {
+		entry = &lockoutEntry{key: key, clientIP: clientIP, host: hostname(host), user: user}
+		t.entries[key] = t.lru.PushFront(entry)
+		for t.lru.Len() > cfg.MaxEntries {
+			oldest := t.lru.Back()
+			t.lru.Remove(oldest)
+			delete(t.entries, oldest.Value.(*lockoutEntry).key)
+		}
+	}
+
+	if entry.failures == 0 || now.Sub(entry.firstFail) > cfg.Window {
+		entry.failures = 0
+		entry.firstFail = now
+	}
+	entry.failures++
+
+	if entry.failures >= cfg.MaxFailures {
+		entry.lockedUntil = now.Add(cfg.Cooldown)
+		entry.failures = 0
+		slog.Warn("Locked out after repeated authentication failures",
+			"client_ip", entry.clientIP, "host", entry.host, "ssh_user", entry.user, "failures", cfg.MaxFailures, "cooldown", cfg.Cooldown)
+	}
+}
+
+// recordSuccess clears any failures recorded for the tuple
+func (t *lockoutTracker) recordSuccess(clientIP, host, user string) {
+	key := lockoutKey(clientIP, host, user)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if elem, ok := t.entries[key]; ok {
+		t.lru.Remove(elem)
+		delete(t.entries, key)
+	}
+}
+
+// isAuthFailure reports whether an ssh.Dial error was caused by rejected
+// credentials. A server that refuses keyboard-interactive without asking
+// anything surfaces as an unexpected SSH_MSG_USERAUTH_FAILURE (51).
+func isAuthFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "unable to authenticate") || strings.Contains(msg, "unexpected message type 51 ")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testClock is a lockoutTracker clock that only moves when told to
+type testClock struct{ at time.Time }
+
+func (c *testClock) now() time.Time          { return c.at }
+func (c *testClock) advance(d time.Duration) { c.at = c.at.Add(d) }
+
+// newTestLockouts returns a tracker on its own clock, with the default
+// limits: 5 failures within 10 minutes lock for 15
+func newTestLockouts() (*lockoutTracker, *testClock, *LockoutConfig) {
+	clock := &testClock{at: time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)}
+	tracker := newLockoutTracker()
+	tracker.now = clock.now
+	cfg := &LockoutConfig{}
+	cfg.applyDefaults()
+	return tracker, clock, cfg
+}
+
+func failAuth(tracker *lockoutTracker, cfg *LockoutConfig, n int) {
+	for range n {
+		tracker.recordFailure(cfg, "192.0.2.1", "db01:22", "root")
+	}
+}
+
+func lockedFor(tracker *lockoutTracker, cfg *LockoutConfig) time.Duration {
+	var locked *LockedError
+	if errors.As(tracker.check(cfg, "192.0.2.1", "db01:22", "root"), &locked) {
+		return locked.RetryAfter
+	}
+	return 0
+}
+
+func TestLockoutThreshold(t *testing.T) {
+	tracker, clock, cfg := newTestLockouts()
+	failAuth(tracker, cfg, 4)
+	if d := lockedFor(tracker, cfg); d != 0 {
+		t.Fatalf("locked for %v after 4 failures of 5", d)
+	}
+	failAuth(tracker, cfg, 1)
+	if d := lockedFor(tracker, cfg); d != 15*time.Minute {
+		t.Fatalf("locked for %v after 5 failures, want 15m", d)
+	}
+	clock.advance(10 * time.Minute)
+	if d := lockedFor(tracker, cfg); d != 5*time.Minute {
+		t.Errorf("locked for %v 10 minutes in, want 5m", d)
+	}
+
+	// The lockout is per client, host and user; the port doesn't count
+	for _, other := range [][3]string{
+		{"192.0.2.2", "db01:22", "root"},
+		{"192.0.2.1", "db02:22", "root"},
+		{"192.0.2.1", "db01:22", "admin"},
+	} {
+		if err := tracker.check(cfg, other[0], other[1], other[2]); err != nil {
+			t.Errorf("%v locked out: %v", other, err)
+		}
+	}
+	if err := tracker.check(cfg, "192.0.2.1", "db01:2222", "root"); err == nil {
+		t.Error("another port of the same host isn't locked out")
+	}
+
+	if err := tracker.check(&LockoutConfig{Disabled: true}, "192.0.2.1", "db01:22", "root"); err != nil {
+		t.Errorf("locked out with lockout disabled: %v", err)
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	tracker, clock, cfg := newTestLockouts()
+
+	// 4 failures, then the window passes and the count starts again
+	failAuth(tracker, cfg, 4)
+	clock.advance(10*time.Minute + time.Second)
+	failAuth(tracker, cfg, 4)
+	if d := lockedFor(tracker, cfg); d != 0 {
+		t.Fatalf("locked for %v by failures in two windows", d)
+	}
+
+	// The window is counted from the first failure of the new count
+	clock.advance(9 * time.Minute)
+	failAuth(tracker, cfg, 1)
+	if d := lockedFor(tracker, cfg); d != 15*time.Minute {
+		t.Errorf("locked for %v after 5 failures within the window, want 15m", d)
+	}
+}
+
+func TestLockoutCooldown(t *testing.T) {
+	tracker, clock, cfg := newTestLockouts()
+	failAuth(tracker, cfg, 5)
+	clock.advance(15*time.Minute - time.Second)
+	if d := lockedFor(tracker, cfg); d != time.Second {
+		t.Fatalf("locked for %v a second before the cooldown ends", d)
+	}
+	clock.advance(time.Second)
+	if d := lockedFor(tracker, cfg); d != 0 {
+		t.Fatalf("locked for %v after the cooldown", d)
+	}
+
+	// The failures that locked the tuple don't count towards the next lockout
+	failAuth(tracker, cfg, 4)
+	if d := lockedFor(tracker, cfg); d != 0 {
+		t.Errorf("locked for %v after 4 failures following the cooldown", d)
+	}
+	failAuth(tracker, cfg, 1)
+	if d := lockedFor(tracker, cfg); d != 15*time.Minute {
+		t.Errorf("locked for %v after 5 more failures, want 15m", d)
+	}
+}
+
+func TestLockoutResetOnSuccess(t *testing.T) {
+	tracker, _, cfg := newTestLockouts()
+	failAuth(tracker, cfg, 4)
+	tracker.recordSuccess("192.0.2.1", "db01:22", "root")
+	failAuth(tracker, cfg, 4)
+	if d := lockedFor(tracker, cfg); d != 0 {
+		t.Fatalf("locked for %v with a success between failures", d)
+	}
+	if tracker.lru.Len() != 1 {
+		t.Errorf("%d entries, want 1", tracker.lru.Len())
+	}
+
+	tracker.recordSuccess("192.0.2.1", "db01:22", "root")
+	if tracker.lru.Len() != 0 || len(tracker.entries) != 0 {
+		t.Errorf("%d entries after a success, want none", tracker.lru.Len())
+	}
+}
+
+func TestLockoutEvictsLeastRecentlyUsed(t *testing.T) {
+	tracker, _, cfg := newTestLockouts()
+	failOther := func(i int) {
+		tracker.recordFailure(cfg, fmt.Sprintf("198.51.100.%d", i%256), fmt.Sprintf("host%d", i), "root")
+	}
+
+	failAuth(tracker, cfg, 5)
+	for i := range cfg.MaxEntries - 1 {
+		failOther(i)
+	}
+	if n := tracker.lru.Len(); n != cfg.MaxEntries || len(tracker.entries) != n {
+		t.Fatalf("%d entries, %d in the map; want %d", n, len(tracker.entries), cfg.MaxEntries)
+	}
+	if d := lockedFor(tracker, cfg); d == 0 {
+		t.Fatal("the locked tuple was evicted before the cap")
+	}
+
+	// Another failure makes the locked tuple the most recently used, so the
+	// next new tuple evicts the oldest of the others
+	failAuth(tracker, cfg, 1)
+	failOther(cfg.MaxEntries)
+	if d := lockedFor(tracker, cfg); d == 0 {
+		t.Fatal("the most recently used tuple was evicted")
+	}
+	if _, ok := tracker.entries[lockoutKey("198.51.100.0", "host0", "root")]; ok {
+		t.Error("the least recently used tuple wasn't evicted")
+	}
+
+	// Now the locked tuple is the oldest and goes first
+	for i := range cfg.MaxEntries - 1 {
+		failOther(cfg.MaxEntries + 1 + i)
+	}
+	if d := lockedFor(tracker, cfg); d != 0 {
+		t.Error("the least recently used tuple is still locked out")
+	}
+	if n := tracker.lru.Len(); n != cfg.MaxEntries || len(tracker.entries) != n {
+		t.Errorf("%d entries, %d in the map; want %d", n, len(tracker.entries), cfg.MaxEntries)
+	}
+}
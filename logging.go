@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoggingConfig configures the application log. The audit stream is
+// configured separately.
+type LoggingConfig struct {
+	Level  string `yaml:"level"`  // debug, info (default), warn or error
+	Format string `yaml:"format"` // text (default) or json
+	Output string `yaml:"output"` // stderr (default), stdout or file
+	File   string `yaml:"file"`   // path when output is file
+	// Rotation applies when output is file
+	Rotation RotationConfig `yaml:"rotation"`
+}
+
+// logLevel can be changed by a config reload
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown logging.level %q (use debug, info, warn or error)", s)
+}
+
+// validateLoggingConfig checks the logging settings
+func validateLoggingConfig(cfg LoggingConfig) error {
+	if _, err := parseLogLevel(cfg.Level); err != nil {
+		return err
+	}
+	switch cfg.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown logging.format %q (use text or json)", cfg.Format)
+	}
+	switch cfg.Output {
+	case "", "stderr", "stdout":
+	case "file":
+		if cfg.File == "" {
+			return fmt.Errorf("logging.file is required when logging.output is \"file\"")
+		}
+		if err := validateRotationConfig(cfg.Rotation); err != nil {
+			return fmt.Errorf("logging.rotation: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown logging.output %q (use stderr, stdout or file)", cfg.Output)
+	}
+	return nil
+}
+
+// initLogging installs the process-wide logger. Output that still goes
+// through the standard log package ends up in the same handler.
+func initLogging(cfg LoggingConfig) error {
+	if err := validateLoggingConfig(cfg); err != nil {
+		return err
+	}
+	level, _ := parseLogLevel(cfg.Level)
+	logLevel.Set(level)
+
+	var w io.Writer = os.Stderr
+	switch cfg.Output {
+	case "stdout":
+		w = os.Stdout
+	case "file":
+		f, err := openRotatingFile(cfg.File, cfg.Rotation, 0640)
+		if err != nil {
+			return fmt.Errorf("error opening log file: %v", err)
+		}
+		w = f
+	}
+
+	var h slog.Handler
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel})
+	} else {
+		h = &textHandler{w: w, mu: &sync.Mutex{}}
+	}
+	slog.SetDefault(slog.New(&redactingHandler{h}))
+	return nil
+}
+
+// redactingHandler scrubs credentials from messages and string attributes
+// before they reach the underlying handler
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	clean := slog.NewRecord(r.Time, r.Level, redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		clean.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, clean)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = redactAttr(a)
+	}
+	return &redactingHandler{h.Handler.WithAttrs(clean)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redact(v.String()))
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, redact(err.Error()))
+		}
+		return slog.String(a.Key, redact(fmt.Sprint(v.Any())))
+	case slog.KindGroup:
+		attrs := v.Group()
+		clean := make([]any, len(attrs))
+		for i, ga := range attrs {
+			clean[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, clean...)
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// textHandler keeps the classic log line format: a timestamp, the level
+// for anything but info, the message, then key=value attributes
+type textHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	attrs  []slog.Attr
+	prefix string // group prefix for attribute keys
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		buf.WriteString(r.Level.String())
+		buf.WriteString(": ")
+	}
+	buf.WriteString(r.Message)
+	for _, a := range h.attrs {
+		writeTextAttr(&buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeTextAttr(&buf, h.prefix, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func writeTextAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			writeTextAttr(buf, prefix+a.Key+".", ga)
+		}
+		return
+	}
+
+	s := v.String()
+	if v.Kind() == slog.KindDuration {
+		precision := time.Millisecond
+		if v.Duration() < time.Millisecond {
+			precision = time.Microsecond
+		}
+		s = v.Duration().Round(precision).String()
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = fmt.Sprintf("%q", s)
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(prefix + a.Key)
+	buf.WriteByte('=')
+	buf.WriteString(s)
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), prefixAttrs(h.prefix, attrs)...)
+	return &nh
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
+
+func prefixAttrs(prefix string, attrs []slog.Attr) []slog.Attr {
+	if prefix == "" {
+		return attrs
+	}
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = slog.Attr{Key: prefix + a.Key, Value: a.Value}
+	}
+	return out
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,493 +1,274 @@
+// Command gossh is a web-based SSH bastion: terminals, transfers and the
+// API behind them.
+//
+// The gateway's state lives in this package: the configuration behind
+// currentConfig, the session registry, the audit log, approvals, the
+// connection pool and the stores. The handlers and handleSSHConnection use
+// it directly, and tests swap it with helpers such as useConfig. The
+// layers that need none of it are in internal/: config decoding
+// (internal/config), the API's errors and responses (internal/httpapi),
+// file transfers (internal/transfer), the terminal protocol
+// (internal/sshbridge), and the SSH server the tests run against
+// (internal/sshtest).
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"html/template"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
-
-	"github.com/fernet/fernet-go"
-	"github.com/gorilla/websocket"
-	"gopkg.in/yaml.v3"
-)
-
-type Config struct {
-	Server struct {
-		Address string `yaml:"address"`
-		Port    int    `yaml:"port"`
-	} `yaml:"server"`
-	Security struct {
-		FernetKey string `yaml:"fernet_key"`
-	} `yaml:"security"`
-}
-
-var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	tmpl   *template.Template
-	config Config
 )
 
-type SSHCredentials struct {
-	Host        string
-	User        string
-	Password    string
-	PrivateKey  string
-	AccessToken string
-}
-
-func init() {
-	// Load configuration
-	if err := loadConfig("config.yaml"); err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-
-	// Validate Fernet key
-	if config.Security.FernetKey == "" {
-		log.Fatal("Fernet key is not configured. Please set security.fernet_key in config.yaml")
-	}
-	if _, err := fernet.DecodeKeys(config.Security.FernetKey); err != nil {
-		log.Fatalf("Invalid Fernet key in config: %v", err)
+// setup loads the configuration and opens what the commands below all
+// need. It runs from main rather than init so tests can install their own
+// configuration.
+func setup() {
+	// Log to stderr until the configured logging is set up
+	initLogging(LoggingConfig{})
+
+	// Load configuration. -demo runs without one if there is none.
+	path := configPath
+	if _, err := os.Stat(configPath); os.IsNotExist(err) && demoRequested() {
+		if path, err = writeDemoConfig(); err != nil {
+			fatal("Failed to write demo config", "err", err)
+		}
+		defer os.Remove(path)
 	}
-
-	// Load templates
-	var err error
-	tmpl, err = template.ParseGlob("templates/*.html")
+	cfg, keys, err := loadConfig(path)
 	if err != nil {
-		log.Printf("Warning: could not parse templates: %v", err)
+		fatal("Failed to load config", "err", err)
 	}
-}
+	installConfig(cfg, keys)
+	maintenance.set(cfg.Server.Maintenance.Enabled, cfg.Server.Maintenance.Message, "")
 
-func loadConfig(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("error opening config file: %v", err)
+	// Set up application logging
+	if err := initLogging(cfg.Logging); err != nil {
+		fatal("Failed to initialize logging", "err", err)
 	}
-	defer file.Close()
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return fmt.Errorf("error reading config file: %v", err)
+	// Export traces when enabled
+	if err := initTracing(cfg.Tracing); err != nil {
+		fatal("Failed to initialize tracing", "err", err)
 	}
 
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("error parsing config file: %v", err)
+	// Open audit sink
+	if err := initAudit(cfg.Audit); err != nil {
+		fatal("Failed to initialize audit log", "err", err)
 	}
 
-	return nil
+	// Load templates
+	loadTemplates()
+	if cfg.Server.DevMode {
+		slog.Warn("Development mode: templates are re-read on every request")
+	}
 }
 
 func main() {
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/terminal", terminalHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/download", downloadHandler)
-	http.HandleFunc("/validate-download", validateDownloadHandler)
-	http.HandleFunc("/ws", wsHandler)
-	http.HandleFunc("/static/", noCacheStaticHandler)
-
-	addr := fmt.Sprintf("%s:%d", config.Server.Address, config.Server.Port)
-	log.Printf("Server starting on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
+	if len(os.Args) == 2 && os.Args[1] == "version" {
+		fmt.Println(build)
+		return
 	}
-}
-
-func noCacheStaticHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-	http.StripPrefix("/static/", http.FileServer(http.Dir("static"))).ServeHTTP(w, r)
-}
+	setup()
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	var creds SSHCredentials
-
-	// Check for direct access via 'access' parameter
-	accessParam := r.URL.Query().Get("access")
-	if accessParam != "" {
-		var err error
-		creds, err = decryptAccess(accessParam)
-		if err != nil {
-			http.Error(w, "Invalid access token", http.StatusBadRequest)
-			log.Printf("Failed to decrypt access token: %v", err)
-			return
+	// "gossh config print" shows the effective configuration and exits
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if len(os.Args) != 3 || os.Args[2] != "print" {
+			fmt.Fprintln(os.Stderr, "usage: gossh config print")
+			os.Exit(2)
 		}
-
-		// Store the access token for use in WebSocket/download/upload
-		creds.AccessToken = accessParam
-
-		// Direct access mode - render terminal page directly
-		if tmpl != nil {
-			tmpl.ExecuteTemplate(w, "terminal.html", creds)
-		} else {
-			http.Error(w, "Templates not loaded", http.StatusInternalServerError)
+		if err := printConfig(os.Stdout, currentConfig()); err != nil {
+			fatal("Failed to print config", "err", err)
 		}
 		return
 	}
 
-	// Normal mode - render the form page
-	if tmpl != nil {
-		tmpl.ExecuteTemplate(w, "index.html", creds)
-	} else {
-		http.Error(w, "Templates not loaded", http.StatusInternalServerError)
-	}
-}
-
-func terminalHandler(w http.ResponseWriter, r *http.Request) {
-	// Render the terminal popup page
-	if tmpl != nil {
-		tmpl.ExecuteTemplate(w, "terminal.html", nil)
-	} else {
-		http.Error(w, "Templates not loaded", http.StatusInternalServerError)
-	}
-}
-
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// "gossh inventory import" sends an inventory to a running server
+	if len(os.Args) > 1 && os.Args[1] == "inventory" {
+		runInventoryCommand(os.Args[2:])
 		return
 	}
 
-	// Parse multipart form (max 2GB)
-	r.ParseMultipartForm(2 << 30) // 2GB
+	watchSIGUSR1()
 
-	// Get file from form
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		respondJSON(w, map[string]interface{}{
-			"success": false,
-			"error":   "Failed to read file: " + err.Error(),
-		})
-		return
+	cfg := currentConfig()
+	if err := loadInheritedListeners(); err != nil {
+		fatal("Failed to adopt inherited listeners", "err", err)
 	}
-	defer file.Close()
-
-	// Check if using access token
-	accessParam := r.FormValue("access")
-	var host, user, password string
-	var privateKey []byte
-
-	if accessParam != "" {
-		// Decrypt access token to get credentials
-		creds, err := decryptAccess(accessParam)
-		if err != nil {
-			respondJSON(w, map[string]interface{}{
-				"success": false,
-				"error":   "Invalid access token",
-			})
-			return
-		}
-		host = creds.Host
-		user = creds.User
-		password = creds.Password
-		if creds.PrivateKey != "" {
-			privateKey, _ = base64.StdEncoding.DecodeString(creds.PrivateKey)
-		}
-	} else {
-		// Get SSH credentials from form (legacy mode)
-		host = r.FormValue("host")
-		user = r.FormValue("user")
-		password = r.FormValue("password")
-		privateKeyB64 := r.FormValue("privatekey")
+	maintenance.inherit()
 
-		if privateKeyB64 != "" {
-			privateKey, err = base64.StdEncoding.DecodeString(privateKeyB64)
-			if err != nil {
-				respondJSON(w, map[string]interface{}{
-					"success": false,
-					"error":   "Invalid private key encoding",
-				})
-				return
-			}
-		}
+	slog.Info("Starting gossh", "version", build.Version, "commit", build.Commit, "build_date", build.BuildDate, "go_version", build.GoVersion)
+	if cfg.Server.DebugEndpoints {
+		publishDebugVars()
 	}
-
-	// Upload file via SSH
-	remotePath, err := uploadFileViaSSH(file, header.Filename, host, user, password, privateKey)
-	if err != nil {
-		respondJSON(w, map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
+	if err := jobs.open(cfg.Jobs.Dir); err != nil {
+		fatal("Failed to open job store", "err", err)
 	}
-
-	respondJSON(w, map[string]interface{}{
-		"success": true,
-		"path":    remotePath,
-	})
-}
-
-func respondJSON(w http.ResponseWriter, data map[string]interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
-}
-
-func validateDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if using access token
-	accessParam := r.URL.Query().Get("access")
-	remotePath := r.URL.Query().Get("path")
-
-	var host, user, password string
-	var privateKey []byte
-	var err error
-
-	if accessParam != "" {
-		// Decrypt access token to get credentials
-		creds, err := decryptAccess(accessParam)
-		if err != nil {
-			respondJSON(w, map[string]interface{}{
-				"valid": false,
-				"error": "Invalid access token",
-			})
-			return
-		}
-		host = creds.Host
-		user = creds.User
-		password = creds.Password
-		if creds.PrivateKey != "" {
-			privateKey, _ = base64.StdEncoding.DecodeString(creds.PrivateKey)
-		}
-	} else {
-		// Get parameters from query string (legacy mode)
-		host = r.URL.Query().Get("host")
-		user = r.URL.Query().Get("user")
-		password = r.URL.Query().Get("password")
-		privateKeyB64 := r.URL.Query().Get("privatekey")
-
-		if privateKeyB64 != "" {
-			privateKey, err = base64.StdEncoding.DecodeString(privateKeyB64)
-			if err != nil {
-				respondJSON(w, map[string]interface{}{
-					"valid": false,
-					"error": "Invalid private key encoding",
-				})
-				return
-			}
-		}
+	go pruneJobs()
+	if err := schedules.open(cfg.Schedules.Dir); err != nil {
+		fatal("Failed to open schedule store", "err", err)
 	}
-
-	if host == "" || user == "" || remotePath == "" {
-		respondJSON(w, map[string]interface{}{
-			"valid": false,
-			"error": "Missing required parameters",
-		})
-		return
+	go schedules.loop()
+	go hostChecks.loop()
+	if err := recordings.open(cfg.Recording.Dir); err != nil {
+		fatal("Failed to open session recordings", "err", err)
 	}
-
-	// Validate remote path - only allow downloads from /home, /opt, and /tmp
-	allowedPaths := []string{"/home/", "/opt/", "/tmp/"}
-	isAllowed := false
-	for _, prefix := range allowedPaths {
-		if strings.HasPrefix(remotePath, prefix) {
-			isAllowed = true
-			break
-		}
+	if err := profiles.open(cfg.Profiles.File); err != nil {
+		fatal("Failed to open profile store", "err", err)
 	}
-	if !isAllowed {
-		respondJSON(w, map[string]interface{}{
-			"valid": false,
-			"error": "Access denied: Downloads are only allowed from /home, /opt, and /tmp directories",
-		})
-		return
+	if err := storedCredentials.open(cfg.CredentialStore.File); err != nil {
+		fatal("Failed to open credential store", "err", err)
 	}
-
-	// Check if file exists via SSH
-	fileInfo, err := validateFileViaSSH(remotePath, host, user, password, privateKey)
-	if err != nil {
-		respondJSON(w, map[string]interface{}{
-			"valid": false,
-			"error": err.Error(),
-		})
-		return
+	if err := managedKeys.open(cfg.ManagedKeys.File); err != nil {
+		fatal("Failed to open key store", "err", err)
 	}
-
-	respondJSON(w, map[string]interface{}{
-		"valid":    true,
-		"filename": fileInfo["filename"],
-		"size":     fileInfo["size"],
-	})
-}
-
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if using access token
-	accessParam := r.URL.Query().Get("access")
-	remotePath := r.URL.Query().Get("path")
-
-	var host, user, password string
-	var privateKey []byte
-	var err error
-
-	if accessParam != "" {
-		// Decrypt access token to get credentials
-		creds, err := decryptAccess(accessParam)
+	if err := history.open(cfg.History.File); err != nil {
+		fatal("Failed to open connection history", "err", err)
+	}
+	if demoRequested() {
+		d, err := startDemoServer()
 		if err != nil {
-			http.Error(w, "Invalid access token", http.StatusBadRequest)
-			log.Printf("Failed to decrypt access token: %v", err)
-			return
+			fatal("Failed to start demo SSH server", "err", err)
 		}
-		host = creds.Host
-		user = creds.User
-		password = creds.Password
-		if creds.PrivateKey != "" {
-			privateKey, _ = base64.StdEncoding.DecodeString(creds.PrivateKey)
+		demo = d
+		fmt.Fprintf(os.Stderr, demoWarning, d.addr, demoUser, demoPassword)
+		slog.Warn("Demo mode: serving a toy SSH server, not a real host", "ssh_addr", d.addr)
+	}
+
+	var servers []*http.Server
+	var bound []boundListener
+	var certs []*certReloader
+	handlers := map[string]http.Handler{}
+	for _, l := range serverListeners(cfg) {
+		handler, ok := handlers[l.role()]
+		if !ok {
+			handler = withAccessLog(withRecovery(withBasePath(withClientAllowlist(withRateLimit(withIdentityHeaders(withCORS(newMux(l.role()))))))))
+			handlers[l.role()] = handler
 		}
-	} else {
-		// Get parameters from query string (legacy mode)
-		host = r.URL.Query().Get("host")
-		user = r.URL.Query().Get("user")
-		password = r.URL.Query().Get("password")
-		privateKeyB64 := r.URL.Query().Get("privatekey")
-
-		if privateKeyB64 != "" {
-			privateKey, err = base64.StdEncoding.DecodeString(privateKeyB64)
+		server := newHTTPServer(handler, cfg.Server.Timeouts)
+		if l.TLS.Enabled() {
+			tlsConfig, reloader, err := newTLSConfig(&l.TLS)
 			if err != nil {
-				http.Error(w, "Invalid private key encoding", http.StatusBadRequest)
-				return
+				fatal("Invalid TLS configuration", "addr", l.Address, "err", err)
 			}
+			server.TLSConfig = tlsConfig
+			certs = append(certs, reloader)
 		}
-	}
-
-	if host == "" || user == "" || remotePath == "" {
-		http.Error(w, "Missing required parameters", http.StatusBadRequest)
-		return
-	}
-
-	// Stream file from SSH server directly to response
-	_, err = downloadFileViaSSH(w, remotePath, host, user, password, privateKey)
-	if err != nil {
-		log.Printf("Download failed: %v", err)
-		http.Error(w, "Download failed: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
-func decryptAccess(encrypted string) (SSHCredentials, error) {
-	var creds SSHCredentials
-
-	// Get and validate Fernet key
-	fernetKey := getDefaultFernetKey()
-	if fernetKey == "" {
-		return creds, fmt.Errorf("fernet key not configured")
-	}
-
-	// Decode the Fernet token
-	key, err := fernet.DecodeKeys(fernetKey)
-	if err != nil {
-		return creds, fmt.Errorf("invalid fernet key: %v", err)
-	}
-
-	token_64 := fernet.VerifyAndDecrypt([]byte(encrypted), 0, key)
-	if token_64 == nil {
-		return creds, fmt.Errorf("failed to decrypt access token")
-	}
 
-	token, err := base64.StdEncoding.DecodeString(string(token_64))
-	if err != nil {
-		return creds, err
-	}
-
-	// Parse the decrypted data
-	values, err := url.ParseQuery(string(token))
-	if err != nil {
-		return creds, err
-	}
-
-	creds.User = values.Get("username")
-	creds.Host = values.Get("hostname")
-	creds.PrivateKey = values.Get("privatekey")
-
-	return creds, nil
-}
-
-// getDefaultFernetKey returns the Fernet key from configuration
-func getDefaultFernetKey() string {
-	return config.Security.FernetKey
-}
-
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Check if using access token
-	accessParam := r.URL.Query().Get("access")
-	if accessParam != "" {
-		// Decrypt access token to get credentials
-		creds, err := decryptAccess(accessParam)
+		ln, err := listen(cfg, l)
 		if err != nil {
-			log.Printf("Failed to decrypt access token: %v", err)
-			conn.WriteMessage(websocket.TextMessage, []byte("Error: Invalid access token"))
-			return
+			_, addr := listenAddress(l)
+			fatal("Failed to listen", "addr", addr, "err", err)
 		}
-
-		// Handle SSH connection with decrypted credentials
-		var privateKey []byte
-		if creds.PrivateKey != "" {
-			privateKey, _ = base64.StdEncoding.DecodeString(creds.PrivateKey)
-		}
-		handleSSHConnection(conn, creds.Host, creds.User, creds.Password, privateKey)
-		return
+		servers = append(servers, server)
+		bound = append(bound, boundListener{ListenerConfig: l, ln: ln})
 	}
-
-	// Get credentials from query params or initial message
-	host := r.URL.Query().Get("host")
-	user := r.URL.Query().Get("user")
-	password := r.URL.Query().Get("password")
-	privateKeyB64 := r.URL.Query().Get("privatekey")
-
-	var privateKey []byte
-	if privateKeyB64 != "" {
-		privateKey, err = base64.StdEncoding.DecodeString(privateKeyB64)
+	handoff, drain := bound, servers
+	if listen := cfg.Forwarding.SOCKSListen; listen != "" {
+		socks, err := startSOCKSProxy(listen)
 		if err != nil {
-			log.Printf("Failed to decode private key: %v", err)
-			conn.WriteMessage(websocket.TextMessage, []byte("Error: Invalid private key encoding"))
-			return
+			fatal("Failed to start SOCKS proxy", "addr", socksAddress(listen), "err", err)
 		}
+		handoff = append(handoff[:len(handoff):len(handoff)], socks)
 	}
-
-	// If no credentials in query, wait for initial message with credentials
-	if host == "" {
-		_, msg, err := conn.ReadMessage()
+	if cfg.GRPC.Listen != "" {
+		server, grpcListener, reloader, err := startGRPCServer(cfg)
 		if err != nil {
-			log.Printf("Failed to read credentials: %v", err)
-			return
+			fatal("Failed to start gRPC API", "addr", cfg.GRPC.Listen, "err", err)
 		}
-
-		// Parse credentials from message (format: host|user|password|privatekey_base64)
-		parts := strings.Split(string(msg), "|")
-		if len(parts) >= 2 {
-			host = parts[0]
-			user = parts[1]
-			if len(parts) > 2 {
-				password = parts[2]
+		handoff = append(handoff[:len(handoff):len(handoff)], grpcListener)
+		drain = append(drain[:len(drain):len(drain)], server)
+		certs = append(certs, reloader)
+	}
+	closeInheritedListeners()
+
+	watchSIGHUP(certs)
+	watchSIGUSR2(handoff)
+	stopped := watchShutdown(drain)
+
+	for i, server := range servers {
+		ln := bound[i].ln
+		slog.Info("Server starting", "addr", ln.Addr().String(), "role", bound[i].role(), "tls", server.TLSConfig != nil)
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(ln, "", "")
+			} else {
+				err = server.Serve(ln)
 			}
-			if len(parts) > 3 && parts[3] != "" {
-				privateKey, _ = base64.StdEncoding.DecodeString(parts[3])
+			if err != http.ErrServerClosed {
+				fatal("Server stopped", "addr", ln.Addr().String(), "err", err)
 			}
-		}
+		}()
 	}
-
-	if host == "" || user == "" {
-		conn.WriteMessage(websocket.TextMessage, []byte("Error: Missing host or user"))
-		return
+	signalReady()
+	<-stopped
+	if demo != nil {
+		demo.close()
 	}
+}
 
-	// Handle SSH connection
-	handleSSHConnection(conn, host, user, password, privateKey)
+// newMux registers the endpoints served by listeners with the given role.
+// The health check and version are served on every listener so each can be
+// probed.
+func newMux(role string) *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(group, pattern string, handler http.HandlerFunc) {
+		if role == roleAll || role == group {
+			mux.HandleFunc(pattern, handler)
+		}
+	}
+	// The terminal page moves files and unlocks its session through these,
+	// on the listener that served it, while API clients use them too
+	handlePage := func(pattern string, handler http.HandlerFunc) {
+		if role == roleAll || role == roleUI || role == roleAPI {
+			mux.HandleFunc(pattern, handler)
+		}
+	}
+	handle(roleUI, "/", withSecurityHeaders(indexHandler))
+	handle(roleUI, "/terminal", withSecurityHeaders(terminalHandler))
+	handle(roleUI, "/access", withSecurityHeaders(accessLandingHandler))
+	handle(roleUI, "/ws", withoutDeadlines(wsHandler))
+	handle(roleUI, "/ws-tunnel", withoutDeadlines(tunnelHandler))
+	handle(roleUI, "/ws-join", withoutDeadlines(joinHandler))
+	handle(roleUI, "/consent", consentHandler)
+	handle(roleUI, "/api/check-host", checkHostHandler)
+	handle(roleUI, "/static/", noCacheStaticHandler)
+	handlePage("/upload", withoutDeadlines(apiKeyAuth(scopeUpload, uploadHandler)))
+	handle(roleAPI, "/api/upload/batch", withoutDeadlines(apiKeyAuth(scopeUpload, batchUploadHandler)))
+	handlePage("/download", withoutDeadlines(apiKeyAuth(scopeDownload, downloadHandler)))
+	handle(roleAPI, "/api/files/preview", apiKeyAuth(scopeDownload, previewHandler))
+	handle(roleAPI, "/api/files/search", withoutDeadlines(apiKeyAuth(scopeDownload, searchHandler)))
+	handle(roleAPI, "/api/files/find", withoutDeadlines(apiKeyAuth(scopeDownload, findHandler)))
+	handle(roleAPI, "/api/files/df", apiKeyAuth(scopeDownload, dfHandler))
+	handle(roleAPI, "/api/files/du", apiKeyAuth(scopeDownload, duHandler))
+	handlePage("/validate-download", apiKeyAuth(scopeDownload, validateDownloadHandler))
+	handle(roleAPI, "/api/exec", withoutDeadlines(apiKeyAuth(scopeExec, execHandler)))
+	handle(roleAPI, "/api/jobs", apiKeyAuth(scopeExec, jobsHandler))
+	handle(roleAPI, "/api/jobs/", apiKeyAuth(scopeExec, jobHandler))
+	handle(roleAPI, "/api/schedules", apiKeyRequired(scopeExec, schedulesHandler))
+	handle(roleAPI, "/api/schedules/", apiKeyRequired(scopeExec, scheduleHandler))
+	handle(roleAPI, "/api/sessions", apiKeyAuth(scopeTerminal, sessionsHandler))
+	handlePage("/api/sessions/", apiKeyAuth(scopeTerminal, sessionHandler))
+	handle(roleAPI, "/api/recordings", apiKeyAuth(scopeAdmin, recordingsHandler))
+	handle(roleAPI, "/api/recordings/", apiKeyAuth(scopeAdmin, recordingHandler))
+	handle(roleAPI, "/api/hosts", apiKeyAuth(scopeTerminal, hostsHandler))
+	handle(roleAPI, "/api/hosts/check", apiKeyAuth(scopeTerminal, hostCheckHandler))
+	handle(roleAPI, "/api/approvals", apiKeyAuth(scopeAdmin, approvalsHandler))
+	handle(roleAPI, "/api/approvals/", apiKeyAuth(scopeAdmin, approvalHandler))
+	handle(roleAPI, "/api/profiles", apiKeyAuth(scopeProfiles, profilesHandler))
+	handle(roleAPI, "/api/profiles/", apiKeyAuth(scopeProfiles, profileHandler))
+	handle(roleAPI, "/api/inventory/import", apiKeyAuth(scopeProfiles, inventoryImportHandler))
+	handle(roleAPI, "/api/credentials", apiKeyAuth(scopeAdmin, credentialsHandler))
+	handle(roleAPI, "/api/credentials/", apiKeyAuth(scopeAdmin, credentialHandler))
+	handle(roleAPI, "/api/keys", apiKeyAuth(scopeProfiles, keysHandler))
+	handle(roleAPI, "/api/keys/", apiKeyAuth(scopeProfiles, keyHandler))
+	handle(roleAPI, "/api/recent", apiKeyAuth(scopeProfiles, recentHandler))
+	handle(roleAPI, "/api/admin/keys", apiKeyAuth(scopeAdmin, adminKeysHandler))
+	handle(roleAPI, "/api/maintenance", apiKeyAuth(scopeAdmin, maintenanceHandler))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/api/version", versionHandler)
+	handleMetrics(mux, role)
+	handleDebug(mux, role)
+	return mux
 }
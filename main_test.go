@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListenerRoles(t *testing.T) {
+	useConfig(t, "")
+	tests := []struct {
+		role   string
+		path   string
+		served bool
+	}{
+		{roleUI, "/terminal", true},
+		{roleUI, "/upload", true},
+		{roleUI, "/download", true},
+		{roleUI, "/validate-download", true},
+		{roleUI, "/api/sessions/abc/unlock", true},
+		{roleUI, "/api/admin/keys", false},
+		{roleAPI, "/upload", true},
+		{roleAPI, "/api/sessions/abc/unlock", true},
+		{roleAPI, "/terminal", false},
+		{roleMetrics, "/upload", false},
+		{roleMetrics, "/healthz", true},
+		{roleAll, "/api/admin/keys", true},
+	}
+	for _, tt := range tests {
+		mux := newMux(tt.role)
+		_, pattern := mux.Handler(httptest.NewRequest("GET", tt.path, nil))
+		// The UI's index page catches everything else
+		if served := pattern != "" && pattern != "/"; served != tt.served {
+			t.Errorf("%s listener: %s served by %q, want served %v", tt.role, tt.path, pattern, tt.served)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+const defaultMaintenanceMessage = "This server is under maintenance. Please try again later."
+
+// MaintenanceConfig is the maintenance state the server starts in. It can
+// be switched at runtime through POST /api/maintenance.
+type MaintenanceConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Message string `yaml:"message"`
+}
+
+// maintenanceState refuses new sessions and transfers while enabled.
+// Established sessions keep running.
+type maintenanceState struct {
+	mu      sync.RWMutex
+	enabled bool
+	message string
+	since   time.Time
+	by      string
+}
+
+var maintenance = &maintenanceState{}
+
+// set switches maintenance mode; an empty message uses the default
+func (m *maintenanceState) set(enabled bool, message, by string) {
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if enabled != m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled, m.message, m.by = enabled, message, by
+}
+
+// check returns a maintenance error while new work is refused
+func (m *maintenanceState) check() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.enabled {
+		return nil
+	}
+	return httpapi.Errorf(httpapi.Maintenance, "%s", m.message)
+}
+
+// handedOverMaintenance is the maintenance state passed to a replacement
+// process in GOSSH_MAINTENANCE
+type handedOverMaintenance struct {
+	Enabled bool      `json:"enabled"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+	By      string    `json:"by,omitempty"`
+}
+
+// handoff returns the state for a replacement process
+func (m *maintenanceState) handoff() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, _ := json.Marshal(handedOverMaintenance{Enabled: m.enabled, Message: m.message, Since: m.since, By: m.by})
+	return string(data)
+}
+
+// inherit takes over maintenance mode from the process that handed over
+// its listeners, so a restart neither ends maintenance nor brings back the
+// server.maintenance setting an admin switched off.
+func (m *maintenanceState) inherit() {
+	value := os.Getenv(maintenanceEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(maintenanceEnv)
+	var state handedOverMaintenance
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		slog.Warn("Ignoring invalid "+maintenanceEnv, "err", err)
+		return
+	}
+	m.mu.Lock()
+	m.enabled, m.message, m.since, m.by = state.Enabled, state.Message, state.Since, state.By
+	m.mu.Unlock()
+	if state.Enabled {
+		slog.Warn("Maintenance mode inherited from previous process", "since", state.Since, "by", state.By)
+	}
+}
+
+func (m *maintenanceState) status() map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status := map[string]interface{}{"enabled": m.enabled}
+	if m.enabled {
+		status["message"] = m.message
+		status["since"] = m.since
+		if m.by != "" {
+			status["by"] = m.by
+		}
+	}
+	return status
+}
+
+// maintenanceHandler serves GET and POST /api/maintenance
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid request body")
+			return
+		}
+		admin := apiKeyFromContext(r.Context())
+		maintenance.set(req.Enabled, req.Message, admin.Name)
+
+		action := "maintenance_disable"
+		if req.Enabled {
+			action = "maintenance_enable"
+		}
+		requestLogger(r).Warn("Maintenance mode changed", "enabled", req.Enabled, "admin", admin.Name, "sessions", sessions.count())
+		audit.Emit(AuditEvent{
+			Event:    auditAdminAction,
+			Outcome:  outcomeSuccess,
+			ClientIP: clientIP(r),
+			User:     admin.Name,
+			Action:   action,
+			Target:   "maintenance",
+		})
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	httpapi.JSON(w, map[string]interface{}{
+		"success":     true,
+		"maintenance": maintenance.status(),
+		"sessions":    sessions.count(),
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceHandoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		// bootstrap is server.maintenance.enabled in the new process
+		bootstrap bool
+	}{
+		{"enabled", true, false},
+		{"disabled at runtime", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &maintenanceState{}
+			old.set(tt.enabled, "Upgrading to 2.0", "ops")
+			t.Setenv(maintenanceEnv, old.handoff())
+
+			replacement := &maintenanceState{}
+			replacement.set(tt.bootstrap, "", "")
+			replacement.inherit()
+			if got := replacement.check() != nil; got != tt.enabled {
+				t.Fatalf("maintenance enabled %v after the handoff, want %v", got, tt.enabled)
+			}
+			if !tt.enabled {
+				return
+			}
+			status := replacement.status()
+			if status["message"] != "Upgrading to 2.0" || status["by"] != "ops" || !status["since"].(time.Time).Equal(old.since) {
+				t.Errorf("status %v after the handoff, want that of %+v", status, old)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWithoutHandoff(t *testing.T) {
+	t.Setenv(maintenanceEnv, "")
+	m := &maintenanceState{}
+	m.set(true, "", "")
+	m.inherit()
+	if err := m.check(); err == nil {
+		t.Error("server.maintenance was overridden without a handoff")
+	}
+}
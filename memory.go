@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Each terminal session charges the memory its buffers hold to a budget of
+// session.memory_limit_bytes: its scrollback, the output waiting to be
+// written to the page, and the files of uploads it holds. When a charge
+// doesn't fit, the session gives way in order: the scrollback is dropped,
+// then output waits for earlier output to be written, and then transfers
+// that still don't fit are refused.
+
+// What gives way when a session reaches its memory limit, counted by
+// gossh_session_memory_limited_total
+const (
+	memScrollbackDropped = "scrollback_dropped"
+	memBackpressure      = "backpressure"
+	memTransferRefused   = "transfer_refused"
+)
+
+var memDegradations = []string{memScrollbackDropped, memBackpressure, memTransferRefused}
+
+var sessionMemoryLimited = map[string]*atomic.Int64{
+	memScrollbackDropped: new(atomic.Int64),
+	memBackpressure:      new(atomic.Int64),
+	memTransferRefused:   new(atomic.Int64),
+}
+
+// sessionMemory is the budget of a session's buffers. Methods on a nil
+// sessionMemory charge nothing and never refuse.
+type sessionMemory struct {
+	limit int64
+
+	mu sync.Mutex
+	// room is signalled when output has been written
+	room                          *sync.Cond
+	scrollback, output, transfers int64
+	peak                          int64
+	// dropped is set once the scrollback has been given up; it stays off
+	// for the rest of the session
+	dropped bool
+}
+
+func newSessionMemory(limit int) *sessionMemory {
+	m := &sessionMemory{limit: int64(limit)}
+	m.room = sync.NewCond(&m.mu)
+	return m
+}
+
+// used is what the session holds. The caller holds mu.
+func (m *sessionMemory) used() int64 {
+	return m.scrollback + m.output + m.transfers
+}
+
+// charged notes the peak after a charge. The caller holds mu.
+func (m *sessionMemory) charged() {
+	m.peak = max(m.peak, m.used())
+}
+
+// fits reports whether n more bytes are within the limit, dropping the
+// scrollback if that makes room. The caller holds mu.
+func (m *sessionMemory) fits(n int64) bool {
+	if m.limit <= 0 || m.used()+n <= m.limit {
+		return true
+	}
+	if m.scrollback > 0 {
+		m.scrollback, m.dropped = 0, true
+		sessionMemoryLimited[memScrollbackDropped].Add(1)
+	}
+	return m.used()+n <= m.limit
+}
+
+// keepScrollback charges a scrollback buffer of n bytes, reporting false
+// when it has been dropped or doesn't fit beside what the session holds.
+// The scrollback gives way to everything else, so it never makes room.
+func (m *sessionMemory) keepScrollback(n int) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dropped {
+		return false
+	}
+	if m.limit > 0 && m.used()+int64(n) > m.limit {
+		m.dropped = true
+		sessionMemoryLimited[memScrollbackDropped].Add(1)
+		return false
+	}
+	m.scrollback += int64(n)
+	m.charged()
+	return true
+}
+
+// scrollbackDropped reports whether the scrollback has been given up, in
+// which case its buffer is to be freed
+func (m *sessionMemory) scrollbackDropped() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropped
+}
+
+// releaseScrollback returns the scrollback's buffer, cleared by the user
+func (m *sessionMemory) releaseScrollback() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.scrollback = 0
+	m.mu.Unlock()
+}
+
+// holdOutput charges n bytes of output waiting to be written to the page.
+// When they don't fit it waits for earlier output to be written, which
+// holds the session's reader back; output larger than the limit goes
+// through once nothing else is waiting.
+func (m *sessionMemory) holdOutput(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	waited := false
+	for !m.fits(int64(n)) && m.output > 0 {
+		if !waited {
+			waited = true
+			sessionMemoryLimited[memBackpressure].Add(1)
+		}
+		m.room.Wait()
+	}
+	m.output += int64(n)
+	m.charged()
+}
+
+// releaseOutput returns output once it has been written
+func (m *sessionMemory) releaseOutput(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.output -= int64(n)
+	m.mu.Unlock()
+	m.room.Broadcast()
+}
+
+// holdTransfer charges a file of n bytes a transfer keeps in memory,
+// refusing it when it doesn't fit
+func (m *sessionMemory) holdTransfer(n int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.fits(int64(n)) {
+		sessionMemoryLimited[memTransferRefused].Add(1)
+		return fmt.Errorf("the session's memory limit of %d bytes is reached; wait for other transfers to finish", m.limit)
+	}
+	m.transfers += int64(n)
+	m.charged()
+	return nil
+}
+
+// releaseTransfer returns a transfer's file once it is done with
+func (m *sessionMemory) releaseTransfer(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.transfers -= int64(n)
+	m.mu.Unlock()
+}
+
+// sessionMemoryInfo is a session's memory as /api/sessions lists it, in
+// bytes
+type sessionMemoryInfo struct {
+	Scrollback int64 `json:"scrollback"`
+	Output     int64 `json:"output"`
+	Transfers  int64 `json:"transfers"`
+	Total      int64 `json:"total"`
+	Peak       int64 `json:"peak"`
+	// Limit is session.memory_limit_bytes as of the session's start, 0
+	// for none
+	Limit             int64 `json:"limit"`
+	ScrollbackDropped bool  `json:"scrollback_dropped,omitempty"`
+}
+
+func (m *sessionMemory) info() *sessionMemoryInfo {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &sessionMemoryInfo{
+		Scrollback:        m.scrollback,
+		Output:            m.output,
+		Transfers:         m.transfers,
+		Total:             m.used(),
+		Peak:              m.peak,
+		Limit:             m.limit,
+		ScrollbackDropped: m.dropped,
+	}
+}
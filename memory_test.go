@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// limitedCounts returns the gossh_session_memory_limited_total counters, to
+// compare before and after
+func limitedCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for _, name := range memDegradations {
+		counts[name] = sessionMemoryLimited[name].Load()
+	}
+	return counts
+}
+
+// checkLimited checks how far each counter moved since before
+func checkLimited(t *testing.T, before map[string]int64, want map[string]int64) {
+	t.Helper()
+	for _, name := range memDegradations {
+		if got := sessionMemoryLimited[name].Load() - before[name]; got != want[name] {
+			t.Errorf("%s counted %d times, want %d", name, got, want[name])
+		}
+	}
+}
+
+func TestSessionMemoryDegradationOrder(t *testing.T) {
+	before := limitedCounts()
+	m := newSessionMemory(100)
+	if !m.keepScrollback(60) {
+		t.Fatal("scrollback refused within the limit")
+	}
+	m.holdOutput(30)
+
+	// The scrollback gives way first
+	if err := m.holdTransfer(50); err != nil {
+		t.Fatalf("transfer refused while the scrollback could be dropped: %v", err)
+	}
+	if !m.scrollbackDropped() {
+		t.Error("scrollback kept past the limit")
+	}
+	checkLimited(t, before, map[string]int64{memScrollbackDropped: 1})
+
+	// Then output waits for earlier output to be written
+	done := make(chan struct{})
+	go func() {
+		m.holdOutput(30)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("output held past the limit without waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.releaseOutput(30)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("output still waiting after earlier output was written")
+	}
+	checkLimited(t, before, map[string]int64{memScrollbackDropped: 1, memBackpressure: 1})
+
+	// And transfers that still don't fit are refused
+	if err := m.holdTransfer(50); err == nil {
+		t.Error("transfer past the limit accepted")
+	}
+	checkLimited(t, before, map[string]int64{memScrollbackDropped: 1, memBackpressure: 1, memTransferRefused: 1})
+
+	got := m.info()
+	want := sessionMemoryInfo{Output: 30, Transfers: 50, Total: 80, Peak: 90, Limit: 100, ScrollbackDropped: true}
+	if *got != want {
+		t.Errorf("info %+v, want %+v", *got, want)
+	}
+
+	// The scrollback stays off once dropped, even with room again
+	m.releaseTransfer(50)
+	if m.keepScrollback(10) {
+		t.Error("scrollback taken back after it was dropped")
+	}
+}
+
+func TestSessionMemoryScrollbackNeverMakesRoom(t *testing.T) {
+	before := limitedCounts()
+	m := newSessionMemory(100)
+	if err := m.holdTransfer(80); err != nil {
+		t.Fatal(err)
+	}
+	if m.keepScrollback(40) {
+		t.Error("scrollback kept past the limit")
+	}
+	if got := m.info(); got.Transfers != 80 || got.Scrollback != 0 {
+		t.Errorf("scrollback took room from a transfer: %+v", *got)
+	}
+	checkLimited(t, before, map[string]int64{memScrollbackDropped: 1})
+}
+
+func TestSessionMemoryOversizedOutput(t *testing.T) {
+	m := newSessionMemory(100)
+	done := make(chan struct{})
+	go func() {
+		m.holdOutput(500)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("output larger than the limit waited with nothing else held")
+	}
+	m.releaseOutput(500)
+	if got := m.info(); got.Total != 0 || got.Peak != 500 {
+		t.Errorf("after release %+v, want nothing held and a peak of 500", *got)
+	}
+}
+
+func TestSessionMemoryUnlimited(t *testing.T) {
+	before := limitedCounts()
+	for _, m := range []*sessionMemory{nil, newSessionMemory(0)} {
+		if !m.keepScrollback(1 << 30) {
+			t.Errorf("%v: scrollback refused", m)
+		}
+		m.holdOutput(1 << 30)
+		if err := m.holdTransfer(1 << 30); err != nil {
+			t.Errorf("%v: transfer refused: %v", m, err)
+		}
+		if m.scrollbackDropped() {
+			t.Errorf("%v: scrollback dropped", m)
+		}
+		m.releaseOutput(1 << 30)
+		m.releaseTransfer(1 << 30)
+		m.releaseScrollback()
+	}
+	checkLimited(t, before, nil)
+}
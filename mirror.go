@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mirroring keeps a copy of every file gossh moves, for compliance. Each
+// transfer leaves <time>-<session>-<sha256> in transfers.mirror_dir with a
+// .json sidecar saying who moved it between which hosts and paths.
+
+const (
+	// mirrorTimeFormat stamps mirrored files; it sorts like the times
+	mirrorTimeFormat = "20060102T150405.000Z"
+	// mirrorPartialPrefix marks copies still being written
+	mirrorPartialPrefix = ".partial-"
+	// mirrorJanitorInterval is how often mirrored files past their
+	// retention or the size cap are removed
+	mirrorJanitorInterval = time.Minute
+)
+
+// mirrorRecord is the sidecar of a mirrored file
+type mirrorRecord struct {
+	Direction string    `json:"direction"` // upload or download
+	Protocol  string    `json:"protocol,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	User      string    `json:"user,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	// Session is the terminal session the file moved through, or else the
+	// ID of the request that moved it
+	Session  string       `json:"session"`
+	Filename string       `json:"filename"`
+	Size     int64        `json:"size"`
+	SHA256   string       `json:"sha256"`
+	Hosts    []mirrorHost `json:"hosts"`
+	// Error is why the transfer failed, in which case the copy holds what
+	// had been moved so far
+	Error string `json:"error,omitempty"`
+	// MirrorError is why the copy is incomplete
+	MirrorError string `json:"mirror_error,omitempty"`
+}
+
+// mirrorHost is a host a mirrored file was moved to or from
+type mirrorHost struct {
+	Host    string `json:"host"`
+	SSHUser string `json:"ssh_user,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Success bool   `json:"success"`
+	// Skipped is set when the host already had the file
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// transferMirror copies a transfer as it passes. Unless transfers are
+// strict about it, a copy that fails is logged and given up while the
+// transfer goes on.
+type transferMirror struct {
+	dir    string
+	strict bool
+	rec    mirrorRecord
+	file   *os.File
+	hasher hash.Hash
+	err    error
+}
+
+// startMirror begins the copy of a transfer described by rec, whose
+// Direction, User, ClientIP, Session and Filename should be set. It returns
+// nil when mirroring is off, or when the copy can't be made and failing is
+// not strict.
+func startMirror(rec mirrorRecord) (*transferMirror, error) {
+	cfg := currentConfig().Transfers
+	if cfg.MirrorDir == "" {
+		return nil, nil
+	}
+	mirrors.started.Do(func() { go mirrors.run() })
+
+	rec.Started = time.Now().UTC()
+	m := &transferMirror{dir: cfg.MirrorDir, strict: cfg.MirrorStrict, rec: rec, hasher: sha256.New()}
+	err := os.MkdirAll(cfg.MirrorDir, 0o700)
+	if err == nil {
+		m.file, err = os.CreateTemp(cfg.MirrorDir, mirrorPartialPrefix+"*")
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to mirror transfer: %v", err)
+		if m.strict {
+			return nil, err
+		}
+		slog.Error("Transfer not mirrored", "filename", rec.Filename, "session", rec.Session, "err", err)
+		return nil, nil
+	}
+	return m, nil
+}
+
+// Write copies p. It fails only for strict transfers, once the copy has.
+// Writes to a nil mirror do nothing.
+func (m *transferMirror) Write(p []byte) (int, error) {
+	if m == nil {
+		return len(p), nil
+	}
+	if m.err == nil {
+		if _, err := m.file.Write(p); err != nil {
+			m.err = fmt.Errorf("failed to mirror transfer: %v", err)
+			slog.Error("Transfer mirroring failed", "filename", m.rec.Filename, "session", m.rec.Session, "err", m.err)
+		} else {
+			m.hasher.Write(p)
+			m.rec.Size += int64(len(p))
+		}
+	}
+	if m.err != nil && m.strict {
+		return 0, m.err
+	}
+	return len(p), nil
+}
+
+// reader tees r into the copy
+func (m *transferMirror) reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return io.TeeReader(r, m)
+}
+
+// responseWriter copies what is written to w, before the client gets it
+func (m *transferMirror) responseWriter(w http.ResponseWriter) http.ResponseWriter {
+	if m == nil {
+		return w
+	}
+	return mirrorResponseWriter{ResponseWriter: w, mirror: m}
+}
+
+type mirrorResponseWriter struct {
+	http.ResponseWriter
+	mirror *transferMirror
+}
+
+func (w mirrorResponseWriter) Write(p []byte) (int, error) {
+	if _, err := w.mirror.Write(p); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// finish files the copy with its sidecar once the transfer is over, err
+// being how it ended. A transfer that failed before moving anything leaves
+// nothing. The error is the mirror's, for strict transfers.
+func (m *transferMirror) finish(hosts []mirrorHost, err error) error {
+	if m == nil {
+		return nil
+	}
+	m.rec.Finished = time.Now().UTC()
+	m.rec.Hosts = hosts
+	m.rec.Error = errorString(err)
+	m.rec.SHA256 = hex.EncodeToString(m.hasher.Sum(nil))
+	if closeErr := m.file.Close(); closeErr != nil && m.err == nil {
+		m.err = fmt.Errorf("failed to mirror transfer: %v", closeErr)
+	}
+	if m.rec.Size == 0 && err != nil {
+		os.Remove(m.file.Name())
+		return nil
+	}
+
+	name := filepath.Join(m.dir, fmt.Sprintf("%s-%s-%s", m.rec.Started.Format(mirrorTimeFormat), m.rec.Session, m.rec.SHA256))
+	if m.err != nil {
+		m.rec.MirrorError = m.err.Error()
+	}
+	if renameErr := os.Rename(m.file.Name(), name); renameErr != nil {
+		os.Remove(m.file.Name())
+		if m.err == nil {
+			m.err = fmt.Errorf("failed to mirror transfer: %v", renameErr)
+		}
+		m.rec.MirrorError = m.err.Error()
+	}
+	if sidecarErr := writeMirrorSidecar(name+".json", m.rec); sidecarErr != nil && m.err == nil {
+		m.err = fmt.Errorf("failed to mirror transfer: %v", sidecarErr)
+	}
+	if m.err != nil {
+		slog.Error("Transfer mirroring failed", "filename", m.rec.Filename, "session", m.rec.Session, "err", m.err)
+		if m.strict {
+			return m.err
+		}
+		return nil
+	}
+	mirrors.kick()
+	return nil
+}
+
+// discard drops the copy of a transfer that didn't happen after all
+func (m *transferMirror) discard() {
+	if m == nil {
+		return
+	}
+	m.file.Close()
+	os.Remove(m.file.Name())
+}
+
+// writeMirrorSidecar writes rec to path, which appears complete or not at all
+func writeMirrorSidecar(path string, rec mirrorRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), mirrorPartialPrefix+filepath.Base(path))
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// mirrorJanitor removes mirrored files past transfers.mirror_retention, then
+// the oldest while the directory holds more than transfers.mirror_max_mb
+type mirrorJanitor struct {
+	started sync.Once
+	wake    chan struct{}
+}
+
+var mirrors = &mirrorJanitor{wake: make(chan struct{}, 1)}
+
+// kick prunes soon, as a copy was just filed
+func (j *mirrorJanitor) kick() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (j *mirrorJanitor) run() {
+	ticker := time.NewTicker(mirrorJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-j.wake:
+		}
+		cfg := currentConfig().Transfers
+		if cfg.MirrorDir != "" {
+			j.prune(cfg.MirrorDir, cfg.MirrorRetention, cfg.MirrorMaxMB<<20)
+		}
+	}
+}
+
+type mirroredFile struct {
+	paths []string // the copy and its sidecar
+	time  time.Time
+	size  int64
+}
+
+// prune removes files of dir older than maxAge, then the oldest while the
+// rest are larger than maxBytes. Zero disables either limit. Copies being
+// written are left alone unless they are past maxAge, as when gossh stopped
+// while writing them.
+func (j *mirrorJanitor) prune(dir string, maxAge time.Duration, maxBytes int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Failed to list mirrored files", "dir", dir, "err", err)
+		return
+	}
+	byName := make(map[string]*mirroredFile)
+	var files []*mirroredFile
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(e.Name(), mirrorPartialPrefix) {
+			if maxAge > 0 && time.Since(info.ModTime()) > maxAge {
+				os.Remove(path)
+			}
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".json")
+		f, ok := byName[name]
+		if !ok {
+			f = &mirroredFile{time: info.ModTime()}
+			byName[name] = f
+			files = append(files, f)
+		}
+		f.paths = append(f.paths, path)
+		f.size += info.Size()
+		if info.ModTime().Before(f.time) {
+			f.time = info.ModTime()
+		}
+		total += info.Size()
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].time.Before(files[b].time) })
+
+	for _, f := range files {
+		expired := maxAge > 0 && time.Since(f.time) > maxAge
+		excess := maxBytes > 0 && total > maxBytes
+		if !expired && !excess {
+			break
+		}
+		for _, path := range f.paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				slog.Error("Failed to remove mirrored file", "path", path, "err", err)
+			}
+		}
+		total -= f.size
+	}
+}
+
+// mirrorSession names the session of a transfer in mirrored file names
+func mirrorSession(meta requestMeta, sess *activeSession) string {
+	switch {
+	case sess != nil:
+		return sess.ID
+	case meta.SessionID != "":
+		return meta.SessionID
+	}
+	return meta.RequestID
+}
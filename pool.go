@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultPoolIdleTimeout = 5 * time.Minute
+	// defaultPoolMaxSessions matches sshd's default MaxSessions
+	defaultPoolMaxSessions = 10
+	// poolKeepaliveTimeout bounds the check that a pooled connection is
+	// still alive before it is handed out
+	poolKeepaliveTimeout = 2 * time.Second
+)
+
+// PoolConfig shares SSH connections between requests for the same host,
+// user and credentials, so a terminal, an upload and a download don't each
+// log in
+type PoolConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// IdleTimeout is how long a connection nobody uses is kept
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxSessions is how many users share a connection; keep it at or below
+	// the hosts' MaxSessions
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+func (c *PoolConfig) applyDefaults() {
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultPoolIdleTimeout
+	}
+	if c.MaxSessions <= 0 {
+		c.MaxSessions = defaultPoolMaxSessions
+	}
+}
+
+// poolKey identifies the connections one request may reuse. The
+// credentials are only kept as a fingerprint.
+type poolKey struct {
+	host, user, auth string
+}
+
+// pooledClient is a connection of the pool
+type pooledClient struct {
+	key    poolKey
+	client *ssh.Client
+	users  int
+	// retired connections are closed by their last user
+	retired bool
+	// idle closes the connection once it has been unused for
+	// ssh.pool.idle_timeout
+	idle *time.Timer
+}
+
+// clientPool keeps SSH connections while they are used, and for a while
+// after
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[poolKey][]*pooledClient
+}
+
+var sshPool = &clientPool{clients: make(map[poolKey][]*pooledClient)}
+
+// poolSecret keys the credential fingerprints, so they can't be checked
+// against guessed passwords outside this process
+var poolSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// poolFingerprint tells credentials apart without keeping them
+func poolFingerprint(password string, privateKey []byte) string {
+	mac := hmac.New(sha256.New, poolSecret)
+	fmt.Fprintf(mac, "%d:%s", len(password), password)
+	mac.Write(privateKey)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// connect returns a connection to host as clientConfig.User, reusing one of
+// the pool when it is enabled, and a function to release it. fingerprint
+// identifies the credentials; empty means the connection must not be
+// shared.
+func (p *clientPool) connect(ctx context.Context, meta requestMeta, host string, clientConfig *ssh.ClientConfig, auth *authRecorder, fingerprint string) (*ssh.Client, func(), error) {
+	cfg := currentConfig().SSH.Pool
+	if !cfg.Enabled || fingerprint == "" {
+		client, err := dialSSH(ctx, meta, host, clientConfig, auth)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+
+	key := poolKey{host: host, user: clientConfig.User, auth: fingerprint}
+	for {
+		pc := p.take(key, cfg.MaxSessions)
+		if pc == nil {
+			break
+		}
+		if alive(pc.client) {
+			meta.Log.Debug("Reusing pooled SSH connection", "host", host, "ssh_user", key.user)
+			return pc.client, p.releaser(pc), nil
+		}
+		// Users still on it keep it until they are done
+		meta.Log.Debug("Retiring unresponsive pooled SSH connection", "host", host, "ssh_user", key.user)
+		p.mu.Lock()
+		p.retire(pc)
+		p.mu.Unlock()
+		p.releaser(pc)()
+	}
+
+	client, err := dialSSH(ctx, meta, host, clientConfig, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	// What the user answered, such as a one-time code, isn't part of the
+	// fingerprint
+	if auth.interactive {
+		return client, func() { client.Close() }, nil
+	}
+	pc := &pooledClient{key: key, client: client, users: 1}
+	p.mu.Lock()
+	p.clients[key] = append(p.clients[key], pc)
+	p.mu.Unlock()
+	go func() {
+		client.Wait()
+		p.mu.Lock()
+		p.retire(pc)
+		p.mu.Unlock()
+	}()
+	return client, p.releaser(pc), nil
+}
+
+// take claims a connection for key with room for another user
+func (p *clientPool) take(key poolKey, maxSessions int) *pooledClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.clients[key] {
+		if pc.users < maxSessions {
+			pc.users++
+			if pc.idle != nil {
+				pc.idle.Stop()
+				pc.idle = nil
+			}
+			return pc
+		}
+	}
+	return nil
+}
+
+// releaser returns the function that gives pc back. The last user of a
+// retired connection closes it; otherwise it is closed once it has been
+// idle for ssh.pool.idle_timeout.
+func (p *clientPool) releaser(pc *pooledClient) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			pc.users--
+			switch {
+			case pc.users > 0:
+			case pc.retired:
+				pc.client.Close()
+			default:
+				pc.idle = time.AfterFunc(currentConfig().SSH.Pool.IdleTimeout, func() { p.expire(pc) })
+			}
+		})
+	}
+}
+
+// expire closes pc unless it was taken again meanwhile
+func (p *clientPool) expire(pc *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc.users == 0 && !pc.retired {
+		p.retire(pc)
+		pc.client.Close()
+	}
+}
+
+// retire removes pc from the pool, so it is no longer handed out. The
+// caller holds mu.
+func (p *clientPool) retire(pc *pooledClient) {
+	pc.retired = true
+	list := p.clients[pc.key]
+	for i, c := range list {
+		if c == pc {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(p.clients, pc.key)
+	} else {
+		p.clients[pc.key] = list
+	}
+	if pc.idle != nil {
+		pc.idle.Stop()
+		pc.idle = nil
+	}
+}
+
+// alive sends a keepalive and waits briefly for the answer
+func alive(client *ssh.Client) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(poolKeepaliveTimeout):
+		return false
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// Previews show a window at the start or end of a remote file, such as the
+// last lines of a log, without downloading all of it.
+
+const (
+	// defaultPreviewBytes is the window shown when a preview doesn't say
+	defaultPreviewBytes = 4096
+	// previewTimeout bounds reading the window with head or tail
+	previewTimeout = 30 * time.Second
+)
+
+// previewCommand prints the size of a regular file, then its first or last
+// bytes with head -c or tail -c. Like the hash command of if_changed
+// uploads, it exits with transfer.HashExitMissing when there is no such
+// file. The path is passed through transfer.ShellQuote.
+const previewCommand = `f=%s; [ -f "$f" ] || exit 3; wc -c < "$f" && %s -c %d "$f"`
+
+// previewResponse is the body of a successful /api/files/preview
+type previewResponse struct {
+	Path string `json:"path"`
+	// Size is the size of the whole file; Offset and Length place the
+	// window in it
+	Size   int64  `json:"size"`
+	From   string `json:"from"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+	// Truncated is set when the window doesn't cover the whole file
+	Truncated bool `json:"truncated"`
+	// Binary windows are given as a hex dump, text ones in their Encoding
+	Binary   bool   `json:"binary"`
+	Encoding string `json:"encoding,omitempty"`
+	Content  string `json:"content"`
+}
+
+// previewWindow is the part of a file read for a preview
+type previewWindow struct {
+	Path   string
+	Size   int64
+	Offset int64
+	Data   []byte
+}
+
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+	query := r.URL.Query()
+	remotePath := query.Get("path")
+
+	target, err := resolveTransferTarget(r, opDownload, query.Get)
+	if err == nil && remotePath == "" {
+		err = httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	from := query.Get("from")
+	if from == "" {
+		from = "head"
+	}
+	if err == nil && from != "head" && from != "tail" {
+		err = httpapi.Errorf(httpapi.BadRequest, "Invalid from: expected head or tail")
+	}
+	n := defaultPreviewBytes
+	if s := query.Get("bytes"); s != "" && err == nil {
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			err = httpapi.Errorf(httpapi.BadRequest, "Invalid bytes: expected a positive number")
+		}
+	}
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	if limit := currentConfig().Transfers.PreviewMaxBytes; n > limit {
+		n = limit
+	}
+
+	if !transfer.DownloadPathAllowed(remotePath) {
+		responder.ErrorCode(w, r, httpapi.PathNotAllowed, "Access denied: Downloads are only allowed from /home, /opt, and /tmp directories, or from Users on Windows hosts")
+		return
+	}
+
+	if err := authorize(r, target.Host, target.User, opDownload); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	if err := quotas.check(target.Quotas); err != nil {
+		responder.Error(w, r, err, httpapi.QuotaExceeded)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	ctx, span := startRequestSpan(r, "transfer.preview")
+	var win previewWindow
+	sshConn, release, err := target.connect(ctx, meta)
+	if err == nil {
+		win, err = previewFileViaSSH(meta.Log, sshConn, remotePath, from == "tail", n)
+		release()
+	}
+	if err == nil {
+		err = quotas.charge(target.Quotas, int64(len(win.Data)), meta, opDownload)
+	}
+	span.SetAttributes(attribute.Int64("gossh.transfer.size", int64(len(win.Data))))
+	endSpan(span, err)
+	audit.Emit(AuditEvent{
+		Event:    auditDownload,
+		Outcome:  outcomeOf(err),
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     target.Host,
+		SSHUser:  target.User,
+		Path:     remotePath,
+		Size:     int64(len(win.Data)),
+		Action:   "preview",
+		Error:    errorString(err),
+	})
+	if err != nil {
+		meta.Log.Error("Preview failed", "host", target.Host, "ssh_user", target.User, "path", remotePath, "err", err)
+		responder.Error(w, r, fmt.Errorf("Preview failed: %w", err), httpapi.TransferFailed)
+		return
+	}
+
+	resp := previewResponse{
+		Path:      win.Path,
+		Size:      win.Size,
+		From:      from,
+		Offset:    win.Offset,
+		Length:    len(win.Data),
+		Truncated: int64(len(win.Data)) < win.Size,
+	}
+	if text, encoding, ok := previewText(win.Data, win.Offset == 0, win.Offset+int64(len(win.Data)) >= win.Size); ok {
+		resp.Content, resp.Encoding = text, encoding
+	} else {
+		resp.Content, resp.Binary = previewHexDump(win.Data, win.Offset), true
+	}
+	httpapi.JSON(w, resp)
+}
+
+// previewFileViaSSH reads up to n bytes at the start of the file at
+// remotePath, or at its end for tail. It reads them over SFTP where the
+// host has it, and with head or tail otherwise.
+func previewFileViaSSH(logger *slog.Logger, sshConn *ssh.Client, remotePath string, tail bool, n int) (previewWindow, error) {
+	if transfer.Platform(sshConn) == transfer.Windows {
+		p, err := transfer.WindowsDownloadPath(remotePath)
+		if err != nil {
+			return previewWindow{Path: remotePath}, err
+		}
+		client, err := sftp.NewClient(sshConn)
+		if err != nil {
+			return previewWindow{Path: p}, fmt.Errorf("failed to start SFTP: %v", err)
+		}
+		defer client.Close()
+		win, err := previewFileViaSFTP(client, "/"+p, tail, n)
+		win.Path = p
+		return win, err
+	}
+
+	p, err := transfer.UnixDownloadPath(remotePath)
+	if err != nil {
+		return previewWindow{Path: remotePath}, err
+	}
+	remotePath = p
+	client, err := sftp.NewClient(sshConn)
+	if err == nil {
+		defer client.Close()
+		return previewFileViaSFTP(client, remotePath, tail, n)
+	}
+	logger.Debug("SFTP unavailable, previewing with head or tail", "path", remotePath, "err", err)
+
+	win := previewWindow{Path: remotePath}
+	command := "head"
+	if tail {
+		command = "tail"
+	}
+	out, err := transfer.CommandOutput(sshConn, fmt.Sprintf(previewCommand, transfer.ShellQuote(remotePath), command, n), previewTimeout)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == transfer.HashExitMissing {
+		return win, httpapi.Errorf(httpapi.NotFound, "File not found or not a regular file: %s", remotePath)
+	}
+	if err != nil {
+		return win, fmt.Errorf("failed to read file: %v", err)
+	}
+	sizeLine, data, _ := strings.Cut(out, "\n")
+	if win.Size, err = strconv.ParseInt(strings.TrimSpace(sizeLine), 10, 64); err != nil {
+		return win, fmt.Errorf("failed to get file size: %v", err)
+	}
+	win.Data = []byte(data)
+	if tail {
+		win.Offset = max(win.Size-int64(len(win.Data)), 0)
+	}
+	return win, nil
+}
+
+// previewFileViaSFTP is previewFileViaSSH over an open SFTP connection
+func previewFileViaSFTP(client *sftp.Client, remotePath string, tail bool, n int) (previewWindow, error) {
+	win := previewWindow{Path: remotePath}
+	info, err := client.Stat(remotePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return win, httpapi.Errorf(httpapi.NotFound, "File not found or not a regular file: %s", remotePath)
+	}
+	win.Size = info.Size()
+	if tail {
+		win.Offset = max(win.Size-int64(n), 0)
+	}
+
+	f, err := client.Open(remotePath)
+	if err != nil {
+		return win, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	buf := make([]byte, min(int64(n), win.Size-win.Offset))
+	read, err := f.ReadAt(buf, win.Offset)
+	if err != nil && err != io.EOF {
+		return win, fmt.Errorf("failed to read file: %v", err)
+	}
+	win.Data = buf[:read]
+	return win, nil
+}
+
+// previewText returns data as text, with the encoding it was found in, or
+// false when it looks binary: it isn't UTF-8, or it holds NULs or more than
+// a few control characters. A window that starts or ends within the file
+// may cut a character in two, whose pieces are dropped.
+func previewText(data []byte, atStart, atEnd bool) (string, string, bool) {
+	if atStart {
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	} else {
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.RuneStart(data[0]); i++ {
+			data = data[1:]
+		}
+	}
+	if !atEnd {
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					data = data[:i]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", "", false
+	}
+
+	ascii := true
+	control := 0
+	for _, b := range data {
+		switch {
+		case b >= utf8.RuneSelf:
+			ascii = false
+		case b < 0x20 && !strings.ContainsRune("\t\n\v\f\r\b\x1b", rune(b)), b == 0x7f:
+			control++
+		}
+	}
+	if control > len(data)/100+1 {
+		return "", "", false
+	}
+	if ascii {
+		return string(data), "ascii", true
+	}
+	return string(data), "utf-8", true
+}
+
+// previewHexDump writes data like hexdump -C, with offsets in the file
+func previewHexDump(data []byte, offset int64) string {
+	var b strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		line := hex.Dump(data[i:min(i+16, len(data))])
+		fmt.Fprintf(&b, "%08x%s", offset+int64(i), line[8:])
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gossh/internal/sshtest"
+)
+
+// TestPreviewQuotesPath previews a file whose name the shell would change
+// if it saw it unquoted, on a host without SFTP so head and tail read it
+func TestPreviewQuotesPath(t *testing.T) {
+	useConfig(t, "")
+	server := sshtest.Start(t, nil)
+	server.DisableSFTP()
+	srv := startTestGateway(t)
+
+	// Downloads are only allowed from /tmp and a few other places
+	dir, err := os.MkdirTemp("/tmp", "gossh-preview-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	remotePath := filepath.Join(dir, "it's a $(echo x) `echo y` $HOME log")
+	if err := os.WriteFile(remotePath, []byte("first line\nlast line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for from, want := range map[string]string{"head": "first", "tail": "line\n"} {
+		query := url.Values{
+			"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password},
+			"path": {remotePath}, "from": {from}, "bytes": {"5"},
+		}
+		status, data := callAPI(t, apiRequest(t, srv, "GET", "/api/files/preview?"+query.Encode(), "", nil))
+		var resp previewResponse
+		if err := json.Unmarshal(data, &resp); status != http.StatusOK || err != nil {
+			t.Fatalf("%s: status %d: %s", from, status, data)
+		}
+		if resp.Content != want || resp.Size != 21 || resp.Path != remotePath {
+			t.Errorf("%s: got %+v, want %q of 21 bytes at the same path", from, resp, want)
+		}
+	}
+}
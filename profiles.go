@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gossh/internal/httpapi"
+)
+
+// ProfilesConfig stores connection profiles
+type ProfilesConfig struct {
+	// File keeps the profiles across restarts. Empty keeps them in memory
+	// only. Changes require a restart.
+	File string `yaml:"file"`
+}
+
+// How a profile's sessions log in
+const (
+	profileAuthPassword    = "password" // the user types a password
+	profileAuthKey         = "key"      // the user supplies a private key
+	profileAuthCredentials = "credentials"
+)
+
+// Profile is a saved connection. Secrets are never stored: a profile either
+// leaves them to the user or names a credential source.
+type Profile struct {
+	ID   string `yaml:"id" json:"id"`
+	Name string `yaml:"name" json:"name"`
+	// Host is an address or alias, without a port
+	Host     string `yaml:"host" json:"host"`
+	Port     int    `yaml:"port,omitempty" json:"port,omitempty"`
+	User     string `yaml:"user,omitempty" json:"user,omitempty"`
+	AuthType string `yaml:"auth_type" json:"auth_type"`
+	// Credentials is a source such as "vault:secret/data/ssh/db01", set
+	// when AuthType is credentials
+	Credentials string   `yaml:"credentials,omitempty" json:"credentials,omitempty"`
+	Tags        []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Notes       string   `yaml:"notes,omitempty" json:"notes,omitempty"`
+
+	// Owner is the identity that created the profile; only they and admin
+	// keys may change it
+	Owner   string    `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Created time.Time `yaml:"created" json:"created"`
+	Updated time.Time `yaml:"updated" json:"updated"`
+
+	// Problem is why the profile can't connect, such as its stored
+	// credential having been deleted
+	Problem string `yaml:"-" json:"problem,omitempty"`
+}
+
+// address returns the host with the port when the profile has one
+func (p *Profile) address() string {
+	if p.Port > 0 {
+		return joinPort(p.Host, strconv.Itoa(p.Port))
+	}
+	return joinPort(p.Host, "")
+}
+
+// target resolves where the profile connects and as whom
+func (p *Profile) target() (string, string) {
+	return resolveHost(p.address(), p.User)
+}
+
+// profileRequest is the body of POST /api/profiles and PUT /api/profiles/{id}
+type profileRequest struct {
+	Name        string   `json:"name"`
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	User        string   `json:"user"`
+	AuthType    string   `json:"auth_type"`
+	Credentials string   `json:"credentials"`
+	Tags        []string `json:"tags"`
+	Notes       string   `json:"notes"`
+}
+
+// apply checks the request and copies it to p
+func (req *profileRequest) apply(p *Profile) error {
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing name")
+	case req.Host == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing host")
+	case req.Port < 0 || req.Port > 65535:
+		return httpapi.Errorf(httpapi.BadRequest, "Invalid port %d", req.Port)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err == nil {
+		return httpapi.Errorf(httpapi.BadRequest, "Host must not include a port; set port")
+	}
+	if req.AuthType == "" {
+		req.AuthType = profileAuthPassword
+	}
+	switch req.AuthType {
+	case profileAuthPassword, profileAuthKey:
+		if req.Credentials != "" {
+			return httpapi.Errorf(httpapi.BadRequest, "Credentials only apply to auth_type %q", profileAuthCredentials)
+		}
+	case profileAuthCredentials:
+		if !isCredentialSource(req.Credentials) {
+			return httpapi.Errorf(httpapi.BadRequest, "Credentials must name a source starting with %q, %q, %q or %q", vaultSourcePrefix, vaultSSHSourcePrefix, storedSourcePrefix, managedKeySourcePrefix)
+		}
+		if problem := credentialSourceProblem(req.Credentials); problem != "" {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid credentials: %s", problem)
+		}
+	default:
+		return httpapi.Errorf(httpapi.BadRequest, "Invalid auth_type %q", req.AuthType)
+	}
+	for _, tag := range req.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return httpapi.Errorf(httpapi.BadRequest, "Tags must not be empty")
+		}
+	}
+
+	p.Name = strings.TrimSpace(req.Name)
+	p.Host = req.Host
+	p.Port = req.Port
+	p.User = req.User
+	p.AuthType = req.AuthType
+	p.Credentials = req.Credentials
+	p.Tags = req.Tags
+	p.Notes = req.Notes
+	p.Problem = ""
+	return nil
+}
+
+// profileStore holds the connection profiles, saving every change to the
+// profiles file
+type profileStore struct {
+	mu       sync.Mutex
+	profiles map[string]*Profile
+	// file is profiles.file as of startup
+	file string
+}
+
+var profiles = &profileStore{profiles: make(map[string]*Profile)}
+
+// open loads the profiles kept in file, which need not exist yet
+func (s *profileStore) open(file string) error {
+	if file == "" {
+		return nil
+	}
+	s.file = file
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("profile store %s: %v", file, err)
+	}
+	var list []*Profile
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("profile store %s: %v", file, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range list {
+		if p.ID == "" {
+			return fmt.Errorf("profile store %s: profile %q has no id", file, p.Name)
+		}
+		s.profiles[p.ID] = p
+	}
+	slog.Info("Loaded connection profiles", "file", file, "profiles", len(list))
+	return nil
+}
+
+// save writes every profile to the file, replacing it atomically. The
+// caller holds mu.
+func (s *profileStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := yaml.Marshal(s.sorted())
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.file), ".profiles-*")
+	if err != nil {
+		return fmt.Errorf("Failed to store profiles: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to store profiles: %v", err)
+	}
+	return nil
+}
+
+// sorted lists the profiles by name. The caller holds mu.
+func (s *profileStore) sorted() []*Profile {
+	list := make([]*Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// visibleTo lists, by name, copies of the profiles id may open a terminal
+// session with
+func (s *profileStore) visibleTo(id Identity) []Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Profile
+	for _, p := range s.sorted() {
+		if profileVisible(p, id) {
+			list = append(list, p.withProblem())
+		}
+	}
+	return list
+}
+
+// withProblem returns a copy of p noting why it can't connect, if it can't
+func (p *Profile) withProblem() Profile {
+	c := *p
+	if c.AuthType == profileAuthCredentials {
+		c.Problem = credentialSourceProblem(c.Credentials)
+	}
+	return c
+}
+
+// usingSource returns the IDs of the profiles logging in with source
+func (s *profileStore) usingSource(source string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for _, p := range s.sorted() {
+		if p.AuthType == profileAuthCredentials && p.Credentials == source {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids
+}
+
+// get returns a copy of profile pid if id may use it
+func (s *profileStore) get(pid string, id Identity) (Profile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[pid]
+	if !ok || !profileVisible(p, id) {
+		return Profile{}, false
+	}
+	return p.withProblem(), true
+}
+
+// lookup returns profile pid whoever may see it, for the server's own use
+func (s *profileStore) lookup(pid string) (Profile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[pid]
+	if !ok {
+		return Profile{}, false
+	}
+	return p.withProblem(), true
+}
+
+// put adds or replaces the profiles, saving them all together
+func (s *profileStore) put(list ...*Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := make(map[string]*Profile, len(list))
+	for _, p := range list {
+		if _, done := prev[p.ID]; !done {
+			prev[p.ID] = s.profiles[p.ID]
+		}
+		s.profiles[p.ID] = p
+	}
+	if err := s.save(); err != nil {
+		for id, p := range prev {
+			if p != nil {
+				s.profiles[id] = p
+			} else {
+				delete(s.profiles, id)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// named returns the first profile called name, whoever may see it
+func (s *profileStore) named(name string) (Profile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.sorted() {
+		if p.Name == name {
+			return *p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// remove deletes profile pid. Sessions opened with it keep running; they
+// copied what they needed when they connected.
+func (s *profileStore) remove(pid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.profiles[pid]
+	if !ok {
+		return nil
+	}
+	delete(s.profiles, pid)
+	if err := s.save(); err != nil {
+		s.profiles[pid] = prev
+		return err
+	}
+	return nil
+}
+
+// profileVisible reports whether the authorization rules let id open a
+// terminal session to p's host
+func profileVisible(p *Profile, id Identity) bool {
+	host, _ := p.target()
+	allowed, _ := evaluateAuthz(&currentConfig().Authz, id, host, opTerminal)
+	return allowed
+}
+
+// canModifyProfile reports whether the request may change or delete p: its
+// owner and admin keys may
+func canModifyProfile(r *http.Request, p *Profile) bool {
+	if key := apiKeyFromContext(r.Context()); key != nil && key.hasScope(scopeAdmin) {
+		return true
+	}
+	return p.Owner == requestIdentity(r).User
+}
+
+// decodeProfileRequest reads a profile body into p
+func decodeProfileRequest(w http.ResponseWriter, r *http.Request, p *Profile) error {
+	var req profileRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		return httpapi.Errorf(httpapi.BadRequest, "Invalid JSON body: %v", err)
+	}
+	return req.apply(p)
+}
+
+// authorizeProfile checks the caller may open sessions to p's host, so no
+// one saves a profile they couldn't use
+func authorizeProfile(r *http.Request, p *Profile) error {
+	host, user := p.target()
+	return authorize(r, host, user, opTerminal)
+}
+
+// profilesHandler lists the profiles the caller may use on GET
+// /api/profiles and creates one on POST
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		list := profiles.visibleTo(requestIdentity(r))
+		if list == nil {
+			list = []Profile{}
+		}
+		httpapi.JSON(w, map[string]interface{}{
+			"success":  true,
+			"profiles": list,
+		})
+
+	case "POST":
+		now := time.Now()
+		// Profile IDs are random like job IDs
+		p := &Profile{ID: newJobID(), Owner: requestIdentity(r).User, Created: now, Updated: now}
+		if err := decodeProfileRequest(w, r, p); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+		if err := authorizeProfile(r, p); err != nil {
+			responder.Error(w, r, err, httpapi.Forbidden)
+			return
+		}
+		if err := profiles.put(p); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditProfileChange(r, "profile_create", p.ID)
+		requestLogger(r).Info("Profile created", "profile", p.ID, "name", p.Name, "host", p.Host)
+		httpapi.JSONStatus(w, http.StatusCreated, p)
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// profileHandler returns, replaces and deletes /api/profiles/{id}
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/profiles/")
+	p, ok := profiles.get(id, requestIdentity(r))
+	if !ok {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Profile not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, p)
+
+	case "PUT":
+		if !canModifyProfile(r, &p) {
+			responder.ErrorCode(w, r, httpapi.Forbidden, "Only the profile's owner can change it")
+			return
+		}
+		if err := decodeProfileRequest(w, r, &p); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+		if err := authorizeProfile(r, &p); err != nil {
+			responder.Error(w, r, err, httpapi.Forbidden)
+			return
+		}
+		p.Updated = time.Now()
+		if err := profiles.put(&p); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditProfileChange(r, "profile_update", p.ID)
+		requestLogger(r).Info("Profile updated", "profile", p.ID, "name", p.Name, "host", p.Host)
+		httpapi.JSON(w, p)
+
+	case "DELETE":
+		if !canModifyProfile(r, &p) {
+			responder.ErrorCode(w, r, httpapi.Forbidden, "Only the profile's owner can delete it")
+			return
+		}
+		if err := profiles.remove(p.ID); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditProfileChange(r, "profile_delete", p.ID)
+		requestLogger(r).Info("Profile deleted", "profile", p.ID, "name", p.Name)
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+		})
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+func auditProfileChange(r *http.Request, action, id string) {
+	audit.Emit(AuditEvent{
+		Event:    auditAdminAction,
+		Outcome:  outcomeSuccess,
+		ClientIP: clientIP(r),
+		User:     requestIdentity(r).User,
+		Action:   action,
+		Target:   id,
+	})
+}
+
+// applyProfile fills creds from profile pid. The user and secrets of the
+// request are kept; the profile's user is the default.
+func applyProfile(r *http.Request, creds *SSHCredentials, pid string) error {
+	p, ok := profiles.get(pid, requestIdentity(r))
+	if !ok {
+		return fmt.Errorf("Profile not found")
+	}
+	creds.Host = p.address()
+	if creds.User == "" {
+		creds.User = p.User
+	}
+	creds.Protocol = ""
+	if p.AuthType == profileAuthCredentials {
+		if p.Problem != "" {
+			return fmt.Errorf("Profile %q can't connect: its %s", p.Name, p.Problem)
+		}
+		creds.Source = p.Credentials
+		creds.Password, creds.PrivateKey = "", ""
+	}
+	return nil
+}
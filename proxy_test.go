@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedPort returns a local address nothing listens on
+func closedPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestUnreachableProxyIsAProxyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy string
+	}{
+		{"refused", "http://" + closedPort(t)},
+		{"unresolvable", "socks5://proxy.gossh-test.invalid:1080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, "ssh:\n  proxy: "+tt.proxy+"\n")
+			meta := requestMeta{Log: discardLogger}
+			rec := newConnectRecord(meta, "db01.internal", "tester", 5*time.Second)
+			_, err := dialTarget(context.Background(), meta, "db01.internal", "db01.internal:22", 5*time.Second, rec)
+			if err == nil {
+				t.Fatal("dial through an unreachable proxy succeeded")
+			}
+			if got := dialFailure(err); got != failureProxyUnreachable {
+				t.Errorf("classified as %q, want %q: %v", got, failureProxyUnreachable, err)
+			}
+			cerr := rec.connectError(dialFailure(err), err)
+			if !strings.HasPrefix(cerr.Error(), "proxy unreachable after ") || cerr.Addr != rec.Proxy {
+				t.Errorf("got %q for %s, want the proxy %s to be unreachable", cerr, cerr.Addr, rec.Proxy)
+			}
+			if got := hostOutcome(cerr.Failure); got != connectDialError {
+				t.Errorf("counted as %q, want %q", got, connectDialError)
+			}
+		})
+	}
+}
+
+func TestSourceAndRoutePrecedence(t *testing.T) {
+	useConfig(t, `
+ssh:
+  source_address: 127.0.0.1
+  proxy: http://127.0.0.1:3128
+  hosts:
+    - match: ["*.dmz"]
+      source_address: lo
+    - match: ["db*"]
+      proxy: socks5://127.0.0.1:1080
+    - match: ["db*", "*.lab"]
+      source_address: lo
+      proxy_command: "ssh -W %h:%p jump"
+    - match: ["*.local"]
+      proxy: none
+`)
+	tests := []struct {
+		host, source, proxy, command string
+	}{
+		{"web01", "127.0.0.1", "http://127.0.0.1:3128", ""},
+		// A source address entry leaves the proxy to the global setting
+		{"www.dmz", "lo", "http://127.0.0.1:3128", ""},
+		// The first entry with a route and the first with a source
+		// address are looked up separately
+		{"db01", "lo", "socks5://127.0.0.1:1080", ""},
+		{"build.lab", "lo", "", "ssh -W %h:%p jump"},
+		{"printer.local", "127.0.0.1", "", ""},
+	}
+	cfg := &currentConfig().SSH
+	for _, tt := range tests {
+		proxy, command := cfg.route(tt.host)
+		if source := cfg.sourceFor(tt.host); source != tt.source || proxy != tt.proxy || command != tt.command {
+			t.Errorf("%s: source %q, proxy %q, command %q; want %q, %q, %q", tt.host, source, proxy, command, tt.source, tt.proxy, tt.command)
+		}
+	}
+}
+
+// externalIPv4 returns an IPv4 address of this host other than loopback,
+// which connections to 127.0.0.1 can be bound to
+func externalIPv4(t *testing.T) string {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			return n.IP.String()
+		}
+	}
+	t.Skip("no IPv4 address besides loopback to bind to")
+	return ""
+}
+
+// acceptPeer listens on loopback and reports the address of the first
+// connection. If reply is set it is written to the connection.
+func acceptPeer(t *testing.T, reply string) (addr string, peer <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ch <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		if reply != "" {
+			bufio.NewReader(conn).ReadString('\n')
+			io.WriteString(conn, reply)
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestSourceAddressWhenDialing(t *testing.T) {
+	source := externalIPv4(t)
+	dial := func(t *testing.T, host, addr string) net.Conn {
+		t.Helper()
+		meta := requestMeta{Log: discardLogger}
+		conn, err := dialTarget(context.Background(), meta, host, addr, 5*time.Second, newConnectRecord(meta, host, "tester", 5*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		target, peer := acceptPeer(t, "")
+		useConfig(t, "ssh:\n  source_address: "+source+"\n")
+		dial(t, "127.0.0.1", target)
+		if got := <-peer; got != source {
+			t.Errorf("host reached from %s, want %s", got, source)
+		}
+	})
+
+	// The proxy is reached from the source address, and the host from
+	// wherever the proxy connects
+	t.Run("proxy", func(t *testing.T) {
+		proxy, peer := acceptPeer(t, "HTTP/1.1 200 Connection established\r\n\r\n")
+		useConfig(t, "ssh:\n  source_address: "+source+"\n  proxy: http://"+proxy+"\n")
+		dial(t, "db01.internal", "db01.internal:22")
+		if got := <-peer; got != source {
+			t.Errorf("proxy reached from %s, want %s", got, source)
+		}
+	})
+
+	// A proxy command makes its own connections
+	t.Run("proxy_command", func(t *testing.T) {
+		useConfig(t, "ssh:\n  source_address: "+source+"\n  proxy_command: \"echo SSH-2.0-%h:%p; cat\"\n")
+		conn := dial(t, "db01.internal", "db01.internal:22")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "SSH-2.0-db01.internal:22\n" {
+			t.Errorf("got %q, %v from the proxy command", line, err)
+		}
+	})
+}
+
+func TestSourceAddressErrors(t *testing.T) {
+	useConfig(t, "")
+	for _, source := range []string{"198.51.100.250", "gossh-test0"} {
+		if err := validateSourceAddress(source); err == nil {
+			t.Errorf("%s accepted as a source address", source)
+		}
+	}
+
+	// An address that goes away after the configuration is checked
+	meta := requestMeta{Log: discardLogger}
+	rec := newConnectRecord(meta, "127.0.0.1", "tester", time.Second)
+	_, err := dialTCP(context.Background(), meta, closedPort(t), "198.51.100.250", time.Second, rec)
+	if err == nil || !strings.HasPrefix(err.Error(), "can't bind source address 198.51.100.250") {
+		t.Errorf("got %v, want a bind error", err)
+	}
+	if _, err := sourceAddress("127.0.0.1", "::1"); err == nil {
+		t.Error("IPv4 source address used for an IPv6 host")
+	}
+}
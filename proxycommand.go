@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// safeProxyArg limits what %h, %p and %r expand to. The values come from
+// the request and the command is run by a shell.
+var safeProxyArg = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// validateProxyCommand checks the % escapes of a proxy command
+func validateProxyCommand(command string) error {
+	_, err := expandProxyCommand(command, "host", "22", "user")
+	return err
+}
+
+// expandProxyCommand substitutes %h, %p, %r and %% in command
+func expandProxyCommand(command, host, port, user string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(command); i++ {
+		if command[i] != '%' {
+			b.WriteByte(command[i])
+			continue
+		}
+		if i+1 == len(command) {
+			return "", fmt.Errorf("trailing %% in %q", command)
+		}
+		i++
+		var value string
+		switch command[i] {
+		case 'h':
+			value = host
+		case 'p':
+			value = port
+		case 'r':
+			value = user
+		case '%':
+			b.WriteByte('%')
+			continue
+		default:
+			return "", fmt.Errorf("unknown escape %%%c in %q", command[i], command)
+		}
+		if !safeProxyArg.MatchString(value) {
+			return "", fmt.Errorf("%q can't be passed to the proxy command", value)
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// dialProxyCommand starts the proxy command for addr and returns a
+// connection over its stdin and stdout. It fails unless the command starts
+// talking, which an SSH server does first, within timeout.
+func dialProxyCommand(ctx context.Context, meta requestMeta, command, addr string, timeout time.Duration, rec *connectRecord) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	line, err := expandProxyCommand(command, host, port, rec.SSHUser)
+	if err != nil {
+		return nil, &proxyError{failureProxy, "command", err.Error()}
+	}
+	rec.Proxy = "command"
+
+	_, span := tracer.Start(ctx, "proxy.command")
+	start := time.Now()
+	conn, err := startProxyCommand(meta, line)
+	var br *bufio.Reader
+	if err == nil {
+		br, err = awaitOutput(conn, timeout)
+	}
+	rec.proxy = time.Since(start)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// awaitOutput waits up to timeout for the command's first output, killing
+// it if none comes
+func awaitOutput(conn *commandConn, timeout time.Duration) (*bufio.Reader, error) {
+	br := bufio.NewReader(conn)
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	if _, err := br.Peek(1); err != nil {
+		conn.Close()
+		msg := err.Error()
+		switch {
+		case os.IsTimeout(err):
+			msg = fmt.Sprintf("no SSH banner within %s", timeout)
+		case err == io.EOF:
+			msg = "exited without output; its stderr is in the log"
+		}
+		return nil, &proxyError{failureProxy, "command", msg}
+	}
+	return br, nil
+}
+
+// commandConn is a connection over a proxy command's stdin and stdout.
+// Closing it kills the command and anything it started.
+type commandConn struct {
+	cmd       *exec.Cmd
+	stdin     *os.File
+	stdout    *os.File
+	closeOnce sync.Once
+}
+
+// startProxyCommand runs line with the shell in its own process group,
+// logging what it writes to stderr
+func startProxyCommand(meta requestMeta, line string) (*commandConn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", line)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdinR, stdoutW, stderrW
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, &proxyError{failureProxy, "command", err.Error()}
+	}
+
+	log := meta.Log.With("proxy_command", line, "pid", cmd.Process.Pid)
+	log.Debug("Proxy command started")
+	go func() {
+		scanner := bufio.NewScanner(stderrR)
+		for scanner.Scan() {
+			log.Warn("Proxy command stderr", "line", scanner.Text())
+		}
+		stderrR.Close()
+	}()
+	go func() {
+		err := cmd.Wait()
+		log.Debug("Proxy command exited", "err", err)
+	}()
+	return &commandConn{cmd: cmd, stdin: stdinW, stdout: stdoutR}, nil
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+		c.stdin.Close()
+		c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr{} }
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+	c.stdin.SetWriteDeadline(t)
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *commandConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
+
+// commandAddr is the address of both ends of a commandConn
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "proxy_command" }
+func (commandAddr) String() string  { return "proxy_command" }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// QuotaConfig limits how many bytes a caller may upload and download over
+// a rolling window. Limits are in MiB; 0 leaves that kind unlimited.
+type QuotaConfig struct {
+	Window time.Duration `yaml:"window"`
+	// UserMB applies to each user authenticated by authz.user_header, and
+	// to each client address making transfers without any identity
+	UserMB int64 `yaml:"user_mb"`
+	// APIKeyMB applies to API keys without their own quota_mb
+	APIKeyMB int64 `yaml:"api_key_mb"`
+	// TokenMB applies to access tokens without their own quota_mb
+	TokenMB int64 `yaml:"token_mb"`
+	// WarnPercent emits a quota warning event once usage passes it
+	WarnPercent int `yaml:"warn_percent"`
+}
+
+func (c *QuotaConfig) applyDefaults() {
+	if c.Window <= 0 {
+		c.Window = 24 * time.Hour
+	}
+	if c.WarnPercent <= 0 {
+		c.WarnPercent = 80
+	}
+}
+
+func validateQuotaConfig(cfg QuotaConfig) error {
+	if cfg.UserMB < 0 || cfg.APIKeyMB < 0 || cfg.TokenMB < 0 {
+		return fmt.Errorf("quotas: limits can't be negative")
+	}
+	if cfg.WarnPercent > 100 {
+		return fmt.Errorf("quotas.warn_percent must be at most 100")
+	}
+	return nil
+}
+
+// quotaBucketSize is the granularity of the rolling window
+const quotaBucketSize = time.Minute
+
+// quotaSubject is an account transfers are charged to, such as
+// "user:alice", "api_key:ci", "token:<id>" or "ip:192.0.2.7"
+type quotaSubject struct {
+	Key   string
+	Limit int64 // bytes per window
+}
+
+// quotaToken identifies the access token a transfer or session came from
+type quotaToken struct {
+	ID      string
+	QuotaMB int64 // the token's own limit, 0 for quotas.token_mb
+}
+
+// accessTokenID names an access token in quota accounting and logs without
+// revealing it
+func accessTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestQuotas returns the quotas a transfer by r is charged to: the API
+// key or authenticated user making it, and the access token it uses. A
+// transfer with none of these is charged to the client's address, since
+// anything else it sends could be changed from one request to the next.
+func requestQuotas(r *http.Request, token quotaToken) []quotaSubject {
+	cfg := currentConfig().Quotas
+	var subjects []quotaSubject
+	add := func(key string, mb int64) {
+		if mb > 0 {
+			subjects = append(subjects, quotaSubject{Key: key, Limit: mb << 20})
+		}
+	}
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		mb := key.QuotaMB
+		if mb == 0 {
+			mb = cfg.APIKeyMB
+		}
+		add("api_key:"+key.Name, mb)
+	} else if id := requestIdentity(r); id.Source == "header" && fromTrustedProxy(r) {
+		add("user:"+id.User, cfg.UserMB)
+	} else if token.ID == "" {
+		add("ip:"+clientIP(r), cfg.UserMB)
+	}
+	if token.ID != "" {
+		mb := token.QuotaMB
+		if mb == 0 {
+			mb = cfg.TokenMB
+		}
+		add("token:"+token.ID, mb)
+	}
+	return subjects
+}
+
+// QuotaExceededError is returned once a subject has used its quota
+type QuotaExceededError struct {
+	Subject    string
+	Limit      int64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("transfer quota of %d MiB for %s exceeded, retry in %s", e.Limit>>20, e.Subject, e.RetryAfter.Round(time.Second))
+}
+
+func (e *QuotaExceededError) ErrorCode() (httpapi.Code, time.Duration) {
+	return httpapi.QuotaExceeded, e.RetryAfter
+}
+
+type usageBucket struct {
+	start time.Time
+	bytes int64
+}
+
+type quotaUsage struct {
+	buckets []usageBucket // oldest first
+	warned  bool
+}
+
+// total drops buckets that have left the window and sums the rest
+func (u *quotaUsage) total(window time.Duration, now time.Time) int64 {
+	for len(u.buckets) > 0 && now.Sub(u.buckets[0].start) >= window {
+		u.buckets = u.buckets[1:]
+	}
+	var sum int64
+	for _, b := range u.buckets {
+		sum += b.bytes
+	}
+	return sum
+}
+
+// retryAfter is how long until enough old usage leaves the window for
+// usage to fall below limit
+func (u *quotaUsage) retryAfter(used, limit int64, window time.Duration, now time.Time) time.Duration {
+	for _, b := range u.buckets {
+		used -= b.bytes
+		if used < limit {
+			return b.start.Add(window).Sub(now)
+		}
+	}
+	return 0
+}
+
+// quotaTracker keeps the bytes transferred per subject in memory. It is not
+// part of the configuration, so usage survives reloads.
+type quotaTracker struct {
+	mu        sync.Mutex
+	usage     map[string]*quotaUsage
+	lastSweep time.Time
+}
+
+var quotas = &quotaTracker{usage: make(map[string]*quotaUsage)}
+
+// check returns a QuotaExceededError if any subject has used its quota
+func (t *quotaTracker) check(subjects []quotaSubject) error {
+	if len(subjects) == 0 {
+		return nil
+	}
+	window := currentConfig().Quotas.Window
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range subjects {
+		u, ok := t.usage[s.Key]
+		if !ok {
+			continue
+		}
+		if used := u.total(window, now); used >= s.Limit {
+			return &QuotaExceededError{Subject: s.Key, Limit: s.Limit, RetryAfter: u.retryAfter(used, s.Limit, window, now)}
+		}
+	}
+	return nil
+}
+
+// quotaWarning is a subject that just passed quotas.warn_percent
+type quotaWarning struct {
+	subject quotaSubject
+	used    int64
+}
+
+// charge adds n bytes to every subject. It returns a QuotaExceededError
+// once a subject is over its quota, so the transfer can be stopped.
+func (t *quotaTracker) charge(subjects []quotaSubject, n int64, meta requestMeta, op string) error {
+	if len(subjects) == 0 || n <= 0 {
+		return nil
+	}
+	cfg := currentConfig().Quotas
+	now := time.Now()
+	start := now.Truncate(quotaBucketSize)
+
+	var exceeded error
+	var warnings []quotaWarning
+	t.mu.Lock()
+	t.sweep(cfg.Window, now)
+	for _, s := range subjects {
+		u, ok := t.usage[s.Key]
+		if !ok {
+			u = &quotaUsage{}
+			t.usage[s.Key] = u
+		}
+		if last := len(u.buckets) - 1; last >= 0 && u.buckets[last].start.Equal(start) {
+			u.buckets[last].bytes += n
+		} else {
+			u.buckets = append(u.buckets, usageBucket{start: start, bytes: n})
+		}
+		used := u.total(cfg.Window, now)
+		if used*100 >= s.Limit*int64(cfg.WarnPercent) {
+			if !u.warned {
+				u.warned = true
+				warnings = append(warnings, quotaWarning{subject: s, used: used})
+			}
+		} else {
+			u.warned = false
+		}
+		if used > s.Limit && exceeded == nil {
+			exceeded = &QuotaExceededError{Subject: s.Key, Limit: s.Limit, RetryAfter: u.retryAfter(used, s.Limit, cfg.Window, now)}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, w := range warnings {
+		meta.Log.Warn("Transfer quota nearly used", "quota", w.subject.Key, "used_bytes", w.used, "limit_bytes", w.subject.Limit)
+		audit.Emit(AuditEvent{
+			Event:     auditQuotaWarning,
+			Outcome:   outcomeSuccess,
+			ClientIP:  meta.ClientIP,
+			User:      meta.User,
+			Target:    w.subject.Key,
+			Operation: op,
+			Size:      w.used,
+		})
+	}
+	return exceeded
+}
+
+// sweep forgets subjects without usage in the window, at most once per
+// bucket. The caller holds mu.
+func (t *quotaTracker) sweep(window time.Duration, now time.Time) {
+	if now.Sub(t.lastSweep) < quotaBucketSize {
+		return
+	}
+	t.lastSweep = now
+	for key, u := range t.usage {
+		if u.total(window, now) == 0 {
+			delete(t.usage, key)
+		}
+	}
+}
+
+// quotaMeter charges a transfer's bytes as they pass, so aborted transfers
+// count too
+type quotaMeter struct {
+	subjects []quotaSubject
+	meta     requestMeta
+	op       string
+	// err is set once the transfer went over a quota
+	err error
+}
+
+func (m *quotaMeter) charge(n int) error {
+	if err := quotas.charge(m.subjects, int64(n), m.meta, m.op); err != nil {
+		m.err = err
+	}
+	return m.err
+}
+
+type quotaReader struct {
+	r     io.Reader
+	meter *quotaMeter
+}
+
+func (q quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if qerr := q.meter.charge(n); qerr != nil {
+		return n, qerr
+	}
+	return n, err
+}
+
+// quotaResponseWriter meters a download written to the client
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	meter *quotaMeter
+}
+
+func (q quotaResponseWriter) Write(p []byte) (int, error) {
+	n, err := q.ResponseWriter.Write(p)
+	if qerr := q.meter.charge(n); qerr != nil {
+		return n, qerr
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRequestQuotas(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [10.0.0.1]
+authz:
+  user_header: X-User
+quotas:
+  user_mb: 10
+  api_key_mb: 20
+  token_mb: 30
+`)
+	sum := sha256.Sum256([]byte("secret"))
+	key, err := newAPIKey("ci", sum[:], nil, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		peer  string
+		user  string
+		key   *apiKey
+		token quotaToken
+		want  []string
+	}{
+		{"proxy user", "10.0.0.1:4000", "alice", nil, quotaToken{}, []string{"user:alice"}},
+		{"user header from another peer", "10.0.0.2:4000", "alice", nil, quotaToken{}, []string{"ip:10.0.0.2"}},
+		{"API key", "10.0.0.2:4000", "alice", key, quotaToken{}, []string{"api_key:ci"}},
+		{"token", "10.0.0.2:4000", "", nil, quotaToken{ID: "t1"}, []string{"token:t1"}},
+		{"proxy user with a token", "10.0.0.1:4000", "alice", nil, quotaToken{ID: "t1", QuotaMB: 5}, []string{"user:alice", "token:t1"}},
+		{"anonymous", "192.0.2.7:4000", "", nil, quotaToken{}, []string{"ip:192.0.2.7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/download", nil)
+			r.RemoteAddr = tt.peer
+			r.Header.Set("X-User", tt.user)
+			if tt.key != nil {
+				r = withAPIKey(r, tt.key)
+			}
+			var got []string
+			for _, s := range requestQuotas(r, tt.token) {
+				got = append(got, s.Key)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("charged to %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+// RouteLimit is a per-client token bucket. A rate of 0 leaves the route
+// group unlimited.
+type RouteLimit struct {
+	Rate  float64 `yaml:"rate"`  // requests per second
+	Burst int     `yaml:"burst"` // defaults to the rate, at least 1
+}
+
+// RateLimitConfig limits the requests each client IP may make, per group
+// of routes. Everything is unlimited by default.
+type RateLimitConfig struct {
+	Static    RouteLimit `yaml:"static"`     // pages and static files
+	API       RouteLimit `yaml:"api"`        // /api/* and /metrics
+	Transfer  RouteLimit `yaml:"transfer"`   // /upload, /download, /validate-download, /api/upload/batch
+	WSUpgrade RouteLimit `yaml:"ws_upgrade"` // /ws, /ws-tunnel and /ws-join
+	// MaxClients bounds the buckets kept; the least recently seen client
+	// is forgotten first
+	MaxClients int `yaml:"max_clients"`
+}
+
+func (c *RateLimitConfig) applyDefaults() {
+	for _, l := range []*RouteLimit{&c.Static, &c.API, &c.Transfer, &c.WSUpgrade} {
+		if l.Rate > 0 && l.Burst <= 0 {
+			l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+		}
+	}
+	if c.MaxClients <= 0 {
+		c.MaxClients = 10000
+	}
+}
+
+func validateRateLimitConfig(cfg RateLimitConfig) error {
+	for group, l := range cfg.limits() {
+		if l.Rate < 0 {
+			return fmt.Errorf("security.rate_limit.%s.rate must not be negative", group)
+		}
+	}
+	return nil
+}
+
+// Route groups for rate limiting
+const (
+	routeStatic    = "static"
+	routeAPI       = "api"
+	routeTransfer  = "transfer"
+	routeWSUpgrade = "ws_upgrade"
+)
+
+var routeGroups = []string{routeStatic, routeAPI, routeTransfer, routeWSUpgrade}
+
+func (c *RateLimitConfig) limits() map[string]RouteLimit {
+	return map[string]RouteLimit{
+		routeStatic:    c.Static,
+		routeAPI:       c.API,
+		routeTransfer:  c.Transfer,
+		routeWSUpgrade: c.WSUpgrade,
+	}
+}
+
+// routeGroup classifies a request path, "" for exempt paths
+func routeGroup(path string) string {
+	switch {
+	case path == "/healthz" || path == "/readyz":
+		return ""
+	case path == "/ws" || path == "/ws-tunnel" || path == "/ws-join":
+		return routeWSUpgrade
+	case path == "/upload" || path == "/download" || path == "/validate-download" || path == "/api/upload/batch":
+		return routeTransfer
+	case strings.HasPrefix(path, "/api/") || path == "/metrics":
+		return routeAPI
+	}
+	return routeStatic
+}
+
+// RateLimitedError is returned when a client has used up its requests
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("too many requests, retry in %s", e.RetryAfter.Truncate(time.Second)+time.Second)
+}
+
+func (e *RateLimitedError) ErrorCode() (httpapi.Code, time.Duration) {
+	return httpapi.RateLimited, e.RetryAfter
+}
+
+type rateBucket struct {
+	key    string
+	limit  RouteLimit
+	bucket *tokenBucket
+}
+
+// rateLimiter keeps one token bucket per (route group, client IP) in an LRU
+// list capped at max_clients, like the lockout tracker
+type rateLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// throttled counts refused requests per route group
+	throttled map[string]*atomic.Int64
+}
+
+var rateLimits = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		throttled: make(map[string]*atomic.Int64),
+	}
+	for _, group := range routeGroups {
+		l.throttled[group] = &atomic.Int64{}
+	}
+	return l
+}
+
+// allow takes a token for the client, returning how long to wait when
+// there is none
+func (l *rateLimiter) allow(cfg *RateLimitConfig, group, clientIP string) (bool, time.Duration) {
+	limit := cfg.limits()[group]
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	key := group + "|" + clientIP
+
+	l.mu.Lock()
+	var entry *rateBucket
+	if elem, ok := l.entries[key]; ok {
+		entry = elem.Value.(*rateBucket)
+		l.lru.MoveToFront(elem)
+	}
+	// A reload changing the limit starts the client with a fresh bucket
+	if entry == nil || entry.limit != limit {
+		if elem, ok := l.entries[key]; ok {
+			l.lru.Remove(elem)
+		}
+		entry = &rateBucket{key: key, limit: limit, bucket: newTokenBucket(limit.Rate, limit.Burst)}
+		l.entries[key] = l.lru.PushFront(entry)
+		for l.lru.Len() > cfg.MaxClients {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*rateBucket).key)
+		}
+	}
+	l.mu.Unlock()
+
+	ok, wait := entry.bucket.take()
+	if !ok {
+		l.throttled[group].Add(1)
+	}
+	return ok, wait
+}
+
+// withRateLimit refuses requests beyond security.rate_limit with 429. The
+// client is identified by clientIP, so trusted proxies are seen through.
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := routeGroup(r.URL.Path)
+		if group == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if ok, wait := rateLimits.allow(&currentConfig().Security.RateLimit, group, ip); !ok {
+			requestLogger(r).Debug("Rate limited", "group", group)
+			responder.Error(w, r, &RateLimitedError{RetryAfter: wait}, httpapi.RateLimited)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
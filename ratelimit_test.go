@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// freshRateLimits gives the test buckets of its own
+func freshRateLimits(t *testing.T) {
+	old := rateLimits
+	rateLimits = newRateLimiter()
+	t.Cleanup(func() { rateLimits = old })
+}
+
+// hammer makes n requests to path from peer over workers goroutines and
+// returns the responses
+func hammer(handler http.Handler, path, peer string, n, workers int) []*httptest.ResponseRecorder {
+	var (
+		wg   sync.WaitGroup
+		next atomic.Int64
+	)
+	results := make([]*httptest.ResponseRecorder, n)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1)) - 1; i < n; i = int(next.Add(1)) - 1 {
+				r := httptest.NewRequest("GET", path, nil)
+				r.RemoteAddr = peer
+				results[i] = httptest.NewRecorder()
+				handler.ServeHTTP(results[i], r)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func countStatus(results []*httptest.ResponseRecorder, status int) int {
+	n := 0
+	for _, res := range results {
+		if res.Code == status {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRouteGroup(t *testing.T) {
+	tests := map[string]string{
+		"/":                  routeStatic,
+		"/static/app.js":     routeStatic,
+		"/terminal":          routeStatic,
+		"/api/sessions":      routeAPI,
+		"/metrics":           routeAPI,
+		"/upload":            routeTransfer,
+		"/download":          routeTransfer,
+		"/validate-download": routeTransfer,
+		"/api/upload/batch":  routeTransfer,
+		"/ws":                routeWSUpgrade,
+		"/ws-tunnel":         routeWSUpgrade,
+		"/ws-join":           routeWSUpgrade,
+		"/healthz":           "",
+		"/readyz":            "",
+	}
+	for path, want := range tests {
+		if got := routeGroup(path); got != want {
+			t.Errorf("%s is in group %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	useConfig(t, `
+security:
+  fernet_key: `+testFernetKey+`
+  rate_limit:
+    api: {rate: 0.001, burst: 20}
+    ws_upgrade: {rate: 0.001, burst: 5}
+`)
+	freshRateLimits(t)
+	handler := withRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	results := hammer(handler, "/api/sessions", "203.0.113.5:40000", 200, 16)
+	if ok, limited := countStatus(results, http.StatusOK), countStatus(results, http.StatusTooManyRequests); ok != 20 || limited != 180 {
+		t.Fatalf("%d allowed and %d refused, want 20 and 180", ok, limited)
+	}
+	for _, res := range results {
+		if res.Code != http.StatusTooManyRequests {
+			continue
+		}
+		if secs, err := strconv.Atoi(res.Header().Get("Retry-After")); err != nil || secs < 1 {
+			t.Fatalf("429 with Retry-After %q", res.Header().Get("Retry-After"))
+		}
+	}
+	if got := rateLimits.throttled[routeAPI].Load(); got != 180 {
+		t.Errorf("%d api requests counted as throttled, want 180", got)
+	}
+
+	// Groups and clients have buckets of their own
+	if ok := countStatus(hammer(handler, "/ws-join", "203.0.113.5:40000", 50, 8), http.StatusOK); ok != 5 {
+		t.Errorf("%d of /ws-join allowed, want the ws_upgrade burst of 5", ok)
+	}
+	if ok := countStatus(hammer(handler, "/api/sessions", "198.51.100.7:40000", 50, 8), http.StatusOK); ok != 20 {
+		t.Errorf("%d allowed for another client, want its own burst of 20", ok)
+	}
+	// Unlimited groups and health checks are never refused
+	for _, path := range []string{"/static/app.js", "/healthz"} {
+		if ok := countStatus(hammer(handler, path, "203.0.113.5:40000", 100, 8), http.StatusOK); ok != 100 {
+			t.Errorf("%d of 100 requests to %s allowed", ok, path)
+		}
+	}
+	if got := rateLimits.throttled[routeStatic].Load(); got != 0 {
+		t.Errorf("%d static requests counted as throttled", got)
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	cfg := &RateLimitConfig{API: RouteLimit{Rate: 0.001, Burst: 1}, MaxClients: 2}
+	l := newRateLimiter()
+	allow := func(ip string) bool {
+		ok, _ := l.allow(cfg, routeAPI, ip)
+		return ok
+	}
+	allow("10.0.0.1")
+	allow("10.0.0.2")
+	// Seen again, 10.0.0.1 is the most recent and 10.0.0.2 is forgotten
+	if allow("10.0.0.1") {
+		t.Error("10.0.0.1 got a second request")
+	}
+	allow("10.0.0.3")
+	if !allow("10.0.0.2") {
+		t.Error("10.0.0.2 wasn't forgotten")
+	}
+	// 10.0.0.2 came back, pushing out 10.0.0.1
+	if !allow("10.0.0.1") {
+		t.Error("10.0.0.1 wasn't forgotten")
+	}
+
+	// Many clients at once never keep more than max_clients buckets
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				allow(fmt.Sprintf("192.0.2.%d", (i*50+j)%250))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := l.lru.Len(); n > cfg.MaxClients || len(l.entries) != n {
+		t.Errorf("%d buckets in the list and %d in the map, want at most %d", n, len(l.entries), cfg.MaxClients)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gossh/internal/httpapi"
+)
+
+const (
+	defaultRecordingFormat = "typescript"
+	// recordingTerm and the initial size are what sessions' PTYs are
+	// requested with
+	recordingTerm                = "xterm-256color"
+	recordingCols, recordingRows = 80, 40
+	typescriptTime               = "2006-01-02 15:04:05-07:00"
+	// recordingSidecar ends the name of a recording's description
+	recordingSidecar = ".json"
+)
+
+// RecordingConfig records the output of every terminal session for
+// playback and audit
+type RecordingConfig struct {
+	// Dir receives the recordings; empty records nothing
+	Dir string `yaml:"dir"`
+	// Format is what recordings are written as, see recordingFormats: one
+	// name, or several separated by commas to write each
+	Format string `yaml:"format"`
+}
+
+func (c *RecordingConfig) applyDefaults() {
+	if c.Format == "" {
+		c.Format = defaultRecordingFormat
+	}
+}
+
+// formats lists the names in Format
+func (c RecordingConfig) formats() []string {
+	var names []string
+	for _, name := range strings.Split(c.Format, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func validateRecordingConfig(c RecordingConfig) error {
+	names := c.formats()
+	if len(names) == 0 {
+		return fmt.Errorf("recording.format is empty")
+	}
+	for i, name := range names {
+		if _, ok := recordingFormats[name]; !ok {
+			known := make([]string, 0, len(recordingFormats))
+			for name := range recordingFormats {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("recording.format must name some of %s, not %q", strings.Join(known, ", "), name)
+		}
+		if slices.Contains(names[:i], name) {
+			return fmt.Errorf("recording.format names %s twice", name)
+		}
+	}
+	return nil
+}
+
+// recordingWriter writes a recording in one format. Delays are the time
+// since the previous event, as scriptreplay takes them.
+type recordingWriter interface {
+	output(delay time.Duration, data []byte) error
+	resize(delay time.Duration, cols, rows int) error
+	// close ends the recording, elapsed after it started
+	close(delay, elapsed time.Duration, ended time.Time) error
+}
+
+// recordingFormats are the formats recordings can be written in, by name.
+// Each returns its writer and the files it writes, by the name
+// /api/recordings/{id}/{file} serves them under.
+var recordingFormats = map[string]func(dir string, meta *recordingMeta) (recordingWriter, map[string]string, error){
+	// typescript is util-linux script's: the output as it was sent, after a
+	// "Script started" line, and a timing file in its advanced format,
+	// which keeps window size changes. scriptreplay plays them:
+	//   scriptreplay -T <id>.timing -B <id>.typescript
+	"typescript": newTypescriptWriter,
+	// asciicast is asciinema's v2 format, one <id>.cast file of JSON lines
+	// that asciinema play and asciinema-player take:
+	//   asciinema play <id>.cast
+	"asciicast": newAsciicastWriter,
+}
+
+// recordingWriters writes a recording in each of several formats
+type recordingWriters []recordingWriter
+
+func (ws recordingWriters) output(delay time.Duration, data []byte) error {
+	for _, w := range ws {
+		if err := w.output(delay, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ws recordingWriters) resize(delay time.Duration, cols, rows int) error {
+	for _, w := range ws {
+		if err := w.resize(delay, cols, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes every writer, returning the first error
+func (ws recordingWriters) close(delay, elapsed time.Duration, ended time.Time) error {
+	var first error
+	for _, w := range ws {
+		if err := w.close(delay, elapsed, ended); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// recordingMeta describes a recording, as its sidecar file and
+// /api/recordings give it
+type recordingMeta struct {
+	ID string `json:"id"` // the session's
+	// Format is the recording's format, or its formats separated by
+	// commas when recording.format named several
+	Format   string `json:"format"`
+	User     string `json:"user,omitempty"`
+	ClientIP string `json:"client_ip"`
+	Host     string `json:"host"`
+	SSHUser  string `json:"ssh_user,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// Participants joined the user in a dual-control session
+	Participants []string  `json:"participants,omitempty"`
+	Started      time.Time `json:"started"`
+	// Ended is unset while the session is open, and left so by a crash
+	Ended *time.Time `json:"ended,omitempty"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	Bytes    int64   `json:"bytes"`
+	// Files are the recording's files in all its formats, by name, e.g.
+	// "typescript" and "timing"
+	Files map[string]string `json:"files"`
+}
+
+// sessionRecording records a session in each of recording.format. Writing stops,
+// with a warning, at the first error; the session goes on. A nil
+// recording records nothing.
+type sessionRecording struct {
+	dir string
+
+	mu      sync.Mutex
+	meta    recordingMeta
+	writer  recordingWriters
+	last    time.Time
+	stopped bool
+}
+
+// startRecording begins recording s when recording.dir is set
+func startRecording(s *activeSession) *sessionRecording {
+	cfg := currentConfig().Recording
+	if cfg.Dir == "" {
+		return nil
+	}
+	rec := &sessionRecording{
+		dir: cfg.Dir,
+		meta: recordingMeta{
+			ID:           s.ID,
+			Format:       strings.Join(cfg.formats(), ","),
+			User:         s.User,
+			ClientIP:     s.ClientIP,
+			Host:         s.Host,
+			SSHUser:      s.SSHUser,
+			Protocol:     s.Protocol,
+			Participants: s.shared.participantNames(),
+			Started:      s.Started,
+		},
+		last: s.Started,
+	}
+	rec.meta.Files = map[string]string{}
+	err := os.MkdirAll(cfg.Dir, 0700)
+	for _, name := range cfg.formats() {
+		if err != nil {
+			break
+		}
+		var w recordingWriter
+		var files map[string]string
+		if w, files, err = recordingFormats[name](cfg.Dir, &rec.meta); err == nil {
+			rec.writer = append(rec.writer, w)
+			maps.Copy(rec.meta.Files, files)
+		}
+	}
+	if err == nil {
+		err = rec.saveMeta()
+	}
+	if err != nil {
+		rec.writer.close(0, 0, time.Now())
+		slog.Error("Failed to start session recording", "session_id", s.ID, "err", err)
+		return nil
+	}
+	return rec
+}
+
+// saveMeta writes the sidecar and indexes the recording. The caller holds
+// mu, or has the recording to itself.
+func (rec *sessionRecording) saveMeta() error {
+	if err := saveRecordingMeta(rec.dir, rec.meta); err != nil {
+		return err
+	}
+	recordings.put(rec.meta)
+	return nil
+}
+
+// saveRecordingMeta writes a recording's sidecar
+func saveRecordingMeta(dir string, meta recordingMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, meta.ID+recordingSidecar)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// record runs write with the delay since the previous event, stopping the
+// recording if it fails. The caller holds mu.
+func (rec *sessionRecording) record(write func(delay time.Duration) error) {
+	if rec.stopped {
+		return
+	}
+	now := time.Now()
+	delay := now.Sub(rec.last)
+	rec.last = now
+	if err := write(delay); err != nil {
+		rec.stopped = true
+		slog.Warn("Session recording stopped", "session_id", rec.meta.ID, "err", err)
+	}
+}
+
+// output records output sent to the page
+func (rec *sessionRecording) output(data []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.meta.Bytes += int64(len(data))
+	rec.record(func(delay time.Duration) error { return rec.writer.output(delay, data) })
+}
+
+// resize records a change of the terminal's size
+func (rec *sessionRecording) resize(cols, rows int) {
+	if rec == nil || cols <= 0 || rows <= 0 {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record(func(delay time.Duration) error { return rec.writer.resize(delay, cols, rows) })
+}
+
+// participants notes the users who have joined the session
+func (rec *sessionRecording) participants(names []string) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.meta.Participants = names
+	if err := rec.saveMeta(); err != nil {
+		slog.Warn("Failed to save session recording", "session_id", rec.meta.ID, "err", err)
+	}
+}
+
+// finish ends the recording along with its session
+func (rec *sessionRecording) finish() {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	ended := time.Now()
+	elapsed := ended.Sub(rec.meta.Started)
+	rec.record(func(delay time.Duration) error { return rec.writer.close(delay, elapsed, ended) })
+	rec.stopped = true
+	rec.meta.Ended = &ended
+	rec.meta.Duration = elapsed.Seconds()
+	if err := rec.saveMeta(); err != nil {
+		slog.Warn("Failed to save session recording", "session_id", rec.meta.ID, "err", err)
+	}
+}
+
+// typescriptWriter writes a recording as util-linux script does
+type typescriptWriter struct {
+	out, timing *os.File
+}
+
+func newTypescriptWriter(dir string, meta *recordingMeta) (recordingWriter, map[string]string, error) {
+	files := map[string]string{"typescript": meta.ID + ".typescript", "timing": meta.ID + ".timing"}
+	w := &typescriptWriter{}
+	var err error
+	open := func(name string) *os.File {
+		if err != nil {
+			return nil
+		}
+		var f *os.File
+		f, err = os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		return f
+	}
+	w.out, w.timing = open(files["typescript"]), open(files["timing"])
+	if err == nil {
+		start := meta.Started.Format(typescriptTime)
+		_, err = fmt.Fprintf(w.out, "Script started on %s [TERM=%q TTY=\"gossh\" COLUMNS=\"%d\" LINES=\"%d\"]\n", start, recordingTerm, recordingCols, recordingRows)
+		if err == nil {
+			_, err = fmt.Fprintf(w.timing, "H 0.000000 START_TIME %s\nH 0.000000 TERM %s\nH 0.000000 COLUMNS %d\nH 0.000000 LINES %d\nH 0.000000 TIMING_LOG %s\nH 0.000000 OUTPUT_LOG %s\n",
+				start, recordingTerm, recordingCols, recordingRows, files["timing"], files["typescript"])
+		}
+	}
+	if err != nil {
+		for _, f := range []*os.File{w.out, w.timing} {
+			if f != nil {
+				f.Close()
+			}
+		}
+		return nil, nil, err
+	}
+	return w, files, nil
+}
+
+func (w *typescriptWriter) output(delay time.Duration, data []byte) error {
+	if _, err := w.out.Write(data); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w.timing, "O %.6f %d\n", delay.Seconds(), len(data))
+	return err
+}
+
+func (w *typescriptWriter) resize(delay time.Duration, cols, rows int) error {
+	_, err := fmt.Fprintf(w.timing, "S %.6f SIGWINCH ROWS=%d COLS=%d\n", delay.Seconds(), rows, cols)
+	return err
+}
+
+func (w *typescriptWriter) close(delay, elapsed time.Duration, ended time.Time) error {
+	_, err := fmt.Fprintf(w.timing, "H %.6f DURATION %.6f\n", delay.Seconds(), elapsed.Seconds())
+	if err == nil {
+		// scriptreplay stops at the last timed byte, so the footer isn't
+		// played
+		_, err = fmt.Fprintf(w.out, "\nScript done on %s\n", ended.Format(typescriptTime))
+	}
+	for _, f := range []*os.File{w.out, w.timing} {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// asciicastWriter writes a recording in asciicast v2: a header line, then
+// one line per event with its time since the start
+type asciicastWriter struct {
+	out     *os.File
+	elapsed time.Duration
+	// partial is the start of a UTF-8 sequence split across outputs, held
+	// for the next so the event's string isn't mangled
+	partial []byte
+}
+
+// asciicastHeader is the first line of an asciicast v2 file
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env"`
+}
+
+func newAsciicastWriter(dir string, meta *recordingMeta) (recordingWriter, map[string]string, error) {
+	files := map[string]string{"cast": meta.ID + ".cast"}
+	f, err := os.OpenFile(filepath.Join(dir, files["cast"]), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     recordingCols,
+		Height:    recordingRows,
+		Timestamp: meta.Started.Unix(),
+		Env:       map[string]string{"TERM": recordingTerm},
+	})
+	if err == nil {
+		_, err = f.Write(append(header, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &asciicastWriter{out: f}, files, nil
+}
+
+// event writes an event line with a string of data
+func (w *asciicastWriter) event(code string, data []byte) error {
+	var quoted bytes.Buffer
+	enc := json.NewEncoder(&quoted)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(string(data)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w.out, "[%.6f, %q, %s]\n", w.elapsed.Seconds(), code, bytes.TrimSuffix(quoted.Bytes(), []byte("\n")))
+	return err
+}
+
+func (w *asciicastWriter) output(delay time.Duration, data []byte) error {
+	w.elapsed += delay
+	if len(w.partial) > 0 {
+		data, w.partial = append(w.partial, data...), nil
+	}
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				data, w.partial = data[:i], bytes.Clone(data[i:])
+			}
+			break
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return w.event("o", data)
+}
+
+func (w *asciicastWriter) resize(delay time.Duration, cols, rows int) error {
+	w.elapsed += delay
+	return w.event("r", fmt.Appendf(nil, "%dx%d", cols, rows))
+}
+
+func (w *asciicastWriter) close(delay, elapsed time.Duration, ended time.Time) error {
+	var err error
+	if len(w.partial) > 0 {
+		// The session ended within a character
+		w.elapsed += delay
+		err = w.event("o", w.partial)
+	}
+	if closeErr := w.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recordingHandler returns a recording's description on GET
+// /api/recordings/{id}, and its files on /api/recordings/{id}/{file}
+func recordingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	dir := currentConfig().Recording.Dir
+	id, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/recordings/"), "/")
+	meta, ok := recordings.get(id)
+	if !ok {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Recording not found")
+		return
+	}
+	if file == "" {
+		httpapi.JSON(w, meta)
+		return
+	}
+	name, ok := meta.Files[file]
+	if !ok || filepath.Base(name) != name {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Recording has no file "+file)
+		return
+	}
+	audit.Emit(AuditEvent{
+		Event:    auditAdminAction,
+		Outcome:  outcomeSuccess,
+		ClientIP: clientIP(r),
+		User:     requestIdentity(r).User,
+		Action:   "recording_download",
+		Target:   id + "/" + file,
+	})
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
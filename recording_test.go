@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freshRecordings gives the test a recording index of its own
+func freshRecordings(t *testing.T) {
+	old := recordings
+	recordings = &recordingIndex{byID: map[string]recordingMeta{}}
+	t.Cleanup(func() { recordings = old })
+}
+
+func readLines(t *testing.T, name string) []string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAsciicastWriter(t *testing.T) {
+	dir := t.TempDir()
+	started := time.Date(2026, 10, 6, 9, 30, 0, 0, time.UTC)
+	w, files, err := newAsciicastWriter(dir, &recordingMeta{ID: "s1", Started: started})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["cast"] != "s1.cast" || len(files) != 1 {
+		t.Fatalf("files %v, want cast: s1.cast", files)
+	}
+	steps := []error{
+		w.output(500*time.Millisecond, []byte("$ ls\r\n")),
+		// A euro sign split across two outputs is written whole, when the
+		// rest of it arrives
+		w.output(250*time.Millisecond, []byte("\xe2\x82")),
+		w.output(250*time.Millisecond, []byte("\xac \"<&>\"\x1b[0m")),
+		w.resize(time.Second, 120, 50),
+		w.output(0, []byte("x\xf0\x9f")),
+		// The session ending within a character leaves what there was
+		w.close(time.Second, 3*time.Second, started.Add(3*time.Second)),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	want := []string{
+		fmt.Sprintf(`{"version":2,"width":80,"height":40,"timestamp":%d,"env":{"TERM":"xterm-256color"}}`, started.Unix()),
+		`[0.500000, "o", "$ ls\r\n"]`,
+		`[1.000000, "o", "€ \"<&>\"\u001b[0m"]`,
+		`[2.000000, "r", "120x50"]`,
+		`[2.000000, "o", "x"]`,
+		`[3.000000, "o", "��"]`,
+	}
+	got := readLines(t, filepath.Join(dir, "s1.cast"))
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("cast file:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, line := range got {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("line %s isn't JSON", line)
+		}
+	}
+}
+
+func TestRecordingInBothFormats(t *testing.T) {
+	dir := t.TempDir()
+	useConfig(t, "recording:\n  dir: "+dir+"\n  format: typescript, asciicast\n")
+	freshRecordings(t)
+
+	started := time.Now()
+	rec := startRecording(&activeSession{ID: "both", User: "alice", Host: "db01:22", Started: started})
+	if rec == nil {
+		t.Fatal("no recording")
+	}
+	rec.output([]byte("hello\r\n"))
+	rec.resize(100, 30)
+	rec.output([]byte("world\r\n"))
+	rec.finish()
+
+	meta, ok := recordings.get("both")
+	if !ok {
+		t.Fatal("the recording isn't indexed")
+	}
+	wantFiles := map[string]string{"typescript": "both.typescript", "timing": "both.timing", "cast": "both.cast"}
+	if meta.Format != "typescript,asciicast" || fmt.Sprint(meta.Files) != fmt.Sprint(wantFiles) || meta.Bytes != 14 || meta.Ended == nil {
+		t.Errorf("meta %+v, want both formats' files", meta)
+	}
+
+	typescript, err := os.ReadFile(filepath.Join(dir, "both.typescript"))
+	if err != nil || !strings.Contains(string(typescript), "\nhello\r\nworld\r\n\nScript done on ") {
+		t.Errorf("typescript %q, %v", typescript, err)
+	}
+	timing := readLines(t, filepath.Join(dir, "both.timing"))
+	if len(timing) != 10 || !strings.HasPrefix(timing[6], "O ") || !strings.HasSuffix(timing[7], " SIGWINCH ROWS=30 COLS=100") || !strings.HasPrefix(timing[9], "H ") {
+		t.Errorf("timing %q", timing)
+	}
+
+	// The cast has the same events
+	var codes, data []string
+	for _, line := range readLines(t, filepath.Join(dir, "both.cast"))[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("event %s: %v", line, err)
+		}
+		codes = append(codes, event[1].(string))
+		data = append(data, event[2].(string))
+	}
+	if strings.Join(codes, " ") != "o r o" || strings.Join(data, "|") != "hello\r\n|100x30|world\r\n" {
+		t.Errorf("cast events %q: %q", codes, data)
+	}
+
+	// The sidecar says the same
+	sidecar, err := os.ReadFile(filepath.Join(dir, "both.json"))
+	var saved recordingMeta
+	if err == nil {
+		err = json.Unmarshal(sidecar, &saved)
+	}
+	if err != nil || saved.Format != meta.Format || len(saved.Files) != 3 {
+		t.Errorf("sidecar %s, %v", sidecar, err)
+	}
+}
+
+func TestRecordingIndexBackfillsAsciicast(t *testing.T) {
+	dir := t.TempDir()
+	started := time.Date(2026, 10, 6, 9, 30, 0, 0, time.UTC)
+	// A session the server stopped during, recorded only as asciicast
+	meta := recordingMeta{ID: "crashed", Format: "asciicast", Host: "db01", Started: started, Files: map[string]string{"cast": "crashed.cast"}}
+	if err := saveRecordingMeta(dir, meta); err != nil {
+		t.Fatal(err)
+	}
+	cast := fmt.Sprintf(`{"version":2,"width":80,"height":40,"timestamp":%d}
+[0.500000, "o", "hello"]
+[1.250000, "r", "100x30"]
+[4.500000, "o", "€"]
+`, started.Unix())
+	if err := os.WriteFile(filepath.Join(dir, "crashed.cast"), []byte(cast), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ix := &recordingIndex{byID: map[string]recordingMeta{}}
+	if err := ix.open(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := ix.get("crashed")
+	if !ok {
+		t.Fatal("the recording isn't indexed")
+	}
+	if got.Duration != 4.5 || got.Bytes != 8 || got.Ended == nil || !got.Ended.Equal(started.Add(4500*time.Millisecond)) {
+		t.Errorf("meta %+v, want 4.5 seconds and 8 bytes", got)
+	}
+}
+
+func TestValidateRecordingFormats(t *testing.T) {
+	for format, want := range map[string]string{
+		"typescript":            "",
+		"asciicast":             "",
+		"typescript, asciicast": "",
+		"asciicast,asciicast":   "names asciicast twice",
+		"mp4":                   `must name some of asciicast, typescript, not "mp4"`,
+		" , ":                   "recording.format is empty",
+	} {
+		err := validateRecordingConfig(RecordingConfig{Format: format})
+		if (want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), want)) {
+			t.Errorf("format %q: %v, want %q", format, err, want)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+const (
+	defaultRecordingPage = 50
+	maxRecordingPage     = 500
+)
+
+// recordingIndex is the metadata of every recording in recording.dir,
+// searchable by /api/recordings. The sidecars are the store it is loaded
+// from and kept in; recordings made without one, by script or before
+// sidecars were written, get one when the index is opened.
+type recordingIndex struct {
+	mu   sync.RWMutex
+	byID map[string]recordingMeta
+}
+
+var recordings = &recordingIndex{byID: map[string]recordingMeta{}}
+
+// validRecordingID matches the names recordings' files are given: session
+// IDs, or the names of typescripts found in the directory
+var validRecordingID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// open loads the recordings in dir, back-filling the sidecars of those
+// without one and the ends of those whose session never finished
+func (ix *recordingIndex) open(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	backfilled := 0
+	for _, e := range entries {
+		var meta recordingMeta
+		if id, ok := strings.CutSuffix(e.Name(), recordingSidecar); ok && validRecordingID.MatchString(id) {
+			data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			if err == nil {
+				err = json.Unmarshal(data, &meta)
+			}
+			if err != nil {
+				slog.Warn("Skipping unreadable recording", "recording", id, "err", err)
+				continue
+			}
+			meta.ID = id
+			if meta.Ended != nil {
+				ix.put(meta)
+				continue
+			}
+			// The server stopped during the session; its timing file says
+			// how long it went on
+			if timing, ok := meta.Files["timing"]; ok {
+				if ts, err := readTypescriptHeaders(dir, "", timing); err == nil {
+					meta.Duration, meta.Bytes = ts.Duration, max(meta.Bytes, ts.Bytes)
+				}
+			} else if cast, ok := meta.Files["cast"]; ok {
+				if duration, bytes, err := readAsciicastLength(dir, cast); err == nil {
+					meta.Duration, meta.Bytes = duration, max(meta.Bytes, bytes)
+				}
+			}
+		} else if id, ok := strings.CutSuffix(e.Name(), ".typescript"); ok && validRecordingID.MatchString(id) && !names[id+recordingSidecar] {
+			timing := id + ".timing"
+			if !names[timing] {
+				timing = ""
+			}
+			ts, err := readTypescriptHeaders(dir, e.Name(), timing)
+			if err != nil {
+				slog.Warn("Skipping unreadable recording", "recording", id, "err", err)
+				continue
+			}
+			meta = ts
+			meta.ID = id
+		} else {
+			continue
+		}
+		ended := meta.Started.Add(time.Duration(meta.Duration * float64(time.Second)))
+		meta.Ended = &ended
+		if err := saveRecordingMeta(dir, meta); err != nil {
+			return fmt.Errorf("back-filling recording %s: %v", meta.ID, err)
+		}
+		ix.put(meta)
+		backfilled++
+	}
+	slog.Info("Loaded session recordings", "dir", dir, "recordings", len(ix.byID), "backfilled", backfilled)
+	return nil
+}
+
+// readTypescriptHeaders describes a recording from script's files: when it
+// started from the timing file's START_TIME or the typescript's "Script
+// started on" line, and its length and output from the timing file. Either
+// name may be empty.
+func readTypescriptHeaders(dir, typescript, timing string) (recordingMeta, error) {
+	meta := recordingMeta{Format: "typescript", Files: map[string]string{}}
+	if typescript != "" {
+		meta.Files["typescript"] = typescript
+		f, err := os.Open(filepath.Join(dir, typescript))
+		if err != nil {
+			return meta, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return meta, err
+		}
+		meta.Started = info.ModTime()
+		line, _ := bufio.NewReader(f).ReadString('\n')
+		meta.Bytes = info.Size() - int64(len(line))
+		if rest, ok := strings.CutPrefix(line, "Script started on "); ok {
+			rest, _, _ = strings.Cut(strings.TrimSpace(rest), " [")
+			for _, layout := range []string{typescriptTime, "Mon 02 Jan 2006 03:04:05 PM MST", time.UnixDate, time.ANSIC} {
+				if t, err := time.Parse(layout, rest); err == nil {
+					meta.Started = t
+					break
+				}
+			}
+		}
+	}
+	if timing == "" {
+		return meta, nil
+	}
+	meta.Files["timing"] = timing
+	f, err := os.Open(filepath.Join(dir, timing))
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	var elapsed, duration float64
+	var bytes int64
+	sawDuration := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The classic format is "delay bytes"; the advanced one starts each
+		// line with its type: O, I, S or H
+		if len(fields) == 2 {
+			fields = append([]string{"O"}, fields...)
+		}
+		if len(fields) < 3 {
+			continue
+		}
+		delay, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		elapsed += delay
+		switch fields[0] {
+		case "O":
+			n, _ := strconv.ParseInt(fields[2], 10, 64)
+			bytes += n
+		case "H":
+			value := strings.Join(fields[3:], " ")
+			switch fields[2] {
+			case "START_TIME":
+				if t, err := time.Parse(typescriptTime, value); err == nil {
+					meta.Started = t
+				}
+			case "DURATION":
+				if d, err := strconv.ParseFloat(value, 64); err == nil {
+					duration, sawDuration = d, true
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return meta, err
+	}
+	if !sawDuration {
+		duration = elapsed
+	}
+	meta.Duration, meta.Bytes = duration, bytes
+	return meta, nil
+}
+
+// readAsciicastLength returns the time of the last event of an asciicast
+// v2 file, in seconds, and the bytes of output it holds
+func readAsciicastLength(dir, name string) (float64, int64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var duration float64
+	var bytes int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		// The header is an object, so it doesn't decode as an event
+		var event []interface{}
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 {
+			continue
+		}
+		at, _ := event[0].(float64)
+		code, _ := event[1].(string)
+		data, _ := event[2].(string)
+		duration = max(duration, at)
+		if code == "o" {
+			bytes += int64(len(data))
+		}
+	}
+	return duration, bytes, scanner.Err()
+}
+
+// put adds or updates a recording
+func (ix *recordingIndex) put(meta recordingMeta) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.byID[meta.ID] = meta
+}
+
+func (ix *recordingIndex) get(id string) (recordingMeta, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	meta, ok := ix.byID[id]
+	return meta, ok
+}
+
+// recordingQuery is a search of /api/recordings
+type recordingQuery struct {
+	host, user, sshUser string
+	// since and until select recordings of sessions open at some time
+	// between them
+	since, until time.Time
+	minDuration  time.Duration
+	// terms must each appear in a recording's metadata
+	terms []string
+	limit int
+	// after is the ID of the last recording of the previous page
+	after string
+}
+
+// parseRecordingQuery reads the search parameters of /api/recordings
+func parseRecordingQuery(q url.Values) (recordingQuery, error) {
+	rq := recordingQuery{
+		host:    q.Get("host"),
+		user:    q.Get("user"),
+		sshUser: q.Get("ssh_user"),
+		terms:   strings.Fields(strings.ToLower(q.Get("q"))),
+		limit:   defaultRecordingPage,
+		after:   q.Get("after"),
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &rq.since}, {"until", &rq.until}} {
+		v := q.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return rq, httpapi.Errorf(httpapi.BadRequest, "Invalid %s %q: expected RFC 3339", bound.name, v)
+		}
+		*bound.t = t
+	}
+	if v := q.Get("min_duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return rq, httpapi.Errorf(httpapi.BadRequest, "Invalid min_duration %q", v)
+		}
+		rq.minDuration = d
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return rq, httpapi.Errorf(httpapi.BadRequest, "Limit must be a positive integer")
+		}
+		rq.limit = min(n, maxRecordingPage)
+	}
+	return rq, nil
+}
+
+// matches reports whether a recording is one the query looks for. Open
+// sessions' recordings count as lasting until now.
+func (rq recordingQuery) matches(meta recordingMeta, now time.Time) bool {
+	if rq.host != "" && !strings.EqualFold(meta.Host, rq.host) {
+		host, _, err := net.SplitHostPort(meta.Host)
+		if err != nil || !strings.EqualFold(host, rq.host) {
+			return false
+		}
+	}
+	if (rq.user != "" && meta.User != rq.user) || (rq.sshUser != "" && meta.SSHUser != rq.sshUser) {
+		return false
+	}
+	ended := now
+	if meta.Ended != nil {
+		ended = *meta.Ended
+	}
+	if (!rq.since.IsZero() && ended.Before(rq.since)) || (!rq.until.IsZero() && meta.Started.After(rq.until)) {
+		return false
+	}
+	if ended.Sub(meta.Started) < rq.minDuration {
+		return false
+	}
+	if len(rq.terms) > 0 {
+		fields := append([]string{meta.ID, meta.User, meta.ClientIP, meta.Host, meta.SSHUser, meta.Protocol, meta.Format}, meta.Participants...)
+		text := strings.ToLower(strings.Join(fields, " "))
+		for _, term := range rq.terms {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// search returns a page of the recordings matching rq, newest first and by
+// ID among those started together, how many match in all, and whether
+// there are more
+func (ix *recordingIndex) search(rq recordingQuery) (page []recordingMeta, total int, more bool, err error) {
+	ix.mu.RLock()
+	var after recordingMeta
+	var hasAfter bool
+	if rq.after != "" {
+		if after, hasAfter = ix.byID[rq.after]; !hasAfter {
+			ix.mu.RUnlock()
+			return nil, 0, false, httpapi.Errorf(httpapi.BadRequest, "Unknown recording %q in after", rq.after)
+		}
+	}
+	now := time.Now()
+	list := []recordingMeta{}
+	for _, meta := range ix.byID {
+		if rq.matches(meta, now) {
+			list = append(list, meta)
+		}
+	}
+	ix.mu.RUnlock()
+
+	newer := func(a, b recordingMeta) int {
+		if c := b.Started.Compare(a.Started); c != 0 {
+			return c
+		}
+		return strings.Compare(b.ID, a.ID)
+	}
+	slices.SortFunc(list, newer)
+	start := 0
+	if hasAfter {
+		start, _ = slices.BinarySearchFunc(list, after, newer)
+		if start < len(list) && list[start].ID == after.ID {
+			start++
+		}
+	}
+	end := min(start+rq.limit, len(list))
+	return list[start:end], len(list), end < len(list), nil
+}
+
+// recordingsHandler searches the recordings on GET /api/recordings, by the
+// host, user, ssh_user, since, until, min_duration and q parameters. Each
+// page holds limit of them; the next is asked for with after set to the
+// last one's ID. Each names its format, so a player can be picked.
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	rq, err := parseRecordingQuery(r.URL.Query())
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	page, total, more, err := recordings.search(rq)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	resp := map[string]interface{}{
+		"success":    true,
+		"recordings": page,
+		"total":      total,
+	}
+	if more {
+		resp["next"] = page[len(page)-1].ID
+	}
+	httpapi.JSON(w, resp)
+}
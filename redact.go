@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// key=value pairs in URLs, query strings and form echoes
+	sensitiveParamPattern = regexp.MustCompile(`(?i)\b(password|privatekey|private_key|passphrase|access|token|secret_id|client_token|session|session_id|session_key)=[^&\s"']*`)
+	// "key": "value" pairs in JSON or YAML echoes
+	sensitiveFieldPattern = regexp.MustCompile(`(?i)("?(?:password|privatekey|private_key|passphrase|access|token|secret_id|client_token|session_key)"?\s*[:=]\s*)"[^"]*"`)
+	// Authorization headers
+	bearerPattern = regexp.MustCompile(`(?i)\b(bearer)\s+[A-Za-z0-9._~+/=-]+`)
+	// PEM encoded key material
+	pemPattern = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+)
+
+// redact removes credentials from a string before it is logged. The
+// default slog handler applies it to every message and attribute.
+func redact(s string) string {
+	s = pemPattern.ReplaceAllString(s, redacted)
+	s = sensitiveParamPattern.ReplaceAllString(s, "${1}="+redacted)
+	s = sensitiveFieldPattern.ReplaceAllString(s, `${1}"`+redacted+`"`)
+	s = bearerPattern.ReplaceAllString(s, "${1} "+redacted)
+	return s
+}
+
+// sensitiveQueryParams never appear in logged URLs. conn is the single-use
+// handoff ID that stands in for an access token, and session and
+// session_id name a terminal session whose connection can be used.
+var sensitiveQueryParams = []string{"password", "privatekey", "private_key", "passphrase", "access", "token", "conn", "session", "session_id", "session_key"}
+
+// redactedRequestURI returns the path and query of u with credential
+// parameters masked
+func redactedRequestURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.EscapedPath()
+	}
+	query := u.Query()
+	for _, name := range sensitiveQueryParams {
+		if _, ok := query[name]; ok {
+			query.Set(name, redacted)
+		}
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// remoteForwardDialTimeout bounds connecting to the exposed local service
+const remoteForwardDialTimeout = 10 * time.Second
+
+// remoteForward asks the SSH host to listen on 127.0.0.1:RemotePort and
+// passes each connection to Local, like ssh -R
+type remoteForward struct {
+	RemotePort int
+	Local      string // host:port as seen from gossh
+}
+
+func (f remoteForward) String() string {
+	return fmt.Sprintf("%d:%s", f.RemotePort, f.Local)
+}
+
+// parseRemoteForward parses "REMOTE_PORT:LOCAL_HOST:LOCAL_PORT"
+func parseRemoteForward(s string) (remoteForward, error) {
+	port, local, ok := strings.Cut(s, ":")
+	remotePort, err := strconv.Atoi(port)
+	if !ok || err != nil || remotePort < 1 || remotePort > 65535 {
+		return remoteForward{}, fmt.Errorf("invalid remote forward %q: want REMOTE_PORT:LOCAL_HOST:LOCAL_PORT", s)
+	}
+	if _, _, err := net.SplitHostPort(local); err != nil {
+		return remoteForward{}, fmt.Errorf("invalid remote forward %q: %v", s, err)
+	}
+	return remoteForward{RemotePort: remotePort, Local: local}, nil
+}
+
+// startRemoteForwards opens the remote forwards a session asked for. A
+// forward that can't be set up is reported in the terminal; the session
+// carries on without it.
+func startRemoteForwards(sess *activeSession, meta requestMeta, forwards []remoteForward) {
+	defer recoverForward(meta)
+	notice := func(format string, args ...interface{}) {
+		sess.out.WriteMessage(websocket.BinaryMessage, []byte("\r\n\x1b[1;33m["+fmt.Sprintf(format, args...)+"]\x1b[0m\r\n"))
+	}
+	for _, f := range forwards {
+		log := meta.Log.With("remote_port", f.RemotePort, "local", f.Local)
+		if !tunnelAllowed(currentConfig().exposeTargets, f.Local) {
+			log.Warn("Remote forward refused: local address is not in forwarding.expose")
+			notice("Remote forward %s refused: %s may not be exposed", f, f.Local)
+			continue
+		}
+		if err := authorizeIdentity(log, meta.ClientIP, sess.identity, sess.Host, sess.SSHUser, opTunnel); err != nil {
+			notice("Remote forward %s refused: %v", f, err)
+			continue
+		}
+		ln, err := sess.client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(f.RemotePort)))
+		if err != nil {
+			log.Warn("Remote forward failed", "err", err)
+			notice("Remote forward %s failed: %v", f, err)
+			continue
+		}
+		rl := &remoteListener{sess: sess, meta: meta, forward: f, ln: ln}
+		if !sess.trackForward(rl) {
+			return
+		}
+		log.Info("Remote forward listening")
+		notice("Port %d on %s forwards to %s", f.RemotePort, hostname(sess.Host), f.Local)
+		go rl.serve()
+	}
+}
+
+// remoteListener accepts connections on the SSH host for one forward
+type remoteListener struct {
+	sess      *activeSession
+	meta      requestMeta
+	forward   remoteForward
+	ln        net.Listener
+	closeOnce sync.Once
+}
+
+func (l *remoteListener) close() {
+	l.closeOnce.Do(func() { l.ln.Close() })
+}
+
+func (l *remoteListener) serve() {
+	defer recoverForward(l.meta)
+	defer l.sess.untrackForward(l)
+	for {
+		remote, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				l.meta.Log.Debug("Remote forward stopped", "remote_port", l.forward.RemotePort, "err", err)
+			}
+			return
+		}
+		go l.relay(remote)
+	}
+}
+
+func (l *remoteListener) relay(remote net.Conn) {
+	meta := l.meta
+	meta.Log = meta.Log.With("remote_port", l.forward.RemotePort, "target", l.forward.Local)
+	local, err := net.DialTimeout("tcp", l.forward.Local, remoteForwardDialTimeout)
+	if err != nil {
+		meta.Log.Warn("Failed to connect remote forward to local address", "err", err)
+		remote.Close()
+		return
+	}
+	p := &proxiedConn{operation: "remote_forward", sess: l.sess, meta: meta, target: l.forward.Local, local: local, remote: remote}
+	if !l.sess.trackForward(p) {
+		return
+	}
+	defer l.sess.untrackForward(p)
+	p.run(currentConfig().Forwarding.IdleTimeout)
+}
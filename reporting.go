@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+// ErrorReportingConfig forwards panics to an error tracker. Reporting is off
+// unless dsn or webhook_url is set.
+type ErrorReportingConfig struct {
+	// DSN of a Sentry-compatible service,
+	// e.g. https://<key>@sentry.example.com/<project>
+	DSN string `yaml:"dsn"`
+	// WebhookURL receives each event as a JSON POST
+	WebhookURL  string        `yaml:"webhook_url"`
+	Environment string        `yaml:"environment"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+func (c *ErrorReportingConfig) applyDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+}
+
+// errorReporter sends panic reports to the configured destinations
+type errorReporter struct {
+	cfg ErrorReportingConfig
+	// storeURL and sentryAuth are derived from the DSN
+	storeURL   string
+	sentryAuth string
+	http       *http.Client
+}
+
+// newErrorReporter returns nil when reporting is not configured
+func newErrorReporter(cfg ErrorReportingConfig) (*errorReporter, error) {
+	cfg.applyDefaults()
+	if cfg.DSN == "" && cfg.WebhookURL == "" {
+		return nil, nil
+	}
+	r := &errorReporter{cfg: cfg, http: &http.Client{Timeout: cfg.Timeout}}
+	if cfg.DSN != "" {
+		dsn, err := url.Parse(cfg.DSN)
+		if err != nil || dsn.User == nil || dsn.User.Username() == "" || dsn.Host == "" {
+			return nil, fmt.Errorf("dsn must look like https://<key>@host/<project>")
+		}
+		project := strings.TrimPrefix(dsn.Path, "/")
+		prefix := ""
+		if i := strings.LastIndex(project, "/"); i >= 0 {
+			prefix, project = "/"+project[:i], project[i+1:]
+		}
+		if project == "" {
+			return nil, fmt.Errorf("dsn is missing the project ID")
+		}
+		r.storeURL = fmt.Sprintf("%s://%s%s/api/%s/store/", dsn.Scheme, dsn.Host, prefix, project)
+		r.sentryAuth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=gossh/%s, sentry_key=%s", build.Version, dsn.User.Username())
+	}
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("webhook_url %q is not a valid URL", cfg.WebhookURL)
+		}
+	}
+	return r, nil
+}
+
+// errorEvent describes a recovered panic. It never carries request
+// parameters or headers, and free text passes through redact.
+type errorEvent struct {
+	ID        string       `json:"id"`
+	Time      time.Time    `json:"time"`
+	Component string       `json:"component"` // "http", "session" or "forward"
+	Message   string       `json:"message"`
+	Stack     string       `json:"stack"`
+	RequestID string       `json:"request_id,omitempty"`
+	SessionID string       `json:"session_id,omitempty"`
+	Method    string       `json:"method,omitempty"`
+	Path      string       `json:"path,omitempty"`
+	Version   string       `json:"version"`
+	frames    []stackFrame `json:"-"`
+}
+
+type stackFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	Line     int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// newErrorEvent captures the stack of the panicking goroutine. It must be
+// called from the deferred function that recovered.
+func newErrorEvent(component string, value interface{}) errorEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return errorEvent{
+		ID:        hex.EncodeToString(id),
+		Time:      time.Now().UTC(),
+		Component: component,
+		Message:   redact(fmt.Sprint(value)),
+		Stack:     redact(string(debug.Stack())),
+		Version:   build.Version,
+		frames:    panicFrames(),
+	}
+}
+
+// panicFrames returns the frames from the panic site outwards, innermost
+// last as Sentry expects
+func panicFrames() []stackFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []stackFrame
+	seenPanic := false
+	for {
+		frame, more := frames.Next()
+		if seenPanic {
+			module, function := splitFunction(frame.Function)
+			out = append(out, stackFrame{
+				Function: function,
+				Module:   module,
+				Filename: frame.File,
+				Line:     frame.Line,
+				InApp:    module == "main",
+			})
+		} else if frame.Function == "runtime.gopanic" {
+			seenPanic = true
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// splitFunction splits "pkg/path.Func" into package and function
+func splitFunction(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		i := slash + 1 + dot
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// reportPanic logs a recovered panic with its stack and forwards it to the
+// error reporter, if one is configured
+func reportPanic(logger *slog.Logger, ev errorEvent) {
+	logger.Error("Recovered from panic", "component", ev.Component, "event_id", ev.ID, "panic", ev.Message, "stack", ev.Stack)
+	if r := currentConfig().reporter; r != nil {
+		go r.send(ev)
+	}
+}
+
+func (r *errorReporter) send(ev errorEvent) {
+	if r.storeURL != "" {
+		r.post(r.storeURL, r.sentryEvent(ev), map[string]string{"X-Sentry-Auth": r.sentryAuth})
+	}
+	if r.cfg.WebhookURL != "" {
+		r.post(r.cfg.WebhookURL, ev, nil)
+	}
+}
+
+// sentryEvent converts ev into the Sentry event payload
+func (r *errorReporter) sentryEvent(ev errorEvent) map[string]interface{} {
+	tags := map[string]string{"component": ev.Component}
+	if ev.RequestID != "" {
+		tags["request_id"] = ev.RequestID
+	}
+	if ev.SessionID != "" {
+		tags["session_id"] = ev.SessionID
+	}
+	event := map[string]interface{}{
+		"event_id":  ev.ID,
+		"timestamp": ev.Time.Format(time.RFC3339Nano),
+		"level":     "fatal",
+		"platform":  "go",
+		"logger":    "gossh",
+		"release":   "gossh@" + ev.Version,
+		"tags":      tags,
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       "panic",
+				"value":      ev.Message,
+				"mechanism":  map[string]interface{}{"type": "recover", "handled": true},
+				"stacktrace": map[string]interface{}{"frames": ev.frames},
+			}},
+		},
+	}
+	if name, err := os.Hostname(); err == nil {
+		event["server_name"] = name
+	}
+	if r.cfg.Environment != "" {
+		event["environment"] = r.cfg.Environment
+	}
+	if ev.Method != "" {
+		event["request"] = map[string]string{"method": ev.Method, "url": ev.Path}
+	}
+	return event
+}
+
+func (r *errorReporter) post(target string, payload interface{}, headers map[string]string) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Warn("Failed to encode error report", "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to send error report", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		slog.Warn("Failed to send error report", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Error report rejected", "status", resp.StatusCode)
+	}
+}
+
+// withRecovery turns a panic in a handler into a logged and reported error
+// and a 500 response, instead of a dropped connection and a stack trace on
+// stderr
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			ev := newErrorEvent("http", value)
+			ev.RequestID = requestID(r)
+			ev.Method = r.Method
+			ev.Path = redactedRequestURI(r.URL)
+			reportPanic(requestLogger(r), ev)
+
+			// Nothing can be sent once the response has started
+			if lw, ok := w.(*accessLogWriter); ok && (lw.status != 0 || lw.hijacked) {
+				return
+			}
+			responder.ErrorCode(w, r, httpapi.Internal, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverSession is deferred by every goroutine serving a terminal session.
+// A panic is logged and reported, and the session's connection is closed so
+// the rest of the session winds down; other sessions are not affected.
+// meta is a pointer so the deferred call sees the session ID assigned once
+// the session starts.
+func recoverSession(meta *requestMeta, conn sshbridge.Conn) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	ev := newErrorEvent("session", value)
+	ev.RequestID = meta.RequestID
+	ev.SessionID = meta.SessionID
+	reportPanic(meta.Log, ev)
+
+	msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "internal error")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// recoverForward is deferred by the goroutines relaying a proxied connection.
+// The connection itself is closed by the relay's own deferred calls.
+func recoverForward(meta requestMeta) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	ev := newErrorEvent("forward", value)
+	ev.SessionID = meta.SessionID
+	reportPanic(meta.Log, ev)
+}
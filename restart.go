@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables passed to a process started by a listener handoff.
+// They are read once at startup and are not configuration overrides.
+const (
+	listenerFDsEnv = "GOSSH_LISTENER_FDS"
+	readyFDEnv     = "GOSSH_READY_FD"
+	maintenanceEnv = "GOSSH_MAINTENANCE"
+)
+
+// handoffReadyTimeout is how long the old process waits for its replacement
+const handoffReadyTimeout = 30 * time.Second
+
+// shutdownRequests asks watchShutdown to drain the server, as SIGTERM would
+var shutdownRequests = make(chan string, 1)
+
+// signalReady tells the process that started this one, and systemd, that
+// the server is accepting connections
+func signalReady() {
+	if fd := os.Getenv(readyFDEnv); fd != "" {
+		os.Unsetenv(readyFDEnv)
+		if n, err := strconv.Atoi(fd); err == nil {
+			f := os.NewFile(uintptr(n), "ready")
+			f.Write([]byte{1})
+			f.Close()
+		}
+	}
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+}
+
+// sdNotify sends state to systemd when running as a Type=notify service
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// boundListener is a listener opened at startup
+type boundListener struct {
+	ListenerConfig
+	ln net.Listener
+}
+
+// watchSIGUSR2 starts a replacement process on SIGUSR2 when
+// server.restart_handoff is enabled. The new process inherits the listening
+// sockets; once it is ready this one drains like on SIGTERM.
+func watchSIGUSR2(listeners []boundListener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	go func() {
+		for range sigs {
+			if !currentConfig().Server.RestartHandoff {
+				slog.Warn("Ignoring SIGUSR2: server.restart_handoff is disabled")
+				continue
+			}
+			pid, err := handOffListeners(listeners)
+			if err != nil {
+				slog.Error("Restart handoff failed, keeping this process", "err", err)
+				continue
+			}
+			slog.Info("Replacement process is serving, draining this one", "pid", pid)
+			shutdownRequests <- "restart handoff"
+			return
+		}
+	}()
+}
+
+// handOffListeners starts the current binary with the listeners and the
+// maintenance state inherited and waits for it to report that it is ready
+func handOffListeners(listeners []boundListener) (int, error) {
+	// ExtraFiles start at fd 3
+	var files []*os.File
+	var entries []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		withFile, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %s cannot be handed over", l.Address)
+		}
+		f, err := withFile.File()
+		if err != nil {
+			return 0, fmt.Errorf("failed to duplicate listener %s: %v", l.Address, err)
+		}
+		entries = append(entries, fmt.Sprintf("%d=%s", 3+len(files), l.Address))
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return 0, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		listenerFDsEnv+"="+strings.Join(entries, "\n"),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)),
+		maintenanceEnv+"="+maintenance.handoff())
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start %s: %v", executable, err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			ready <- fmt.Errorf("replacement process exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(handoffReadyTimeout):
+		err = fmt.Errorf("replacement process was not ready after %s", handoffReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	// Socket files now belong to the replacement
+	for _, l := range listeners {
+		if ul, ok := l.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	// The replacement outlives this process; don't leave a zombie behind
+	// while draining
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/sshbridge"
+)
+
+const restrictedPrompt = "restricted> "
+
+// shellMetacharacters are refused outright in restricted sessions. Commands
+// are run through the remote user's shell, so anything that could chain,
+// redirect, substitute or glob must never reach it.
+const shellMetacharacters = ";&|<>$`\\(){}[]'\"*?~\n\r"
+
+// SessionConfig holds defaults applied to every terminal session
+type SessionConfig struct {
+	// RestrictedCommands, when set, limits every terminal session to these
+	// command patterns instead of a shell
+	RestrictedCommands []string `yaml:"restricted_commands"`
+	// ConnectTimeout bounds the TCP connection to a target host
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// ScrollbackBytes is how much recent output a session keeps for the
+	// page to ask for again
+	ScrollbackBytes int `yaml:"scrollback_bytes"`
+	// SanitizeOutput takes control strings such as title changes and
+	// terminal queries out of the output before the page and the
+	// scrollback see it
+	SanitizeOutput bool `yaml:"sanitize_output"`
+	// LockAfter locks sessions without input for this long until the user
+	// authenticates again; 0 never locks them
+	LockAfter time.Duration `yaml:"lock_after"`
+	// LockSignInURL is where the page of a locked session sends the user
+	// to sign in again at the authentication proxy
+	LockSignInURL string `yaml:"lock_sign_in_url"`
+	// IdleTimeout ends sessions without input for this long, locked or
+	// not; 0 never ends them
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MemoryLimitBytes caps what each session's scrollback, pending
+	// output and uploads hold; 0 for no limit
+	MemoryLimitBytes int `yaml:"memory_limit_bytes"`
+	// AutoResponses answer prompts with server-held secrets, in sessions
+	// whose authz rule names them
+	AutoResponses map[string]AutoResponseConfig `yaml:"auto_responses"`
+	// ZModem bridges rz and sz in the shell to the page. It looks at every
+	// byte of output, so it is off by default.
+	ZModem bool `yaml:"zmodem"`
+	// Trzsz does the same for trz and tsz
+	Trzsz bool `yaml:"trzsz"`
+	// Activity tells the page when long commands finish
+	Activity ActivityConfig `yaml:"activity"`
+	// Inactivity tells the page when sessions go quiet and wake up
+	Inactivity InactivityConfig `yaml:"inactivity"`
+	// MaxDuration ends terminal sessions that have run this long; 0 lets
+	// them run. authz.host_policies can replace it per host.
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+func (c *SessionConfig) applyDefaults() {
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = 10 * time.Second
+	}
+	if c.ScrollbackBytes <= 0 {
+		c.ScrollbackBytes = defaultScrollbackBytes
+	}
+	c.MemoryLimitBytes = max(c.MemoryLimitBytes, 0)
+	c.Activity.applyDefaults()
+	c.Inactivity.applyDefaults()
+	for name, a := range c.AutoResponses {
+		a.applyDefaults()
+		c.AutoResponses[name] = a
+	}
+}
+
+// commandPolicy is a set of command allowlists. A command may run only if
+// it matches a pattern in every list.
+type commandPolicy struct {
+	lists    [][]*regexp.Regexp
+	patterns [][]string
+}
+
+// newCommandPolicy compiles allowlists of command patterns. In a pattern,
+// "*" matches any run of characters within one argument, so "ls *" allows
+// a single argument and "ls * *" two; everything else matches literally.
+// Whitespace is normalized in patterns and commands alike.
+func newCommandPolicy(lists [][]string) (*commandPolicy, error) {
+	p := &commandPolicy{}
+	for _, list := range lists {
+		var compiled []*regexp.Regexp
+		var patterns []string
+		for _, pattern := range list {
+			pattern = strings.Join(strings.Fields(pattern), " ")
+			if pattern == "" {
+				continue
+			}
+			parts := strings.Split(pattern, "*")
+			for i := range parts {
+				parts[i] = regexp.QuoteMeta(parts[i])
+			}
+			re, err := regexp.Compile("^" + strings.Join(parts, "[^ ]*") + "$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid command pattern %q: %v", pattern, err)
+			}
+			compiled = append(compiled, re)
+			patterns = append(patterns, pattern)
+		}
+		if len(compiled) == 0 {
+			return nil, fmt.Errorf("command allowlist is empty")
+		}
+		p.lists = append(p.lists, compiled)
+		p.patterns = append(p.patterns, patterns)
+	}
+	return p, nil
+}
+
+// check returns the normalized command, or an error explaining the refusal
+func (p *commandPolicy) check(line string) (string, error) {
+	if i := strings.IndexAny(line, shellMetacharacters); i >= 0 {
+		return "", fmt.Errorf("shell metacharacter %q is not allowed", line[i])
+	}
+	command := strings.Join(strings.Fields(line), " ")
+	for _, list := range p.lists {
+		allowed := false
+		for _, re := range list {
+			if re.MatchString(command) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("command not allowed")
+		}
+	}
+	return command, nil
+}
+
+// sessionCommandPolicy collects the command allowlists that apply to a
+// terminal session on host: the global session setting, the authz rule that
+// granted access and any list carried in the access token
+func sessionCommandPolicy(r *http.Request, host string, tokenCommands []string) [][]string {
+	var lists [][]string
+	cfg := currentConfig()
+	if len(cfg.Session.RestrictedCommands) > 0 {
+		lists = append(lists, cfg.Session.RestrictedCommands)
+	}
+	if rule, _ := decidingRule(&cfg.Authz, requestIdentity(r), host, opTerminal); rule != nil && len(rule.RestrictedCommands) > 0 {
+		lists = append(lists, rule.RestrictedCommands)
+	}
+	if len(tokenCommands) > 0 {
+		lists = append(lists, tokenCommands)
+	}
+	return lists
+}
+
+// frameWriter streams command output to the terminal as binary frames
+type frameWriter struct {
+	out   *wsWriter
+	count *atomic.Int64
+}
+
+func (f frameWriter) Write(p []byte) (int, error) {
+	f.count.Add(int64(len(p)))
+	if err := f.out.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// runningCommand is the command currently executing in a restricted session
+type runningCommand struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	done    chan error
+}
+
+// restrictedSession replaces the remote shell with a minimal command loop.
+// Each submitted line is checked against the policy and run with exec on the
+// SSH connection under its own PTY.
+type restrictedSession struct {
+	session  *activeSession
+	out      *wsWriter
+	wsConn   sshbridge.Conn
+	sshConn  *ssh.Client
+	meta     requestMeta
+	host     string
+	user     string
+	policy   *commandPolicy
+	bytesIn  *atomic.Int64
+	bytesOut *atomic.Int64
+
+	line       []rune
+	escape     int // position in an escape sequence being skipped
+	cols, rows int
+}
+
+func (rs *restrictedSession) print(s string) {
+	rs.out.WriteMessage(websocket.BinaryMessage, []byte(s))
+}
+
+func (rs *restrictedSession) run() {
+	rs.cols, rs.rows = 80, 40
+
+	msgs := make(chan sshbridge.ClientMessage)
+	go func() {
+		defer close(msgs)
+		for {
+			messageType, message, err := rs.wsConn.ReadMessage()
+			if err != nil {
+				rs.meta.Log.Debug("Error reading from websocket", "err", err)
+				return
+			}
+			msg, err := sshbridge.DecodeClientMessage(messageType, message)
+			if err != nil {
+				rs.meta.Log.Warn("Error unmarshaling message", "err", err)
+				continue
+			}
+			// Nothing but resizes while the session is locked
+			if rs.session.lock.blocks(msg.Type) {
+				continue
+			}
+			msgs <- msg
+		}
+	}()
+
+	rs.print("Restricted session: only approved commands can be run. Type \"help\" to list them.\r\n" + restrictedPrompt)
+
+	var running *runningCommand
+	defer func() {
+		if running != nil {
+			running.session.Close()
+		}
+	}()
+
+	for {
+		var done chan error
+		if running != nil {
+			done = running.done
+		}
+
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			switch msg.Type {
+			case "input":
+				rs.session.typed()
+				rs.bytesIn.Add(int64(len(msg.Data)))
+				if running != nil {
+					// The command's PTY handles Ctrl-C and any prompts
+					running.stdin.Write([]byte(msg.Data))
+					continue
+				}
+				line, submitted, exit := rs.edit(msg.Data)
+				if exit {
+					rs.print("\r\n")
+					return
+				}
+				if submitted {
+					running = rs.submit(line)
+					if running == nil {
+						rs.print(restrictedPrompt)
+					}
+				}
+			case "resize":
+				if msg.Cols > 0 && msg.Rows > 0 {
+					rs.cols, rs.rows = msg.Cols, msg.Rows
+					rs.session.resized(rs.cols, rs.rows)
+				}
+				if running != nil {
+					running.session.WindowChange(rs.rows, rs.cols)
+				}
+			case "replay":
+				rs.out.replay(msg.Bytes)
+			case "clear_scrollback":
+				rs.out.clearScrollback()
+			case "upload":
+				sendUploadResponse(rs.out, sshbridge.UploadResponse{
+					Type:    "upload_response",
+					ID:      msg.ID,
+					Success: false,
+					Error:   "Uploads are not available in restricted sessions",
+				})
+			}
+
+		case err := <-done:
+			running.session.Close()
+			running = nil
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
+				rs.print(fmt.Sprintf("\r\n[exit status %d]\r\n", exitErr.ExitStatus()))
+			} else if err != nil {
+				rs.print(fmt.Sprintf("\r\n[command failed: %v]\r\n", err))
+			}
+			rs.print(restrictedPrompt)
+		}
+	}
+}
+
+// edit applies terminal input to the line being typed, echoing it back. It
+// reports a submitted line, or exit when Ctrl-D is pressed on an empty line.
+func (rs *restrictedSession) edit(data string) (string, bool, bool) {
+	for len(data) > 0 {
+		r, size := utf8.DecodeRuneInString(data)
+		data = data[size:]
+
+		// Skip escape sequences such as arrow keys
+		if rs.escape > 0 {
+			if rs.escape == 1 && (r == '[' || r == 'O') {
+				rs.escape = 2
+			} else if rs.escape == 1 || (r >= 0x40 && r <= 0x7e) {
+				rs.escape = 0
+			}
+			continue
+		}
+
+		switch {
+		case r == 0x1b:
+			rs.escape = 1
+		case r == '\r' || r == '\n':
+			line := string(rs.line)
+			rs.line = rs.line[:0]
+			rs.print("\r\n")
+			return line, true, false
+		case r == 0x7f || r == 0x08:
+			if len(rs.line) > 0 {
+				rs.line = rs.line[:len(rs.line)-1]
+				rs.print("\b \b")
+			}
+		case r == 0x03:
+			rs.line = rs.line[:0]
+			rs.print("^C\r\n" + restrictedPrompt)
+		case r == 0x04:
+			if len(rs.line) == 0 {
+				return "", false, true
+			}
+		case r >= 0x20:
+			rs.line = append(rs.line, r)
+			rs.print(string(r))
+		}
+	}
+	return "", false, false
+}
+
+// submit handles a completed line, starting the command if it's allowed
+func (rs *restrictedSession) submit(line string) *runningCommand {
+	switch strings.TrimSpace(line) {
+	case "":
+		return nil
+	case "exit", "logout":
+		rs.wsConn.Close()
+		return nil
+	case "help":
+		rs.print("Allowed commands:\r\n")
+		for _, patterns := range rs.policy.patterns {
+			for _, p := range patterns {
+				rs.print("  " + p + "\r\n")
+			}
+		}
+		return nil
+	}
+
+	ev := AuditEvent{
+		Event:    auditCommand,
+		ClientIP: rs.meta.ClientIP,
+		User:     rs.meta.User,
+		Host:     rs.host,
+		SSHUser:  rs.user,
+		Command:  line,
+	}
+
+	command, err := rs.policy.check(line)
+	if err != nil {
+		ev.Outcome = outcomeDenied
+		ev.Error = err.Error()
+		audit.Emit(ev)
+		rs.meta.Log.Warn("Restricted session refused command", "command", line, "err", err)
+		rs.print(fmt.Sprintf("Refused: %v\r\n", err))
+		return nil
+	}
+
+	cmd, err := rs.start(command)
+	ev.Outcome = outcomeOf(err)
+	ev.Error = errorString(err)
+	audit.Emit(ev)
+	if err != nil {
+		rs.meta.Log.Error("Failed to run restricted command", "command", command, "err", err)
+		rs.print(fmt.Sprintf("Error: %v\r\n", err))
+		return nil
+	}
+	return cmd
+}
+
+// start runs command on the SSH connection with output streamed to the terminal
+func (rs *restrictedSession) start(command string) (*runningCommand, error) {
+	session, err := rs.sshConn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm-256color", rs.rows, rs.cols, modes); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to request PTY: %v", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	session.Stdout = frameWriter{out: rs.out, count: rs.bytesOut}
+	session.Stderr = frameWriter{out: rs.out, count: rs.bytesOut}
+
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+
+	cmd := &runningCommand{session: session, stdin: stdin, done: make(chan error, 1)}
+	started := time.Now()
+	go func() {
+		err := session.Wait()
+		rs.meta.Log.Info("Restricted command finished", "command", command, "duration", time.Since(started))
+		cmd.done <- err
+	}()
+	return cmd, nil
+}
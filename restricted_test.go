@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandPolicy(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists [][]string
+		line  string
+		// want is the normalized command, or "" when refused
+		want string
+	}{
+		{"exact", [][]string{{"uptime"}}, "uptime", "uptime"},
+		{"not listed", [][]string{{"uptime"}}, "reboot", ""},
+		{"extra argument", [][]string{{"uptime"}}, "uptime -p", ""},
+		{"star matches one argument", [][]string{{"systemctl restart *"}}, "systemctl restart nginx", "systemctl restart nginx"},
+		{"star stops at a space", [][]string{{"systemctl restart *"}}, "systemctl restart nginx sshd", ""},
+		{"star needs its argument", [][]string{{"systemctl restart *"}}, "systemctl restart", ""},
+		{"two stars", [][]string{{"journalctl -u * -n *"}}, "journalctl -u nginx -n 50", "journalctl -u nginx -n 50"},
+		{"star within an argument", [][]string{{"tail /var/log/*.log"}}, "tail /var/log/syslog.log", "tail /var/log/syslog.log"},
+		{"star within an argument stops at a space", [][]string{{"tail /var/log/*.log"}}, "tail /var/log/a /etc/b.log", ""},
+		{"regexp characters match literally", [][]string{{"df -h ."}}, "df -h x", ""},
+
+		{"command whitespace", [][]string{{"systemctl status *"}}, "  systemctl \t status   nginx ", "systemctl status nginx"},
+		{"pattern whitespace", [][]string{{" systemctl   status  * "}}, "systemctl status nginx", "systemctl status nginx"},
+
+		{"every list allows", [][]string{{"systemctl * *"}, {"systemctl status *", "uptime"}}, "systemctl status nginx", "systemctl status nginx"},
+		{"one list refuses", [][]string{{"systemctl *"}, {"uptime"}}, "systemctl stop", ""},
+		{"other list refuses", [][]string{{"uptime"}, {"systemctl *"}}, "uptime", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newCommandPolicy(tt.lists)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.check(tt.line)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("check(%q) allowed %q", tt.line, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("check(%q) = %q, %v; want %q", tt.line, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandPolicyMetacharacters(t *testing.T) {
+	p, err := newCommandPolicy([][]string{{"*", "* *", "* * *"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"uptime; reboot",
+		"uptime && reboot",
+		"uptime || reboot",
+		"uptime | sh",
+		"cat < /etc/shadow",
+		"echo x > /etc/motd",
+		"echo $HOME",
+		"echo `id`",
+		"echo $(id)",
+		`echo \x`,
+		"ls {a,b}",
+		"ls [ab]",
+		"echo 'x'",
+		`echo "x"`,
+		"ls *",
+		"ls ?",
+		"ls ~root",
+		"uptime\nreboot",
+		"uptime\rreboot",
+		"uptime &",
+	} {
+		if got, err := p.check(line); err == nil || !strings.Contains(err.Error(), "metacharacter") {
+			t.Errorf("check(%q) = %q, %v; want a metacharacter refusal", line, got, err)
+		}
+	}
+}
+
+func TestCommandPolicyEmptyList(t *testing.T) {
+	if _, err := newCommandPolicy([][]string{{"uptime"}, {" ", ""}}); err == nil {
+		t.Error("a list of blank patterns was accepted")
+	}
+}
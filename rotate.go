@@ -0,0 +1,297 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backupTimeFormat stamps rotated files: gossh.log becomes
+// gossh-2006-01-02T15-04-05.000.log
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotationConfig controls how a log file is rotated. Zero values disable the
+// corresponding limit.
+type RotationConfig struct {
+	MaxSizeMB  int           `yaml:"max_size_mb"` // rotate once the file reaches this size
+	MaxBackups int           `yaml:"max_backups"` // rotated files to keep
+	MaxAge     time.Duration `yaml:"max_age"`     // delete rotated files older than this
+	Compress   bool          `yaml:"compress"`    // gzip rotated files
+}
+
+func validateRotationConfig(cfg RotationConfig) error {
+	if cfg.MaxSizeMB < 0 || cfg.MaxBackups < 0 || cfg.MaxAge < 0 {
+		return fmt.Errorf("rotation limits must not be negative")
+	}
+	return nil
+}
+
+// rotatingFile is an append-only log file that rolls over to a timestamped
+// backup when it grows past the size limit or when rotate is called. It is
+// safe for concurrent use.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	perm os.FileMode
+	cfg  RotationConfig
+	file *os.File
+	size int64
+
+	millMu sync.Mutex // serializes compression and pruning of backups
+}
+
+// rotatingFiles are the open log files rotated by SIGUSR1
+var rotatingFiles struct {
+	mu    sync.Mutex
+	files map[*rotatingFile]bool
+}
+
+// openRotatingFile opens path for appending. It fails if the file can't be
+// written or its directory can't hold the rotated backups.
+func openRotatingFile(path string, cfg RotationConfig, perm os.FileMode) (*rotatingFile, error) {
+	probe, err := os.CreateTemp(filepath.Dir(path), ".gossh-write-test-*")
+	if err != nil {
+		return nil, fmt.Errorf("log directory %s is not writable: %v", filepath.Dir(path), err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	f := &rotatingFile{path: path, perm: perm, cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	rotatingFiles.mu.Lock()
+	if rotatingFiles.files == nil {
+		rotatingFiles.files = make(map[*rotatingFile]bool)
+	}
+	rotatingFiles.files[f] = true
+	rotatingFiles.mu.Unlock()
+	return f, nil
+}
+
+// open (re)opens the live file. Must be called with mu held.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return fmt.Errorf("cannot open %s for writing: %v", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat %s: %v", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("%s is closed", f.path)
+	}
+	max := int64(f.cfg.MaxSizeMB) * 1024 * 1024
+	if max > 0 && f.size > 0 && f.size+int64(len(p)) > max {
+		if err := f.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. It reports
+// false when there was nothing to rotate.
+func (f *rotatingFile) rotate() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return false, nil
+	}
+	// Nothing to rotate in an empty file that is still in place
+	if _, err := os.Stat(f.path); err == nil && f.size == 0 {
+		return false, nil
+	}
+	return true, f.rotateLocked()
+}
+
+func (f *rotatingFile) rotateLocked() error {
+	f.file.Close()
+	f.file = nil
+
+	// logrotate may already have moved the file away; then it's reopened
+	backup := f.backupName(time.Now())
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		// Keep writing to the old file rather than losing lines
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("cannot rotate %s: %v", f.path, err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.mill()
+	return nil
+}
+
+// backupName returns the name a rotation at t moves the file to
+func (f *rotatingFile) backupName(t time.Time) string {
+	dir, name := filepath.Split(f.path)
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, strings.TrimSuffix(name, ext)+"-"+t.UTC().Format(backupTimeFormat)+ext)
+}
+
+// mill compresses new backups and removes those beyond the retention limits
+func (f *rotatingFile) mill() {
+	f.millMu.Lock()
+	defer f.millMu.Unlock()
+
+	backups, err := f.backups()
+	if err != nil {
+		slog.Error("Failed to list rotated log files", "path", f.path, "err", err)
+		return
+	}
+
+	var keep []logBackup
+	for i, b := range backups {
+		expired := f.cfg.MaxAge > 0 && time.Since(b.time) > f.cfg.MaxAge
+		excess := f.cfg.MaxBackups > 0 && i >= f.cfg.MaxBackups
+		if expired || excess {
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				slog.Error("Failed to remove rotated log file", "path", b.path, "err", err)
+			}
+			continue
+		}
+		keep = append(keep, b)
+	}
+
+	if !f.cfg.Compress {
+		return
+	}
+	for _, b := range keep {
+		if strings.HasSuffix(b.path, ".gz") {
+			continue
+		}
+		if err := compressFile(b.path, f.perm); err != nil {
+			slog.Error("Failed to compress rotated log file", "path", b.path, "err", err)
+		}
+	}
+}
+
+type logBackup struct {
+	path string
+	time time.Time
+}
+
+// backups lists rotated copies of the file, newest first
+func (f *rotatingFile) backups() ([]logBackup, error) {
+	dir := filepath.Dir(f.path)
+	name := filepath.Base(f.path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []logBackup
+	for _, e := range entries {
+		stamp := strings.TrimSuffix(e.Name(), ".gz")
+		if e.IsDir() || !strings.HasPrefix(stamp, prefix) || !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimPrefix(stamp, prefix), ext)
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, logBackup{path: filepath.Join(dir, e.Name()), time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].time.After(backups[j].time) })
+	return backups, nil
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string, perm os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (f *rotatingFile) Close() error {
+	rotatingFiles.mu.Lock()
+	delete(rotatingFiles.files, f)
+	rotatingFiles.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// watchSIGUSR1 rotates every open log file on SIGUSR1, so logrotate can use
+// a postrotate signal instead of copytruncate
+func watchSIGUSR1() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			rotatingFiles.mu.Lock()
+			files := make([]*rotatingFile, 0, len(rotatingFiles.files))
+			for f := range rotatingFiles.files {
+				files = append(files, f)
+			}
+			rotatingFiles.mu.Unlock()
+
+			for _, f := range files {
+				rotated, err := f.rotate()
+				if err != nil {
+					slog.Error("Log rotation failed", "path", f.path, "err", err)
+				} else if rotated {
+					slog.Info("Log file rotated", "path", f.path)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+)
+
+// States of an outputSanitizer
+const (
+	sanitizeText = iota
+	sanitizeEsc  // after ESC
+	sanitizeString
+	sanitizeStringEsc // ESC within a string, which ends it when followed by \
+)
+
+// outputSanitizer takes control strings out of terminal output: OSC, DCS,
+// SOS, PM and APC, with which output can retitle the page, set hyperlinks,
+// talk to the clipboard or query and reprogram the terminal. CSI sequences
+// such as colors and cursor movement, and everything else, pass unchanged.
+// The output may split a string across reads. It is guarded by the
+// wsWriter's mu.
+type outputSanitizer struct {
+	state int
+}
+
+// sanitize returns p without control strings. An ESC at the end of p is
+// held back until the next call tells whether it starts one.
+func (s *outputSanitizer) sanitize(p []byte) []byte {
+	if s.state == sanitizeText && bytes.IndexByte(p, 0x1b) < 0 {
+		return p
+	}
+	out := make([]byte, 0, len(p)+1)
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch s.state {
+		case sanitizeText:
+			if b == 0x1b {
+				s.state = sanitizeEsc
+				continue
+			}
+			out = append(out, b)
+
+		case sanitizeEsc:
+			switch b {
+			case ']', 'P', 'X', '^', '_':
+				s.state = sanitizeString
+			case 0x1b:
+				out = append(out, 0x1b)
+			default:
+				out = append(out, 0x1b, b)
+				s.state = sanitizeText
+			}
+
+		case sanitizeString:
+			switch b {
+			case 0x07, 0x18, 0x1a: // BEL ends an OSC, CAN and SUB cancel any
+				s.state = sanitizeText
+			case 0x1b:
+				s.state = sanitizeStringEsc
+			}
+
+		case sanitizeStringEsc:
+			if b == '\\' {
+				s.state = sanitizeText
+				continue
+			}
+			// A new sequence cancels this one
+			s.state = sanitizeEsc
+			i--
+		}
+	}
+	return out
+}
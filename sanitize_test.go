@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOutputSanitizer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"plain text", []string{"hello\r\n"}, "hello\r\n"},
+		{"colors kept", []string{"\x1b[1;31mred\x1b[0m"}, "\x1b[1;31mred\x1b[0m"},
+		{"title set with BEL", []string{"a\x1b]0;pwned\x07b"}, "ab"},
+		{"hyperlink with ST", []string{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\"}, "link"},
+		{"DCS", []string{"a\x1bP$q\"p\x1b\\b"}, "ab"},
+		{"APC", []string{"a\x1b_payload\x1b\\b"}, "ab"},
+		{"split across reads", []string{"a\x1b", "]2;ti", "tle\x1b", "\\b"}, "ab"},
+		{"ESC held at the end", []string{"a\x1b", "[0mb"}, "a\x1b[0mb"},
+		{"cancelled by CAN", []string{"a\x1b]0;x\x18b"}, "ab"},
+		{"new sequence ends a string", []string{"a\x1b]0;x\x1b[1mb"}, "a\x1b[1mb"},
+		{"double ESC", []string{"\x1b\x1b[0m"}, "\x1b\x1b[0m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s outputSanitizer
+			var got strings.Builder
+			for _, c := range tt.chunks {
+				got.Write(s.sanitize([]byte(c)))
+			}
+			if got.String() != tt.want {
+				t.Errorf("sanitized %q to %q, want %q", tt.chunks, got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestScrollbackKeepsSanitizedOutput(t *testing.T) {
+	useConfig(t, `
+session:
+  sanitize_output: true
+`)
+	conn := newFakeConn()
+	w := newTerminalWriter(conn)
+	w.WriteMessage(websocket.BinaryMessage, []byte("$ cat notes\r\n\x1b]0;pwned\x07\x1b[1mbold\x1b[0m\r\n"))
+	before := len(conn.messages())
+	if err := w.replay(0); err != nil {
+		t.Fatal(err)
+	}
+	var replayed string
+	for _, m := range conn.messages()[before:] {
+		if m.messageType == websocket.BinaryMessage {
+			replayed += string(m.data)
+		}
+	}
+	if want := "$ cat notes\r\n\x1b[1mbold\x1b[0m\r\n"; replayed != want {
+		t.Errorf("replayed %q, want %q", replayed, want)
+	}
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/httpapi"
+)
+
+const (
+	defaultScheduleTimeout   = 10 * time.Minute
+	defaultScheduleMaxRuns   = 100
+	defaultScheduleMaxOutput = 64 << 10
+	// webhookTimeout bounds sending a notification to a webhook
+	webhookTimeout = 10 * time.Second
+)
+
+// SchedulesConfig runs commands on hosts at the times cron expressions give
+type SchedulesConfig struct {
+	// Dir keeps the schedules created through /api/schedules, and the runs
+	// of every schedule, across restarts. Empty keeps them in memory only.
+	// Changes require a restart.
+	Dir string `yaml:"dir"`
+	// Timezone the expressions are read in, e.g. Europe/Berlin; the
+	// server's by default
+	Timezone string `yaml:"timezone"`
+	// MaxRuns is how many of each schedule's latest runs are kept, with up
+	// to MaxOutput bytes of their stdout and of their stderr
+	MaxRuns   int `yaml:"max_runs"`
+	MaxOutput int `yaml:"max_output"`
+	// WebhookURL is sent a JSON POST for each failed run of a schedule
+	// with notify set
+	WebhookURL string `yaml:"webhook_url"`
+	// Entries are schedules defined here rather than through the API
+	Entries []Schedule `yaml:"entries"`
+}
+
+func (c *SchedulesConfig) applyDefaults() {
+	if c.MaxRuns <= 0 {
+		c.MaxRuns = defaultScheduleMaxRuns
+	}
+	if c.MaxOutput <= 0 {
+		c.MaxOutput = defaultScheduleMaxOutput
+	}
+}
+
+// parseSchedules checks the schedules section, returning its entries ready
+// to run and the location their expressions are read in
+func parseSchedules(cfg SchedulesConfig, maxTimeout time.Duration) ([]*Schedule, *time.Location, error) {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || u.Host == "" {
+			return nil, nil, fmt.Errorf("webhook_url %q is not a valid URL", cfg.WebhookURL)
+		}
+	}
+	entries := make([]*Schedule, 0, len(cfg.Entries))
+	seen := make(map[string]bool)
+	for i := range cfg.Entries {
+		s := cfg.Entries[i]
+		if !validScheduleID.MatchString(s.ID) {
+			return nil, nil, fmt.Errorf("entry %d: id %q must be letters, digits, ., _ and -", i+1, s.ID)
+		}
+		if seen[s.ID] {
+			return nil, nil, fmt.Errorf("%s: duplicate id", s.ID)
+		}
+		seen[s.ID] = true
+		if err := s.prepare(maxTimeout); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.ID, err)
+		}
+		s.Source = "config"
+		entries = append(entries, &s)
+	}
+	return entries, loc, nil
+}
+
+// validScheduleID keeps the IDs of schedules, which name files in
+// schedules.dir, short and plain
+var validScheduleID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Schedule runs a command on a host whenever its cron expression matches.
+// Like profiles, schedules hold no secrets: they log in with a credential
+// source.
+type Schedule struct {
+	ID   string `yaml:"id" json:"id"`
+	Cron string `yaml:"cron" json:"cron"`
+	// Host is an address or alias
+	Host string `yaml:"host" json:"host"`
+	User string `yaml:"user,omitempty" json:"user,omitempty"`
+	// Credentials is a source such as "vault:secret/data/ssh/db01"
+	Credentials string `yaml:"credentials" json:"credentials"`
+	Command     string `yaml:"command" json:"command"`
+	Timeout     string `yaml:"timeout,omitempty" json:"timeout,omitempty"` // e.g. "30s"
+	// Notify sends failed runs to schedules.webhook_url
+	Notify bool `yaml:"notify,omitempty" json:"notify,omitempty"`
+
+	// Source is "config" or "api"; Owner is the identity that created a
+	// schedule through the API, which only they and admin keys may delete
+	Source string `yaml:"-" json:"source"`
+	Owner  string `yaml:"-" json:"owner,omitempty"`
+
+	cron    *cronSchedule
+	timeout time.Duration
+}
+
+// prepare checks s and parses its expression and timeout
+func (s *Schedule) prepare(maxTimeout time.Duration) error {
+	switch {
+	case s.Cron == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing cron")
+	case s.Host == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing host")
+	case s.Command == "":
+		return httpapi.Errorf(httpapi.MissingParams, "Missing command")
+	}
+	if !isCredentialSource(s.Credentials) {
+		return httpapi.Errorf(httpapi.BadRequest, "Credentials must name a source starting with %q, %q, %q or %q", vaultSourcePrefix, vaultSSHSourcePrefix, storedSourcePrefix, managedKeySourcePrefix)
+	}
+	var err error
+	if s.cron, err = parseCron(s.Cron); err != nil {
+		return httpapi.Errorf(httpapi.BadRequest, "Invalid cron %q: %v", s.Cron, err)
+	}
+	s.timeout = defaultScheduleTimeout
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil || d <= 0 {
+			return httpapi.Errorf(httpapi.BadRequest, "Invalid timeout %q", s.Timeout)
+		}
+		if d > maxTimeout {
+			return httpapi.Errorf(httpapi.BadRequest, "Timeout exceeds the maximum of %s", maxTimeout)
+		}
+		s.timeout = d
+	}
+	return nil
+}
+
+// target resolves where the schedule's command runs and as whom
+func (s *Schedule) target() *transferTarget {
+	host, user := resolveHost(s.Host, s.User)
+	return &transferTarget{Host: host, User: user, Source: s.Credentials}
+}
+
+// scheduleSkipped marks a run that didn't start, as the previous one was
+// still running or the server was in maintenance. Runs that did end like
+// jobs: completed, timed_out, failed or interrupted.
+const scheduleSkipped = "skipped"
+
+// scheduleRun is a run of a schedule, as stored and as
+// /api/schedules/{id}/runs returns it
+type scheduleRun struct {
+	Status    string    `json:"status"`
+	Scheduled time.Time `json:"scheduled"`
+	Host      string    `json:"host"`
+	SSHUser   string    `json:"ssh_user,omitempty"`
+	// Duration is in seconds
+	Duration  float64 `json:"duration"`
+	ExitCode  *int    `json:"exit_code,omitempty"`
+	Signal    string  `json:"signal,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Stdout    string  `json:"stdout,omitempty"`
+	Stderr    string  `json:"stderr,omitempty"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+// failed reports whether the run is worth telling the webhook about: the
+// command exited with a status other than 0, or didn't run to the end
+func (run *scheduleRun) failed() bool {
+	if run.Status == scheduleSkipped {
+		return false
+	}
+	return run.Status != jobCompleted || (run.ExitCode != nil && *run.ExitCode != 0)
+}
+
+// scheduler runs the schedules of the config file and of the API, keeping
+// the latest runs of each
+type scheduler struct {
+	mu sync.Mutex
+	// api holds the schedules created through the API, by ID
+	api map[string]*Schedule
+	// runs are the kept runs of each schedule, oldest first
+	runs    map[string][]scheduleRun
+	running map[string]bool
+	// dir is schedules.dir as of startup
+	dir string
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+}
+
+var schedules = newScheduler()
+
+func newScheduler() *scheduler {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &scheduler{
+		api:     make(map[string]*Schedule),
+		runs:    make(map[string][]scheduleRun),
+		running: make(map[string]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// open uses dir as the store, loading the schedules created through the
+// API and the runs kept of each
+func (s *scheduler) open(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "runs"), 0700); err != nil {
+		return fmt.Errorf("schedule store %s: %v", dir, err)
+	}
+	s.dir = dir
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(filepath.Join(dir, "schedules.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("schedule store %s: %v", dir, err)
+	}
+	if err == nil {
+		var list []*Schedule
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("schedule store %s: %v", dir, err)
+		}
+		maxTimeout := currentConfig().Jobs.MaxTimeout
+		for _, sch := range list {
+			if err := sch.prepare(maxTimeout); err != nil || !validScheduleID.MatchString(sch.ID) {
+				slog.Warn("Skipping invalid schedule", "schedule", sch.ID, "err", err)
+				continue
+			}
+			sch.Source = "api"
+			s.api[sch.ID] = sch
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "runs"))
+	if err != nil {
+		return fmt.Errorf("schedule store %s: %v", dir, err)
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validScheduleID.MatchString(id) {
+			continue
+		}
+		data, err := os.ReadFile(s.runsPath(id))
+		var runs []scheduleRun
+		if err == nil {
+			err = json.Unmarshal(data, &runs)
+		}
+		if err != nil {
+			slog.Warn("Skipping unreadable schedule runs", "schedule", id, "err", err)
+			continue
+		}
+		s.runs[id] = runs
+	}
+	slog.Info("Loaded schedules", "dir", dir, "schedules", len(s.api))
+	return nil
+}
+
+// runsPath is where the runs of schedule id are stored
+func (s *scheduler) runsPath(id string) string {
+	return filepath.Join(s.dir, "runs", id+".json")
+}
+
+// store writes v as JSON to name in the store, replacing it atomically
+func (s *scheduler) store(name string, v interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".schedule-*")
+	if err != nil {
+		return fmt.Errorf("Failed to store schedules: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to store schedules: %v", err)
+	}
+	return nil
+}
+
+// saveAPI stores the schedules created through the API. The caller holds
+// mu.
+func (s *scheduler) saveAPI() error {
+	list := make([]*Schedule, 0, len(s.api))
+	for _, sch := range s.api {
+		list = append(list, sch)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return s.store(filepath.Join(s.dir, "schedules.json"), list)
+}
+
+// all lists the schedules of the config file, then those of the API, by ID
+func (s *scheduler) all() []*Schedule {
+	list := append([]*Schedule(nil), currentConfig().scheduleEntries...)
+	s.mu.Lock()
+	api := make([]*Schedule, 0, len(s.api))
+	for _, sch := range s.api {
+		api = append(api, sch)
+	}
+	s.mu.Unlock()
+	sort.Slice(api, func(i, j int) bool { return api[i].ID < api[j].ID })
+	return append(list, api...)
+}
+
+// get returns schedule id
+func (s *scheduler) get(id string) (*Schedule, bool) {
+	for _, sch := range currentConfig().scheduleEntries {
+		if sch.ID == id {
+			return sch, true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sch, ok := s.api[id]
+	return sch, ok
+}
+
+// put adds a schedule created through the API
+func (s *scheduler) put(sch *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.api[sch.ID] = sch
+	if err := s.saveAPI(); err != nil {
+		delete(s.api, sch.ID)
+		return err
+	}
+	return nil
+}
+
+// remove deletes a schedule created through the API with its runs. A run
+// in progress finishes, but isn't kept.
+func (s *scheduler) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.api[id]
+	if !ok {
+		return nil
+	}
+	delete(s.api, id)
+	if err := s.saveAPI(); err != nil {
+		s.api[id] = prev
+		return err
+	}
+	delete(s.runs, id)
+	if s.dir != "" {
+		os.Remove(s.runsPath(id))
+	}
+	return nil
+}
+
+// history returns copies of the kept runs of schedule id, newest first,
+// and whether one is in progress
+func (s *scheduler) history(id string) ([]scheduleRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := make([]scheduleRun, len(s.runs[id]))
+	for i, run := range s.runs[id] {
+		runs[len(runs)-1-i] = run
+	}
+	return runs, s.running[id]
+}
+
+// record keeps run, dropping the oldest beyond schedules.max_runs. Runs are
+// ordered by when they were due, as one skipped while another ran is
+// recorded first.
+func (s *scheduler) record(sch *Schedule, run scheduleRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.api[sch.ID]; sch.Source == "api" && !ok {
+		return
+	}
+	runs := append(s.runs[sch.ID], run)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Scheduled.Before(runs[j].Scheduled) })
+	if limit := currentConfig().Schedules.MaxRuns; len(runs) > limit {
+		runs = append([]scheduleRun(nil), runs[len(runs)-limit:]...)
+	}
+	s.runs[sch.ID] = runs
+	if err := s.store(s.runsPath(sch.ID), runs); err != nil {
+		slog.Warn("Failed to store schedule run", "schedule", sch.ID, "err", err)
+	}
+}
+
+// loop runs the schedules that match each minute from now on. Minutes
+// missed while gossh was down, or while the machine slept, are skipped
+// rather than made up for.
+func (s *scheduler) loop() {
+	next := time.Now().Truncate(time.Minute).Add(time.Minute)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if late := time.Since(next); late >= time.Minute {
+			slog.Warn("Skipping missed schedule runs", "since", next, "late", late.Round(time.Second))
+			next = time.Now().Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		s.tick(next)
+		next = next.Add(time.Minute)
+	}
+}
+
+// tick starts the schedules that match the minute at
+func (s *scheduler) tick(at time.Time) {
+	local := at.In(currentConfig().scheduleLocation)
+	for _, sch := range s.all() {
+		if sch.cron.matches(local) {
+			s.trigger(sch, at)
+		}
+	}
+}
+
+// trigger starts a run of sch, unless the previous one is still running
+func (s *scheduler) trigger(sch *Schedule, at time.Time) {
+	log := slog.With("schedule", sch.ID)
+	skip := func(reason string) {
+		log.Warn("Schedule run skipped", "reason", reason)
+		s.record(sch, scheduleRun{Status: scheduleSkipped, Scheduled: at, Host: sch.target().Host, Error: reason})
+	}
+	if err := maintenance.check(); err != nil {
+		skip("the server is in maintenance")
+		return
+	}
+	s.mu.Lock()
+	if s.running[sch.ID] {
+		s.mu.Unlock()
+		skip("the previous run is still running")
+		return
+	}
+	s.running[sch.ID] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go s.run(sch, at, log)
+}
+
+// run runs sch's command and records how it ended
+func (s *scheduler) run(sch *Schedule, at time.Time, log *slog.Logger) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, sch.ID)
+		s.mu.Unlock()
+	}()
+
+	cfg := currentConfig().Schedules
+	target := sch.target()
+	meta := requestMeta{User: sch.Owner, Log: log}
+	stdout := &cappedBuffer{max: cfg.MaxOutput}
+	stderr := &cappedBuffer{max: cfg.MaxOutput}
+	var result execResponse
+	sshConn, release, err := target.connect(s.ctx, meta)
+	if err == nil {
+		log.Info("Schedule run started", "host", target.Host, "ssh_user", target.User)
+		result, err = runCommand(s.ctx, meta, sshConn, sch.Command, nil, sch.timeout, stdout, stderr)
+		release()
+	} else if cause := context.Cause(s.ctx); cause != nil {
+		err = cause
+	}
+	ev := execAuditEvent(meta, target, sch.Command, result, sch.timeout, err)
+	ev.Action = "schedule"
+	ev.Target = sch.ID
+	audit.Emit(ev)
+
+	run := scheduleRun{
+		Scheduled: at,
+		Host:      target.Host,
+		SSHUser:   target.User,
+		Duration:  result.Duration,
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.isTruncated() || stderr.isTruncated(),
+		Error:     errorString(err),
+	}
+	switch {
+	case errors.Is(err, errJobInterrupted):
+		run.Status = jobInterrupted
+	case err != nil:
+		run.Status = jobFailed
+	case result.TimedOut:
+		run.Status = jobTimedOut
+	default:
+		run.Status = jobCompleted
+	}
+	// An interrupted command that had started was killed
+	if err == nil || (run.Status == jobInterrupted && result.Duration > 0) {
+		run.ExitCode = &result.ExitCode
+		run.Signal = result.Signal
+	}
+	s.record(sch, run)
+	log.Info("Schedule run finished", "status", run.Status, "exit_code", result.ExitCode, "duration", time.Duration(result.Duration*float64(time.Second)))
+	if sch.Notify && run.failed() && cfg.WebhookURL != "" {
+		go notifyScheduleFailure(cfg.WebhookURL, sch, run)
+	}
+}
+
+// interrupt stops the running commands for shutdown, and waits up to
+// timeout for them to record their end
+func (s *scheduler) interrupt(timeout time.Duration) {
+	s.cancel(errJobInterrupted)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Schedule runs did not stop in time")
+	}
+}
+
+// scheduleNotification is what the webhook is sent about a failed run.
+// The output passes through redact.
+type scheduleNotification struct {
+	Event    string      `json:"event"` // "schedule_failed"
+	Schedule string      `json:"schedule"`
+	Command  string      `json:"command"`
+	Run      scheduleRun `json:"run"`
+	Version  string      `json:"version"`
+}
+
+func notifyScheduleFailure(webhookURL string, sch *Schedule, run scheduleRun) {
+	run.Stdout, run.Stderr, run.Error = redact(run.Stdout), redact(run.Stderr), redact(run.Error)
+	if err := postWebhook(webhookURL, scheduleNotification{Event: "schedule_failed", Schedule: sch.ID, Command: redact(sch.Command), Run: run, Version: build.Version}); err != nil {
+		slog.Warn("Failed to send schedule notification", "schedule", sch.ID, "err", err)
+	}
+}
+
+// postWebhook sends v to a webhook as JSON
+func postWebhook(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// scheduleView is a schedule as the API returns it
+type scheduleView struct {
+	*Schedule
+	// Next is when the schedule runs next, if ever
+	Next    *time.Time `json:"next,omitempty"`
+	Running bool       `json:"running"`
+	// LastRun is the latest run, without its output
+	LastRun *scheduleRun `json:"last_run,omitempty"`
+}
+
+func newScheduleView(sch *Schedule) scheduleView {
+	view := scheduleView{Schedule: sch}
+	if next, ok := sch.cron.next(time.Now().In(currentConfig().scheduleLocation)); ok {
+		view.Next = &next
+	}
+	var runs []scheduleRun
+	runs, view.Running = schedules.history(sch.ID)
+	if len(runs) > 0 {
+		last := runs[0]
+		last.Stdout, last.Stderr = "", ""
+		view.LastRun = &last
+	}
+	return view
+}
+
+// scheduleVisible reports whether the caller of r may see sch and the
+// output of its runs: its owner and admin keys may, and only admin keys
+// see the schedules from the config file
+func scheduleVisible(sch *Schedule, r *http.Request) bool {
+	if key := apiKeyFromContext(r.Context()); key != nil && key.hasScope(scopeAdmin) {
+		return true
+	}
+	return sch.Owner != "" && sch.Owner == requestIdentity(r).User
+}
+
+// scheduleRequest is the body of POST /api/schedules
+type scheduleRequest struct {
+	Cron        string `json:"cron"`
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	Credentials string `json:"credentials"`
+	Command     string `json:"command"`
+	Timeout     string `json:"timeout"`
+	Notify      bool   `json:"notify"`
+}
+
+// schedulesHandler lists, on GET /api/schedules, the schedules the caller
+// may see, and creates one on POST
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		list := []scheduleView{}
+		for _, sch := range schedules.all() {
+			if scheduleVisible(sch, r) {
+				list = append(list, newScheduleView(sch))
+			}
+		}
+		httpapi.JSON(w, map[string]interface{}{
+			"success":   true,
+			"schedules": list,
+		})
+
+	case "POST":
+		var req scheduleRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			responder.ErrorCode(w, r, httpapi.BadRequest, "Invalid JSON body: "+err.Error())
+			return
+		}
+		// Schedule IDs are random like job IDs
+		sch := &Schedule{
+			ID:          newJobID(),
+			Cron:        req.Cron,
+			Host:        req.Host,
+			User:        req.User,
+			Credentials: req.Credentials,
+			Command:     req.Command,
+			Timeout:     req.Timeout,
+			Notify:      req.Notify,
+			Source:      "api",
+			Owner:       requestIdentity(r).User,
+		}
+		if err := sch.prepare(currentConfig().Jobs.MaxTimeout); err != nil {
+			responder.Error(w, r, err, httpapi.BadRequest)
+			return
+		}
+		if err := authorize(r, sch.target().Host, sch.target().User, opExec); err != nil {
+			responder.Error(w, r, err, httpapi.Forbidden)
+			return
+		}
+		if err := schedules.put(sch); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditScheduleChange(r, "schedule_create", sch.ID)
+		requestLogger(r).Info("Schedule created", "schedule", sch.ID, "cron", sch.Cron, "host", sch.Host)
+		httpapi.JSONStatus(w, http.StatusCreated, newScheduleView(sch))
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+// scheduleHandler returns and deletes /api/schedules/{id}, and lists its
+// runs, newest first, on /api/schedules/{id}/runs
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/schedules/"), "/")
+	sch, ok := schedules.get(id)
+	if !ok || !scheduleVisible(sch, r) || (sub != "" && sub != "runs") {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Schedule not found")
+		return
+	}
+
+	if sub == "runs" {
+		if r.Method != "GET" {
+			responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+			return
+		}
+		runs, running := schedules.history(sch.ID)
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				responder.ErrorCode(w, r, httpapi.BadRequest, "Limit must be a positive integer")
+				return
+			}
+			runs = runs[:min(n, len(runs))]
+		}
+		httpapi.JSON(w, map[string]interface{}{
+			"schedule": sch.ID,
+			"running":  running,
+			"runs":     runs,
+		})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		httpapi.JSON(w, newScheduleView(sch))
+
+	case "DELETE":
+		if sch.Source != "api" {
+			responder.ErrorCode(w, r, httpapi.Forbidden, "Schedules from the config file can only be removed there")
+			return
+		}
+		if err := schedules.remove(sch.ID); err != nil {
+			responder.Error(w, r, err, httpapi.Internal)
+			return
+		}
+		auditScheduleChange(r, "schedule_delete", sch.ID)
+		requestLogger(r).Info("Schedule deleted", "schedule", sch.ID)
+		httpapi.JSON(w, map[string]interface{}{
+			"success": true,
+		})
+
+	default:
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+func auditScheduleChange(r *http.Request, action, id string) {
+	audit.Emit(AuditEvent{
+		Event:    auditAdminAction,
+		Outcome:  outcomeSuccess,
+		ClientIP: clientIP(r),
+		User:     requestIdentity(r).User,
+		Action:   action,
+		Target:   id,
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSchedulesVisibleToOwner(t *testing.T) {
+	useConfig(t, `
+schedules:
+  entries:
+    - id: nightly
+      cron: "30 2 * * *"
+      host: db01:22
+      user: backup
+      credentials: stored:backup
+      command: backup.sh
+`)
+	srv := startTestGateway(t)
+	keys := map[string]string{}
+	for name, scopes := range map[string][]string{"alice": {scopeExec}, "bob": {scopeExec}, "admin": {scopeExec, scopeAdmin}} {
+		secret, _, err := mintAPIKey(name, scopes, 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = secret
+	}
+
+	status, data := callAPI(t, apiRequest(t, srv, "POST", "/api/schedules", keys["alice"], scheduleRequest{
+		Cron: "*/5 * * * *", Host: "web01:22", User: "deploy", Credentials: "stored:deploy", Command: "uptime",
+	}))
+	var created scheduleView
+	if err := json.Unmarshal(data, &created); status != http.StatusCreated || err != nil {
+		t.Fatalf("creating a schedule: status %d: %s", status, data)
+	}
+	id := created.ID
+	t.Cleanup(func() { schedules.remove(id) })
+	if created.Owner != "alice" {
+		t.Errorf("owner %q, want alice", created.Owner)
+	}
+
+	listed := func(key string) map[string]bool {
+		t.Helper()
+		status, data := callAPI(t, apiRequest(t, srv, "GET", "/api/schedules", key, nil))
+		var resp struct {
+			Schedules []scheduleView `json:"schedules"`
+		}
+		if err := json.Unmarshal(data, &resp); status != http.StatusOK || err != nil {
+			t.Fatalf("listing schedules: status %d: %s", status, data)
+		}
+		ids := map[string]bool{}
+		for _, sch := range resp.Schedules {
+			ids[sch.ID] = true
+		}
+		return ids
+	}
+	if got := listed(keys["alice"]); !got[id] || got["nightly"] || len(got) != 1 {
+		t.Errorf("alice sees %v, want only her schedule", got)
+	}
+	if got := listed(keys["bob"]); len(got) != 0 {
+		t.Errorf("bob sees %v, want none", got)
+	}
+	if got := listed(keys["admin"]); !got[id] || !got["nightly"] {
+		t.Errorf("admin sees %v, want both schedules", got)
+	}
+
+	for _, path := range []string{"/api/schedules/" + id, "/api/schedules/" + id + "/runs", "/api/schedules/nightly", "/api/schedules/nightly/runs"} {
+		if status, data := callAPI(t, apiRequest(t, srv, "GET", path, keys["bob"], nil)); status != http.StatusNotFound {
+			t.Errorf("bob's GET %s: status %d, want 404: %s", path, status, data)
+		}
+	}
+	if status, data := callAPI(t, apiRequest(t, srv, "DELETE", "/api/schedules/"+id, keys["bob"], nil)); status != http.StatusNotFound {
+		t.Errorf("bob's DELETE: status %d, want 404: %s", status, data)
+	}
+	if _, ok := schedules.get(id); !ok {
+		t.Fatal("bob deleted alice's schedule")
+	}
+	if status, data := callAPI(t, apiRequest(t, srv, "GET", "/api/schedules/"+id+"/runs", keys["alice"], nil)); status != http.StatusOK {
+		t.Errorf("alice's runs: status %d: %s", status, data)
+	}
+	if status, data := callAPI(t, apiRequest(t, srv, "DELETE", "/api/schedules/"+id, keys["alice"], nil)); status != http.StatusOK {
+		t.Errorf("alice's DELETE: status %d: %s", status, data)
+	}
+}
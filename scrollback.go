@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshbridge"
+)
+
+const defaultScrollbackBytes = 256 << 10
+
+// scrollback is a ring buffer of a session's most recent output, exactly
+// as it was sent to the page, so after session.sanitize_output. It is
+// guarded by the wsWriter's mu.
+type scrollback struct {
+	size  int
+	buf   []byte
+	start int // index of the oldest byte
+	n     int // bytes held
+	// full is set once older output has been overwritten
+	full bool
+}
+
+func newScrollback(size int) *scrollback {
+	return &scrollback{size: size}
+}
+
+func (s *scrollback) write(p []byte) {
+	if s.buf == nil {
+		s.buf = make([]byte, s.size)
+	}
+	if len(p) >= s.size {
+		copy(s.buf, p[len(p)-s.size:])
+		s.start, s.n, s.full = 0, s.size, true
+		return
+	}
+	end := (s.start + s.n) % s.size
+	c := copy(s.buf[end:], p)
+	copy(s.buf, p[c:])
+	s.n += len(p)
+	if s.n > s.size {
+		s.start = (s.start + s.n - s.size) % s.size
+		s.n, s.full = s.size, true
+	}
+}
+
+// tail returns the last n bytes held, or all of them when n is 0. Unless it
+// reaches back to the session's first output, it starts at a line, so the
+// replay doesn't begin halfway through one.
+func (s *scrollback) tail(n int) []byte {
+	if n <= 0 || n > s.n {
+		n = s.n
+	}
+	out := make([]byte, n)
+	from := (s.start + s.n - n) % s.size
+	c := copy(out, s.buf[from:])
+	copy(out[c:], s.buf)
+	if n < s.n || s.full {
+		if i := bytes.IndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+	}
+	return out
+}
+
+// since returns the last n bytes written, exactly, while the scrollback
+// still holds them, and otherwise all it holds from a line on
+func (s *scrollback) since(n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	if n > s.n {
+		return s.tail(0)
+	}
+	out := make([]byte, n)
+	from := (s.start + s.n - n) % s.size
+	c := copy(out, s.buf[from:])
+	copy(out[c:], s.buf)
+	return out
+}
+
+func (s *scrollback) clear() {
+	s.buf, s.start, s.n, s.full = nil, 0, 0, false
+}
+
+// keptScrollback returns the scrollback unless the session's memory budget
+// gave it up, freeing it then. Its buffer is charged before it is first
+// written to when grow is set. The caller holds mu.
+func (w *wsWriter) keptScrollback(grow bool) *scrollback {
+	if w.scrollback == nil {
+		return nil
+	}
+	if w.mem.scrollbackDropped() || (grow && w.scrollback.buf == nil && !w.mem.keepScrollback(w.scrollback.size)) {
+		w.scrollback = nil
+	}
+	return w.scrollback
+}
+
+// replay sends the last n bytes of the scrollback again, up to all of it
+// when n is 0. Live output waits until it has been sent.
+func (w *wsWriter) replay(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var data []byte
+	if sb := w.keptScrollback(false); sb != nil {
+		data = sb.tail(n)
+	}
+	if err := w.writeJSON(sshbridge.ReplayMessage{Type: "replay", Bytes: len(data)}); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := w.write(websocket.BinaryMessage, data); err != nil {
+			return err
+		}
+	}
+	return w.writeJSON(sshbridge.ReplayMessage{Type: "replay_end"})
+}
+
+// clearScrollback forgets the session's output, at the user's request
+func (w *wsWriter) clearScrollback() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.scrollback != nil {
+		w.scrollback.clear()
+		w.mem.releaseScrollback()
+	}
+	return w.writeJSON(sshbridge.ReplayMessage{Type: "scrollback_cleared"})
+}
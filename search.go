@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// Searches look for lines matching a pattern in the files under a directory
+// of a host. They run grep over exec where the host has it, the pattern
+// reaching grep on its stdin rather than in the command, and otherwise walk
+// the directory over SFTP.
+
+const (
+	// searchMaxLine is how much of a matching line is returned
+	searchMaxLine = 1024
+	// searchScanLine is how much of each line is matched when searching
+	// over SFTP
+	searchScanLine = 64 << 10
+	// searchBinaryPeek is how much of a file is looked at for NULs, which
+	// make it binary and not searched, like grep -I does
+	searchBinaryPeek = 8 << 10
+)
+
+// searchProbeCommand succeeds on hosts with a find and a grep that
+// understand the options searches use
+const searchProbeCommand = `command -v find >/dev/null 2>&1 && command -v xargs >/dev/null 2>&1 && echo x | grep -nIH --null -F -e x >/dev/null 2>&1`
+
+// searchGrepCommand reads the pattern from the first line of its stdin,
+// then searches the NUL-separated file names that follow
+const searchGrepCommand = `IFS= read -r p && exec xargs -0 grep -nIH --null %s -e "$p" --`
+
+// searchRequest is the body of POST /api/files/search
+type searchRequest struct {
+	targetRequest
+	Root    string `json:"root"`
+	Pattern string `json:"pattern"`
+	// Regex reads Pattern as an extended regular expression; it is a fixed
+	// string otherwise
+	Regex      bool `json:"regex"`
+	IgnoreCase bool `json:"ignore_case"`
+	// Include only searches files whose names match one of these globs
+	Include    []string `json:"include"`
+	MaxMatches int      `json:"max_matches"`
+	MaxFiles   int      `json:"max_files"`
+	Timeout    string   `json:"timeout"`
+}
+
+// searchMatch is a line of the response for each matching line
+type searchMatch struct {
+	Event string `json:"event"` // "match"
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Text  string `json:"text"`
+	// Truncated is set when the line was longer than searchMaxLine
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// searchSummary is the last line of the response
+type searchSummary struct {
+	Event   string `json:"event"`  // "summary"
+	Method  string `json:"method"` // grep or sftp
+	Matches int    `json:"matches"`
+	Files   int    `json:"files"` // searched so far
+	// Stopped names the limit that ended the search early: matches, files
+	// or timeout
+	Stopped  string  `json:"stopped,omitempty"`
+	Duration float64 `json:"duration"` // in seconds
+	// Warning is the first complaint of find or grep, such as a directory
+	// that couldn't be read
+	Warning string             `json:"warning,omitempty"`
+	Error   *httpapi.ErrorBody `json:"error,omitempty"`
+}
+
+// fileSearch is a search in progress, written to the response as it goes
+type fileSearch struct {
+	root       string
+	pattern    string
+	grepFlags  string
+	re         *regexp.Regexp
+	include    []string
+	maxMatches int
+	maxFiles   int
+
+	meter *quotaMeter
+	enc   *json.Encoder
+	flush func() error
+
+	// mu guards the counts, which the grep search updates from two
+	// goroutines
+	mu      sync.Mutex
+	summary searchSummary
+	bytes   int64
+}
+
+// searchHandler streams the lines matching a pattern in the files under a
+// directory, as NDJSON
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+
+	var req searchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		responder.ErrorCode(w, r, httpapi.BadRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+	s, timeout, err := newFileSearch(&req)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	target, err := resolveTransferTarget(r, opDownload, req.param)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	if err := authorize(r, target.Host, target.User, opDownload); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+	if err := quotas.check(target.Quotas); err != nil {
+		responder.Error(w, r, err, httpapi.QuotaExceeded)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	s.meter = &quotaMeter{subjects: target.Quotas, meta: meta, op: opDownload}
+	ctx, span := startRequestSpan(r, "files.search")
+	sshConn, release, err := target.connect(ctx, meta)
+	if err != nil {
+		endSpan(span, err)
+		responder.Error(w, r, err, httpapi.ConnectFailed)
+		return
+	}
+	defer release()
+	if s.root, err = transfer.HostDownloadPath(sshConn, s.root); err != nil {
+		endSpan(span, err)
+		responder.Error(w, r, err, httpapi.PathNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	s.enc = json.NewEncoder(w)
+	s.flush = http.NewResponseController(w).Flush
+
+	start := time.Now()
+	searchCtx, cancel := context.WithTimeout(ctx, timeout)
+	err = s.run(searchCtx, meta.Log, sshConn)
+	if searchCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		s.summary.Stopped, err = "timeout", nil
+	}
+	cancel()
+	s.summary.Event = "summary"
+	s.summary.Duration = time.Since(start).Seconds()
+	if err != nil {
+		body := responder.Body(r, err, httpapi.TransferFailed)
+		s.summary.Error = &body
+	}
+	s.enc.Encode(s.summary)
+
+	span.SetAttributes(attribute.Int("gossh.search.matches", s.summary.Matches), attribute.Int("gossh.search.files", s.summary.Files))
+	endSpan(span, err)
+	audit.Emit(AuditEvent{
+		Event:    auditDownload,
+		Outcome:  outcomeOf(err),
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     target.Host,
+		SSHUser:  target.User,
+		Path:     s.root,
+		Size:     s.bytes,
+		Action:   "search",
+		Target:   req.Pattern,
+		Error:    errorString(err),
+	})
+	if err != nil {
+		meta.Log.Error("Search failed", "host", target.Host, "ssh_user", target.User, "root", s.root, "err", err)
+		return
+	}
+	meta.Log.Info("Search finished", "host", target.Host, "ssh_user", target.User, "root", s.root, "method", s.summary.Method, "matches", s.summary.Matches, "files", s.summary.Files, "stopped", s.summary.Stopped)
+}
+
+// newFileSearch checks a search request, returning the search and how long
+// it may run
+func newFileSearch(req *searchRequest) (*fileSearch, time.Duration, error) {
+	cfg := currentConfig().Transfers
+	if req.Root == "" || req.Pattern == "" {
+		return nil, 0, httpapi.Errorf(httpapi.MissingParams, "Missing root or pattern")
+	}
+	if strings.ContainsAny(req.Pattern, "\n\x00") {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid pattern: it can't span lines")
+	}
+	expr := req.Pattern
+	flags := "-F"
+	if req.Regex {
+		flags = "-E"
+	} else {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if req.IgnoreCase {
+		expr = "(?i)" + expr
+		flags += " -i"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid pattern: %v", err)
+	}
+	for _, glob := range req.Include {
+		if _, err := path.Match(glob, ""); err != nil || glob == "" || strings.Contains(glob, "/") {
+			return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid include %q: expected a file name glob", glob)
+		}
+	}
+
+	s := &fileSearch{
+		root:       req.Root,
+		pattern:    req.Pattern,
+		grepFlags:  flags,
+		re:         re,
+		include:    req.Include,
+		maxMatches: cfg.SearchMaxMatches,
+		maxFiles:   cfg.SearchMaxFiles,
+	}
+	if req.MaxMatches < 0 || req.MaxFiles < 0 {
+		return nil, 0, httpapi.Errorf(httpapi.BadRequest, "max_matches and max_files can't be negative")
+	}
+	if req.MaxMatches > 0 {
+		s.maxMatches = min(req.MaxMatches, s.maxMatches)
+	}
+	if req.MaxFiles > 0 {
+		s.maxFiles = min(req.MaxFiles, s.maxFiles)
+	}
+	timeout := cfg.SearchTimeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			return nil, 0, httpapi.Errorf(httpapi.BadRequest, "Invalid timeout %q", req.Timeout)
+		}
+		timeout = min(d, timeout)
+	}
+	return s, timeout, nil
+}
+
+// run searches with grep where the host has it, and over SFTP otherwise
+func (s *fileSearch) run(ctx context.Context, logger *slog.Logger, sshConn *ssh.Client) error {
+	if transfer.Platform(sshConn) != transfer.Windows {
+		_, err := transfer.CommandOutput(sshConn, searchProbeCommand, transfer.ProbeTimeout)
+		if err == nil {
+			s.summary.Method = "grep"
+			return s.grep(ctx, sshConn)
+		}
+		logger.Debug("grep unavailable, searching over SFTP", "err", err)
+	}
+	s.summary.Method = "sftp"
+	client, err := sftp.NewClient(sshConn)
+	if err != nil {
+		return fmt.Errorf("the host has neither grep nor SFTP: %v", err)
+	}
+	defer client.Close()
+	root := s.root
+	if transfer.Platform(sshConn) == transfer.Windows {
+		root = "/" + root
+	}
+	return s.walk(ctx, client, root)
+}
+
+// match reports a matching line, telling whether the search goes on
+func (s *fileSearch) match(file string, line int, text []byte, truncated bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.summary.Matches >= s.maxMatches {
+		s.summary.Stopped = "matches"
+		return false, nil
+	}
+	if err := s.meter.charge(len(text)); err != nil {
+		return false, err
+	}
+	s.summary.Matches++
+	s.bytes += int64(len(text))
+	s.enc.Encode(searchMatch{Event: "match", File: file, Line: line, Text: string(text), Truncated: truncated})
+	s.flush()
+	return true, nil
+}
+
+// visit counts a file about to be searched, telling whether it may be
+func (s *fileSearch) visit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.summary.Files >= s.maxFiles {
+		s.summary.Stopped = "files"
+		return false
+	}
+	s.summary.Files++
+	return true
+}
+
+// included tells whether a file called name is searched
+func (s *fileSearch) included(name string) bool {
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, glob := range s.include {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grep lists the files under the root with find and feeds them to grep,
+// which gets the pattern from its stdin. Passing the names through gossh
+// counts them against the file limit.
+func (s *fileSearch) grep(ctx context.Context, sshConn *ssh.Client) error {
+	findArgs := []string{"find", transfer.ShellQuote(s.root), "-type", "f"}
+	if len(s.include) > 0 {
+		findArgs = append(findArgs, `\(`)
+		for i, glob := range s.include {
+			if i > 0 {
+				findArgs = append(findArgs, "-o")
+			}
+			findArgs = append(findArgs, "-name", transfer.ShellQuote(glob))
+		}
+		findArgs = append(findArgs, `\)`)
+	}
+	findArgs = append(findArgs, "-print0")
+
+	find, err := sshConn.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer find.Close()
+	grep, err := sshConn.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer grep.Close()
+
+	names, err := find.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	stdin, err := grep.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdin pipe: %v", err)
+	}
+	stdout, err := grep.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	findErr := &cappedBuffer{max: searchMaxLine}
+	grepErr := &cappedBuffer{max: searchMaxLine}
+	find.Stderr, grep.Stderr = findErr, grepErr
+
+	if err := find.Start(strings.Join(findArgs, " ")); err != nil {
+		return fmt.Errorf("failed to start find: %v", err)
+	}
+	if err := grep.Start(fmt.Sprintf(searchGrepCommand, s.grepFlags)); err != nil {
+		return fmt.Errorf("failed to start grep: %v", err)
+	}
+
+	// Closing the sessions ends both commands and unblocks their pipes,
+	// once the search is over or out of time
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			find.Signal(ssh.SIGKILL)
+			grep.Signal(ssh.SIGKILL)
+			find.Close()
+			grep.Close()
+		})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-done:
+		}
+	}()
+
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		defer stdin.Close()
+		if _, err := io.WriteString(stdin, s.pattern+"\n"); err != nil {
+			return
+		}
+		br := bufio.NewReader(names)
+		for {
+			name, err := br.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			if !s.visit() {
+				find.Signal(ssh.SIGKILL)
+				find.Close()
+				return
+			}
+			if _, err := stdin.Write(name); err != nil {
+				return
+			}
+		}
+	}()
+
+	br := bufio.NewReader(stdout)
+	for {
+		name, err := br.ReadBytes(0)
+		if err != nil {
+			break
+		}
+		line, truncated, err := readLine(br, searchMaxLine+20)
+		if err != nil {
+			break
+		}
+		num, text, _ := bytes.Cut(line, []byte(":"))
+		n, _ := strconv.Atoi(string(num))
+		if len(text) > searchMaxLine {
+			text, truncated = text[:searchMaxLine], true
+		}
+		more, err := s.match(string(name[:len(name)-1]), n, text, truncated)
+		if err != nil || !more {
+			stop()
+			<-fed
+			return err
+		}
+	}
+	<-fed
+	find.Wait()
+	grep.Wait()
+	for _, b := range []*cappedBuffer{findErr, grepErr} {
+		if msg, _, _ := strings.Cut(strings.TrimSpace(b.String()), "\n"); msg != "" && s.summary.Warning == "" {
+			s.summary.Warning = msg
+		}
+	}
+	return nil
+}
+
+// walk searches the files under root over SFTP, without following links
+func (s *fileSearch) walk(ctx context.Context, client *sftp.Client, root string) error {
+	walker := client.Walk(root)
+	for walker.Step() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := walker.Err(); err != nil {
+			if s.summary.Warning == "" {
+				s.summary.Warning = err.Error()
+			}
+			continue
+		}
+		if !walker.Stat().Mode().IsRegular() || !s.included(path.Base(walker.Path())) {
+			continue
+		}
+		if !s.visit() {
+			return nil
+		}
+		more, err := s.searchFile(ctx, client, walker.Path())
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchFile searches one file over SFTP, telling whether the search goes on
+func (s *fileSearch) searchFile(ctx context.Context, client *sftp.Client, remotePath string) (bool, error) {
+	f, err := client.Open(remotePath)
+	if err != nil {
+		if s.summary.Warning == "" {
+			s.summary.Warning = err.Error()
+		}
+		return true, nil
+	}
+	defer f.Close()
+
+	// Windows paths are given as C:/Users/..., like the root
+	name := remotePath
+	if transfer.WindowsDrivePath.MatchString(name) {
+		name = strings.TrimPrefix(name, "/")
+	}
+	br := bufio.NewReaderSize(f, searchBinaryPeek)
+	if head, _ := br.Peek(searchBinaryPeek); bytes.IndexByte(head, 0) >= 0 {
+		return true, nil
+	}
+	for n := 1; ctx.Err() == nil; n++ {
+		line, long, err := readLine(br, searchScanLine)
+		if err != nil {
+			return true, nil
+		}
+		if !s.re.Match(line) {
+			continue
+		}
+		text, truncated := line, long
+		if len(text) > searchMaxLine {
+			text, truncated = text[:searchMaxLine], true
+		}
+		if more, err := s.match(name, n, text, truncated); err != nil || !more {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// readLine reads a line from br without its newline, keeping only the first
+// limit bytes of longer ones, which it reports
+func readLine(br *bufio.Reader, limit int) ([]byte, bool, error) {
+	var line []byte
+	n := 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+		n += len(chunk)
+		if room := limit - len(line); room > 0 {
+			line = append(line, chunk[:min(room, len(chunk))]...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && n > 0:
+			err = nil
+		}
+		return line, n > limit, err
+	}
+}
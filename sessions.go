@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+// activeSession is a terminal session with an established SSH connection.
+// Uploads and downloads started from the terminal page reuse its connection
+// by session ID instead of sending credentials again.
+type activeSession struct {
+	ID       string
+	ClientIP string
+	User     string
+	Host     string
+	SSHUser  string
+	Started  time.Time
+
+	// Restricted sessions only run allowlisted commands, so their
+	// connection can't be borrowed for file transfers
+	Restricted bool
+	// ReadOnly sessions are view-only
+	ReadOnly bool
+	// Protocol is set for telnet sessions, which have no SSH client
+	Protocol string
+	// Operations granted by the access token the session came from
+	Operations []string
+	// Token is the access token the session came from, for transfer quotas
+	Token quotaToken
+
+	client *ssh.Client
+	// shell is closed instead of client when the connection is pooled
+	shell io.Closer
+	out   *wsWriter
+	conn  sshbridge.Conn
+	// Session byte counters, shared with the session's tunnels
+	bytesIn, bytesOut *atomic.Int64
+	identity          Identity
+	// key is given to the page that opened the session, and stands in for
+	// an identity when borrowing the connection of an anonymous session
+	key string
+	// lastInput is when the user last typed, as UnixNano; idle keeps when
+	// the session last printed
+	lastInput atomic.Int64
+	idle      *idleMonitor
+	recording *sessionRecording
+	limit     *sessionLimit
+	// lock locks the session after session.lock_after without input;
+	// lockPassword checks the password it logged in with, to unlock it
+	lock         *sessionLock
+	lockPassword []byte
+	// idleTimeout ends the session after session.idle_timeout without
+	// input
+	idleTimeout *idleTimeout
+	// shared is set when other users have joined the session, by dual
+	// control
+	shared *sharedTerminal
+
+	// forwards are the open tunnels and proxied connections, closed when
+	// the session ends
+	forwardsMu sync.Mutex
+	forwards   map[forward]struct{}
+	ended      bool
+}
+
+// ownedBy reports whether id opened the session. Anonymous callers own no
+// session, since anyone can be anonymous.
+func (s *activeSession) ownedBy(id Identity) bool {
+	return id.User != "" && s.User == id.User
+}
+
+// usableBy reports whether a caller identified as id, presenting key, may
+// use the session's connection: it must be the user who opened the session,
+// or hold the session's key when it was opened anonymously
+func (s *activeSession) usableBy(id Identity, key string) bool {
+	if s.User != "" {
+		return s.User == id.User
+	}
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.key)) == 1
+}
+
+// forward is a connection forwarded through a session
+type forward interface {
+	close()
+}
+
+// trackForward registers f to be closed with the session. It returns false,
+// after closing f, when the session has already ended.
+func (s *activeSession) trackForward(f forward) bool {
+	s.forwardsMu.Lock()
+	if s.ended {
+		s.forwardsMu.Unlock()
+		f.close()
+		return false
+	}
+	if s.forwards == nil {
+		s.forwards = make(map[forward]struct{})
+	}
+	s.forwards[f] = struct{}{}
+	s.forwardsMu.Unlock()
+	return true
+}
+
+func (s *activeSession) untrackForward(f forward) {
+	s.forwardsMu.Lock()
+	delete(s.forwards, f)
+	s.forwardsMu.Unlock()
+}
+
+// closeForwards ends every forwarded connection of the session
+func (s *activeSession) closeForwards() {
+	s.forwardsMu.Lock()
+	s.ended = true
+	open := s.forwards
+	s.forwards = nil
+	s.forwardsMu.Unlock()
+	for f := range open {
+		f.close()
+	}
+}
+
+// typed notes input from the user
+func (s *activeSession) typed() {
+	s.lastInput.Store(time.Now().UnixNano())
+}
+
+// lastTyped is when the user last typed, or the session started
+func (s *activeSession) lastTyped() time.Time {
+	if n := s.lastInput.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return s.Started
+}
+
+// resized notes a change of the terminal's size
+func (s *activeSession) resized(cols, rows int) {
+	s.recording.resize(cols, rows)
+}
+
+// close ends the session from the server side, telling the page why
+func (s *activeSession) close(reason string) {
+	s.closeWith(websocket.CloseGoingAway, reason)
+}
+
+// closeWith is close with a WebSocket close code
+func (s *activeSession) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	s.conn.Close()
+	switch {
+	case s.shell != nil:
+		s.shell.Close()
+	case s.client != nil:
+		s.client.Close()
+	}
+}
+
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*activeSession
+	draining bool
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]*activeSession)}
+
+// register adds a session with a fresh random ID
+func (r *sessionRegistry) register(s *activeSession) error {
+	id, err := randomID(16)
+	if err != nil {
+		return err
+	}
+	if s.key, err = randomID(16); err != nil {
+		return err
+	}
+	s.ID = id
+	s.Started = time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return errShuttingDown
+	}
+	r.sessions[id] = s
+	s.idle = newIdleMonitor(s.out, s.Started)
+	s.recording = startRecording(s)
+	s.limit = startSessionLimit(s)
+	s.lock = startSessionLock(s)
+	s.idleTimeout = startIdleTimeout(s)
+	s.out.observe(s)
+	if s.shared != nil {
+		s.shared.attach(s)
+	}
+	return nil
+}
+
+func (r *sessionRegistry) unregister(id string) {
+	r.mu.Lock()
+	s := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if s != nil {
+		s.idle.stop()
+		s.limit.stop()
+		s.lock.stop()
+		s.idleTimeout.stop()
+		s.recording.finish()
+	}
+}
+
+func (r *sessionRegistry) get(id string) (*activeSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+func (r *sessionRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) snapshot() []*activeSession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*activeSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+func (r *sessionRegistry) isDraining() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.draining
+}
+
+// drain stops new sessions from registering and returns the active ones
+func (r *sessionRegistry) drain() []*activeSession {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+	return r.snapshot()
+}
+
+// sessionInfo is a session as /api/sessions lists it
+type sessionInfo struct {
+	ID         string `json:"id"`
+	User       string `json:"user,omitempty"`
+	ClientIP   string `json:"client_ip"`
+	Host       string `json:"host"`
+	SSHUser    string `json:"ssh_user,omitempty"`
+	Protocol   string `json:"protocol,omitempty"`
+	ReadOnly   bool   `json:"read_only,omitempty"`
+	Restricted bool   `json:"restricted,omitempty"`
+	// Participants are the users who joined a dual-control session
+	Participants []string  `json:"participants,omitempty"`
+	Started      time.Time `json:"started"`
+	// LastInput is when the user last typed, if ever, LastOutput when the
+	// session last printed, and LastActivity the later of the two
+	LastInput    *time.Time `json:"last_input,omitempty"`
+	LastOutput   time.Time  `json:"last_output"`
+	LastActivity time.Time  `json:"last_activity"`
+	// Inactive is set once the output has been quiet for
+	// session.inactivity.after
+	Inactive bool  `json:"inactive"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Memory is what the session's buffers hold, against
+	// session.memory_limit_bytes
+	Memory *sessionMemoryInfo `json:"memory,omitempty"`
+	// LockedSince is when the session was locked, while it is
+	LockedSince *time.Time `json:"locked_since,omitempty"`
+	// Key is the session key, shown only to the user who opened it
+	Key string `json:"key,omitempty"`
+}
+
+func (s *activeSession) info(now time.Time) sessionInfo {
+	info := sessionInfo{
+		ID:           s.ID,
+		User:         s.User,
+		ClientIP:     s.ClientIP,
+		Host:         s.Host,
+		SSHUser:      s.SSHUser,
+		Protocol:     s.Protocol,
+		ReadOnly:     s.ReadOnly,
+		Restricted:   s.Restricted,
+		Started:      s.Started,
+		Participants: s.shared.participantNames(),
+		LastOutput:   s.idle.last(),
+		BytesIn:      s.bytesIn.Load(),
+		BytesOut:     s.bytesOut.Load(),
+		Memory:       s.out.mem.info(),
+	}
+	info.LastActivity = info.LastOutput
+	if n := s.lastInput.Load(); n != 0 {
+		t := time.Unix(0, n)
+		info.LastInput = &t
+		if t.After(info.LastActivity) {
+			info.LastActivity = t
+		}
+	}
+	info.Inactive = now.Sub(info.LastOutput) >= currentConfig().Session.Inactivity.After
+	if t := s.lock.locked(); !t.IsZero() {
+		info.LockedSince = &t
+	}
+	return info
+}
+
+// sessionsHandler lists the open terminal sessions on GET /api/sessions,
+// most recently active first: all of them to admin keys, and otherwise
+// those the caller opened. Anonymous callers see none.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	key := apiKeyFromContext(r.Context())
+	admin := key != nil && key.hasScope(scopeAdmin)
+	id := requestIdentity(r)
+
+	now := time.Now()
+	list := []sessionInfo{}
+	for _, s := range sessions.snapshot() {
+		if owner := s.ownedBy(id); admin || owner {
+			info := s.info(now)
+			if owner {
+				info.Key = s.key
+			}
+			list = append(list, info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastActivity.After(list[j].LastActivity) })
+	httpapi.JSON(w, map[string]interface{}{
+		"success":  true,
+		"sessions": list,
+	})
+}
+
+// sessionHandler serves the actions on a session under /api/sessions/{id}/
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/")
+	s, ok := sessions.get(id)
+	if !ok {
+		responder.ErrorCode(w, r, httpapi.NotFound, "Session not found")
+		return
+	}
+	switch action {
+	case "unlock":
+		unlockHandler(w, r, s)
+	default:
+		responder.ErrorCode(w, r, httpapi.NotFound, "Not found")
+	}
+}
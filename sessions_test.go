@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gossh/internal/sshtest"
+)
+
+func TestSessionsListedToTheirOwner(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [127.0.0.1]
+authz:
+  user_header: X-User
+`)
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+	admin, _, err := mintAPIKey("admin", []string{scopeTerminal, scopeAdmin}, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := url.Values{"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password}}
+	anonymous := openTestPage(t, srv, login)
+	alice := openTestPageWith(t, srv, login, http.Header{"X-User": {"alice"}})
+
+	listed := func(key, user string) map[string]sessionInfo {
+		t.Helper()
+		r := apiRequest(t, srv, "GET", "/api/sessions", key, nil)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		status, data := callAPI(t, r)
+		var resp struct {
+			Sessions []sessionInfo `json:"sessions"`
+		}
+		if err := json.Unmarshal(data, &resp); status != http.StatusOK || err != nil {
+			t.Fatalf("listing sessions: status %d: %s", status, data)
+		}
+		ids := map[string]sessionInfo{}
+		for _, s := range resp.Sessions {
+			ids[s.ID] = s
+		}
+		return ids
+	}
+	if got := listed("", ""); len(got) != 0 {
+		t.Errorf("an anonymous caller sees %d sessions, want none", len(got))
+	}
+	got := listed("", "alice")
+	if _, ok := got[alice.session.SessionID]; !ok || len(got) != 1 {
+		t.Errorf("alice sees %v, want only her session", got)
+	}
+	if got[alice.session.SessionID].Key != alice.session.SessionKey {
+		t.Error("alice isn't given her session's key")
+	}
+	if got := listed("", "bob"); len(got) != 0 {
+		t.Errorf("bob sees %d sessions, want none", len(got))
+	}
+	got = listed(admin, "")
+	for _, page := range []*testPage{anonymous, alice} {
+		s, ok := got[page.session.SessionID]
+		if !ok {
+			t.Errorf("admin doesn't see session %s", page.session.SessionID)
+		}
+		if s.Key != "" {
+			t.Errorf("admin is given the key of session %s", page.session.SessionID)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultShutdownGrace   = 30 * time.Second
+	defaultShutdownMessage = "This server is shutting down for maintenance. Please save your work; the session will be closed shortly."
+)
+
+// errShuttingDown refuses sessions that finish connecting after shutdown began
+var errShuttingDown = errors.New("server is shutting down")
+
+// watchShutdown drains the servers on SIGINT or SIGTERM, or when a restart
+// handoff has passed the listeners on. The returned channel
+// is closed once shutdown is complete; a second signal exits immediately.
+func watchShutdown(servers []*http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		var reason string
+		select {
+		case sig := <-sigs:
+			reason = sig.String()
+		case reason = <-shutdownRequests:
+		}
+		go func() {
+			<-sigs
+			slog.Warn("Second signal received, exiting without draining")
+			os.Exit(1)
+		}()
+		slog.Info("Shutting down", "reason", reason)
+		shutdown(servers)
+		close(done)
+	}()
+	return done
+}
+
+// shutdown stops accepting connections, warns every terminal, and waits up
+// to server.shutdown_grace for sessions and transfers to finish before
+// closing whatever is left
+func shutdown(servers []*http.Server) {
+	cfg := currentConfig()
+	grace := cfg.Server.ShutdownGrace
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	// Shutdown closes the listeners and waits for in-flight requests such as
+	// uploads and downloads. Hijacked WebSockets are drained separately.
+	httpDone := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() { httpDone <- server.Shutdown(ctx) }()
+	}
+
+	// Jobs and scheduled commands run for hours, so they are interrupted
+	// rather than waited for
+	jobsDone := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schedules.interrupt(execKillGrace + time.Second)
+		}()
+		jobs.interrupt(execKillGrace + time.Second)
+		wg.Wait()
+		close(jobsDone)
+	}()
+
+	active := sessions.drain()
+	// Sessions still waiting for approval would have nowhere to go
+	approvals.cancelAll()
+	banner := []byte("\r\n\x1b[1;33m[" + cfg.Server.ShutdownMessage + "]\x1b[0m\r\n")
+	for _, s := range active {
+		s.out.WriteMessage(websocket.BinaryMessage, banner)
+	}
+	slog.Info("Waiting for sessions to end", "sessions", len(active), "grace", grace)
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for sessions.count() > 0 {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	if remaining := sessions.snapshot(); len(remaining) > 0 {
+		slog.Warn("Grace period over, closing remaining sessions", "sessions", len(remaining))
+		for _, s := range remaining {
+			s.close("server shutting down")
+		}
+		// Give the sessions a moment to record their end
+		deadline := time.Now().Add(5 * time.Second)
+		for sessions.count() > 0 && time.Now().Before(deadline) {
+			<-ticker.C
+		}
+	}
+
+	failed := false
+	for range servers {
+		if err := <-httpDone; err != nil {
+			slog.Warn("Grace period over, closing remaining requests", "err", err)
+			failed = true
+		}
+	}
+	if failed {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+	<-jobsDone
+	audit.flush(5 * time.Second)
+	shutdownTracing()
+	slog.Info("Shutdown complete")
+}
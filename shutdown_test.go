@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startFakeSession registers a terminal session over a fakeConn. It ends
+// when the connection is closed or, if leave is set, when the page sees
+// the shutdown banner.
+func startFakeSession(t *testing.T, leave bool) *fakeConn {
+	t.Helper()
+	conn := newFakeConn()
+	conn.notify = make(chan fakeMessage, 16)
+	s := &activeSession{Host: "web01:22", SSHUser: "deploy", conn: conn, out: newTerminalWriter(conn)}
+	if err := sessions.register(s); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer sessions.unregister(s.ID)
+		for {
+			select {
+			case m := <-conn.notify:
+				if leave && strings.Contains(string(m.data), currentConfig().Server.ShutdownMessage) {
+					return
+				}
+			case <-conn.closed:
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+// undrain lets sessions register again once the test ends
+func undrain(t *testing.T) {
+	t.Cleanup(func() {
+		sessions.mu.Lock()
+		sessions.draining = false
+		sessions.mu.Unlock()
+	})
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	useConfig(t, `
+server:
+  shutdown_grace: 300ms
+  shutdown_message: Back at noon
+`)
+	undrain(t)
+	polite := startFakeSession(t, true)
+	stubborn := startFakeSession(t, false)
+
+	// A download in progress is let finish
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "report.csv")
+	})}
+	go srv.Serve(ln)
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/download")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+
+	start := time.Now()
+	shutdown([]*http.Server{srv})
+	elapsed := time.Since(start)
+
+	if elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("shutdown took %v with a session outlasting the 300ms grace", elapsed)
+	}
+	for name, conn := range map[string]*fakeConn{"polite": polite, "stubborn": stubborn} {
+		if !strings.Contains(conn.output(), "[Back at noon]") {
+			t.Errorf("%s session wasn't warned: %q", name, conn.output())
+		}
+	}
+	if len(polite.controls) != 0 {
+		t.Errorf("session that left was closed too: %q", polite.controls)
+	}
+	want := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	if len(stubborn.controls) != 1 || string(stubborn.controls[0].data) != string(want) {
+		t.Errorf("session outlasting the grace got %q, want a going-away close", stubborn.controls)
+	}
+	if n := sessions.count(); n != 0 {
+		t.Errorf("%d sessions left after shutdown", n)
+	}
+	if got := <-body; got != "report.csv" {
+		t.Errorf("download in progress got %q", got)
+	}
+	if err := sessions.register(&activeSession{out: newTerminalWriter(newFakeConn())}); err != errShuttingDown {
+		t.Errorf("session registered during shutdown: %v", err)
+	}
+}
+
+func TestShutdownEndsEarly(t *testing.T) {
+	useConfig(t, `
+server:
+  shutdown_grace: 10s
+`)
+	undrain(t)
+	conn := startFakeSession(t, true)
+
+	start := time.Now()
+	shutdown(nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown waited %v after the last session ended", elapsed)
+	}
+	if !strings.Contains(conn.output(), defaultShutdownMessage) {
+		t.Errorf("session wasn't warned with the default message: %q", conn.output())
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// socksHandshakeTimeout bounds the SOCKS negotiation before a connection is
+// relayed
+const socksHandshakeTimeout = 10 * time.Second
+
+// inheritedSOCKSPrefix marks the SOCKS listener among handed-over sockets
+const inheritedSOCKSPrefix = "socks:"
+
+// SOCKS5 constants, RFC 1928 and RFC 1929
+const (
+	socksVersion       = 5
+	socksAuthVersion   = 1
+	socksAuthPassword  = 0x02
+	socksNoAcceptable  = 0xff
+	socksCmdConnect    = 0x01
+	socksAtypIPv4      = 0x01
+	socksAtypDomain    = 0x03
+	socksAtypIPv6      = 0x04
+	socksSucceeded     = 0x00
+	socksGeneralFail   = 0x01
+	socksNotAllowed    = 0x02
+	socksHostUnreach   = 0x04
+	socksCmdNotSupp    = 0x07
+	socksAtypeNotSupp  = 0x08
+	socksAuthSucceeded = 0x00
+	socksAuthFailed    = 0x01
+)
+
+// socksAddress binds forwarding.socks_listen, defaulting the host to
+// localhost
+func socksAddress(listen string) string {
+	if _, err := strconv.Atoi(listen); err == nil {
+		return net.JoinHostPort("127.0.0.1", listen)
+	}
+	if host, port, err := net.SplitHostPort(listen); err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return listen
+}
+
+// startSOCKSProxy opens the SOCKS5 listener, or adopts it from the process
+// that handed over its listeners. The returned bound listener is passed on
+// by the next restart handoff.
+func startSOCKSProxy(listen string) (boundListener, error) {
+	addr := socksAddress(listen)
+	key := inheritedSOCKSPrefix + addr
+	var ln net.Listener
+	var err error
+	if f, ok := inheritedListeners[key]; ok {
+		delete(inheritedListeners, key)
+		ln, err = adoptListener(f)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return boundListener{}, err
+	}
+	slog.Info("SOCKS proxy listening", "addr", ln.Addr().String())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Warn("SOCKS proxy accept failed", "err", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go serveSOCKS(conn)
+		}
+	}()
+	return boundListener{ListenerConfig: ListenerConfig{Address: key}, ln: ln}, nil
+}
+
+// serveSOCKS negotiates one SOCKS5 connection. The username names the
+// session to proxy through and the password is its session key.
+func serveSOCKS(conn net.Conn) {
+	log := slog.With("client_ip", hostname(conn.RemoteAddr().String()), "proxy", "socks")
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	sess, err := socksAuthenticate(conn)
+	if err != nil {
+		log.Warn("SOCKS handshake failed", "err", err)
+		conn.Close()
+		return
+	}
+	meta := requestMeta{
+		ClientIP:  hostname(conn.RemoteAddr().String()),
+		User:      sess.User,
+		SessionID: sess.ID,
+	}
+	meta.Log = log.With("session_id", sess.ID, "host", sess.Host)
+	if meta.User != "" {
+		meta.Log = meta.Log.With("user", meta.User)
+	}
+
+	target, err := socksReadRequest(conn)
+	if err != nil {
+		meta.Log.Warn("SOCKS request refused", "err", err)
+		conn.Close()
+		return
+	}
+	meta.Log = meta.Log.With("target", target)
+	if !tunnelAllowed(currentConfig().tunnelTargets, target) {
+		meta.Log.Warn("SOCKS target not allowed")
+		socksReply(conn, socksNotAllowed)
+		conn.Close()
+		return
+	}
+	if err := authorizeIdentity(meta.Log, meta.ClientIP, sess.identity, sess.Host, sess.SSHUser, opTunnel); err != nil {
+		socksReply(conn, socksNotAllowed)
+		conn.Close()
+		return
+	}
+
+	remote, err := sess.client.Dial("tcp", target)
+	if err != nil {
+		meta.Log.Warn("Failed to open SOCKS connection", "err", err)
+		socksReply(conn, socksDialFailure(err))
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	p := &proxiedConn{operation: "socks", sess: sess, meta: meta, target: target, local: conn, remote: remote}
+	if !sess.trackForward(p) {
+		return
+	}
+	defer sess.untrackForward(p)
+	p.run(currentConfig().Forwarding.IdleTimeout)
+}
+
+// socksAuthenticate runs method negotiation and username/password
+// authentication, returning the session named by the username once the
+// password matches its key
+func socksAuthenticate(conn net.Conn) (*activeSession, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == socksAuthPassword
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return nil, fmt.Errorf("client did not offer username/password authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+		return nil, err
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksAuthVersion {
+		return nil, fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, int(header[1])+1)
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, err
+	}
+	password := make([]byte, username[len(username)-1])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+	sessionID := string(username[:len(username)-1])
+
+	sess, ok := sessions.get(sessionID)
+	if ok && subtle.ConstantTimeCompare(password, []byte(sess.key)) != 1 {
+		conn.Write([]byte{socksAuthVersion, socksAuthFailed})
+		return nil, fmt.Errorf("wrong password for session %s", sess.ID)
+	}
+	if !ok || sess.Restricted || sess.ReadOnly || !permitsOperation(sess.Operations, opTunnel) {
+		conn.Write([]byte{socksAuthVersion, socksAuthFailed})
+		if !ok {
+			return nil, fmt.Errorf("session not found or has ended")
+		}
+		return nil, fmt.Errorf("session %s does not permit forwarding", sess.ID)
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, socksAuthSucceeded}); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// socksReadRequest reads a CONNECT request and returns its host:port
+func socksReadRequest(conn net.Conn) (string, error) {
+	// VER CMD RSV ATYP
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[1] != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupp)
+		return "", fmt.Errorf("command %d is not supported, only CONNECT", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if header[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAtypeNotSupp)
+		return "", fmt.Errorf("address type %d is not supported", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply sends a reply with an empty bound address
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksDialFailure maps a failed dial from the SSH host to a reply code.
+// SSH servers report refused and unreachable destinations alike.
+func socksDialFailure(err error) byte {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		return socksGeneralFail
+	}
+	switch openErr.Reason {
+	case ssh.Prohibited:
+		return socksNotAllowed
+	case ssh.ConnectionFailed:
+		return socksHostUnreach
+	}
+	return socksGeneralFail
+}
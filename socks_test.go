@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"gossh/internal/sshtest"
+)
+
+// dialSOCKS connects to target through the SOCKS proxy at addr as user and
+// password
+func dialSOCKS(t *testing.T, addr, user, password, target string) (net.Conn, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return socksConnect(conn, &url.URL{Host: addr, User: url.UserPassword(user, password)}, target)
+}
+
+func TestSOCKSChecksSessionKey(t *testing.T) {
+	useConfig(t, `
+forwarding:
+  allowed_targets: ["127.0.0.1:*"]
+`)
+	echo := startEchoServer(t)
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+	login := url.Values{"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password}}
+	page := openTestPage(t, srv, login)
+	other := openTestPage(t, srv, login)
+
+	proxy, err := startSOCKSProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.ln.Close() })
+	addr := proxy.ln.Addr().String()
+
+	id := page.session.SessionID
+	for name, password := range map[string]string{
+		"no password":            "",
+		"wrong password":         "wrong",
+		"another session's key":  other.session.SessionKey,
+		"the session ID as well": id,
+	} {
+		if _, err := dialSOCKS(t, addr, id, password, echo); !isProxyAuthFailure(err) {
+			t.Errorf("%s: got %v, want the credentials rejected", name, err)
+		}
+	}
+	if _, err := dialSOCKS(t, addr, "no-such-session", page.session.SessionKey, echo); !isProxyAuthFailure(err) {
+		t.Errorf("unknown session: got %v, want the credentials rejected", err)
+	}
+
+	conn, err := dialSOCKS(t, addr, id, page.session.SessionKey, echo)
+	if err != nil {
+		t.Fatalf("the session's key was refused: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Errorf("proxy echoed %q, %v", got, err)
+	}
+}
+
+func isProxyAuthFailure(err error) bool {
+	var proxyErr *proxyError
+	return errors.As(err, &proxyErr) && proxyErr.failure == failureProxyAuth
+}
@@ -1,78 +1,604 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
-	"net/http"
-	"path/filepath"
+	"log/slog"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
-)
-
-type WSMessage struct {
-	Type     string `json:"type"`
-	Data     string `json:"data"`
-	Cols     int    `json:"cols"`
-	Rows     int    `json:"rows"`
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-}
 
-type UploadResponse struct {
-	Type    string `json:"type"`
-	Success bool   `json:"success"`
-	Path    string `json:"path"`
-	Error   string `json:"error"`
-}
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+	"gossh/internal/transfer"
+)
 
-func handleSSHConnection(wsConn *websocket.Conn, host, user, password string, privateKey []byte) {
-	// Build SSH client configuration
+// newSSHClientConfig builds the SSH client configuration for the given
+// credentials. The recorder notes which authentication method is used.
+func newSSHClientConfig(user, password string, privateKey []byte) (*ssh.ClientConfig, *authRecorder, error) {
+	auth := &authRecorder{}
 	config := &ssh.ClientConfig{
 		User:            user,
 		Auth:            []ssh.AuthMethod{},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // WARNING: Use proper host key verification in production
+		Timeout:         currentConfig().Session.ConnectTimeout,
 	}
 
 	// Add authentication methods
 	if password != "" {
-		config.Auth = append(config.Auth, ssh.Password(password))
+		config.Auth = append(config.Auth, auth.password(password))
 	}
 
 	if len(privateKey) > 0 {
 		signer, err := ssh.ParsePrivateKey(privateKey)
 		if err != nil {
-			log.Printf("Failed to parse private key: %v", err)
-			wsConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to parse private key: %v\r\n", err)))
+			return nil, nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		config.Auth = append(config.Auth, auth.publicKeys(signer))
+	}
+
+	return config, auth, nil
+}
+
+// dialSSH connects to host on behalf of the client in meta, enforcing the
+// failed-authentication lockout for the (client IP, host, user) tuple. Name
+// resolution, the TCP dial, key exchange and authentication are traced as
+// separate spans, and timed in a connection record.
+func dialSSH(ctx context.Context, meta requestMeta, host string, clientConfig *ssh.ClientConfig, auth *authRecorder) (*ssh.Client, error) {
+	ctx, span := tracer.Start(ctx, "ssh.connect", trace.WithAttributes(
+		attribute.String("server.address", hostname(host)),
+		attribute.String("ssh.user", clientConfig.User),
+	))
+	sshConn, err := dialSSHTraced(ctx, meta, host, clientConfig, auth)
+	endSpan(span, err)
+	return sshConn, err
+}
+
+func dialSSHTraced(ctx context.Context, meta requestMeta, host string, clientConfig *ssh.ClientConfig, auth *authRecorder) (*ssh.Client, error) {
+	clientIP := meta.ClientIP
+	lockout := &currentConfig().Security.Lockout
+	if err := lockouts.check(lockout, clientIP, host, clientConfig.User); err != nil {
+		return nil, err
+	}
+
+	addr := sshAddress(host)
+	aliased := aliasedHostAt(addr)
+	// A jump host may add its identity files to auth
+	requestKeys := auth.keys
+
+	rec := newConnectRecord(meta, host, clientConfig.User, clientConfig.Timeout)
+	if sink, ok := ctx.Value(connectRecordKey{}).(**connectRecord); ok && *sink == nil {
+		*sink = rec
+	}
+	fail := func(failure string, err error) error {
+		hostStats.recordOutcome(host, hostOutcome(failure), 0)
+		return rec.finish(meta, failure, err)
+	}
+
+	hostStats.recordAttempt(host)
+	var conn net.Conn
+	var err error
+	if aliased != nil && aliased.jumpHost != "" {
+		conn, err = dialJumpHost(ctx, meta, aliased.jumpHost, addr, clientConfig, auth, rec)
+	} else {
+		conn, err = dialTarget(ctx, meta, host, addr, clientConfig.Timeout, rec)
+	}
+	if err != nil {
+		return nil, fail(dialFailure(err), err)
+	}
+
+	// The host key is checked once key exchange completes; everything
+	// after that is authentication
+	_, handshake := tracer.Start(ctx, "ssh.handshake")
+	var authSpan trace.Span
+	var hostKeyErr error
+	config := *clientConfig
+	checkHostKey := clientConfig.HostKeyCallback
+	if aliased != nil && aliased.hostKey != nil {
+		checkHostKey = ssh.FixedHostKey(aliased.hostKey)
+		config.HostKeyAlgorithms = hostKeyAlgorithms(aliased.hostKey)
+	}
+	if aliased != nil && len(aliased.identityFiles) > 0 && !requestKeys && currentConfig().SSH.IdentityFiles {
+		if signers := identitySigners(meta, aliased.identityFiles); len(signers) > 0 {
+			config.Auth = append(config.Auth[:len(config.Auth):len(config.Auth)], auth.publicKeys(signers...))
+		}
+	}
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		handshake.End()
+		_, authSpan = tracer.Start(ctx, "ssh.auth")
+		hostKeyErr = checkHostKey(hostname, remote, key)
+		return hostKeyErr
+	}
+	// A port that accepts connections but never speaks SSH would hang the
+	// handshake; the banner has as long to arrive as the TCP connect had
+	banner := &bannerConn{Conn: conn}
+	if clientConfig.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(clientConfig.Timeout))
+	}
+	handshakeStart := time.Now()
+	c, chans, reqs, err := ssh.NewClientConn(banner, addr, &config)
+	rec.handshake = time.Since(handshakeStart)
+	rec.AuthMethod = auth.method
+	if authSpan != nil {
+		endSpan(authSpan, err)
+	} else {
+		endSpan(handshake, err)
+	}
+	if err != nil {
+		conn.Close()
+		switch {
+		case !banner.received.Load():
+			return nil, fail(failureBanner, err)
+		case hostKeyErr != nil:
+			return nil, fail(failureHostKey, err)
+		case isAuthFailure(err):
+			lockouts.recordFailure(lockout, clientIP, host, clientConfig.User)
+			return nil, fail(failureAuth, err)
+		}
+		return nil, fail(failureHandshake, err)
+	}
+	hostStats.recordOutcome(host, connectSuccess, rec.handshake)
+	rec.finish(meta, "", nil)
+
+	lockouts.recordSuccess(clientIP, host, clientConfig.User)
+	client := ssh.NewClient(c, chans, reqs)
+	openSSHClients.Add(1)
+	go func() {
+		client.Wait()
+		openSSHClients.Add(-1)
+	}()
+	return client, nil
+}
+
+// bannerConn notes whether the server has sent anything, which tells a
+// port that isn't SSH from a failed handshake. The read deadline set for the
+// banner is lifted once something arrives.
+type bannerConn struct {
+	net.Conn
+	received atomic.Bool
+}
+
+func (c *bannerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.received.Load() {
+		c.received.Store(true)
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// dialTCP resolves and dials addr, tracing and timing each step. The
+// addresses are tried in ssh.ip_family order, each for at most
+// ssh.attempt_timeout, until one connects or timeout runs out. A non-empty
+// source is the local address or interface to connect from.
+func dialTCP(ctx context.Context, meta requestMeta, addr, source string, timeout time.Duration, rec *connectRecord) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		dnsCtx, span := tracer.Start(ctx, "dns.lookup")
+		start := time.Now()
+		addrs, err = net.DefaultResolver.LookupHost(dnsCtx, host)
+		rec.dns = time.Since(start)
+		endSpan(span, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &currentConfig().SSH
+	addrs, err = orderAddresses(host, addrs, cfg.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	dialCtx, span := tracer.Start(ctx, "tcp.dial")
+	defer span.End()
+	start := time.Now()
+	defer func() { rec.tcp = time.Since(start) }()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	for i, ip := range addrs {
+		target := net.JoinHostPort(ip, port)
+		dialer := net.Dialer{Timeout: attemptTimeout(i, len(addrs), cfg.AttemptTimeout, deadline)}
+		var conn net.Conn
+		if dialer.LocalAddr, err = sourceAddress(source, ip); err == nil {
+			conn, err = dialer.DialContext(dialCtx, "tcp", target)
+			err = bindError(err, dialer.LocalAddr)
+		}
+		if err == nil {
+			meta.Log.Debug("TCP connected", "address", target, "local", conn.LocalAddr().String(), "attempt", i+1, "addresses", len(addrs))
+			return conn, nil
+		}
+		meta.Log.Debug("TCP connect attempt failed", "address", target, "err", err)
+	}
+	span.SetStatus(codes.Error, err.Error())
+	return nil, err
+}
+
+// sessionOptions carries per-session policy resolved before connecting
+type sessionOptions struct {
+	// AllowedCommands, when non-empty, replaces the shell with the
+	// restricted command loop. A command must match every list.
+	AllowedCommands [][]string
+
+	// ReadOnly sessions show output but drop all keyboard input
+	ReadOnly bool
+	// InitialCommand runs in place of the login shell when set
+	InitialCommand string
+
+	// Operations limits what transfers may reuse the session for; empty
+	// allows all
+	Operations []string
+	// Token is the access token the session came from, and Quotas what
+	// uploads from the terminal are charged to
+	Token  quotaToken
+	Quotas []quotaSubject
+
+	// Signer adds certificate authentication, e.g. a Vault-signed
+	// ephemeral key
+	Signer ssh.Signer
+
+	// Identity opened the session; forwarded connections are authorized
+	// against it
+	Identity Identity
+	// RemoteForwards are opened on the SSH host once the shell is up
+	RemoteForwards []remoteForward
+	// AutoResponses answer prompts in the shell's output
+	AutoResponses []*autoResponse
+	// Shared is the terminal of a dual-control session, which the session
+	// runs over
+	Shared *sharedTerminal
+}
+
+// wsWriter serializes writes to a WebSocket connection, which supports only
+// one concurrent writer
+type wsWriter struct {
+	mu   sync.Mutex
+	conn sshbridge.Conn
+	// pending counts writes waiting for or in progress on conn
+	pending atomic.Int32
+	// pacer disconnects the client when it takes longer than
+	// ws.write_timeout for ws.slow_writes writes in a row
+	pacer *sshbridge.Pacer
+	// scrollback keeps the terminal output, binary frames, for replay
+	scrollback *scrollback
+	// mem is the session's memory budget, charged for the scrollback and
+	// for messages waiting to be written
+	mem *sessionMemory
+	// clipboard takes OSC 52 clipboard writes out of the terminal output
+	clipboard *osc52Filter
+	// sanitizer, with session.sanitize_output, takes the other control
+	// strings out after it
+	sanitizer *outputSanitizer
+	// held keeps terminal output from the page while the session is
+	// locked, heldBytes counting what the scrollback took meanwhile
+	held      bool
+	heldBytes int
+	// idle and recording see the output once the session is registered,
+	// and session is ended should the client be too slow
+	idle      *idleMonitor
+	recording *sessionRecording
+	session   *activeSession
+}
+
+// newTerminalWriter returns the writer of a terminal session's page
+func newTerminalWriter(conn sshbridge.Conn) *wsWriter {
+	cfg := currentConfig()
+	w := &wsWriter{
+		conn:       conn,
+		scrollback: newScrollback(cfg.Session.ScrollbackBytes),
+		mem:        newSessionMemory(cfg.Session.MemoryLimitBytes),
+		clipboard:  newOSC52Filter(cfg.Security.AllowClipboard, cfg.Security.ClipboardMaxBytes),
+	}
+	w.pacer = sshbridge.NewPacer(conn, cfg.WebSocket.WriteTimeout, cfg.WebSocket.SlowWrites, w.cutOffSlow)
+	if cfg.Session.SanitizeOutput {
+		w.sanitizer = &outputSanitizer{}
+	}
+	return w
+}
+
+func (w *wsWriter) WriteMessage(messageType int, data []byte) error {
+	w.pending.Add(1)
+	defer w.pending.Add(-1)
+	w.mem.holdOutput(len(data))
+	defer w.mem.releaseOutput(len(data))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if messageType != websocket.BinaryMessage {
+		return w.write(messageType, data)
+	}
+
+	var clips []string
+	if w.clipboard != nil {
+		data, clips = w.clipboard.filter(data)
+	}
+	if w.sanitizer != nil {
+		data = w.sanitizer.sanitize(data)
+	}
+	if sb := w.keptScrollback(true); sb != nil {
+		sb.write(data)
+	}
+	if w.held {
+		// The page gets it on unlock; clipboard writes are dropped
+		if len(data) > 0 {
+			w.heldBytes += len(data)
+			w.idle.output(time.Now())
+			w.recording.output(data)
+		}
+		return nil
+	}
+	if len(data) > 0 {
+		w.idle.output(time.Now())
+		w.recording.output(data)
+		if err := w.write(messageType, data); err != nil {
+			return err
+		}
+	}
+	for _, clip := range clips {
+		if err := w.writeJSON(sshbridge.ClipboardMessage{Type: "clipboard", Data: clip}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observe has the idle monitor and recording of s see the output from now
+// on
+func (w *wsWriter) observe(s *activeSession) {
+	w.mu.Lock()
+	w.idle, w.recording, w.session = s.idle, s.recording, s
+	w.mu.Unlock()
+}
+
+// write sends a message. The caller holds mu.
+func (w *wsWriter) write(messageType int, data []byte) error {
+	return w.pacer.Write(messageType, data)
+}
+
+// cutOffSlow disconnects a client that has stopped keeping up with its
+// output, ending its session. The caller holds mu.
+func (w *wsWriter) cutOffSlow() {
+	slowClientDisconnects.Add(1)
+	if s := w.session; s != nil {
+		slog.Warn("Disconnecting a client too slow to take its output", "session_id", s.ID, "host", hostname(s.Host), "write_timeout", w.pacer.Deadline())
+		go s.closeWith(sshbridge.CloseClientTooSlow, "client too slow")
+		return
+	}
+	sshbridge.CloseSlow(w.conn)
+}
+
+// WriteJSON sends v as a JSON text message
+func (w *wsWriter) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteMessage(websocket.TextMessage, data)
+}
+
+// writeJSON is WriteJSON for callers holding mu
+func (w *wsWriter) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.write(websocket.TextMessage, data)
+}
+
+func handleSSHConnection(ctx context.Context, wsConn sshbridge.Conn, meta requestMeta, host, user, password string, privateKey []byte, opts sessionOptions) {
+	defer recoverSession(&meta, wsConn)
+	out := newTerminalWriter(wsConn)
+
+	// terminal.open covers everything up to the first byte of output
+	ctx, openSpan := tracer.Start(ctx, "terminal.open")
+	var openOnce sync.Once
+	finishOpen := func(err error) {
+		openOnce.Do(func() { endSpan(openSpan, err) })
+	}
+	defer finishOpen(nil)
+
+	meta.Log = meta.Log.With("host", host, "ssh_user", user)
+	startEvent := AuditEvent{
+		Event:        auditSessionStart,
+		ClientIP:     meta.ClientIP,
+		User:         meta.User,
+		Host:         host,
+		SSHUser:      user,
+		AuthMethod:   authMethod(password, privateKey),
+		ReadOnly:     opts.ReadOnly,
+		Participants: opts.Shared.participantNames(),
+	}
+	if opts.Signer != nil {
+		startEvent.AuthMethod = "certificate"
+	}
+
+	// Build SSH client configuration
+	clientConfig, auth, err := newSSHClientConfig(user, password, privateKey)
+	if err != nil {
+		startEvent.Outcome = outcomeFailure
+		startEvent.Error = err.Error()
+		audit.Emit(startEvent)
+		finishOpen(err)
+		meta.Log.Warn("Failed to parse private key", "err", err)
+		out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to parse private key: %v\r\n", err)))
+		return
+	}
+	if opts.Signer != nil {
+		clientConfig.Auth = append(clientConfig.Auth, auth.publicKeys(opts.Signer))
+	}
+	// Servers may ask for more than a password, such as a one-time code or,
+	// when it has expired, a new password; the page answers
+	var ask ssh.KeyboardInteractiveChallenge
+	input := &promptReader{Conn: wsConn}
+	if _, ok := wsConn.(promptlessConn); !ok {
+		ask = (&terminalAuthPrompter{out: out, conn: input}).ask
+	}
+	clientConfig.Auth = append(clientConfig.Auth, auth.keyboardInteractive(password, ask))
+
+	var policy *commandPolicy
+	if len(opts.AllowedCommands) > 0 {
+		if policy, err = newCommandPolicy(opts.AllowedCommands); err != nil {
+			finishOpen(err)
+			meta.Log.Error("Invalid command policy", "err", err)
+			out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Invalid command policy: %v\r\n", err)))
 			return
 		}
-		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
 	}
 
-	// Add default port if not specified
-	if !containsPort(host) {
-		host = host + ":22"
+	// A read-only view of a restricted session may only run an allowed command
+	if opts.ReadOnly && policy != nil {
+		if _, err := policy.check(opts.InitialCommand); err != nil || opts.InitialCommand == "" {
+			finishOpen(errors.New("initial command not allowed in read-only session"))
+			meta.Log.Warn("Refused read-only session: initial command is not allowed", "command", opts.InitialCommand)
+			out.WriteMessage(websocket.TextMessage, []byte("Error: Initial command is not allowed in this restricted session\r\n"))
+			return
+		}
+		policy = nil
 	}
 
-	// Connect to SSH server
-	sshConn, err := ssh.Dial("tcp", host, config)
+	// Connect to SSH server. Restricted sessions and vault-signed
+	// certificates don't share connections.
+	fingerprint := ""
+	if currentConfig().SSH.Pool.Enabled && policy == nil && opts.Signer == nil {
+		fingerprint = poolFingerprint(password, privateKey)
+	}
+	sshConn, release, err := sshPool.connect(ctx, meta, host, clientConfig, auth, fingerprint)
 	if err != nil {
-		log.Printf("Failed to connect to SSH server: %v", err)
-		wsConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to connect: %v\r\n", err)))
+		finishOpen(err)
+		startEvent.Outcome = outcomeFailure
+		startEvent.Error = err.Error()
+		audit.Emit(startEvent)
+		meta.Log.Warn("Failed to connect to SSH server", "err", err)
+		out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to connect: %v\r\n", err)))
+		return
+	}
+	defer release()
+
+	var bytesIn, bytesOut atomic.Int64
+	var started time.Time
+
+	// begin records the session start, registers the session so transfers
+	// from the page can reuse the connection, and tells the page about it.
+	// shell is the session's channel, which ends it when the connection
+	// is shared.
+	begin := func(shell io.Closer) (*activeSession, bool) {
+		startEvent.Outcome = outcomeSuccess
+		audit.Emit(startEvent)
+		started = time.Now()
+
+		// Restricted sessions run nothing but allowed commands, so only the
+		// version string tells their platform
+		platform := transfer.BannerPlatform(sshConn)
+		if policy == nil {
+			platform = transfer.Platform(sshConn)
+		}
+		active := &activeSession{
+			ClientIP:   meta.ClientIP,
+			User:       meta.User,
+			Host:       host,
+			SSHUser:    user,
+			Restricted: policy != nil,
+			ReadOnly:   opts.ReadOnly,
+			Operations: opts.Operations,
+			Token:      opts.Token,
+			client:     sshConn,
+			out:        out,
+			conn:       wsConn,
+			bytesIn:    &bytesIn,
+			bytesOut:   &bytesOut,
+			identity:   opts.Identity,
+			shared:     opts.Shared,
+			// Sessions that logged in with a password can be unlocked
+			// with it
+			lockPassword: lockPassword(password),
+		}
+		if fingerprint != "" {
+			active.shell = shell
+		}
+		if err := sessions.register(active); err != nil {
+			finishOpen(err)
+			meta.Log.Error("Failed to register session", "err", err)
+			return nil, false
+		}
+		meta.Log = meta.Log.With("session_id", active.ID)
+		meta.SessionID = active.ID
+		openSpan.SetAttributes(attribute.String("gossh.session_id", active.ID))
+		meta.Log.Info("SSH session started", "auth_method", startEvent.AuthMethod, "restricted", active.Restricted, "read_only", active.ReadOnly)
+		history.record(opts.Identity, opts.Token.ID != "", host, user)
+		out.WriteJSON(sshbridge.SessionMessage{Type: "session", SessionID: active.ID, Host: host, User: user, ReadOnly: opts.ReadOnly, Platform: platform, SessionKey: active.key})
+		return active, true
+	}
+
+	end := func(active *activeSession) {
+		sessions.unregister(active.ID)
+		active.closeForwards()
+		meta.Log.Info("SSH session ended", "duration", time.Since(started), "bytes_in", bytesIn.Load(), "bytes_out", bytesOut.Load())
+		audit.Emit(AuditEvent{
+			Event:        auditSessionEnd,
+			ClientIP:     meta.ClientIP,
+			User:         meta.User,
+			Host:         host,
+			SSHUser:      user,
+			AuthMethod:   startEvent.AuthMethod,
+			ReadOnly:     opts.ReadOnly,
+			Participants: opts.Shared.participantNames(),
+			DurationMS:   time.Since(started).Milliseconds(),
+			BytesIn:      bytesIn.Load(),
+			BytesOut:     bytesOut.Load(),
+		})
+	}
+
+	// Restricted sessions run allowlisted commands instead of a shell
+	if policy != nil {
+		active, ok := begin(nil)
+		if !ok {
+			return
+		}
+		defer end(active)
+
+		rs := &restrictedSession{
+			session:  active,
+			out:      out,
+			wsConn:   input,
+			sshConn:  sshConn,
+			meta:     meta,
+			host:     host,
+			user:     user,
+			policy:   policy,
+			bytesIn:  &bytesIn,
+			bytesOut: &bytesOut,
+		}
+		finishOpen(nil)
+		rs.run()
+		wsConn.Close()
 		return
 	}
-	defer sshConn.Close()
 
 	// Create SSH session
 	session, err := sshConn.NewSession()
 	if err != nil {
-		log.Printf("Failed to create SSH session: %v", err)
-		wsConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to create session: %v\r\n", err)))
+		finishOpen(err)
+		meta.Log.Error("Failed to create SSH session", "err", err)
+		out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to create session: %v\r\n", err)))
 		return
 	}
 	defer session.Close()
@@ -85,120 +611,247 @@ func handleSSHConnection(wsConn *websocket.Conn, host, user, password string, pr
 	}
 
 	// Request pseudo terminal
-	if err := session.RequestPty("xterm-256color", 40, 80, modes); err != nil {
-		log.Printf("Failed to request pseudo terminal: %v", err)
-		wsConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to request PTY: %v\r\n", err)))
+	_, ptySpan := tracer.Start(ctx, "ssh.pty")
+	err = session.RequestPty("xterm-256color", 40, 80, modes)
+	endSpan(ptySpan, err)
+	if err != nil {
+		finishOpen(err)
+		meta.Log.Error("Failed to request pseudo terminal", "err", err)
+		out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to request PTY: %v\r\n", err)))
 		return
 	}
 
 	// Set up pipes
 	stdin, err := session.StdinPipe()
 	if err != nil {
-		log.Printf("Failed to setup stdin pipe: %v", err)
+		finishOpen(err)
+		meta.Log.Error("Failed to set up stdin pipe", "err", err)
 		return
 	}
 
 	stdout, err := session.StdoutPipe()
 	if err != nil {
-		log.Printf("Failed to setup stdout pipe: %v", err)
+		finishOpen(err)
+		meta.Log.Error("Failed to set up stdout pipe", "err", err)
 		return
 	}
 
 	stderr, err := session.StderrPipe()
 	if err != nil {
-		log.Printf("Failed to setup stderr pipe: %v", err)
+		finishOpen(err)
+		meta.Log.Error("Failed to set up stderr pipe", "err", err)
 		return
 	}
 
-	// Start shell
-	if err := session.Shell(); err != nil {
-		log.Printf("Failed to start shell: %v", err)
-		wsConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to start shell: %v\r\n", err)))
+	// Start the initial command, or the login shell
+	_, shellSpan := tracer.Start(ctx, "ssh.shell")
+	if opts.InitialCommand != "" {
+		err = session.Start(opts.InitialCommand)
+	} else {
+		err = session.Shell()
+	}
+	endSpan(shellSpan, err)
+	if err != nil {
+		finishOpen(err)
+		startEvent.Outcome = outcomeFailure
+		startEvent.Error = err.Error()
+		audit.Emit(startEvent)
+		meta.Log.Error("Failed to start shell", "err", err)
+		out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to start shell: %v\r\n", err)))
 		return
 	}
 
+	active, ok := begin(session)
+	if !ok {
+		return
+	}
+	defer end(active)
+
+	var responder *promptResponder
+	if len(opts.AutoResponses) > 0 && !opts.ReadOnly {
+		responder = newPromptResponder(meta, host, user, stdin, opts.AutoResponses)
+	}
+	activity := newActivityMonitor(out)
+	defer activity.stop()
+
+	// Uploads from the page take turns on the connection
+	uploads := newUploadQueue(out, sshConn, meta, host, user, opts.Quotas)
+	defer uploads.close()
+
+	zmodem := newZModemBridge(meta, host, user, out, wsConn, stdin, opts)
+	trzsz := newTrzszBridge(meta, host, user, out, wsConn, stdin, opts)
+
+	if len(opts.RemoteForwards) > 0 {
+		if opts.ReadOnly || !permitsOperation(opts.Operations, opTunnel) {
+			meta.Log.Warn("Ignoring remote forwards the session may not open")
+		} else {
+			go startRemoteForwards(active, meta, opts.RemoteForwards)
+		}
+	}
+
 	// Handle SSH output to WebSocket
 	done := make(chan bool)
 
 	go func() {
+		defer close(done)
+		defer recoverSession(&meta, wsConn)
 		buf := make([]byte, 1024)
 		for {
 			n, err := stdout.Read(buf)
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("Error reading stdout: %v", err)
+					meta.Log.Warn("Error reading stdout", "err", err)
 				}
-				done <- true
 				return
 			}
 			if n > 0 {
-				wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
+				finishOpen(nil)
+				bytesOut.Add(int64(n))
+				if data := zmodem.output(trzsz.output(buf[:n])); len(data) > 0 {
+					out.WriteMessage(websocket.BinaryMessage, data)
+					responder.output(data)
+					activity.output(data)
+				}
 			}
 		}
 	}()
 
 	go func() {
+		defer recoverSession(&meta, wsConn)
 		buf := make([]byte, 1024)
 		for {
 			n, err := stderr.Read(buf)
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("Error reading stderr: %v", err)
+					meta.Log.Warn("Error reading stderr", "err", err)
 				}
 				return
 			}
 			if n > 0 {
-				wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
+				finishOpen(nil)
+				bytesOut.Add(int64(n))
+				out.WriteMessage(websocket.BinaryMessage, buf[:n])
+				responder.output(buf[:n])
+				activity.output(buf[:n])
 			}
 		}
 	}()
 
 	// Handle WebSocket input to SSH
 	go func() {
+		defer recoverSession(&meta, wsConn)
+		notified := false
 		for {
-			_, message, err := wsConn.ReadMessage()
+			messageType, message, err := input.ReadMessage()
 			if err != nil {
-				log.Printf("Error reading from websocket: %v", err)
+				meta.Log.Debug("Error reading from websocket", "err", err)
 				stdin.Close()
 				return
 			}
 
-			var msg WSMessage
-			if err := json.Unmarshal(message, &msg); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
+			msg, err := sshbridge.DecodeClientMessage(messageType, message)
+			if err != nil {
+				meta.Log.Warn("Error unmarshaling message", "err", err)
+				continue
+			}
+			// A locked session takes nothing from the page until it
+			// is unlocked
+			if active.lock.blocks(msg.Type) {
 				continue
 			}
 
 			switch msg.Type {
 			case "input":
+				if opts.ReadOnly {
+					if !notified {
+						notified = true
+						out.WriteMessage(websocket.BinaryMessage, []byte("\r\n\x1b[1;33m[read-only session: input is disabled]\x1b[0m\r\n"))
+					}
+					continue
+				}
+				// Typing goes nowhere during a transfer in the
+				// terminal; Ctrl+C cancels it
+				if zmodem.busy() || trzsz.busy() {
+					if strings.Contains(msg.Data, "\x03") {
+						zmodem.cancel()
+						trzsz.cancel()
+					}
+					continue
+				}
 				// Write user input to SSH stdin
+				responder.typed()
+				activity.input(msg.Data)
+				active.typed()
+				bytesIn.Add(int64(len(msg.Data)))
 				if _, err := stdin.Write([]byte(msg.Data)); err != nil {
-					log.Printf("Error writing to stdin: %v", err)
+					meta.Log.Warn("Error writing to stdin", "err", err)
 					return
 				}
 			case "resize":
 				// Resize terminal
 				if err := session.WindowChange(msg.Rows, msg.Cols); err != nil {
-					log.Printf("Error resizing terminal: %v", err)
+					meta.Log.Warn("Error resizing terminal", "err", err)
 				}
+				active.resized(msg.Cols, msg.Rows)
+			case "zmodem_upload":
+				zmodem.uploadChosen(msg)
+			case "zmodem_cancel":
+				zmodem.cancel()
+			case "trzsz_upload":
+				trzsz.uploadChosen(msg)
+			case "trzsz_cancel":
+				trzsz.cancel()
+			case "replay":
+				out.replay(msg.Bytes)
+			case "clear_scrollback":
+				out.clearScrollback()
 			case "upload":
-				// Handle file upload
-				go handleFileUpload(wsConn, sshConn, msg)
+				if opts.ReadOnly {
+					sendUploadResponse(out, sshbridge.UploadResponse{
+						Type:  "upload_response",
+						ID:    msg.ID,
+						Error: "Uploads are not available in read-only sessions",
+					})
+					continue
+				}
+				if !permitsOperation(opts.Operations, opUpload) {
+					sendUploadResponse(out, sshbridge.UploadResponse{
+						Type:  "upload_response",
+						ID:    msg.ID,
+						Error: "Access token does not permit uploads",
+					})
+					continue
+				}
+				uploads.add(msg)
+			case "upload_cancel":
+				uploads.cancel(msg.ID)
 			}
 		}
 	}()
 
 	// Wait for session to finish or stdout to close
 	<-done
-	log.Println("SSH session ended")
 
 	// Wait for session to finish
-	session.Wait()
+	err = session.Wait()
+	if reporter, ok := wsConn.(sshbridge.ExitReporter); ok {
+		reporter.ReportExit(err)
+	}
 
 	// Close the WebSocket connection
 	wsConn.Close()
 }
 
+// sshDialError wraps a dial failure, passing lockout errors through unchanged
+// so handlers can report them distinctly
+func sshDialError(err error) error {
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return err
+	}
+	return httpapi.Errorf(httpapi.ConnectFailed, "failed to connect to SSH server: %v", err)
+}
+
 func containsPort(host string) bool {
 	for i := len(host) - 1; i >= 0; i-- {
 		if host[i] == ':' {
@@ -212,350 +865,83 @@ func containsPort(host string) bool {
 	return false
 }
 
-func handleFileUpload(wsConn *websocket.Conn, sshConn *ssh.Client, msg WSMessage) {
-	var response UploadResponse
-	response.Type = "upload_response"
+// handleFileUpload writes an upload from the page to the host
+func (q *uploadQueue) handleFileUpload(u *queuedUpload) (response sshbridge.UploadResponse) {
+	meta := q.meta
+	event := AuditEvent{
+		Event:    auditUpload,
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     q.host,
+		SSHUser:  q.user,
+		Path:     fmt.Sprintf("/tmp/%s", u.filename),
+	}
+	var mirror *transferMirror
+	defer func() {
+		var err error
+		if !response.Success {
+			err = errors.New(response.Error)
+		}
+		host := mirrorHost{Host: q.host, SSHUser: q.user, Path: event.Path, Success: response.Success, Error: response.Error}
+		if mirrorErr := mirror.finish([]mirrorHost{host}, err); mirrorErr != nil && response.Success {
+			response.Success = false
+			response.Error = mirrorErr.Error()
+		}
+		event.Outcome = outcomeSuccess
+		if !response.Success {
+			event.Outcome = outcomeFailure
+			event.Error = response.Error
+		}
+		audit.Emit(event)
+	}()
 
-	// Decode base64 file data
-	fileData, err := base64.StdEncoding.DecodeString(msg.Data)
-	if err != nil {
+	if err := quotas.check(q.subjects); err != nil {
 		response.Success = false
-		response.Error = fmt.Sprintf("Failed to decode file data: %v", err)
-		sendUploadResponse(wsConn, response)
-		return
-	}
-
-	// Create remote file path
-	remotePath := fmt.Sprintf("/tmp/%s", msg.Filename)
-
-	// Create a new session to write the file
-	uploadSession, err := sshConn.NewSession()
+		response.Error = err.Error()
+		return response
+	}
+	var err error
+	mirror, err = startMirror(mirrorRecord{
+		Direction: auditUpload,
+		User:      meta.User,
+		ClientIP:  meta.ClientIP,
+		Session:   mirrorSession(meta, nil),
+		Filename:  u.filename,
+	})
 	if err != nil {
 		response.Success = false
-		response.Error = fmt.Sprintf("Failed to create upload session: %v", err)
-		sendUploadResponse(wsConn, response)
-		return
-	}
-	defer uploadSession.Close()
-
-	// Get stdin pipe
-	stdinPipe, err := uploadSession.StdinPipe()
+		response.Error = err.Error()
+		return response
+	}
+
+	sum := sha256.Sum256(u.data)
+	event.Size = int64(len(u.data))
+	event.SHA256 = hex.EncodeToString(sum[:])
+
+	result, err := transferHost(meta.Log, q.sshConn).Upload(mirror.reader(q.reader(u)), u.filename, transfer.UploadOptions{Size: event.Size, SHA256: event.SHA256, Extract: u.extract})
+	// The file arrived in one message, so it is charged in one piece; going
+	// over the quota refuses the next transfer
+	quotas.charge(q.subjects, result.Size, meta, opUpload)
+	event.Path = result.Path
+	event.Action = transfer.UploadAction(result)
+	response.Success = err == nil
+	response.Path = result.Path
+	response.Warning = result.Warning
+	response.Extracted = result.Extracted
 	if err != nil {
-		response.Success = false
-		response.Error = fmt.Sprintf("Failed to get stdin pipe: %v", err)
-		sendUploadResponse(wsConn, response)
-		return
+		response.Error = fmt.Sprintf("Failed to upload file: %v", err)
 	}
-
-	// Get stderr to capture any errors
-	stderrPipe, err := uploadSession.StderrPipe()
-	if err != nil {
-		response.Success = false
-		response.Error = fmt.Sprintf("Failed to get stderr pipe: %v", err)
-		sendUploadResponse(wsConn, response)
-		return
-	}
-
-	// Use cat to write the file - properly quote the filename to handle spaces and special characters
-	if err := uploadSession.Start(fmt.Sprintf("cat > '%s'", remotePath)); err != nil {
-		response.Success = false
-		response.Error = fmt.Sprintf("Failed to start upload command: %v", err)
-		sendUploadResponse(wsConn, response)
-		return
-	}
-
-	// Write file data
-	if _, err := stdinPipe.Write(fileData); err != nil {
-		response.Success = false
-		response.Error = fmt.Sprintf("Failed to write file data: %v", err)
-		sendUploadResponse(wsConn, response)
-		return
-	}
-	stdinPipe.Close()
-
-	// Wait for command to complete and check for errors
-	if err := uploadSession.Wait(); err != nil {
-		// Read stderr to get error details
-		stderrData, _ := io.ReadAll(stderrPipe)
-		response.Success = false
-		response.Error = fmt.Sprintf("Failed to upload file: %v - %s", err, string(stderrData))
-		sendUploadResponse(wsConn, response)
-		return
-	}
-
-	response.Success = true
-	response.Path = remotePath
-	sendUploadResponse(wsConn, response)
+	return response
 }
 
-func sendUploadResponse(wsConn *websocket.Conn, response UploadResponse) {
+func sendUploadResponse(out *wsWriter, response sshbridge.UploadResponse) {
 	data, err := json.Marshal(response)
 	if err != nil {
-		log.Printf("Failed to marshal upload response: %v", err)
+		slog.Error("Failed to marshal upload response", "err", err)
 		return
 	}
 
-	if err := wsConn.WriteMessage(websocket.TextMessage, data); err != nil {
-		log.Printf("Failed to send upload response: %v", err)
-	}
-}
-
-func uploadFileViaSSH(file multipart.File, filename, host, user, password string, privateKey []byte) (string, error) {
-	// Build SSH client configuration
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	// Add authentication methods
-	if password != "" {
-		config.Auth = append(config.Auth, ssh.Password(password))
-	}
-
-	if len(privateKey) > 0 {
-		signer, err := ssh.ParsePrivateKey(privateKey)
-		if err != nil {
-			return "", fmt.Errorf("failed to parse private key: %v", err)
-		}
-		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
-	}
-
-	// Add default port if not specified
-	if !containsPort(host) {
-		host = host + ":22"
+	if err := out.WriteMessage(websocket.TextMessage, data); err != nil {
+		slog.Warn("Failed to send upload response", "err", err)
 	}
-
-	// Connect to SSH server
-	sshConn, err := ssh.Dial("tcp", host, config)
-	if err != nil {
-		return "", fmt.Errorf("failed to connect to SSH server: %v", err)
-	}
-	defer sshConn.Close()
-
-	// Create remote file path
-	remotePath := fmt.Sprintf("/tmp/%s", filename)
-
-	// Create a new session to write the file
-	uploadSession, err := sshConn.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("failed to create upload session: %v", err)
-	}
-	defer uploadSession.Close()
-
-	// Get stdin pipe
-	stdinPipe, err := uploadSession.StdinPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to get stdin pipe: %v", err)
-	}
-
-	// Get stderr to capture any errors
-	stderrPipe, err := uploadSession.StderrPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to get stderr pipe: %v", err)
-	}
-
-	// Use cat to write the file - properly quote the filename
-	if err := uploadSession.Start(fmt.Sprintf("cat > '%s'", remotePath)); err != nil {
-		return "", fmt.Errorf("failed to start upload command: %v", err)
-	}
-
-	// Copy file data to stdin
-	if _, err := io.Copy(stdinPipe, file); err != nil {
-		return "", fmt.Errorf("failed to write file data: %v", err)
-	}
-	stdinPipe.Close()
-
-	// Wait for command to complete
-	if err := uploadSession.Wait(); err != nil {
-		stderrData, _ := io.ReadAll(stderrPipe)
-		return "", fmt.Errorf("failed to upload file: %v - %s", err, string(stderrData))
-	}
-
-	return remotePath, nil
-}
-
-func validateFileViaSSH(remotePath, host, user, password string, privateKey []byte) (map[string]interface{}, error) {
-	// Validate remote path - only allow downloads from /home, /opt, and /tmp
-	allowedPaths := []string{"/home/", "/opt/", "/tmp/"}
-	isAllowed := false
-	for _, prefix := range allowedPaths {
-		if len(remotePath) >= len(prefix) && remotePath[:len(prefix)] == prefix {
-			isAllowed = true
-			break
-		}
-	}
-	if !isAllowed {
-		return nil, fmt.Errorf("access denied: downloads are only allowed from /home, /opt, and /tmp directories")
-	}
-
-	// Build SSH client configuration
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	// Add authentication methods
-	if password != "" {
-		config.Auth = append(config.Auth, ssh.Password(password))
-	}
-
-	if len(privateKey) > 0 {
-		signer, err := ssh.ParsePrivateKey(privateKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse private key: %v", err)
-		}
-		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
-	}
-
-	// Add default port if not specified
-	if !containsPort(host) {
-		host = host + ":22"
-	}
-
-	// Connect to SSH server
-	sshConn, err := ssh.Dial("tcp", host, config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to SSH server: %v", err)
-	}
-	defer sshConn.Close()
-
-	// Create a session to check file
-	session, err := sshConn.NewSession()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %v", err)
-	}
-	defer session.Close()
-
-	// Check if file exists and get its size using stat
-	output, err := session.CombinedOutput(fmt.Sprintf("test -f '%s' && stat -c '%%s' '%s' || echo 'NOT_FOUND'", remotePath, remotePath))
-	if err != nil || strings.TrimSpace(string(output)) == "NOT_FOUND" {
-		return nil, fmt.Errorf("file not found or not a regular file: %s", remotePath)
-	}
-
-	// Parse file size
-	var fileSize int64
-	if _, err := fmt.Sscanf(string(output), "%d", &fileSize); err != nil {
-		return nil, fmt.Errorf("failed to get file information: %v", err)
-	}
-
-	// Extract filename from path
-	filename := filepath.Base(remotePath)
-
-	return map[string]interface{}{
-		"filename": filename,
-		"size":     fileSize,
-	}, nil
-}
-
-func downloadFileViaSSH(w http.ResponseWriter, remotePath, host, user, password string, privateKey []byte) (string, error) {
-	// Validate remote path - only allow downloads from /home, /opt, and /tmp
-	allowedPaths := []string{"/home/", "/opt/", "/tmp/"}
-	isAllowed := false
-	for _, prefix := range allowedPaths {
-		if len(remotePath) >= len(prefix) && remotePath[:len(prefix)] == prefix {
-			isAllowed = true
-			break
-		}
-	}
-	if !isAllowed {
-		return "", fmt.Errorf("access denied: downloads are only allowed from /home, /opt, and /tmp directories")
-	}
-
-	// Build SSH client configuration
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	// Add authentication methods
-	if password != "" {
-		config.Auth = append(config.Auth, ssh.Password(password))
-	}
-
-	if len(privateKey) > 0 {
-		signer, err := ssh.ParsePrivateKey(privateKey)
-		if err != nil {
-			return "", fmt.Errorf("failed to parse private key: %v", err)
-		}
-		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
-	}
-
-	// Add default port if not specified
-	if !containsPort(host) {
-		host = host + ":22"
-	}
-
-	// Connect to SSH server
-	sshConn, err := ssh.Dial("tcp", host, config)
-	if err != nil {
-		return "", fmt.Errorf("failed to connect to SSH server: %v", err)
-	}
-	defer sshConn.Close()
-
-	// Create a new session to read the file
-	downloadSession, err := sshConn.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("failed to create download session: %v", err)
-	}
-	defer downloadSession.Close()
-
-	// Get stdout pipe to stream file content
-	stdoutPipe, err := downloadSession.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to get stdout pipe: %v", err)
-	}
-
-	// Get stderr to capture any errors
-	stderrPipe, err := downloadSession.StderrPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to get stderr pipe: %v", err)
-	}
-
-	// Extract filename from path
-	filename := filepath.Base(remotePath)
-
-	// Get file size first using stat command
-	statSession, err := sshConn.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("failed to create stat session: %v", err)
-	}
-	statOutput, err := statSession.CombinedOutput(fmt.Sprintf("stat -c %%s '%s'", remotePath))
-	statSession.Close()
-	if err != nil {
-		return "", fmt.Errorf("failed to get file size: %v", err)
-	}
-
-	// Parse file size
-	var fileSize int64
-	if _, err := fmt.Sscanf(string(statOutput), "%d", &fileSize); err != nil {
-		return "", fmt.Errorf("failed to parse file size: %v", err)
-	}
-
-	// Start the cat command - do this before setting headers
-	// so if it fails, we can still return a proper HTTP error
-	if err := downloadSession.Start(fmt.Sprintf("cat '%s'", remotePath)); err != nil {
-		return "", fmt.Errorf("failed to start download command: %v", err)
-	}
-
-	// Now set response headers - after this point, we're committed to streaming
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileSize))
-
-	// Stream file content directly to HTTP response writer
-	// This avoids loading the entire file into memory
-	if _, err := io.Copy(w, stdoutPipe); err != nil {
-		return "", fmt.Errorf("failed to stream file data: %v", err)
-	}
-
-	// Wait for command to complete
-	if err := downloadSession.Wait(); err != nil {
-		stderrData, _ := io.ReadAll(stderrPipe)
-		return "", fmt.Errorf("failed to download file: %v - %s", err, string(stderrData))
-	}
-
-	return filename, nil
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConfigFile is an OpenSSH client config read from ssh.config_file. Only
+// Host blocks and the HostName, Port, User, ProxyJump and IdentityFile
+// directives are used; everything else is ignored.
+type sshConfigFile struct {
+	blocks []sshConfigBlock
+	// dial holds the jump host and identity files of the addresses that
+	// Host entries without wildcards resolve to
+	dial map[string]*aliasedHost
+}
+
+// sshConfigBlock is a Host block, or the directives before the first one
+type sshConfigBlock struct {
+	patterns []string
+	// options are the supported directives, lower-cased, in file order
+	options []sshConfigOption
+}
+
+type sshConfigOption struct {
+	key, value string
+}
+
+// sshConfigSettings are the directives in effect for a host name; as with
+// ssh, the first value found for each wins
+type sshConfigSettings struct {
+	hostName, port, user, proxyJump string
+	identityFiles                   []string
+}
+
+// supportedSSHOptions are the directives gossh applies
+var supportedSSHOptions = map[string]bool{
+	"hostname":     true,
+	"port":         true,
+	"user":         true,
+	"proxyjump":    true,
+	"identityfile": true,
+}
+
+// ignoredSSHOptions remembers which unsupported directives were logged, so
+// each is logged once rather than on every reload
+var ignoredSSHOptions sync.Map
+
+func ignoreSSHOption(keyword, reason string) {
+	if _, logged := ignoredSSHOptions.LoadOrStore(keyword, true); !logged {
+		slog.Info("Ignoring ssh.config_file directive", "directive", keyword, "reason", reason)
+	}
+}
+
+// parseSSHConfigFile reads an OpenSSH client config
+func parseSSHConfigFile(filename string) (*sshConfigFile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	f := &sshConfigFile{blocks: []sshConfigBlock{{patterns: []string{"*"}}}}
+	block := &f.blocks[0]
+	inMatch := false
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, args := splitSSHConfigLine(line)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("line %d: %s has no value", n, keyword)
+		}
+		keyword = strings.ToLower(keyword)
+		switch {
+		case keyword == "host":
+			f.blocks = append(f.blocks, sshConfigBlock{patterns: args})
+			block = &f.blocks[len(f.blocks)-1]
+			inMatch = false
+		case keyword == "match":
+			ignoreSSHOption("Match", "Match blocks are not supported; their directives are skipped")
+			inMatch = true
+		case inMatch:
+		case keyword == "proxyjump" && strings.Contains(args[0], ","):
+			ignoreSSHOption("ProxyJump", "only a single jump host is supported")
+		case supportedSSHOptions[keyword]:
+			block.options = append(block.options, sshConfigOption{keyword, args[0]})
+		default:
+			ignoreSSHOption(keyword, "not supported")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	f.dial = make(map[string]*aliasedHost)
+	for _, b := range f.blocks {
+		for _, name := range b.patterns {
+			if strings.ContainsAny(name, "*?!") {
+				continue
+			}
+			s := f.settings(name)
+			addr := sshAddress(strings.ToLower(joinPort(s.address(name), s.port)))
+			if _, ok := f.dial[addr]; !ok && (s.proxyJump != "" || len(s.identityFiles) > 0) {
+				f.dial[addr] = s.dialSettings()
+			}
+		}
+	}
+	return f, nil
+}
+
+// splitSSHConfigLine splits "Keyword value" and "Keyword=value" lines;
+// double quotes group words
+func splitSSHConfigLine(line string) (string, []string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, nil
+	}
+	keyword := line[:i]
+	rest := strings.TrimSpace(line[i:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	var args []string
+	var word strings.Builder
+	quoted, inWord := false, false
+	for _, c := range rest {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return keyword, args
+}
+
+// matches reports whether the block applies to name: a pattern matches and
+// no negated one does
+func (b *sshConfigBlock) matches(name string) bool {
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		if ok, _ := path.Match(pattern, name); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// settings returns the directives in effect for name
+func (f *sshConfigFile) settings(name string) sshConfigSettings {
+	name = strings.ToLower(name)
+	var s sshConfigSettings
+	for i := range f.blocks {
+		if !f.blocks[i].matches(name) {
+			continue
+		}
+		for _, o := range f.blocks[i].options {
+			switch o.key {
+			case "hostname":
+				if s.hostName == "" {
+					s.hostName = strings.ReplaceAll(o.value, "%h", name)
+				}
+			case "port":
+				if s.port == "" {
+					s.port = o.value
+				}
+			case "user":
+				if s.user == "" {
+					s.user = o.value
+				}
+			case "proxyjump":
+				if s.proxyJump == "" {
+					s.proxyJump = o.value
+				}
+			case "identityfile":
+				s.identityFiles = append(s.identityFiles, o.value)
+			}
+		}
+	}
+	if strings.EqualFold(s.proxyJump, "none") {
+		s.proxyJump = ""
+	}
+	return s
+}
+
+func (s *sshConfigSettings) address(name string) string {
+	if s.hostName != "" {
+		return s.hostName
+	}
+	return name
+}
+
+func (s *sshConfigSettings) dialSettings() *aliasedHost {
+	return &aliasedHost{jumpHost: s.proxyJump, identityFiles: s.identityFiles}
+}
+
+// resolve applies HostName, Port and User to host, which may carry a port,
+// unless the request gave its own
+func (f *sshConfigFile) resolve(host, user string) (string, string) {
+	name, port := host, ""
+	if containsPort(host) {
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			name, port = h, p
+		}
+	}
+	s := f.settings(strings.Trim(name, "[]"))
+	if user == "" {
+		user = s.user
+	}
+	if port == "" {
+		port = s.port
+	}
+	if s.hostName == "" && port == "" {
+		return host, user
+	}
+	return joinPort(s.address(strings.Trim(name, "[]")), port), user
+}
+
+// dialSettings returns the jump host and identity files for the SSH
+// address addr: those of the Host entry resolving to it, or of the blocks
+// matching its host name
+func (f *sshConfigFile) dialSettings(addr string) *aliasedHost {
+	if s, ok := f.dial[strings.ToLower(addr)]; ok {
+		return s
+	}
+	s := f.settings(hostname(addr))
+	if s.proxyJump == "" && len(s.identityFiles) == 0 {
+		return nil
+	}
+	return s.dialSettings()
+}
+
+// joinPort adds port to host when it is set, bracketing IPv6 addresses
+// either way
+func joinPort(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// identitySigners loads the identity files named for a host. Files the
+// process can't read or parse, such as passphrase-protected keys, are
+// skipped.
+func identitySigners(meta requestMeta, files []string) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, file := range files {
+		if rest, ok := strings.CutPrefix(file, "~/"); ok {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				continue
+			}
+			file = filepath.Join(home, rest)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			meta.Log.Debug("Skipping identity file", "file", file, "err", err)
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			meta.Log.Warn("Skipping identity file", "file", file, "err", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeSSHConfig parses config as an ssh.config_file
+func writeSSHConfig(t *testing.T, config string) *sshConfigFile {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(filename, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseSSHConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+const testSSHConfig = `
+# Before any Host: applies to every host, ahead of the blocks below
+IdentityFile ~/.ssh/global
+
+Host web1 web2
+    HostName %h.example.com
+    User deploy
+
+Host db
+    HostName 10.0.0.5
+    Port 2222
+    ProxyJump bastion.example.com
+    IdentityFile ~/.ssh/db
+
+Host *.internal !secret.internal
+    User ops
+    ProxyJump bastion.example.com
+
+Match host db exec "true"
+    User matched
+    Port 1
+
+Host "quoted name"
+    HostName=quoted.example.com
+
+Host WEB*
+    User second
+    Port 2200
+    ProxyJump none
+
+Host *
+    User fallback
+    IdentityFile ~/.ssh/last
+    ProxyJump a.example.com,b.example.com
+    ForwardAgent yes
+`
+
+func TestSSHConfigSettings(t *testing.T) {
+	f := writeSSHConfig(t, testSSHConfig)
+	tests := []struct {
+		name string
+		want sshConfigSettings
+	}{
+		// %h is the name asked for; User comes from the first block to set
+		// it, Port from a later one that does
+		{"web1", sshConfigSettings{hostName: "web1.example.com", user: "deploy", port: "2200", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+		{"WEB2", sshConfigSettings{hostName: "web2.example.com", user: "deploy", port: "2200", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+		// ProxyJump none stops later blocks from setting one
+		{"web3", sshConfigSettings{user: "second", port: "2200", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+		// The Match block's directives are skipped until the next Host
+		{"db", sshConfigSettings{hostName: "10.0.0.5", port: "2222", user: "fallback", proxyJump: "bastion.example.com", identityFiles: []string{"~/.ssh/global", "~/.ssh/db", "~/.ssh/last"}}},
+		{"cache.internal", sshConfigSettings{user: "ops", proxyJump: "bastion.example.com", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+		// A negated pattern keeps the block from applying
+		{"secret.internal", sshConfigSettings{user: "fallback", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+		{"quoted name", sshConfigSettings{hostName: "quoted.example.com", user: "fallback", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+		// Only Host * applies; its ProxyJump has two hops and is ignored
+		{"other", sshConfigSettings{user: "fallback", identityFiles: []string{"~/.ssh/global", "~/.ssh/last"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := f.settings(tt.name)
+			if got.hostName != tt.want.hostName || got.port != tt.want.port || got.user != tt.want.user ||
+				got.proxyJump != tt.want.proxyJump || !slices.Equal(got.identityFiles, tt.want.identityFiles) {
+				t.Errorf("settings = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHConfigResolve(t *testing.T) {
+	f := writeSSHConfig(t, testSSHConfig)
+	tests := []struct {
+		host, user         string
+		wantHost, wantUser string
+	}{
+		{"db", "", "10.0.0.5:2222", "fallback"},
+		// The request's own port and user win over the file's
+		{"db:22", "admin", "10.0.0.5:22", "admin"},
+		{"web1", "", "web1.example.com:2200", "deploy"},
+		{"other", "", "other", "fallback"},
+		{"other:2022", "", "other:2022", "fallback"},
+		{"[2001:db8::1]:22", "root", "[2001:db8::1]:22", "root"},
+	}
+	for _, tt := range tests {
+		host, user := f.resolve(tt.host, tt.user)
+		if host != tt.wantHost || user != tt.wantUser {
+			t.Errorf("resolve(%q, %q) = %q, %q; want %q, %q", tt.host, tt.user, host, user, tt.wantHost, tt.wantUser)
+		}
+	}
+}
+
+func TestSSHConfigDialSettings(t *testing.T) {
+	f := writeSSHConfig(t, testSSHConfig)
+
+	// The address db resolves to gets db's jump host and keys, though no
+	// block matches 10.0.0.5 itself
+	s := f.dialSettings("10.0.0.5:2222")
+	if s == nil || s.jumpHost != "bastion.example.com" || !slices.Contains(s.identityFiles, "~/.ssh/db") {
+		t.Errorf("dialSettings(10.0.0.5:2222) = %+v, want db's", s)
+	}
+	// Any other address gets the blocks matching its host name
+	s = f.dialSettings("cache.internal:22")
+	if s == nil || s.jumpHost != "bastion.example.com" {
+		t.Errorf("dialSettings(cache.internal:22) = %+v, want the *.internal jump host", s)
+	}
+	if s := f.dialSettings("10.0.0.5:22"); s == nil || s.jumpHost != "" {
+		t.Errorf("dialSettings(10.0.0.5:22) = %+v, want only the identity files of Host *", s)
+	}
+	if s := writeSSHConfig(t, "Host db\n  User x\n").dialSettings("db:22"); s != nil {
+		t.Errorf("dialSettings without a jump host or keys = %+v, want nil", s)
+	}
+}
+
+func TestParseSSHConfigErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(filename, []byte("Host db\n\n  HostName\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSSHConfigFile(filename); err == nil || !strings.Contains(err.Error(), "line 3: HostName has no value") {
+		t.Errorf("err = %v, want one naming line 3", err)
+	}
+	if _, err := parseSSHConfigFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing file was read")
+	}
+}
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"HostName example.com", "HostName", []string{"example.com"}},
+		{"HostName=example.com", "HostName", []string{"example.com"}},
+		{"HostName = example.com", "HostName", []string{"example.com"}},
+		{"Host\ta  b", "Host", []string{"a", "b"}},
+		{`IdentityFile "~/My Keys/id" other`, "IdentityFile", []string{"~/My Keys/id", "other"}},
+		{`User ""`, "User", []string{""}},
+		{"Host", "Host", nil},
+	}
+	for _, tt := range tests {
+		keyword, args := splitSSHConfigLine(tt.line)
+		if keyword != tt.keyword || !slices.Equal(args, tt.args) {
+			t.Errorf("splitSSHConfigLine(%q) = %q, %q; want %q, %q", tt.line, keyword, args, tt.keyword, tt.args)
+		}
+	}
+}
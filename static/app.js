@@ -5,6 +5,122 @@ document.addEventListener('DOMContentLoaded', function() {
     if (!form) {
         return; // Exit if form doesn't exist (e.g., on terminal page)
     }
+
+    // Insecure protocols (telnet) log in at the device's prompt, so the
+    // SSH credential fields don't apply
+    const protocolSelect = document.getElementById('protocol');
+    if (protocolSelect) {
+        protocolSelect.addEventListener('change', function() {
+            const insecure = protocolSelect.selectedOptions[0].dataset.insecure === 'true';
+            document.getElementById('insecureWarning').hidden = !insecure;
+            document.getElementById('user').required = !insecure;
+            for (const id of ['user', 'password', 'privatekey']) {
+                document.getElementById(id).disabled = insecure;
+            }
+        });
+    }
+    
+    // A host alias with a default user makes the username optional
+    const aliases = document.getElementById('hostAliases');
+    if (aliases) {
+        document.getElementById('host').addEventListener('input', function(e) {
+            const option = Array.from(aliases.options).find(o => o.value === e.target.value);
+            const user = document.getElementById('user');
+            user.placeholder = option && option.dataset.user ? option.dataset.user : '';
+            user.required = !user.disabled && !user.placeholder;
+        });
+    }
+    
+    // A profile supplies the host, and may supply the user and credentials
+    const profileSelect = document.getElementById('profile');
+    if (profileSelect) {
+        profileSelect.addEventListener('change', function() {
+            const option = profileSelect.selectedOptions[0];
+            const selected = option.value !== '';
+            // Profiles are SSH only
+            if (protocolSelect) {
+                protocolSelect.value = 'ssh';
+                protocolSelect.disabled = selected;
+                protocolSelect.dispatchEvent(new Event('change'));
+            }
+            const host = document.getElementById('host');
+            const user = document.getElementById('user');
+            host.value = selected ? option.dataset.host : '';
+            host.disabled = selected;
+            host.required = !selected;
+            user.placeholder = option.dataset.user || '';
+            user.required = !option.dataset.user && option.dataset.auth !== 'credentials';
+            for (const id of ['password', 'privatekey']) {
+                document.getElementById(id).disabled = option.dataset.auth === 'credentials';
+            }
+        });
+    }
+    
+    // A known host fills in the host, or picks its profile
+    const hostPicker = document.getElementById('hostPicker');
+    if (hostPicker) {
+        hostPicker.addEventListener('change', function() {
+            const option = hostPicker.selectedOptions[0];
+            if (option.value === '') {
+                return;
+            }
+            if (profileSelect) {
+                profileSelect.value = option.dataset.profile || '';
+                profileSelect.dispatchEvent(new Event('change'));
+            }
+            if (!option.dataset.profile) {
+                const host = document.getElementById('host');
+                host.value = option.value;
+                host.dispatchEvent(new Event('input'));
+                host.dispatchEvent(new Event('change'));
+            }
+            document.getElementById('user').focus();
+        });
+    }
+    
+    // Check the host can be reached before a terminal is opened for it
+    const hostCheck = document.getElementById('hostCheck');
+    if (hostCheck) {
+        document.getElementById('host').addEventListener('change', async function(e) {
+            const host = e.target.value.trim();
+            hostCheck.hidden = true;
+            if (!host || (protocolSelect && protocolSelect.value !== 'ssh')) {
+                return;
+            }
+            try {
+                const response = await fetch(`api/check-host?host=${encodeURIComponent(host)}`);
+                const result = await response.json();
+                if (e.target.value.trim() !== host) {
+                    return; // the host changed while checking
+                }
+                if (response.ok) {
+                    hostCheck.textContent = result.reachable ? `Reachable: ${result.banner}` : result.error;
+                    hostCheck.classList.toggle('ok', result.reachable);
+                    hostCheck.hidden = false;
+                }
+            } catch (err) {
+                // The check is advisory; connecting reports any problem
+            }
+        });
+    }
+    
+    // A recent connection fills in the form, leaving the password to type
+    for (const link of document.querySelectorAll('.recent a')) {
+        link.addEventListener('click', function(e) {
+            e.preventDefault();
+            if (profileSelect && profileSelect.value !== '') {
+                profileSelect.value = '';
+                profileSelect.dispatchEvent(new Event('change'));
+            }
+            if (protocolSelect && protocolSelect.value !== 'ssh') {
+                protocolSelect.value = 'ssh';
+                protocolSelect.dispatchEvent(new Event('change'));
+            }
+            document.getElementById('host').value = link.dataset.host;
+            document.getElementById('user').value = link.dataset.user;
+            document.getElementById('password').focus();
+        });
+    }
     
     // Form submission handler
     form.addEventListener('submit', async function(e) {
@@ -14,6 +130,13 @@ document.addEventListener('DOMContentLoaded', function() {
         const user = document.getElementById('user').value;
         const password = document.getElementById('password').value;
         const privateKeyFile = document.getElementById('privatekey').files[0];
+        const protocol = protocolSelect ? protocolSelect.value : 'ssh';
+        const profile = profileSelect ? profileSelect.value : '';
+
+        if (protocol !== 'ssh') {
+            openTerminalPopup(host, '', '', '', protocol);
+            return;
+        }
         
         let privateKeyBase64 = '';
         
@@ -25,27 +148,34 @@ document.addEventListener('DOMContentLoaded', function() {
                 privateKeyBase64 = btoa(privateKeyContent);
                 
                 // Open terminal in a full-screen popup window
-                openTerminalPopup(host, user, password, privateKeyBase64);
+                openTerminalPopup(host, user, password, privateKeyBase64, '', profile);
             };
             reader.readAsText(privateKeyFile);
         } else {
             // Open terminal in a full-screen popup window
-            openTerminalPopup(host, user, password, privateKeyBase64);
+            openTerminalPopup(host, user, password, privateKeyBase64, '', profile);
         }
     });
 });
 
-function openTerminalPopup(host, user, password, privatekey) {
+function openTerminalPopup(host, user, password, privatekey, protocol, profile) {
     const params = new URLSearchParams({
         host: host,
         user: user,
         password: password,
         privatekey: privatekey
     });
+    if (protocol) {
+        params.set('protocol', protocol);
+    }
+    if (profile) {
+        params.set('profile', profile);
+    }
     
-    // Open popup window with 960x640 size
+    // Open popup window with 960x640 size. The URL is relative so it
+    // stays under the prefix gossh is served at.
     const popup = window.open(
-        `/terminal?${params.toString()}`,
+        `terminal?${params.toString()}`,
         'SSH Terminal',
         'width=960,height=640,location=no,menubar=no,toolbar=no,status=no,resizable=yes'
     );
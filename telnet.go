@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+// TelnetConfig lets terminal sessions reach devices that only speak
+// telnet. Telnet sends everything, passwords included, in clear text, so it
+// is off unless enabled.
+type TelnetConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Connection protocols of a terminal session
+const (
+	protocolSSH    = "ssh"
+	protocolTelnet = "telnet"
+)
+
+const defaultTelnetPort = "23"
+
+// Telnet commands and options, RFC 854, 857, 858 and 1073
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho = 1
+	telnetOptSGA  = 3
+	telnetOptNAWS = 31
+)
+
+// protocolOption is a connection protocol offered on the login form
+type protocolOption struct {
+	Name  string
+	Label string
+	// Insecure protocols send credentials and the session unencrypted
+	Insecure bool
+}
+
+// protocolOptions lists the protocols the server accepts
+func protocolOptions() []protocolOption {
+	options := []protocolOption{{Name: protocolSSH, Label: "SSH"}}
+	if currentConfig().Telnet.Enabled {
+		options = append(options, protocolOption{Name: protocolTelnet, Label: "Telnet (insecure, unencrypted)", Insecure: true})
+	}
+	return options
+}
+
+// checkProtocol validates the protocol a terminal session asks for
+func checkProtocol(protocol string) error {
+	switch protocol {
+	case "", protocolSSH:
+		return nil
+	case protocolTelnet:
+		if !currentConfig().Telnet.Enabled {
+			return httpapi.Errorf(httpapi.Forbidden, "Telnet is disabled on this server")
+		}
+		return nil
+	}
+	return httpapi.Errorf(httpapi.BadRequest, "Unknown protocol %q", protocol)
+}
+
+// handleTelnetConnection bridges a terminal page to a telnet server. There
+// is no authentication step: the login prompt is part of the session.
+func handleTelnetConnection(ctx context.Context, wsConn sshbridge.Conn, meta requestMeta, host string, opts sessionOptions) {
+	defer recoverSession(&meta, wsConn)
+	out := newTerminalWriter(wsConn)
+	meta.Log = meta.Log.With("host", host, "protocol", protocolTelnet)
+
+	startEvent := AuditEvent{
+		Event:        auditSessionStart,
+		ClientIP:     meta.ClientIP,
+		User:         meta.User,
+		Host:         host,
+		Protocol:     protocolTelnet,
+		ReadOnly:     opts.ReadOnly,
+		Participants: opts.Shared.participantNames(),
+	}
+
+	addr := host
+	if !containsPort(addr) {
+		addr = net.JoinHostPort(addr, defaultTelnetPort)
+	}
+	timeout := currentConfig().Session.ConnectTimeout
+	rec := newConnectRecord(meta, host, "", timeout)
+	conn, err := dialTarget(ctx, meta, host, addr, timeout, rec)
+	if err != nil {
+		startEvent.Outcome = outcomeFailure
+		startEvent.Error = err.Error()
+		audit.Emit(startEvent)
+		meta.Log.Warn("Failed to connect to telnet server", "err", err)
+		out.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Failed to connect: %v\r\n", err)))
+		return
+	}
+	t := newTelnetConn(conn)
+	defer t.Close()
+
+	startEvent.Outcome = outcomeSuccess
+	audit.Emit(startEvent)
+	started := time.Now()
+	var bytesIn, bytesOut atomic.Int64
+	active := &activeSession{
+		ClientIP: meta.ClientIP,
+		User:     meta.User,
+		Host:     host,
+		Protocol: protocolTelnet,
+		ReadOnly: opts.ReadOnly,
+		// Nothing but the terminal is available over telnet
+		Operations: []string{opTerminal},
+		Token:      opts.Token,
+		out:        out,
+		conn:       wsConn,
+		bytesIn:    &bytesIn,
+		bytesOut:   &bytesOut,
+		identity:   opts.Identity,
+		shared:     opts.Shared,
+	}
+	if err := sessions.register(active); err != nil {
+		meta.Log.Error("Failed to register session", "err", err)
+		return
+	}
+	meta.Log = meta.Log.With("session_id", active.ID)
+	meta.SessionID = active.ID
+	meta.Log.Info("Telnet session started", "dns_ms", millis(rec.dns), "tcp_ms", millis(rec.tcp), "read_only", opts.ReadOnly)
+	out.WriteJSON(sshbridge.SessionMessage{Type: "session", SessionID: active.ID, Host: host, ReadOnly: opts.ReadOnly, Protocol: protocolTelnet, Insecure: true, SessionKey: active.key})
+	defer func() {
+		sessions.unregister(active.ID)
+		meta.Log.Info("Telnet session ended", "duration", time.Since(started), "bytes_in", bytesIn.Load(), "bytes_out", bytesOut.Load())
+		audit.Emit(AuditEvent{
+			Event:        auditSessionEnd,
+			ClientIP:     meta.ClientIP,
+			User:         meta.User,
+			Host:         host,
+			Protocol:     protocolTelnet,
+			ReadOnly:     opts.ReadOnly,
+			Participants: opts.Shared.participantNames(),
+			DurationMS:   time.Since(started).Milliseconds(),
+			BytesIn:      bytesIn.Load(),
+			BytesOut:     bytesOut.Load(),
+		})
+	}()
+
+	activity := newActivityMonitor(out)
+	defer activity.stop()
+
+	// Handle WebSocket input to the telnet server
+	go func() {
+		defer recoverSession(&meta, wsConn)
+		defer t.Close()
+		notified := false
+		for {
+			messageType, message, err := wsConn.ReadMessage()
+			if err != nil {
+				meta.Log.Debug("Error reading from websocket", "err", err)
+				return
+			}
+
+			msg, err := sshbridge.DecodeClientMessage(messageType, message)
+			if err != nil {
+				meta.Log.Warn("Error unmarshaling message", "err", err)
+				continue
+			}
+			// Nothing but resizes while the session is locked
+			if active.lock.blocks(msg.Type) {
+				continue
+			}
+
+			switch msg.Type {
+			case "input":
+				if opts.ReadOnly {
+					if !notified {
+						notified = true
+						out.WriteMessage(websocket.BinaryMessage, []byte("\r\n\x1b[1;33m[read-only session: input is disabled]\x1b[0m\r\n"))
+					}
+					continue
+				}
+				activity.input(msg.Data)
+				active.typed()
+				bytesIn.Add(int64(len(msg.Data)))
+				if _, err := t.Write([]byte(msg.Data)); err != nil {
+					meta.Log.Warn("Error writing to telnet server", "err", err)
+					return
+				}
+			case "resize":
+				if err := t.resize(msg.Cols, msg.Rows); err != nil {
+					meta.Log.Warn("Error resizing terminal", "err", err)
+				}
+				active.resized(msg.Cols, msg.Rows)
+			case "replay":
+				out.replay(msg.Bytes)
+			case "clear_scrollback":
+				out.clearScrollback()
+			case "upload":
+				sendUploadResponse(out, sshbridge.UploadResponse{
+					Type:  "upload_response",
+					ID:    msg.ID,
+					Error: "File transfers are not available in telnet sessions",
+				})
+			}
+		}
+	}()
+
+	// Relay the telnet server's output until it disconnects
+	buf := make([]byte, 1024)
+	for {
+		n, err := t.Read(buf)
+		if n > 0 {
+			bytesOut.Add(int64(n))
+			out.WriteMessage(websocket.BinaryMessage, buf[:n])
+			activity.output(buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				meta.Log.Warn("Error reading from telnet server", "err", err)
+			}
+			break
+		}
+	}
+	wsConn.Close()
+}
+
+// telnetConn speaks the telnet protocol over a TCP connection. It agrees to
+// ECHO and SGA from the server and offers NAWS so the window size follows
+// the terminal; every other option is refused. Reads return the data
+// stream with commands removed.
+type telnetConn struct {
+	conn   net.Conn
+	reader *telnetReader
+
+	// mu serializes writes and guards the window size
+	mu         sync.Mutex
+	naws       bool
+	cols, rows int
+	closeOnce  sync.Once
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	t := &telnetConn{conn: conn, cols: 80, rows: 40}
+	t.reader = &telnetReader{t: t, remote: map[byte]bool{}, local: map[byte]bool{}}
+	return t
+}
+
+// Write sends terminal input, escaping IAC and sending Enter as CR NUL
+// as network virtual terminals expect
+func (t *telnetConn) Write(p []byte) (int, error) {
+	data := make([]byte, 0, len(p)+8)
+	for i, b := range p {
+		switch {
+		case b == telnetIAC:
+			data = append(data, telnetIAC, telnetIAC)
+		case b == '\r' && (i+1 == len(p) || p[i+1] != '\n'):
+			data = append(data, '\r', 0)
+		default:
+			data = append(data, b)
+		}
+	}
+	if err := t.send(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *telnetConn) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+func (t *telnetConn) Close() error {
+	t.closeOnce.Do(func() { t.conn.Close() })
+	return nil
+}
+
+func (t *telnetConn) send(data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.conn.Write(data)
+	return err
+}
+
+// resize records the window size and reports it if NAWS is on
+func (t *telnetConn) resize(cols, rows int) error {
+	if cols <= 0 || rows <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cols, t.rows = cols, rows
+	if !t.naws {
+		return nil
+	}
+	return t.writeWindowSize()
+}
+
+// setNAWS turns window size reporting on or off, sending the current size
+// when it turns on
+func (t *telnetConn) setNAWS(on bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.naws = on
+	if !on {
+		return nil
+	}
+	return t.writeWindowSize()
+}
+
+// writeWindowSize sends IAC SB NAWS WIDTH HEIGHT IAC SE; mu must be held
+func (t *telnetConn) writeWindowSize() error {
+	msg := []byte{telnetIAC, telnetSB, telnetOptNAWS}
+	for _, v := range []int{min(t.cols, 0xffff), min(t.rows, 0xffff)} {
+		for _, b := range []byte{byte(v >> 8), byte(v)} {
+			msg = append(msg, b)
+			if b == telnetIAC {
+				msg = append(msg, telnetIAC)
+			}
+		}
+	}
+	msg = append(msg, telnetIAC, telnetSE)
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+// telnetReader separates telnet commands from data. Its state carries over
+// between reads, as commands may be split across TCP segments.
+type telnetReader struct {
+	t     *telnetConn
+	state int
+	cmd   byte
+	cr    bool // the last data byte was CR
+	// Options enabled on the server's side (remote) and on ours (local)
+	remote, local map[byte]bool
+	buf           [1024]byte
+}
+
+// telnetReader states
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+func (r *telnetReader) Read(p []byte) (int, error) {
+	for {
+		size := min(len(p), len(r.buf))
+		n, err := r.t.conn.Read(r.buf[:size])
+		out := 0
+		for _, b := range r.buf[:n] {
+			data, ok, nerr := r.process(b)
+			if nerr != nil {
+				return out, nerr
+			}
+			if ok {
+				p[out] = data
+				out++
+			}
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// process handles one byte from the server, returning it if it is data
+func (r *telnetReader) process(b byte) (byte, bool, error) {
+	switch r.state {
+	case telnetData:
+		if b == telnetIAC {
+			r.state = telnetCommand
+			return 0, false, nil
+		}
+		// CR NUL stands for a bare carriage return
+		wasCR := r.cr
+		r.cr = b == '\r'
+		if b == 0 && wasCR {
+			return 0, false, nil
+		}
+		return b, true, nil
+	case telnetCommand:
+		r.state = telnetData
+		switch b {
+		case telnetIAC:
+			return telnetIAC, true, nil
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			r.cmd = b
+			r.state = telnetOption
+		case telnetSB:
+			r.state = telnetSub
+		}
+		// Other commands (NOP, GA, AYT...) need no reply
+		return 0, false, nil
+	case telnetOption:
+		r.state = telnetData
+		return 0, false, r.negotiate(r.cmd, b)
+	case telnetSub:
+		// No option we agree to sends subnegotiations that need a reply
+		if b == telnetIAC {
+			r.state = telnetSubIAC
+		}
+		return 0, false, nil
+	case telnetSubIAC:
+		r.state = telnetSub
+		if b == telnetSE {
+			r.state = telnetData
+		}
+		return 0, false, nil
+	}
+	return 0, false, nil
+}
+
+// negotiate answers an option request, replying only when the option's
+// state changes so the two sides can't loop
+func (r *telnetReader) negotiate(cmd, opt byte) error {
+	reply := func(verb byte) error {
+		return r.t.send([]byte{telnetIAC, verb, opt})
+	}
+	switch cmd {
+	case telnetWILL:
+		if opt != telnetOptEcho && opt != telnetOptSGA {
+			return reply(telnetDONT)
+		}
+		if r.remote[opt] {
+			return nil
+		}
+		r.remote[opt] = true
+		return reply(telnetDO)
+	case telnetWONT:
+		if !r.remote[opt] {
+			return nil
+		}
+		r.remote[opt] = false
+		return reply(telnetDONT)
+	case telnetDO:
+		if opt != telnetOptSGA && opt != telnetOptNAWS {
+			return reply(telnetWONT)
+		}
+		if r.local[opt] {
+			return nil
+		}
+		r.local[opt] = true
+		if err := reply(telnetWILL); err != nil {
+			return err
+		}
+		if opt == telnetOptNAWS {
+			return r.t.setNAWS(true)
+		}
+		return nil
+	case telnetDONT:
+		if !r.local[opt] {
+			return nil
+		}
+		r.local[opt] = false
+		if opt == telnetOptNAWS {
+			r.t.setNAWS(false)
+		}
+		return reply(telnetWONT)
+	}
+	return nil
+}
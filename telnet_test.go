@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTelnetPipe returns a telnetConn and the server's end of its
+// connection. What the telnetConn reads as data arrives on the channel.
+func startTelnetPipe(t *testing.T) (*telnetConn, net.Conn, <-chan []byte) {
+	client, server := net.Pipe()
+	tc := newTelnetConn(client)
+	t.Cleanup(func() {
+		tc.Close()
+		server.Close()
+	})
+	data := make(chan []byte, 16)
+	go func() {
+		defer close(data)
+		buf := make([]byte, 64)
+		for {
+			n, err := tc.Read(buf)
+			if n > 0 {
+				data <- bytes.Clone(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return tc, server, data
+}
+
+// expectBytes reads len(want) bytes from conn and checks them
+func expectBytes(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading %v: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// expectData waits for the telnetConn to read want as data
+func expectData(t *testing.T, data <-chan []byte, want string) {
+	t.Helper()
+	var got []byte
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case d, ok := <-data:
+			if !ok {
+				t.Fatalf("read %q, then the connection ended; want %q", got, want)
+			}
+			got = append(got, d...)
+		case <-timeout:
+			t.Fatalf("read %q, want %q", got, want)
+		}
+	}
+	if string(got) != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+func sendBytes(t *testing.T, conn net.Conn, b ...byte) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTelnetWriteEscapes(t *testing.T) {
+	tc, server, _ := startTelnetPipe(t)
+	tests := []struct {
+		input string
+		want  []byte
+	}{
+		{"ls\r", []byte("ls\r\x00")},
+		{"ls\r\n", []byte("ls\r\n")},
+		{"a\rb", []byte("a\r\x00b")},
+		{"\xff", []byte{telnetIAC, telnetIAC}},
+		{"x\xff\xffy", []byte{'x', telnetIAC, telnetIAC, telnetIAC, telnetIAC, 'y'}},
+	}
+	for _, tt := range tests {
+		go tc.Write([]byte(tt.input))
+		expectBytes(t, server, tt.want)
+	}
+}
+
+func TestTelnetReadRemovesCommands(t *testing.T) {
+	_, server, data := startTelnetPipe(t)
+
+	// An escaped IAC is data
+	sendBytes(t, server, 'a', telnetIAC, telnetIAC, 'b')
+	expectData(t, data, "a\xffb")
+
+	// CR NUL is a bare CR; other NULs are data
+	sendBytes(t, server, '1', '\r', 0, '2', 0, '\r', '\n')
+	expectData(t, data, "1\r2\x00\r\n")
+
+	// NOP and a subnegotiation, with an escaped IAC in it, are dropped
+	sendBytes(t, server, 'c', telnetIAC, 241, telnetIAC, telnetSB, 24, 1, telnetIAC, telnetIAC, 2, telnetIAC, telnetSE, 'd')
+	expectData(t, data, "cd")
+
+	// A command split across reads is still a command
+	sendBytes(t, server, 'e', telnetIAC)
+	sendBytes(t, server, telnetSB)
+	sendBytes(t, server, telnetOptNAWS, 0, telnetIAC)
+	sendBytes(t, server, telnetSE, 'f')
+	expectData(t, data, "ef")
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	_, server, data := startTelnetPipe(t)
+	const optTTYPE = 24
+
+	// ECHO and SGA are accepted from the server, once
+	sendBytes(t, server, telnetIAC, telnetWILL, telnetOptEcho)
+	expectBytes(t, server, []byte{telnetIAC, telnetDO, telnetOptEcho})
+	sendBytes(t, server, telnetIAC, telnetWILL, telnetOptEcho)
+	sendBytes(t, server, telnetIAC, telnetWILL, telnetOptSGA)
+	expectBytes(t, server, []byte{telnetIAC, telnetDO, telnetOptSGA})
+
+	// Anything else is refused either way
+	sendBytes(t, server, telnetIAC, telnetWILL, optTTYPE)
+	expectBytes(t, server, []byte{telnetIAC, telnetDONT, optTTYPE})
+	sendBytes(t, server, telnetIAC, telnetDO, optTTYPE)
+	expectBytes(t, server, []byte{telnetIAC, telnetWONT, optTTYPE})
+	sendBytes(t, server, telnetIAC, telnetDO, telnetOptEcho)
+	expectBytes(t, server, []byte{telnetIAC, telnetWONT, telnetOptEcho})
+
+	// Turning an option off is acknowledged only when it was on
+	sendBytes(t, server, telnetIAC, telnetWONT, telnetOptEcho)
+	expectBytes(t, server, []byte{telnetIAC, telnetDONT, telnetOptEcho})
+	sendBytes(t, server, telnetIAC, telnetWONT, telnetOptEcho)
+	sendBytes(t, server, telnetIAC, telnetDONT, optTTYPE)
+	sendBytes(t, server, telnetIAC, telnetDO, telnetOptSGA)
+	expectBytes(t, server, []byte{telnetIAC, telnetWILL, telnetOptSGA})
+
+	// None of it is data
+	sendBytes(t, server, 'x')
+	expectData(t, data, "x")
+}
+
+func TestTelnetNAWS(t *testing.T) {
+	tc, server, _ := startTelnetPipe(t)
+
+	// Until the server asks for it, the window size isn't sent
+	if err := tc.resize(100, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// Agreeing to NAWS sends the size at once
+	sendBytes(t, server, telnetIAC, telnetDO, telnetOptNAWS)
+	expectBytes(t, server, []byte{telnetIAC, telnetWILL, telnetOptNAWS})
+	expectBytes(t, server, []byte{telnetIAC, telnetSB, telnetOptNAWS, 0, 100, 0, 30, telnetIAC, telnetSE})
+
+	// A size byte of 255 is escaped
+	go tc.resize(300, 255)
+	expectBytes(t, server, []byte{telnetIAC, telnetSB, telnetOptNAWS, 1, 44, 0, telnetIAC, telnetIAC, telnetIAC, telnetSE})
+	go tc.resize(0xffff+1, 24)
+	expectBytes(t, server, []byte{telnetIAC, telnetSB, telnetOptNAWS, telnetIAC, telnetIAC, telnetIAC, telnetIAC, 0, 24, telnetIAC, telnetSE})
+
+	// A size that isn't positive is ignored, and DO again gets no reply
+	go tc.resize(0, 24)
+	sendBytes(t, server, telnetIAC, telnetDO, telnetOptNAWS)
+	go tc.resize(81, 25)
+	expectBytes(t, server, []byte{telnetIAC, telnetSB, telnetOptNAWS, 0, 81, 0, 25, telnetIAC, telnetSE})
+
+	// After DONT, resizes are kept to ourselves
+	sendBytes(t, server, telnetIAC, telnetDONT, telnetOptNAWS)
+	expectBytes(t, server, []byte{telnetIAC, telnetWONT, telnetOptNAWS})
+	if err := tc.resize(120, 50); err != nil {
+		t.Fatal(err)
+	}
+	sendBytes(t, server, telnetIAC, telnetDO, telnetOptNAWS)
+	expectBytes(t, server, []byte{telnetIAC, telnetWILL, telnetOptNAWS})
+	expectBytes(t, server, []byte{telnetIAC, telnetSB, telnetOptNAWS, 0, 120, 0, 50, telnetIAC, telnetSE})
+}
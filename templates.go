@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// templatesGlob matches the page templates
+const templatesGlob = "templates/*.html"
+
+var (
+	tmpl *template.Template
+	// tmplErr is why tmpl failed to load
+	tmplErr error
+)
+
+// loadTemplates parses the page templates once at startup
+func loadTemplates() {
+	tmpl, tmplErr = template.ParseGlob(templatesGlob)
+	if tmplErr != nil {
+		slog.Warn("Could not parse templates", "err", tmplErr)
+	}
+}
+
+// renderTemplate writes the named page. With server.dev_mode the templates
+// are parsed again for every render, so edits show on reload, and errors
+// are shown in the page instead of a generic message.
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	if !currentConfig().Server.DevMode {
+		if tmpl == nil {
+			http.Error(w, "Templates not loaded", http.StatusInternalServerError)
+			return
+		}
+		tmpl.ExecuteTemplate(w, name, data)
+		return
+	}
+
+	t, err := template.ParseGlob(templatesGlob)
+	var buf bytes.Buffer
+	if err == nil {
+		err = t.ExecuteTemplate(&buf, name, data)
+	}
+	if err != nil {
+		requestLogger(r).Warn("Template error", "template", name, "err", err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "<!DOCTYPE html><title>Template error</title><h1>Template error in %s</h1><pre>%s</pre>",
+			html.EscapeString(name), html.EscapeString(err.Error()))
+		return
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,178 @@
+// Package terminalclient opens terminal sessions through the gossh gRPC API.
+//
+//	client, err := terminalclient.Dial("gossh.example.com:9443", apiKey, nil)
+//	...
+//	session, err := client.Open(ctx, &terminalpb.Connect{Host: "db1:22", User: "ops", Password: pw})
+//	...
+//	go io.Copy(session, os.Stdin)
+//	io.Copy(os.Stdout, session)
+//	fmt.Println("exit status", session.Exit().GetStatus())
+package terminalclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"gossh/terminalpb"
+)
+
+// Client is a connection to the API
+type Client struct {
+	conn *grpc.ClientConn
+	api  terminalpb.TerminalClient
+}
+
+// Dial connects to the API at addr, authenticating with an API key that has
+// the terminal scope. A nil tlsConfig verifies the server against the
+// system roots.
+func Dial(addr, apiKey string, tlsConfig *tls.Config) (*Client, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithPerRPCCredentials(apiKeyCredentials(apiKey)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, api: terminalpb.NewTerminalClient(conn)}, nil
+}
+
+// Close closes the connection and every session opened on it
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Open starts a session and waits until it is open. Cancelling ctx ends the
+// session.
+func (c *Client) Open(ctx context.Context, connect *terminalpb.Connect) (*Session, error) {
+	stream, err := c.api.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&terminalpb.ClientMessage{Msg: &terminalpb.ClientMessage_Connect{Connect: connect}}); err != nil {
+		return nil, err
+	}
+	s := &Session{stream: stream}
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		switch m := msg.Msg.(type) {
+		case *terminalpb.ServerMessage_Session:
+			s.Info = m.Session
+			return s, nil
+		case *terminalpb.ServerMessage_Output:
+			// Output before the session message, such as a banner
+			s.pending = append(s.pending, m.Output.GetData()...)
+		case *terminalpb.ServerMessage_Error:
+			return nil, &SessionError{Message: m.Error.GetMessage()}
+		case *terminalpb.ServerMessage_Exit:
+			return nil, errors.New("terminalclient: session ended before it opened")
+		}
+	}
+}
+
+// SessionError is an error reported by the server, such as a failed
+// connection to the host
+type SessionError struct {
+	Message string
+}
+
+func (e *SessionError) Error() string {
+	return "gossh: " + e.Message
+}
+
+// Session is an open terminal. Reading returns its output until the
+// session ends; writing types into it.
+type Session struct {
+	// Info describes the session
+	Info *terminalpb.Session
+
+	stream  terminalpb.Terminal_StreamClient
+	sendMu  sync.Mutex
+	pending []byte
+	exit    *terminalpb.Exit
+	err     error
+}
+
+// Read reads terminal output. It returns io.EOF once the session has
+// ended, or the SessionError it was closed with.
+func (s *Session) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		msg, err := s.stream.Recv()
+		if err != nil {
+			s.err = err
+			continue
+		}
+		switch m := msg.Msg.(type) {
+		case *terminalpb.ServerMessage_Output:
+			s.pending = m.Output.GetData()
+		case *terminalpb.ServerMessage_Error:
+			s.err = &SessionError{Message: m.Error.GetMessage()}
+		case *terminalpb.ServerMessage_Exit:
+			s.exit = m.Exit
+			if s.err == nil {
+				s.err = io.EOF
+			}
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write sends p as terminal input
+func (s *Session) Write(p []byte) (int, error) {
+	data := append([]byte(nil), p...)
+	if err := s.send(&terminalpb.ClientMessage{Msg: &terminalpb.ClientMessage_Input{Input: &terminalpb.Input{Data: data}}}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize sets the terminal size
+func (s *Session) Resize(cols, rows int) error {
+	return s.send(&terminalpb.ClientMessage{Msg: &terminalpb.ClientMessage_Resize{Resize: &terminalpb.Resize{Cols: uint32(cols), Rows: uint32(rows)}}})
+}
+
+// Close ends the input, like closing the page's WebSocket. Keep reading to
+// get the rest of the output and the exit status.
+func (s *Session) Close() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.stream.CloseSend()
+}
+
+// Exit returns how the session ended, once Read has returned io.EOF
+func (s *Session) Exit() *terminalpb.Exit {
+	return s.exit
+}
+
+func (s *Session) send(msg *terminalpb.ClientMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.stream.Send(msg)
+}
+
+// apiKeyCredentials sends the API key as a bearer token with every call
+type apiKeyCredentials string
+
+func (k apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(k)}, nil
+}
+
+func (k apiKeyCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gossh/internal/sshbridge"
+)
+
+// Transfers inside the terminal: rz and sz (ZMODEM) or trz and tsz
+// (trzsz) run in the session, and the server takes the other end so the
+// page only deals with whole files.
+
+const (
+	// terminalTransferChunk is how much of a downloaded file each message
+	// to the page carries, and how often upload progress is reported
+	terminalTransferChunk = 32 << 10
+	// terminalTransferChooseTimeout bounds the wait for the user to pick
+	// a file the host asked for
+	terminalTransferChooseTimeout = 2 * time.Minute
+	// maxTerminalUpload is the largest file the page may send, as for
+	// /upload
+	maxTerminalUpload = 2 << 30
+)
+
+// rawOutputConn is implemented by connections whose client gets the
+// terminal output unchanged, with no page to bridge transfers to
+type rawOutputConn interface {
+	rawOutput()
+}
+
+// terminalTransfers tells which ways a session's terminal may move files.
+// Like /upload and /download through the session, read-only sessions and
+// those restricted to commands may not.
+func terminalTransfers(opts sessionOptions) (download, upload bool) {
+	if opts.ReadOnly || len(opts.AllowedCommands) > 0 {
+		return false, false
+	}
+	return permitsOperation(opts.Operations, opDownload), permitsOperation(opts.Operations, opUpload)
+}
+
+// transferFileName keeps the base name of a file the host or the page
+// names, without control characters; "" when nothing usable is left
+func transferFileName(name string) string {
+	base := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, path.Base(strings.ReplaceAll(name, `\`, "/")))
+	if base == "." || base == ".." || base == "/" {
+		return ""
+	}
+	return base
+}
+
+// chosenFile decodes the file the page sent for an upload
+func chosenFile(msg sshbridge.ClientMessage) (string, []byte, error) {
+	name := transferFileName(msg.Filename)
+	if name == "" {
+		return "", nil, errors.New("invalid file name")
+	}
+	if base64.StdEncoding.DecodedLen(len(msg.Data)) > maxTerminalUpload {
+		return "", nil, fmt.Errorf("the file is larger than %d bytes", maxTerminalUpload)
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode file data: %v", err)
+	}
+	return name, data, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// TimeoutsConfig bounds how long the server waits on a client. Uploads,
+// downloads and terminal WebSockets are exempt from the read and write
+// timeouts, which would otherwise cut off long transfers and sessions.
+type TimeoutsConfig struct {
+	ReadHeader     time.Duration `yaml:"read_header"` // time to send the request headers
+	Read           time.Duration `yaml:"read"`        // time to send the whole request
+	Write          time.Duration `yaml:"write"`       // time to receive the response
+	Idle           time.Duration `yaml:"idle"`        // keep-alive time between requests
+	MaxHeaderBytes int           `yaml:"max_header_bytes"`
+}
+
+func (c *TimeoutsConfig) applyDefaults() {
+	if c.ReadHeader <= 0 {
+		c.ReadHeader = 10 * time.Second
+	}
+	if c.Read <= 0 {
+		c.Read = 30 * time.Second
+	}
+	if c.Write <= 0 {
+		c.Write = 60 * time.Second
+	}
+	if c.Idle <= 0 {
+		c.Idle = 120 * time.Second
+	}
+	if c.MaxHeaderBytes <= 0 {
+		c.MaxHeaderBytes = 64 << 10
+	}
+}
+
+// newHTTPServer returns a server for handler with the configured timeouts
+func newHTTPServer(handler http.Handler, cfg TimeoutsConfig) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeader,
+		ReadTimeout:       cfg.Read,
+		WriteTimeout:      cfg.Write,
+		IdleTimeout:       cfg.Idle,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// withoutDeadlines lifts the server's read and write timeouts for a
+// streaming endpoint once its headers have been read
+func withoutDeadlines(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		next(w, r)
+	}
+}
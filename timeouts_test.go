@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeouts are short enough for tests to outlast
+var testTimeouts = TimeoutsConfig{
+	ReadHeader:     100 * time.Millisecond,
+	Read:           200 * time.Millisecond,
+	Write:          200 * time.Millisecond,
+	Idle:           time.Second,
+	MaxHeaderBytes: 4096,
+}
+
+// startTimeoutServer serves handler with testTimeouts and returns its address
+func startTimeoutServer(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(handler, testTimeouts)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// slowDownload writes a line every 100ms for 600ms, three times the write
+// timeout
+func slowDownload(w http.ResponseWriter, r *http.Request) {
+	for i := 0; i < 6; i++ {
+		io.WriteString(w, "chunk\n")
+		http.NewResponseController(w).Flush()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestStalledHeadersAreDropped(t *testing.T) {
+	addr := startTimeoutServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The headers are never finished
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: gossh\r\n")
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("connection still open after %v: %v", time.Since(start), err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled headers dropped after %v, want about read_header", elapsed)
+	}
+}
+
+func TestOversizedHeadersAreRefused(t *testing.T) {
+	addr := startTimeoutServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header.Set("X-Padding", strings.Repeat("a", 8192))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestLongDownloadOutlastsWriteTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", withoutDeadlines(slowDownload))
+	mux.HandleFunc("/page", slowDownload)
+	addr := startTimeoutServer(t, mux)
+
+	read := func(path string) (int, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		lines := 0
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines++
+		}
+		return lines, scanner.Err()
+	}
+	if lines, err := read("/download"); lines != 6 || err != nil {
+		t.Errorf("download got %d of 6 chunks: %v", lines, err)
+	}
+	// Other responses are still held to the write timeout
+	if lines, _ := read("/page"); lines == 6 {
+		t.Error("response outlasting server.timeouts.write wasn't cut off")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// TLSConfig configures native HTTPS for the listener
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	MinVersion   string `yaml:"min_version"`    // "1.2" (default) or "1.3"
+	ClientCAFile string `yaml:"client_ca_file"` // require client certificates signed by this CA
+}
+
+// Enabled reports whether TLS has been configured
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// validateTLSConfig checks the TLS settings of a listener; prefix names the
+// config section in messages
+func validateTLSConfig(prefix string, cfg TLSConfig) []string {
+	var problems []string
+	if cfg.Enabled() && (cfg.CertFile == "" || cfg.KeyFile == "") {
+		problems = append(problems, prefix+" requires both cert_file and key_file")
+	}
+	if v := cfg.MinVersion; v != "" && v != "1.2" && v != "1.3" {
+		problems = append(problems, fmt.Sprintf("%s.min_version %q is not supported (use \"1.2\" or \"1.3\")", prefix, v))
+	}
+	return problems
+}
+
+// certReloader serves the current certificate and can reload it from disk
+// when a renewed certificate is installed
+type certReloader struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate %s and key %s: %v", c.certFile, c.keyFile, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// newTLSConfig builds the server TLS configuration. Errors are returned for
+// missing files, mismatched certificate/key pairs and invalid settings so
+// startup can fail clearly.
+func newTLSConfig(cfg *TLSConfig) (*tls.Config, *certReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, nil, fmt.Errorf("server.tls requires both cert_file and key_file")
+	}
+
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	switch cfg.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, nil, fmt.Errorf("unsupported server.tls.min_version %q (use \"1.2\" or \"1.3\")", cfg.MinVersion)
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, reloader, nil
+}
+
+// tlsEnabled reports whether r arrived over HTTPS. Cookies set in reply
+// must carry the Secure flag when it did.
+func tlsEnabled(r *http.Request) bool {
+	return r.TLS != nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig configures OpenTelemetry tracing. The standard OTEL_*
+// environment variables (OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_SERVICE_NAME,
+// OTEL_TRACES_SAMPLER, ...) are honoured; settings here override them.
+type TracingConfig struct {
+	// Enabled turns tracing on. Setting OTEL_TRACES_EXPORTER=otlp does too.
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://otel:4318.
+	// /v1/traces is added when the URL has no path.
+	Endpoint    string  `yaml:"endpoint"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"` // 0 leaves the sampler to OTEL_TRACES_SAMPLER
+}
+
+// tracer is a no-op until initTracing installs a provider
+var tracer = otel.Tracer("gossh")
+
+// tracerProvider is set when tracing is enabled
+var tracerProvider *sdktrace.TracerProvider
+
+func (c TracingConfig) active() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	return c.Enabled || os.Getenv("OTEL_TRACES_EXPORTER") == "otlp"
+}
+
+func validateTracingConfig(cfg TracingConfig) error {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// initTracing installs the OTLP exporter when tracing is enabled. Spans are
+// exported in batches in the background.
+func initTracing(cfg TracingConfig) error {
+	if !cfg.active() {
+		return nil
+	}
+
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid tracing.endpoint: %v", err)
+		}
+		if endpoint.Path == "" || endpoint.Path == "/" {
+			endpoint.Path = "/v1/traces"
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint.String()))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+
+	resOpts := []resource.Option{
+		resource.WithAttributes(attribute.String("service.name", "gossh")),
+		resource.WithFromEnv(),
+	}
+	if cfg.ServiceName != "" {
+		resOpts = append(resOpts, resource.WithAttributes(attribute.String("service.name", cfg.ServiceName)))
+	}
+	res, err := resource.New(context.Background(), resOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	providerOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	}
+	if cfg.SampleRatio > 0 {
+		providerOpts = append(providerOpts, sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))))
+	}
+	provider := sdktrace.NewTracerProvider(providerOpts...)
+	otel.SetTracerProvider(provider)
+	tracerProvider = provider
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return nil
+}
+
+// shutdownTracing flushes spans that haven't been exported yet
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "err", err)
+	}
+}
+
+// startRequestSpan starts a span for r, continuing a trace propagated by
+// the caller. Only the request ID and path are recorded, never the query.
+func startRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.route", r.URL.Path),
+		attribute.String("client.address", clientIP(r)),
+		attribute.String("gossh.request_id", requestID(r)),
+	))
+}
+
+// endSpan records err, scrubbed of credentials, and ends span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, redact(err.Error()))
+	}
+	span.End()
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/transfer"
+)
+
+// TransfersConfig tunes file transfers
+type TransfersConfig struct {
+	// Concurrency is how many uploads a terminal page sends over its
+	// WebSocket run at once; the rest wait in a queue of up to MaxQueued
+	Concurrency int `yaml:"concurrency"`
+	MaxQueued   int `yaml:"max_queued"`
+	// FreeSpaceMarginMB is left free on the destination filesystem: uploads
+	// that would leave less are refused before they start
+	FreeSpaceMarginMB int64 `yaml:"free_space_margin_mb"`
+	// BatchConcurrency is how many hosts a batch upload sends to at once,
+	// of at most BatchMaxTargets
+	BatchConcurrency int `yaml:"batch_concurrency"`
+	BatchMaxTargets  int `yaml:"batch_max_targets"`
+	// SpoolDir holds the files of batch uploads, the system's temporary
+	// directory by default. Files of up to SpoolMaxMB are kept for
+	// SpoolRetention after their last use, so failed hosts can be retried.
+	SpoolDir       string        `yaml:"spool_dir"`
+	SpoolMaxMB     int64         `yaml:"spool_max_mb"`
+	SpoolRetention time.Duration `yaml:"spool_retention"`
+	// MirrorDir, when set, keeps a copy of every file uploaded or
+	// downloaded, with a JSON sidecar saying who moved it where. Copies
+	// older than MirrorRetention are removed, then the oldest while there
+	// are more than MirrorMaxMB; zero disables either limit. MirrorStrict
+	// fails transfers that can't be copied instead of logging it.
+	MirrorDir       string        `yaml:"mirror_dir"`
+	MirrorMaxMB     int64         `yaml:"mirror_max_mb"`
+	MirrorRetention time.Duration `yaml:"mirror_retention"`
+	MirrorStrict    bool          `yaml:"mirror_strict"`
+	// ChecksumTimeout bounds hashing the file at the destination of an
+	// if_changed upload; once it passes the file is sent regardless
+	ChecksumTimeout time.Duration `yaml:"checksum_timeout"`
+	// PreviewMaxBytes caps the window of a file /api/files/preview shows
+	PreviewMaxBytes int `yaml:"preview_max_bytes"`
+	// /api/files/search stops after SearchMaxMatches matches,
+	// SearchMaxFiles files or SearchTimeout, or sooner if the request says
+	SearchMaxMatches int           `yaml:"search_max_matches"`
+	SearchMaxFiles   int           `yaml:"search_max_files"`
+	SearchTimeout    time.Duration `yaml:"search_timeout"`
+	// /api/files/du sizes up to DUMaxEntries entries of a directory within
+	// DUTimeout. Where it walks over SFTP, it gives up after DUMaxFiles.
+	DUMaxEntries int           `yaml:"du_max_entries"`
+	DUMaxFiles   int           `yaml:"du_max_files"`
+	DUTimeout    time.Duration `yaml:"du_timeout"`
+	// /api/files/find lists up to FindMaxResults entries, FindMaxDepth
+	// levels below its root, within FindTimeout, or less if the request
+	// says
+	FindMaxResults int           `yaml:"find_max_results"`
+	FindMaxDepth   int           `yaml:"find_max_depth"`
+	FindTimeout    time.Duration `yaml:"find_timeout"`
+	// Uploads sent with extract=true are refused when the archive holds
+	// more than ExtractMaxFiles members or ExtractMaxMB of files, and
+	// unpacking them is given ExtractTimeout
+	ExtractMaxMB    int64         `yaml:"extract_max_mb"`
+	ExtractMaxFiles int           `yaml:"extract_max_files"`
+	ExtractTimeout  time.Duration `yaml:"extract_timeout"`
+}
+
+// defaultFreeSpaceMarginMB leaves room for the logs and temporary files of
+// whatever else runs on the host
+const defaultFreeSpaceMarginMB = 16
+
+func (c *TransfersConfig) applyDefaults() {
+	if c.Concurrency == 0 {
+		c.Concurrency = 2
+	}
+	if c.MaxQueued == 0 {
+		c.MaxQueued = 20
+	}
+	if c.FreeSpaceMarginMB == 0 {
+		c.FreeSpaceMarginMB = defaultFreeSpaceMarginMB
+	}
+	if c.BatchConcurrency <= 0 {
+		c.BatchConcurrency = 4
+	}
+	if c.BatchMaxTargets <= 0 {
+		c.BatchMaxTargets = 100
+	}
+	if c.SpoolDir == "" {
+		c.SpoolDir = os.TempDir()
+	}
+	if c.SpoolMaxMB <= 0 {
+		c.SpoolMaxMB = 2048
+	}
+	if c.SpoolRetention <= 0 {
+		c.SpoolRetention = time.Hour
+	}
+	if c.ChecksumTimeout <= 0 {
+		c.ChecksumTimeout = 5 * time.Minute
+	}
+	if c.PreviewMaxBytes <= 0 {
+		c.PreviewMaxBytes = 64 << 10
+	}
+	if c.SearchMaxMatches <= 0 {
+		c.SearchMaxMatches = 1000
+	}
+	if c.SearchMaxFiles <= 0 {
+		c.SearchMaxFiles = 10000
+	}
+	if c.SearchTimeout <= 0 {
+		c.SearchTimeout = time.Minute
+	}
+	if c.DUMaxEntries <= 0 {
+		c.DUMaxEntries = 1000
+	}
+	if c.DUMaxFiles <= 0 {
+		c.DUMaxFiles = 100000
+	}
+	if c.DUTimeout <= 0 {
+		c.DUTimeout = 30 * time.Second
+	}
+	if c.FindMaxResults <= 0 {
+		c.FindMaxResults = 1000
+	}
+	if c.FindMaxDepth <= 0 {
+		c.FindMaxDepth = 20
+	}
+	if c.FindTimeout <= 0 {
+		c.FindTimeout = 30 * time.Second
+	}
+	if c.ExtractMaxMB <= 0 {
+		c.ExtractMaxMB = 1024
+	}
+	if c.ExtractMaxFiles <= 0 {
+		c.ExtractMaxFiles = 10000
+	}
+	if c.ExtractTimeout <= 0 {
+		c.ExtractTimeout = 5 * time.Minute
+	}
+}
+
+// limits returns the limits c sets on each transfer
+func (c TransfersConfig) limits() transfer.Limits {
+	return transfer.Limits{
+		FreeSpaceMarginMB: c.FreeSpaceMarginMB,
+		ChecksumTimeout:   c.ChecksumTimeout,
+		ExtractMaxMB:      c.ExtractMaxMB,
+		ExtractMaxFiles:   c.ExtractMaxFiles,
+		ExtractTimeout:    c.ExtractTimeout,
+	}
+}
+
+// transferHost returns the transfer.Host for sshConn, under the limits of
+// the configuration in use
+func transferHost(logger *slog.Logger, sshConn *ssh.Client) *transfer.Host {
+	return transfer.NewHost(sshConn, logger, currentConfig().Transfers.limits())
+}
+
+func validateTransfersConfig(cfg TransfersConfig) error {
+	if cfg.Concurrency < 0 || cfg.MaxQueued < 0 {
+		return fmt.Errorf("transfers.concurrency and transfers.max_queued can't be negative")
+	}
+	if cfg.FreeSpaceMarginMB < 0 {
+		return fmt.Errorf("transfers.free_space_margin_mb can't be negative")
+	}
+	if cfg.MirrorMaxMB < 0 || cfg.MirrorRetention < 0 {
+		return fmt.Errorf("transfers.mirror_max_mb and transfers.mirror_retention can't be negative")
+	}
+	return nil
+}
+
+// transferTarget is the SSH endpoint an upload or download request refers to
+type transferTarget struct {
+	Host       string
+	User       string
+	Password   string
+	PrivateKey []byte
+	Source     string // credential source reference, resolved in connect
+	// Identity asked for the transfer; stored credentials are checked
+	// against it
+	Identity Identity
+
+	// Session is set when the request reuses a terminal session's connection
+	Session *activeSession
+	// Quotas the transferred bytes are charged to
+	Quotas []quotaSubject
+}
+
+// checkBoundTarget refuses host or user parameters that differ from the
+// host and user a session or access token is bound to
+func checkBoundTarget(get func(string) string, host, user string) error {
+	if h, _ := resolveHost(get("host"), ""); h != "" && hostname(h) != hostname(host) {
+		return httpapi.Errorf(httpapi.Forbidden, "Host does not match the host this connection is bound to")
+	}
+	if u := get("user"); u != "" && u != user {
+		return httpapi.Errorf(httpapi.Forbidden, "User does not match the user this connection is bound to")
+	}
+	return nil
+}
+
+// operationNoun names what requests for op do, in refusals
+func operationNoun(op string) string {
+	if op == opExec {
+		return "Commands"
+	}
+	return "File transfers"
+}
+
+// resolveTransferTarget determines the target of a transfer request for op
+// from a terminal session ID, an access token, or legacy plain credentials,
+// in that order. get reads a request parameter (r.FormValue or the URL query).
+// Sessions and access tokens pin the target to their own host and user. A
+// session opened anonymously also takes its session_key.
+func resolveTransferTarget(r *http.Request, op string, get func(string) string) (*transferTarget, error) {
+	if sessionID := get("session"); sessionID != "" {
+		sess, ok := sessions.get(sessionID)
+		if !ok {
+			return nil, httpapi.Errorf(httpapi.NotFound, "Session not found or has ended")
+		}
+		if !sess.usableBy(requestIdentity(r), get("session_key")) {
+			return nil, httpapi.Errorf(httpapi.Forbidden, "Session belongs to another user")
+		}
+		if sess.Restricted || sess.ReadOnly || sess.Protocol == protocolTelnet {
+			return nil, httpapi.Errorf(httpapi.Forbidden, "%s are not available in this session", operationNoun(op))
+		}
+		if !permitsOperation(sess.Operations, op) {
+			return nil, httpapi.Errorf(httpapi.Forbidden, "Session does not permit %s", op)
+		}
+		if err := checkBoundTarget(get, sess.Host, sess.SSHUser); err != nil {
+			return nil, err
+		}
+		return &transferTarget{Host: sess.Host, User: sess.SSHUser, Session: sess, Quotas: requestQuotas(r, sess.Token)}, nil
+	}
+
+	target := &transferTarget{Identity: requestIdentity(r)}
+	if accessParam := get("access"); accessParam != "" {
+		// Decrypt access token to get credentials
+		creds, err := decryptAccessRequest(r, accessParam)
+		if err != nil {
+			return nil, httpapi.Errorf(httpapi.InvalidToken, "Invalid access token")
+		}
+		if len(creds.Commands) > 0 || creds.ReadOnly || creds.Protocol == protocolTelnet {
+			return nil, httpapi.Errorf(httpapi.Forbidden, "Access token does not permit %s", strings.ToLower(operationNoun(op)))
+		}
+		if !permitsOperation(creds.Operations, op) {
+			return nil, httpapi.Errorf(httpapi.Forbidden, "Access token does not permit %s", op)
+		}
+		if err := checkBoundTarget(get, creds.Host, creds.User); err != nil {
+			return nil, err
+		}
+		target.Host = creds.Host
+		target.User = creds.User
+		target.Password = creds.Password
+		target.Source = creds.Source
+		target.Quotas = requestQuotas(r, creds.Token)
+		if creds.PrivateKey != "" {
+			target.PrivateKey, _ = base64.StdEncoding.DecodeString(creds.PrivateKey)
+		}
+	} else {
+		// Get SSH credentials from the request (legacy mode)
+		if protocol := get("protocol"); protocol != "" && protocol != protocolSSH {
+			return nil, httpapi.Errorf(httpapi.Forbidden, "%s are only available over SSH", operationNoun(op))
+		}
+		target.Host, target.User = resolveHost(get("host"), get("user"))
+		target.Password = get("password")
+		target.Source = get("credentials")
+		target.Quotas = requestQuotas(r, quotaToken{})
+		if privateKeyB64 := get("privatekey"); privateKeyB64 != "" {
+			privateKey, err := base64.StdEncoding.DecodeString(privateKeyB64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid private key encoding")
+			}
+			target.PrivateKey = privateKey
+		}
+	}
+
+	if target.Host == "" || (target.User == "" && target.Source == "") {
+		return nil, httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	return target, nil
+}
+
+// connect returns an SSH client for the target along with a function to
+// release it. Session connections are shared and are not closed.
+func (t *transferTarget) connect(ctx context.Context, meta requestMeta) (*ssh.Client, func(), error) {
+	if t.Session != nil {
+		return t.Session.client, func() {}, nil
+	}
+
+	stored := &vaultCredentials{}
+	if t.Source != "" {
+		var err error
+		id := t.Identity
+		if id.User == "" {
+			id.User = meta.User
+		}
+		if stored, err = lookupCredentialSource(meta, id, t.Source, t.Host, t.User); err != nil {
+			return nil, nil, err
+		}
+		if stored.User != "" {
+			t.User = stored.User
+		}
+		t.Password = stored.Password
+		t.PrivateKey = stored.PrivateKey
+	}
+	if t.User == "" {
+		return nil, nil, httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	// The user may have come from the stored credentials, or the target
+	// from a schedule, and jobs may have waited in the queue
+	if err := authorizeLogin(meta.Log, meta.ClientIP, meta.User, t.Host, t.User, ""); err != nil {
+		stored.Wipe()
+		return nil, nil, err
+	}
+	if err := authorizeHostPolicy(meta.Log, meta.ClientIP, meta.User, t.Host, ""); err != nil {
+		stored.Wipe()
+		return nil, nil, err
+	}
+
+	clientConfig, auth, err := newSSHClientConfig(t.User, t.Password, t.PrivateKey)
+	if err != nil {
+		stored.Wipe()
+		return nil, nil, err
+	}
+	if stored.Signer != nil {
+		clientConfig.Auth = append(clientConfig.Auth, auth.publicKeys(stored.Signer))
+	}
+
+	// Vault-signed certificates are short-lived, so their connections
+	// aren't shared
+	fingerprint := ""
+	if stored.Signer == nil {
+		fingerprint = poolFingerprint(t.Password, t.PrivateKey)
+	}
+	sshConn, release, err := sshPool.connect(ctx, meta, t.Host, clientConfig, auth, fingerprint)
+	if err != nil {
+		stored.Wipe()
+		return nil, nil, sshDialError(err)
+	}
+	return sshConn, func() {
+		release()
+		stored.Wipe()
+	}, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fernet/fernet-go"
+	"github.com/gorilla/websocket"
+)
+
+// testAccessToken encrypts values as generate_url.py does, with the key
+// useConfig installs
+func testAccessToken(t *testing.T, values url.Values) string {
+	t.Helper()
+	key, err := fernet.DecodeKey(testFernetKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.StdEncoding.EncodeToString([]byte(values.Encode()))
+	token, err := fernet.EncryptAndSign([]byte(payload), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(token)
+}
+
+// addTestSession registers s under id until the test ends
+func addTestSession(t *testing.T, id string, s *activeSession) {
+	t.Helper()
+	s.ID = id
+	sessions.mu.Lock()
+	sessions.sessions[id] = s
+	sessions.mu.Unlock()
+	t.Cleanup(func() {
+		sessions.mu.Lock()
+		delete(sessions.sessions, id)
+		sessions.mu.Unlock()
+	})
+}
+
+// TestTransferTargetSwapAfterToken edits the host and user of a transfer
+// from a token or a session, as a page with edited form fields would
+func TestTransferTargetSwapAfterToken(t *testing.T) {
+	useConfig(t, "")
+	token := testAccessToken(t, url.Values{"hostname": {"web01:22"}, "username": {"deploy"}, "password": {"secret"}})
+	downloadOnly := testAccessToken(t, url.Values{"hostname": {"web01:22"}, "username": {"deploy"}, "operation": {opDownload}})
+	addTestSession(t, "s1", &activeSession{Host: "web01:22", SSHUser: "deploy", key: "k1"})
+
+	tests := []struct {
+		name   string
+		op     string
+		params url.Values
+		// wantErr is a part of the refusal, or "" for web01 as deploy
+		wantErr string
+	}{
+		{"token", opUpload, url.Values{"access": {token}}, ""},
+		{"token with its own host", opUpload, url.Values{"access": {token}, "host": {"web01:22"}, "user": {"deploy"}}, ""},
+		{"token to another host", opUpload, url.Values{"access": {token}, "host": {"db01:22"}}, "Host does not match"},
+		{"token as another user", opDownload, url.Values{"access": {token}, "user": {"root"}}, "User does not match"},
+		{"token for another operation", opUpload, url.Values{"access": {downloadOnly}}, "does not permit upload"},
+		{"session", opDownload, url.Values{"session": {"s1"}, "session_key": {"k1"}}, ""},
+		{"session to another host", opDownload, url.Values{"session": {"s1"}, "session_key": {"k1"}, "host": {"db01"}}, "Host does not match"},
+		{"session as another user", opUpload, url.Values{"session": {"s1"}, "session_key": {"k1"}, "user": {"root"}}, "User does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/download?"+tt.params.Encode(), nil)
+			target, err := resolveTransferTarget(r, tt.op, r.URL.Query().Get)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.Host != "web01:22" || target.User != "deploy" {
+				t.Errorf("target %s as %s, want web01:22 as deploy", target.Host, target.User)
+			}
+		})
+	}
+}
+
+func TestTerminalTokenRefusesOtherHost(t *testing.T) {
+	useConfig(t, `
+security:
+  fernet_key: `+testFernetKey+`
+  allow_query_token: true
+`)
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	token := testAccessToken(t, url.Values{"hostname": {"web01:22"}, "username": {"deploy"}})
+	conn, err := handoffs.put(SSHCredentials{Host: "web01:22", User: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, params := range map[string]url.Values{
+		"token":   {"access": {token}, "host": {"db01:22"}},
+		"handoff": {"conn": {conn}, "host": {"db01:22"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?"+params.Encode(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_, msg, err := client.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "Error: Host does not match the host this connection is bound to"; string(msg) != want {
+				t.Errorf("got %q, want %q", msg, want)
+			}
+		})
+	}
+}
+
+func TestTerminalTokenInURLNeedsAllowQueryToken(t *testing.T) {
+	useConfig(t, "")
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	token := testAccessToken(t, url.Values{"hostname": {"web01:22"}, "username": {"deploy"}})
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?access="+url.QueryEscape(token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Error: Access tokens in the URL are disabled; use /access#<token> instead"; string(msg) != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+}
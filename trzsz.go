@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gossh/internal/sshbridge"
+)
+
+// trzsz (trz and tsz) moves files over the terminal in lines of text,
+// "#TYPE:value\n", taking turns: every line of one side is answered by one
+// of the other. trz or tsz on the host prints a magic line, the side in
+// the terminal, here the server, answers with an action, the host sends
+// its config and then the files go one way, a line of data at a time.
+
+const (
+	// trzszTimeout ends a transfer the host stopped answering
+	trzszTimeout = 30 * time.Second
+	// trzszMaxLine bounds a line from the host, which for data grows with
+	// tsz's -B buffer size
+	trzszMaxLine = 16 << 20
+	// trzszBufSize is the data each line of an upload carries unless trz
+	// asks for other sizes, capped at trzszMaxBufSize
+	trzszBufSize    = 10 << 10
+	trzszMaxBufSize = 1 << 20
+	// trzszVersion is the version of trzsz the server speaks
+	trzszVersion = "1.1.6"
+)
+
+// protocolTrzsz marks the audit events of trzsz transfers
+const protocolTrzsz = "trzsz"
+
+// trzszMagic starts the line trz and tsz print
+const trzszMagic = "::TRZSZ:TRANSFER:"
+
+// trzszTrigger is the rest of that line: S for tsz, R for trz, D for
+// trz -d, their version, and an ID telling a new transfer from the same
+// line shown again
+var trzszTrigger = regexp.MustCompile(`^([SRD]):(\d+\.\d+\.\d+)(:\d+)?$`)
+
+// trzszAction answers the magic line
+type trzszAction struct {
+	Lang       string `json:"lang"`
+	Confirm    bool   `json:"confirm"`
+	Version    string `json:"version"`
+	SupportDir bool   `json:"support_dir"`
+	Binary     bool   `json:"binary"`
+}
+
+// trzszConfig is what trz and tsz were told on their command line
+type trzszConfig struct {
+	Binary    bool  `json:"binary"`
+	Directory bool  `json:"directory"`
+	BufSize   int64 `json:"bufsize"`
+}
+
+// States of a trzszBridge
+const (
+	tzIdle = iota
+	// tzTrigger: the rest of the magic line is being read
+	tzTrigger
+	// tzChoose: trz waits for the user to pick a file
+	tzChoose
+	// tzTransfer: lines are being exchanged
+	tzTransfer
+	// tzDiscard: the transfer was stopped; a line the host sent before it
+	// knew is dropped
+	tzDiscard
+)
+
+// trzszBridge watches a session's output for trz and tsz starting and
+// answers them as zmodemBridge does rz and sz: files tsz sends are passed
+// to the page as downloads, and trz gets a file the user picks. A nil
+// bridge passes everything through.
+type trzszBridge struct {
+	meta     requestMeta
+	host     string
+	sshUser  string
+	out      *wsWriter
+	stdin    io.Writer
+	download bool // whether tsz may send to the page
+	upload   bool // whether trz may get files from the page
+	quotas   []quotaSubject
+
+	mu      sync.Mutex
+	state   int
+	matched int    // bytes of trzszMagic matched, while idle
+	trigger []byte // what follows the magic
+	lastID  string // the ID of the last transfer's magic line
+	line    []byte // the host's line being read
+	timer   *time.Timer
+	// echo is terminal output of the bridge's own, such as a refusal
+	echo []byte
+	// drain holds bytes dropped until another arrives: the line end of
+	// the magic
+	drain string
+
+	// sending is set when trz receives, so the server sends
+	sending bool
+	// expect is the type of the host's next line; for an upload that is
+	// always SUCC, answering the line step names
+	expect  string
+	step    string
+	bufSize int64
+	files   int      // how many files tsz has yet to send
+	saved   []string // the names of the files transferred so far
+
+	// The file being transferred
+	name    string
+	size    int64
+	pos     int64 // bytes received, or sent
+	sent    int64 // bytes in the data line awaiting its SUCC
+	md5     hash.Hash
+	hasher  hash.Hash
+	mirror  *transferMirror
+	sum     string
+	started time.Time
+	chunk   []byte // received data not passed to the page yet
+	file    []byte // the file the user picked for trz
+}
+
+// newTrzszBridge returns the bridge of a session, or nil when trzsz
+// support is off or the client has no page to pass files to
+func newTrzszBridge(meta requestMeta, host, sshUser string, out *wsWriter, conn sshbridge.Conn, stdin io.Writer, opts sessionOptions) *trzszBridge {
+	if !currentConfig().Session.Trzsz {
+		return nil
+	}
+	if _, ok := conn.(rawOutputConn); ok {
+		return nil
+	}
+	download, upload := terminalTransfers(opts)
+	return &trzszBridge{
+		meta:     meta,
+		host:     host,
+		sshUser:  sshUser,
+		out:      out,
+		stdin:    stdin,
+		download: download,
+		upload:   upload,
+		quotas:   opts.Quotas,
+	}
+}
+
+// output takes the session's output and returns what is for the terminal
+func (t *trzszBridge) output(p []byte) []byte {
+	if t == nil {
+		return p
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == tzIdle && t.matched == 0 && t.drain == "" && bytes.IndexByte(p, ':') < 0 {
+		return p
+	}
+	if t.state == tzTransfer {
+		t.deadline(trzszTimeout)
+	}
+
+	term := make([]byte, 0, len(p))
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if t.drain != "" {
+			if strings.IndexByte(t.drain, b) >= 0 {
+				continue
+			}
+			t.drain = ""
+		}
+		switch t.state {
+		case tzIdle:
+			if b == trzszMagic[t.matched] {
+				if t.matched++; t.matched == len(trzszMagic) {
+					t.state, t.matched, t.trigger = tzTrigger, 0, t.trigger[:0]
+					// trz saves the cursor and rings the bell before it
+					term = bytes.TrimSuffix(term, []byte("\x1b7\x07"))
+				}
+				continue
+			}
+			if b == ':' && t.matched == 2 {
+				// A longer run of colons: the first is text
+				term = append(term, ':')
+				continue
+			}
+			if t.matched > 0 {
+				term = append(term, trzszMagic[:t.matched]...)
+				t.matched = 0
+				i--
+				continue
+			}
+			term = append(term, b)
+
+		case tzTrigger:
+			end := b == '\r' || b == '\n'
+			if !end {
+				t.trigger = append(t.trigger, b)
+			}
+			// The ID has 13 digits; older versions end the line instead
+			m := trzszTrigger.FindSubmatch(t.trigger)
+			if m != nil && (end || len(m[3]) == 14) && t.begin(m[1][0], string(m[3])) {
+				t.drain = "\r\n"
+				break
+			}
+			if end || m == nil && (len(t.trigger) > 40 || !strings.ContainsRune("SRD0123456789.:", rune(b))) {
+				// Not trzsz after all
+				term = append(term, trzszMagic...)
+				term = append(term, t.trigger...)
+				if end {
+					term = append(term, b)
+				}
+				t.state = tzIdle
+			}
+
+		case tzDiscard:
+			if len(t.line) == 0 && b != '#' {
+				t.state = tzIdle
+				i--
+				continue
+			}
+			if b == '\n' {
+				t.state, t.line = tzIdle, t.line[:0]
+			} else if len(t.line) < trzszMaxLine {
+				t.line = append(t.line, b)
+			}
+
+		default:
+			if b != '\n' {
+				if len(t.line) >= trzszMaxLine {
+					t.fail(errors.New("the host sent too long a line"), true)
+					continue
+				}
+				t.line = append(t.line, b)
+				continue
+			}
+			t.handleLine(t.line)
+			t.line = t.line[:0]
+		}
+		if t.echo != nil {
+			term = append(term, t.echo...)
+			t.echo = nil
+		}
+	}
+	return term
+}
+
+// begin starts a transfer on the magic line of tsz (S) or trz (R and D).
+// It returns false for the line of the last transfer shown again. The
+// caller holds mu.
+func (t *trzszBridge) begin(mode byte, id string) bool {
+	if id != "" && id == t.lastID {
+		return false
+	}
+	t.lastID = id
+	t.state, t.line, t.bufSize = tzTransfer, t.line[:0], trzszBufSize
+	t.sending, t.files, t.saved = mode != 'S', 0, nil
+	t.expect, t.step = "CFG", ""
+	switch {
+	case mode == 'D':
+		t.refuse("directory transfers are")
+	case mode == 'S' && !t.download:
+		t.refuse("downloads are")
+	case mode != 'S' && !t.upload:
+		t.refuse("uploads are")
+	case mode == 'S':
+		t.meta.Log.Debug("trzsz transfer started", "direction", "download")
+		t.action(true)
+		t.deadline(trzszTimeout)
+	default:
+		t.state = tzChoose
+		t.meta.Log.Debug("trzsz transfer started", "direction", "upload")
+		t.notify(sshbridge.TransferMessage{Event: "upload_request"})
+		t.deadline(terminalTransferChooseTimeout)
+	}
+	return true
+}
+
+// refuse declines a transfer the session may not make. The caller holds
+// mu.
+func (t *trzszBridge) refuse(what string) {
+	t.action(false)
+	t.echo = fmt.Appendf(nil, "\r\n\x1b[1;33m[trzsz %s not available in this session]\x1b[0m\r\n", what)
+	t.meta.Log.Info("Refused trzsz transfer", "what", strings.TrimSuffix(what, " are"))
+	t.state = tzIdle
+	t.end()
+}
+
+// action answers the magic line. Hosts only fall back from binary mode,
+// which needs every byte to pass the terminal unchanged, for clients in
+// JavaScript; the page is where the files end up, so the server says it
+// is one.
+func (t *trzszBridge) action(confirm bool) {
+	act, _ := json.Marshal(trzszAction{Lang: "js", Confirm: confirm, Version: trzszVersion})
+	t.sendString("ACT", string(act))
+}
+
+// handleLine acts on a line from the host. The caller holds mu.
+func (t *trzszBridge) handleLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	// Anything before the last # is junk, such as tmux adds
+	i := bytes.LastIndexByte(line, '#')
+	if i < 0 {
+		return
+	}
+	typ, value, ok := strings.Cut(string(line[i+1:]), ":")
+	if !ok {
+		return
+	}
+	switch typ {
+	case "fail", "FAIL":
+		// FAIL carries a traceback after the message
+		msg := "failed on the host"
+		if p, err := decodeTrzsz(value, trzszMaxLine); err == nil {
+			msg, _, _ = strings.Cut(strings.TrimSpace(string(p)), "\n")
+		}
+		t.fail(errors.New(msg), false)
+		return
+	case "EXIT":
+		if p, err := decodeTrzsz(value, trzszMaxLine); err == nil {
+			t.echo = append(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n")), '\r', '\n')
+		}
+		t.end()
+		return
+	}
+	if t.state != tzTransfer {
+		return
+	}
+	if typ != t.expect {
+		t.fail(fmt.Errorf("the host sent %s where %s was expected", typ, t.expect), true)
+		return
+	}
+
+	var err error
+	switch {
+	case typ == "CFG":
+		err = t.config(value)
+	case t.sending:
+		err = t.sendStep(value)
+	default:
+		err = t.receiveStep(value)
+	}
+	if err != nil {
+		t.fail(err, true)
+	}
+}
+
+// config reads the host's config and starts the transfer. The caller
+// holds mu.
+func (t *trzszBridge) config(value string) error {
+	p, err := decodeTrzsz(value, trzszMaxLine)
+	if err != nil {
+		return fmt.Errorf("bad config from the host: %v", err)
+	}
+	var cfg trzszConfig
+	if err := json.Unmarshal(p, &cfg); err != nil {
+		return fmt.Errorf("bad config from the host: %v", err)
+	}
+	if cfg.Binary {
+		return errors.New("binary mode is not supported, run it without -b")
+	}
+	if cfg.Directory {
+		return errors.New("directory transfers are not supported")
+	}
+	if cfg.BufSize > 0 {
+		t.bufSize = min(cfg.BufSize, trzszMaxBufSize)
+	}
+	if !t.sending {
+		t.expect = "NUM"
+		return nil
+	}
+	t.expect, t.step = "SUCC", "NUM"
+	t.send("NUM", "1")
+	return nil
+}
+
+// receiveStep handles a line of tsz. The caller holds mu.
+func (t *trzszBridge) receiveStep(value string) error {
+	switch t.expect {
+	case "NUM":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad file count %q from the host", value)
+		}
+		t.files = n
+		t.send("SUCC", value)
+		t.expect = "NAME"
+		if n == 0 {
+			t.finish()
+		}
+	case "NAME":
+		p, err := decodeTrzsz(value, trzszMaxLine)
+		if err != nil {
+			return fmt.Errorf("bad file name from the host: %v", err)
+		}
+		name := transferFileName(string(p))
+		if name == "" {
+			return errors.New("the host sent no file name")
+		}
+		if err := quotas.check(t.quotas); err != nil {
+			return err
+		}
+		t.name, t.size, t.pos = name, 0, 0
+		t.md5, t.hasher, t.started = md5.New(), sha256.New(), time.Now()
+		if err := t.startMirror(auditDownload, nil); err != nil {
+			return err
+		}
+		t.sendString("SUCC", name)
+		t.expect = "SIZE"
+	case "SIZE":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad file size %q from the host", value)
+		}
+		t.size = size
+		t.send("SUCC", value)
+		t.meta.Log.Info("trzsz download started", "file", t.name, "size", size)
+		t.notify(sshbridge.TransferMessage{Event: "download", Filename: t.name, Size: size})
+		t.expect = "DATA"
+		if size == 0 {
+			t.expect = "MD5"
+		}
+	case "DATA":
+		data, err := decodeTrzsz(value, t.size-t.pos)
+		if err != nil {
+			return fmt.Errorf("bad data from the host: %v", err)
+		}
+		if _, err := t.mirror.Write(data); err != nil {
+			return err
+		}
+		t.pos += int64(len(data))
+		t.md5.Write(data)
+		t.hasher.Write(data)
+		t.chunk = append(t.chunk, data...)
+		if len(t.chunk) >= terminalTransferChunk {
+			t.flush()
+		}
+		if err := quotas.charge(t.quotas, int64(len(data)), t.meta, opDownload); err != nil {
+			return err
+		}
+		t.send("SUCC", strconv.Itoa(len(data)))
+		if t.pos >= t.size {
+			t.expect = "MD5"
+		}
+	case "MD5":
+		digest, err := decodeTrzsz(value, md5.Size)
+		if err != nil {
+			return fmt.Errorf("bad MD5 from the host: %v", err)
+		}
+		if !bytes.Equal(digest, t.md5.Sum(nil)) {
+			return fmt.Errorf("the MD5 of %s doesn't match", t.name)
+		}
+		t.send("SUCC", encodeTrzsz(digest))
+		t.finishDownload()
+		if t.files--; t.files > 0 {
+			t.expect = "NAME"
+		} else {
+			t.finish()
+		}
+	}
+	return nil
+}
+
+// flush passes received data on to the page. The caller holds mu.
+func (t *trzszBridge) flush() {
+	if len(t.chunk) == 0 {
+		return
+	}
+	t.notify(sshbridge.TransferMessage{Event: "data", Data: base64.StdEncoding.EncodeToString(t.chunk)})
+	t.chunk = t.chunk[:0]
+}
+
+// finishDownload tells the page a file is complete. The caller holds mu.
+func (t *trzszBridge) finishDownload() {
+	t.flush()
+	t.sum = hex.EncodeToString(t.hasher.Sum(nil))
+	t.notify(sshbridge.TransferMessage{Event: "download_end", Filename: t.name, Size: t.pos, SHA256: t.sum})
+	t.meta.Log.Info("trzsz download finished", "file", t.name, "size", t.pos, "duration", time.Since(t.started))
+	t.audit(auditDownload, nil)
+	t.saved = append(t.saved, t.name)
+	t.name = ""
+}
+
+// uploadChosen sends trz the file the user picked
+func (t *trzszBridge) uploadChosen(msg sshbridge.ClientMessage) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != tzChoose {
+		return
+	}
+	name, data, err := chosenFile(msg)
+	if err != nil {
+		t.fail(err, true)
+		return
+	}
+	if err := t.out.mem.holdTransfer(len(data)); err != nil {
+		t.fail(err, true)
+		return
+	}
+	t.name, t.size, t.file, t.pos = name, int64(len(data)), data, 0
+	t.md5, t.started = md5.New(), time.Now()
+	t.md5.Write(data)
+	sum := sha256.Sum256(data)
+	t.sum = hex.EncodeToString(sum[:])
+	if err := quotas.check(t.quotas); err != nil {
+		t.fail(err, true)
+		return
+	}
+	if err := t.startMirror(auditUpload, data); err != nil {
+		t.fail(err, true)
+		return
+	}
+
+	t.state = tzTransfer
+	t.meta.Log.Info("trzsz upload started", "file", name, "size", t.size)
+	t.action(true)
+	t.deadline(trzszTimeout)
+}
+
+// sendStep handles trz's answer to the last line sent. The caller holds
+// mu.
+func (t *trzszBridge) sendStep(value string) error {
+	switch t.step {
+	case "NUM":
+		if value != "1" {
+			return fmt.Errorf("the host took %s files of 1", value)
+		}
+		t.sendString("NAME", t.name)
+		t.step = "NAME"
+	case "NAME":
+		// trz may save the file under another name
+		if p, err := decodeTrzsz(value, trzszMaxLine); err == nil && len(p) > 0 {
+			t.saved = append(t.saved, string(p))
+		} else {
+			t.saved = append(t.saved, t.name)
+		}
+		t.send("SIZE", strconv.FormatInt(t.size, 10))
+		t.step = "SIZE"
+	case "SIZE":
+		if value != strconv.FormatInt(t.size, 10) {
+			return fmt.Errorf("the host took a size of %s for %d bytes", value, t.size)
+		}
+		t.sendData()
+	case "DATA":
+		if value != strconv.FormatInt(t.sent, 10) {
+			return fmt.Errorf("the host took %s bytes of %d", value, t.sent)
+		}
+		t.pos += t.sent
+		if err := quotas.charge(t.quotas, t.sent, t.meta, opUpload); err != nil {
+			return err
+		}
+		if t.pos/terminalTransferChunk != (t.pos-t.sent)/terminalTransferChunk || t.pos == t.size {
+			t.notify(sshbridge.TransferMessage{Event: "progress", Filename: t.name, Size: t.size, Bytes: t.pos})
+		}
+		t.sendData()
+	case "MD5":
+		digest, err := decodeTrzsz(value, md5.Size)
+		if err != nil || !bytes.Equal(digest, t.md5.Sum(nil)) {
+			return fmt.Errorf("the host's MD5 of %s doesn't match", t.name)
+		}
+		t.notify(sshbridge.TransferMessage{Event: "upload_end", Filename: t.name, Size: t.size, SHA256: t.sum})
+		t.meta.Log.Info("trzsz upload finished", "file", t.name, "size", t.size, "duration", time.Since(t.started))
+		t.audit(auditUpload, nil)
+		t.name = ""
+		t.finish()
+	}
+	return nil
+}
+
+// sendData sends the next line of the upload, or its MD5 once all data
+// went. The caller holds mu.
+func (t *trzszBridge) sendData() {
+	if t.pos >= t.size {
+		t.send("MD5", encodeTrzsz(t.md5.Sum(nil)))
+		t.step = "MD5"
+		return
+	}
+	t.sent = min(t.bufSize, t.size-t.pos)
+	t.send("DATA", encodeTrzsz(t.file[t.pos:t.pos+t.sent]))
+	t.step = "DATA"
+}
+
+// finish tells the host the transfer is done, which it prints on its way
+// out. The caller holds mu.
+func (t *trzszBridge) finish() {
+	noun := "files"
+	if len(t.saved) == 1 {
+		noun = "file"
+	}
+	msg := fmt.Sprintf("Saved %d %s", len(t.saved), noun)
+	if !t.sending {
+		msg += " in the browser"
+	}
+	for _, name := range t.saved {
+		msg += "\r\n- " + name
+	}
+	t.sendString("EXIT", msg)
+	t.end()
+}
+
+// cancel stops the transfer at the user's request
+func (t *trzszBridge) cancel() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case tzChoose:
+		t.action(false)
+		t.end()
+	case tzTransfer:
+		t.fail(errors.New("cancelled"), true)
+	}
+}
+
+// busy tells whether a transfer holds the terminal, which ignores typing
+// meanwhile
+func (t *trzszBridge) busy() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state == tzChoose || t.state == tzTransfer
+}
+
+// fail ends the transfer, telling the host why unless the error is its
+// own. The caller holds mu.
+func (t *trzszBridge) fail(err error, abort bool) {
+	if abort {
+		t.sendString("fail", err.Error())
+	}
+	t.meta.Log.Warn("trzsz transfer failed", "file", t.name, "err", err)
+	if t.name != "" {
+		event := auditDownload
+		if t.sending {
+			event = auditUpload
+		}
+		t.audit(event, err)
+	}
+	t.notify(sshbridge.TransferMessage{Event: "error", Filename: t.name, Error: err.Error()})
+	t.end()
+	if abort {
+		t.state = tzDiscard
+	}
+}
+
+// end gives the terminal back. The caller holds mu.
+func (t *trzszBridge) end() {
+	t.stopTimer()
+	if t.state == tzChoose || t.state == tzTransfer {
+		t.notify(sshbridge.TransferMessage{Event: "end"})
+	}
+	t.state, t.matched, t.line = tzIdle, 0, nil
+	t.out.mem.releaseTransfer(len(t.file))
+	t.name, t.file, t.chunk, t.md5, t.hasher = "", nil, nil, nil, nil
+}
+
+// deadline (re)starts the timer that ends a stalled transfer. The caller
+// holds mu.
+func (t *trzszBridge) deadline(d time.Duration) {
+	if t.timer != nil {
+		t.timer.Reset(d)
+		return
+	}
+	t.timer = time.AfterFunc(d, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.state == tzChoose || t.state == tzTransfer {
+			t.fail(errors.New("timed out"), true)
+		}
+	})
+}
+
+func (t *trzszBridge) stopTimer() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// send writes a line to the host
+func (t *trzszBridge) send(typ, value string) {
+	if _, err := io.WriteString(t.stdin, "#"+typ+":"+value+"\n"); err != nil {
+		t.meta.Log.Warn("Failed to send trzsz line", "err", err)
+	}
+}
+
+func (t *trzszBridge) sendString(typ, s string) {
+	t.send(typ, encodeTrzsz([]byte(s)))
+}
+
+func (t *trzszBridge) notify(msg sshbridge.TransferMessage) {
+	msg.Type = protocolTrzsz
+	t.out.WriteJSON(msg)
+}
+
+// startMirror begins the copy of the file being transferred, data when
+// uploading. The caller holds mu.
+func (t *trzszBridge) startMirror(direction string, data []byte) error {
+	m, err := startMirror(mirrorRecord{
+		Direction: direction,
+		Protocol:  protocolTrzsz,
+		User:      t.meta.User,
+		ClientIP:  t.meta.ClientIP,
+		Session:   mirrorSession(t.meta, nil),
+		Filename:  t.name,
+	})
+	if err == nil {
+		_, err = m.Write(data)
+	}
+	t.mirror = m
+	return err
+}
+
+// audit records a transfer that ended, or failed, with the bytes moved
+func (t *trzszBridge) audit(event string, err error) {
+	host := mirrorHost{Host: t.host, SSHUser: t.sshUser, Path: t.name, Success: err == nil, Error: errorString(err)}
+	if mirrorErr := t.mirror.finish([]mirrorHost{host}, err); err == nil {
+		err = mirrorErr
+	}
+	t.mirror = nil
+	e := AuditEvent{
+		Event:    event,
+		Outcome:  outcomeOf(err),
+		ClientIP: t.meta.ClientIP,
+		User:     t.meta.User,
+		Host:     t.host,
+		SSHUser:  t.sshUser,
+		Protocol: protocolTrzsz,
+		Path:     t.name,
+		Size:     t.pos,
+		Error:    errorString(err),
+	}
+	if err == nil {
+		e.SHA256 = t.sum
+	}
+	audit.Emit(e)
+}
+
+// encodeTrzsz is how trzsz writes everything but numbers: compressed
+// with zlib, then base64
+func encodeTrzsz(p []byte) string {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(p)
+	w.Close()
+	return base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+// decodeTrzsz reads a value encodeTrzsz wrote, of at most limit bytes
+func decodeTrzsz(s string, limit int64) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	p, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(p)) > limit {
+		return nil, fmt.Errorf("more than the %d bytes expected", limit)
+	}
+	return p, nil
+}
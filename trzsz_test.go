@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshbridge"
+)
+
+// trzszStep is a turn of a trzsz transcript: output of trz or tsz on the
+// host, and the lines the server must answer with
+type trzszStep struct {
+	host string
+	want []string
+}
+
+// trzszSession is a bridge with the page and the host's stdin it talks to
+type trzszSession struct {
+	bridge *trzszBridge
+	page   *fakeConn
+	stdin  *bytes.Buffer
+	term   []byte
+}
+
+func newTrzszSession(t *testing.T, opts sessionOptions) *trzszSession {
+	t.Helper()
+	useConfig(t, "session:\n  trzsz: true\n")
+	s := &trzszSession{page: newFakeConn(), stdin: &bytes.Buffer{}}
+	s.bridge = newTrzszBridge(requestMeta{Log: discardLogger}, "web01", "deploy", newTerminalWriter(s.page), s.page, s.stdin, opts)
+	if s.bridge == nil {
+		t.Fatal("trzsz is disabled")
+	}
+	return s
+}
+
+// play feeds the host's side of the transcript to the bridge, checking
+// the server's answers
+func (s *trzszSession) play(t *testing.T, steps []trzszStep) {
+	t.Helper()
+	for i, step := range steps {
+		s.term = append(s.term, s.bridge.output([]byte(step.host))...)
+		s.expect(t, i, step.want)
+	}
+}
+
+// expect checks the lines sent to the host since the last check
+func (s *trzszSession) expect(t *testing.T, step int, want []string) {
+	t.Helper()
+	var got []string
+	if s.stdin.Len() > 0 {
+		got = strings.Split(strings.TrimSuffix(s.stdin.String(), "\n"), "\n")
+	}
+	s.stdin.Reset()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("step %d: the server sent\n%s\nwant\n%s", step, readableTrzsz(got), readableTrzsz(want))
+	}
+}
+
+// events returns the events of the transfer messages sent to the page
+func (s *trzszSession) events(t *testing.T) []sshbridge.TransferMessage {
+	t.Helper()
+	var msgs []sshbridge.TransferMessage
+	for _, m := range s.page.messages() {
+		if m.messageType != websocket.TextMessage {
+			continue
+		}
+		var msg sshbridge.TransferMessage
+		if err := json.Unmarshal(m.data, &msg); err != nil || msg.Type != protocolTrzsz {
+			t.Fatalf("unexpected message to the page: %s", m.data)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func eventNames(msgs []sshbridge.TransferMessage) string {
+	var names []string
+	for _, m := range msgs {
+		names = append(names, m.Event)
+	}
+	return strings.Join(names, ",")
+}
+
+// readableTrzsz decodes the values of trzsz lines for failure messages
+func readableTrzsz(lines []string) string {
+	var out []string
+	for _, line := range lines {
+		typ, value, _ := strings.Cut(strings.TrimPrefix(line, "#"), ":")
+		if p, err := decodeTrzsz(value, trzszMaxLine); err == nil {
+			value = strconv.Quote(string(p))
+		}
+		out = append(out, "  #"+typ+":"+value)
+	}
+	return strings.Join(out, "\n")
+}
+
+func tzLine(typ, value string) string {
+	return "#" + typ + ":" + value
+}
+
+func tzEncoded(typ string, p []byte) string {
+	return tzLine(typ, encodeTrzsz(p))
+}
+
+func tzAction(confirm bool) string {
+	act, _ := json.Marshal(trzszAction{Lang: "js", Confirm: confirm, Version: trzszVersion})
+	return tzEncoded("ACT", act)
+}
+
+// trzsz 1.1.6 saves the cursor, rings the bell and prints the magic line
+// with a 13-digit ID
+const (
+	tszMagic  = "\x1b7\x07::TRZSZ:TRANSFER:S:1.1.6:1696475556714\r\n"
+	trzMagic  = "\x1b7\x07::TRZSZ:TRANSFER:R:1.1.6:1696475601152\r\n"
+	trzDMagic = "\x1b7\x07::TRZSZ:TRANSFER:D:1.1.6:1696475632290\r\n"
+	// tszConfig is the config tsz sends without options
+	tszConfig = `{"lang":"py","timeout":20,"binary":false,"directory":false,"bufsize":10240,"escape_chars":[],"tmux_pane_width":0}`
+)
+
+func TestTrzszDownload(t *testing.T) {
+	s := newTrzszSession(t, sessionOptions{})
+	first := bytes.Repeat([]byte("first line of the report\n"), 400)
+	second := []byte("last line\n")
+	file := append(append([]byte(nil), first...), second...)
+	sum := md5.Sum(file)
+
+	s.play(t, []trzszStep{
+		{"$ tsz report.txt\r\n" + tszMagic, []string{tzAction(true)}},
+		{tzEncoded("CFG", []byte(tszConfig)) + "\n", nil},
+		{tzLine("NUM", "1") + "\n", []string{tzLine("SUCC", "1")}},
+		{tzEncoded("NAME", []byte("report.txt")) + "\n", []string{tzEncoded("SUCC", []byte("report.txt"))}},
+		{tzLine("SIZE", strconv.Itoa(len(file))) + "\n", []string{tzLine("SUCC", strconv.Itoa(len(file)))}},
+		// A data line may arrive split over several reads
+		{tzEncoded("DATA", first)[:100], nil},
+		{tzEncoded("DATA", first)[100:] + "\r\n", []string{tzLine("SUCC", strconv.Itoa(len(first)))}},
+		{tzEncoded("DATA", second) + "\n", []string{tzLine("SUCC", strconv.Itoa(len(second)))}},
+		{tzEncoded("MD5", sum[:]) + "\n", []string{
+			tzEncoded("SUCC", sum[:]),
+			tzEncoded("EXIT", []byte("Saved 1 file in the browser\r\n- report.txt")),
+		}},
+		{"Saved 1 file in the browser\r\n- report.txt\r\n$ ", nil},
+	})
+
+	if got, want := string(s.term), "$ tsz report.txt\r\nSaved 1 file in the browser\r\n- report.txt\r\n$ "; got != want {
+		t.Errorf("terminal shows %q, want %q", got, want)
+	}
+	msgs := s.events(t)
+	if got, want := eventNames(msgs), "download,data,download_end,end"; got != want {
+		t.Fatalf("page got %s, want %s", got, want)
+	}
+	data, _ := base64.StdEncoding.DecodeString(msgs[1].Data)
+	sha := sha256.Sum256(file)
+	if !bytes.Equal(data, file) || msgs[2].SHA256 != hex.EncodeToString(sha[:]) || msgs[2].Size != int64(len(file)) {
+		t.Errorf("page got %d bytes and %+v, want %d bytes", len(data), msgs[2], len(file))
+	}
+	if s.bridge.busy() {
+		t.Error("the bridge still holds the terminal")
+	}
+
+	// The terminal redrawing the magic line doesn't start another transfer
+	out := s.bridge.output([]byte(tszMagic))
+	s.expect(t, 0, nil)
+	if !bytes.Contains(out, []byte("::TRZSZ:TRANSFER:S:1.1.6:1696475556714")) {
+		t.Errorf("the magic line shown again became %q", out)
+	}
+}
+
+func TestTrzszUpload(t *testing.T) {
+	s := newTrzszSession(t, sessionOptions{})
+	file := bytes.Repeat([]byte{0, 1, 2, 0xff}, 6000) // three data lines
+	sum := md5.Sum(file)
+
+	s.play(t, []trzszStep{{"$ trz\r\n" + trzMagic, nil}})
+	if got := eventNames(s.events(t)); got != "upload_request" {
+		t.Fatalf("page got %s, want upload_request", got)
+	}
+	if !s.bridge.busy() {
+		t.Fatal("the terminal isn't held while the user picks a file")
+	}
+	s.bridge.uploadChosen(sshbridge.ClientMessage{Type: "trzsz_upload", Filename: "C:\\Users\\alice\\data.bin", Data: base64.StdEncoding.EncodeToString(file)})
+	s.expect(t, 0, []string{tzAction(true)})
+
+	cfg := strings.Replace(tszConfig, `"bufsize":10240`, `"bufsize":10000`, 1)
+	s.play(t, []trzszStep{
+		{tzEncoded("CFG", []byte(cfg)) + "\n", []string{tzLine("NUM", "1")}},
+		{tzLine("SUCC", "1") + "\n", []string{tzEncoded("NAME", []byte("data.bin"))}},
+		// trz saves it under another name when the file exists
+		{tzEncoded("SUCC", []byte("data.bin.0")) + "\n", []string{tzLine("SIZE", "24000")}},
+		{tzLine("SUCC", "24000") + "\n", []string{tzEncoded("DATA", file[:10000])}},
+		{tzLine("SUCC", "10000") + "\n", []string{tzEncoded("DATA", file[10000:20000])}},
+		{tzLine("SUCC", "10000") + "\n", []string{tzEncoded("DATA", file[20000:])}},
+		{tzLine("SUCC", "4000") + "\n", []string{tzEncoded("MD5", sum[:])}},
+		{tzEncoded("SUCC", sum[:]) + "\n", []string{tzEncoded("EXIT", []byte("Saved 1 file\r\n- data.bin.0"))}},
+	})
+
+	msgs := s.events(t)
+	if got, want := eventNames(msgs), "upload_request,progress,upload_end,end"; got != want {
+		t.Errorf("page got %s, want %s", got, want)
+	}
+	if s.bridge.busy() {
+		t.Error("the bridge still holds the terminal")
+	}
+}
+
+func TestTrzszRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  sessionOptions
+		magic string
+		what  string
+	}{
+		{"download", sessionOptions{Operations: []string{opUpload}}, tszMagic, "downloads are"},
+		{"upload", sessionOptions{Operations: []string{opDownload}}, trzMagic, "uploads are"},
+		{"read-only", sessionOptions{ReadOnly: true}, tszMagic, "downloads are"},
+		{"directory", sessionOptions{}, trzDMagic, "directory transfers are"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTrzszSession(t, tt.opts)
+			s.play(t, []trzszStep{{tt.magic, []string{tzAction(false)}}})
+			if want := "[trzsz " + tt.what + " not available in this session]"; !strings.Contains(string(s.term), want) {
+				t.Errorf("terminal shows %q, want %q", s.term, want)
+			}
+			if s.bridge.busy() {
+				t.Error("a refused transfer holds the terminal")
+			}
+		})
+	}
+}
+
+func TestTrzszFailures(t *testing.T) {
+	file := []byte("hello\n")
+	wrong := md5.Sum([]byte("something else"))
+	start := []trzszStep{
+		{tszMagic, []string{tzAction(true)}},
+	}
+	tests := []struct {
+		name  string
+		steps []trzszStep
+		err   string
+	}{
+		{"binary mode", []trzszStep{
+			{tzEncoded("CFG", []byte(strings.Replace(tszConfig, `"binary":false`, `"binary":true`, 1))) + "\n",
+				[]string{tzEncoded("fail", []byte("binary mode is not supported, run it without -b"))}},
+		}, "binary mode is not supported, run it without -b"},
+		{"MD5 mismatch", []trzszStep{
+			{tzEncoded("CFG", []byte(tszConfig)) + "\n", nil},
+			{tzLine("NUM", "1") + "\n", []string{tzLine("SUCC", "1")}},
+			{tzEncoded("NAME", []byte("hello.txt")) + "\n", []string{tzEncoded("SUCC", []byte("hello.txt"))}},
+			{tzLine("SIZE", "6") + "\n", []string{tzLine("SUCC", "6")}},
+			{tzEncoded("DATA", file) + "\n", []string{tzLine("SUCC", "6")}},
+			{tzEncoded("MD5", wrong[:]) + "\n", []string{tzEncoded("fail", []byte("the MD5 of hello.txt doesn't match"))}},
+		}, "the MD5 of hello.txt doesn't match"},
+		{"more data than the size", []trzszStep{
+			{tzEncoded("CFG", []byte(tszConfig)) + "\n", nil},
+			{tzLine("NUM", "1") + "\n", []string{tzLine("SUCC", "1")}},
+			{tzEncoded("NAME", []byte("hello.txt")) + "\n", []string{tzEncoded("SUCC", []byte("hello.txt"))}},
+			{tzLine("SIZE", "2") + "\n", []string{tzLine("SUCC", "2")}},
+			{tzEncoded("DATA", file) + "\n", []string{tzEncoded("fail", []byte("bad data from the host: more than the 2 bytes expected"))}},
+		}, "bad data from the host: more than the 2 bytes expected"},
+		{"out of turn", []trzszStep{
+			{tzLine("NUM", "1") + "\n", []string{tzEncoded("fail", []byte("the host sent NUM where CFG was expected"))}},
+		}, "the host sent NUM where CFG was expected"},
+		// The host's own failure isn't answered
+		{"host fails", []trzszStep{
+			{tzEncoded("CFG", []byte(tszConfig)) + "\n", nil},
+			{tzEncoded("FAIL", []byte("Permission denied\nTraceback (most recent call last):\n...")) + "\n", nil},
+		}, "Permission denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTrzszSession(t, sessionOptions{})
+			s.play(t, append(start, tt.steps...))
+			msgs := s.events(t)
+			if len(msgs) < 2 || msgs[len(msgs)-2].Event != "error" || msgs[len(msgs)-2].Error != tt.err || msgs[len(msgs)-1].Event != "end" {
+				t.Errorf("page got %+v, want error %q and end", msgs, tt.err)
+			}
+			if s.bridge.busy() {
+				t.Error("a failed transfer holds the terminal")
+			}
+			// Output after the failure reaches the terminal again
+			if out := s.bridge.output([]byte("$ ")); string(out) != "$ " {
+				t.Errorf("terminal shows %q after the failure", out)
+			}
+		})
+	}
+}
+
+func TestTrzszPassesOtherOutput(t *testing.T) {
+	s := newTrzszSession(t, sessionOptions{})
+	in := []string{
+		"plain output\r\n",
+		"a::b:::c\r\n",
+		"::TRZSZ:TRANSFER:hello\r\n",
+		"::TRZSZ:TRANSFER:S:1.1\r\n",
+		// The magic split over reads, then not followed by a trigger
+		"::TRZSZ:TRANS",
+		"FER:S:x\r\n",
+	}
+	var got []byte
+	for _, p := range in {
+		got = append(got, s.bridge.output([]byte(p))...)
+	}
+	if want := strings.Join(in, ""); string(got) != want {
+		t.Errorf("terminal shows %q, want %q", got, want)
+	}
+	s.expect(t, 0, nil)
+	if msgs := s.events(t); len(msgs) > 0 {
+		t.Errorf("page got %+v", msgs)
+	}
+}
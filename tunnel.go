@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/httpapi"
+	"gossh/internal/sshbridge"
+)
+
+// ForwardingConfig lets terminal sessions forward TCP connections from the
+// SSH host, over a WebSocket or the SOCKS proxy. Forwarding is off unless
+// allowed_targets is set.
+type ForwardingConfig struct {
+	// AllowedTargets lists the host:port destinations tunnels may open, as
+	// seen from the SSH host. The host is a name, an IP address or a CIDR;
+	// the port a number, a range such as 5432-5439, or *.
+	AllowedTargets []string `yaml:"allowed_targets"`
+	// IdleTimeout closes tunnels without traffic in either direction
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// SOCKSListen opens a SOCKS5 proxy through terminal sessions, e.g.
+	// "1080"; the host defaults to localhost
+	SOCKSListen string `yaml:"socks_listen"`
+	// Expose lists the addresses near gossh, in the allowed_targets format,
+	// that access tokens may make reachable from the SSH host
+	Expose []string `yaml:"expose"`
+}
+
+func (c *ForwardingConfig) applyDefaults() {
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = 5 * time.Minute
+	}
+}
+
+func validateForwardingConfig(cfg ForwardingConfig) error {
+	if cfg.SOCKSListen != "" {
+		if _, _, err := net.SplitHostPort(socksAddress(cfg.SOCKSListen)); err != nil {
+			return fmt.Errorf("forwarding.socks_listen: %v", err)
+		}
+	}
+	return nil
+}
+
+// tunnelTarget is a parsed entry of forwarding.allowed_targets
+type tunnelTarget struct {
+	host    string     // lower-cased host name, when not an address
+	network *net.IPNet // set for IP addresses and CIDRs
+	minPort int
+	maxPort int
+}
+
+func parseTunnelTargets(values []string) ([]tunnelTarget, error) {
+	var targets []tunnelTarget
+	for _, v := range values {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(v))
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid target %q: want host:port", v)
+		}
+		t := tunnelTarget{}
+		if ip := net.ParseIP(host); ip != nil || strings.Contains(host, "/") {
+			nets, err := parseCIDRs([]string{host})
+			if err != nil {
+				return nil, err
+			}
+			t.network = nets[0]
+		} else {
+			t.host = strings.ToLower(host)
+		}
+		if t.minPort, t.maxPort, err = parsePortRange(port); err != nil {
+			return nil, fmt.Errorf("invalid target %q: %v", v, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// parsePortRange parses "5432", "5432-5439" or "*"
+func parsePortRange(s string) (int, int, error) {
+	if s == "*" {
+		return 1, 65535, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	min, err1 := strconv.Atoi(lo)
+	max, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("port must be 1-65535, a range or *")
+	}
+	return min, max, nil
+}
+
+// tunnelAllowed reports whether target, a host:port, may be tunneled to.
+// Names are compared as given; the SSH host resolves them.
+func tunnelAllowed(targets []tunnelTarget, target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, t := range targets {
+		if port < t.minPort || port > t.maxPort {
+			continue
+		}
+		if t.network != nil && ip != nil && t.network.Contains(ip) {
+			return true
+		}
+		if t.network == nil && ip == nil && strings.EqualFold(t.host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelHandler serves /ws-tunnel?session_id=<id>&target=host:port. It opens a
+// TCP connection from the session's SSH host to target and relays it as
+// binary WebSocket messages. Failures before the upgrade are reported as
+// HTTP errors so command-line clients can show them.
+func tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	if err := maintenance.check(); err != nil {
+		responder.Error(w, r, err, httpapi.Maintenance)
+		return
+	}
+	sess, target, err := resolveTunnel(r)
+	if err != nil {
+		responder.Error(w, r, err, httpapi.BadRequest)
+		return
+	}
+	if err := authorize(r, sess.Host, sess.SSHUser, opTunnel); err != nil {
+		responder.Error(w, r, err, httpapi.Forbidden)
+		return
+	}
+
+	meta := newRequestMeta(r)
+	meta.SessionID = sess.ID
+	meta.Log = meta.Log.With("session_id", sess.ID, "host", sess.Host, "target", target)
+	remote, err := sess.client.Dial("tcp", target)
+	if err != nil {
+		meta.Log.Warn("Failed to open tunnel", "err", err)
+		responder.Error(w, r, httpapi.Errorf(httpapi.ConnectFailed, "Failed to connect to %s: %v", target, err), httpapi.ConnectFailed)
+		return
+	}
+	defer remote.Close()
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		meta.Log.Warn("Failed to upgrade connection", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	t := &tunnel{sess: sess, meta: meta, target: target, ws: conn, remote: remote}
+	if !sess.trackForward(t) {
+		return
+	}
+	defer sess.untrackForward(t)
+	t.run(currentConfig().Forwarding.IdleTimeout)
+}
+
+// resolveTunnel checks that the request may tunnel through its session to
+// the requested target. Sessions opened anonymously take their session_key.
+func resolveTunnel(r *http.Request) (*activeSession, string, error) {
+	query := r.URL.Query()
+	sessionID, target := query.Get("session_id"), query.Get("target")
+	if sessionID == "" || target == "" {
+		return nil, "", httpapi.Errorf(httpapi.MissingParams, "Missing required parameters")
+	}
+	sess, ok := sessions.get(sessionID)
+	if !ok {
+		return nil, "", httpapi.Errorf(httpapi.NotFound, "Session not found or has ended")
+	}
+	if !sess.usableBy(requestIdentity(r), query.Get("session_key")) {
+		return nil, "", httpapi.Errorf(httpapi.Forbidden, "Session belongs to another user")
+	}
+	if sess.Restricted || sess.ReadOnly {
+		return nil, "", httpapi.Errorf(httpapi.Forbidden, "Tunnels are not available in this session")
+	}
+	if !permitsOperation(sess.Operations, opTunnel) {
+		return nil, "", httpapi.Errorf(httpapi.Forbidden, "Session does not permit %s", opTunnel)
+	}
+	if !tunnelAllowed(currentConfig().tunnelTargets, target) {
+		return nil, "", httpapi.Errorf(httpapi.Forbidden, "Tunnel target %s is not allowed", target)
+	}
+	return sess, target, nil
+}
+
+// tunnel relays one forwarded TCP connection
+type tunnel struct {
+	sess   *activeSession
+	meta   requestMeta
+	target string
+	ws     *websocket.Conn
+	remote net.Conn
+
+	bytesIn, bytesOut atomic.Int64
+	closeOnce         sync.Once
+}
+
+// close ends both sides, which unblocks the other direction
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.remote.Close()
+		t.ws.Close()
+	})
+}
+
+func (t *tunnel) run(idleTimeout time.Duration) {
+	started := time.Now()
+	t.meta.Log.Info("Tunnel opened")
+
+	idle := time.AfterFunc(idleTimeout, func() {
+		t.meta.Log.Info("Closing idle tunnel", "idle_timeout", idleTimeout)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout")
+		t.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		t.close()
+	})
+	defer idle.Stop()
+
+	wsCfg := currentConfig().WebSocket
+	out := &wsWriter{conn: t.ws}
+	out.pacer = sshbridge.NewPacer(t.ws, wsCfg.WriteTimeout, wsCfg.SlowWrites, out.cutOffSlow)
+	done := make(chan struct{})
+	go func() {
+		defer recoverSession(&t.meta, t.ws)
+		defer close(done)
+		defer t.close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := t.remote.Read(buf)
+			if n > 0 {
+				idle.Reset(idleTimeout)
+				if werr := out.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					return
+				}
+				t.bytesOut.Add(int64(n))
+				t.sess.bytesOut.Add(int64(n))
+			}
+			if err != nil {
+				// Tell the client the remote side closed
+				if err == io.EOF {
+					msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+					t.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				}
+				return
+			}
+		}
+	}()
+
+	func() {
+		defer recoverSession(&t.meta, t.ws)
+		defer t.close()
+		for {
+			msgType, data, err := t.ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msgType != websocket.BinaryMessage {
+				msg := websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "tunnels carry binary messages only")
+				t.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				return
+			}
+			idle.Reset(idleTimeout)
+			if _, err := t.remote.Write(data); err != nil {
+				return
+			}
+			t.bytesIn.Add(int64(len(data)))
+			t.sess.bytesIn.Add(int64(len(data)))
+		}
+	}()
+	<-done
+
+	duration := time.Since(started)
+	t.meta.Log.Info("Tunnel closed", "duration", duration, "bytes_in", t.bytesIn.Load(), "bytes_out", t.bytesOut.Load())
+	audit.Emit(AuditEvent{
+		Event:      auditTunnel,
+		Outcome:    outcomeSuccess,
+		ClientIP:   t.meta.ClientIP,
+		User:       t.meta.User,
+		Host:       t.sess.Host,
+		SSHUser:    t.sess.SSHUser,
+		Target:     t.target,
+		DurationMS: duration.Milliseconds(),
+		BytesIn:    t.bytesIn.Load(),
+		BytesOut:   t.bytesOut.Load(),
+	})
+}
+
+// proxiedConn relays a TCP connection through a session: "socks" for the
+// SOCKS proxy, where local is the client, and "remote_forward", where local
+// is the exposed service
+type proxiedConn struct {
+	operation string
+	sess      *activeSession
+	meta      requestMeta
+	target    string
+	local     net.Conn
+	remote    net.Conn
+
+	bytesIn, bytesOut atomic.Int64
+	closeOnce         sync.Once
+}
+
+func (p *proxiedConn) close() {
+	p.closeOnce.Do(func() {
+		p.remote.Close()
+		p.local.Close()
+	})
+}
+
+func (p *proxiedConn) run(idleTimeout time.Duration) {
+	started := time.Now()
+	p.meta.Log.Info("Forwarded connection opened", "operation", p.operation)
+
+	idle := time.AfterFunc(idleTimeout, func() {
+		p.meta.Log.Info("Closing idle forwarded connection", "operation", p.operation, "idle_timeout", idleTimeout)
+		p.close()
+	})
+	defer idle.Stop()
+
+	relay := func(dst, src net.Conn, count, sessCount *atomic.Int64) {
+		defer p.close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				idle.Reset(idleTimeout)
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return
+				}
+				count.Add(int64(n))
+				sessCount.Add(int64(n))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer recoverForward(p.meta)
+		defer close(done)
+		relay(p.local, p.remote, &p.bytesOut, p.sess.bytesOut)
+	}()
+	func() {
+		defer recoverForward(p.meta)
+		relay(p.remote, p.local, &p.bytesIn, p.sess.bytesIn)
+	}()
+	<-done
+
+	duration := time.Since(started)
+	p.meta.Log.Info("Forwarded connection closed", "operation", p.operation, "duration", duration, "bytes_in", p.bytesIn.Load(), "bytes_out", p.bytesOut.Load())
+	audit.Emit(AuditEvent{
+		Event:      auditTunnel,
+		Outcome:    outcomeSuccess,
+		ClientIP:   p.meta.ClientIP,
+		User:       p.meta.User,
+		Host:       p.sess.Host,
+		SSHUser:    p.sess.SSHUser,
+		Target:     p.target,
+		Operation:  p.operation,
+		DurationMS: duration.Milliseconds(),
+		BytesIn:    p.bytesIn.Load(),
+		BytesOut:   p.bytesOut.Load(),
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshtest"
+)
+
+// startEchoServer listens on localhost and echoes what each connection
+// sends
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialTunnel opens /ws-tunnel with query, returning the connection or the
+// status it was refused with
+func dialTunnel(t *testing.T, srv string, query url.Values, header http.Header) (*websocket.Conn, int) {
+	t.Helper()
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Origin", srv)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv, "http")+"/ws-tunnel?"+query.Encode(), header)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, http.StatusSwitchingProtocols
+}
+
+func TestTunnelNeedsSessionOwner(t *testing.T) {
+	useConfig(t, `
+server:
+  trusted_proxies: [127.0.0.1]
+authz:
+  user_header: X-User
+forwarding:
+  allowed_targets: ["127.0.0.1:*"]
+`)
+	echo := startEchoServer(t)
+	server := sshtest.Start(t, nil)
+	srv := startTestGateway(t)
+	login := url.Values{"host": {server.Addr}, "user": {sshtest.User}, "password": {sshtest.Password}}
+	anonymous := openTestPage(t, srv, login)
+	alice := openTestPageWith(t, srv, login, http.Header{"X-User": {"alice"}})
+
+	tests := []struct {
+		name   string
+		page   *testPage
+		key    string // session_key sent
+		user   string // named by the proxy
+		status int
+	}{
+		{"anonymous session without its key", anonymous, "", "", http.StatusForbidden},
+		{"anonymous session with another key", anonymous, alice.session.SessionKey, "", http.StatusForbidden},
+		{"anonymous session with its key", anonymous, anonymous.session.SessionKey, "", http.StatusSwitchingProtocols},
+		{"anonymous session by a named user", anonymous, "", "alice", http.StatusForbidden},
+		{"user's session by another user", alice, "", "bob", http.StatusForbidden},
+		{"user's session anonymously", alice, "", "", http.StatusForbidden},
+		{"user's session with its key but not its user", alice, alice.session.SessionKey, "bob", http.StatusForbidden},
+		{"user's session by its user", alice, "", "alice", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"session_id": {tt.page.session.SessionID}, "target": {echo}}
+			if tt.key != "" {
+				query.Set("session_key", tt.key)
+			}
+			header := http.Header{}
+			if tt.user != "" {
+				header.Set("X-User", tt.user)
+			}
+			conn, status := dialTunnel(t, srv.URL, query, header)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			if conn == nil {
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ping" {
+				t.Errorf("tunnel echoed %q, %v", data, err)
+			}
+		})
+	}
+
+	// The session is named by session_id
+	query := url.Values{"session": {anonymous.session.SessionID}, "session_key": {anonymous.session.SessionKey}, "target": {echo}}
+	if _, status := dialTunnel(t, srv.URL, query, nil); status != http.StatusBadRequest {
+		t.Errorf("?session= got %d, want 400", status)
+	}
+}
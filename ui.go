@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fernet/fernet-go"
+
+	"gossh/internal/httpapi"
+)
+
+// UIConfig brands the pages. Values are plain text or URLs; the templates
+// escape them and none is ever inserted as raw HTML.
+type UIConfig struct {
+	Title       string `yaml:"title"`
+	LogoURL     string `yaml:"logo_url"`     // http(s) URL, or a path such as /static/logo.png
+	LoginBanner string `yaml:"login_banner"` // shown above the login form
+	Theme       string `yaml:"theme"`        // terminal colours: dark (default), light or solarized
+	// RequireConsent shows ConsentText before the terminal connects; the
+	// user must accept it, and acceptance is audited
+	RequireConsent bool   `yaml:"require_consent"`
+	ConsentText    string `yaml:"consent_text"`
+}
+
+const defaultConsentText = "This system is for authorized use only. Activity may be monitored and recorded. By continuing you consent to these terms."
+
+func (c *UIConfig) applyDefaults() {
+	if c.Title == "" {
+		c.Title = "SSH Terminal"
+	}
+	if c.Theme == "" {
+		c.Theme = "dark"
+	}
+	if c.ConsentText == "" {
+		c.ConsentText = defaultConsentText
+	}
+}
+
+func validateUIConfig(cfg UIConfig) []string {
+	var problems []string
+	switch cfg.Theme {
+	case "dark", "light", "solarized":
+	default:
+		problems = append(problems, fmt.Sprintf("ui.theme %q is not one of dark, light or solarized", cfg.Theme))
+	}
+	if cfg.LogoURL != "" && logoOrigin(cfg.LogoURL) == "" && !strings.HasPrefix(cfg.LogoURL, "/") {
+		problems = append(problems, "ui.logo_url must be an http(s) URL or a path starting with /")
+	}
+	return problems
+}
+
+// logoOrigin returns the origin of an absolute logo URL, which the
+// Content-Security-Policy must allow images from
+func logoOrigin(logoURL string) string {
+	u, err := url.Parse(logoURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// consentCookieName records that the usage notice was accepted
+const consentCookieName = "gossh_consent"
+
+// consentMaxAge is how long an acceptance lasts before the notice is shown again
+const consentMaxAge = 12 * time.Hour
+
+// consentDigest identifies the notice text, so changing it asks everyone again
+func consentDigest(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hasConsent reports whether r carries an acceptance of the current notice.
+// The cookie is sealed with the Fernet key so it can't be forged.
+func hasConsent(r *http.Request) bool {
+	cookie, err := r.Cookie(consentCookieName)
+	if err != nil {
+		return false
+	}
+	cfg := currentConfig()
+	keys, err := fernet.DecodeKeys(cfg.Security.FernetKey)
+	if err != nil {
+		return false
+	}
+	digest := fernet.VerifyAndDecrypt([]byte(cookie.Value), consentMaxAge, keys)
+	return string(digest) == consentDigest(cfg.UI.ConsentText)
+}
+
+// consentHandler records that the user accepted the usage notice
+func consentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		responder.ErrorCode(w, r, httpapi.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	cfg := currentConfig()
+	keys, err := fernet.DecodeKeys(cfg.Security.FernetKey)
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.Internal, "Server misconfigured")
+		return
+	}
+	digest := consentDigest(cfg.UI.ConsentText)
+	token, err := fernet.EncryptAndSign([]byte(digest), keys[0])
+	if err != nil {
+		responder.ErrorCode(w, r, httpapi.Internal, "Failed to record consent")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     consentCookieName,
+		Value:    string(token),
+		Path:     basePath(r) + "/",
+		MaxAge:   int(consentMaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   tlsEnabled(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	audit.Emit(AuditEvent{
+		Event:    auditConsent,
+		Outcome:  outcomeSuccess,
+		ClientIP: clientIP(r),
+		Target:   digest,
+	})
+	requestLogger(r).Info("Usage notice accepted", "notice", digest)
+	w.WriteHeader(http.StatusNoContent)
+}
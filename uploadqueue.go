@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"gossh/internal/sshbridge"
+	"gossh/internal/transfer"
+)
+
+// uploadProgressInterval is how often a running upload reports progress
+const uploadProgressInterval = 1 << 20
+
+// maxUploadIDLength bounds the IDs pages may give their uploads
+const maxUploadIDLength = 64
+
+// errUploadCancelled ends an upload the page cancelled or whose session ended
+var errUploadCancelled = errors.New("upload cancelled")
+
+// uploadQueue runs the uploads a terminal page sends over its WebSocket a
+// few at a time. Each upload opens an SSH session on the terminal's
+// connection, and sshd refuses more than MaxSessions (10 by default) at once.
+type uploadQueue struct {
+	out        *wsWriter
+	sshConn    *ssh.Client
+	meta       requestMeta
+	host, user string
+	subjects   []quotaSubject
+	limit      int
+	maxQueued  int
+
+	mu      sync.Mutex
+	pending []*queuedUpload
+	running map[string]*queuedUpload
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// queuedUpload is an upload waiting in or taken from the queue
+type queuedUpload struct {
+	id       string
+	filename string
+	data     []byte
+	extract  *transfer.Archive
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newUploadQueue(out *wsWriter, sshConn *ssh.Client, meta requestMeta, host, user string, subjects []quotaSubject) *uploadQueue {
+	cfg := currentConfig().Transfers
+	return &uploadQueue{
+		out:       out,
+		sshConn:   sshConn,
+		meta:      meta,
+		host:      host,
+		user:      user,
+		subjects:  subjects,
+		limit:     cfg.Concurrency,
+		maxQueued: cfg.MaxQueued,
+		running:   make(map[string]*queuedUpload),
+	}
+}
+
+// add accepts an upload message from the page, starting it right away when
+// fewer than the limit are running
+func (q *uploadQueue) add(msg sshbridge.ClientMessage) {
+	refuse := func(format string, args ...interface{}) {
+		sendUploadResponse(q.out, sshbridge.UploadResponse{
+			Type:  "upload_response",
+			ID:    msg.ID,
+			Error: fmt.Sprintf(format, args...),
+		})
+	}
+	if len(msg.ID) > maxUploadIDLength {
+		refuse("Upload IDs are limited to %d characters", maxUploadIDLength)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		refuse("Failed to decode file data: %v", err)
+		return
+	}
+	var extract *transfer.Archive
+	if msg.Extract {
+		if extract, err = transfer.NewArchive(msg.Filename, msg.ExtractTo, bytes.NewReader(data), int64(len(data)), currentConfig().Transfers.limits()); err != nil {
+			refuse("%v", err)
+			return
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	id := msg.ID
+	if id == "" {
+		if id, err = randomID(8); err != nil {
+			refuse("Failed to queue upload: %v", err)
+			return
+		}
+	} else if q.find(id) != nil {
+		refuse("Upload %s is already queued", id)
+		return
+	}
+	if len(q.pending) >= q.maxQueued {
+		refuse("Too many uploads are queued; wait for some to finish")
+		return
+	}
+	if err := q.out.mem.holdTransfer(len(data)); err != nil {
+		refuse("Upload refused: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &queuedUpload{id: id, filename: msg.Filename, data: data, extract: extract, ctx: ctx, cancel: cancel}
+	q.pending = append(q.pending, u)
+	q.status(u, sshbridge.UploadStatusMessage{Event: "queued", Position: len(q.pending) - 1 + len(q.running)})
+	q.next()
+}
+
+// cancel drops a queued upload, or stops a running one at its next write
+func (q *uploadQueue) cancel(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u, ok := q.running[id]; ok {
+		u.cancel()
+		return
+	}
+	for i, u := range q.pending {
+		if u.id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			u.cancel()
+			q.out.mem.releaseTransfer(len(u.data))
+			q.finish(u, sshbridge.UploadResponse{Error: "Upload cancelled"})
+			return
+		}
+	}
+	q.meta.Log.Debug("Cancel for an unknown upload", "upload_id", id)
+}
+
+// close aborts the queue when the session ends: queued uploads are dropped
+// and running ones stopped, and close returns once they have
+func (q *uploadQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	for _, u := range q.pending {
+		u.cancel()
+		q.out.mem.releaseTransfer(len(u.data))
+	}
+	q.pending = nil
+	for _, u := range q.running {
+		u.cancel()
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// find returns the queued or running upload with id. q.mu must be held.
+func (q *uploadQueue) find(id string) *queuedUpload {
+	if u, ok := q.running[id]; ok {
+		return u
+	}
+	for _, u := range q.pending {
+		if u.id == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// next starts queued uploads while there is room. q.mu must be held.
+func (q *uploadQueue) next() {
+	for len(q.pending) > 0 && len(q.running) < q.limit {
+		u := q.pending[0]
+		q.pending = q.pending[1:]
+		q.running[u.id] = u
+		q.wg.Add(1)
+		go q.run(u)
+	}
+}
+
+func (q *uploadQueue) run(u *queuedUpload) {
+	defer q.wg.Done()
+	defer recoverSession(&q.meta, q.out.conn)
+	q.status(u, sshbridge.UploadStatusMessage{Event: "started"})
+	response := q.handleFileUpload(u)
+	q.out.mem.releaseTransfer(len(u.data))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, u.id)
+	u.cancel()
+	if !q.closed {
+		q.finish(u, response)
+		q.next()
+	}
+}
+
+// finish reports the end of an upload
+func (q *uploadQueue) finish(u *queuedUpload, response sshbridge.UploadResponse) {
+	q.status(u, sshbridge.UploadStatusMessage{
+		Event:   "finished",
+		Success: response.Success,
+		Path:    response.Path,
+		Error:   response.Error,
+		Warning: response.Warning,
+	})
+	response.Type = "upload_response"
+	response.ID = u.id
+	sendUploadResponse(q.out, response)
+}
+
+func (q *uploadQueue) status(u *queuedUpload, msg sshbridge.UploadStatusMessage) {
+	msg.Type = "upload_status"
+	msg.ID = u.id
+	msg.Filename = u.filename
+	msg.Size = int64(len(u.data))
+	q.out.WriteJSON(msg)
+}
+
+// reader returns the upload's data, reporting progress as it is read and
+// failing once the upload is cancelled
+func (q *uploadQueue) reader(u *queuedUpload) io.Reader {
+	return &uploadReader{q: q, u: u, data: u.data}
+}
+
+type uploadReader struct {
+	q        *uploadQueue
+	u        *queuedUpload
+	data     []byte
+	read     int64
+	reported int64
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	if r.u.ctx.Err() != nil {
+		return 0, errUploadCancelled
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	r.read += int64(n)
+	if r.read-r.reported >= uploadProgressInterval {
+		r.reported = r.read
+		r.q.status(r.u, sshbridge.UploadStatusMessage{Event: "progress", Bytes: r.read})
+	}
+	return n, nil
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Credential source prefixes: a KV secret path, or a role of the SSH
+// secrets engine that signs an ephemeral key for each connection
+const (
+	vaultSourcePrefix    = "vault:"
+	vaultSSHSourcePrefix = "vault-ssh:"
+)
+
+// VaultConfig configures HashiCorp Vault as a source of SSH credentials.
+// Unset fields fall back to the standard VAULT_* environment variables.
+type VaultConfig struct {
+	Address      string           `yaml:"address"`       // VAULT_ADDR
+	Token        string           `yaml:"token"`         // VAULT_TOKEN
+	RoleID       string           `yaml:"role_id"`       // VAULT_ROLE_ID, AppRole login
+	SecretID     string           `yaml:"secret_id"`     // VAULT_SECRET_ID
+	AppRoleMount string           `yaml:"approle_mount"` // default "approle"
+	Namespace    string           `yaml:"namespace"`     // VAULT_NAMESPACE
+	CACert       string           `yaml:"ca_cert"`       // VAULT_CACERT
+	CacheTTL     time.Duration    `yaml:"cache_ttl"`     // default 30s, negative disables caching
+	AllowedPaths []VaultPathGrant `yaml:"allowed_paths"` // empty allows none
+
+	// SSH secrets engine used by vault-ssh: sources
+	SSHMount string        `yaml:"ssh_mount"` // default "ssh"
+	SSHRole  string        `yaml:"ssh_role"`  // role used when the source names none
+	SSHTTL   time.Duration `yaml:"ssh_ttl"`   // certificate lifetime, default 5m
+}
+
+// VaultPathGrant lets the users and groups listed name the secrets
+// matching Path, for connections to the hosts matching Hosts
+type VaultPathGrant struct {
+	Path   string   `yaml:"path"`  // glob pattern of secret paths
+	Hosts  []string `yaml:"hosts"` // shell patterns of hostnames
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+}
+
+func (g *VaultPathGrant) validate() error {
+	if g.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if _, err := path.Match(g.Path, ""); err != nil {
+		return fmt.Errorf("invalid path pattern %q", g.Path)
+	}
+	if len(g.Hosts) == 0 {
+		return fmt.Errorf("%s: hosts are required", g.Path)
+	}
+	for _, pattern := range g.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: invalid host pattern %q", g.Path, pattern)
+		}
+	}
+	if len(g.Users) == 0 && len(g.Groups) == 0 {
+		return fmt.Errorf("%s: users or groups are required", g.Path)
+	}
+	return nil
+}
+
+// matchesHost reports whether the grant is for host
+func (g *VaultPathGrant) matchesHost(host string) bool {
+	host = hostname(host)
+	for _, pattern := range g.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// usableBy reports whether id may name the grant's secrets
+func (g *VaultPathGrant) usableBy(id Identity) bool {
+	if id.User == "" {
+		return false
+	}
+	if slices.Contains(g.Users, id.User) {
+		return true
+	}
+	for _, group := range identityGroups(&currentConfig().Authz, id) {
+		if slices.Contains(g.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDefaults fills unset fields from the environment and built-in defaults
+func (c *VaultConfig) applyDefaults() {
+	envDefault := func(v *string, name string) {
+		if *v == "" {
+			*v = os.Getenv(name)
+		}
+	}
+	envDefault(&c.Address, "VAULT_ADDR")
+	envDefault(&c.Token, "VAULT_TOKEN")
+	envDefault(&c.RoleID, "VAULT_ROLE_ID")
+	envDefault(&c.SecretID, "VAULT_SECRET_ID")
+	envDefault(&c.Namespace, "VAULT_NAMESPACE")
+	envDefault(&c.CACert, "VAULT_CACERT")
+	if c.AppRoleMount == "" {
+		c.AppRoleMount = "approle"
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = 30 * time.Second
+	}
+	if c.SSHMount == "" {
+		c.SSHMount = "ssh"
+	}
+	if c.SSHTTL == 0 {
+		c.SSHTTL = 5 * time.Minute
+	}
+}
+
+// vaultCredentials are SSH credentials read from a Vault secret
+type vaultCredentials struct {
+	Host       string // optional, pins the secret to one host
+	User       string
+	Password   string
+	PrivateKey []byte
+
+	// Signer authenticates with an ephemeral certificate signed by Vault
+	Signer    ssh.Signer
+	ephemeral ed25519.PrivateKey
+}
+
+// Wipe zeroes the ephemeral private key once the connection is closed
+func (c *vaultCredentials) Wipe() {
+	for i := range c.ephemeral {
+		c.ephemeral[i] = 0
+	}
+}
+
+type vaultCacheEntry struct {
+	creds   *vaultCredentials
+	expires time.Time
+}
+
+// vaultClient reads secrets over Vault's HTTP API. It logs in with AppRole
+// when no static token is configured and caches secrets for CacheTTL.
+type vaultClient struct {
+	cfg  VaultConfig
+	http *http.Client
+
+	mu           sync.Mutex
+	token        string
+	tokenExpires time.Time // zero for static tokens
+	cache        map[string]vaultCacheEntry
+}
+
+// newVaultClient returns nil unless a Vault address has been configured
+func newVaultClient(cfg VaultConfig) (*vaultClient, error) {
+	cfg.applyDefaults()
+	if cfg.Address == "" {
+		return nil, nil
+	}
+	if cfg.Token == "" && (cfg.RoleID == "" || cfg.SecretID == "") {
+		return nil, fmt.Errorf("vault requires either token or role_id and secret_id")
+	}
+	for i := range cfg.AllowedPaths {
+		if err := cfg.AllowedPaths[i].validate(); err != nil {
+			return nil, fmt.Errorf("vault.allowed_paths #%d: %v", i+1, err)
+		}
+	}
+	if len(cfg.AllowedPaths) == 0 {
+		slog.Warn("vault.allowed_paths is empty, so connections can't name vault: credential sources")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault CA file %s", cfg.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &vaultClient{
+		cfg:   cfg,
+		http:  &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		token: cfg.Token,
+		cache: make(map[string]vaultCacheEntry),
+	}, nil
+}
+
+// vaultError describes a failed Vault request without exposing secrets
+type vaultError struct {
+	Status int
+	Path   string
+	Msg    string
+}
+
+func (e *vaultError) Error() string {
+	switch {
+	case e.Status == http.StatusForbidden:
+		return fmt.Sprintf("vault denied access to %s: check the policy attached to gossh's vault token", e.Path)
+	case e.Status == http.StatusNotFound:
+		return fmt.Sprintf("no secret found at vault path %s", e.Path)
+	case e.Status == http.StatusServiceUnavailable:
+		return "vault is unavailable (sealed or in standby)"
+	case e.Msg != "":
+		return fmt.Sprintf("vault request for %s failed (HTTP %d): %s", e.Path, e.Status, e.Msg)
+	}
+	return fmt.Sprintf("vault request for %s failed (HTTP %d)", e.Path, e.Status)
+}
+
+// do sends a request to the Vault API and decodes the JSON response into out
+func (v *vaultClient) do(method, apiPath, token string, body, out interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(v.cfg.Address, "/")+"/v1/"+strings.TrimLeft(apiPath, "/"), &reqBody)
+	if err != nil {
+		return fmt.Errorf("invalid vault address: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach vault at %s: %v", v.cfg.Address, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return &vaultError{Status: resp.StatusCode, Path: apiPath, Msg: strings.Join(errResp.Errors, "; ")}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from vault for %s: %v", apiPath, err)
+	}
+	return nil
+}
+
+// currentToken returns a valid Vault token, logging in with AppRole when
+// the previous login is missing or close to expiring
+func (v *vaultClient) currentToken() (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.cfg.Token != "" {
+		return v.token, nil
+	}
+	if v.token != "" && time.Now().Before(v.tokenExpires) {
+		return v.token, nil
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	loginPath := "auth/" + strings.Trim(v.cfg.AppRoleMount, "/") + "/login"
+	err := v.do("POST", loginPath, "", map[string]string{
+		"role_id":   v.cfg.RoleID,
+		"secret_id": v.cfg.SecretID,
+	}, &resp)
+	if err != nil {
+		return "", fmt.Errorf("vault AppRole login failed: %v", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault AppRole login returned no token")
+	}
+
+	// Log in again once 80% of the lease has passed
+	lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+	if lease <= 0 {
+		lease = time.Hour
+	}
+	v.token = resp.Auth.ClientToken
+	v.tokenExpires = time.Now().Add(lease * 4 / 5)
+	return v.token, nil
+}
+
+// forgetToken drops an AppRole token that Vault rejected
+func (v *vaultClient) forgetToken() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.cfg.Token == "" {
+		v.token = ""
+	}
+}
+
+// request performs an authenticated request, logging in again once if an
+// AppRole token turns out to have been revoked or expired
+func (v *vaultClient) request(method, apiPath string, body, out interface{}) error {
+	token, err := v.currentToken()
+	if err != nil {
+		return err
+	}
+	err = v.do(method, apiPath, token, body, out)
+	if verr, ok := err.(*vaultError); ok && verr.Status == http.StatusForbidden && v.cfg.Token == "" {
+		v.forgetToken()
+		if token, err = v.currentToken(); err != nil {
+			return err
+		}
+		err = v.do(method, apiPath, token, body, out)
+	}
+	return err
+}
+
+// permits checks that vault.allowed_paths lets id name secretPath for a
+// connection to host. A nil id stands for the server's own configuration,
+// which only the hosts are checked for.
+func (v *vaultClient) permits(secretPath, host string, id *Identity) error {
+	secretPath = strings.Trim(secretPath, "/")
+	if len(v.cfg.AllowedPaths) == 0 {
+		return fmt.Errorf("vault path %s is not permitted: vault.allowed_paths lists no paths", secretPath)
+	}
+	pathAllowed, hostAllowed := false, false
+	for i := range v.cfg.AllowedPaths {
+		g := &v.cfg.AllowedPaths[i]
+		if ok, _ := path.Match(g.Path, secretPath); !ok {
+			continue
+		}
+		pathAllowed = true
+		if !g.matchesHost(host) {
+			continue
+		}
+		hostAllowed = true
+		if id == nil || g.usableBy(*id) {
+			return nil
+		}
+	}
+	switch {
+	case !pathAllowed:
+		return fmt.Errorf("vault path %s is not permitted by vault.allowed_paths", secretPath)
+	case !hostAllowed:
+		return fmt.Errorf("vault path %s is not permitted for host %s", secretPath, hostname(host))
+	}
+	return fmt.Errorf("vault path %s may not be used by %s", secretPath, id)
+}
+
+// sshCredentials reads the SSH credentials stored at secretPath. Both KV
+// version 1 and version 2 secrets are understood.
+func (v *vaultClient) sshCredentials(secretPath string) (*vaultCredentials, error) {
+	secretPath = strings.Trim(secretPath, "/")
+	if secretPath == "" {
+		return nil, fmt.Errorf("vault credential source has no path")
+	}
+
+	v.mu.Lock()
+	entry, ok := v.cache[secretPath]
+	v.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.creds, nil
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.request("GET", secretPath, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, isV2 := data["metadata"]; isV2 {
+			data = inner
+		}
+	}
+	field := func(names ...string) string {
+		for _, name := range names {
+			if s, ok := data[name].(string); ok && s != "" {
+				return s
+			}
+		}
+		return ""
+	}
+
+	creds := &vaultCredentials{
+		Host:     field("host", "hostname"),
+		User:     field("user", "username"),
+		Password: field("password"),
+	}
+	if key := field("private_key", "privatekey"); key != "" {
+		creds.PrivateKey = []byte(key)
+	}
+	if creds.Password == "" && len(creds.PrivateKey) == 0 {
+		return nil, fmt.Errorf("vault secret at %s has neither a password nor a private_key field", secretPath)
+	}
+
+	if v.cfg.CacheTTL > 0 {
+		v.mu.Lock()
+		v.cache[secretPath] = vaultCacheEntry{creds: creds, expires: time.Now().Add(v.cfg.CacheTTL)}
+		v.mu.Unlock()
+	}
+	return creds, nil
+}
+
+// signSSHCertificate generates an ephemeral ed25519 keypair and has the
+// Vault SSH CA sign its public key for principal. The private key never
+// leaves memory and is wiped by Wipe.
+func (v *vaultClient) signSSHCertificate(role, principal string) (*vaultCredentials, error) {
+	if role == "" {
+		role = v.cfg.SSHRole
+	}
+	if role == "" {
+		return nil, fmt.Errorf("no vault SSH role given and vault.ssh_role is not set")
+	}
+	if principal == "" {
+		return nil, fmt.Errorf("a user is required to request a vault SSH certificate")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate SSH keypair: %v", err)
+	}
+	creds := &vaultCredentials{User: principal, ephemeral: priv}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		creds.Wipe()
+		return nil, err
+	}
+
+	var resp struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	mount := strings.Trim(v.cfg.SSHMount, "/")
+	err = v.request("POST", mount+"/sign/"+role, map[string]string{
+		"public_key":       string(ssh.MarshalAuthorizedKey(sshPub)),
+		"valid_principals": principal,
+		"cert_type":        "user",
+		"ttl":              fmt.Sprintf("%ds", int(v.cfg.SSHTTL.Seconds())),
+	}, &resp)
+	if err != nil {
+		creds.Wipe()
+		return nil, sshSignError(err, mount, role, principal)
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data.SignedKey))
+	if err != nil {
+		creds.Wipe()
+		return nil, fmt.Errorf("vault returned an invalid SSH certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		creds.Wipe()
+		return nil, fmt.Errorf("vault returned a public key instead of an SSH certificate")
+	}
+	if !containsString(cert.ValidPrincipals, principal) {
+		creds.Wipe()
+		return nil, fmt.Errorf("vault SSH role %q signed a certificate for %v, not %q: check the role's allowed_users and default_user", role, cert.ValidPrincipals, principal)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		creds.Wipe()
+		return nil, err
+	}
+	if creds.Signer, err = ssh.NewCertSigner(cert, signer); err != nil {
+		creds.Wipe()
+		return nil, fmt.Errorf("vault SSH certificate does not match the generated key: %v", err)
+	}
+	return creds, nil
+}
+
+// sshSignError turns a failed sign request into an actionable message
+func sshSignError(err error, mount, role, principal string) error {
+	verr, ok := err.(*vaultError)
+	if !ok {
+		return err
+	}
+	msg := strings.ToLower(verr.Msg)
+	switch {
+	case strings.Contains(msg, "principal") || strings.Contains(msg, "not in allowed list") || strings.Contains(msg, "allowed_users"):
+		return fmt.Errorf("vault SSH role %q does not allow principal %q: add it to the role's allowed_users", role, principal)
+	case strings.Contains(msg, "unknown role") || verr.Status == http.StatusNotFound:
+		return fmt.Errorf("vault SSH role %q not found under mount %q", role, mount)
+	case strings.Contains(msg, "ttl"):
+		return fmt.Errorf("vault SSH role %q rejected the certificate TTL: lower vault.ssh_ttl or raise the role's max_ttl (%s)", role, verr.Msg)
+	}
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCredentialSource resolves a credential source reference for a
+// connection to host as user. "vault:secret/data/ssh/db01" reads a stored
+// secret, if vault.allowed_paths lets id use it on host; a secret that
+// names a host may only be used for that host.
+// "vault-ssh:<role>" signs an ephemeral certificate for user, which callers
+// must Wipe when the connection ends. "stored:<id>" decrypts a credential
+// held by gossh, if id may use it on host.
+func lookupCredentialSource(meta requestMeta, id Identity, source, host, user string) (*vaultCredentials, error) {
+	if cid, ok := strings.CutPrefix(source, storedSourcePrefix); ok {
+		return storedCredentials.lookup(meta, id, cid, host, user)
+	}
+	if kid, ok := strings.CutPrefix(source, managedKeySourcePrefix); ok {
+		return managedKeys.lookup(meta, id, kid, host, user)
+	}
+	vault := currentConfig().vault
+	if vault == nil && (strings.HasPrefix(source, vaultSourcePrefix) || strings.HasPrefix(source, vaultSSHSourcePrefix)) {
+		return nil, fmt.Errorf("vault credential source is not configured on this server")
+	}
+
+	if role, ok := strings.CutPrefix(source, vaultSSHSourcePrefix); ok {
+		creds, err := vault.signSSHCertificate(role, user)
+		if err != nil {
+			slog.Error("Vault SSH certificate request failed", "host", hostname(host), "ssh_user", user, "err", err)
+			return nil, err
+		}
+		return creds, nil
+	}
+
+	secretPath, ok := strings.CutPrefix(source, vaultSourcePrefix)
+	if !ok {
+		return nil, fmt.Errorf("unsupported credential source (expected %s<path>, %s<role>, %s<id> or %s<id>)", vaultSourcePrefix, vaultSSHSourcePrefix, storedSourcePrefix, managedKeySourcePrefix)
+	}
+
+	return vault.secretFor(meta, &id, secretPath, host)
+}
+
+// secretFor reads the secret at secretPath for a connection to host, if
+// id may use it there (see permits)
+func (v *vaultClient) secretFor(meta requestMeta, id *Identity, secretPath, host string) (*vaultCredentials, error) {
+	if err := v.permits(secretPath, host, id); err != nil {
+		meta.Log.Warn("Refused vault credential source", "path", strings.Trim(secretPath, "/"), "host", hostname(host), "err", err)
+		return nil, err
+	}
+	creds, err := v.sshCredentials(secretPath)
+	if err != nil {
+		slog.Error("Vault credential lookup failed", "path", secretPath, "err", err)
+		return nil, err
+	}
+	if creds.Host != "" && hostname(creds.Host) != hostname(host) {
+		return nil, fmt.Errorf("vault secret at %s is not valid for host %s", strings.Trim(secretPath, "/"), hostname(host))
+	}
+	return creds, nil
+}
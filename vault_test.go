@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gossh/internal/sshtest"
+)
+
+// testVault is a fake Vault and how many secrets were read from it
+type testVault struct {
+	*httptest.Server
+	reads atomic.Int32
+}
+
+// fakeVault serves KV v2 secrets by path
+func fakeVault(t *testing.T, secrets map[string]map[string]string) *testVault {
+	t.Helper()
+	v := &testVault{}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.reads.Add(1)
+		data, ok := secrets[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": data, "metadata": map[string]interface{}{}},
+		})
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func TestVaultSourceBinding(t *testing.T) {
+	srv := fakeVault(t, map[string]map[string]string{
+		"secret/data/ssh/db01":   {"user": "dba", "password": "db-pass"},
+		"secret/data/ssh/pinned": {"host": "db02.internal", "password": "pinned-pass"},
+		"secret/data/other/x":    {"password": "other-pass"},
+	})
+	useConfig(t, `
+authz:
+  groups:
+    team-db: [alice]
+vault:
+  address: `+srv.URL+`
+  token: test-token
+  cache_ttl: -1s
+  allowed_paths:
+    - path: "secret/data/ssh/*"
+      hosts: ["db*.internal"]
+      users: [bob]
+      groups: [team-db]
+`)
+	meta := requestMeta{Log: discardLogger}
+	alice := Identity{User: "alice"}
+	tests := []struct {
+		name     string
+		id       Identity
+		source   string
+		host     string
+		password string // empty when refused
+	}{
+		{"group member", alice, "vault:secret/data/ssh/db01", "db01.internal", "db-pass"},
+		{"listed user", Identity{User: "bob"}, "vault:secret/data/ssh/db01", "db01.internal:22", "db-pass"},
+		{"group from the header", Identity{User: "carol", Groups: []string{"team-db"}}, "vault:secret/data/ssh/db01", "db01.internal", "db-pass"},
+		{"anonymous", Identity{}, "vault:secret/data/ssh/db01", "db01.internal", ""},
+		{"user named anonymous", Identity{User: "anonymous"}, "vault:secret/data/ssh/db01", "db01.internal", ""},
+		{"other user", Identity{User: "mallory"}, "vault:secret/data/ssh/db01", "db01.internal", ""},
+		{"host outside the entry", alice, "vault:secret/data/ssh/db01", "evil.example.com", ""},
+		{"path not listed", alice, "vault:secret/data/other/x", "db01.internal", ""},
+		{"secret pinned to its host", alice, "vault:secret/data/ssh/pinned", "db02.internal", "pinned-pass"},
+		{"secret pinned to another host", alice, "vault:secret/data/ssh/pinned", "db01.internal", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := lookupCredentialSource(meta, tt.id, tt.source, tt.host, "")
+			if tt.password == "" {
+				if err == nil {
+					t.Fatalf("lookupCredentialSource(%s, %s) for %v succeeded, want refused", tt.source, tt.host, tt.id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupCredentialSource(%s, %s) for %v: %v", tt.source, tt.host, tt.id, err)
+			}
+			if creds.Password != tt.password {
+				t.Errorf("password = %q, want %q", creds.Password, tt.password)
+			}
+		})
+	}
+}
+
+func TestVaultConfiguredSecretChecksHosts(t *testing.T) {
+	srv := fakeVault(t, map[string]map[string]string{
+		"secret/data/ssh/sudo": {"password": "sudo-pass"},
+	})
+	cfg := useConfig(t, `
+vault:
+  address: `+srv.URL+`
+  token: test-token
+  allowed_paths:
+    - path: "secret/data/ssh/*"
+      hosts: ["prod*.internal"]
+      groups: [oncall]
+`)
+	meta := requestMeta{Log: discardLogger}
+	if _, err := cfg.vault.secretFor(meta, nil, "secret/data/ssh/sudo", "prod1.internal"); err != nil {
+		t.Errorf("configured secret on a listed host: %v", err)
+	}
+	if _, err := cfg.vault.secretFor(meta, nil, "secret/data/ssh/sudo", "attacker.example.com"); err == nil {
+		t.Error("configured secret was read for a host outside its entry")
+	}
+}
+
+func TestVaultAllowedPathsValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		grant VaultPathGrant
+	}{
+		{"no path", VaultPathGrant{Hosts: []string{"*"}, Users: []string{"alice"}}},
+		{"bad path pattern", VaultPathGrant{Path: "secret/[", Hosts: []string{"*"}, Users: []string{"alice"}}},
+		{"no hosts", VaultPathGrant{Path: "secret/*", Users: []string{"alice"}}},
+		{"bad host pattern", VaultPathGrant{Path: "secret/*", Hosts: []string{"db["}, Users: []string{"alice"}}},
+		{"no users or groups", VaultPathGrant{Path: "secret/*", Hosts: []string{"*"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := VaultConfig{Address: "https://vault.example.com", Token: "t", AllowedPaths: []VaultPathGrant{tt.grant}}
+			if _, err := newVaultClient(cfg); err == nil {
+				t.Errorf("newVaultClient accepted %+v", tt.grant)
+			}
+		})
+	}
+}
+
+// TestVaultPathsDeniedUnlessListed names vault: sources in /api/exec
+// requests through the gateway harness
+func TestVaultPathsDeniedUnlessListed(t *testing.T) {
+	server := sshtest.Start(t, nil)
+	vault := fakeVault(t, map[string]map[string]string{
+		"secret/data/ssh/db01": {"password": sshtest.Password},
+		"secret/data/other/x":  {"password": sshtest.Password},
+	})
+	tests := []struct {
+		name         string
+		allowedPaths string
+		source       string
+		ran          bool
+	}{
+		{"no allowed paths", "", "vault:secret/data/ssh/db01", false},
+		{"path not listed", `
+    - path: "secret/data/ssh/*"
+      hosts: ["127.0.0.1"]
+      users: [ci]`, "vault:secret/data/other/x", false},
+		{"listed for another user", `
+    - path: "secret/data/ssh/*"
+      hosts: ["127.0.0.1"]
+      users: [someone-else]`, "vault:secret/data/ssh/db01", false},
+		{"listed", `
+    - path: "secret/data/ssh/*"
+      hosts: ["127.0.0.1"]
+      users: [ci]`, "vault:secret/data/ssh/db01", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, `
+vault:
+  address: `+vault.URL+`
+  token: test-token
+  cache_ttl: -1s
+  allowed_paths:`+tt.allowedPaths+`
+`)
+			srv := startTestGateway(t)
+			key, _, err := mintAPIKey("ci", []string{scopeExec}, 0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vault.reads.Store(0)
+			body := execRequest{
+				targetRequest: targetRequest{Host: server.Addr, User: sshtest.User, Credentials: tt.source},
+				Command:       "echo ran",
+			}
+			status, data := callAPI(t, apiRequest(t, srv, "POST", "/api/exec", key, body))
+			if !tt.ran {
+				if status == http.StatusOK {
+					t.Fatalf("the command ran: %s", data)
+				}
+				if n := vault.reads.Load(); n != 0 {
+					t.Errorf("Vault was asked for %d secrets", n)
+				}
+				return
+			}
+			var result execResponse
+			if err := json.Unmarshal(data, &result); status != http.StatusOK || err != nil || strings.TrimSpace(result.Stdout) != "ran" {
+				t.Errorf("status %d: %s", status, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"gossh/internal/httpapi"
+)
+
+// Set at build time, see build.sh:
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=3a80bce -X main.buildDate=2026-10-14T12:00:00Z"
+//
+// Builds without them fall back to the module and VCS information the Go
+// toolchain records.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildInfo describes the running binary
+type buildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+}
+
+var build = readBuildInfo()
+
+func readBuildInfo() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		dirty := false
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+				if len(b.Commit) > 12 {
+					b.Commit = b.Commit[:12]
+				}
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			case s.Key == "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit == "" && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	return b
+}
+
+// String is the one-line form printed by "gossh version"
+func (b buildInfo) String() string {
+	s := "gossh " + b.Version
+	if b.Commit != "" {
+		s += " (" + b.Commit + ")"
+	}
+	if b.BuildDate != "" {
+		s += " built " + b.BuildDate
+	}
+	return fmt.Sprintf("%s, %s", s, b.GoVersion)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	httpapi.JSON(w, map[string]interface{}{
+		"version":    build.Version,
+		"commit":     build.Commit,
+		"build_date": build.BuildDate,
+		"go_version": build.GoVersion,
+	})
+}
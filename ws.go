@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshbridge"
+)
+
+// WebSocketConfig tunes the WebSocket connections terminals run over
+type WebSocketConfig struct {
+	// ReadBuffer and WriteBuffer are the I/O buffer sizes in bytes. Larger
+	// write buffers send bulk terminal output in fewer frames.
+	ReadBuffer  int `yaml:"read_buffer"`
+	WriteBuffer int `yaml:"write_buffer"`
+	// HandshakeTimeout bounds writing the upgrade response
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	// MaxMessageSize closes connections sending larger messages; 0 is no
+	// limit. Terminal uploads arrive as one base64 message.
+	MaxMessageSize int64 `yaml:"max_message_size"`
+	// WriteTimeout is how long a write to the browser may take before it
+	// counts as slow
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// SlowWrites disconnects a client after this many slow writes in a
+	// row, or one write stalled that many times WriteTimeout
+	SlowWrites int `yaml:"slow_writes"`
+	// Subprotocols the server offers after the terminal protocol versions,
+	// in order of preference
+	Subprotocols []string `yaml:"subprotocols"`
+}
+
+func (c *WebSocketConfig) applyDefaults() {
+	if c.ReadBuffer <= 0 {
+		c.ReadBuffer = 1024
+	}
+	if c.WriteBuffer <= 0 {
+		c.WriteBuffer = 1024
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = 10 * time.Second
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 30 * time.Second
+	}
+	if c.SlowWrites <= 0 {
+		c.SlowWrites = 3
+	}
+}
+
+func validateWebSocketConfig(cfg WebSocketConfig) error {
+	if cfg.MaxMessageSize < 0 || (cfg.MaxMessageSize > 0 && cfg.MaxMessageSize < 1024) {
+		return fmt.Errorf("ws.max_message_size must be 0 (no limit) or at least 1024 bytes")
+	}
+	if cfg.WriteTimeout < 0 {
+		return fmt.Errorf("ws.write_timeout must not be negative")
+	}
+	return nil
+}
+
+// slowClientDisconnects counts connections cut off for not keeping up with
+// their output, for /metrics
+var slowClientDisconnects atomic.Int64
+
+// newUpgrader builds the upgrader for cfg. loadConfig makes one per
+// configuration, so its buffer pools are shared by every connection.
+func newUpgrader(cfg WebSocketConfig) *websocket.Upgrader {
+	return sshbridge.NewUpgrader(cfg.ReadBuffer, cfg.WriteBuffer, cfg.HandshakeTimeout, cfg.Subprotocols, checkWebSocketOrigin)
+}
+
+// checkWebSocketOrigin refuses upgrades that pages on other sites start in
+// a visitor's browser. Browsers always send Origin; the page's own has the
+// host it was served from. server.cors doesn't loosen this: browsers send
+// cookies with upgrades whatever allow_credentials says. Clients that
+// aren't browsers send none.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	requestLogger(r).Warn("Refused WebSocket from another origin", "origin", origin)
+	return false
+}
+
+// upgradeWebSocket upgrades r with the current ws settings and applies the
+// read limit to the new connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	cfg := currentConfig()
+	conn, err := cfg.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.WebSocket.MaxMessageSize > 0 {
+		conn.SetReadLimit(cfg.WebSocket.MaxMessageSize)
+	}
+	return conn, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshbridge"
+)
+
+// fakeMessage is a WebSocket message sent to or by a fakeConn
+type fakeMessage struct {
+	messageType int
+	data        []byte
+}
+
+// fakeConn is a sshbridge.Conn for tests. What the page sends is queued with
+// send; what the server writes is kept for output and messages.
+type fakeConn struct {
+	in        chan fakeMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	written  []fakeMessage
+	deadline time.Time
+	// stall, when set, holds writes until the write deadline passes or the
+	// connection is closed, as a client that stopped reading would
+	stall bool
+	// delay, when set, is how long each write takes
+	delay time.Duration
+	// controls are the control messages written
+	controls []fakeMessage
+	// notify, when set, is sent each message as it is written
+	notify chan fakeMessage
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{in: make(chan fakeMessage, 64), closed: make(chan struct{})}
+}
+
+// send queues a message from the page
+func (c *fakeConn) send(messageType int, data []byte) {
+	c.in <- fakeMessage{messageType, data}
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.in:
+		return m.messageType, m.data, nil
+	case <-c.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *fakeConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	stall, deadline, delay := c.stall, c.deadline, c.delay
+	c.mu.Unlock()
+	time.Sleep(delay)
+	if stall {
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timeout = time.After(time.Until(deadline))
+		}
+		select {
+		case <-timeout:
+			return timeoutError{}
+		case <-c.closed:
+			return websocket.ErrCloseSent
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return websocket.ErrCloseSent
+	default:
+	}
+	m := fakeMessage{messageType, append([]byte(nil), data...)}
+	c.written = append(c.written, m)
+	if c.notify != nil {
+		c.notify <- m
+	}
+	return nil
+}
+
+func (c *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.mu.Lock()
+	c.controls = append(c.controls, fakeMessage{messageType, append([]byte(nil), data...)})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// messages returns what has been written so far
+func (c *fakeConn) messages() []fakeMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeMessage(nil), c.written...)
+}
+
+// output returns the binary frames written so far, joined
+func (c *fakeConn) output() string {
+	var out []byte
+	for _, m := range c.messages() {
+		if m.messageType == websocket.BinaryMessage {
+			out = append(out, m.data...)
+		}
+	}
+	return string(out)
+}
+
+// timeoutError is the net.Error of a write past its deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWebSocketOrigin(t *testing.T) {
+	// CORS origins, even "*", may not open WebSockets
+	useConfig(t, "server:\n  cors:\n    allowed_origins: [https://portal.example.com, \"*\"]\n")
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://gossh.example.com", true},
+		{"http://GOSSH.example.com", true},
+		{"https://portal.example.com", false},
+		{"https://evil.example.net", false},
+		{"https://gossh.example.com.evil.example.net", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://gossh.example.com/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkWebSocketOrigin(r); got != tt.want {
+			t.Errorf("origin %q: allowed %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+// startWebSocketServer serves upgradeWebSocket and hands each connection to
+// the returned channel
+func startWebSocketServer(t testing.TB) (url string, conns <-chan *websocket.Conn) {
+	t.Helper()
+	ch := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err == nil {
+			ch <- conn
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), ch
+}
+
+func TestUpgradeRefusesOtherOrigins(t *testing.T) {
+	useConfig(t, "")
+	url, conns := startWebSocketServer(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.net"}})
+	if err == nil {
+		t.Fatal("upgrade from another origin succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %v, want 403", resp)
+	}
+
+	client, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http" + strings.TrimPrefix(url, "ws")}})
+	if err != nil {
+		t.Fatalf("upgrade from the page's own origin: %v", err)
+	}
+	client.Close()
+	(<-conns).Close()
+}
+
+// waitCutOff waits for a client to be disconnected as too slow
+func waitCutOff(t *testing.T, conn *fakeConn) {
+	t.Helper()
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Fatal("slow client still connected")
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	want := websocket.FormatCloseMessage(sshbridge.CloseClientTooSlow, "client too slow")
+	if len(conn.controls) != 1 || !bytes.Equal(conn.controls[0].data, want) {
+		t.Errorf("control messages %q, want a close with %d", conn.controls, sshbridge.CloseClientTooSlow)
+	}
+}
+
+func TestStalledClientIsDisconnected(t *testing.T) {
+	useConfig(t, "ws:\n  write_timeout: 20ms\n  slow_writes: 3\n")
+	conn := newFakeConn()
+	conn.stall = true
+	w := newTerminalWriter(conn)
+	before := slowClientDisconnects.Load()
+
+	start := time.Now()
+	if err := w.WriteMessage(websocket.BinaryMessage, []byte("make\r\n")); err == nil {
+		t.Error("write to a stalled client succeeded")
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("stalled write gave up after %v, before write_timeout times slow_writes", elapsed)
+	}
+	waitCutOff(t, conn)
+
+	// Later writes fail without counting the client again
+	if err := w.WriteMessage(websocket.BinaryMessage, []byte("more\r\n")); err == nil {
+		t.Error("write after the disconnect succeeded")
+	}
+	if got := slowClientDisconnects.Load() - before; got != 1 {
+		t.Errorf("counted %d slow disconnects, want 1", got)
+	}
+}
+
+func TestSlowWritesInARow(t *testing.T) {
+	useConfig(t, "ws:\n  write_timeout: 20ms\n  slow_writes: 3\n")
+	conn := newFakeConn()
+	w := newTerminalWriter(conn)
+	before := slowClientDisconnects.Load()
+	write := func(delay time.Duration) {
+		t.Helper()
+		conn.mu.Lock()
+		conn.delay = delay
+		conn.mu.Unlock()
+		if err := w.WriteMessage(websocket.BinaryMessage, []byte("line\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A write in time resets the count
+	write(40 * time.Millisecond)
+	write(40 * time.Millisecond)
+	write(0)
+	write(40 * time.Millisecond)
+	write(40 * time.Millisecond)
+	select {
+	case <-conn.closed:
+		t.Fatal("disconnected before slow_writes slow writes in a row")
+	default:
+	}
+	if got := slowClientDisconnects.Load() - before; got != 0 {
+		t.Errorf("counted %d slow disconnects, want none yet", got)
+	}
+
+	write(40 * time.Millisecond)
+	waitCutOff(t, conn)
+	if got := slowClientDisconnects.Load() - before; got != 1 {
+		t.Errorf("counted %d slow disconnects, want 1", got)
+	}
+}
+
+// BenchmarkBulkOutput measures terminal output throughput to a browser, such
+// as cat of a large file, for several ws.write_buffer sizes
+func BenchmarkBulkOutput(b *testing.B) {
+	chunk := bytes.Repeat([]byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcde\n"), 512)
+	for _, size := range []int{1024, 4096, 32768} {
+		b.Run(fmt.Sprintf("write_buffer=%d", size), func(b *testing.B) {
+			useConfig(b, fmt.Sprintf("ws:\n  write_buffer: %d\n", size))
+			url, conns := startWebSocketServer(b)
+			client, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			server := <-conns
+			defer server.Close()
+			go func() {
+				for {
+					_, r, err := client.NextReader()
+					if err != nil {
+						return
+					}
+					io.Copy(io.Discard, r)
+				}
+			}()
+
+			w := newTerminalWriter(server)
+			b.SetBytes(int64(len(chunk)))
+			for b.Loop() {
+				if err := w.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+)
+
+// ZMODEM framing, as in Chuck Forsberg's zmodem.h. Frames are headers, some
+// of which are followed by data subpackets.
+const (
+	zPad   = '*'
+	zDLE   = 0x18 // also CAN, which cancels a transfer when repeated
+	zBin   = 'A'  // binary header with CRC-16
+	zHex   = 'B'  // hex header with CRC-16
+	zBin32 = 'C'  // binary header with CRC-32
+
+	// Frame types
+	zRQInit  = 0
+	zRInit   = 1
+	zSInit   = 2
+	zAck     = 3
+	zFile    = 4
+	zSkip    = 5
+	zNak     = 6
+	zAbort   = 7
+	zFin     = 8
+	zRPos    = 9
+	zData    = 10
+	zEOF     = 11
+	zFErr    = 12
+	zCRC     = 13
+	zCommand = 18
+
+	// Ends of data subpackets
+	zCRCE = 'h' // end of frame
+	zCRCG = 'i' // more data follows
+	zCRCQ = 'j' // more data follows, ZACK wanted
+	zCRCW = 'k' // end of frame, ZACK wanted
+
+	// ZRINIT capabilities, in ZF0
+	zCanFDX  = 0x01
+	zCanOVIO = 0x02
+	zCanFC32 = 0x20
+)
+
+// zmodemMaxSubpacket bounds a received data subpacket; lrzsz sends at most
+// 8 KiB with -8
+const zmodemMaxSubpacket = 8 << 10
+
+// zframe is a ZMODEM header: a type and four bytes that are either flags
+// (ZF3 to ZF0) or a little-endian file position
+type zframe struct {
+	typ byte
+	arg [4]byte
+}
+
+func posFrame(typ byte, pos int64) zframe {
+	f := zframe{typ: typ}
+	binary.LittleEndian.PutUint32(f.arg[:], uint32(pos))
+	return f
+}
+
+func (f zframe) pos() int64 {
+	return int64(binary.LittleEndian.Uint32(f.arg[:]))
+}
+
+// flags returns ZF0, where ZRINIT carries the receiver's capabilities
+func (f zframe) flags() byte {
+	return f.arg[3]
+}
+
+// carriesData tells whether data subpackets follow a header of the type
+func (f zframe) carriesData() bool {
+	switch f.typ {
+	case zSInit, zFile, zData, zCommand:
+		return true
+	}
+	return false
+}
+
+// crc16 is ZMODEM's CRC-16, the one of XMODEM
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// appendZDLE escapes p for a binary frame. Every control character is
+// escaped, not only ZMODEM's own, as the bytes go through the remote PTY.
+func appendZDLE(dst, p []byte) []byte {
+	for _, b := range p {
+		switch {
+		case b == 0x7f:
+			dst = append(dst, zDLE, 'l')
+		case b == 0xff:
+			dst = append(dst, zDLE, 'm')
+		case b&0x60 == 0:
+			dst = append(dst, zDLE, b^0x40)
+		default:
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
+
+// unZDLE decodes the byte following a ZDLE
+func unZDLE(b byte) (byte, bool) {
+	switch {
+	case b == 'l':
+		return 0x7f, true
+	case b == 'm':
+		return 0xff, true
+	case b&0x60 == 0x40:
+		return b ^ 0x40, true
+	}
+	return 0, false
+}
+
+// hexHeader encodes f as a hex header, which receivers send
+func hexHeader(f zframe) []byte {
+	raw := append([]byte{f.typ}, f.arg[:]...)
+	crc := crc16(raw)
+	raw = append(raw, byte(crc>>8), byte(crc))
+	b := hex.AppendEncode([]byte{zPad, zPad, zDLE, zHex}, raw)
+	b = append(b, '\r', 0x8a)
+	// XON restarts a sender stopped by flow control, except after the
+	// frames that end a conversation
+	if f.typ != zFin && f.typ != zAck {
+		b = append(b, 0x11)
+	}
+	return b
+}
+
+// binHeader encodes f as a binary header, with a CRC-32 when the receiver
+// can check one
+func binHeader(f zframe, crc32ok bool) []byte {
+	raw := append([]byte{f.typ}, f.arg[:]...)
+	b := []byte{zPad, zDLE, zBin}
+	if crc32ok {
+		b[2] = zBin32
+		raw = binary.LittleEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+	} else {
+		crc := crc16(raw)
+		raw = append(raw, byte(crc>>8), byte(crc))
+	}
+	return appendZDLE(b, raw)
+}
+
+// subpacket encodes a data subpacket ending with end
+func subpacket(p []byte, end byte, crc32ok bool) []byte {
+	b := appendZDLE(make([]byte, 0, len(p)+len(p)/8+16), p)
+	b = append(b, zDLE, end)
+	if crc32ok {
+		crc := crc32.Update(crc32.ChecksumIEEE(p), crc32.IEEETable, []byte{end})
+		return appendZDLE(b, binary.LittleEndian.AppendUint32(nil, crc))
+	}
+	crc := crc16(append(append([]byte(nil), p...), end))
+	return appendZDLE(b, []byte{byte(crc >> 8), byte(crc)})
+}
+
+// Kinds of zevent
+const (
+	zevHeader = iota + 1
+	zevData
+	// zevGarbled is a frame with a bad CRC or encoding, after which the
+	// decoder looks for the next header
+	zevGarbled
+	// zevCancel is the other side cancelling with a run of CANs
+	zevCancel
+)
+
+type zevent struct {
+	kind  int
+	frame zframe
+	data  []byte
+	end   byte // of a data subpacket
+}
+
+// States of a zdecoder
+const (
+	zdScan = iota
+	zdPad
+	zdEncoding
+	zdHexHeader
+	zdBinHeader
+	zdData
+	zdDataCRC
+)
+
+// zdecoder reads ZMODEM frames a byte at a time, so the terminal can take
+// the output back the moment a transfer ends
+type zdecoder struct {
+	state int
+	enc   byte
+	esc   bool // the previous byte was a ZDLE
+	cans  int  // consecutive CANs
+	// crc32 is set for the data subpackets of a CRC-32 header
+	crc32 bool
+	buf   []byte
+	crc   []byte
+	end   byte
+}
+
+// next takes one byte and returns the event it completes, if any
+func (d *zdecoder) next(b byte) (zevent, bool) {
+	if b == zDLE {
+		d.cans++
+		// Five CANs can't occur in a frame, where a ZDLE is always
+		// followed by an escaped byte
+		if d.cans >= 5 {
+			d.cans = 0
+			d.reset()
+			return zevent{kind: zevCancel}, true
+		}
+	} else {
+		d.cans = 0
+	}
+
+	switch d.state {
+	case zdScan:
+		if b == zPad {
+			d.state = zdPad
+		}
+	case zdPad:
+		switch b {
+		case zPad:
+		case zDLE:
+			d.state = zdEncoding
+		default:
+			d.state = zdScan
+		}
+	case zdEncoding:
+		d.buf = d.buf[:0]
+		d.esc = false
+		switch b {
+		case zHex:
+			d.enc, d.state = b, zdHexHeader
+		case zBin, zBin32:
+			d.enc, d.state = b, zdBinHeader
+		default:
+			d.state = zdScan
+		}
+
+	case zdHexHeader:
+		// Two hex digits a byte: type, four argument bytes and a CRC-16
+		d.buf = append(d.buf, b)
+		if !isHexDigit(b) {
+			return d.garbled()
+		}
+		if len(d.buf) < 14 {
+			return zevent{}, false
+		}
+		raw, err := hex.DecodeString(string(d.buf))
+		if err != nil || crc16(raw[:5]) != binary.BigEndian.Uint16(raw[5:]) {
+			return d.garbled()
+		}
+		d.state = zdScan
+		return zevent{kind: zevHeader, frame: zframe{typ: raw[0], arg: [4]byte(raw[1:5])}}, true
+
+	case zdBinHeader:
+		b, ok, err := d.unescape(b)
+		if err {
+			return d.garbled()
+		}
+		if !ok {
+			return zevent{}, false
+		}
+		d.buf = append(d.buf, b)
+		want := 7
+		if d.enc == zBin32 {
+			want = 9
+		}
+		if len(d.buf) < want {
+			return zevent{}, false
+		}
+		if !checkCRC(d.buf[:5], d.buf[5:]) {
+			return d.garbled()
+		}
+		f := zframe{typ: d.buf[0], arg: [4]byte(d.buf[1:5])}
+		d.state = zdScan
+		if f.carriesData() {
+			d.state, d.crc32, d.buf = zdData, d.enc == zBin32, d.buf[:0]
+		}
+		return zevent{kind: zevHeader, frame: f}, true
+
+	case zdData:
+		if d.esc && b == zDLE {
+			// Two in a row never occur in a frame: the start of a cancel
+			return zevent{}, false
+		}
+		if d.esc {
+			d.esc = false
+			switch b {
+			case zCRCE, zCRCG, zCRCQ, zCRCW:
+				d.end, d.state, d.crc = b, zdDataCRC, d.crc[:0]
+				return zevent{}, false
+			}
+			c, ok := unZDLE(b)
+			if !ok {
+				return d.garbled()
+			}
+			b = c
+		} else if b == zDLE {
+			d.esc = true
+			return zevent{}, false
+		} else if isFlowControl(b) {
+			return zevent{}, false
+		}
+		if len(d.buf) >= zmodemMaxSubpacket {
+			return d.garbled()
+		}
+		d.buf = append(d.buf, b)
+
+	case zdDataCRC:
+		b, ok, err := d.unescape(b)
+		if err {
+			return d.garbled()
+		}
+		if !ok {
+			return zevent{}, false
+		}
+		d.crc = append(d.crc, b)
+		want := 2
+		if d.crc32 {
+			want = 4
+		}
+		if len(d.crc) < want {
+			return zevent{}, false
+		}
+		if !checkCRC(append(d.buf, d.end), d.crc) {
+			return d.garbled()
+		}
+		ev := zevent{kind: zevData, data: append([]byte(nil), d.buf...), end: d.end}
+		d.buf = d.buf[:0]
+		d.state = zdData
+		if d.end == zCRCE || d.end == zCRCW {
+			d.state = zdScan
+		}
+		return ev, true
+	}
+	return zevent{}, false
+}
+
+// unescape decodes the bytes of a binary header or CRC. ok is false while
+// b is a ZDLE or flow control.
+func (d *zdecoder) unescape(b byte) (c byte, ok, garbled bool) {
+	if d.esc && b == zDLE {
+		return 0, false, false
+	}
+	if d.esc {
+		d.esc = false
+		c, ok = unZDLE(b)
+		return c, ok, !ok
+	}
+	if b == zDLE {
+		d.esc = true
+		return 0, false, false
+	}
+	if isFlowControl(b) {
+		return 0, false, false
+	}
+	return b, true, false
+}
+
+func (d *zdecoder) garbled() (zevent, bool) {
+	d.reset()
+	return zevent{kind: zevGarbled}, true
+}
+
+// reset looks for the next header
+func (d *zdecoder) reset() {
+	d.state, d.esc, d.buf = zdScan, false, d.buf[:0]
+}
+
+// checkCRC checks the CRC-16 (big-endian) or CRC-32 (little-endian) of p
+func checkCRC(p, crc []byte) bool {
+	if len(crc) == 4 {
+		return crc32.ChecksumIEEE(p) == binary.LittleEndian.Uint32(crc)
+	}
+	return crc16(p) == binary.BigEndian.Uint16(crc)
+}
+
+func isHexDigit(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
+// isFlowControl reports XON and XOFF, which are dropped wherever they appear
+// unescaped in a binary frame
+func isFlowControl(b byte) bool {
+	return b&0x7f == 0x11 || b&0x7f == 0x13
+}
+
+// zmodemStart is how a ZMODEM conversation begins on the wire, a hex header
+// of type ZRQINIT (sz) or ZRINIT (rz): **<ZDLE>B00 or **<ZDLE>B01
+const zmodemStart = "**\x18B0"
+
+// hexHeaderEnd holds the bytes that may end a hex header: a line end,
+// with the high bit set or not, and XON
+const hexHeaderEnd = "\r\n\x8a\x11"
+
+// zmodemAbort cancels a transfer, as lrzsz does: CANs, then backspaces to
+// erase them should they end up on a terminal
+var zmodemAbort = append(bytes.Repeat([]byte{zDLE}, 8), bytes.Repeat([]byte{'\b'}, 8)...)
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gossh/internal/sshbridge"
+)
+
+// zmodemStep is a turn of a ZMODEM transcript: output of rz or sz on the
+// host, and the frames the server must answer with
+type zmodemStep struct {
+	host string
+	want []byte
+}
+
+// syncBuffer is the host's stdin, which the writer of an upload shares
+// with the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns what was written since the last take
+func (b *syncBuffer) take() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := bytes.Clone(b.buf.Bytes())
+	b.buf.Reset()
+	return p
+}
+
+// zmodemSession is a bridge with the page and the host's stdin it talks to
+type zmodemSession struct {
+	bridge *zmodemBridge
+	page   *fakeConn
+	stdin  *syncBuffer
+	term   []byte
+}
+
+func newZModemSession(t *testing.T, opts sessionOptions) *zmodemSession {
+	t.Helper()
+	useConfig(t, "session:\n  zmodem: true\n")
+	s := &zmodemSession{page: newFakeConn(), stdin: &syncBuffer{}}
+	s.bridge = newZModemBridge(requestMeta{Log: discardLogger}, "web01", "deploy", newTerminalWriter(s.page), s.page, s.stdin, opts)
+	if s.bridge == nil {
+		t.Fatal("ZMODEM is disabled")
+	}
+	t.Cleanup(s.bridge.cancel)
+	return s
+}
+
+// play feeds the host's side of the transcript to the bridge, checking
+// the server's answers
+func (s *zmodemSession) play(t *testing.T, steps []zmodemStep) {
+	t.Helper()
+	for i, step := range steps {
+		s.term = append(s.term, s.bridge.output([]byte(step.host))...)
+		s.expect(t, i, step.want)
+	}
+}
+
+// expect checks the frames sent to the host since the last check
+func (s *zmodemSession) expect(t *testing.T, step int, want []byte) {
+	t.Helper()
+	if got := s.stdin.take(); !bytes.Equal(got, want) {
+		t.Fatalf("step %d: the server sent\n  %q\nwant\n  %q", step, got, want)
+	}
+}
+
+// await reads what is sent to the host until it ends with suffix
+func (s *zmodemSession) await(t *testing.T, suffix []byte) []byte {
+	t.Helper()
+	var got []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.HasSuffix(got, suffix) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the server sent %q, want it to end with %q", got, suffix)
+		}
+		got = append(got, s.stdin.take()...)
+		time.Sleep(5 * time.Millisecond)
+	}
+	return got
+}
+
+// events returns the transfer messages sent to the page
+func (s *zmodemSession) events(t *testing.T) []sshbridge.TransferMessage {
+	t.Helper()
+	var msgs []sshbridge.TransferMessage
+	for _, m := range s.page.messages() {
+		if m.messageType != websocket.TextMessage {
+			continue
+		}
+		var msg sshbridge.TransferMessage
+		if err := json.Unmarshal(m.data, &msg); err != nil || msg.Type != protocolZModem {
+			t.Fatalf("unexpected message to the page: %s", m.data)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func zh(f zframe) string {
+	return string(hexHeader(f))
+}
+
+func zb(f zframe) string {
+	return string(binHeader(f, true))
+}
+
+func zsub(p []byte, end byte) string {
+	return string(subpacket(p, end, true))
+}
+
+// zfileFrame is the ZFILE of lrzsz's sz for name, which is size bytes
+func zfileFrame(name string, size int) string {
+	info := name + "\x00" + strconv.Itoa(size) + " 14641774404 100644 0 1 " + strconv.Itoa(size) + "\x00"
+	return zb(zframe{typ: zFile}) + zsub([]byte(info), zCRCW)
+}
+
+// zmodemFile has bytes that must be escaped in a subpacket: ZDLE, XON,
+// XOFF and their high-bit twins
+func zmodemFile(n int) []byte {
+	file := make([]byte, n)
+	for i := range file {
+		file[i] = []byte{'a', zDLE, 0x11, 0x13, 0x91, 0x93, 0x8d, '\r', 0}[i%9]
+	}
+	return file
+}
+
+// szStart is what lrzsz's sz prints: rz for an older terminal to run,
+// then a ZRQINIT
+var szStart = "rz\r" + zh(zframe{typ: zRQInit})
+
+// lrzszCancel is how lrzsz cancels: ten CANs, then backspaces over them
+var lrzszCancel = strings.Repeat("\x18", 10) + strings.Repeat("\b", 10)
+
+func TestZModemDownload(t *testing.T) {
+	s := newZModemSession(t, sessionOptions{})
+	file := zmodemFile(2500)
+	rinit := s.bridge.rinit()
+
+	s.play(t, []zmodemStep{
+		{"$ sz report.bin\r\n" + szStart, rinit},
+		{zfileFrame("/var/tmp/report.bin", len(file)), hexHeader(posFrame(zRPos, 0))},
+		{zb(posFrame(zData, 0)) + zsub(file[:1024], zCRCG), nil},
+		// A ZCRCQ subpacket wants a ZACK; the rest of it arrives later
+		{zsub(file[1024:2048], zCRCQ)[:300], nil},
+		{zsub(file[1024:2048], zCRCQ)[300:], hexHeader(posFrame(zAck, 2048))},
+		{zsub(file[2048:], zCRCE), nil},
+		{zb(posFrame(zEOF, int64(len(file)))), rinit},
+		{zh(zframe{typ: zFin}), hexHeader(zframe{typ: zFin})},
+		{"OO$ ", nil},
+	})
+
+	if got, want := string(s.term), "$ sz report.bin\r\nrz\r$ "; got != want {
+		t.Errorf("terminal shows %q, want %q", got, want)
+	}
+	msgs := s.events(t)
+	if got, want := eventNames(msgs), "download,data,download_end,end"; got != want {
+		t.Fatalf("page got %s, want %s", got, want)
+	}
+	if msgs[0].Filename != "report.bin" || msgs[0].Size != int64(len(file)) {
+		t.Errorf("download announced as %+v", msgs[0])
+	}
+	data, _ := base64.StdEncoding.DecodeString(msgs[1].Data)
+	sha := sha256.Sum256(file)
+	if !bytes.Equal(data, file) || msgs[2].SHA256 != hex.EncodeToString(sha[:]) || msgs[2].Size != int64(len(file)) {
+		t.Errorf("page got %d bytes and %+v, want %d bytes", len(data), msgs[2], len(file))
+	}
+	if s.bridge.busy() {
+		t.Error("the bridge still holds the terminal")
+	}
+}
+
+func TestZModemUpload(t *testing.T) {
+	s := newZModemSession(t, sessionOptions{})
+	file := zmodemFile(2500)
+	rinit := zh(zframe{typ: zRInit, arg: [4]byte{0, 0, 0, zCanFDX | zCanOVIO | zCanFC32}})
+
+	s.play(t, []zmodemStep{{"$ rz\r\nrz waiting to receive." + rinit, nil}})
+	if got := eventNames(s.events(t)); got != "upload_request" {
+		t.Fatalf("page got %s, want upload_request", got)
+	}
+	if !s.bridge.busy() {
+		t.Fatal("the terminal isn't held while the user picks a file")
+	}
+	s.bridge.uploadChosen(sshbridge.ClientMessage{Type: "zmodem_upload", Filename: "C:\\Users\\alice\\data.bin", Data: base64.StdEncoding.EncodeToString(file)})
+	zfile := s.stdin.take()
+	if !bytes.HasPrefix(zfile, binHeader(zframe{typ: zFile}, true)) || !bytes.Contains(zfile, []byte("data.bin\x18@2500 ")) {
+		t.Fatalf("the server offered %q", zfile)
+	}
+
+	// rz resumes a partial file
+	s.play(t, []zmodemStep{{zh(posFrame(zRPos, 1000)), nil}})
+	want := binHeader(posFrame(zData, 1000), true)
+	want = append(want, subpacket(file[1000:2024], zCRCG, true)...)
+	want = append(want, subpacket(file[2024:], zCRCE, true)...)
+	want = append(want, binHeader(posFrame(zEOF, 2500), true)...)
+	if got := s.await(t, want); !bytes.Equal(got, want) {
+		t.Fatalf("the server sent\n  %q\nwant\n  %q", got, want)
+	}
+
+	s.play(t, []zmodemStep{
+		{rinit, hexHeader(zframe{typ: zFin})},
+		{zh(zframe{typ: zFin}), []byte("OO")},
+		{"$ ", nil},
+	})
+	if got, want := string(s.term), "$ rz\r\nrz waiting to receive.$ "; got != want {
+		t.Errorf("terminal shows %q, want %q", got, want)
+	}
+	msgs := s.events(t)
+	if got, want := eventNames(msgs), "upload_request,progress,upload_end,end"; got != want {
+		t.Fatalf("page got %s, want %s", got, want)
+	}
+	sha := sha256.Sum256(file)
+	if end := msgs[2]; end.Filename != "data.bin" || end.Size != 2500 || end.SHA256 != hex.EncodeToString(sha[:]) {
+		t.Errorf("upload ended with %+v", end)
+	}
+}
+
+func TestZModemCRCErrors(t *testing.T) {
+	s := newZModemSession(t, sessionOptions{})
+	file := bytes.Repeat([]byte("0123456789abcdef"), 160)
+	bad := []byte(zsub(file[1024:2048], zCRCG))
+	bad[100] ^= 1
+
+	s.play(t, []zmodemStep{
+		{szStart, s.bridge.rinit()},
+		{zfileFrame("log.txt", len(file)), hexHeader(posFrame(zRPos, 0))},
+		{zb(posFrame(zData, 0)) + zsub(file[:1024], zCRCG), nil},
+		// A subpacket with a bad CRC asks for the data again from where
+		// it broke off
+		{string(bad), hexHeader(posFrame(zRPos, 1024))},
+		// What sz had in flight meanwhile is dropped
+		{zsub(file[2048:], zCRCE) + zb(posFrame(zEOF, int64(len(file)))), nil},
+		{zb(posFrame(zData, 1024)) + zsub(file[1024:], zCRCE), nil},
+		{zb(posFrame(zEOF, int64(len(file)))), s.bridge.rinit()},
+	})
+	msgs := s.events(t)
+	if got, want := eventNames(msgs), "download,data,download_end"; got != want {
+		t.Fatalf("page got %s, want %s", got, want)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(msgs[1].Data); !bytes.Equal(data, file) {
+		t.Errorf("page got %q, want %q", data, file)
+	}
+
+	// A frame with a bad CRC before the file is named is answered with a
+	// ZNAK
+	header := []byte(zb(zframe{typ: zFile}))
+	header[len(header)-1] ^= 1
+	s.play(t, []zmodemStep{{string(header), hexHeader(zframe{typ: zNak})}})
+
+	// The transfer ends once too many frames are bad, the subpacket above
+	// included
+	s.play(t, []zmodemStep{{strings.Repeat(string(header), zmodemMaxErrors-2), bytes.Repeat(hexHeader(zframe{typ: zNak}), zmodemMaxErrors-2)}})
+	if !s.bridge.busy() {
+		t.Fatalf("transfer ended after %d errors", zmodemMaxErrors)
+	}
+	s.play(t, []zmodemStep{{string(header), zmodemAbort}, {"\r\n$ ", nil}})
+	msgs = s.events(t)
+	if got := msgs[len(msgs)-2]; got.Event != "error" || got.Error != "too many errors" {
+		t.Errorf("page got %+v, want a too many errors error", got)
+	}
+	if s.bridge.busy() || !strings.HasSuffix(string(s.term), "\r\n$ ") {
+		t.Errorf("terminal not given back: %q", s.term)
+	}
+}
+
+func TestZModemCancelled(t *testing.T) {
+	start := []zmodemStep{
+		{"$ sz big.iso\r\n" + szStart, (*zmodemBridge).rinit(nil)},
+		{zfileFrame("big.iso", 1<<20), hexHeader(posFrame(zRPos, 0))},
+		{zb(posFrame(zData, 0)) + zsub(make([]byte, 1024), zCRCG), nil},
+	}
+
+	t.Run("on the host", func(t *testing.T) {
+		s := newZModemSession(t, sessionOptions{})
+		s.play(t, start)
+
+		// The host isn't told to stop again, and its cancel sequence
+		// doesn't reach the terminal
+		s.play(t, []zmodemStep{
+			{"\x18\x18\x18\x18\x18", nil},
+			{lrzszCancel[5:] + "\r\n$ ", nil},
+		})
+		if got, want := string(s.term), "$ sz big.iso\r\nrz\r\r\n$ "; got != want {
+			t.Errorf("terminal shows %q, want %q", got, want)
+		}
+		msgs := s.events(t)
+		if got, want := eventNames(msgs), "download,error,end"; got != want {
+			t.Fatalf("page got %s, want %s", got, want)
+		}
+		if msgs[1].Filename != "big.iso" || msgs[1].Error != "cancelled on the host" {
+			t.Errorf("page got %+v", msgs[1])
+		}
+		if s.bridge.busy() {
+			t.Error("a cancelled transfer holds the terminal")
+		}
+	})
+
+	t.Run("in the page", func(t *testing.T) {
+		s := newZModemSession(t, sessionOptions{})
+		s.play(t, start)
+
+		s.bridge.cancel()
+		s.expect(t, 0, zmodemAbort)
+		// sz answers with its own cancel sequence
+		s.play(t, []zmodemStep{{lrzszCancel + "\r\n$ ", nil}})
+		if got, want := string(s.term), "$ sz big.iso\r\nrz\r\r\n$ "; got != want {
+			t.Errorf("terminal shows %q, want %q", got, want)
+		}
+		msgs := s.events(t)
+		if got, want := eventNames(msgs), "download,error,end"; got != want || msgs[1].Error != "cancelled" {
+			t.Fatalf("page got %+v", msgs)
+		}
+	})
+}
+
+func TestZModemRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  sessionOptions
+		start string
+		what  string
+	}{
+		{"download", sessionOptions{Operations: []string{opUpload}}, szStart, "downloads are"},
+		{"upload", sessionOptions{Operations: []string{opDownload}}, "rz waiting to receive." + zh(zframe{typ: zRInit}), "uploads are"},
+		{"read-only", sessionOptions{ReadOnly: true}, szStart, "downloads are"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newZModemSession(t, tt.opts)
+			s.play(t, []zmodemStep{{tt.start, zmodemAbort}, {"\r\n$ ", nil}})
+			want := "\r\n\x1b[1;33m[ZMODEM " + tt.what + " not available in this session]\x1b[0m\r\n$ "
+			if !strings.HasSuffix(string(s.term), want) {
+				t.Errorf("terminal shows %q, want it to end with %q", s.term, want)
+			}
+			if s.bridge.busy() {
+				t.Error("a refused transfer holds the terminal")
+			}
+		})
+	}
+}
+
+func TestZModemPassesOtherOutput(t *testing.T) {
+	s := newZModemSession(t, sessionOptions{})
+	in := []string{
+		"plain output\r\n",
+		"** bold ** and ***\r\n",
+		// Neither ZRQINIT nor ZRINIT
+		"**\x18B0400000000\r\n",
+		// The start split over reads, then not a transfer after all
+		"**\x18",
+		"Bx\r\n",
+		"*",
+		"*\x18B05\r\n$ ",
+	}
+	var got []byte
+	for _, p := range in {
+		got = append(got, s.bridge.output([]byte(p))...)
+	}
+	if want := strings.Join(in, ""); string(got) != want {
+		t.Errorf("terminal shows %q, want %q", got, want)
+	}
+	s.expect(t, 0, nil)
+	if msgs := s.events(t); len(msgs) > 0 {
+		t.Errorf("page got %+v", msgs)
+	}
+}
+
+// rawFakeConn is a connection with no page, like the gRPC API's
+type rawFakeConn struct {
+	*fakeConn
+}
+
+func (rawFakeConn) rawOutput() {}
+
+func TestZModemToggle(t *testing.T) {
+	newBridge := func(conn sshbridge.Conn) *zmodemBridge {
+		return newZModemBridge(requestMeta{Log: discardLogger}, "web01", "deploy", newTerminalWriter(conn), conn, &syncBuffer{}, sessionOptions{})
+	}
+	useConfig(t, "")
+	if newBridge(newFakeConn()) != nil {
+		t.Error("ZMODEM bridged with session.zmodem off")
+	}
+	useConfig(t, "session:\n  zmodem: true\n")
+	if newBridge(rawFakeConn{newFakeConn()}) != nil {
+		t.Error("ZMODEM bridged for a client without a page")
+	}
+
+	// A nil bridge leaves the output alone
+	var z *zmodemBridge
+	if got := string(z.output([]byte(szStart))); got != szStart || z.busy() {
+		t.Errorf("disabled bridge changed the output to %q", got)
+	}
+	z.cancel()
+	z.uploadChosen(sshbridge.ClientMessage{})
+}
+
+func TestZDecoder(t *testing.T) {
+	hdr := hexHeader(posFrame(zRPos, 0x12345678))
+	badHex := bytes.Clone(hdr)
+	badHex[6] = 'f'
+	data := append(binHeader(posFrame(zData, 0), false), subpacket([]byte{zDLE, 'x', 0x11}, zCRCE, false)...)
+	badData := bytes.Clone(data)
+	badData[len(badData)-1] ^= 1
+
+	tests := []struct {
+		name string
+		in   []byte
+		want []zevent
+	}{
+		{"hex header", hdr, []zevent{{kind: zevHeader, frame: posFrame(zRPos, 0x12345678)}}},
+		{"hex header with a bad CRC", badHex, []zevent{{kind: zevGarbled}}},
+		{"hex header with a bad digit", []byte("**\x18B0z"), []zevent{{kind: zevGarbled}}},
+		{"CRC-16 data", data, []zevent{
+			{kind: zevHeader, frame: posFrame(zData, 0)},
+			{kind: zevData, data: []byte{zDLE, 'x', 0x11}, end: zCRCE},
+		}},
+		{"data with a bad CRC", badData, []zevent{{kind: zevHeader, frame: posFrame(zData, 0)}, {kind: zevGarbled}}},
+		{"bad escape", append(binHeader(posFrame(zData, 0), true), zDLE, 'z'), []zevent{{kind: zevHeader, frame: posFrame(zData, 0)}, {kind: zevGarbled}}},
+		{"five CANs", []byte("\x18\x18\x18\x18\x18"), []zevent{{kind: zevCancel}}},
+		{"CANs inside a header", append(hdr[:8:8], "\x18\x18\x18\x18\x18"...), []zevent{{kind: zevGarbled}, {kind: zevCancel}}},
+		{"four CANs", []byte("\x18\x18\x18\x18*"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d zdecoder
+			var got []zevent
+			for _, b := range tt.in {
+				if ev, ok := d.next(b); ok {
+					got = append(got, ev)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].kind != tt.want[i].kind || got[i].frame != tt.want[i].frame || !bytes.Equal(got[i].data, tt.want[i].data) || got[i].end != tt.want[i].end {
+					t.Errorf("event %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gossh/internal/sshbridge"
+)
+
+const (
+	// zmodemTimeout ends a transfer the other side stopped answering
+	zmodemTimeout = 30 * time.Second
+	// zmodemMaxErrors is how many bad frames or retransmissions a transfer
+	// survives
+	zmodemMaxErrors = 10
+	// zmodemSubpacketSize is the data sent in each subpacket of an upload
+	zmodemSubpacketSize = 1024
+)
+
+// protocolZModem marks the audit events of ZMODEM transfers
+const protocolZModem = "zmodem"
+
+// States of a zmodemBridge
+const (
+	zmIdle = iota
+	// zmStart: the first header of rz or sz is being read
+	zmStart
+	// zmReceive: sz on the host is sending, to the page
+	zmReceive
+	// zmFinish: sz's ZFIN has been answered; its "OO" is left
+	zmFinish
+	// zmChoose: rz on the host waits for the user to pick a file
+	zmChoose
+	// zmSend: the file is going to rz
+	zmSend
+	// zmSendFin: our ZFIN has been sent, waiting for rz's
+	zmSendFin
+)
+
+// zmodemBridge watches a session's output for rz and sz starting, and runs
+// the other end of the transfer: a file sz sends is passed to the page as a
+// download, and rz gets a file the user picks in the page. The terminal
+// output is held back meanwhile. A nil bridge passes everything through.
+type zmodemBridge struct {
+	meta     requestMeta
+	host     string
+	sshUser  string
+	out      *wsWriter
+	stdin    io.Writer
+	download bool // whether sz may send to the page
+	upload   bool // whether rz may get files from the page
+	quotas   []quotaSubject
+
+	mu      sync.Mutex
+	state   int
+	matched int // bytes of zmodemStart matched, while idle
+	dec     zdecoder
+	errors  int
+	timer   *time.Timer
+	// echo is terminal output of the bridge's own, such as a refusal
+	echo []byte
+	// crc32 is set when rz checks CRC-32 frames
+	crc32 bool
+
+	// The file being transferred
+	name    string
+	size    int64
+	pos     int64 // bytes received, or sent
+	sum     string
+	started time.Time
+	// expect is the frame the next data subpacket belongs to
+	expect byte
+	// skip drops received data until a ZDATA at pos, after an error
+	skip   bool
+	hasher hash.Hash
+	chunk  []byte // received data not passed to the page yet
+	mirror *transferMirror
+	file   []byte // the file the user picked for rz
+	// zfile is the ZFILE frame offering file, sent again should rz ask
+	zfile     []byte
+	streaming bool
+	rpos      int64 // where rz last asked the upload to resume
+	oo        int   // how much of sz's "OO" has been read
+	// drain holds bytes dropped after a transfer, until another arrives:
+	// the rest of the host's cancel sequence, or the end of the last
+	// header
+	drain string
+
+	// gen changes when the transfer ends or rz asks to resend from
+	// elsewhere, which stops the writer of the upload
+	gen atomic.Int64
+	// writeMu keeps frames to stdin whole
+	writeMu sync.Mutex
+}
+
+// newZModemBridge returns the bridge of a session, or nil when ZMODEM
+// support is off or the client has no page to pass files to
+func newZModemBridge(meta requestMeta, host, sshUser string, out *wsWriter, conn sshbridge.Conn, stdin io.Writer, opts sessionOptions) *zmodemBridge {
+	if !currentConfig().Session.ZModem {
+		return nil
+	}
+	if _, ok := conn.(rawOutputConn); ok {
+		return nil
+	}
+	download, upload := terminalTransfers(opts)
+	return &zmodemBridge{
+		meta:     meta,
+		host:     host,
+		sshUser:  sshUser,
+		out:      out,
+		stdin:    stdin,
+		download: download,
+		upload:   upload,
+		quotas:   opts.Quotas,
+	}
+}
+
+// output takes the session's output and returns what is for the terminal
+func (z *zmodemBridge) output(p []byte) []byte {
+	if z == nil {
+		return p
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.state == zmIdle && z.matched == 0 && z.drain == "" && bytes.IndexByte(p, zPad) < 0 {
+		return p
+	}
+	if z.state != zmIdle && z.state != zmChoose {
+		z.deadline(zmodemTimeout)
+	}
+
+	term := make([]byte, 0, len(p))
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if z.drain != "" {
+			if strings.IndexByte(z.drain, b) >= 0 {
+				continue
+			}
+			z.drain = ""
+		}
+		switch z.state {
+		case zmIdle:
+			if z.matched < len(zmodemStart) {
+				if b == zmodemStart[z.matched] {
+					z.matched++
+					continue
+				}
+				if b == zPad && z.matched == 2 {
+					// A longer run of pads: the first is text
+					term = append(term, zPad)
+					continue
+				}
+				if z.matched > 0 {
+					// Not a transfer: let it through and look at b again
+					term = append(term, zmodemStart[:z.matched]...)
+					z.matched = 0
+					i--
+					continue
+				}
+				term = append(term, b)
+				continue
+			}
+			z.matched = 0
+			if b != '0'+zRQInit && b != '0'+zRInit {
+				term = append(term, zmodemStart...)
+				i--
+				continue
+			}
+			z.state, z.dec = zmStart, zdecoder{}
+			for _, c := range []byte(zmodemStart) {
+				z.dec.next(c)
+			}
+			z.dec.next(b)
+
+		case zmFinish:
+			// sz ends with "OO"; anything else is the shell again
+			if b == 'O' {
+				if z.oo++; z.oo == 2 {
+					z.end()
+				}
+				continue
+			}
+			z.end()
+			i--
+
+		default:
+			if ev, ok := z.dec.next(b); ok {
+				z.handle(ev)
+			}
+		}
+		if z.echo != nil {
+			term = append(term, z.echo...)
+			z.echo = nil
+		}
+	}
+	return term
+}
+
+// handle acts on a frame from the host. The caller holds mu.
+func (z *zmodemBridge) handle(ev zevent) {
+	switch ev.kind {
+	case zevCancel:
+		z.fail(errors.New("cancelled on the host"), false)
+		return
+	case zevGarbled:
+		if z.state == zmStart {
+			// Not a transfer after all
+			z.end()
+			return
+		}
+		z.errors++
+		if z.errors > zmodemMaxErrors {
+			z.fail(errors.New("too many errors"), true)
+			return
+		}
+		if z.state == zmReceive {
+			if z.name != "" {
+				// Ask for the data again from what arrived intact
+				z.skip = true
+				z.write(hexHeader(posFrame(zRPos, z.pos)))
+			} else {
+				z.write(hexHeader(zframe{typ: zNak}))
+			}
+		}
+		return
+	}
+
+	switch z.state {
+	case zmStart:
+		z.begin(ev.frame)
+	case zmReceive:
+		z.receive(ev)
+	default:
+		if ev.kind == zevHeader {
+			z.sendHandle(ev.frame)
+		}
+	}
+}
+
+// begin starts a transfer on the first header of sz (ZRQINIT) or rz
+// (ZRINIT). The caller holds mu.
+func (z *zmodemBridge) begin(f zframe) {
+	z.errors = 0
+	switch f.typ {
+	case zRQInit:
+		if !z.download {
+			z.refuse("downloads")
+			return
+		}
+		z.state = zmReceive
+		z.meta.Log.Debug("ZMODEM transfer started", "direction", "download")
+		z.write(z.rinit())
+	case zRInit:
+		if !z.upload {
+			z.refuse("uploads")
+			return
+		}
+		z.state = zmChoose
+		z.crc32 = f.flags()&zCanFC32 != 0
+		z.meta.Log.Debug("ZMODEM transfer started", "direction", "upload")
+		z.notify(sshbridge.TransferMessage{Event: "upload_request"})
+		z.deadline(terminalTransferChooseTimeout)
+	default:
+		z.end()
+	}
+}
+
+// refuse cancels a transfer the session may not make. The caller holds mu.
+func (z *zmodemBridge) refuse(what string) {
+	z.write(zmodemAbort)
+	z.echo = fmt.Appendf(nil, "\r\n\x1b[1;33m[ZMODEM %s are not available in this session]\x1b[0m\r\n", what)
+	z.meta.Log.Info("Refused ZMODEM transfer", "direction", strings.TrimSuffix(what, "s"))
+	z.end()
+	z.drain = hexHeaderEnd
+}
+
+// rinit is the ZRINIT of the receiving end: full duplex, streaming,
+// CRC-32
+func (z *zmodemBridge) rinit() []byte {
+	return hexHeader(zframe{typ: zRInit, arg: [4]byte{0, 0, 0, zCanFDX | zCanOVIO | zCanFC32}})
+}
+
+// receive handles the frames of sz. The caller holds mu.
+func (z *zmodemBridge) receive(ev zevent) {
+	if ev.kind == zevData {
+		z.receiveData(ev)
+		return
+	}
+	f := ev.frame
+	if f.carriesData() {
+		z.expect = f.typ
+	}
+	switch f.typ {
+	case zRQInit:
+		z.write(z.rinit())
+	case zData:
+		if z.name == "" {
+			return
+		}
+		z.skip = f.pos() != z.pos
+		if z.skip {
+			z.write(hexHeader(posFrame(zRPos, z.pos)))
+		}
+	case zEOF:
+		// An EOF anywhere but at the end of the data is from before a
+		// retransmission
+		if z.name == "" || f.pos() != z.pos {
+			return
+		}
+		z.finishDownload()
+		z.write(z.rinit())
+	case zFin:
+		z.write(hexHeader(zframe{typ: zFin}))
+		z.state, z.oo, z.drain = zmFinish, 0, hexHeaderEnd
+		z.stopTimer()
+	case zCommand:
+		z.fail(errors.New("the host asked to run a command, which is never done"), true)
+	case zAbort, zFErr:
+		z.fail(errors.New("aborted on the host"), true)
+	}
+}
+
+// receiveData handles a data subpacket of sz. The caller holds mu.
+func (z *zmodemBridge) receiveData(ev zevent) {
+	switch z.expect {
+	case zSInit:
+		z.write(hexHeader(zframe{typ: zAck}))
+	case zFile:
+		if z.name != "" {
+			return
+		}
+		name, size := parseZFile(ev.data)
+		if name == "" {
+			z.fail(errors.New("the host sent no file name"), true)
+			return
+		}
+		z.name, z.size, z.pos, z.skip = name, size, 0, false
+		z.hasher, z.started = sha256.New(), time.Now()
+		if err := quotas.check(z.quotas); err != nil {
+			z.fail(err, true)
+			return
+		}
+		if err := z.startMirror(auditDownload, nil); err != nil {
+			z.fail(err, true)
+			return
+		}
+		z.meta.Log.Info("ZMODEM download started", "file", name, "size", size)
+		z.notify(sshbridge.TransferMessage{Event: "download", Filename: name, Size: size})
+		z.write(hexHeader(posFrame(zRPos, 0)))
+	case zData:
+		if z.name == "" || z.skip {
+			return
+		}
+		if _, err := z.mirror.Write(ev.data); err != nil {
+			z.fail(err, true)
+			return
+		}
+		z.pos += int64(len(ev.data))
+		z.hasher.Write(ev.data)
+		z.chunk = append(z.chunk, ev.data...)
+		if len(z.chunk) >= terminalTransferChunk {
+			z.flush()
+		}
+		if err := quotas.charge(z.quotas, int64(len(ev.data)), z.meta, opDownload); err != nil {
+			z.fail(err, true)
+			return
+		}
+		if ev.end == zCRCQ || ev.end == zCRCW {
+			z.write(hexHeader(posFrame(zAck, z.pos)))
+		}
+	}
+}
+
+// flush passes received data on to the page. The caller holds mu.
+func (z *zmodemBridge) flush() {
+	if len(z.chunk) == 0 {
+		return
+	}
+	z.notify(sshbridge.TransferMessage{Event: "data", Data: base64.StdEncoding.EncodeToString(z.chunk)})
+	z.chunk = z.chunk[:0]
+}
+
+// finishDownload tells the page the file is complete. The caller holds mu.
+func (z *zmodemBridge) finishDownload() {
+	z.flush()
+	z.sum = hex.EncodeToString(z.hasher.Sum(nil))
+	z.notify(sshbridge.TransferMessage{Event: "download_end", Filename: z.name, Size: z.pos, SHA256: z.sum})
+	z.meta.Log.Info("ZMODEM download finished", "file", z.name, "size", z.pos, "duration", time.Since(z.started))
+	z.audit(auditDownload, nil)
+	z.name = ""
+}
+
+// parseZFile reads the file information of a ZFILE: the name, a NUL, and
+// the size, modification time and more, separated by spaces. Only the
+// base name is kept.
+func parseZFile(p []byte) (string, int64) {
+	name, rest, _ := bytes.Cut(p, []byte{0})
+	var size int64
+	if fields := strings.Fields(string(bytes.TrimRight(rest, "\x00"))); len(fields) > 0 {
+		size, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	return transferFileName(string(name)), size
+}
+
+// uploadChosen offers rz the file the user picked
+func (z *zmodemBridge) uploadChosen(msg sshbridge.ClientMessage) {
+	if z == nil {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.state != zmChoose {
+		return
+	}
+	name, data, err := chosenFile(msg)
+	if err != nil {
+		z.fail(err, true)
+		return
+	}
+	if err := z.out.mem.holdTransfer(len(data)); err != nil {
+		z.fail(err, true)
+		return
+	}
+	z.name, z.size, z.file, z.pos = name, int64(len(data)), data, 0
+	z.started, z.streaming = time.Now(), false
+	sum := sha256.Sum256(data)
+	z.sum = hex.EncodeToString(sum[:])
+	if err := quotas.check(z.quotas); err != nil {
+		z.fail(err, true)
+		return
+	}
+	if err := z.startMirror(auditUpload, data); err != nil {
+		z.fail(err, true)
+		return
+	}
+
+	z.state = zmSend
+	z.meta.Log.Info("ZMODEM upload started", "file", name, "size", z.size)
+	info := fmt.Sprintf("%s\x00%d %o %o 0 1 %d\x00", name, z.size, time.Now().Unix(), 0100644, z.size)
+	z.zfile = append(binHeader(zframe{typ: zFile}, z.crc32), subpacket([]byte(info), zCRCW, z.crc32)...)
+	z.write(z.zfile)
+	z.deadline(zmodemTimeout)
+}
+
+// sendHandle handles the headers of rz. The caller holds mu.
+func (z *zmodemBridge) sendHandle(f zframe) {
+	switch f.typ {
+	case zRInit:
+		switch {
+		case z.state == zmSend && !z.streaming:
+			// rz didn't get the ZFILE
+			z.write(z.zfile)
+		case z.state == zmSend && z.pos >= z.size:
+			z.notify(sshbridge.TransferMessage{Event: "upload_end", Filename: z.name, Size: z.size, SHA256: z.sum})
+			z.meta.Log.Info("ZMODEM upload finished", "file", z.name, "size", z.size, "duration", time.Since(z.started))
+			z.audit(auditUpload, nil)
+			z.name = ""
+			z.gen.Add(1)
+			z.state = zmSendFin
+			z.write(hexHeader(zframe{typ: zFin}))
+		case z.state == zmSendFin:
+			z.write(hexHeader(zframe{typ: zFin}))
+		}
+	case zRPos:
+		if z.state != zmSend {
+			return
+		}
+		// Like lrzsz, only give up when rz keeps asking for the same
+		// position
+		if z.streaming && f.pos() == z.rpos {
+			z.errors++
+			if z.errors > zmodemMaxErrors {
+				z.fail(errors.New("too many retransmissions"), true)
+				return
+			}
+		} else {
+			z.errors = 0
+		}
+		z.streaming, z.rpos = true, f.pos()
+		gen := z.gen.Add(1)
+		go z.stream(gen, z.file, min(f.pos(), z.size), z.crc32)
+	case zCRC:
+		if z.state == zmSend {
+			z.write(hexHeader(posFrame(zCRC, int64(crc32.ChecksumIEEE(z.file)))))
+		}
+	case zNak:
+		if z.state == zmSend && !z.streaming {
+			z.write(z.zfile)
+		}
+	case zSkip:
+		if z.state == zmSend {
+			z.fail(errors.New("the host skipped the file"), true)
+		}
+	case zFin:
+		if z.state == zmSendFin {
+			z.write([]byte("OO"))
+			z.end()
+			z.drain = hexHeaderEnd
+		}
+	case zAbort, zFErr:
+		z.fail(errors.New("aborted on the host"), true)
+	}
+}
+
+// stream sends file from pos to rz, until it is done or gen changes
+func (z *zmodemBridge) stream(gen int64, file []byte, pos int64, crc32ok bool) {
+	size := int64(len(file))
+	if !z.writeFrame(gen, binHeader(posFrame(zData, pos), crc32ok)) {
+		return
+	}
+	if size == 0 {
+		z.writeFrame(gen, subpacket(nil, zCRCE, crc32ok))
+	}
+	reported := pos
+	for pos < size {
+		n := min(int64(zmodemSubpacketSize), size-pos)
+		end := byte(zCRCG)
+		if pos+n == size {
+			end = zCRCE
+		}
+		if !z.writeFrame(gen, subpacket(file[pos:pos+n], end, crc32ok)) {
+			return
+		}
+		pos += n
+
+		z.mu.Lock()
+		if z.gen.Load() != gen {
+			z.mu.Unlock()
+			return
+		}
+		z.deadline(zmodemTimeout)
+		if pos > z.pos {
+			err := quotas.charge(z.quotas, pos-z.pos, z.meta, opUpload)
+			z.pos = pos
+			if err != nil {
+				z.fail(err, true)
+				z.mu.Unlock()
+				return
+			}
+		}
+		if pos-reported >= terminalTransferChunk || pos == size {
+			reported = pos
+			z.notify(sshbridge.TransferMessage{Event: "progress", Filename: z.name, Size: size, Bytes: pos})
+		}
+		z.mu.Unlock()
+	}
+	z.writeFrame(gen, binHeader(posFrame(zEOF, size), crc32ok))
+}
+
+// writeFrame writes a frame of the upload unless it was stopped
+func (z *zmodemBridge) writeFrame(gen int64, frame []byte) bool {
+	z.writeMu.Lock()
+	defer z.writeMu.Unlock()
+	if z.gen.Load() != gen {
+		return false
+	}
+	if _, err := z.stdin.Write(frame); err != nil {
+		z.meta.Log.Warn("Failed to send ZMODEM data", "err", err)
+		return false
+	}
+	return true
+}
+
+// write sends a frame of the conversation to the host
+func (z *zmodemBridge) write(frame []byte) {
+	z.writeMu.Lock()
+	defer z.writeMu.Unlock()
+	if _, err := z.stdin.Write(frame); err != nil {
+		z.meta.Log.Warn("Failed to send ZMODEM frame", "err", err)
+	}
+}
+
+// cancel stops the transfer at the user's request
+func (z *zmodemBridge) cancel() {
+	if z == nil {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.state != zmIdle {
+		z.fail(errors.New("cancelled"), true)
+	}
+}
+
+// busy tells whether a transfer holds the terminal, which ignores typing
+// meanwhile
+func (z *zmodemBridge) busy() bool {
+	if z == nil {
+		return false
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.state != zmIdle
+}
+
+// fail ends the transfer, telling the host to stop as well unless it
+// cancelled itself. The caller holds mu.
+func (z *zmodemBridge) fail(err error, abort bool) {
+	if abort {
+		z.gen.Add(1)
+		z.write(zmodemAbort)
+	}
+	z.meta.Log.Warn("ZMODEM transfer failed", "file", z.name, "err", err)
+	if z.name != "" {
+		event := auditUpload
+		if z.state == zmReceive {
+			event = auditDownload
+		}
+		z.audit(event, err)
+	}
+	z.notify(sshbridge.TransferMessage{Event: "error", Filename: z.name, Error: err.Error()})
+	z.end()
+	// The rest of either side's run of CANs and backspaces
+	z.drain = "\x18\b"
+}
+
+// end gives the terminal back. The caller holds mu.
+func (z *zmodemBridge) end() {
+	z.gen.Add(1)
+	z.stopTimer()
+	if z.state != zmIdle && z.state != zmStart {
+		z.notify(sshbridge.TransferMessage{Event: "end"})
+	}
+	z.state, z.matched, z.dec = zmIdle, 0, zdecoder{}
+	z.out.mem.releaseTransfer(len(z.file))
+	z.name, z.file, z.zfile, z.chunk, z.hasher = "", nil, nil, nil, nil
+}
+
+// deadline (re)starts the timer that ends a stalled transfer. The caller
+// holds mu.
+func (z *zmodemBridge) deadline(d time.Duration) {
+	if z.timer != nil {
+		z.timer.Reset(d)
+		return
+	}
+	z.timer = time.AfterFunc(d, func() {
+		z.mu.Lock()
+		defer z.mu.Unlock()
+		if z.state != zmIdle {
+			z.fail(errors.New("timed out"), true)
+		}
+	})
+}
+
+func (z *zmodemBridge) stopTimer() {
+	if z.timer != nil {
+		z.timer.Stop()
+	}
+}
+
+func (z *zmodemBridge) notify(msg sshbridge.TransferMessage) {
+	msg.Type = protocolZModem
+	z.out.WriteJSON(msg)
+}
+
+// audit records a transfer that ended, or failed, with the bytes moved
+// startMirror begins the copy of the file being transferred, data when
+// uploading. The caller holds mu.
+func (z *zmodemBridge) startMirror(direction string, data []byte) error {
+	m, err := startMirror(mirrorRecord{
+		Direction: direction,
+		Protocol:  protocolZModem,
+		User:      z.meta.User,
+		ClientIP:  z.meta.ClientIP,
+		Session:   mirrorSession(z.meta, nil),
+		Filename:  z.name,
+	})
+	if err == nil {
+		_, err = m.Write(data)
+	}
+	z.mirror = m
+	return err
+}
+
+func (z *zmodemBridge) audit(event string, err error) {
+	host := mirrorHost{Host: z.host, SSHUser: z.sshUser, Path: z.name, Success: err == nil, Error: errorString(err)}
+	if mirrorErr := z.mirror.finish([]mirrorHost{host}, err); err == nil {
+		err = mirrorErr
+	}
+	z.mirror = nil
+	e := AuditEvent{
+		Event:    event,
+		Outcome:  outcomeOf(err),
+		ClientIP: z.meta.ClientIP,
+		User:     z.meta.User,
+		Host:     z.host,
+		SSHUser:  z.sshUser,
+		Protocol: protocolZModem,
+		Path:     z.name,
+		Size:     z.pos,
+		Error:    errorString(err),
+	}
+	if err == nil {
+		e.SHA256 = z.sum
+	}
+	audit.Emit(e)
+}